@@ -24,10 +24,21 @@ package alerts
  //
 
 
+// The state transitions recorded in the alert history
+const (
+	ALERT_RAISED = "raised"
+	ALERT_UPDATED = "updated"
+	ALERT_ACKNOWLEDGED = "acknowledged"
+	ALERT_CLEARED = "cleared"
+)
+
 type Alert struct {
 	Key string `json:"key"`
 	Level string `json:"level"`
 	Timestamp uint64 `json:"timestamp"`
 	Metadata interface{} `json:"metadata"`
 	Status bool `json:"status"`
+	// Set once an operator has acknowledged a firing alert. It is
+	// reset when the alert is raised again
+	Acknowledged bool `json:"acknowledged,omitempty"`
 }
\ No newline at end of file
@@ -25,23 +25,57 @@ package alerts
 
 
 import (
+	"bytes"
+	"encoding/json"
 	"sync"
+	"time"
+
+	. "github.com/armPelionEdge/devicedb/error"
+	. "github.com/armPelionEdge/devicedb/historian"
 )
 
 type AlertStore interface {
 	Put(alert Alert) error
+	Lookup(key string) (*Alert, error)
 	DeleteAll(alerts map[string]Alert) error
 	ForEach(func(alert Alert)) error
 }
 
+// AlertMap holds the alerts waiting to be forwarded to the cloud. An
+// alert map created by NewAlertLifecycleMap also remembers the state of
+// every alert so it can record state transitions in an alert history,
+// let alerts be acknowledged and drop duplicate reports
 type AlertMap struct {
 	mu sync.Mutex
 	alertStore AlertStore
+	// The latest state of every alert. Unlike alertStore, alerts are
+	// not removed from it once they have been forwarded
+	stateStore AlertStore
+	history *Historian
+	// Reports of an alert that change none of its status, level and
+	// metadata within this many milliseconds of the last one are dropped,
+	// and changes to an alert are held back from forwarding for this long
+	// so the changes of a flapping alert are forwarded together
+	dedupWindow uint64
+	// When the first change to each alert that has not been forwarded
+	// yet was recorded, in milliseconds of the local clock
+	pendingSince map[string]uint64
 }
 
 func NewAlertMap(alertStore AlertStore) *AlertMap {
 	return &AlertMap{
 		alertStore: alertStore,
+		pendingSince: make(map[string]uint64),
+	}
+}
+
+func NewAlertLifecycleMap(alertStore AlertStore, stateStore AlertStore, history *Historian, dedupWindow uint64) *AlertMap {
+	return &AlertMap{
+		alertStore: alertStore,
+		stateStore: stateStore,
+		history: history,
+		dedupWindow: dedupWindow,
+		pendingSince: make(map[string]uint64),
 	}
 }
 
@@ -49,7 +83,222 @@ func (alertMap *AlertMap) UpdateAlert(alert Alert) error {
 	alertMap.mu.Lock()
 	defer alertMap.mu.Unlock()
 
-	return alertMap.alertStore.Put(alert)
+	return alertMap.updateAlert(alert)
+}
+
+func (alertMap *AlertMap) updateAlert(alert Alert) error {
+	if alertMap.stateStore == nil {
+		return alertMap.queueAlert(alert)
+	}
+
+	previous, err := alertMap.stateStore.Lookup(alert.Key)
+
+	if err != nil {
+		return err
+	}
+
+	transition := ALERT_UPDATED
+	alert.Acknowledged = false
+
+	if alert.Status && (previous == nil || !previous.Status) {
+		transition = ALERT_RAISED
+	} else if !alert.Status && previous != nil && previous.Status {
+		transition = ALERT_CLEARED
+	} else if previous != nil {
+		if alert.Timestamp < previous.Timestamp + alertMap.dedupWindow && sameAlertState(*previous, alert) {
+			return nil
+		}
+
+		alert.Acknowledged = previous.Acknowledged
+	}
+
+	if err := alertMap.recordTransition(transition, alert); err != nil {
+		return err
+	}
+
+	// An acknowledged alert is silenced until it clears
+	if alert.Acknowledged {
+		return nil
+	}
+
+	return alertMap.queueAlert(alert)
+}
+
+// queueAlert stores an alert until it is forwarded. Must be called with
+// the lock held
+func (alertMap *AlertMap) queueAlert(alert Alert) error {
+	if err := alertMap.alertStore.Put(alert); err != nil {
+		return err
+	}
+
+	if _, ok := alertMap.pendingSince[alert.Key]; !ok {
+		alertMap.pendingSince[alert.Key] = uint64(time.Now().UnixNano()) / 1000000
+	}
+
+	return nil
+}
+
+// ClearAlert clears a firing alert, keeping its level and metadata. It
+// returns EAlertDoesNotExist if the alert is not firing
+func (alertMap *AlertMap) ClearAlert(key string, timestamp uint64) error {
+	alertMap.mu.Lock()
+	defer alertMap.mu.Unlock()
+
+	if alertMap.stateStore == nil {
+		return EAlertDoesNotExist
+	}
+
+	alert, err := alertMap.stateStore.Lookup(key)
+
+	if err != nil {
+		return err
+	}
+
+	if alert == nil || !alert.Status {
+		return EAlertDoesNotExist
+	}
+
+	alert.Status = false
+	alert.Timestamp = timestamp
+
+	return alertMap.updateAlert(*alert)
+}
+
+// Alert returns the latest state of an alert, or nil if it was never
+// reported
+func (alertMap *AlertMap) Alert(key string) (*Alert, error) {
+	alertMap.mu.Lock()
+	defer alertMap.mu.Unlock()
+
+	if alertMap.stateStore == nil {
+		return nil, nil
+	}
+
+	return alertMap.stateStore.Lookup(key)
+}
+
+// CurrentAlerts returns the alerts that are firing. If levels is not
+// empty only alerts at one of those levels are returned
+func (alertMap *AlertMap) CurrentAlerts(levels []string) ([]Alert, error) {
+	var alerts []Alert = make([]Alert, 0)
+
+	if alertMap.stateStore == nil {
+		return alerts, nil
+	}
+
+	err := alertMap.stateStore.ForEach(func(alert Alert) {
+		if !alert.Status {
+			return
+		}
+
+		if len(levels) != 0 && !containsString(levels, alert.Level) {
+			return
+		}
+
+		alerts = append(alerts, alert)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return alerts, nil
+}
+
+// sameAlertState reports whether two reports of an alert have the same
+// level, status and metadata. The metadata of a stored alert was decoded
+// from JSON so both are compared in their encoded form
+func sameAlertState(a Alert, b Alert) bool {
+	if a.Level != b.Level || a.Status != b.Status {
+		return false
+	}
+
+	aMetadata, aErr := json.Marshal(a.Metadata)
+	bMetadata, bErr := json.Marshal(b.Metadata)
+
+	return aErr == nil && bErr == nil && bytes.Equal(aMetadata, bMetadata)
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AcknowledgeAlert marks a firing alert as acknowledged. Further updates
+// to the alert are recorded in the alert history but not forwarded
+// until it clears. It returns EAlertDoesNotExist if the alert is not
+// firing
+func (alertMap *AlertMap) AcknowledgeAlert(key string, timestamp uint64) error {
+	alertMap.mu.Lock()
+	defer alertMap.mu.Unlock()
+
+	if alertMap.stateStore == nil {
+		return EAlertDoesNotExist
+	}
+
+	alert, err := alertMap.stateStore.Lookup(key)
+
+	if err != nil {
+		return err
+	}
+
+	if alert == nil || !alert.Status {
+		return EAlertDoesNotExist
+	}
+
+	if alert.Acknowledged {
+		return nil
+	}
+
+	alert.Acknowledged = true
+	alert.Timestamp = timestamp
+
+	if err := alertMap.recordTransition(ALERT_ACKNOWLEDGED, *alert); err != nil {
+		return err
+	}
+
+	// The acknowledgement is forwarded so the cloud knows the alert
+	// has been seen to
+	return alertMap.queueAlert(*alert)
+}
+
+func (alertMap *AlertMap) recordTransition(transition string, alert Alert) error {
+	if err := alertMap.stateStore.Put(alert); err != nil {
+		return err
+	}
+
+	if alertMap.history == nil {
+		return nil
+	}
+
+	encodedAlert, err := json.Marshal(alert)
+
+	if err != nil {
+		return err
+	}
+
+	return alertMap.history.LogEvent(&Event{
+		Timestamp: alert.Timestamp,
+		SourceID: alert.Key,
+		Type: transition,
+		Data: string(encodedAlert),
+	})
+}
+
+// History returns the state transitions recorded for alerts. Each event
+// has the alert key as its source, the transition as its type and the
+// alert encoded as JSON as its data
+func (alertMap *AlertMap) History(query *HistoryQuery) (*EventIterator, error) {
+	if alertMap.history == nil {
+		return nil, EStorage
+	}
+
+	return alertMap.history.Query(query)
 }
 
 func (alertMap *AlertMap) GetAlerts() (map[string]Alert, error) {
@@ -66,6 +315,37 @@ func (alertMap *AlertMap) GetAlerts() (map[string]Alert, error) {
 	return alerts, nil
 }
 
+// ForwardableAlerts returns the alerts that are ready to be forwarded
+// at time now, in milliseconds of the local clock. An alert is held back
+// until the dedup window has passed since the first change to it that
+// has not been forwarded yet, however often it changes in the meantime
+func (alertMap *AlertMap) ForwardableAlerts(now uint64) (map[string]Alert, error) {
+	alertMap.mu.Lock()
+	defer alertMap.mu.Unlock()
+
+	alerts, err := alertMap.GetAlerts()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for key, _ := range alerts {
+		since, ok := alertMap.pendingSince[key]
+
+		if !ok {
+			// The alert was stored before a restart. Its window starts now
+			since = now
+			alertMap.pendingSince[key] = now
+		}
+
+		if since + alertMap.dedupWindow > now {
+			delete(alerts, key)
+		}
+	}
+
+	return alerts, nil
+}
+
 // Blocks calls to UpdateAlert()
 func (alertMap *AlertMap) ClearAlerts(alerts map[string]Alert) error {
 	alertMap.mu.Lock()
@@ -89,5 +369,18 @@ func (alertMap *AlertMap) ClearAlerts(alerts map[string]Alert) error {
 		return err
 	}
 
-	return alertMap.alertStore.DeleteAll(deleteAlerts)
+	if err := alertMap.alertStore.DeleteAll(deleteAlerts); err != nil {
+		return err
+	}
+
+	for key, _ := range alerts {
+		if _, ok := deleteAlerts[key]; ok {
+			delete(alertMap.pendingSince, key)
+		} else {
+			// The change made since reading has not been forwarded yet
+			alertMap.pendingSince[key] = uint64(time.Now().UnixNano()) / 1000000
+		}
+	}
+
+	return nil
 }
\ No newline at end of file
@@ -26,11 +26,16 @@ package alerts_test
 
 import (
 	"errors"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
 	. "github.com/armPelionEdge/devicedb/alerts"
+	. "github.com/armPelionEdge/devicedb/error"
+	. "github.com/armPelionEdge/devicedb/historian"
+	. "github.com/armPelionEdge/devicedb/storage"
+	. "github.com/armPelionEdge/devicedb/util"
 )
 
 var _ = Describe("AlertMap", func() {
@@ -172,3 +177,171 @@ var _ = Describe("AlertMap", func() {
 		})
 	})
 })
+
+var _ = Describe("AlertMap lifecycle", func() {
+	var alertMap *AlertMap
+	var alertStore *MockAlertStore
+	var stateStore *MockAlertStore
+	var storageEngine StorageDriver
+	var history *Historian
+
+	BeforeEach(func() {
+		alertStore = NewMockAlertStore()
+		stateStore = NewMockAlertStore()
+		storageEngine = MakeNewStorageDriver()
+		storageEngine.Open()
+		history = NewHistorian(storageEngine, 0, 0, 1000)
+		alertMap = NewAlertLifecycleMap(alertStore, stateStore, history, 1000)
+	})
+
+	AfterEach(func() {
+		storageEngine.Close()
+	})
+
+	transitions := func(key string) []string {
+		iter, err := alertMap.History(&HistoryQuery{ Sources: []string{ key } })
+
+		Expect(err).Should(BeNil())
+
+		defer iter.Release()
+
+		var result []string
+
+		for iter.Next() {
+			result = append(result, iter.Event().Type)
+		}
+
+		return result
+	}
+
+	It("Should record each state transition in the alert history", func() {
+		Expect(alertMap.UpdateAlert(Alert{ Key: "abc", Level: "warning", Timestamp: 1000, Status: true })).Should(BeNil())
+		Expect(alertMap.UpdateAlert(Alert{ Key: "abc", Level: "critical", Timestamp: 2000, Status: true })).Should(BeNil())
+		Expect(alertMap.AcknowledgeAlert("abc", 3000)).Should(BeNil())
+		Expect(alertMap.UpdateAlert(Alert{ Key: "abc", Level: "critical", Timestamp: 5000, Status: false })).Should(BeNil())
+
+		Expect(transitions("abc")).Should(Equal([]string{ ALERT_RAISED, ALERT_UPDATED, ALERT_ACKNOWLEDGED, ALERT_CLEARED }))
+		Expect(stateStore.Get("abc").Status).Should(BeFalse())
+	})
+
+	It("Should forward the acknowledgement but silence updates to an acknowledged alert until it clears", func() {
+		Expect(alertMap.UpdateAlert(Alert{ Key: "abc", Level: "warning", Timestamp: 1000, Status: true })).Should(BeNil())
+		Expect(alertMap.AcknowledgeAlert("abc", 2000)).Should(BeNil())
+		Expect(alertStore.Get("abc").Acknowledged).Should(BeTrue())
+		Expect(alertStore.Get("abc").Timestamp).Should(Equal(uint64(2000)))
+
+		Expect(alertMap.UpdateAlert(Alert{ Key: "abc", Level: "critical", Timestamp: 3000, Status: true })).Should(BeNil())
+		Expect(alertStore.Get("abc").Timestamp).Should(Equal(uint64(2000)))
+		Expect(stateStore.Get("abc").Level).Should(Equal("critical"))
+		Expect(stateStore.Get("abc").Acknowledged).Should(BeTrue())
+
+		Expect(alertMap.UpdateAlert(Alert{ Key: "abc", Level: "critical", Timestamp: 4000, Status: false })).Should(BeNil())
+		Expect(alertStore.Get("abc").Status).Should(BeFalse())
+
+		// Raising it again needs a new acknowledgement
+		Expect(alertMap.UpdateAlert(Alert{ Key: "abc", Level: "critical", Timestamp: 5000, Status: true })).Should(BeNil())
+		Expect(alertStore.Get("abc").Acknowledged).Should(BeFalse())
+	})
+
+	It("Should refuse to acknowledge an alert that is not firing", func() {
+		Expect(alertMap.AcknowledgeAlert("abc", 1000)).Should(Equal(EAlertDoesNotExist))
+
+		Expect(alertMap.UpdateAlert(Alert{ Key: "abc", Timestamp: 1000, Status: false })).Should(BeNil())
+		Expect(alertMap.AcknowledgeAlert("abc", 2000)).Should(Equal(EAlertDoesNotExist))
+	})
+
+	It("Should drop reports that change nothing within the dedup window", func() {
+		Expect(alertMap.UpdateAlert(Alert{ Key: "abc", Level: "warning", Timestamp: 1000, Status: true })).Should(BeNil())
+		Expect(alertMap.UpdateAlert(Alert{ Key: "abc", Level: "warning", Timestamp: 1500, Status: true })).Should(BeNil())
+		Expect(alertStore.Get("abc").Timestamp).Should(Equal(uint64(1000)))
+
+		Expect(alertMap.UpdateAlert(Alert{ Key: "abc", Level: "warning", Timestamp: 2500, Status: true })).Should(BeNil())
+		Expect(alertStore.Get("abc").Timestamp).Should(Equal(uint64(2500)))
+		Expect(transitions("abc")).Should(Equal([]string{ ALERT_RAISED, ALERT_UPDATED }))
+	})
+
+	It("Should record reports that change the metadata of an alert within the dedup window", func() {
+		Expect(alertMap.UpdateAlert(Alert{ Key: "abc", Level: "warning", Timestamp: 1000, Metadata: map[string]interface{}{ "door": "open" }, Status: true })).Should(BeNil())
+		Expect(alertMap.UpdateAlert(Alert{ Key: "abc", Level: "warning", Timestamp: 1200, Metadata: map[string]interface{}{ "door": "open" }, Status: true })).Should(BeNil())
+		Expect(alertMap.UpdateAlert(Alert{ Key: "abc", Level: "warning", Timestamp: 1500, Metadata: map[string]interface{}{ "door": "ajar" }, Status: true })).Should(BeNil())
+		Expect(alertStore.Get("abc").Metadata).Should(Equal(map[string]interface{}{ "door": "ajar" }))
+		Expect(transitions("abc")).Should(Equal([]string{ ALERT_RAISED, ALERT_UPDATED }))
+	})
+
+	It("Should hold back changes to alerts for the dedup window from forwarding", func() {
+		start := uint64(time.Now().UnixNano()) / 1000000
+
+		Expect(alertMap.UpdateAlert(Alert{ Key: "abc", Timestamp: 1000, Status: true })).Should(BeNil())
+
+		alerts, err := alertMap.ForwardableAlerts(start)
+
+		Expect(err).Should(BeNil())
+		Expect(alerts).Should(BeEmpty())
+
+		alerts, err = alertMap.ForwardableAlerts(uint64(time.Now().UnixNano()) / 1000000 + 1000)
+
+		Expect(err).Should(BeNil())
+		Expect(alerts).Should(HaveLen(1))
+		Expect(alerts).Should(HaveKey("abc"))
+		Expect(alertMap.ClearAlerts(alerts)).Should(BeNil())
+
+		// A later change starts a new window
+		start = uint64(time.Now().UnixNano()) / 1000000
+
+		Expect(alertMap.UpdateAlert(Alert{ Key: "abc", Timestamp: 2000, Status: false })).Should(BeNil())
+
+		alerts, err = alertMap.ForwardableAlerts(start)
+
+		Expect(err).Should(BeNil())
+		Expect(alerts).Should(BeEmpty())
+	})
+
+	It("Should forward a flapping alert once the dedup window has passed since its first change", func() {
+		start := uint64(time.Now().UnixNano()) / 1000000
+
+		// The reported timestamps run far ahead of the local clock and
+		// the alert changes more often than the window
+		for i := 0; i < 5; i++ {
+			Expect(alertMap.UpdateAlert(Alert{ Key: "def", Timestamp: start + 1000000 + uint64(i) * 500, Status: i % 2 == 0 })).Should(BeNil())
+		}
+
+		alerts, err := alertMap.ForwardableAlerts(start)
+
+		Expect(err).Should(BeNil())
+		Expect(alerts).Should(BeEmpty())
+
+		alerts, err = alertMap.ForwardableAlerts(uint64(time.Now().UnixNano()) / 1000000 + 1000)
+
+		Expect(err).Should(BeNil())
+		Expect(alerts).Should(HaveLen(1))
+		Expect(alerts["def"].Status).Should(BeTrue())
+		Expect(alerts["def"].Timestamp).Should(Equal(start + 1002000))
+	})
+
+	It("Should clear a firing alert keeping its level and metadata", func() {
+		Expect(alertMap.ClearAlert("abc", 1000)).Should(Equal(EAlertDoesNotExist))
+
+		Expect(alertMap.UpdateAlert(Alert{ Key: "abc", Level: "warning", Timestamp: 1000, Metadata: "door open", Status: true })).Should(BeNil())
+		Expect(alertMap.ClearAlert("abc", 2000)).Should(BeNil())
+		Expect(alertStore.Get("abc")).Should(Equal(Alert{ Key: "abc", Level: "warning", Timestamp: 2000, Metadata: "door open", Status: false }))
+		Expect(transitions("abc")).Should(Equal([]string{ ALERT_RAISED, ALERT_CLEARED }))
+
+		Expect(alertMap.ClearAlert("abc", 3000)).Should(Equal(EAlertDoesNotExist))
+	})
+
+	It("Should list the firing alerts filtered by level", func() {
+		Expect(alertMap.UpdateAlert(Alert{ Key: "abc", Level: "warning", Timestamp: 1000, Status: true })).Should(BeNil())
+		Expect(alertMap.UpdateAlert(Alert{ Key: "def", Level: "critical", Timestamp: 1000, Status: true })).Should(BeNil())
+		Expect(alertMap.UpdateAlert(Alert{ Key: "ghi", Level: "critical", Timestamp: 1000, Status: false })).Should(BeNil())
+
+		alerts, err := alertMap.CurrentAlerts(nil)
+
+		Expect(err).Should(BeNil())
+		Expect(alerts).Should(HaveLen(2))
+
+		alerts, err = alertMap.CurrentAlerts([]string{ "critical" })
+
+		Expect(err).Should(BeNil())
+		Expect(alerts).Should(Equal([]Alert{ Alert{ Key: "def", Level: "critical", Timestamp: 1000, Status: true } }))
+	})
+})
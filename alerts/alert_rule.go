@@ -0,0 +1,220 @@
+package alerts
+//
+ // Copyright (c) 2019 ARM Limited.
+ //
+ // SPDX-License-Identifier: MIT
+ //
+ // Permission is hereby granted, free of charge, to any person obtaining a copy
+ // of this software and associated documentation files (the "Software"), to
+ // deal in the Software without restriction, including without limitation the
+ // rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ // sell copies of the Software, and to permit persons to whom the Software is
+ // furnished to do so, subject to the following conditions:
+ //
+ // The above copyright notice and this permission notice shall be included in all
+ // copies or substantial portions of the Software.
+ //
+ // THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ // IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ // FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ // AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ // LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ // SOFTWARE.
+ //
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	. "github.com/armPelionEdge/devicedb/data"
+	. "github.com/armPelionEdge/devicedb/historian"
+)
+
+// Alert rules are stored as JSON in the cloud bucket under this prefix.
+// The rest of the key is the rule ID
+const ALERT_RULE_PREFIX = "devicedb/alerts/rules/"
+
+// The bucket that holds the alert rules
+const ALERT_RULE_BUCKET = "cloud"
+
+// Alerts raised by a rule have keys starting with this prefix followed
+// by the rule ID
+const RULE_ALERT_PREFIX = "rule:"
+
+// The kinds of alert rule
+const (
+	// Raised while the numeric value of a key compares to a threshold
+	RULE_VALUE = "value"
+	// Raised while the number of conflicting siblings of a key compares
+	// to a threshold
+	RULE_CONFLICT = "conflict"
+	// Raised when no matching event was logged to the history for some time
+	RULE_ABSENCE = "absence"
+)
+
+// AlertRule describes a condition under which the rule engine raises
+// an alert. Value and conflict rules apply to every key in a bucket
+// matching their key pattern, which uses the syntax of path.Match, and
+// raise a separate alert for each key. Absence rules raise a single
+// alert
+type AlertRule struct {
+	Kind string `json:"kind"`
+	Level string `json:"level"`
+	// The bucket holding the keys a value or conflict rule applies to.
+	// Defaults to the default bucket
+	Bucket string `json:"bucket,omitempty"`
+	Key string `json:"key,omitempty"`
+	// One of >, >=, <, <=, == or !=
+	Operator string `json:"operator,omitempty"`
+	Threshold float64 `json:"threshold"`
+	// The condition of a value or conflict rule must hold for this many
+	// milliseconds before the alert is raised
+	For uint64 `json:"for,omitempty"`
+	// An absence rule raises its alert when no event from this source
+	// and of this type was logged in the last Within milliseconds. An
+	// empty source or type matches any
+	Source string `json:"source,omitempty"`
+	Type string `json:"type,omitempty"`
+	Within uint64 `json:"within,omitempty"`
+}
+
+// Validate ensures a rule is complete and that its key pattern is well
+// formed
+func (rule *AlertRule) Validate() error {
+	if len(rule.Level) == 0 {
+		return errors.New("Alert rule has no level")
+	}
+
+	switch rule.Kind {
+	case RULE_VALUE, RULE_CONFLICT:
+		if len(rule.Key) == 0 {
+			return errors.New("Alert rule has no key pattern")
+		}
+
+		if _, err := path.Match(rule.Key, ""); err != nil {
+			return errors.New(fmt.Sprintf("Invalid alert rule key pattern %s", rule.Key))
+		}
+
+		switch rule.Operator {
+		case ">", ">=", "<", "<=", "==", "!=":
+		default:
+			return errors.New(fmt.Sprintf("Invalid alert rule operator %s", rule.Operator))
+		}
+	case RULE_ABSENCE:
+		if len(rule.Source) == 0 && len(rule.Type) == 0 {
+			return errors.New("Alert rule has neither a source nor a type")
+		}
+
+		if rule.Within == 0 {
+			return errors.New("Alert rule has no time window")
+		}
+	default:
+		return errors.New(fmt.Sprintf("Invalid alert rule kind %s", rule.Kind))
+	}
+
+	return nil
+}
+
+func (rule *AlertRule) bucket() string {
+	if len(rule.Bucket) == 0 {
+		return "default"
+	}
+
+	return rule.Bucket
+}
+
+func (rule *AlertRule) matchesKey(bucket string, key string) bool {
+	if rule.Kind != RULE_VALUE && rule.Kind != RULE_CONFLICT || rule.bucket() != bucket {
+		return false
+	}
+
+	matched, _ := path.Match(rule.Key, key)
+
+	return matched
+}
+
+func (rule *AlertRule) matchesEvent(event *Event) bool {
+	if rule.Kind != RULE_ABSENCE {
+		return false
+	}
+
+	if len(rule.Source) != 0 && rule.Source != event.SourceID {
+		return false
+	}
+
+	if len(rule.Type) != 0 && rule.Type != event.Type {
+		return false
+	}
+
+	return true
+}
+
+// keyPrefix returns the longest prefix shared by every key that the key
+// pattern can match
+func (rule *AlertRule) keyPrefix() string {
+	if i := strings.IndexAny(rule.Key, "*?[\\"); i >= 0 {
+		return rule.Key[:i]
+	}
+
+	return rule.Key
+}
+
+func (rule *AlertRule) compare(value float64) bool {
+	switch rule.Operator {
+	case ">":
+		return value > rule.Threshold
+	case ">=":
+		return value >= rule.Threshold
+	case "<":
+		return value < rule.Threshold
+	case "<=":
+		return value <= rule.Threshold
+	case "==":
+		return value == rule.Threshold
+	case "!=":
+		return value != rule.Threshold
+	}
+
+	return false
+}
+
+// holds reports whether the condition of a value or conflict rule holds
+// for a key with these siblings. It never holds for a deleted key. A
+// value rule holds if any sibling is a number that satisfies it
+func (rule *AlertRule) holds(siblingSet *SiblingSet) bool {
+	if siblingSet == nil || siblingSet.IsTombstoneSet() {
+		return false
+	}
+
+	var conflicts float64 = -1
+	var matched bool
+
+	// Iter() must be drained so the loop cannot stop early
+	for sibling := range siblingSet.Iter() {
+		if sibling.IsTombstone() {
+			continue
+		}
+
+		conflicts += 1
+
+		if rule.Kind != RULE_VALUE {
+			continue
+		}
+
+		value, err := strconv.ParseFloat(strings.TrimSpace(string(sibling.Value())), 64)
+
+		if err == nil && rule.compare(value) {
+			matched = true
+		}
+	}
+
+	if rule.Kind == RULE_CONFLICT {
+		return rule.compare(conflicts)
+	}
+
+	return matched
+}
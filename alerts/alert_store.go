@@ -52,6 +52,27 @@ func (alertStore *AlertStoreImpl) Put(alert Alert) error {
 	return alertStore.storageDriver.Batch(batch)
 }
 
+// Lookup returns the alert with the given key or nil if there is none
+func (alertStore *AlertStoreImpl) Lookup(key string) (*Alert, error) {
+	values, err := alertStore.storageDriver.Get([][]byte{ []byte(key) })
+
+	if err != nil {
+		return nil, err
+	}
+
+	if values[0] == nil {
+		return nil, nil
+	}
+
+	var alert Alert
+
+	if err := json.Unmarshal(values[0], &alert); err != nil {
+		return nil, err
+	}
+
+	return &alert, nil
+}
+
 func (alertStore *AlertStoreImpl) DeleteAll(alerts map[string]Alert) error {
 	batch := storage.NewBatch()
 
@@ -0,0 +1,760 @@
+package alerts
+//
+ // Copyright (c) 2019 ARM Limited.
+ //
+ // SPDX-License-Identifier: MIT
+ //
+ // Permission is hereby granted, free of charge, to any person obtaining a copy
+ // of this software and associated documentation files (the "Software"), to
+ // deal in the Software without restriction, including without limitation the
+ // rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ // sell copies of the Software, and to permit persons to whom the Software is
+ // furnished to do so, subject to the following conditions:
+ //
+ // The above copyright notice and this permission notice shall be included in all
+ // copies or substantial portions of the Software.
+ //
+ // THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ // IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ // FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ // AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ // LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ // SOFTWARE.
+ //
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/armPelionEdge/devicedb/bucket"
+	. "github.com/armPelionEdge/devicedb/data"
+	. "github.com/armPelionEdge/devicedb/error"
+	. "github.com/armPelionEdge/devicedb/historian"
+	. "github.com/armPelionEdge/devicedb/logging"
+)
+
+// RuleEngine raises and clears alerts according to the alert rules
+// stored in the cloud bucket. Value and conflict rules are evaluated as
+// keys are updated and absence rules as events are logged to the
+// history so alerting keeps working while the relay is disconnected from
+// the cloud. The alert map must not record its history in the historian
+// watched by the engine
+type RuleEngine struct {
+	mu sync.Mutex
+	buckets *BucketList
+	history *Historian
+	alertMap *AlertMap
+	interval time.Duration
+	rules map[string]*AlertRule
+	// When the condition of a value or conflict rule started holding for
+	// each key, by rule ID
+	since map[string]map[string]uint64
+	// When the last event matching an absence rule was logged, by rule ID
+	lastSeen map[string]uint64
+	// The level of each firing alert raised by a rule, by rule ID then
+	// by key. Absence rules use an empty key
+	firing map[string]map[string]string
+	// The bucket watches that feed value and conflict rules, by bucket
+	// name. Each one only covers the key prefixes of the rules that apply
+	// to its bucket
+	watches map[string]*ruleBucketWatch
+	// Rows received from the bucket watches wait here until the engine
+	// gets to them so writes never wait on rule evaluation
+	queueLock sync.Mutex
+	queue []ruleBucketRow
+	queueReady chan bool
+	ctx context.Context
+	cancel context.CancelFunc
+	done chan bool
+	// Stop waits on the goroutines that read from the buckets so none
+	// outlives the engine
+	workers sync.WaitGroup
+}
+
+type ruleBucketWatch struct {
+	prefixes string
+	cancel context.CancelFunc
+}
+
+type ruleBucketRow struct {
+	bucket string
+	row Row
+}
+
+func NewRuleEngine(buckets *BucketList, history *Historian, alertMap *AlertMap, interval uint64) *RuleEngine {
+	return &RuleEngine{
+		buckets: buckets,
+		history: history,
+		alertMap: alertMap,
+		interval: time.Millisecond * time.Duration(interval),
+		rules: make(map[string]*AlertRule),
+		since: make(map[string]map[string]uint64),
+		lastSeen: make(map[string]uint64),
+		firing: make(map[string]map[string]string),
+		watches: make(map[string]*ruleBucketWatch),
+		queueReady: make(chan bool, 1),
+		done: make(chan bool),
+	}
+}
+
+// Start loads the alert rules and begins evaluating them. Alerts raised
+// by rules before a restart are cleared if their condition no longer
+// holds
+func (engine *RuleEngine) Start() {
+	if err := engine.loadFiring(); err != nil {
+		Log.Warningf("Unable to load the alerts raised by alert rules: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	engine.ctx = ctx
+	engine.cancel = cancel
+
+	// Keys written from here on are read from the bucket watches. Those
+	// written before are evaluated as the rules are loaded
+	positions := engine.changeLogPositions()
+
+	engine.watchHistory(ctx)
+
+	engine.workers.Add(1)
+
+	go func() {
+		defer engine.workers.Done()
+
+		engine.loadRules()
+
+		engine.mu.Lock()
+		engine.updateWatches(positions)
+		engine.mu.Unlock()
+
+		// A ticker keeps the rules evaluated on schedule while rows keep
+		// arriving from the watches
+		ticker := time.NewTicker(engine.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-engine.done:
+				engine.done = make(chan bool)
+				return
+			case <-engine.queueReady:
+				engine.processQueue()
+			case <-ticker.C:
+				engine.Evaluate(uint64(time.Now().UnixNano()) / 1000000)
+			}
+		}
+	}()
+}
+
+func (engine *RuleEngine) Stop() {
+	if engine.cancel == nil {
+		return
+	}
+
+	engine.cancel()
+	close(engine.done)
+	engine.workers.Wait()
+}
+
+// Rules returns the alert rules that are loaded by rule ID
+func (engine *RuleEngine) Rules() map[string]AlertRule {
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+
+	rules := make(map[string]AlertRule, len(engine.rules))
+
+	for id, rule := range engine.rules {
+		rules[id] = *rule
+	}
+
+	return rules
+}
+
+// Evaluate raises the alerts of value and conflict rules whose condition
+// has held for long enough and evaluates absence rules as of now
+func (engine *RuleEngine) Evaluate(now uint64) {
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+
+	for id, rule := range engine.rules {
+		if rule.Kind == RULE_ABSENCE {
+			engine.evaluateAbsence(id, rule, now)
+
+			continue
+		}
+
+		for key, since := range engine.since[id] {
+			if now >= since && now - since >= rule.For {
+				engine.raise(id, rule, key, now)
+			}
+		}
+	}
+}
+
+// changeLogPositions returns the position each bucket's change log has
+// reached
+func (engine *RuleEngine) changeLogPositions() map[string]uint64 {
+	positions := make(map[string]uint64)
+
+	for _, bucket := range engine.buckets.All() {
+		positions[bucket.Name()] = bucket.ChangeLogPosition()
+	}
+
+	return positions
+}
+
+// updateWatches watches the key prefixes of the rules that are loaded in
+// each bucket, and the rules themselves in the cloud bucket. A bucket
+// whose prefixes changed is watched again from its position in positions
+// so no key written after that is missed. Must be called with the lock
+// held
+func (engine *RuleEngine) updateWatches(positions map[string]uint64) {
+	bucketPrefixes := map[string]map[string]bool{
+		ALERT_RULE_BUCKET: map[string]bool{ ALERT_RULE_PREFIX: true },
+	}
+
+	for _, rule := range engine.rules {
+		if rule.Kind != RULE_VALUE && rule.Kind != RULE_CONFLICT {
+			continue
+		}
+
+		if _, ok := bucketPrefixes[rule.bucket()]; !ok {
+			bucketPrefixes[rule.bucket()] = make(map[string]bool)
+		}
+
+		bucketPrefixes[rule.bucket()][rule.keyPrefix()] = true
+	}
+
+	for name, watch := range engine.watches {
+		if _, ok := bucketPrefixes[name]; !ok {
+			watch.cancel()
+			delete(engine.watches, name)
+		}
+	}
+
+	for name, prefixSet := range bucketPrefixes {
+		bucket := engine.buckets.Get(name)
+
+		if bucket == nil {
+			continue
+		}
+
+		prefixes := make([]string, 0, len(prefixSet))
+
+		for prefix, _ := range prefixSet {
+			prefixes = append(prefixes, prefix)
+		}
+
+		sort.Strings(prefixes)
+
+		watch, ok := engine.watches[name]
+
+		if ok && watch.prefixes == strings.Join(prefixes, "\x00") {
+			continue
+		}
+
+		if ok {
+			watch.cancel()
+		}
+
+		ctx, cancel := context.WithCancel(engine.ctx)
+		engine.watches[name] = &ruleBucketWatch{ prefixes: strings.Join(prefixes, "\x00"), cancel: cancel }
+		engine.watchBucket(ctx, bucket, prefixes, positions[name])
+	}
+}
+
+func (engine *RuleEngine) watchBucket(ctx context.Context, bucket Bucket, prefixes []string, position uint64) {
+	ch := make(chan Row)
+	watchPrefixes := make([][]byte, len(prefixes))
+
+	for i, prefix := range prefixes {
+		watchPrefixes[i] = []byte(prefix)
+	}
+
+	// Nothing is replayed from the bucket itself. Once the watch is in
+	// place the keys written since position are read from the change log
+	go bucket.Watch(ctx, nil, watchPrefixes, math.MaxUint64, ch)
+
+	// The bucket delivers updates while holding its locks so the channel is
+	// always drained right away, until the bucket closes it once the watch
+	// is cancelled
+	engine.workers.Add(1)
+
+	go func() {
+		defer engine.workers.Done()
+
+		for row := range ch {
+			// An empty row marks the end of the replay
+			if row.Key == "" {
+				engine.workers.Add(1)
+
+				go func() {
+					defer engine.workers.Done()
+
+					engine.catchUp(ctx, bucket, prefixes, position)
+				}()
+
+				continue
+			}
+
+			engine.enqueue(bucket.Name(), row)
+		}
+	}()
+}
+
+// catchUp queues the keys in the watched prefixes that were written to a
+// bucket since position. The change log holds the latest value of each
+// key so a row read here is never older than one already received from
+// the watch. It stops early once the watch is cancelled
+func (engine *RuleEngine) catchUp(ctx context.Context, bucket Bucket, prefixes []string, position uint64) {
+	iter, _, err := bucket.ChangesSince(position)
+
+	if err != nil {
+		Log.Warningf("Unable to read the keys written to bucket %s while its alert rules were loaded: %v", bucket.Name(), err)
+
+		return
+	}
+
+	defer iter.Release()
+
+	for ctx.Err() == nil && iter.Next() {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(string(iter.Key()), prefix) {
+				engine.enqueue(bucket.Name(), Row{ Key: string(iter.Key()), LocalVersion: iter.LocalVersion(), Siblings: iter.Value() })
+
+				break
+			}
+		}
+	}
+
+	if iter.Error() != nil {
+		Log.Warningf("Unable to read the keys written to bucket %s while its alert rules were loaded: %v", bucket.Name(), iter.Error())
+	}
+}
+
+func (engine *RuleEngine) enqueue(bucket string, row Row) {
+	engine.queueLock.Lock()
+	engine.queue = append(engine.queue, ruleBucketRow{ bucket: bucket, row: row })
+	engine.queueLock.Unlock()
+
+	select {
+	case engine.queueReady <- true:
+	default:
+	}
+}
+
+// processQueue evaluates the rules against every row received from the
+// bucket watches so far
+func (engine *RuleEngine) processQueue() {
+	engine.queueLock.Lock()
+	queue := engine.queue
+	engine.queue = nil
+	engine.queueLock.Unlock()
+
+	for _, bucketRow := range queue {
+		engine.processRow(bucketRow.bucket, bucketRow.row)
+	}
+}
+
+func (engine *RuleEngine) watchHistory(ctx context.Context) {
+	lastSerial := engine.history.LogSerial()
+
+	if lastSerial > 0 {
+		lastSerial -= 1
+	}
+
+	engine.workers.Add(1)
+
+	go func() {
+		defer engine.workers.Done()
+
+		for {
+			ch := make(chan *Event)
+
+			go engine.history.Watch(ctx, &HistoryQuery{ }, lastSerial, ch)
+
+			for event := range ch {
+				// A nil event marks the end of the replay
+				if event == nil {
+					continue
+				}
+
+				lastSerial = event.Serial
+				engine.processEvent(event)
+			}
+
+			// The history closes the channel early if the engine falls
+			// behind so watch again from the last event processed
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+		}
+	}()
+}
+
+func (engine *RuleEngine) processRow(bucket string, row Row) {
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+
+	now := uint64(time.Now().UnixNano()) / 1000000
+
+	if bucket == ALERT_RULE_BUCKET && strings.HasPrefix(row.Key, ALERT_RULE_PREFIX) {
+		positions := engine.changeLogPositions()
+		engine.loadRule(strings.TrimPrefix(row.Key, ALERT_RULE_PREFIX), row.Siblings, now)
+		engine.updateWatches(positions)
+	}
+
+	for id, rule := range engine.rules {
+		if rule.matchesKey(bucket, row.Key) {
+			engine.evaluateKey(id, rule, row.Key, row.Siblings, now)
+		}
+	}
+}
+
+func (engine *RuleEngine) processEvent(event *Event) {
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+
+	now := uint64(time.Now().UnixNano()) / 1000000
+
+	for id, rule := range engine.rules {
+		if !rule.matchesEvent(event) {
+			continue
+		}
+
+		if event.Timestamp > engine.lastSeen[id] {
+			engine.lastSeen[id] = event.Timestamp
+		}
+
+		engine.evaluateAbsence(id, rule, now)
+	}
+}
+
+// loadRule replaces the rule with this ID by the one encoded in
+// siblingSet, or removes it if the rule was deleted or is invalid, and
+// evaluates it against the keys it applies to
+func (engine *RuleEngine) loadRule(id string, siblingSet *SiblingSet, now uint64) {
+	var rule *AlertRule
+
+	if siblingSet != nil && siblingSet.Value() != nil {
+		rule = &AlertRule{ }
+
+		if err := json.Unmarshal(siblingSet.Value(), rule); err != nil {
+			Log.Warningf("Ignoring alert rule %s: %v", id, err)
+
+			rule = nil
+		} else if err := rule.Validate(); err != nil {
+			Log.Warningf("Ignoring alert rule %s: %v", id, err)
+
+			rule = nil
+		}
+	}
+
+	delete(engine.rules, id)
+
+	if rule == nil {
+		for key, _ := range engine.firing[id] {
+			engine.clear(id, key, now)
+		}
+
+		delete(engine.since, id)
+		delete(engine.lastSeen, id)
+
+		return
+	}
+
+	engine.rules[id] = rule
+
+	if rule.Kind == RULE_ABSENCE {
+		delete(engine.since, id)
+
+		if err := engine.loadLastSeen(id, rule, now); err != nil {
+			Log.Warningf("Unable to find the last event matching alert rule %s: %v", id, err)
+		}
+
+		// Any alert raised under a different kind of rule no longer applies
+		for key, _ := range engine.firing[id] {
+			if key != "" {
+				engine.clear(id, key, now)
+			}
+		}
+
+		engine.evaluateAbsence(id, rule, now)
+
+		return
+	}
+
+	delete(engine.lastSeen, id)
+
+	if _, ok := engine.since[id]; !ok {
+		engine.since[id] = make(map[string]uint64)
+	}
+
+	seen := make(map[string]bool)
+
+	if bucket := engine.buckets.Get(rule.bucket()); bucket != nil {
+		iter, err := bucket.GetMatches([][]byte{ []byte(rule.keyPrefix()) })
+
+		if err != nil {
+			Log.Warningf("Unable to evaluate alert rule %s: %v", id, err)
+
+			return
+		}
+
+		for iter.Next() {
+			key := string(iter.Key())
+
+			if rule.matchesKey(rule.bucket(), key) {
+				seen[key] = true
+				engine.evaluateKey(id, rule, key, iter.Value(), now)
+			}
+		}
+
+		iter.Release()
+
+		if iter.Error() != nil {
+			Log.Warningf("Unable to evaluate alert rule %s: %v", id, iter.Error())
+
+			return
+		}
+	}
+
+	// Clear alerts for keys the rule no longer applies to
+	for key, _ := range engine.since[id] {
+		if !seen[key] {
+			delete(engine.since[id], key)
+		}
+	}
+
+	for key, _ := range engine.firing[id] {
+		if !seen[key] {
+			engine.clear(id, key, now)
+		}
+	}
+}
+
+// loadRules loads every rule stored in the cloud bucket then clears the
+// alerts raised before a restart by rules that have since been removed
+func (engine *RuleEngine) loadRules() {
+	bucket := engine.buckets.Get(ALERT_RULE_BUCKET)
+
+	if bucket == nil {
+		return
+	}
+
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+
+	now := uint64(time.Now().UnixNano()) / 1000000
+	iter, err := bucket.GetMatches([][]byte{ []byte(ALERT_RULE_PREFIX) })
+
+	if err != nil {
+		Log.Warningf("Unable to load alert rules: %v", err)
+
+		return
+	}
+
+	for iter.Next() {
+		engine.loadRule(strings.TrimPrefix(string(iter.Key()), ALERT_RULE_PREFIX), iter.Value(), now)
+	}
+
+	iter.Release()
+
+	if iter.Error() != nil {
+		Log.Warningf("Unable to load alert rules: %v", iter.Error())
+
+		return
+	}
+
+	for id, keys := range engine.firing {
+		if _, ok := engine.rules[id]; ok {
+			continue
+		}
+
+		for key, _ := range keys {
+			engine.clear(id, key, now)
+		}
+	}
+}
+
+// loadLastSeen finds when the last event matching an absence rule was
+// logged. If there is none the rule starts counting from now
+func (engine *RuleEngine) loadLastSeen(id string, rule *AlertRule, now uint64) error {
+	query := &HistoryQuery{ Order: "desc", Limit: 1 }
+
+	if len(rule.Source) != 0 {
+		query.Sources = []string{ rule.Source }
+	}
+
+	if len(rule.Type) != 0 {
+		query.Types = []string{ rule.Type }
+	}
+
+	iter, err := engine.history.Query(query)
+
+	if err != nil {
+		return err
+	}
+
+	defer iter.Release()
+
+	lastSeen := now
+
+	if iter.Next() {
+		lastSeen = iter.Event().Timestamp
+	}
+
+	if iter.Error() != nil {
+		return iter.Error()
+	}
+
+	if lastSeen > engine.lastSeen[id] {
+		engine.lastSeen[id] = lastSeen
+	}
+
+	return nil
+}
+
+func (engine *RuleEngine) evaluateKey(id string, rule *AlertRule, key string, siblingSet *SiblingSet, now uint64) {
+	if !rule.holds(siblingSet) {
+		delete(engine.since[id], key)
+		engine.clear(id, key, now)
+
+		return
+	}
+
+	since, ok := engine.since[id][key]
+
+	if !ok {
+		since = now
+		engine.since[id][key] = now
+	}
+
+	if now >= since && now - since >= rule.For {
+		engine.raise(id, rule, key, now)
+	}
+}
+
+func (engine *RuleEngine) evaluateAbsence(id string, rule *AlertRule, now uint64) {
+	lastSeen := engine.lastSeen[id]
+
+	if now >= lastSeen && now - lastSeen >= rule.Within {
+		engine.raise(id, rule, "", now)
+	} else {
+		engine.clear(id, "", now)
+	}
+}
+
+func (engine *RuleEngine) raise(id string, rule *AlertRule, key string, now uint64) {
+	// The alert may have been cleared by hand since it was raised so it is
+	// raised again unless it is still firing at this level
+	if level, ok := engine.firing[id][key]; ok && level == rule.Level {
+		alert, err := engine.alertMap.Alert(ruleAlertKey(id, key))
+
+		if err != nil {
+			Log.Warningf("Unable to look up alert for alert rule %s: %v", id, err)
+
+			return
+		}
+
+		if alert != nil && alert.Status && alert.Level == rule.Level {
+			return
+		}
+	}
+
+	err := engine.alertMap.UpdateAlert(Alert{
+		Key: ruleAlertKey(id, key),
+		Level: rule.Level,
+		Timestamp: now,
+		Metadata: map[string]interface{}{ "rule": id, "key": key },
+		Status: true,
+	})
+
+	if err != nil {
+		Log.Warningf("Unable to raise alert for alert rule %s: %v", id, err)
+
+		return
+	}
+
+	if _, ok := engine.firing[id]; !ok {
+		engine.firing[id] = make(map[string]string)
+	}
+
+	engine.firing[id][key] = rule.Level
+}
+
+func (engine *RuleEngine) clear(id string, key string, now uint64) {
+	if _, ok := engine.firing[id][key]; !ok {
+		return
+	}
+
+	err := engine.alertMap.ClearAlert(ruleAlertKey(id, key), now)
+
+	if err != nil && err != EAlertDoesNotExist {
+		Log.Warningf("Unable to clear alert for alert rule %s: %v", id, err)
+
+		return
+	}
+
+	delete(engine.firing[id], key)
+
+	if len(engine.firing[id]) == 0 {
+		delete(engine.firing, id)
+	}
+}
+
+// loadFiring finds the alerts raised by rules that are still firing.
+// Their metadata records the rule and key that raised them
+func (engine *RuleEngine) loadFiring() error {
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+
+	alerts, err := engine.alertMap.CurrentAlerts(nil)
+
+	if err != nil {
+		return err
+	}
+
+	for _, alert := range alerts {
+		if !strings.HasPrefix(alert.Key, RULE_ALERT_PREFIX) {
+			continue
+		}
+
+		metadata, ok := alert.Metadata.(map[string]interface{})
+
+		if !ok {
+			continue
+		}
+
+		id, ok := metadata["rule"].(string)
+
+		if !ok {
+			continue
+		}
+
+		key, _ := metadata["key"].(string)
+
+		if _, ok := engine.firing[id]; !ok {
+			engine.firing[id] = make(map[string]string)
+		}
+
+		engine.firing[id][key] = alert.Level
+	}
+
+	return nil
+}
+
+func ruleAlertKey(id string, key string) string {
+	if key == "" {
+		return RULE_ALERT_PREFIX + id
+	}
+
+	return RULE_ALERT_PREFIX + id + ":" + key
+}
@@ -0,0 +1,203 @@
+package alerts_test
+//
+ // Copyright (c) 2019 ARM Limited.
+ //
+ // SPDX-License-Identifier: MIT
+ //
+ // Permission is hereby granted, free of charge, to any person obtaining a copy
+ // of this software and associated documentation files (the "Software"), to
+ // deal in the Software without restriction, including without limitation the
+ // rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ // sell copies of the Software, and to permit persons to whom the Software is
+ // furnished to do so, subject to the following conditions:
+ //
+ // The above copyright notice and this permission notice shall be included in all
+ // copies or substantial portions of the Software.
+ //
+ // THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ // IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ // FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ // AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ // LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ // SOFTWARE.
+ //
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/armPelionEdge/devicedb/alerts"
+	. "github.com/armPelionEdge/devicedb/bucket"
+	. "github.com/armPelionEdge/devicedb/bucket/builtin"
+	. "github.com/armPelionEdge/devicedb/data"
+	. "github.com/armPelionEdge/devicedb/historian"
+	. "github.com/armPelionEdge/devicedb/storage"
+	. "github.com/armPelionEdge/devicedb/util"
+)
+
+var _ = Describe("RuleEngine", func() {
+	var storageEngine StorageDriver
+	var defaultBucket *DefaultBucket
+	var cloudBucket *CloudBucket
+	var events *Historian
+	var alertMap *AlertMap
+	var ruleEngine *RuleEngine
+
+	BeforeEach(func() {
+		storageEngine = MakeNewStorageDriver()
+		storageEngine.Open()
+		defaultBucket, _ = NewDefaultBucket("relay1", NewPrefixedStorageDriver([]byte{ 0 }, storageEngine), 4)
+		cloudBucket, _ = NewCloudBucket("cloud", NewPrefixedStorageDriver([]byte{ 1 }, storageEngine), 4, CloudMode)
+		events = NewHistorian(NewPrefixedStorageDriver([]byte{ 2 }, storageEngine), 0, 0, 1000)
+		alertMap = NewAlertLifecycleMap(
+			NewAlertStore(NewPrefixedStorageDriver([]byte{ 3 }, storageEngine)),
+			NewAlertStore(NewPrefixedStorageDriver([]byte{ 4 }, storageEngine)),
+			NewHistorian(NewPrefixedStorageDriver([]byte{ 5 }, storageEngine), 0, 0, 1000),
+			0,
+		)
+		ruleEngine = NewRuleEngine(NewBucketList().AddBucket(defaultBucket).AddBucket(cloudBucket), events, alertMap, 60000)
+		ruleEngine.Start()
+	})
+
+	AfterEach(func() {
+		ruleEngine.Stop()
+		storageEngine.Close()
+	})
+
+	put := func(bucket Bucket, key string, value string) {
+		siblingSets, err := bucket.Get([][]byte{ []byte(key) })
+
+		Expect(err).Should(BeNil())
+
+		context := map[string]uint64{ }
+
+		if siblingSets[0] != nil {
+			context = siblingSets[0].Join()
+		}
+
+		updateBatch := NewUpdateBatch()
+		updateBatch.Put([]byte(key), []byte(value), NewDVV(NewDot("", 0), context))
+		_, err = bucket.Batch(updateBatch)
+
+		Expect(err).Should(BeNil())
+	}
+
+	firing := func() []string {
+		alerts, err := alertMap.CurrentAlerts(nil)
+
+		Expect(err).Should(BeNil())
+
+		keys := []string{ }
+
+		for _, alert := range alerts {
+			keys = append(keys, alert.Key)
+		}
+
+		return keys
+	}
+
+	nowMS := func() uint64 {
+		return uint64(time.Now().UnixNano()) / 1000000
+	}
+
+	It("Should raise and clear an alert as the value of a key crosses a threshold", func() {
+		put(cloudBucket, ALERT_RULE_PREFIX + "hot", `{ "kind": "value", "level": "critical", "key": "sensors/*/temp", "operator": ">", "threshold": 80 }`)
+		Eventually(ruleEngine.Rules).Should(HaveKey("hot"))
+
+		put(defaultBucket, "sensors/a/temp", "85")
+		put(defaultBucket, "sensors/b/temp", "75")
+		put(defaultBucket, "sensors/c/humidity", "90")
+		Eventually(firing).Should(Equal([]string{ "rule:hot:sensors/a/temp" }))
+
+		put(defaultBucket, "sensors/a/temp", "70")
+		Eventually(firing).Should(BeEmpty())
+	})
+
+	It("Should raise an alert again after it is cleared by hand while its condition holds", func() {
+		put(cloudBucket, ALERT_RULE_PREFIX + "hot", `{ "kind": "value", "level": "critical", "key": "sensors/*/temp", "operator": ">", "threshold": 80 }`)
+		Eventually(ruleEngine.Rules).Should(HaveKey("hot"))
+
+		put(defaultBucket, "sensors/a/temp", "85")
+		Eventually(firing).Should(Equal([]string{ "rule:hot:sensors/a/temp" }))
+
+		Expect(alertMap.ClearAlert("rule:hot:sensors/a/temp", nowMS())).Should(BeNil())
+		Expect(firing()).Should(BeEmpty())
+
+		ruleEngine.Evaluate(nowMS())
+		Expect(firing()).Should(Equal([]string{ "rule:hot:sensors/a/temp" }))
+	})
+
+	It("Should evaluate a new rule against existing keys and wait for its condition to hold long enough", func() {
+		put(defaultBucket, "sensors/a/temp", "90")
+		put(cloudBucket, ALERT_RULE_PREFIX + "hot", `{ "kind": "value", "level": "critical", "key": "sensors/*/temp", "operator": ">=", "threshold": 80, "for": 300000 }`)
+		Eventually(ruleEngine.Rules).Should(HaveKey("hot"))
+		Expect(firing()).Should(BeEmpty())
+
+		ruleEngine.Evaluate(nowMS() + 300000)
+		Expect(firing()).Should(Equal([]string{ "rule:hot:sensors/a/temp" }))
+	})
+
+	It("Should raise an alert while a key has conflicting siblings", func() {
+		put(cloudBucket, ALERT_RULE_PREFIX + "conflicts", `{ "kind": "conflict", "level": "warning", "key": "*", "operator": ">", "threshold": 0 }`)
+		Eventually(ruleEngine.Rules).Should(HaveKey("conflicts"))
+
+		put(defaultBucket, "a", "1")
+		Consistently(firing, "100ms").Should(BeEmpty())
+
+		updateBatch := NewUpdateBatch()
+		updateBatch.Put([]byte("a"), []byte("2"), NewDVV(NewDot("", 0), map[string]uint64{ "relay2": 0 }))
+		defaultBucket.Batch(updateBatch)
+		Eventually(firing).Should(Equal([]string{ "rule:conflicts:a" }))
+
+		put(defaultBucket, "a", "3")
+		Eventually(firing).Should(BeEmpty())
+	})
+
+	It("Should raise an alert when no matching event was logged in time and clear it once one is", func() {
+		put(cloudBucket, ALERT_RULE_PREFIX + "heartbeat", `{ "kind": "absence", "level": "warning", "source": "door1", "type": "heartbeat", "within": 600000 }`)
+		Eventually(ruleEngine.Rules).Should(HaveKey("heartbeat"))
+
+		ruleEngine.Evaluate(nowMS() + 300000)
+		Expect(firing()).Should(BeEmpty())
+
+		ruleEngine.Evaluate(nowMS() + 600000)
+		Expect(firing()).Should(Equal([]string{ "rule:heartbeat" }))
+
+		Expect(events.LogEvent(&Event{ Timestamp: nowMS(), SourceID: "door2", Type: "heartbeat" })).Should(BeNil())
+		Consistently(firing, "100ms").Should(HaveLen(1))
+
+		Expect(events.LogEvent(&Event{ Timestamp: nowMS(), SourceID: "door1", Type: "heartbeat" })).Should(BeNil())
+		Eventually(firing).Should(BeEmpty())
+	})
+
+	It("Should clear the alerts of a rule once it is removed", func() {
+		put(defaultBucket, "sensors/a/temp", "90")
+		put(cloudBucket, ALERT_RULE_PREFIX + "hot", `{ "kind": "value", "level": "critical", "key": "sensors/*/temp", "operator": ">", "threshold": 80 }`)
+		Eventually(firing).Should(HaveLen(1))
+
+		siblingSets, err := cloudBucket.Get([][]byte{ []byte(ALERT_RULE_PREFIX + "hot") })
+
+		Expect(err).Should(BeNil())
+
+		updateBatch := NewUpdateBatch()
+		updateBatch.Delete([]byte(ALERT_RULE_PREFIX + "hot"), NewDVV(NewDot("", 0), siblingSets[0].Join()))
+		cloudBucket.Batch(updateBatch)
+
+		Eventually(ruleEngine.Rules).Should(BeEmpty())
+		Expect(firing()).Should(BeEmpty())
+	})
+
+	It("Should stop an engine that was never started", func() {
+		NewRuleEngine(NewBucketList(), events, alertMap, 60000).Stop()
+	})
+
+	It("Should ignore invalid rules", func() {
+		put(cloudBucket, ALERT_RULE_PREFIX + "bad", `{ "kind": "value", "level": "critical", "key": "sensors/*/temp", "operator": "~" }`)
+		put(cloudBucket, ALERT_RULE_PREFIX + "good", `{ "kind": "absence", "level": "warning", "type": "heartbeat", "within": 1000 }`)
+		Eventually(ruleEngine.Rules).Should(HaveKey("good"))
+		Expect(ruleEngine.Rules()).Should(HaveLen(1))
+	})
+})
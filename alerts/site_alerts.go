@@ -0,0 +1,440 @@
+package alerts
+//
+ // Copyright (c) 2019 ARM Limited.
+ //
+ // SPDX-License-Identifier: MIT
+ //
+ // Permission is hereby granted, free of charge, to any person obtaining a copy
+ // of this software and associated documentation files (the "Software"), to
+ // deal in the Software without restriction, including without limitation the
+ // rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ // sell copies of the Software, and to permit persons to whom the Software is
+ // furnished to do so, subject to the following conditions:
+ //
+ // The above copyright notice and this permission notice shall be included in all
+ // copies or substantial portions of the Software.
+ //
+ // THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ // IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ // FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ // AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ // LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ // SOFTWARE.
+ //
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"sync"
+
+	. "github.com/armPelionEdge/devicedb/error"
+	. "github.com/armPelionEdge/devicedb/historian"
+	. "github.com/armPelionEdge/devicedb/logging"
+	. "github.com/armPelionEdge/devicedb/storage"
+)
+
+var (
+	RELAY_ALERTS_PREFIX = []byte{ 0 }
+	RELAY_REPORT_PREFIX = []byte{ 1 }
+)
+
+// The key and level of the alert raised for a relay that stopped
+// reporting
+const (
+	STALE_RELAY_ALERT = "devicedb.relay.stale"
+	STALE_RELAY_ALERT_LEVEL = "critical"
+)
+
+// RelayAlert is an alert forwarded by a relay
+type RelayAlert struct {
+	Alert
+	SiteID string `json:"siteID"`
+	RelayID string `json:"relayID"`
+}
+
+// RelayReport records when a relay last reported and whether it has
+// been flagged as stale since
+type RelayReport struct {
+	SiteID string `json:"siteID"`
+	RelayID string `json:"relayID"`
+	LastReport uint64 `json:"lastReport"`
+	Stale bool `json:"stale"`
+}
+
+// SiteAlerts keeps the current state of the alerts forwarded by each
+// relay in each site. It also tracks when each relay last reported so
+// that a stale relay alert can be raised for relays that go quiet
+type SiteAlerts struct {
+	storageDriver StorageDriver
+	lock sync.Mutex
+	reports map[string]map[string]*RelayReport
+}
+
+func NewSiteAlerts(storageDriver StorageDriver) (*SiteAlerts, error) {
+	siteAlerts := &SiteAlerts{
+		storageDriver: storageDriver,
+		reports: make(map[string]map[string]*RelayReport),
+	}
+
+	iter, err := storageDriver.GetMatches([][]byte{ RELAY_REPORT_PREFIX })
+
+	if err != nil {
+		Log.Errorf("Storage driver error in NewSiteAlerts(): %s", err.Error())
+
+		return nil, EStorage
+	}
+
+	defer iter.Release()
+
+	for iter.Next() {
+		var report RelayReport
+
+		if err := json.Unmarshal(iter.Value(), &report); err != nil {
+			Log.Warningf("Ignoring invalid relay report: %v", err)
+
+			continue
+		}
+
+		if _, ok := siteAlerts.reports[report.SiteID]; !ok {
+			siteAlerts.reports[report.SiteID] = make(map[string]*RelayReport)
+		}
+
+		siteAlerts.reports[report.SiteID][report.RelayID] = &report
+	}
+
+	if iter.Error() != nil {
+		Log.Errorf("Storage driver error in NewSiteAlerts(): %s", iter.Error().Error())
+
+		return nil, EStorage
+	}
+
+	return siteAlerts, nil
+}
+
+func encodeSiteAlertsKey(prefix []byte, ids ...string) []byte {
+	// Base64 never contains the delimeter so one site's prefix can't
+	// be a prefix of another's
+	key := append([]byte{ }, prefix...)
+
+	for _, id := range ids {
+		key = append(key, []byte(base64.StdEncoding.EncodeToString([]byte(id)))...)
+		key = append(key, DELIMETER...)
+	}
+
+	return key
+}
+
+func (siteAlerts *SiteAlerts) alertStore(siteID string, relayID string) *AlertStoreImpl {
+	return NewAlertStore(NewPrefixedStorageDriver(encodeSiteAlertsKey(RELAY_ALERTS_PREFIX, siteID, relayID), siteAlerts.storageDriver))
+}
+
+// UpdateAlerts records the alerts forwarded by a relay. An alert only
+// replaces the one stored under the same key if it is at least as
+// recent so batches retried out of order do no harm. This counts as a
+// report from the relay
+func (siteAlerts *SiteAlerts) UpdateAlerts(siteID string, relayID string, alerts []Alert, now uint64) error {
+	siteAlerts.lock.Lock()
+	defer siteAlerts.lock.Unlock()
+
+	alertStore := siteAlerts.alertStore(siteID, relayID)
+
+	for _, alert := range alerts {
+		// Only the cloud raises this alert
+		if alert.Key == STALE_RELAY_ALERT {
+			continue
+		}
+
+		current, err := alertStore.Lookup(alert.Key)
+
+		if err != nil {
+			Log.Errorf("Storage driver error in UpdateAlerts(%s, %s): %s", siteID, relayID, err.Error())
+
+			return EStorage
+		}
+
+		if current != nil && current.Timestamp > alert.Timestamp {
+			continue
+		}
+
+		if err := alertStore.Put(alert); err != nil {
+			Log.Errorf("Storage driver error in UpdateAlerts(%s, %s): %s", siteID, relayID, err.Error())
+
+			return EStorage
+		}
+	}
+
+	return siteAlerts.touch(siteID, relayID, now)
+}
+
+// Touch records that a relay reported, clearing its stale relay alert
+// if it was raised
+func (siteAlerts *SiteAlerts) Touch(siteID string, relayID string, now uint64) error {
+	siteAlerts.lock.Lock()
+	defer siteAlerts.lock.Unlock()
+
+	return siteAlerts.touch(siteID, relayID, now)
+}
+
+func (siteAlerts *SiteAlerts) touch(siteID string, relayID string, now uint64) error {
+	report := RelayReport{ SiteID: siteID, RelayID: relayID }
+
+	if current, ok := siteAlerts.reports[siteID][relayID]; ok {
+		report = *current
+	}
+
+	if report.Stale {
+		err := siteAlerts.alertStore(siteID, relayID).Put(Alert{
+			Key: STALE_RELAY_ALERT,
+			Level: STALE_RELAY_ALERT_LEVEL,
+			Timestamp: now,
+			Metadata: map[string]interface{}{ "lastReport": report.LastReport },
+			Status: false,
+		})
+
+		if err != nil {
+			Log.Errorf("Storage driver error in Touch(%s, %s): %s", siteID, relayID, err.Error())
+
+			return EStorage
+		}
+	}
+
+	if now > report.LastReport {
+		report.LastReport = now
+	}
+
+	report.Stale = false
+
+	return siteAlerts.putReport(report)
+}
+
+func (siteAlerts *SiteAlerts) putReport(report RelayReport) error {
+	encodedReport, _ := json.Marshal(report)
+	batch := NewBatch()
+	batch.Put(encodeSiteAlertsKey(RELAY_REPORT_PREFIX, report.SiteID, report.RelayID), encodedReport)
+
+	if err := siteAlerts.storageDriver.Batch(batch); err != nil {
+		Log.Errorf("Storage driver error in putReport(%s, %s): %s", report.SiteID, report.RelayID, err.Error())
+
+		return EStorage
+	}
+
+	if _, ok := siteAlerts.reports[report.SiteID]; !ok {
+		siteAlerts.reports[report.SiteID] = make(map[string]*RelayReport)
+	}
+
+	siteAlerts.reports[report.SiteID][report.RelayID] = &report
+
+	return nil
+}
+
+// StaleRelays returns the relays that have not reported in the last
+// staleAfter milliseconds and have not been flagged as stale yet
+func (siteAlerts *SiteAlerts) StaleRelays(now uint64, staleAfter uint64) []RelayReport {
+	siteAlerts.lock.Lock()
+	defer siteAlerts.lock.Unlock()
+
+	var staleRelays []RelayReport = make([]RelayReport, 0)
+
+	for _, reports := range siteAlerts.reports {
+		for _, report := range reports {
+			if !report.Stale && now >= report.LastReport && now - report.LastReport >= staleAfter {
+				staleRelays = append(staleRelays, *report)
+			}
+		}
+	}
+
+	return staleRelays
+}
+
+// MarkStale raises the stale relay alert for a relay. It does nothing
+// if the relay never reported or was already flagged
+func (siteAlerts *SiteAlerts) MarkStale(siteID string, relayID string, now uint64) error {
+	siteAlerts.lock.Lock()
+	defer siteAlerts.lock.Unlock()
+
+	current, ok := siteAlerts.reports[siteID][relayID]
+
+	if !ok || current.Stale {
+		return nil
+	}
+
+	err := siteAlerts.alertStore(siteID, relayID).Put(Alert{
+		Key: STALE_RELAY_ALERT,
+		Level: STALE_RELAY_ALERT_LEVEL,
+		Timestamp: now,
+		Metadata: map[string]interface{}{ "lastReport": current.LastReport },
+		Status: true,
+	})
+
+	if err != nil {
+		Log.Errorf("Storage driver error in MarkStale(%s, %s): %s", siteID, relayID, err.Error())
+
+		return EStorage
+	}
+
+	report := *current
+	report.Stale = true
+
+	return siteAlerts.putReport(report)
+}
+
+// ForgetRelay removes the alerts and the report of a relay, for
+// instance once it has left a site
+func (siteAlerts *SiteAlerts) ForgetRelay(siteID string, relayID string) error {
+	siteAlerts.lock.Lock()
+	defer siteAlerts.lock.Unlock()
+
+	iter, err := siteAlerts.storageDriver.GetMatches([][]byte{ encodeSiteAlertsKey(RELAY_ALERTS_PREFIX, siteID, relayID) })
+
+	if err != nil {
+		Log.Errorf("Storage driver error in ForgetRelay(%s, %s): %s", siteID, relayID, err.Error())
+
+		return EStorage
+	}
+
+	defer iter.Release()
+
+	batch := NewBatch()
+
+	for iter.Next() {
+		batch.Delete(iter.Key())
+	}
+
+	if iter.Error() != nil {
+		Log.Errorf("Storage driver error in ForgetRelay(%s, %s): %s", siteID, relayID, iter.Error().Error())
+
+		return EStorage
+	}
+
+	batch.Delete(encodeSiteAlertsKey(RELAY_REPORT_PREFIX, siteID, relayID))
+
+	if err := siteAlerts.storageDriver.Batch(batch); err != nil {
+		Log.Errorf("Storage driver error in ForgetRelay(%s, %s): %s", siteID, relayID, err.Error())
+
+		return EStorage
+	}
+
+	delete(siteAlerts.reports[siteID], relayID)
+
+	return nil
+}
+
+// Alerts returns the firing alerts of the relays in a site, or in every
+// site if siteID is empty. If levels is not empty only alerts at one of
+// those levels are returned
+func (siteAlerts *SiteAlerts) Alerts(siteID string, levels []string) ([]RelayAlert, error) {
+	alerts, err := siteAlerts.AlertStates(siteID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return FiringRelayAlerts(alerts, levels), nil
+}
+
+// AlertStates returns the state of every alert of the relays in a site,
+// or in every site if siteID is empty, including alerts that have been
+// cleared. The owners of a site's partition may each have missed some
+// changes so their states are merged with MergeRelayAlertStates
+func (siteAlerts *SiteAlerts) AlertStates(siteID string) ([]RelayAlert, error) {
+	prefix := RELAY_ALERTS_PREFIX
+
+	if siteID != "" {
+		prefix = encodeSiteAlertsKey(RELAY_ALERTS_PREFIX, siteID)
+	}
+
+	iter, err := siteAlerts.storageDriver.GetMatches([][]byte{ prefix })
+
+	if err != nil {
+		Log.Errorf("Storage driver error in AlertStates(%s): %s", siteID, err.Error())
+
+		return nil, EStorage
+	}
+
+	defer iter.Release()
+
+	var alerts []RelayAlert = make([]RelayAlert, 0)
+
+	for iter.Next() {
+		var relayAlert RelayAlert
+
+		if err := json.Unmarshal(iter.Value(), &relayAlert.Alert); err != nil {
+			Log.Warningf("Ignoring invalid relay alert: %v", err)
+
+			continue
+		}
+
+		// The key is made up of the encoded site and relay IDs followed
+		// by the alert key
+		parts := bytes.SplitN(iter.Key()[len(RELAY_ALERTS_PREFIX):], DELIMETER, 3)
+
+		if len(parts) != 3 {
+			continue
+		}
+
+		decodedSiteID, _ := base64.StdEncoding.DecodeString(string(parts[0]))
+		decodedRelayID, _ := base64.StdEncoding.DecodeString(string(parts[1]))
+		relayAlert.SiteID = string(decodedSiteID)
+		relayAlert.RelayID = string(decodedRelayID)
+		alerts = append(alerts, relayAlert)
+	}
+
+	if iter.Error() != nil {
+		Log.Errorf("Storage driver error in AlertStates(%s): %s", siteID, iter.Error().Error())
+
+		return nil, EStorage
+	}
+
+	return alerts, nil
+}
+
+// MergeRelayAlertStates combines the alert states read from several
+// owners of a site's partition, keeping the most recent state of each
+// alert of each relay
+func MergeRelayAlertStates(states ...[]RelayAlert) []RelayAlert {
+	type relayAlertKey struct {
+		siteID string
+		relayID string
+		key string
+	}
+
+	latest := make(map[relayAlertKey]int)
+	var merged []RelayAlert = make([]RelayAlert, 0)
+
+	for _, alerts := range states {
+		for _, relayAlert := range alerts {
+			key := relayAlertKey{ siteID: relayAlert.SiteID, relayID: relayAlert.RelayID, key: relayAlert.Key }
+
+			if i, ok := latest[key]; ok {
+				if relayAlert.Timestamp > merged[i].Timestamp {
+					merged[i] = relayAlert
+				}
+
+				continue
+			}
+
+			latest[key] = len(merged)
+			merged = append(merged, relayAlert)
+		}
+	}
+
+	return merged
+}
+
+// FiringRelayAlerts returns the alerts that are firing. If levels is not
+// empty only alerts at one of those levels are returned
+func FiringRelayAlerts(alerts []RelayAlert, levels []string) []RelayAlert {
+	var firing []RelayAlert = make([]RelayAlert, 0, len(alerts))
+
+	for _, relayAlert := range alerts {
+		if !relayAlert.Status || len(levels) != 0 && !containsString(levels, relayAlert.Level) {
+			continue
+		}
+
+		firing = append(firing, relayAlert)
+	}
+
+	return firing
+}
@@ -0,0 +1,163 @@
+package alerts_test
+//
+ // Copyright (c) 2019 ARM Limited.
+ //
+ // SPDX-License-Identifier: MIT
+ //
+ // Permission is hereby granted, free of charge, to any person obtaining a copy
+ // of this software and associated documentation files (the "Software"), to
+ // deal in the Software without restriction, including without limitation the
+ // rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ // sell copies of the Software, and to permit persons to whom the Software is
+ // furnished to do so, subject to the following conditions:
+ //
+ // The above copyright notice and this permission notice shall be included in all
+ // copies or substantial portions of the Software.
+ //
+ // THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ // IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ // FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ // AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ // LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ // SOFTWARE.
+ //
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/armPelionEdge/devicedb/alerts"
+	. "github.com/armPelionEdge/devicedb/storage"
+	. "github.com/armPelionEdge/devicedb/util"
+)
+
+var _ = Describe("SiteAlerts", func() {
+	var storageEngine StorageDriver
+	var siteAlerts *SiteAlerts
+
+	BeforeEach(func() {
+		var err error
+
+		storageEngine = MakeNewStorageDriver()
+		storageEngine.Open()
+		siteAlerts, err = NewSiteAlerts(storageEngine)
+
+		Expect(err).Should(BeNil())
+	})
+
+	AfterEach(func() {
+		storageEngine.Close()
+	})
+
+	It("Should keep the latest state of each alert per site and relay", func() {
+		Expect(siteAlerts.UpdateAlerts("site1", "relay1", []Alert{
+			Alert{ Key: "door", Level: "critical", Timestamp: 2000, Status: true },
+			Alert{ Key: "window", Level: "warning", Timestamp: 2000, Status: true },
+		}, 2000)).Should(BeNil())
+		Expect(siteAlerts.UpdateAlerts("site10", "relay2", []Alert{
+			Alert{ Key: "door", Level: "critical", Timestamp: 2000, Status: true },
+		}, 2000)).Should(BeNil())
+
+		// An older report does not replace a newer one
+		Expect(siteAlerts.UpdateAlerts("site1", "relay1", []Alert{
+			Alert{ Key: "door", Level: "critical", Timestamp: 1000, Status: false },
+			Alert{ Key: "window", Level: "warning", Timestamp: 3000, Status: false },
+		}, 3000)).Should(BeNil())
+
+		alerts, err := siteAlerts.Alerts("site1", nil)
+
+		Expect(err).Should(BeNil())
+		Expect(alerts).Should(Equal([]RelayAlert{
+			RelayAlert{ Alert: Alert{ Key: "door", Level: "critical", Timestamp: 2000, Status: true }, SiteID: "site1", RelayID: "relay1" },
+		}))
+
+		alerts, err = siteAlerts.Alerts("", []string{ "critical" })
+
+		Expect(err).Should(BeNil())
+		Expect(alerts).Should(HaveLen(2))
+
+		alerts, err = siteAlerts.Alerts("", []string{ "warning" })
+
+		Expect(err).Should(BeNil())
+		Expect(alerts).Should(BeEmpty())
+	})
+
+	It("Should raise a stale relay alert for relays that stop reporting until they report again", func() {
+		Expect(siteAlerts.Touch("site1", "relay1", 1000)).Should(BeNil())
+		Expect(siteAlerts.StaleRelays(5000, 5000)).Should(BeEmpty())
+		Expect(siteAlerts.StaleRelays(6000, 5000)).Should(Equal([]RelayReport{ RelayReport{ SiteID: "site1", RelayID: "relay1", LastReport: 1000 } }))
+
+		Expect(siteAlerts.MarkStale("site1", "relay1", 6000)).Should(BeNil())
+		Expect(siteAlerts.StaleRelays(7000, 5000)).Should(BeEmpty())
+
+		alerts, err := siteAlerts.Alerts("site1", nil)
+
+		Expect(err).Should(BeNil())
+		Expect(alerts).Should(HaveLen(1))
+		Expect(alerts[0].Key).Should(Equal(STALE_RELAY_ALERT))
+		Expect(alerts[0].Level).Should(Equal(STALE_RELAY_ALERT_LEVEL))
+
+		// Relays cannot clear the stale relay alert themselves
+		Expect(siteAlerts.UpdateAlerts("site1", "relay1", []Alert{ Alert{ Key: STALE_RELAY_ALERT, Timestamp: 8000, Status: true } }, 8000)).Should(BeNil())
+
+		alerts, err = siteAlerts.Alerts("site1", nil)
+
+		Expect(err).Should(BeNil())
+		Expect(alerts).Should(BeEmpty())
+	})
+
+	It("Should remember when relays last reported across restarts", func() {
+		Expect(siteAlerts.Touch("site1", "relay1", 1000)).Should(BeNil())
+
+		siteAlerts, err := NewSiteAlerts(storageEngine)
+
+		Expect(err).Should(BeNil())
+		Expect(siteAlerts.StaleRelays(6000, 5000)).Should(HaveLen(1))
+	})
+
+	It("Should return cleared alerts among the alert states", func() {
+		Expect(siteAlerts.UpdateAlerts("site1", "relay1", []Alert{
+			Alert{ Key: "door", Level: "critical", Timestamp: 2000, Status: true },
+			Alert{ Key: "window", Level: "warning", Timestamp: 2000, Status: false },
+		}, 2000)).Should(BeNil())
+
+		alerts, err := siteAlerts.AlertStates("site1")
+
+		Expect(err).Should(BeNil())
+		Expect(alerts).Should(HaveLen(2))
+		Expect(FiringRelayAlerts(alerts, nil)).Should(Equal([]RelayAlert{
+			RelayAlert{ Alert: Alert{ Key: "door", Level: "critical", Timestamp: 2000, Status: true }, SiteID: "site1", RelayID: "relay1" },
+		}))
+		Expect(FiringRelayAlerts(alerts, []string{ "warning" })).Should(BeEmpty())
+	})
+
+	It("Should keep the most recent state of each alert across owners", func() {
+		// The first owner missed the update that cleared the door alert
+		// and raised the window alert
+		stale := []RelayAlert{
+			RelayAlert{ Alert: Alert{ Key: "door", Level: "critical", Timestamp: 1000, Status: true }, SiteID: "site1", RelayID: "relay1" },
+		}
+		current := []RelayAlert{
+			RelayAlert{ Alert: Alert{ Key: "door", Level: "critical", Timestamp: 2000, Status: false }, SiteID: "site1", RelayID: "relay1" },
+			RelayAlert{ Alert: Alert{ Key: "window", Level: "warning", Timestamp: 2000, Status: true }, SiteID: "site1", RelayID: "relay1" },
+			RelayAlert{ Alert: Alert{ Key: "door", Level: "critical", Timestamp: 500, Status: true }, SiteID: "site1", RelayID: "relay2" },
+		}
+
+		Expect(FiringRelayAlerts(MergeRelayAlertStates(stale, current), nil)).Should(ConsistOf(
+			RelayAlert{ Alert: Alert{ Key: "window", Level: "warning", Timestamp: 2000, Status: true }, SiteID: "site1", RelayID: "relay1" },
+			RelayAlert{ Alert: Alert{ Key: "door", Level: "critical", Timestamp: 500, Status: true }, SiteID: "site1", RelayID: "relay2" },
+		))
+	})
+
+	It("Should forget the alerts and report of a relay", func() {
+		Expect(siteAlerts.UpdateAlerts("site1", "relay1", []Alert{ Alert{ Key: "door", Level: "critical", Timestamp: 2000, Status: true } }, 2000)).Should(BeNil())
+		Expect(siteAlerts.ForgetRelay("site1", "relay1")).Should(BeNil())
+		Expect(siteAlerts.StaleRelays(10000, 5000)).Should(BeEmpty())
+
+		alerts, err := siteAlerts.Alerts("", nil)
+
+		Expect(err).Should(BeNil())
+		Expect(alerts).Should(BeEmpty())
+	})
+})
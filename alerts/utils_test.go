@@ -61,6 +61,14 @@ func (alertStore *MockAlertStore) Get(key string) Alert {
 	return alertStore.alerts[key]
 }
 
+func (alertStore *MockAlertStore) Lookup(key string) (*Alert, error) {
+	if alert, ok := alertStore.alerts[key]; ok {
+		return &alert, nil
+	}
+
+	return nil, nil
+}
+
 func (alertStore *MockAlertStore) DeleteAll(alerts map[string]Alert) error {
 	if alertStore.deleteAllError != nil {
 		return alertStore.deleteAllError
@@ -42,7 +42,10 @@ type Bucket interface {
     ShouldAcceptReads(clientID string) bool
     RecordMetadata() error
     RebuildMerkleLeafs() error
+    Redepth(depth uint8) error
     MerkleTree() *MerkleTree
+    KeyCount() uint64
+    MerkleRootChanges() uint64
     GarbageCollect(tombstonePurgeAge uint64) error
     Get(keys [][]byte) ([]*SiblingSet, error)
     GetMatches(keys [][]byte) (SiblingSetIterator, error)
@@ -52,6 +55,10 @@ type Bucket interface {
     Batch(batch *UpdateBatch) (map[string]*SiblingSet, error)
     Merge(siblingSets map[string]*SiblingSet) error
     Watch(ctx context.Context, keys [][]byte, prefixes [][]byte, localVersion uint64, ch chan Row)
+    ChangeLogID() string
+    ChangeLogPosition() uint64
+    ChangeLogHorizon() uint64
+    ChangesSince(position uint64) (SiblingSetIterator, uint64, error)
     LockWrites()
     UnlockWrites()
     LockReads()
@@ -86,6 +86,7 @@ type Monitor struct {
     listeners map[*listener]bool
     mu sync.Mutex
     previousVersion uint64
+    nextVersion uint64
     updateHeap *UpdateHeap
 }
 
@@ -96,6 +97,7 @@ func NewMonitor(startVersion uint64) *Monitor {
     return &Monitor{
         listeners: make(map[*listener]bool),
         previousVersion: startVersion,
+        nextVersion: startVersion + 1,
         updateHeap: updateHeap,
     }
 }
@@ -141,6 +143,16 @@ func (monitor *Monitor) DiscardIDRange(low uint64, high uint64) {
     }
 }
 
+// NextVersion returns the lowest version that has not yet been
+// delivered. All versions below it have either been delivered or
+// discarded
+func (monitor *Monitor) NextVersion() uint64 {
+    monitor.mu.Lock()
+    defer monitor.mu.Unlock()
+
+    return monitor.nextVersion
+}
+
 func (monitor *Monitor) submitUpdate(update data.Row) {
     if update.LocalVersion < monitor.previousVersion || update.LocalVersion == monitor.previousVersion && update.LocalVersion != 0 {
         Log.Criticalf("An update was submitted to the monitor with key %s and version %d but the lowest expected version is %d. This update will not be sent. This should not happen and represents a bug in the watcher system.", update.Key, update.LocalVersion, monitor.previousVersion)
@@ -159,6 +171,7 @@ func (monitor *Monitor) flushUpdates() {
     // The reason this has to check if the localversion is 0 is in case it is the first update ever submitted.
     for monitor.updateHeap.Len() > 0 && (h[0].LocalVersion == 0 || h[0].LocalVersion == monitor.previousVersion + 1) {
         monitor.previousVersion = h[0].LocalVersion
+        monitor.nextVersion = h[0].LocalVersion + 1
         h = *monitor.updateHeap
         nextUpdate := heap.Pop(monitor.updateHeap).(*data.Row)
 
@@ -82,6 +82,10 @@ var _ = Describe("Monitor", func() {
                     monitor.AddListener(ctx, [][]byte{ }, [][]byte{ []byte("a") }, deliveryChannel)
                 })
 
+                AfterEach(func() {
+                    cancel()
+                })
+
                 Context("And the submitted update has a LocalVersion of 0", func() {
                     Specify("The update should be delivered to that listener right away", func() {
                         go monitor.Notify(data.Row{ Key: "abc", LocalVersion: 0, Siblings: &data.SiblingSet{ } })
@@ -171,6 +175,10 @@ var _ = Describe("Monitor", func() {
                     monitor.AddListener(ctx, [][]byte{ }, [][]byte{ []byte("a") }, deliveryChannel)
                 })
 
+                AfterEach(func() {
+                    cancel()
+                })
+
                 Context("And the submitted update has a LocalVersion of 0", func() {
                     Specify("The update should be discarded and not delivered to the listener", func() {
                         go monitor.Notify(data.Row{ Key: "abc", LocalVersion: 0, Siblings: &data.SiblingSet{ } })
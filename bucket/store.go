@@ -47,13 +47,21 @@ import (
 )
 
 const MAX_SORTING_KEY_LENGTH = 255
-const StorageFormatVersion = "1"
+const StorageFormatVersion = "2"
 const UpgradeFormatBatchSize = 100
+const RedepthBatchSize = 1000
 
 var MASTER_MERKLE_TREE_PREFIX = []byte{ 0 }
 var PARTITION_MERKLE_LEAF_PREFIX = []byte{ 1 }
 var PARTITION_DATA_PREFIX = []byte{ 2 }
 var NODE_METADATA_PREFIX = []byte{ 3 }
+var CHANGE_LOG_PREFIX = []byte{ 4 }
+
+var changeLogIDKey = encodeNodeMetadataKey([]byte("changeLogID"))
+var changeLogHorizonKey = encodeNodeMetadataKey([]byte("changeLogHorizon"))
+var changeLogFloorKey = encodeNodeMetadataKey([]byte("changeLogFloor"))
+var merkleDepthKey = encodeNodeMetadataKey([]byte("merkleDepth"))
+var merkleRedepthKey = encodeNodeMetadataKey([]byte("merkleRedepth"))
 
 func NanoToMilli(v uint64) uint64 {
     return v / 1000000
@@ -129,8 +137,38 @@ func encodeMetadataKey(k []byte) []byte {
     return result
 }
 
+// Older metadata keys share a prefix with the partition merkle leafs
+// and are wiped out whenever the merkle leafs are rebuilt. Metadata that
+// must survive a rebuild is stored under NODE_METADATA_PREFIX instead
+func encodeNodeMetadataKey(k []byte) []byte {
+    result := make([]byte, 0, len(NODE_METADATA_PREFIX) + len(k))
+    result = append(result, NODE_METADATA_PREFIX...)
+    result = append(result, k...)
+    
+    return result
+}
+
+func encodeChangeLogKey(localVersion uint64) []byte {
+    result := make([]byte, len(CHANGE_LOG_PREFIX) + 8)
+
+    copy(result, CHANGE_LOG_PREFIX)
+    binary.BigEndian.PutUint64(result[len(CHANGE_LOG_PREFIX):], localVersion)
+
+    return result
+}
+
+func encodeUint64(v uint64) []byte {
+    result := make([]byte, 8)
+
+    binary.BigEndian.PutUint64(result, v)
+
+    return result
+}
+
 type Store struct {
     nextRowID uint64    
+    keyCount uint64
+    merkleRootChanges uint64
     nodeID string
     storageDriver StorageDriver
     merkleTree *MerkleTree
@@ -142,6 +180,14 @@ type Store struct {
     storageFormatVersion string
     monitor *Monitor
     watcherLock sync.Mutex
+    committedRowID uint64
+    changeLogID string
+    changeLogHorizon uint64
+    changeLogLock sync.Mutex
+    redepthLock sync.Mutex
+    merkleSwapLock sync.RWMutex
+    merkleTreeLock sync.Mutex
+    shadowMerkleTree *MerkleTree
 }
 
 func (store *Store) Initialize(nodeID string, storageDriver StorageDriver, merkleDepth uint8, conflictResolver ConflictResolver) error {
@@ -154,7 +200,6 @@ func (store *Store) Initialize(nodeID string, storageDriver StorageDriver, merkl
     store.multiLock = NewMultiLock()
     store.merkleLock = NewMultiLock()
     store.conflictResolver = conflictResolver
-    store.merkleTree, _ = NewMerkleTree(merkleDepth)
     
     var err error
     dbMerkleDepth, storageFormatVersion, err := store.getStoreMetadata()
@@ -165,10 +210,25 @@ func (store *Store) Initialize(nodeID string, storageDriver StorageDriver, merkl
         return err
     }
 
+    chosenMerkleDepth, redepthInterrupted, err := store.getMerkleDepthMetadata()
+
+    if err != nil {
+        Log.Errorf("Error retrieving merkle depth metadata for node %s: %v", nodeID, err)
+
+        return err
+    }
+
+    // A depth chosen with Redepth() takes precedence over the one
+    // this store is initialized with
+    if chosenMerkleDepth != 0 {
+        merkleDepth = chosenMerkleDepth
+    }
+
+    store.merkleTree, _ = NewMerkleTree(merkleDepth)
     store.storageFormatVersion = storageFormatVersion
     
-    if dbMerkleDepth != merkleDepth || storageFormatVersion != StorageFormatVersion {
-        if dbMerkleDepth != merkleDepth {
+    if dbMerkleDepth != merkleDepth || storageFormatVersion != StorageFormatVersion || redepthInterrupted {
+        if dbMerkleDepth != merkleDepth || redepthInterrupted {
             Log.Debugf("Initializing node %s rebuilding merkle leafs with depth %d", nodeID, merkleDepth)
             
             err = store.RebuildMerkleLeafs()
@@ -201,6 +261,14 @@ func (store *Store) Initialize(nodeID string, storageDriver StorageDriver, merkl
             
             return err
         }
+
+        if redepthInterrupted {
+            if err := store.storageDriver.Batch(NewBatch().Delete(merkleRedepthKey)); err != nil {
+                Log.Errorf("Error clearing interrupted merkle re-depth for node %s: %v", nodeID, err)
+
+                return err
+            }
+        }
     }
 
     err = store.calculateNextRowID()
@@ -210,6 +278,14 @@ func (store *Store) Initialize(nodeID string, storageDriver StorageDriver, merkl
 
         return err
     }
+
+    err = store.initializeChangeLog()
+
+    if err != nil {
+        Log.Errorf("Error initializing change log for node %s: %v", nodeID, err)
+
+        return err
+    }
     
     err = store.initializeMerkleTree()
     
@@ -224,10 +300,53 @@ func (store *Store) Initialize(nodeID string, storageDriver StorageDriver, merkl
     } else {
         store.monitor = NewMonitor(store.nextRowID - 1)
     }
+
+    store.monitor.nextVersion = store.nextRowID
+    store.committedRowID = store.nextRowID
     
     return nil
 }
 
+func (store *Store) initializeChangeLog() error {
+    values, err := store.storageDriver.Get([][]byte{ changeLogIDKey, changeLogHorizonKey })
+
+    if err != nil {
+        return err
+    }
+
+    if values[1] != nil && len(values[1]) == 8 {
+        store.changeLogHorizon = binary.BigEndian.Uint64(values[1])
+    }
+
+    if values[0] != nil {
+        store.changeLogID = string(values[0])
+
+        return nil
+    }
+
+    // This is the first time this store has been opened with a change log. Any
+    // tombstones purged before now are unaccounted for so the horizon starts
+    // at the current end of the log
+    changeLogID, err := UUID()
+
+    if err != nil {
+        return err
+    }
+
+    batch := NewBatch()
+    batch.Put(changeLogIDKey, []byte(changeLogID))
+    batch.Put(changeLogHorizonKey, encodeUint64(store.nextRowID))
+
+    if err := store.storageDriver.Batch(batch); err != nil {
+        return err
+    }
+
+    store.changeLogID = changeLogID
+    store.changeLogHorizon = store.nextRowID
+
+    return nil
+}
+
 func (store *Store) initializeMerkleTree() error {
     iter, err := store.storageDriver.GetMatches([][]byte{ MASTER_MERKLE_TREE_PREFIX })
     
@@ -273,17 +392,36 @@ func (store *Store) calculateNextRowID() error {
     }
 
     store.nextRowID = 0
+    store.keyCount = 0
     defer iter.Release()
 
     for iter.Next() {
+        store.keyCount++
+
         if iter.LocalVersion() >= store.nextRowID {
             store.nextRowID = iter.LocalVersion() + 1
         }
     }
 
+    if iter.Error() != nil {
+        return iter.Error()
+    }
+
+    // Rows at the end of the log may have been forgotten or purged. Row IDs
+    // must never be reused since peers may have already seen them
+    values, err := store.storageDriver.Get([][]byte{ changeLogFloorKey })
+
+    if err != nil {
+        return err
+    }
+
+    if values[0] != nil && len(values[0]) == 8 && binary.BigEndian.Uint64(values[0]) > store.nextRowID {
+        store.nextRowID = binary.BigEndian.Uint64(values[0])
+    }
+
     Log.Infof("Next row ID = %d", store.nextRowID)
 
-    return iter.Error()
+    return nil
 }
 
 func (store *Store) getStoreMetadata() (uint8, string, error) {
@@ -307,6 +445,25 @@ func (store *Store) getStoreMetadata() (uint8, string, error) {
     return merkleDepth, storageFormatVersion, nil
 }
 
+// getMerkleDepthMetadata returns the depth last chosen for this store by
+// Redepth(), or zero if there is none, and whether a re-depth was cut
+// short before it could tidy up the merkle leaf index
+func (store *Store) getMerkleDepthMetadata() (uint8, bool, error) {
+    values, err := store.storageDriver.Get([][]byte{ merkleDepthKey, merkleRedepthKey })
+
+    if err != nil {
+        return 0, false, err
+    }
+
+    var merkleDepth uint8
+
+    if len(values[0]) == 1 && values[0][0] >= MerkleMinDepth && values[0][0] <= MerkleMaxDepth {
+        merkleDepth = values[0][0]
+    }
+
+    return merkleDepth, values[1] != nil, nil
+}
+
 func (store *Store) RecordMetadata() error {
     batch := NewBatch()
     
@@ -400,6 +557,24 @@ func (store *Store) RebuildMerkleLeafs() error {
 }
 
 func (store *Store) UpgradeStorageFormat() error {
+    if store.storageFormatVersion == "0" {
+        if err := store.upgradeRowFormat(); err != nil {
+            return err
+        }
+    }
+
+    if err := store.RebuildChangeLog(); err != nil {
+        Log.Errorf("Unable to rebuild change log while upgrading storage format: %v", err.Error())
+
+        return err
+    }
+
+    store.storageFormatVersion = StorageFormatVersion
+
+    return nil
+}
+
+func (store *Store) upgradeRowFormat() error {
     iter, err := store.GetAll()
 
     if err != nil {
@@ -446,15 +621,326 @@ func (store *Store) UpgradeStorageFormat() error {
         return iter.Error()
     }
 
-    store.storageFormatVersion = StorageFormatVersion
+    store.storageFormatVersion = "1"
+
+    return nil
+}
+
+// RebuildChangeLog discards the change log index and rebuilds
+// it from the local versions of the rows currently in the store
+func (store *Store) RebuildChangeLog() error {
+    iter, err := store.storageDriver.GetMatches([][]byte{ CHANGE_LOG_PREFIX })
+
+    if err != nil {
+        return err
+    }
+
+    batch := NewBatch()
+    batchSize := 0
+
+    for iter.Next() {
+        batch.Delete(iter.Key())
+        batchSize++
+
+        if batchSize == UpgradeFormatBatchSize {
+            if err := store.storageDriver.Batch(batch); err != nil {
+                iter.Release()
+
+                return err
+            }
+
+            batch = NewBatch()
+            batchSize = 0
+        }
+    }
+
+    iter.Release()
+
+    if iter.Error() != nil {
+        return iter.Error()
+    }
+
+    ssIter, err := store.GetAll()
+
+    if err != nil {
+        return err
+    }
+
+    defer ssIter.Release()
+
+    for ssIter.Next() {
+        batch.Put(encodeChangeLogKey(ssIter.LocalVersion()), ssIter.Key())
+        batchSize++
+
+        if batchSize == UpgradeFormatBatchSize {
+            if err := store.storageDriver.Batch(batch); err != nil {
+                return err
+            }
+
+            batch = NewBatch()
+            batchSize = 0
+        }
+    }
+
+    if ssIter.Error() != nil {
+        return ssIter.Error()
+    }
+
+    if batchSize > 0 {
+        return store.storageDriver.Batch(batch)
+    }
 
     return nil
 }
 
 func (store *Store) MerkleTree() *MerkleTree {
+    store.merkleTreeLock.Lock()
+    defer store.merkleTreeLock.Unlock()
+
     return store.merkleTree
 }
 
+// KeyCount returns the number of keys in this store, tombstones included
+func (store *Store) KeyCount() uint64 {
+    return atomic.LoadUint64(&store.keyCount)
+}
+
+// MerkleRootChanges returns the number of writes that changed the merkle
+// root hash of this store since it was opened
+func (store *Store) MerkleRootChanges() uint64 {
+    return atomic.LoadUint64(&store.merkleRootChanges)
+}
+
+// Redepth rebuilds the merkle tree of this store at a new depth without
+// taking the store offline. The new tree is built from a snapshot of the
+// store and every write made after the snapshot is applied to it as well,
+// so writes are only held back while the trees are swapped. From then on
+// the new depth is used whenever the store is initialized, whatever depth
+// it is initialized with.
+func (store *Store) Redepth(depth uint8) error {
+    merkleTree, err := NewMerkleTree(depth)
+
+    if err != nil {
+        return EMerkleDepth
+    }
+
+    store.redepthLock.Lock()
+    defer store.redepthLock.Unlock()
+
+    if store.MerkleTree().Depth() == depth {
+        return nil
+    }
+
+    // Until the leaf index is pruned it holds entries for both depths. If the
+    // process stops before then the next call to Initialize() rebuilds it
+    if err := store.storageDriver.Batch(NewBatch().Put(merkleRedepthKey, []byte{ depth })); err != nil {
+        Log.Errorf("Storage driver error in Redepth(%d): %s", depth, err.Error())
+
+        return EStorage
+    }
+
+    Log.Infof("Re-depthing merkle tree of node %s from depth %d to depth %d", store.nodeID, store.MerkleTree().Depth(), depth)
+
+    store.merkleSwapLock.Lock()
+    iter, err := store.storageDriver.GetMatches([][]byte{ PARTITION_DATA_PREFIX })
+
+    if err == nil {
+        store.shadowMerkleTree = merkleTree
+    }
+
+    store.merkleSwapLock.Unlock()
+
+    if err != nil {
+        Log.Errorf("Storage driver error in Redepth(%d): %s", depth, err.Error())
+
+        return EStorage
+    }
+
+    buildErr := store.buildMerkleTree(merkleTree, NewBasicSiblingSetIterator(iter, store.storageFormatVersion))
+
+    store.merkleSwapLock.Lock()
+
+    if buildErr == nil {
+        buildErr = store.installMerkleTree(merkleTree)
+    }
+
+    store.shadowMerkleTree = nil
+    store.merkleSwapLock.Unlock()
+
+    if buildErr != nil {
+        Log.Errorf("Storage driver error in Redepth(%d): %s", depth, buildErr.Error())
+    }
+
+    if err := store.pruneMerkleLeafIndex(); err != nil {
+        Log.Errorf("Unable to prune merkle leaf index in Redepth(%d): %s", depth, err.Error())
+
+        return EStorage
+    }
+
+    if err := store.storageDriver.Batch(NewBatch().Delete(merkleRedepthKey)); err != nil {
+        Log.Errorf("Storage driver error in Redepth(%d): %s", depth, err.Error())
+
+        return EStorage
+    }
+
+    if buildErr != nil {
+        return EStorage
+    }
+
+    Log.Infof("Merkle tree of node %s is now at depth %d", store.nodeID, depth)
+
+    return nil
+}
+
+// buildMerkleTree adds every row in a snapshot of the store to a merkle tree
+// and indexes the rows under the leafs they belong to in that tree. Rows
+// are indexed in batches with their keys locked so that rows deleted since
+// the snapshot was taken are not indexed again
+func (store *Store) buildMerkleTree(merkleTree *MerkleTree, siblingSetIterator SiblingSetIterator) error {
+    defer siblingSetIterator.Release()
+
+    keys := make([][]byte, 0, RedepthBatchSize)
+
+    for siblingSetIterator.Next() {
+        key := append([]byte{ }, siblingSetIterator.Key()...)
+
+        merkleTree.Update(NewUpdate().AddDiff(string(key), nil, siblingSetIterator.Value()))
+        keys = append(keys, key)
+
+        if len(keys) == RedepthBatchSize {
+            if err := store.indexMerkleLeafs(merkleTree, keys); err != nil {
+                return err
+            }
+
+            keys = keys[:0]
+        }
+    }
+
+    if siblingSetIterator.Error() != nil {
+        return siblingSetIterator.Error()
+    }
+
+    return store.indexMerkleLeafs(merkleTree, keys)
+}
+
+func (store *Store) indexMerkleLeafs(merkleTree *MerkleTree, keys [][]byte) error {
+    if len(keys) == 0 {
+        return nil
+    }
+
+    store.merkleSwapLock.RLock()
+    defer store.merkleSwapLock.RUnlock()
+
+    store.lock(keys)
+    defer store.unlock(keys, false)
+
+    rowKeys := make([][]byte, len(keys))
+
+    for i, key := range keys {
+        rowKeys[i] = encodePartitionDataKey(key)
+    }
+
+    values, err := store.storageDriver.Get(rowKeys)
+
+    if err != nil {
+        return err
+    }
+
+    batch := NewBatch()
+
+    for i, key := range keys {
+        if values[i] != nil {
+            batch.Put(encodePartitionMerkleLeafKey(merkleTree.LeafNode(key), key), []byte{ })
+        }
+    }
+
+    return store.storageDriver.Batch(batch)
+}
+
+// installMerkleTree replaces the leaf hashes of the current merkle tree with
+// those of a new one and makes it the current tree. The caller must hold
+// merkleSwapLock for writing
+func (store *Store) installMerkleTree(merkleTree *MerkleTree) error {
+    iter, err := store.storageDriver.GetMatches([][]byte{ MASTER_MERKLE_TREE_PREFIX })
+
+    if err != nil {
+        return err
+    }
+
+    defer iter.Release()
+
+    batch := NewBatch()
+
+    for iter.Next() {
+        batch.Delete(append([]byte{ }, iter.Key()...))
+    }
+
+    if iter.Error() != nil {
+        return iter.Error()
+    }
+
+    for leafID := uint32(1); leafID < merkleTree.NodeLimit(); leafID += 2 {
+        if merkleTree.NodeHash(leafID).High() != 0 || merkleTree.NodeHash(leafID).Low() != 0 {
+            leafHash := merkleTree.NodeHash(leafID).Bytes()
+            batch.Put(encodeMerkleLeafKey(leafID), leafHash[:])
+        }
+    }
+
+    batch.Put(encodeMetadataKey([]byte("merkleDepth")), []byte{ byte(merkleTree.Depth()) })
+    batch.Put(merkleDepthKey, []byte{ byte(merkleTree.Depth()) })
+
+    if err := store.storageDriver.Batch(batch); err != nil {
+        return err
+    }
+
+    store.merkleTreeLock.Lock()
+    store.merkleTree = merkleTree
+    store.merkleTreeLock.Unlock()
+
+    return nil
+}
+
+// pruneMerkleLeafIndex deletes the entries in the merkle leaf index that
+// don't match the leaf their key belongs to in the current merkle tree
+func (store *Store) pruneMerkleLeafIndex() error {
+    merkleTree := store.MerkleTree()
+    iter, err := store.storageDriver.GetMatches([][]byte{ PARTITION_MERKLE_LEAF_PREFIX })
+
+    if err != nil {
+        return err
+    }
+
+    defer iter.Release()
+
+    batch := NewBatch()
+
+    for iter.Next() {
+        leafID, key, err := decodePartitionMerkleLeafKey(iter.Key())
+
+        // Older metadata keys share a prefix with the index. Their
+        // leaf IDs are beyond the reach of any merkle depth
+        if err != nil || leafID >= 1 << MerkleMaxDepth || leafID == merkleTree.LeafNode(key) {
+            continue
+        }
+
+        batch.Delete(append([]byte{ }, iter.Key()...))
+
+        if batch.Size() == RedepthBatchSize {
+            if err := store.storageDriver.Batch(batch); err != nil {
+                return err
+            }
+
+            batch = NewBatch()
+        }
+    }
+
+    if iter.Error() != nil {
+        return iter.Error()
+    }
+
+    return store.storageDriver.Batch(batch)
+}
+
 func (store *Store) GarbageCollect(tombstonePurgeAge uint64) error {
     iter, err := store.storageDriver.GetMatches([][]byte{ PARTITION_DATA_PREFIX })
     
@@ -481,38 +967,61 @@ func (store *Store) GarbageCollect(tombstonePurgeAge uint64) error {
             continue
         }
         
+        store.merkleSwapLock.RLock()
         store.lock([][]byte{ key })
         
         func() {
             // the key must be re-queried because at the time of iteration we did not have a lock
             // on the key in order to update it
-            siblingSets, err := store.Get([][]byte{ key })
+            row, err := store.getRow(key)
             
             if err != nil {
                 return
             }
             
-            siblingSet := siblingSets[0]
-            
-            if siblingSet == nil {
+            if row == nil {
                 return
             }
         
-            if !siblingSet.CanPurge(now - tombstonePurgeAge) {
+            if !row.Siblings.CanPurge(now - tombstonePurgeAge) {
                 return
             }
         
             Log.Debugf("GC: Purge tombstone at key %s. It is older than %d milliseconds", string(key), tombstonePurgeAge)
             leafID := store.merkleTree.LeafNode(key)
             
+            store.changeLogLock.Lock()
+            defer store.changeLogLock.Unlock()
+
+            // Peers that have not yet read this row from the change log will never
+            // see the tombstone so they need to fall back to a full merkle sync
+            horizon := store.changeLogHorizon
+
+            if row.LocalVersion + 1 > horizon {
+                horizon = row.LocalVersion + 1
+            }
+
             batch := NewBatch()
             batch.Delete(encodePartitionMerkleLeafKey(leafID, key))
             batch.Delete(encodePartitionDataKey(key))
+            batch.Delete(encodeChangeLogKey(row.LocalVersion))
+            batch.Put(changeLogHorizonKey, encodeUint64(horizon))
+            batch.Put(changeLogFloorKey, encodeUint64(atomic.LoadUint64(&store.nextRowID)))
+
+            if store.shadowMerkleTree != nil {
+                batch.Delete(encodePartitionMerkleLeafKey(store.shadowMerkleTree.LeafNode(key), key))
+            }
         
             err = store.storageDriver.Batch(batch)
+
+            if err == nil {
+                store.changeLogHorizon = horizon
+                atomic.AddUint64(&store.keyCount, ^uint64(0))
+            }
         }()
         
         store.unlock([][]byte{ key }, false)
+        store.merkleSwapLock.RUnlock()
         
         if err != nil {
             Log.Errorf("Garbage collection error: %s", err.Error())
@@ -664,6 +1173,9 @@ func (store *Store) GetSyncChildren(nodeID uint32) (SiblingSetIterator, error) {
 
     defer store.readsTryLock.RUnlock()
 
+    store.merkleSwapLock.RLock()
+    defer store.merkleSwapLock.RUnlock()
+
     if nodeID >= store.merkleTree.NodeLimit() {
         return nil, EMerkleRange
     }
@@ -688,40 +1200,66 @@ func (store *Store) Forget(keys [][]byte) error {
             continue
         }
 
+        store.merkleSwapLock.RLock()
         store.lock([][]byte{ key })
         
-        siblingSets, err := store.Get([][]byte{ key })
+        row, err := store.getRow(key)
         
         if err != nil {
             Log.Errorf("Unable to forget key %s due to storage error: %v", string(key), err)
 
             store.unlock([][]byte{ key }, false)
+            store.merkleSwapLock.RUnlock()
 
             return EStorage
         }
         
-        siblingSet := siblingSets[0]
-        
-        if siblingSet == nil {
+        if row == nil {
             store.unlock([][]byte{ key }, false)
+            store.merkleSwapLock.RUnlock()
 
             continue
         }
 
+        siblingSet := row.Siblings
+
         // Update merkle tree to reflect deletion
         leafID := store.merkleTree.LeafNode(key)
         newLeafHash := store.merkleTree.NodeHash(leafID).Xor(siblingSet.Hash(key))
         store.merkleTree.UpdateLeafHash(leafID, newLeafHash)
 
+        // Nothing is left in the change log for peers to read the removal
+        // from so the horizon moves past a row ID reserved for it. Peers that
+        // replay the change log from below it fall back to a full merkle sync
+        rowID := atomic.AddUint64(&store.nextRowID, 1) - 1
+
+        store.changeLogLock.Lock()
+
         batch := NewBatch()
         batch.Delete(encodePartitionMerkleLeafKey(leafID, key))
         batch.Delete(encodePartitionDataKey(key))
+        batch.Delete(encodeChangeLogKey(row.LocalVersion))
+        batch.Put(changeLogHorizonKey, encodeUint64(rowID + 1))
+        batch.Put(changeLogFloorKey, encodeUint64(rowID + 1))
         leafHashBytes := newLeafHash.Bytes()
         batch.Put(encodeMerkleLeafKey(leafID), leafHashBytes[:])
+
+        if store.shadowMerkleTree != nil {
+            store.shadowMerkleTree.Update(NewUpdate().AddDiff(string(key), siblingSet, nil))
+            batch.Delete(encodePartitionMerkleLeafKey(store.shadowMerkleTree.LeafNode(key), key))
+        }
     
         err = store.storageDriver.Batch(batch)
+
+        if err == nil {
+            store.changeLogHorizon = rowID + 1
+        }
+
+        store.changeLogLock.Unlock()
+        store.skipRowID(rowID)
         
         store.unlock([][]byte{ key }, false)
+        store.merkleSwapLock.RUnlock()
         
         if err != nil {
             Log.Errorf("Unable to forget key %s due to storage error: %v", string(key), err.Error())
@@ -729,14 +1267,43 @@ func (store *Store) Forget(keys [][]byte) error {
             return EStorage
         }
 
+        atomic.AddUint64(&store.keyCount, ^uint64(0))
+
+        if siblingSet.Hash(key) != (Hash{}) {
+            atomic.AddUint64(&store.merkleRootChanges, 1)
+        }
+
         Log.Debugf("Forgot key %s", string(key))
     }
     
     return nil
 }
 
-func (store *Store) updateInit(keys [][]byte) (map[string]*SiblingSet, error) {
+func (store *Store) getRow(key []byte) (*Row, error) {
+    values, err := store.storageDriver.Get([][]byte{ encodePartitionDataKey(key) })
+
+    if err != nil {
+        return nil, err
+    }
+
+    if values[0] == nil {
+        return nil, nil
+    }
+
+    var row Row
+
+    if err := row.Decode(values[0], store.storageFormatVersion); err != nil {
+        return nil, err
+    }
+
+    row.Key = string(key)
+
+    return &row, nil
+}
+
+func (store *Store) updateInit(keys [][]byte) (map[string]*SiblingSet, map[string]uint64, error) {
     siblingSetMap := map[string]*SiblingSet{ }
+    localVersions := map[string]uint64{ }
     
     // db objects
     for i := 0; i < len(keys); i += 1 {
@@ -748,7 +1315,7 @@ func (store *Store) updateInit(keys [][]byte) (map[string]*SiblingSet, error) {
     if err != nil {
         Log.Errorf("Storage driver error in updateInit(%v): %s", keys, err.Error())
         
-        return nil, EStorage
+        return nil, nil, EStorage
     }
     
     for i := 0; i < len(keys); i += 1 {
@@ -764,19 +1331,20 @@ func (store *Store) updateInit(keys [][]byte) (map[string]*SiblingSet, error) {
             if err != nil {
                 Log.Warningf("Could not decode sibling set in updateInit(%v): %s", keys, err.Error())
                 
-                return nil, EStorage
+                return nil, nil, EStorage
             }
             
             siblingSetMap[string(key)] = row.Siblings
+            localVersions[string(key)] = row.LocalVersion
         }
         
         values = values[1:]
     }
     
-    return siblingSetMap, nil
+    return siblingSetMap, localVersions, nil
 }
 
-func (store *Store) batch(update *Update, merkleTree *MerkleTree) (*Batch, []Row) {
+func (store *Store) batch(update *Update, merkleTree *MerkleTree, localVersions map[string]uint64) (*Batch, []Row) {
     _, leafNodes := merkleTree.Update(update)
     batch := NewBatch()
     updatedRows := make([]Row, 0, update.Size())
@@ -805,11 +1373,58 @@ func (store *Store) batch(update *Update, merkleTree *MerkleTree) (*Batch, []Row
         nextRowID++
         
         batch.Put(encodePartitionDataKey(key), row.Encode())
+
+        if localVersion, ok := localVersions[diff.Key()]; ok {
+            batch.Delete(encodeChangeLogKey(localVersion))
+        }
+
+        batch.Put(encodeChangeLogKey(row.LocalVersion), key)
+    }
+
+    // A re-depth is under way. The tree it is building has to reflect this
+    // update too and the keys are indexed under the leafs they will belong to
+    if store.shadowMerkleTree != nil {
+        _, shadowLeafNodes := store.shadowMerkleTree.Update(update)
+
+        for leafID, _ := range shadowLeafNodes {
+            for key, _ := range shadowLeafNodes[leafID] {
+                batch.Put(encodePartitionMerkleLeafKey(leafID, []byte(key)), []byte{ })
+            }
+        }
     }
 
     return batch, updatedRows
 }
 
+func (store *Store) undoUpdate(update *Update) {
+    store.merkleTree.UndoUpdate(update)
+
+    if store.shadowMerkleTree != nil {
+        store.shadowMerkleTree.UndoUpdate(update)
+    }
+}
+
+func (store *Store) countNewKeys(update *Update) {
+    for diff := range update.Iter() {
+        if diff.OldSiblingSet() == nil || diff.OldSiblingSet().Size() == 0 {
+            atomic.AddUint64(&store.keyCount, 1)
+        }
+    }
+
+    // The root hash is the xor of the hashes of every key so the batch
+    // changed it if the hashes it replaced differ from those it wrote.
+    // Reading the root before and after would also see concurrent batches
+    var rootDiff Hash
+
+    for diff := range update.Iter() {
+        rootDiff = rootDiff.Xor(diff.OldSiblingSet().Hash([]byte(diff.Key()))).Xor(diff.NewSiblingSet().Hash([]byte(diff.Key())))
+    }
+
+    if rootDiff != (Hash{}) {
+        atomic.AddUint64(&store.merkleRootChanges, 1)
+    }
+}
+
 func (store *Store) updateToSibling(o Op, c *DVV, oldestTombstone *Sibling) *Sibling {
     if o.IsDelete() {
         if oldestTombstone == nil {
@@ -844,11 +1459,14 @@ func (store *Store) Batch(batch *UpdateBatch) (map[string]*SiblingSet, error) {
         keys = append(keys, keyBytes)
     }
     
+    store.merkleSwapLock.RLock()
+    defer store.merkleSwapLock.RUnlock()
+
     store.lock(keys)
     defer store.unlock(keys, true)
 
     merkleTree := store.merkleTree
-    siblingSets, err := store.updateInit(keys)
+    siblingSets, localVersions, err := store.updateInit(keys)
     
     //return nil, nil
     if err != nil {
@@ -889,18 +1507,19 @@ func (store *Store) Batch(batch *UpdateBatch) (map[string]*SiblingSet, error) {
         update.AddDiff(key, siblingSet, updatedSiblingSet)
     }
     
-    storageBatch, updatedRows := store.batch(update, merkleTree)
+    storageBatch, updatedRows := store.batch(update, merkleTree, localVersions)
     err = store.storageDriver.Batch(storageBatch)
     
     if err != nil {
         Log.Errorf("Storage driver error in Batch(%v): %s", batch, err.Error())
 
         store.discardIDRange(updatedRows)
-        store.merkleTree.UndoUpdate(update)
+        store.undoUpdate(update)
         
         return nil, EStorage
     }
 
+    store.countNewKeys(update)
     store.notifyWatchers(updatedRows)
     
     return siblingSets, nil
@@ -925,11 +1544,14 @@ func (store *Store) Merge(siblingSets map[string]*SiblingSet) error {
         keys = append(keys, []byte(key))
     }
     
+    store.merkleSwapLock.RLock()
+    defer store.merkleSwapLock.RUnlock()
+
     store.lock(keys)
     defer store.unlock(keys, true)
     
     merkleTree := store.merkleTree
-    mySiblingSets, err := store.updateInit(keys)
+    mySiblingSets, localVersions, err := store.updateInit(keys)
     
     if err != nil {
         return err
@@ -962,24 +1584,87 @@ func (store *Store) Merge(siblingSets map[string]*SiblingSet) error {
     }
 
     if update.Size() != 0 {
-        batch, updatedRows := store.batch(update, merkleTree)
+        batch, updatedRows := store.batch(update, merkleTree, localVersions)
         err := store.storageDriver.Batch(batch)
 
         if err != nil {
             Log.Errorf("Storage driver error in Merge(%v): %s", siblingSets, err.Error())
 
             store.discardIDRange(updatedRows)
-            store.merkleTree.UndoUpdate(update)
+            store.undoUpdate(update)
 
             return EStorage
         }
 
+        store.countNewKeys(update)
         store.notifyWatchers(updatedRows)
     }
     
     return nil
 }
 
+// ChangeLogID identifies the sequence of local versions assigned
+// by this store. Positions in the change log of one store are
+// meaningless to any other store.
+func (store *Store) ChangeLogID() string {
+    return store.changeLogID
+}
+
+// ChangeLogPosition returns the position up to which the change
+// log is complete. Every row with a local version lower than
+// the position has been committed and no rows will be added
+// below it in the future.
+func (store *Store) ChangeLogPosition() uint64 {
+    store.watcherLock.Lock()
+    defer store.watcherLock.Unlock()
+
+    position := store.monitor.NextVersion()
+
+    if store.committedRowID < position {
+        position = store.committedRowID
+    }
+
+    return position
+}
+
+// ChangeLogHorizon returns the lowest position from which the
+// change log can still be replayed. Tombstones for rows below
+// the horizon may have been purged by garbage collection.
+func (store *Store) ChangeLogHorizon() uint64 {
+    store.changeLogLock.Lock()
+    defer store.changeLogLock.Unlock()
+
+    return store.changeLogHorizon
+}
+
+// ChangesSince iterates over all rows whose local version falls
+// between the given position and the current change log position,
+// in the order in which they were written. It also returns the
+// change log position at the end of the iteration.
+func (store *Store) ChangesSince(position uint64) (SiblingSetIterator, uint64, error) {
+    if !store.readsTryLock.TryRLock() {
+        return nil, 0, EOperationLocked
+    }
+
+    defer store.readsTryLock.RUnlock()
+
+    end := store.ChangeLogPosition()
+
+    if position > end {
+        position = end
+    }
+
+    iter, err := store.storageDriver.GetRange(encodeChangeLogKey(position), encodeChangeLogKey(end))
+
+    if err != nil {
+        Log.Errorf("Storage driver error in ChangesSince(%d): %s", position, err.Error())
+
+        return nil, 0, EStorage
+    }
+
+    return NewChangeLogIterator(iter, store.storageDriver, store.storageFormatVersion), end, nil
+}
+
 func (store *Store) Watch(ctx context.Context, keys [][]byte, prefixes [][]byte, localVersion uint64, ch chan Row) {
     store.addWatcher(ctx, keys, prefixes, localVersion, ch)
 }
@@ -1081,6 +1766,10 @@ func (store *Store) notifyWatchers(updatedRows []Row) {
     // submit update to watcher collection
     for _, update := range updatedRows {
         store.monitor.Notify(update)
+
+        if update.LocalVersion + 1 > store.committedRowID {
+            store.committedRowID = update.LocalVersion + 1
+        }
     }
 }
 
@@ -1095,6 +1784,19 @@ func (store *Store) discardIDRange(updatedRows []Row) {
     store.monitor.DiscardIDRange(updatedRows[0].LocalVersion, updatedRows[len(updatedRows) - 1].LocalVersion)
 }
 
+// Releases a row ID that was reserved without writing a row so the
+// change log position can move past it
+func (store *Store) skipRowID(rowID uint64) {
+    store.watcherLock.Lock()
+    defer store.watcherLock.Unlock()
+
+    store.monitor.DiscardIDRange(rowID, rowID)
+
+    if rowID + 1 > store.committedRowID {
+        store.committedRowID = rowID + 1
+    }
+}
+
 func (store *Store) sortedLockKeys(keys [][]byte) ([]string, []string) {
     leafSet := make(map[string]bool, len(keys))
     keyStrings := make([]string, 0, len(keys))
@@ -1380,6 +2082,110 @@ func (mIterator *MerkleChildrenIterator) Error() error {
     return nil
 }
 
+type ChangeLogIterator struct {
+    dbIterator StorageIterator
+    storageDriver StorageDriver
+    parseError error
+    currentKey []byte
+    currentValue *SiblingSet
+    storageFormatVersion string
+    currentLocalVersion uint64
+}
+
+func NewChangeLogIterator(iter StorageIterator, storageDriver StorageDriver, storageFormatVersion string) *ChangeLogIterator {
+    return &ChangeLogIterator{ iter, storageDriver, nil, nil, nil, storageFormatVersion, 0 }
+}
+
+func (clIterator *ChangeLogIterator) Next() bool {
+    clIterator.currentKey = nil
+    clIterator.currentValue = nil
+    clIterator.currentLocalVersion = 0
+
+    for clIterator.dbIterator.Next() {
+        key := append([]byte{ }, clIterator.dbIterator.Value()...)
+        localVersion := binary.BigEndian.Uint64(clIterator.dbIterator.Key()[len(CHANGE_LOG_PREFIX):])
+        values, err := clIterator.storageDriver.Get([][]byte{ encodePartitionDataKey(key) })
+
+        if err != nil {
+            Log.Errorf("Storage driver error in Next(): %s", err)
+
+            clIterator.parseError = err
+            clIterator.Release()
+
+            return false
+        }
+
+        if values[0] == nil {
+            // The row was forgotten or purged after the iterator was created
+            continue
+        }
+
+        var row Row
+
+        clIterator.parseError = row.Decode(values[0], clIterator.storageFormatVersion)
+
+        if clIterator.parseError != nil {
+            Log.Errorf("Storage driver error in Next() key = %v, value = %v: %s", key, values[0], clIterator.parseError.Error())
+
+            clIterator.Release()
+
+            return false
+        }
+
+        if row.LocalVersion != localVersion {
+            // The row was updated after the iterator was created. The newer
+            // version will appear later in the log
+            continue
+        }
+
+        clIterator.currentKey = key
+        clIterator.currentValue = row.Siblings
+        clIterator.currentLocalVersion = row.LocalVersion
+
+        return true
+    }
+
+    if clIterator.dbIterator.Error() != nil {
+        Log.Errorf("Storage driver error in Next(): %s", clIterator.dbIterator.Error())
+    }
+
+    clIterator.Release()
+
+    return false
+}
+
+func (clIterator *ChangeLogIterator) Prefix() []byte {
+    return nil
+}
+
+func (clIterator *ChangeLogIterator) Key() []byte {
+    return clIterator.currentKey
+}
+
+func (clIterator *ChangeLogIterator) Value() *SiblingSet {
+    return clIterator.currentValue
+}
+
+func (clIterator *ChangeLogIterator) LocalVersion() uint64 {
+    return clIterator.currentLocalVersion
+}
+
+func (clIterator *ChangeLogIterator) Release() {
+    clIterator.dbIterator.Release()
+}
+
+func (clIterator *ChangeLogIterator) Error() error {
+    if clIterator.parseError != nil {
+        return EStorage
+    }
+
+    if clIterator.dbIterator.Error() != nil {
+        return EStorage
+    }
+
+    return nil
+}
+
 type BasicSiblingSetIterator struct {
     dbIterator StorageIterator
     parseError error
@@ -496,6 +496,270 @@ var _ = Describe("Store", func() {
             })
         })
     })
+
+    Describe("#ChangesSince", func() {
+        var storageEngine StorageDriver
+        var store *Store
+
+        changedKeys := func(position uint64) ([]string, uint64) {
+            iter, end, err := store.ChangesSince(position)
+
+            Expect(err).Should(BeNil())
+
+            keys := []string{ }
+
+            for iter.Next() {
+                keys = append(keys, string(iter.Key()))
+            }
+
+            Expect(iter.Error()).Should(BeNil())
+            iter.Release()
+
+            return keys, end
+        }
+
+        BeforeEach(func() {
+            storageEngine = makeNewStorageDriver()
+            storageEngine.Open()
+            store = &Store{ }
+            store.Initialize("nodeA", storageEngine, MerkleMinDepth, nil)
+        })
+
+        AfterEach(func() {
+            storageEngine.Close()
+        })
+
+        It("should return the rows written after the position in the order they were written", func() {
+            Expect(store.ChangeLogID()).ShouldNot(Equal(""))
+            Expect(store.ChangeLogPosition()).Should(Equal(uint64(0)))
+
+            updateBatch := NewUpdateBatch()
+            updateBatch.Put([]byte("keyA"), []byte("value123"), NewDVV(NewDot("", 0), map[string]uint64{ }))
+            _, err := store.Batch(updateBatch)
+
+            Expect(err).Should(BeNil())
+
+            updateBatch = NewUpdateBatch()
+            updateBatch.Put([]byte("keyB"), []byte("value456"), NewDVV(NewDot("", 0), map[string]uint64{ }))
+            _, err = store.Batch(updateBatch)
+
+            Expect(err).Should(BeNil())
+
+            keys, position := changedKeys(0)
+
+            Expect(keys).Should(Equal([]string{ "keyA", "keyB" }))
+            Expect(position).Should(Equal(uint64(2)))
+            Expect(store.ChangeLogPosition()).Should(Equal(uint64(2)))
+
+            updateBatch = NewUpdateBatch()
+            updateBatch.Put([]byte("keyA"), []byte("value789"), NewDVV(NewDot("", 0), map[string]uint64{ }))
+            _, err = store.Batch(updateBatch)
+
+            Expect(err).Should(BeNil())
+
+            keys, _ = changedKeys(0)
+
+            Expect(keys).Should(Equal([]string{ "keyB", "keyA" }))
+
+            keys, position = changedKeys(position)
+
+            Expect(keys).Should(Equal([]string{ "keyA" }))
+            Expect(position).Should(Equal(uint64(3)))
+
+            keys, position = changedKeys(position)
+
+            Expect(keys).Should(Equal([]string{ }))
+            Expect(position).Should(Equal(uint64(3)))
+        })
+
+        It("should leave forgotten keys out of the log without reusing their local versions after a restart", func() {
+            updateBatch := NewUpdateBatch()
+            updateBatch.Put([]byte("keyA"), []byte("value123"), NewDVV(NewDot("", 0), map[string]uint64{ }))
+            updateBatch.Put([]byte("keyB"), []byte("value456"), NewDVV(NewDot("", 0), map[string]uint64{ }))
+            _, err := store.Batch(updateBatch)
+
+            Expect(err).Should(BeNil())
+            Expect(store.Forget([][]byte{ []byte("keyA"), []byte("keyB") })).Should(BeNil())
+
+            keys, position := changedKeys(0)
+
+            Expect(keys).Should(Equal([]string{ }))
+            Expect(position).Should(Equal(uint64(4)))
+
+            changeLogID := store.ChangeLogID()
+            store = &Store{ }
+            store.Initialize("nodeA", storageEngine, MerkleMinDepth, nil)
+
+            Expect(store.ChangeLogID()).Should(Equal(changeLogID))
+            Expect(store.ChangeLogPosition()).Should(Equal(uint64(4)))
+        })
+
+        It("should advance the horizon past keys that are forgotten", func() {
+            updateBatch := NewUpdateBatch()
+            updateBatch.Put([]byte("keyA"), []byte("value123"), NewDVV(NewDot("", 0), map[string]uint64{ }))
+            _, err := store.Batch(updateBatch)
+
+            Expect(err).Should(BeNil())
+            Expect(store.ChangeLogHorizon()).Should(Equal(uint64(0)))
+            Expect(store.Forget([][]byte{ []byte("keyA") })).Should(BeNil())
+            Expect(store.ChangeLogHorizon()).Should(Equal(uint64(2)))
+            Expect(store.ChangeLogPosition()).Should(Equal(uint64(2)))
+
+            store = &Store{ }
+            store.Initialize("nodeA", storageEngine, MerkleMinDepth, nil)
+
+            Expect(store.ChangeLogHorizon()).Should(Equal(uint64(2)))
+        })
+
+        It("should advance the horizon past tombstones that are garbage collected", func() {
+            updateBatch := NewUpdateBatch()
+            updateBatch.Put([]byte("keyA"), []byte("value123"), NewDVV(NewDot("", 0), map[string]uint64{ }))
+            _, err := store.Batch(updateBatch)
+
+            Expect(err).Should(BeNil())
+
+            updateBatch = NewUpdateBatch()
+            updateBatch.Delete([]byte("keyA"), NewDVV(NewDot("", 0), map[string]uint64{ }))
+            _, err = store.Batch(updateBatch)
+
+            Expect(err).Should(BeNil())
+            Expect(store.ChangeLogHorizon()).Should(Equal(uint64(0)))
+
+            time.Sleep(time.Millisecond * 10)
+
+            Expect(store.GarbageCollect(0)).Should(BeNil())
+            Expect(store.ChangeLogHorizon()).Should(Equal(uint64(2)))
+
+            keys, _ := changedKeys(0)
+
+            Expect(keys).Should(Equal([]string{ }))
+        })
+    })
+    
+    Describe("#Redepth", func() {
+        var storageEngine StorageDriver
+        var store *Store
+
+        syncChildren := func(store *Store) []string {
+            iter, err := store.GetSyncChildren(store.MerkleTree().RootNode())
+
+            Expect(err).Should(BeNil())
+
+            keys := []string{ }
+
+            for iter.Next() {
+                keys = append(keys, string(iter.Key()))
+            }
+
+            Expect(iter.Error()).Should(BeNil())
+            iter.Release()
+
+            return keys
+        }
+
+        BeforeEach(func() {
+            storageEngine = makeNewStorageDriver()
+            storageEngine.Open()
+            store = &Store{ }
+            store.Initialize("nodeA", storageEngine, MerkleMinDepth, nil)
+
+            updateBatch := NewUpdateBatch()
+
+            for i := 0; i < 50; i++ {
+                updateBatch.Put([]byte(fmt.Sprintf("key%d", i)), []byte("value"), NewDVV(NewDot("", 0), map[string]uint64{ }))
+            }
+
+            _, err := store.Batch(updateBatch)
+
+            Expect(err).Should(BeNil())
+        })
+
+        AfterEach(func() {
+            storageEngine.Close()
+        })
+
+        It("should build a merkle tree at the new depth that matches one built from scratch", func() {
+            rootHash := store.MerkleTree().RootHash()
+
+            Expect(store.Redepth(MerkleMinDepth + 4)).Should(BeNil())
+            Expect(store.MerkleTree().Depth()).Should(Equal(uint8(MerkleMinDepth + 4)))
+            Expect(store.MerkleTree().RootHash()).Should(Equal(rootHash))
+            Expect(store.KeyCount()).Should(Equal(uint64(50)))
+
+            rebuiltTree, _ := NewMerkleTree(MerkleMinDepth + 4)
+
+            for i := 0; i < 50; i++ {
+                key := []byte(fmt.Sprintf("key%d", i))
+                values, err := store.Get([][]byte{ key })
+
+                Expect(err).Should(BeNil())
+                rebuiltTree.Update(NewUpdate().AddDiff(string(key), nil, values[0]))
+            }
+
+            for node := uint32(1); node < rebuiltTree.NodeLimit(); node++ {
+                Expect(store.MerkleTree().NodeHash(node)).Should(Equal(rebuiltTree.NodeHash(node)))
+            }
+        })
+
+        It("should leave exactly one leaf index entry per key", func() {
+            Expect(store.Redepth(MerkleMinDepth + 2)).Should(BeNil())
+            Expect(syncChildren(store)).Should(HaveLen(50))
+
+            Expect(store.Redepth(MerkleMinDepth)).Should(BeNil())
+            Expect(syncChildren(store)).Should(HaveLen(50))
+        })
+
+        It("should keep the new depth after a restart even if another depth is configured", func() {
+            Expect(store.Redepth(MerkleMinDepth + 3)).Should(BeNil())
+
+            rootHash := store.MerkleTree().RootHash()
+            store = &Store{ }
+            store.Initialize("nodeA", storageEngine, MerkleMinDepth, nil)
+
+            Expect(store.MerkleTree().Depth()).Should(Equal(uint8(MerkleMinDepth + 3)))
+            Expect(store.MerkleTree().RootHash()).Should(Equal(rootHash))
+            Expect(store.KeyCount()).Should(Equal(uint64(50)))
+        })
+
+        It("should reject depths outside the supported range", func() {
+            Expect(store.Redepth(MerkleMaxDepth + 1)).Should(Equal(EMerkleDepth))
+            Expect(store.Redepth(MerkleMinDepth - 1)).Should(Equal(EMerkleDepth))
+            Expect(store.MerkleTree().Depth()).Should(Equal(uint8(MerkleMinDepth)))
+        })
+
+        It("should count keys as they are added and forgotten", func() {
+            Expect(store.KeyCount()).Should(Equal(uint64(50)))
+            Expect(store.Forget([][]byte{ []byte("key0"), []byte("key1") })).Should(BeNil())
+            Expect(store.KeyCount()).Should(Equal(uint64(48)))
+
+            updateBatch := NewUpdateBatch()
+            updateBatch.Put([]byte("key2"), []byte("value2"), NewDVV(NewDot("", 0), map[string]uint64{ }))
+            updateBatch.Put([]byte("key0"), []byte("value0"), NewDVV(NewDot("", 0), map[string]uint64{ }))
+            _, err := store.Batch(updateBatch)
+
+            Expect(err).Should(BeNil())
+            Expect(store.KeyCount()).Should(Equal(uint64(49)))
+        })
+
+        It("should count the writes that changed the merkle root", func() {
+            Expect(store.MerkleRootChanges()).Should(Equal(uint64(1)))
+            Expect(store.Forget([][]byte{ []byte("key0"), []byte("key1") })).Should(BeNil())
+            Expect(store.MerkleRootChanges()).Should(Equal(uint64(3)))
+
+            updateBatch := NewUpdateBatch()
+            updateBatch.Delete([]byte("nosuchkey"), NewDVV(NewDot("", 0), map[string]uint64{ }))
+            _, err := store.Batch(updateBatch)
+
+            Expect(err).Should(BeNil())
+            Expect(store.MerkleRootChanges()).Should(Equal(uint64(3)))
+
+            siblingSets, err := store.Get([][]byte{ []byte("key2") })
+
+            Expect(err).Should(BeNil())
+            Expect(store.Merge(map[string]*SiblingSet{ "key2": siblingSets[0] })).Should(BeNil())
+            Expect(store.MerkleRootChanges()).Should(Equal(uint64(3)))
+        })
+    })
     
     Context("a key does not exist in the node", func() {
         var (
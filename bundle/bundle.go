@@ -0,0 +1,274 @@
+package bundle
+
+//
+ // Copyright (c) 2019 ARM Limited.
+ //
+ // SPDX-License-Identifier: MIT
+ //
+ // Permission is hereby granted, free of charge, to any person obtaining a copy
+ // of this software and associated documentation files (the "Software"), to
+ // deal in the Software without restriction, including without limitation the
+ // rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ // sell copies of the Software, and to permit persons to whom the Software is
+ // furnished to do so, subject to the following conditions:
+ //
+ // The above copyright notice and this permission notice shall be included in all
+ // copies or substantial portions of the Software.
+ //
+ // THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ // IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ // FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ // AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ // LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ // SOFTWARE.
+ //
+
+
+import (
+    "crypto"
+    "crypto/ecdsa"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/sha256"
+    "crypto/tls"
+    "crypto/x509"
+    "encoding/json"
+    "errors"
+    "time"
+
+    . "github.com/armPelionEdge/devicedb/data"
+    . "github.com/armPelionEdge/devicedb/merkle"
+)
+
+const BUNDLE_VERSION = 1
+
+// Bundles summarize a bucket at a fixed depth regardless of the merkle depth
+// chosen by either side so that summaries from any two peers can be compared.
+// Depth 10 splits the key space into 512 ranges
+const SUMMARY_DEPTH uint8 = 10
+
+var EBundleVersion = errors.New("Unsupported bundle version")
+var EBundleSummary = errors.New("Summary depth does not match")
+var EBundleUnsigned = errors.New("Bundle is not signed")
+var EBundleSignature = errors.New("Bundle signature is invalid")
+var EBundleKeyType = errors.New("Signing key must be an RSA or ECDSA key")
+
+// A Summary holds the hashes of a bucket's merkle tree at SUMMARY_DEPTH.
+// Hashes[i] is the combined hash of every key whose leaf at that depth is
+// 2i + 1, the same value a merkle tree of that depth would hold in that leaf.
+type Summary struct {
+    Depth uint8 `json:"depth"`
+    Hashes []Hash `json:"hashes"`
+}
+
+func NewSummary() *Summary {
+    return &Summary{
+        Depth: SUMMARY_DEPTH,
+        Hashes: make([]Hash, 1 << (SUMMARY_DEPTH - 1)),
+    }
+}
+
+func (summary *Summary) rangeOf(key string) uint32 {
+    keyHash := NewHash([]byte(key))
+
+    return LeafNode(&keyHash, summary.Depth) >> 1
+}
+
+func (summary *Summary) valid() bool {
+    return summary.Depth == SUMMARY_DEPTH && len(summary.Hashes) == 1 << (SUMMARY_DEPTH - 1)
+}
+
+// Bundle is the unit of offline replication. It carries every sibling set
+// that its source holds and that the intended recipient might be missing
+// along with a summary of the source bucket so the recipient can export
+// only what the source lacks on the way back.
+type Bundle struct {
+    Version int `json:"version"`
+    Source string `json:"source"`
+    Site string `json:"site"`
+    Bucket string `json:"bucket"`
+    Created time.Time `json:"created"`
+    Summary *Summary `json:"summary"`
+    SiblingSets map[string]*SiblingSet `json:"siblingSets"`
+}
+
+// ExportRequest describes the peer a bundle is meant for. Summary is the
+// summary from the last bundle received from that peer. A nil summary
+// exports the whole bucket.
+type ExportRequest struct {
+    Peer string `json:"peer"`
+    Summary *Summary `json:"summary"`
+}
+
+// NewBundle reads every sibling set from iter and returns a bundle containing
+// those that fall in a key range whose hash differs from the corresponding
+// hash in known. Iterating the bucket once, rather than reading summary hashes
+// off the merkle tree, keeps the summary consistent with the keys exported even
+// if the bucket is written to concurrently.
+func NewBundle(source string, site string, bucket string, iter SiblingSetIterator, known *Summary) (*Bundle, error) {
+    defer iter.Release()
+
+    if known != nil && !known.valid() {
+        return nil, EBundleSummary
+    }
+
+    summary := NewSummary()
+    ranges := make(map[uint32]map[string]*SiblingSet)
+
+    for iter.Next() {
+        key := string(iter.Key())
+        siblingSet := iter.Value()
+        r := summary.rangeOf(key)
+
+        summary.Hashes[r] = summary.Hashes[r].Xor(siblingSet.Hash([]byte(key)))
+
+        if _, ok := ranges[r]; !ok {
+            ranges[r] = make(map[string]*SiblingSet)
+        }
+
+        ranges[r][key] = siblingSet
+    }
+
+    if iter.Error() != nil {
+        return nil, iter.Error()
+    }
+
+    siblingSets := make(map[string]*SiblingSet)
+
+    for r, keys := range ranges {
+        if known != nil && known.Hashes[r] == summary.Hashes[r] {
+            continue
+        }
+
+        for key, siblingSet := range keys {
+            siblingSets[key] = siblingSet
+        }
+    }
+
+    return &Bundle{
+        Version: BUNDLE_VERSION,
+        Source: source,
+        Site: site,
+        Bucket: bucket,
+        Created: time.Now(),
+        Summary: summary,
+        SiblingSets: siblingSets,
+    }, nil
+}
+
+// SignedBundle is the on-disk format of a bundle. Bundle holds the exact bytes
+// that were signed and Certificates holds the signer's DER encoded certificate
+// chain, leaf first.
+type SignedBundle struct {
+    Bundle json.RawMessage `json:"bundle"`
+    Certificates [][]byte `json:"certificates"`
+    Signature []byte `json:"signature"`
+}
+
+// Sign encodes a bundle and signs it with the private key of certificate
+func Sign(bundle *Bundle, certificate tls.Certificate) ([]byte, error) {
+    signer, ok := certificate.PrivateKey.(crypto.Signer)
+
+    if !ok {
+        return nil, EBundleKeyType
+    }
+
+    switch signer.Public().(type) {
+    case *rsa.PublicKey:
+    case *ecdsa.PublicKey:
+    default:
+        return nil, EBundleKeyType
+    }
+
+    encodedBundle, err := json.Marshal(bundle)
+
+    if err != nil {
+        return nil, err
+    }
+
+    digest := sha256.Sum256(encodedBundle)
+    signature, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+
+    if err != nil {
+        return nil, err
+    }
+
+    return json.Marshal(SignedBundle{
+        Bundle: encodedBundle,
+        Certificates: certificate.Certificate,
+        Signature: signature,
+    })
+}
+
+// Open verifies that a signed bundle was produced by the holder of a
+// certificate issued by one of roots and decodes it. If roots is nil the
+// system roots are used.
+func Open(encoded []byte, roots *x509.CertPool) (*Bundle, *x509.Certificate, error) {
+    var signedBundle SignedBundle
+
+    if err := json.Unmarshal(encoded, &signedBundle); err != nil {
+        return nil, nil, err
+    }
+
+    if len(signedBundle.Certificates) == 0 || len(signedBundle.Signature) == 0 {
+        return nil, nil, EBundleUnsigned
+    }
+
+    certificate, err := x509.ParseCertificate(signedBundle.Certificates[0])
+
+    if err != nil {
+        return nil, nil, err
+    }
+
+    intermediates := x509.NewCertPool()
+
+    for _, der := range signedBundle.Certificates[1:] {
+        intermediate, err := x509.ParseCertificate(der)
+
+        if err != nil {
+            return nil, nil, err
+        }
+
+        intermediates.AddCert(intermediate)
+    }
+
+    // Relay and cloud certificates are issued for TLS client or server
+    // authentication so any extended key usage is acceptable here
+    _, err = certificate.Verify(x509.VerifyOptions{
+        Roots: roots,
+        Intermediates: intermediates,
+        KeyUsages: []x509.ExtKeyUsage{ x509.ExtKeyUsageAny },
+    })
+
+    if err != nil {
+        return nil, nil, err
+    }
+
+    var algorithm x509.SignatureAlgorithm
+
+    switch certificate.PublicKey.(type) {
+    case *rsa.PublicKey:
+        algorithm = x509.SHA256WithRSA
+    case *ecdsa.PublicKey:
+        algorithm = x509.ECDSAWithSHA256
+    default:
+        return nil, nil, EBundleKeyType
+    }
+
+    if err := certificate.CheckSignature(algorithm, signedBundle.Bundle, signedBundle.Signature); err != nil {
+        return nil, nil, EBundleSignature
+    }
+
+    var bundle Bundle
+
+    if err := json.Unmarshal(signedBundle.Bundle, &bundle); err != nil {
+        return nil, nil, err
+    }
+
+    if bundle.Version != BUNDLE_VERSION {
+        return nil, nil, EBundleVersion
+    }
+
+    return &bundle, certificate, nil
+}
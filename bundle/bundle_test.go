@@ -0,0 +1,293 @@
+package bundle_test
+
+//
+ // Copyright (c) 2019 ARM Limited.
+ //
+ // SPDX-License-Identifier: MIT
+ //
+ // Permission is hereby granted, free of charge, to any person obtaining a copy
+ // of this software and associated documentation files (the "Software"), to
+ // deal in the Software without restriction, including without limitation the
+ // rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ // sell copies of the Software, and to permit persons to whom the Software is
+ // furnished to do so, subject to the following conditions:
+ //
+ // The above copyright notice and this permission notice shall be included in all
+ // copies or substantial portions of the Software.
+ //
+ // THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ // IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ // FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ // AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ // LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ // SOFTWARE.
+ //
+
+
+import (
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/json"
+    "fmt"
+    "math/big"
+    "time"
+
+    . "github.com/armPelionEdge/devicedb/bundle"
+    . "github.com/armPelionEdge/devicedb/data"
+    . "github.com/armPelionEdge/devicedb/merkle"
+
+    . "github.com/onsi/ginkgo"
+    . "github.com/onsi/gomega"
+)
+
+type mapIterator struct {
+    keys []string
+    values map[string]*SiblingSet
+    index int
+}
+
+func newMapIterator(values map[string]*SiblingSet) *mapIterator {
+    iter := &mapIterator{ values: values, index: -1 }
+
+    for key, _ := range values {
+        iter.keys = append(iter.keys, key)
+    }
+
+    return iter
+}
+
+func (iter *mapIterator) Next() bool {
+    iter.index++
+
+    return iter.index < len(iter.keys)
+}
+
+func (iter *mapIterator) Prefix() []byte {
+    return nil
+}
+
+func (iter *mapIterator) Key() []byte {
+    return []byte(iter.keys[iter.index])
+}
+
+func (iter *mapIterator) Value() *SiblingSet {
+    return iter.values[iter.keys[iter.index]]
+}
+
+func (iter *mapIterator) LocalVersion() uint64 {
+    return 0
+}
+
+func (iter *mapIterator) Release() {
+}
+
+func (iter *mapIterator) Error() error {
+    return nil
+}
+
+func siblingSet(nodeID string, count uint64, value string) *SiblingSet {
+    return NewSiblingSet(map[*Sibling]bool{
+        NewSibling(NewDVV(NewDot(nodeID, count), map[string]uint64{ }), []byte(value), 0): true,
+    })
+}
+
+func testValues(n int) map[string]*SiblingSet {
+    values := make(map[string]*SiblingSet)
+
+    for i := 0; i < n; i++ {
+        values[fmt.Sprintf("key%d", i)] = siblingSet("r1", uint64(i + 1), fmt.Sprintf("value%d", i))
+    }
+
+    return values
+}
+
+// newCertificateAuthority creates a throwaway CA so the tests do not depend
+// on the expiry dates of the certificates checked into test_certs
+func newCertificateAuthority() (*x509.Certificate, *ecdsa.PrivateKey) {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+    Expect(err).Should(BeNil())
+
+    template := &x509.Certificate{
+        SerialNumber: big.NewInt(1),
+        Subject: pkix.Name{ CommonName: "Test CA" },
+        NotBefore: time.Now().Add(-time.Hour),
+        NotAfter: time.Now().Add(time.Hour),
+        IsCA: true,
+        BasicConstraintsValid: true,
+        KeyUsage: x509.KeyUsageCertSign,
+    }
+
+    der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+
+    Expect(err).Should(BeNil())
+
+    ca, err := x509.ParseCertificate(der)
+
+    Expect(err).Should(BeNil())
+
+    return ca, key
+}
+
+func newCertificate(id string, ca *x509.Certificate, caKey *ecdsa.PrivateKey) tls.Certificate {
+    key, err := rsa.GenerateKey(rand.Reader, 2048)
+
+    Expect(err).Should(BeNil())
+
+    template := &x509.Certificate{
+        SerialNumber: big.NewInt(2),
+        Subject: pkix.Name{ CommonName: id },
+        NotBefore: time.Now().Add(-time.Hour),
+        NotAfter: time.Now().Add(time.Hour),
+        KeyUsage: x509.KeyUsageDigitalSignature,
+        ExtKeyUsage: []x509.ExtKeyUsage{ x509.ExtKeyUsageClientAuth },
+    }
+
+    der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+
+    Expect(err).Should(BeNil())
+
+    return tls.Certificate{ Certificate: [][]byte{ der }, PrivateKey: key }
+}
+
+var _ = Describe("Bundle", func() {
+    var certificate tls.Certificate
+    var roots *x509.CertPool
+
+    BeforeEach(func() {
+        ca, caKey := newCertificateAuthority()
+        certificate = newCertificate("WWRL000000", ca, caKey)
+        roots = x509.NewCertPool()
+        roots.AddCert(ca)
+    })
+
+    Describe("#NewBundle", func() {
+        It("should include every sibling set when no summary is known", func() {
+            values := testValues(100)
+            bundle, err := NewBundle("WWRL000000", "site1", "default", newMapIterator(values), nil)
+
+            Expect(err).Should(BeNil())
+            Expect(bundle.Version).Should(Equal(BUNDLE_VERSION))
+            Expect(bundle.Source).Should(Equal("WWRL000000"))
+            Expect(bundle.Site).Should(Equal("site1"))
+            Expect(bundle.Bucket).Should(Equal("default"))
+            Expect(bundle.SiblingSets).Should(Equal(values))
+        })
+
+        It("should produce a summary that matches the merkle tree at the summary depth", func() {
+            values := testValues(100)
+            merkleTree, _ := NewMerkleTree(SUMMARY_DEPTH + 2)
+            update := NewUpdate()
+
+            for key, value := range values {
+                update.AddDiff(key, nil, value)
+            }
+
+            merkleTree.Update(update)
+
+            bundle, err := NewBundle("WWRL000000", "site1", "default", newMapIterator(values), nil)
+
+            Expect(err).Should(BeNil())
+            Expect(bundle.Summary.Depth).Should(Equal(SUMMARY_DEPTH))
+            Expect(len(bundle.Summary.Hashes)).Should(Equal(1 << (SUMMARY_DEPTH - 1)))
+
+            for i, hash := range bundle.Summary.Hashes {
+                Expect(hash).Should(Equal(merkleTree.NodeHash(uint32(2*i + 1) << 2)))
+            }
+        })
+
+        It("should include only sibling sets in ranges that differ from the known summary", func() {
+            values := testValues(100)
+            known, _ := NewBundle("cloud", "site1", "default", newMapIterator(values), nil)
+
+            values["key7"] = siblingSet("r2", 1, "changed")
+            values["newKey"] = siblingSet("r2", 2, "new")
+
+            bundle, err := NewBundle("WWRL000000", "site1", "default", newMapIterator(values), known.Summary)
+
+            Expect(err).Should(BeNil())
+            Expect(bundle.SiblingSets).Should(HaveKey("key7"))
+            Expect(bundle.SiblingSets).Should(HaveKey("newKey"))
+            Expect(len(bundle.SiblingSets)).Should(BeNumerically("<", len(values)))
+        })
+
+        It("should include nothing when the known summary matches", func() {
+            values := testValues(100)
+            known, _ := NewBundle("cloud", "site1", "default", newMapIterator(values), nil)
+            bundle, err := NewBundle("WWRL000000", "site1", "default", newMapIterator(values), known.Summary)
+
+            Expect(err).Should(BeNil())
+            Expect(bundle.SiblingSets).Should(BeEmpty())
+        })
+
+        It("should return EBundleSummary if the known summary has a different depth", func() {
+            _, err := NewBundle("WWRL000000", "site1", "default", newMapIterator(testValues(1)), &Summary{ Depth: 3, Hashes: make([]Hash, 4) })
+
+            Expect(err).Should(Equal(EBundleSummary))
+        })
+    })
+
+    Describe("#Sign", func() {
+        It("should produce a bundle that Open accepts", func() {
+            values := testValues(10)
+            bundle, _ := NewBundle("WWRL000000", "site1", "default", newMapIterator(values), nil)
+            signed, err := Sign(bundle, certificate)
+
+            Expect(err).Should(BeNil())
+
+            opened, signer, err := Open(signed, roots)
+
+            Expect(err).Should(BeNil())
+            Expect(signer.Subject.CommonName).Should(Equal("WWRL000000"))
+            Expect(opened.Source).Should(Equal("WWRL000000"))
+            Expect(opened.Summary).Should(Equal(bundle.Summary))
+            Expect(len(opened.SiblingSets)).Should(Equal(len(values)))
+
+            for key, value := range values {
+                Expect(opened.SiblingSets[key].Hash([]byte(key))).Should(Equal(value.Hash([]byte(key))))
+            }
+        })
+    })
+
+    Describe("#Open", func() {
+        It("should return EBundleSignature if the bundle was modified after signing", func() {
+            bundle, _ := NewBundle("WWRL000000", "site1", "default", newMapIterator(testValues(10)), nil)
+            signed, _ := Sign(bundle, certificate)
+
+            var signedBundle SignedBundle
+            Expect(json.Unmarshal(signed, &signedBundle)).Should(BeNil())
+
+            bundle.Source = "WWRL000001"
+            signedBundle.Bundle, _ = json.Marshal(bundle)
+            tampered, _ := json.Marshal(signedBundle)
+
+            _, _, err := Open(tampered, roots)
+
+            Expect(err).Should(Equal(EBundleSignature))
+        })
+
+        It("should return an error if the signer is not trusted", func() {
+            bundle, _ := NewBundle("WWRL000000", "site1", "default", newMapIterator(testValues(10)), nil)
+            signed, _ := Sign(bundle, certificate)
+
+            _, _, err := Open(signed, x509.NewCertPool())
+
+            Expect(err).Should(Not(BeNil()))
+        })
+
+        It("should return EBundleUnsigned if the bundle has no signature", func() {
+            encodedBundle, _ := json.Marshal(Bundle{ Version: BUNDLE_VERSION })
+            unsigned, _ := json.Marshal(SignedBundle{ Bundle: encodedBundle })
+
+            _, _, err := Open(unsigned, roots)
+
+            Expect(err).Should(Equal(EBundleUnsigned))
+        })
+    })
+})
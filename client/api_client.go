@@ -28,30 +28,46 @@ import (
     "bytes"
     "context"
     "encoding/json"
+    "errors"
     "fmt"
     "io"
     "io/ioutil"
     "net/http"
+    "net/url"
+    "strconv"
+    "time"
 
+    "github.com/armPelionEdge/devicedb/bundle"
     "github.com/armPelionEdge/devicedb/routes"
+    "github.com/armPelionEdge/devicedb/webhooks"
     . "github.com/armPelionEdge/devicedb/error"
 )
 
 type APIClientConfig struct {
     Servers []string
+    // How long a watcher established by Watch() waits
+    // before trying to reconnect after its connection
+    // is interrupted. Defaults to one second
+    WatchReconnectTimeout time.Duration
 }
 
 type APIClient struct {
     servers []string
     nextServerIndex int
     httpClient *http.Client
+    watchReconnectTimeout time.Duration
 }
 
 func New(config APIClientConfig) *APIClient {
+    if config.WatchReconnectTimeout == 0 {
+        config.WatchReconnectTimeout = time.Second
+    }
+
     return &APIClient{
         servers: config.Servers,
         nextServerIndex: 0,
         httpClient: &http.Client{ },
+        watchReconnectTimeout: config.WatchReconnectTimeout,
     }
 }
 
@@ -150,6 +166,22 @@ func (client *APIClient) MoveRelay(ctx context.Context, relayID string, siteID s
     return nil
 }
 
+func (client *APIClient) SetRelaySubscription(ctx context.Context, relayID string, subscription map[string][]string) error {
+    body, err := json.Marshal(routes.RelaySubscription{ Buckets: subscription })
+
+    if err != nil {
+        return err
+    }
+
+    _, err = client.sendRequest(ctx, "PUT", "/relays/" + relayID + "/subscription", body)
+
+    if err != nil {
+        return err
+    }
+
+    return nil
+}
+
 func (client *APIClient) RemoveRelay(ctx context.Context, relayID string) error {
     _, err := client.sendRequest(ctx, "DELETE", "/relays/" + relayID, nil)
 
@@ -160,6 +192,68 @@ func (client *APIClient) RemoveRelay(ctx context.Context, relayID string) error
     return nil
 }
 
+func (client *APIClient) Webhooks(ctx context.Context) (map[string]routes.WebhookBody, error) {
+    encodedWebhooks, err := client.sendRequest(ctx, "GET", "/webhooks", nil)
+
+    if err != nil {
+        return nil, err
+    }
+
+    var webhooks map[string]routes.WebhookBody
+
+    err = json.Unmarshal(encodedWebhooks, &webhooks)
+
+    if err != nil {
+        return nil, err
+    }
+
+    return webhooks, nil
+}
+
+func (client *APIClient) SetWebhook(ctx context.Context, webhookID string, webhook routes.WebhookBody) error {
+    body, err := json.Marshal(webhook)
+
+    if err != nil {
+        return err
+    }
+
+    _, err = client.sendRequest(ctx, "PUT", "/webhooks/" + url.PathEscape(webhookID), body)
+
+    if err != nil {
+        return err
+    }
+
+    return nil
+}
+
+func (client *APIClient) RemoveWebhook(ctx context.Context, webhookID string) error {
+    _, err := client.sendRequest(ctx, "DELETE", "/webhooks/" + url.PathEscape(webhookID), nil)
+
+    if err != nil {
+        return err
+    }
+
+    return nil
+}
+
+func (client *APIClient) WebhookStatus(ctx context.Context, webhookID string) (webhooks.Status, error) {
+    encodedStatus, err := client.sendRequest(ctx, "GET", "/webhooks/" + url.PathEscape(webhookID) + "/status", nil)
+
+    if err != nil {
+        return webhooks.Status{}, err
+    }
+
+    var status webhooks.Status
+
+    err = json.Unmarshal(encodedStatus, &status)
+
+    if err != nil {
+        return webhooks.Status{}, err
+    }
+
+    return status, nil
+}
+
 func (client *APIClient) Batch(ctx context.Context, siteID string, bucket string, batch Batch) (int, int, error) {
     transportUpdateBatch := batch.ToTransportUpdateBatch()
     encodedTransportUpdateBatch, err := json.Marshal(transportUpdateBatch)
@@ -189,6 +283,48 @@ func (client *APIClient) Batch(ctx context.Context, siteID string, bucket string
     return int(batchResult.Replicas), int(batchResult.NApplied), ENoQuorum
 }
 
+func (client *APIClient) ExportBundle(ctx context.Context, siteID string, bucket string, request bundle.ExportRequest) (*bundle.Bundle, error) {
+    encodedExportRequest, err := json.Marshal(request)
+
+    if err != nil {
+        return nil, err
+    }
+
+    response, err := client.sendRequest(ctx, "POST", fmt.Sprintf("/sites/%s/buckets/%s/bundle/export", siteID, bucket), encodedExportRequest)
+
+    if err != nil {
+        return nil, err
+    }
+
+    var exportedBundle bundle.Bundle
+
+    if err := json.Unmarshal(response, &exportedBundle); err != nil {
+        return nil, err
+    }
+
+    return &exportedBundle, nil
+}
+
+func (client *APIClient) ImportBundle(ctx context.Context, siteID string, bucket string, signedBundle []byte) (int, int, error) {
+    response, err := client.sendRequest(ctx, "POST", fmt.Sprintf("/sites/%s/buckets/%s/bundle/import", siteID, bucket), signedBundle)
+
+    if err != nil {
+        return 0, 0, err
+    }
+
+    var batchResult routes.BatchResult
+
+    if err := json.Unmarshal(response, &batchResult); err != nil {
+        return 0, 0, err
+    }
+
+    if batchResult.Quorum {
+        return int(batchResult.Replicas), int(batchResult.NApplied), nil
+    }
+
+    return int(batchResult.Replicas), int(batchResult.NApplied), ENoQuorum
+}
+
 func (client *APIClient) Get(ctx context.Context, siteID string, bucket string, keys []string) ([]Entry, error) {
     url := fmt.Sprintf("/sites/%s/buckets/%s/keys?", siteID, bucket)
 
@@ -267,6 +403,120 @@ func (client *APIClient) GetMatches(ctx context.Context, siteID string, bucket s
     return entryIterator, nil
 }
 
+// Watch streams updates to keys in a site bucket that match keys or prefixes. Each
+// connection is served by one replica of the site and serials only order updates
+// from that replica. Pass the Replica and LastStableSerial of the last update seen
+// to resume a watch, or zero for both to receive the current value of every
+// matching key first. When the watcher reconnects to a different replica, after a
+// failover for example, the stream starts over so some updates may be delivered
+// more than once. Reconnection attempts rotate through the configured servers
+func (client *APIClient) Watch(ctx context.Context, siteID string, bucket string, keys []string, prefixes []string, replica uint64, lastSerial uint64) (chan WatchUpdate, chan error) {
+    var query url.Values = url.Values{}
+
+    for _, key := range keys {
+        query.Add("key", key)
+    }
+
+    for _, prefix := range prefixes {
+        query.Add("prefix", prefix)
+    }
+
+    updates := make(chan WatchUpdate)
+    errorsChan := make(chan error)
+
+    go func() {
+        defer func() {
+            close(updates)
+            close(errorsChan)
+        }()
+
+        for {
+            query.Set("replica", strconv.FormatUint(replica, 10))
+            query.Set("lastSerial", strconv.FormatUint(lastSerial, 10))
+
+            reqCtx, cancel := context.WithCancel(ctx)
+            resp, err := client.sendStreamingRequest(reqCtx, "GET", fmt.Sprintf("/sites/%s/buckets/%s/watch?%s", siteID, bucket, query.Encode()), nil)
+
+            if err == nil {
+                servingReplica, _ := strconv.ParseUint(resp.Header.Get(routes.ReplicaIDHeader), 10, 64)
+
+                // Serials from another replica can't be compared to the
+                // ones seen so far. The server restarts the stream from
+                // the beginning in that case
+                if servingReplica != replica {
+                    replica = servingReplica
+                    lastSerial = 0
+                }
+
+                var streamingMissedUpdates bool = true
+                var highestMissedSerial uint64
+                updateIterator := &streamedUpdateIterator{ reader: resp.Body }
+
+                for updateIterator.Next() {
+                    update := updateIterator.Update()
+                    update.Replica = replica
+
+                    // The updates missed since lastSerial come first and
+                    // are not ordered by serial. An empty update marks the
+                    // end of them
+                    if streamingMissedUpdates {
+                        if update.IsEmpty() {
+                            streamingMissedUpdates = false
+
+                            if lastSerial < highestMissedSerial {
+                                lastSerial = highestMissedSerial
+                            }
+
+                            update.LastStableSerial = lastSerial
+                            updates <- update
+
+                            continue
+                        }
+
+                        if highestMissedSerial < update.Serial {
+                            highestMissedSerial = update.Serial
+                        }
+                    }
+
+                    if update.Serial <= lastSerial && (lastSerial != 0 || update.Serial != 0) {
+                        errorsChan <- errors.New("Protocol error")
+                        break
+                    } else if !streamingMissedUpdates {
+                        lastSerial = update.Serial
+                    }
+
+                    update.LastStableSerial = lastSerial
+                    updates <- update
+                }
+
+                if updateIterator.Error() != nil {
+                    select {
+                    case <-ctx.Done():
+                    default:
+                        errorsChan <- updateIterator.Error()
+                    }
+                }
+            } else {
+                select {
+                case <-ctx.Done():
+                default:
+                    errorsChan <- err
+                }
+            }
+
+            cancel()
+
+            select {
+            case <-ctx.Done():
+                return
+            case <-time.After(client.watchReconnectTimeout):
+            }
+        }
+    }()
+
+    return updates, errorsChan
+}
+
 func (client *APIClient) LogDump(ctx context.Context) (routes.LogDump, error) {
     url := "/log_dump"
     response, err := client.sendRequest(ctx, "GET", url, nil)
@@ -330,6 +580,16 @@ func (client *APIClient) DownloadSnapshot(ctx context.Context, uuid string) (io.
 }
 
 func (client *APIClient) sendRequestRaw(ctx context.Context, httpVerb string, endpointURL string, body []byte) (io.ReadCloser, error) {
+    resp, err := client.sendStreamingRequest(ctx, httpVerb, endpointURL, body)
+
+    if err != nil {
+        return nil, err
+    }
+
+    return resp.Body, nil
+}
+
+func (client *APIClient) sendStreamingRequest(ctx context.Context, httpVerb string, endpointURL string, body []byte) (*http.Response, error) {
     u := fmt.Sprintf("http://%s%s", client.nextServer(), endpointURL)
     request, err := http.NewRequest(httpVerb, u, bytes.NewReader(body))
 
@@ -346,6 +606,8 @@ func (client *APIClient) sendRequestRaw(ctx context.Context, httpVerb string, en
     }
 
     if resp.StatusCode != http.StatusOK {
+        defer resp.Body.Close()
+
         errorMessage, err := ioutil.ReadAll(resp.Body)
         
         if err != nil {
@@ -355,7 +617,7 @@ func (client *APIClient) sendRequestRaw(ctx context.Context, httpVerb string, en
         return nil, &ErrorStatusCode{ Message: string(errorMessage), StatusCode: resp.StatusCode }
     }
 
-    return resp.Body, nil
+    return resp, nil
 }
 
 func (client *APIClient) sendRequest(ctx context.Context, httpVerb string, endpointURL string, body []byte) ([]byte, error) {
@@ -34,6 +34,7 @@ import (
     "strings"
     "context"
     "fmt"
+    "net/url"
 
     . "github.com/armPelionEdge/devicedb/raft"
     . "github.com/armPelionEdge/devicedb/error"
@@ -220,6 +221,26 @@ func (client *Client) MerkleTreeNode(ctx context.Context, memberAddress PeerAddr
     return merkleNode, nil
 }
 
+// ScopedMerkleTreeNode returns the hash of a merkle node computed as if the
+// bucket only contained the keys starting with one of the prefixes
+func (client *Client) ScopedMerkleTreeNode(ctx context.Context, memberAddress PeerAddress, siteID string, bucketName string, nodeID uint32, prefixes []string) (rest.MerkleNode, error) {
+    query := url.Values{ "scoped": []string{ "true" }, "prefix": prefixes }
+    endpoint := memberAddress.ToHTTPURL(fmt.Sprintf("/sites/%s/buckets/%s/merkle/nodes/%d?%s", siteID, bucketName, nodeID, query.Encode()))
+    response, err := client.sendRequest(ctx, "GET", endpoint, []byte{ })
+
+    if err != nil {
+        return rest.MerkleNode{}, err
+    }
+
+    var merkleNode rest.MerkleNode
+
+    if err := json.Unmarshal(response, &merkleNode); err != nil {
+        return rest.MerkleNode{}, err
+    }
+
+    return merkleNode, nil
+}
+
 func (client *Client) MerkleTreeNodeKeys(ctx context.Context, memberAddress PeerAddress, siteID string, bucketName string, nodeID uint32) (rest.MerkleKeys, error) {
     endpoint := memberAddress.ToHTTPURL(fmt.Sprintf("/sites/%s/buckets/%s/merkle/nodes/%d/keys", siteID, bucketName, nodeID))
     response, err := client.sendRequest(ctx, "GET", endpoint, []byte{ })
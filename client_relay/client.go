@@ -36,6 +36,7 @@ import (
     "net/http"
     "net/url"
     "time"
+    "github.com/armPelionEdge/devicedb/bundle"
     "github.com/armPelionEdge/devicedb/client"
     "github.com/armPelionEdge/devicedb/transport"
 )
@@ -71,6 +72,47 @@ type Client interface {
     // and error channels until they are closed to prevent blocking of the watcher 
     // goroutine.
     Watch(ctx context.Context, bucket string, keys []string, prefixes []string, lastSerial uint64) (chan Update, chan error)
+    // Export an offline sync bundle from a bucket for some peer. The request
+    // should carry the summary from the last bundle received from that peer
+    // so that only keys the peer may be missing are exported. The returned
+    // bundle is unsigned.
+    ExportBundle(ctx context.Context, bucket string, request bundle.ExportRequest) (*bundle.Bundle, error)
+    // Merge an offline sync bundle exported by some peer into a bucket. The
+    // bundle must be signed by the peer that exported it as produced by
+    // bundle.Sign()
+    ImportBundle(ctx context.Context, bucket string, signedBundle []byte) error
+    // Get the merkle depth of a bucket along with the number of keys
+    // it holds
+    MerkleDepth(ctx context.Context, bucket string) (MerkleDepth, error)
+    // Rebuild the merkle tree of a bucket at a different depth. The
+    // bucket stays available while it is rebuilt. This call returns
+    // once the new tree is in place.
+    SetMerkleDepth(ctx context.Context, bucket string, depth uint8) (MerkleDepth, error)
+    // Watch for events logged to the history. lastSerial specifies the
+    // serial number of the last received event. Events logged after it
+    // that match the filter are streamed to the event channel in the
+    // order they were logged. As with Watch() the client reconnects
+    // after a disconnection, pushing an error to the error channel,
+    // and resumes from the last event it received. Both channels close
+    // once the context is cancelled and must be consumed until then.
+    WatchEvents(ctx context.Context, filter EventFilter, lastSerial uint64) (chan Event, chan error)
+    // List the alerts that are currently firing. If levels is not empty
+    // only alerts at one of those levels are returned
+    Alerts(ctx context.Context, levels []string) ([]Alert, error)
+    // Raise an alert or update the level and metadata of one that is
+    // already firing
+    RaiseAlert(ctx context.Context, key string, level string, metadata interface{}) error
+    // Clear a firing alert. An error is returned if the alert is not
+    // firing
+    ClearAlert(ctx context.Context, key string) error
+    // Acknowledge a firing alert. Acknowledged alerts are no longer
+    // forwarded to the cloud until they are raised again
+    AcknowledgeAlert(ctx context.Context, key string) error
+}
+
+type MerkleDepth struct {
+    Depth uint8 `json:"depth"`
+    KeyCount uint64 `json:"keyCount"`
 }
 
 type Config struct {
@@ -191,6 +233,88 @@ func (c *HTTPClient) GetMatches(ctx context.Context, bucket string, keys []strin
     return &StreamedEntryIterator{ reader: respBody }, nil
 }
 
+func (c *HTTPClient) ExportBundle(ctx context.Context, bucket string, request bundle.ExportRequest) (*bundle.Bundle, error) {
+    url := fmt.Sprintf("/%s/bundle/export", bucket)
+    body, err := json.Marshal(request)
+
+    if err != nil {
+        return nil, err
+    }
+
+    respBody, err := c.sendRequest(ctx, "POST", url, body)
+
+    if err != nil {
+        return nil, err
+    }
+
+    defer respBody.Close()
+
+    var exportedBundle bundle.Bundle
+
+    if err := json.NewDecoder(respBody).Decode(&exportedBundle); err != nil {
+        return nil, err
+    }
+
+    return &exportedBundle, nil
+}
+
+func (c *HTTPClient) ImportBundle(ctx context.Context, bucket string, signedBundle []byte) error {
+    url := fmt.Sprintf("/%s/bundle/import", bucket)
+    respBody, err := c.sendRequest(ctx, "POST", url, signedBundle)
+
+    if err != nil {
+        return err
+    }
+
+    respBody.Close()
+
+    return nil
+}
+
+func (c *HTTPClient) MerkleDepth(ctx context.Context, bucket string) (MerkleDepth, error) {
+    url := fmt.Sprintf("/%s/merkleDepth", bucket)
+    respBody, err := c.sendRequest(ctx, "GET", url, nil)
+
+    if err != nil {
+        return MerkleDepth{}, err
+    }
+
+    defer respBody.Close()
+
+    var merkleDepth MerkleDepth
+
+    if err := json.NewDecoder(respBody).Decode(&merkleDepth); err != nil {
+        return MerkleDepth{}, err
+    }
+
+    return merkleDepth, nil
+}
+
+func (c *HTTPClient) SetMerkleDepth(ctx context.Context, bucket string, depth uint8) (MerkleDepth, error) {
+    url := fmt.Sprintf("/%s/merkleDepth", bucket)
+    body, err := json.Marshal(MerkleDepth{ Depth: depth })
+
+    if err != nil {
+        return MerkleDepth{}, err
+    }
+
+    respBody, err := c.sendRequest(ctx, "PUT", url, body)
+
+    if err != nil {
+        return MerkleDepth{}, err
+    }
+
+    defer respBody.Close()
+
+    var merkleDepth MerkleDepth
+
+    if err := json.NewDecoder(respBody).Decode(&merkleDepth); err != nil {
+        return MerkleDepth{}, err
+    }
+
+    return merkleDepth, nil
+}
+
 func (c *HTTPClient) Watch(ctx context.Context, bucket string, keys []string, prefixes []string, lastSerial uint64) (chan Update, chan error) {
     var query url.Values = url.Values{}
 
@@ -310,6 +434,159 @@ func (c *HTTPClient) Watch(ctx context.Context, bucket string, keys []string, pr
     return updates, errorsChan
 }
 
+func (c *HTTPClient) WatchEvents(ctx context.Context, filter EventFilter, lastSerial uint64) (chan Event, chan error) {
+    var query url.Values = url.Values{}
+
+    for _, source := range filter.Sources {
+        query.Add("source", source)
+    }
+
+    for _, eventType := range filter.Types {
+        query.Add("type", eventType)
+    }
+
+    for _, group := range filter.Groups {
+        query.Add("group", group)
+    }
+
+    events := make(chan Event)
+    errorsChan := make(chan error)
+
+    go func() {
+        defer func() {
+            close(events)
+            close(errorsChan)
+        }()
+
+        for {
+            reqCtx, cancel := context.WithCancel(ctx)
+            url := fmt.Sprintf("/events/stream?%s&lastSerial=%d", query.Encode(), lastSerial)
+            respBody, err := c.sendRequest(reqCtx, "GET", url, nil)
+
+            if err == nil {
+                eventIterator := &StreamedEventIterator{ reader: respBody }
+
+                // stream events until the response stream
+                // is interrupted or an error occurs
+                for eventIterator.Next() {
+                    event := eventIterator.Event()
+
+                    // marks the end of the missed events
+                    if event == nil {
+                        continue
+                    }
+
+                    // Unlike bucket updates events are always
+                    // sent in increasing serial order
+                    if event.Serial <= lastSerial {
+                        errorsChan <- errors.New("Protocol error")
+                        cancel()
+                        break
+                    }
+
+                    lastSerial = event.Serial
+                    events <- *event
+                }
+
+                if eventIterator.Error() != nil {
+                    // Only report the error if the context
+                    // wasn't canceled. We don't want to send
+                    // 'context canceled' errors
+                    select {
+                    case <-ctx.Done():
+                    default:
+                        errorsChan <- eventIterator.Error()
+                    }
+                }
+            } else {
+                select {
+                case <-ctx.Done():
+                default:
+                    errorsChan <- err
+                }
+            }
+
+            cancel()
+
+            // stop if the watcher was cancelled or try
+            // to re-establish the connection in a moment
+            select {
+            case <-ctx.Done():
+                return
+            case <-time.After(c.watchReconnectTimeout):
+            }
+        }
+    }()
+
+    return events, errorsChan
+}
+
+func (c *HTTPClient) Alerts(ctx context.Context, levels []string) ([]Alert, error) {
+    query := url.Values{}
+
+    for _, level := range levels {
+        query.Add("level", level)
+    }
+
+    respBody, err := c.sendRequest(ctx, "GET", "/alerts?" + query.Encode(), nil)
+
+    if err != nil {
+        return nil, err
+    }
+
+    defer respBody.Close()
+
+    var alerts []Alert
+
+    if err := json.NewDecoder(respBody).Decode(&alerts); err != nil {
+        return nil, err
+    }
+
+    return alerts, nil
+}
+
+func (c *HTTPClient) RaiseAlert(ctx context.Context, key string, level string, metadata interface{}) error {
+    body, err := json.Marshal(map[string]interface{}{ "level": level, "metadata": metadata })
+
+    if err != nil {
+        return err
+    }
+
+    respBody, err := c.sendRequest(ctx, "PUT", fmt.Sprintf("/alerts/%s", url.PathEscape(key)), body)
+
+    if err != nil {
+        return err
+    }
+
+    respBody.Close()
+
+    return nil
+}
+
+func (c *HTTPClient) ClearAlert(ctx context.Context, key string) error {
+    respBody, err := c.sendRequest(ctx, "DELETE", fmt.Sprintf("/alerts/%s", url.PathEscape(key)), nil)
+
+    if err != nil {
+        return err
+    }
+
+    respBody.Close()
+
+    return nil
+}
+
+func (c *HTTPClient) AcknowledgeAlert(ctx context.Context, key string) error {
+    respBody, err := c.sendRequest(ctx, "POST", fmt.Sprintf("/alerts/%s/acknowledge", url.PathEscape(key)), nil)
+
+    if err != nil {
+        return err
+    }
+
+    respBody.Close()
+
+    return nil
+}
+
 func (c *HTTPClient) sendRequest(ctx context.Context, httpVerb string, endpointURL string, body []byte) (io.ReadCloser, error) {
     u := fmt.Sprintf("%s%s", c.server, endpointURL)
     request, err := http.NewRequest(httpVerb, u, bytes.NewReader(body))
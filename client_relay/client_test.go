@@ -28,12 +28,20 @@ import (
     "fmt"
     "time"
     "bytes"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
     "crypto/tls"
     "crypto/x509"
+    "crypto/x509/pkix"
+    "math/big"
     "io/ioutil"
     "errors"
     "context"
     
+    "github.com/armPelionEdge/devicedb/bundle"
+    "github.com/armPelionEdge/devicedb/historian"
+    . "github.com/armPelionEdge/devicedb/merkle"
     . "github.com/armPelionEdge/devicedb/server"
     . "github.com/armPelionEdge/devicedb/util"
     ddbSync "github.com/armPelionEdge/devicedb/sync"
@@ -81,6 +89,55 @@ func loadCerts(id string) (*tls.Config, *tls.Config, error) {
     return serverTLSConfig, clientTLSConfig, nil
 }
 
+// newBundleCA creates a throwaway CA for signing bundles so the tests do not
+// depend on the expiry dates of the certificates checked into test_certs
+func newBundleCA() (*x509.Certificate, *ecdsa.PrivateKey) {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+    Expect(err).Should(BeNil())
+
+    template := &x509.Certificate{
+        SerialNumber: big.NewInt(1),
+        Subject: pkix.Name{ CommonName: "Test CA" },
+        NotBefore: time.Now().Add(-time.Hour),
+        NotAfter: time.Now().Add(time.Hour),
+        IsCA: true,
+        BasicConstraintsValid: true,
+        KeyUsage: x509.KeyUsageCertSign,
+    }
+
+    der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+
+    Expect(err).Should(BeNil())
+
+    ca, err := x509.ParseCertificate(der)
+
+    Expect(err).Should(BeNil())
+
+    return ca, key
+}
+
+func newBundleSigner(id string, ca *x509.Certificate, caKey *ecdsa.PrivateKey) tls.Certificate {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+    Expect(err).Should(BeNil())
+
+    template := &x509.Certificate{
+        SerialNumber: big.NewInt(2),
+        Subject: pkix.Name{ CommonName: id },
+        NotBefore: time.Now().Add(-time.Hour),
+        NotAfter: time.Now().Add(time.Hour),
+        KeyUsage: x509.KeyUsageDigitalSignature,
+        ExtKeyUsage: []x509.ExtKeyUsage{ x509.ExtKeyUsageClientAuth },
+    }
+
+    der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+
+    Expect(err).Should(BeNil())
+
+    return tls.Certificate{ Certificate: [][]byte{ der }, PrivateKey: key }
+}
+
 const SYNC_PERIOD_MS = 10
 
 func url(u string, server *Server) string {
@@ -96,6 +153,7 @@ var _ = Describe("Client", func() {
     var server *Server
     var hub *Hub
     var syncController *SyncController
+    var signer tls.Certificate
     stop := make(chan int)
     
     BeforeEach(func() {
@@ -110,10 +168,16 @@ var _ = Describe("Client", func() {
             ServerURI: "http://localhost:8080",
         })
 
+        ca, caKey := newBundleCA()
+        signer = newBundleSigner("cloud", ca, caKey)
+        bundleRoots := x509.NewCertPool()
+        bundleRoots.AddCert(ca)
+
         server, _ = NewServer(ServerConfig{
             DBFile: "/tmp/testdb-" + RandomString(),
             Port: 8080,
             Hub: hub,
+            BundleRoots: bundleRoots,
         })
         
         go func() {
@@ -174,6 +238,61 @@ var _ = Describe("Client", func() {
         })
     })
     
+    Describe("Event watcher", func() {
+        It("Should replay missed events then stream new ones that match the filter", func() {
+            Expect(server.History().LogEvent(&historian.Event{ Timestamp: 1, SourceID: "door1", Type: "door_open" })).Should(BeNil())
+            Expect(server.History().LogEvent(&historian.Event{ Timestamp: 2, SourceID: "door1", Type: "door_close" })).Should(BeNil())
+            Expect(server.History().LogEvent(&historian.Event{ Timestamp: 3, SourceID: "door2", Type: "door_open" })).Should(BeNil())
+
+            ctx, cancel := context.WithCancel(context.Background())
+            defer cancel()
+
+            events, errors := client.WatchEvents(ctx, client_relay.EventFilter{ Types: []string{ "door_open" } }, 1)
+
+            go func() {
+                for range errors {
+                }
+            }()
+
+            Eventually(events).Should(Receive(WithTransform(func(e client_relay.Event) string { return e.Source }, Equal("door2"))))
+
+            Expect(server.History().LogEvent(&historian.Event{ Timestamp: 4, SourceID: "door3", Type: "door_close" })).Should(BeNil())
+            Expect(server.History().LogEvent(&historian.Event{ Timestamp: 5, SourceID: "door3", Type: "door_open" })).Should(BeNil())
+
+            var event client_relay.Event
+
+            Eventually(events).Should(Receive(&event))
+            Expect(event.Source).Should(Equal("door3"))
+            Expect(event.Serial).Should(Equal(uint64(5)))
+        })
+    })
+
+    Describe("Alerts", func() {
+        It("Should raise, acknowledge and clear alerts", func() {
+            Expect(client.RaiseAlert(context.TODO(), "door1", "critical", "door open")).Should(BeNil())
+            Expect(client.RaiseAlert(context.TODO(), "door2", "warning", nil)).Should(BeNil())
+
+            alerts, err := client.Alerts(context.TODO(), []string{ "critical" })
+
+            Expect(err).Should(BeNil())
+            Expect(alerts).Should(HaveLen(1))
+            Expect(alerts[0].Key).Should(Equal("door1"))
+            Expect(alerts[0].Level).Should(Equal("critical"))
+            Expect(alerts[0].Metadata).Should(Equal("door open"))
+
+            Expect(client.AcknowledgeAlert(context.TODO(), "door1")).Should(BeNil())
+            Expect(client.ClearAlert(context.TODO(), "door2")).Should(BeNil())
+
+            alerts, err = client.Alerts(context.TODO(), nil)
+
+            Expect(err).Should(BeNil())
+            Expect(alerts).Should(HaveLen(1))
+            Expect(alerts[0].Acknowledged).Should(BeTrue())
+
+            Expect(client.ClearAlert(context.TODO(), "door2")).Should(Not(BeNil()))
+        })
+    })
+
     Describe("CRUD", func() {
         It("Should work", func() {
             batch := clientlib.NewBatch()
@@ -227,4 +346,71 @@ var _ = Describe("Client", func() {
             Expect(iter.Entry()).Should(Equal(clientlib.Entry{}))
         })
     })
+
+    Describe("Bundles", func() {
+        It("Should work", func() {
+            batch := clientlib.NewBatch()
+            batch.Put("a", "b", "")
+            batch.Put("x", "c", "")
+
+            Expect(client.Batch(context.TODO(), "default", *batch)).Should(BeNil())
+
+            exported, err := client.ExportBundle(context.TODO(), "default", bundle.ExportRequest{ })
+
+            Expect(err).Should(BeNil())
+            Expect(exported.SiblingSets).Should(HaveKey("a"))
+            Expect(exported.SiblingSets).Should(HaveKey("x"))
+
+            incremental, err := client.ExportBundle(context.TODO(), "default", bundle.ExportRequest{ Summary: exported.Summary })
+
+            Expect(err).Should(BeNil())
+            Expect(incremental.SiblingSets).Should(BeEmpty())
+
+            exported.Source = "cloud"
+
+            signedBundle, err := bundle.Sign(exported, signer)
+
+            Expect(err).Should(BeNil())
+            Expect(client.ImportBundle(context.TODO(), "default", signedBundle)).Should(BeNil())
+            Expect(client.ImportBundle(context.TODO(), "local", signedBundle)).Should(Not(BeNil()))
+
+            exported.Source = "WWRL000001"
+            signedBundle, err = bundle.Sign(exported, signer)
+
+            Expect(err).Should(BeNil())
+            Expect(client.ImportBundle(context.TODO(), "default", signedBundle)).Should(Not(BeNil()))
+
+            _, err = client.ExportBundle(context.TODO(), "local", bundle.ExportRequest{ })
+
+            Expect(err).Should(Not(BeNil()))
+        })
+    })
+
+    Describe("Merkle depth", func() {
+        It("Should work", func() {
+            batch := clientlib.NewBatch()
+            batch.Put("a", "b", "")
+            batch.Put("x", "c", "")
+
+            Expect(client.Batch(context.TODO(), "default", *batch)).Should(BeNil())
+
+            merkleDepth, err := client.MerkleDepth(context.TODO(), "default")
+
+            Expect(err).Should(BeNil())
+            Expect(merkleDepth).Should(Equal(client_relay.MerkleDepth{ Depth: MerkleDefaultDepth, KeyCount: 2 }))
+
+            merkleDepth, err = client.SetMerkleDepth(context.TODO(), "default", 4)
+
+            Expect(err).Should(BeNil())
+            Expect(merkleDepth).Should(Equal(client_relay.MerkleDepth{ Depth: 4, KeyCount: 2 }))
+
+            _, err = client.SetMerkleDepth(context.TODO(), "default", MerkleMaxDepth + 1)
+
+            Expect(err).Should(Not(BeNil()))
+
+            _, err = client.MerkleDepth(context.TODO(), "nosuchbucket")
+
+            Expect(err).Should(Not(BeNil()))
+        })
+    })
 })
@@ -0,0 +1,118 @@
+package client_relay
+//
+ // Copyright (c) 2019 ARM Limited.
+ //
+ // SPDX-License-Identifier: MIT
+ //
+ // Permission is hereby granted, free of charge, to any person obtaining a copy
+ // of this software and associated documentation files (the "Software"), to
+ // deal in the Software without restriction, including without limitation the
+ // rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ // sell copies of the Software, and to permit persons to whom the Software is
+ // furnished to do so, subject to the following conditions:
+ //
+ // The above copyright notice and this permission notice shall be included in all
+ // copies or substantial portions of the Software.
+ //
+ // THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ // IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ // FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ // AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ // LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ // SOFTWARE.
+ //
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+)
+
+type StreamedEventIterator struct {
+	reader io.ReadCloser
+	scanner *bufio.Scanner
+	closed bool
+	err error
+	event *Event
+}
+
+// Next moves to the next event in the stream. The event is nil
+// if this is the marker sent after the missed events have been
+// replayed
+func (iter *StreamedEventIterator) Next() bool {
+	if iter.closed {
+		return false
+	}
+
+	if iter.scanner == nil {
+		iter.scanner = bufio.NewScanner(iter.reader)
+	}
+
+	// data: %s line
+	if !iter.scanner.Scan() {
+		if iter.scanner.Err() != nil {
+			iter.err = iter.scanner.Err()
+		}
+
+		iter.close()
+
+		return false
+	}
+
+	if !strings.HasPrefix(iter.scanner.Text(), "data: ") {
+		// protocol error.
+		iter.err = errors.New("Protocol error")
+
+		iter.close()
+
+		return false
+	}
+
+	encodedEvent := iter.scanner.Text()[len("data: "):]
+
+	if encodedEvent == "" {
+		iter.event = nil
+	} else {
+		var event Event
+
+		if err := json.Unmarshal([]byte(encodedEvent), &event); err != nil {
+			iter.err = err
+
+			iter.close()
+
+			return false
+		}
+
+		iter.event = &event
+	}
+
+	// consume newline between "data: %s" lines
+	if !iter.scanner.Scan() {
+		if iter.scanner.Err() != nil {
+			iter.err = iter.scanner.Err()
+		}
+
+		iter.close()
+
+		return false
+	}
+
+	return true
+}
+
+func (iter *StreamedEventIterator) close() {
+	iter.event = nil
+	iter.closed = true
+	iter.reader.Close()
+}
+
+func (iter *StreamedEventIterator) Event() *Event {
+	return iter.event
+}
+
+func (iter *StreamedEventIterator) Error() error {
+	return iter.err
+}
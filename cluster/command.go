@@ -108,6 +108,9 @@ const (
     ClusterRemoveRelay ClusterCommandType = iota
     ClusterMoveRelay ClusterCommandType = iota
     ClusterSnapshot ClusterCommandType = iota
+    ClusterSetRelaySubscription ClusterCommandType = iota
+    ClusterSetRelayAddress ClusterCommandType = iota
+    ClusterSetWebhook ClusterCommandType = iota
 )
 
 type ClusterCommand struct {
@@ -171,6 +174,26 @@ type ClusterSnapshotBody struct {
     UUID string
 }
 
+type ClusterSetRelaySubscriptionBody struct {
+    RelayID string
+    // Maps bucket names to the key prefixes the relay replicates from that
+    // bucket. A nil or empty subscription removes any restriction
+    Subscription map[string][]string
+}
+
+type ClusterSetRelayAddressBody struct {
+    RelayID string
+    // The host:port at which other relays in the same site can reach
+    // this relay. An empty address removes the advertised address
+    Address string
+}
+
+type ClusterSetWebhookBody struct {
+    WebhookID string
+    // The new configuration of the webhook. A nil webhook removes it
+    Webhook *Webhook
+}
+
 func EncodeClusterCommand(command ClusterCommand) ([]byte, error) {
     encodedCommand, err := json.Marshal(command)
 
@@ -249,6 +272,18 @@ func CreateClusterCommand(commandType ClusterCommandType, body interface{}) (Clu
         if _, ok := body.(ClusterSnapshotBody); !ok {
             return ClusterCommand{}, ECouldNotParseCommand
         }
+    case ClusterSetRelaySubscription:
+        if _, ok := body.(ClusterSetRelaySubscriptionBody); !ok {
+            return ClusterCommand{}, ECouldNotParseCommand
+        }
+    case ClusterSetRelayAddress:
+        if _, ok := body.(ClusterSetRelayAddressBody); !ok {
+            return ClusterCommand{}, ECouldNotParseCommand
+        }
+    case ClusterSetWebhook:
+        if _, ok := body.(ClusterSetWebhookBody); !ok {
+            return ClusterCommand{}, ECouldNotParseCommand
+        }
     default:
         return ClusterCommand{ }, ENoSuchCommand
     }
@@ -363,6 +398,30 @@ func DecodeClusterCommandBody(command ClusterCommand) (interface{}, error) {
             break
         }
 
+        return body, nil
+    case ClusterSetRelaySubscription:
+        var body ClusterSetRelaySubscriptionBody
+
+        if err := json.Unmarshal(command.Data, &body); err != nil {
+            break
+        }
+
+        return body, nil
+    case ClusterSetRelayAddress:
+        var body ClusterSetRelayAddressBody
+
+        if err := json.Unmarshal(command.Data, &body); err != nil {
+            break
+        }
+
+        return body, nil
+    case ClusterSetWebhook:
+        var body ClusterSetWebhookBody
+
+        if err := json.Unmarshal(command.Data, &body); err != nil {
+            break
+        }
+
         return body, nil
     default:
         return nil, ENoSuchCommand
@@ -276,6 +276,12 @@ func (cc *ConfigController) ClusterCommand(ctx context.Context, commandBody inte
         command.Type = ClusterMoveRelay
     case ClusterSnapshotBody:
         command.Type = ClusterSnapshot
+    case ClusterSetRelaySubscriptionBody:
+        command.Type = ClusterSetRelaySubscription
+    case ClusterSetRelayAddressBody:
+        command.Type = ClusterSetRelayAddress
+    case ClusterSetWebhookBody:
+        command.Type = ClusterSetWebhook
     default:
         return ENoSuchCommand
     }
@@ -28,6 +28,7 @@ import (
     "errors"
     "sync"
     "sort"
+    "reflect"
     "github.com/armPelionEdge/devicedb/raft"
 
     . "github.com/armPelionEdge/devicedb/logging"
@@ -37,6 +38,7 @@ var ENoSuchCommand = errors.New("The cluster command type is not supported")
 var ENoSuchNode = errors.New("The node specified in the update does not exist")
 var ENoSuchSite = errors.New("The specified site does not exist")
 var ENoSuchRelay = errors.New("The specified relay does not exist")
+var EInvalidWebhook = errors.New("The webhook must have an ID, a bucket and a URL")
 var ENodeDoesNotOwnReplica = errors.New("A node tried to transfer a partition replica to itself but it no longer owns that replica")
 var ECouldNotParseCommand = errors.New("The cluster command data was not properly formatted. Unable to parse it.")
 var EReplicaNumberInvalid = errors.New("The command specified an invalid replica number for a partition.")
@@ -111,6 +113,12 @@ func (clusterController *ClusterController) Step(clusterCommand ClusterCommand)
     case ClusterSnapshot:
         // Do nothing
         err = nil
+    case ClusterSetRelaySubscription:
+        err = clusterController.SetRelaySubscription(body.(ClusterSetRelaySubscriptionBody))
+    case ClusterSetRelayAddress:
+        err = clusterController.SetRelayAddress(body.(ClusterSetRelayAddressBody))
+    case ClusterSetWebhook:
+        err = clusterController.SetWebhook(body.(ClusterSetWebhookBody))
     default:
         return nil, ENoSuchCommand
     }
@@ -143,6 +151,8 @@ func (clusterController *ClusterController) ApplySnapshot(snap []byte) error {
     localNodePartitionReplicaSnapshot := clusterController.localNodePartitionReplicaSnapshot()
     relaysSnapshot := clusterController.relaysSnapshot()
     sitesSnapshot := clusterController.sitesSnapshot()
+    relayAddressesSnapshot := clusterController.relayAddressesSnapshot()
+    relaySubscriptionsSnapshot := clusterController.relaySubscriptionsSnapshot()
     _, localNodeWasPresentBefore := clusterController.State.Nodes[clusterController.LocalNodeID]
 
     if err := clusterController.State.Recover(snap); err != nil {
@@ -161,6 +171,8 @@ func (clusterController *ClusterController) ApplySnapshot(snap []byte) error {
     clusterController.localDiffPartitionReplicasAndNotify(localNodePartitionReplicaSnapshot)
     clusterController.diffRelaysAndNotify(relaysSnapshot)
     clusterController.diffSitesAndNotify(sitesSnapshot)
+    clusterController.diffRelayAddressesAndNotify(relayAddressesSnapshot)
+    clusterController.diffRelaySubscriptionsAndNotify(relaySubscriptionsSnapshot)
 
     if localNodeWasPresentBefore && !localNodeIsPresentNow {
         // This node was removed. Provide a remove node delta
@@ -206,6 +218,64 @@ func (clusterController *ClusterController) diffRelaysAndNotify(relaysSnapshot m
     }
 }
 
+func (clusterController *ClusterController) relayAddressesSnapshot() map[string]string {
+    var addresses map[string]string = make(map[string]string)
+
+    for relay, address := range clusterController.State.RelayAddresses {
+        addresses[relay] = address
+    }
+
+    return addresses
+}
+
+func (clusterController *ClusterController) diffRelayAddressesAndNotify(relayAddressesSnapshot map[string]string) {
+    for relay, address := range relayAddressesSnapshot {
+        if _, ok := clusterController.State.Relays[relay]; !ok {
+            // Relay removal is already reported by diffRelaysAndNotify
+            continue
+        }
+
+        if clusterController.State.RelayAddresses[relay] != address {
+            clusterController.notifyLocalNode(DeltaRelayAddressChanged, RelayAddressChanged{ RelayID: relay, Address: clusterController.State.RelayAddresses[relay] })
+        }
+    }
+
+    for relay, address := range clusterController.State.RelayAddresses {
+        if _, ok := relayAddressesSnapshot[relay]; !ok {
+            clusterController.notifyLocalNode(DeltaRelayAddressChanged, RelayAddressChanged{ RelayID: relay, Address: address })
+        }
+    }
+}
+
+func (clusterController *ClusterController) relaySubscriptionsSnapshot() map[string]map[string][]string {
+    var subscriptions map[string]map[string][]string = make(map[string]map[string][]string)
+
+    for relay, subscription := range clusterController.State.RelaySubscriptions {
+        subscriptions[relay] = subscription
+    }
+
+    return subscriptions
+}
+
+func (clusterController *ClusterController) diffRelaySubscriptionsAndNotify(relaySubscriptionsSnapshot map[string]map[string][]string) {
+    for relay, subscription := range relaySubscriptionsSnapshot {
+        if _, ok := clusterController.State.Relays[relay]; !ok {
+            // Relay removal is already reported by diffRelaysAndNotify
+            continue
+        }
+
+        if !reflect.DeepEqual(clusterController.State.RelaySubscriptions[relay], subscription) {
+            clusterController.notifyLocalNode(DeltaRelaySubscriptionChanged, RelaySubscriptionChanged{ RelayID: relay })
+        }
+    }
+
+    for relay, _ := range clusterController.State.RelaySubscriptions {
+        if _, ok := relaySubscriptionsSnapshot[relay]; !ok {
+            clusterController.notifyLocalNode(DeltaRelaySubscriptionChanged, RelaySubscriptionChanged{ RelayID: relay })
+        }
+    }
+}
+
 func (clusterController *ClusterController) diffSitesAndNotify(sitesSnapshot map[string]bool) {
     for site, _ := range sitesSnapshot {
         if _, ok := clusterController.State.Sites[site]; !ok {
@@ -494,6 +564,137 @@ func (clusterController *ClusterController) MoveRelay(clusterCommand ClusterMove
     return nil
 }
 
+func (clusterController *ClusterController) SetRelaySubscription(clusterCommand ClusterSetRelaySubscriptionBody) error {
+    if _, ok := clusterController.State.Relays[clusterCommand.RelayID]; !ok {
+        return ENoSuchRelay
+    }
+
+    currentSubscription := clusterController.State.RelaySubscriptions[clusterCommand.RelayID]
+
+    if (len(currentSubscription) == 0 && len(clusterCommand.Subscription) == 0) || reflect.DeepEqual(currentSubscription, clusterCommand.Subscription) {
+        return nil
+    }
+
+    clusterController.State.SetRelaySubscription(clusterCommand.RelayID, clusterCommand.Subscription)
+    clusterController.notifyLocalNode(DeltaRelaySubscriptionChanged, RelaySubscriptionChanged{ RelayID: clusterCommand.RelayID })
+
+    return nil
+}
+
+// Returns a copy of the key prefixes, per bucket, that are replicated to
+// the relay. A nil map means the relay replicates entire buckets
+func (clusterController *ClusterController) RelaySubscription(relayID string) map[string][]string {
+    clusterController.stateUpdateLock.Lock()
+    defer clusterController.stateUpdateLock.Unlock()
+
+    subscription, ok := clusterController.State.RelaySubscriptions[relayID]
+
+    if !ok {
+        return nil
+    }
+
+    subscriptionCopy := make(map[string][]string, len(subscription))
+
+    for bucket, prefixes := range subscription {
+        subscriptionCopy[bucket] = append([]string{ }, prefixes...)
+    }
+
+    return subscriptionCopy
+}
+
+func (clusterController *ClusterController) SetRelayAddress(clusterCommand ClusterSetRelayAddressBody) error {
+    if _, ok := clusterController.State.Relays[clusterCommand.RelayID]; !ok {
+        return ENoSuchRelay
+    }
+
+    if clusterController.State.RelayAddresses[clusterCommand.RelayID] == clusterCommand.Address {
+        return nil
+    }
+
+    clusterController.State.SetRelayAddress(clusterCommand.RelayID, clusterCommand.Address)
+    clusterController.notifyLocalNode(DeltaRelayAddressChanged, RelayAddressChanged{ RelayID: clusterCommand.RelayID, Address: clusterCommand.Address })
+
+    return nil
+}
+
+func (clusterController *ClusterController) RelayAddress(relayID string) string {
+    clusterController.stateUpdateLock.Lock()
+    defer clusterController.stateUpdateLock.Unlock()
+
+    return clusterController.State.RelayAddresses[relayID]
+}
+
+// Returns the relays that belong to a site mapped to the LAN address each
+// one advertises. Relays that have not advertised an address map to ""
+func (clusterController *ClusterController) SiteRelays(siteID string) map[string]string {
+    clusterController.stateUpdateLock.Lock()
+    defer clusterController.stateUpdateLock.Unlock()
+
+    relays := make(map[string]string)
+
+    if siteID == "" {
+        return relays
+    }
+
+    for relayID, relaysSiteID := range clusterController.State.Relays {
+        if relaysSiteID == siteID {
+            relays[relayID] = clusterController.State.RelayAddresses[relayID]
+        }
+    }
+
+    return relays
+}
+
+func (clusterController *ClusterController) SetWebhook(clusterCommand ClusterSetWebhookBody) error {
+    if clusterCommand.WebhookID == "" {
+        return EInvalidWebhook
+    }
+
+    if clusterCommand.Webhook != nil {
+        if clusterCommand.Webhook.Bucket == "" || clusterCommand.Webhook.URL == "" {
+            return EInvalidWebhook
+        }
+
+        if clusterCommand.Webhook.SiteID != "" && !clusterController.State.SiteExists(clusterCommand.Webhook.SiteID) {
+            return ENoSuchSite
+        }
+    }
+
+    clusterController.State.SetWebhook(clusterCommand.WebhookID, clusterCommand.Webhook)
+
+    return nil
+}
+
+// Returns a copy of the webhooks in the cluster mapped by their IDs
+func (clusterController *ClusterController) Webhooks() map[string]Webhook {
+    clusterController.stateUpdateLock.Lock()
+    defer clusterController.stateUpdateLock.Unlock()
+
+    webhooks := make(map[string]Webhook, len(clusterController.State.Webhooks))
+
+    for webhookID, webhook := range clusterController.State.Webhooks {
+        webhooks[webhookID] = webhook
+    }
+
+    return webhooks
+}
+
+// Returns the IDs of all sites in the cluster in sorted order
+func (clusterController *ClusterController) Sites() []string {
+    clusterController.stateUpdateLock.Lock()
+    defer clusterController.stateUpdateLock.Unlock()
+
+    sites := make([]string, 0, len(clusterController.State.Sites))
+
+    for siteID, _ := range clusterController.State.Sites {
+        sites = append(sites, siteID)
+    }
+
+    sort.Strings(sites)
+
+    return sites
+}
+
 func (clusterController *ClusterController) RelaySite(relayID string) string {
     clusterController.stateUpdateLock.Lock()
     defer clusterController.stateUpdateLock.Unlock()
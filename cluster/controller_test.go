@@ -1811,6 +1811,145 @@ var _ = Describe("Controller", func() {
                 Expect(clusterController.State).Should(Equal(snapshotClusterState))
                 Expect(clusterController.Deltas()[0]).Should(Equal(ClusterStateDelta{ Type: DeltaSiteRemoved, Delta: SiteRemoved{ SiteID: "site1" } }))
             })
+
+            It("should notify the node of relays whose advertised address is different after the snapshot is applied", func() {
+                originalClusterState := ClusterState{
+                    Nodes: map[uint64]*NodeConfig{
+                    },
+                    ClusterSettings: ClusterSettings{ ReplicationFactor: 2, Partitions: 4 },
+                    Relays: map[string]string{ "WWRL000000": "site1", "WWRL000001": "site1" },
+                    RelayAddresses: map[string]string{ "WWRL000000": "10.0.0.1:9090" },
+                }
+                snapshotClusterState := ClusterState{
+                    Nodes: map[uint64]*NodeConfig{
+                    },
+                    ClusterSettings: ClusterSettings{ ReplicationFactor: 2, Partitions: 4 }, // normally these values dont change but to test the difference we will change these
+                    Relays: map[string]string{ "WWRL000000": "site1", "WWRL000001": "site1" },
+                    RelayAddresses: map[string]string{ "WWRL000001": "10.0.0.2:9090" },
+                }
+
+                snapshotClusterState.Initialize() // makes sure tokens and partition replicas are filled in
+                originalClusterState.Initialize() // makes sure tokens and partition replicas are filled in
+
+                clusterController := &ClusterController{
+                    LocalNodeID: 1,
+                    State: originalClusterState,
+                    PartitioningStrategy: &testPartitioningStrategy{ },
+                }
+
+                snap, _ := snapshotClusterState.Snapshot()
+
+                Expect(clusterController.ApplySnapshot(snap)).Should(BeNil())
+                Expect(clusterController.State).Should(Equal(snapshotClusterState))
+                Expect(clusterController.Deltas()).Should(ConsistOf(
+                    ClusterStateDelta{ Type: DeltaRelayAddressChanged, Delta: RelayAddressChanged{ RelayID: "WWRL000000", Address: "" } },
+                    ClusterStateDelta{ Type: DeltaRelayAddressChanged, Delta: RelayAddressChanged{ RelayID: "WWRL000001", Address: "10.0.0.2:9090" } },
+                ))
+            })
+        })
+
+        Describe("#SetRelaySubscription", func() {
+            var clusterController *ClusterController
+
+            BeforeEach(func() {
+                clusterController = &ClusterController{
+                    LocalNodeID: 1,
+                    State: ClusterState{
+                        Relays: map[string]string{ "WWRL000000": "site1" },
+                        Sites: map[string]bool{ "site1": true },
+                    },
+                    PartitioningStrategy: &testPartitioningStrategy{ },
+                }
+            })
+
+            It("should notify the node only if the subscription changed", func() {
+                Expect(clusterController.SetRelaySubscription(ClusterSetRelaySubscriptionBody{ RelayID: "WWRL000000", Subscription: map[string][]string{ } })).Should(BeNil())
+                Expect(clusterController.Deltas()).Should(BeEmpty())
+
+                Expect(clusterController.SetRelaySubscription(ClusterSetRelaySubscriptionBody{ RelayID: "WWRL000000", Subscription: map[string][]string{ "default": []string{ "a" } } })).Should(BeNil())
+                Expect(clusterController.Deltas()).Should(Equal([]ClusterStateDelta{ ClusterStateDelta{ Type: DeltaRelaySubscriptionChanged, Delta: RelaySubscriptionChanged{ RelayID: "WWRL000000" } } }))
+
+                Expect(clusterController.SetRelaySubscription(ClusterSetRelaySubscriptionBody{ RelayID: "WWRL000000", Subscription: map[string][]string{ "default": []string{ "a" } } })).Should(BeNil())
+                Expect(clusterController.Deltas()).Should(HaveLen(1))
+
+                Expect(clusterController.SetRelaySubscription(ClusterSetRelaySubscriptionBody{ RelayID: "WWRL000000", Subscription: nil })).Should(BeNil())
+                Expect(clusterController.Deltas()).Should(HaveLen(2))
+            })
+        })
+
+        Describe("#SetRelayAddress", func() {
+            var clusterController *ClusterController
+
+            BeforeEach(func() {
+                clusterController = &ClusterController{
+                    LocalNodeID: 1,
+                    State: ClusterState{
+                        Relays: map[string]string{ "WWRL000000": "site1", "WWRL000001": "site1", "WWRL000002": "site2" },
+                        Sites: map[string]bool{ "site1": true, "site2": true },
+                    },
+                    PartitioningStrategy: &testPartitioningStrategy{ },
+                }
+            })
+
+            It("should return ENoSuchRelay if the relay does not exist", func() {
+                Expect(clusterController.SetRelayAddress(ClusterSetRelayAddressBody{ RelayID: "WWRL000009", Address: "10.0.0.9:9090" })).Should(Equal(ENoSuchRelay))
+                Expect(clusterController.Deltas()).Should(BeEmpty())
+            })
+
+            It("should record the address and notify the node only if the address changed", func() {
+                Expect(clusterController.SetRelayAddress(ClusterSetRelayAddressBody{ RelayID: "WWRL000000", Address: "10.0.0.1:9090" })).Should(BeNil())
+                Expect(clusterController.Deltas()).Should(Equal([]ClusterStateDelta{ ClusterStateDelta{ Type: DeltaRelayAddressChanged, Delta: RelayAddressChanged{ RelayID: "WWRL000000", Address: "10.0.0.1:9090" } } }))
+                Expect(clusterController.RelayAddress("WWRL000000")).Should(Equal("10.0.0.1:9090"))
+
+                Expect(clusterController.SetRelayAddress(ClusterSetRelayAddressBody{ RelayID: "WWRL000000", Address: "10.0.0.1:9090" })).Should(BeNil())
+                Expect(clusterController.Deltas()).Should(HaveLen(1))
+            })
+
+            It("should list the relays in a site along with their addresses", func() {
+                Expect(clusterController.SetRelayAddress(ClusterSetRelayAddressBody{ RelayID: "WWRL000000", Address: "10.0.0.1:9090" })).Should(BeNil())
+                Expect(clusterController.SetRelayAddress(ClusterSetRelayAddressBody{ RelayID: "WWRL000002", Address: "10.0.0.3:9090" })).Should(BeNil())
+                Expect(clusterController.SiteRelays("site1")).Should(Equal(map[string]string{ "WWRL000000": "10.0.0.1:9090", "WWRL000001": "" }))
+                Expect(clusterController.SiteRelays("site2")).Should(Equal(map[string]string{ "WWRL000002": "10.0.0.3:9090" }))
+                Expect(clusterController.SiteRelays("")).Should(BeEmpty())
+            })
+        })
+
+        Describe("#SetWebhook", func() {
+            var clusterController *ClusterController
+
+            BeforeEach(func() {
+                clusterController = &ClusterController{
+                    LocalNodeID: 1,
+                    State: ClusterState{
+                        Sites: map[string]bool{ "site2": true, "site1": true },
+                    },
+                    PartitioningStrategy: &testPartitioningStrategy{ },
+                }
+            })
+
+            It("should return EInvalidWebhook if the webhook has no ID, bucket or URL", func() {
+                Expect(clusterController.SetWebhook(ClusterSetWebhookBody{ Webhook: &Webhook{ Bucket: "default", URL: "http://localhost:8080" } })).Should(Equal(EInvalidWebhook))
+                Expect(clusterController.SetWebhook(ClusterSetWebhookBody{ WebhookID: "hook1", Webhook: &Webhook{ URL: "http://localhost:8080" } })).Should(Equal(EInvalidWebhook))
+                Expect(clusterController.SetWebhook(ClusterSetWebhookBody{ WebhookID: "hook1", Webhook: &Webhook{ Bucket: "default" } })).Should(Equal(EInvalidWebhook))
+                Expect(clusterController.Webhooks()).Should(BeEmpty())
+            })
+
+            It("should return ENoSuchSite if the webhook is tied to a site that does not exist", func() {
+                Expect(clusterController.SetWebhook(ClusterSetWebhookBody{ WebhookID: "hook1", Webhook: &Webhook{ SiteID: "site9", Bucket: "default", URL: "http://localhost:8080" } })).Should(Equal(ENoSuchSite))
+                Expect(clusterController.Webhooks()).Should(BeEmpty())
+            })
+
+            It("should record the webhook and remove it when it is set to nil", func() {
+                Expect(clusterController.SetWebhook(ClusterSetWebhookBody{ WebhookID: "hook1", Webhook: &Webhook{ SiteID: "site1", Bucket: "default", URL: "http://localhost:8080" } })).Should(BeNil())
+                Expect(clusterController.Webhooks()).Should(Equal(map[string]Webhook{ "hook1": Webhook{ SiteID: "site1", Bucket: "default", URL: "http://localhost:8080" } }))
+
+                Expect(clusterController.SetWebhook(ClusterSetWebhookBody{ WebhookID: "hook1" })).Should(BeNil())
+                Expect(clusterController.Webhooks()).Should(BeEmpty())
+            })
+
+            It("should list the sites in sorted order", func() {
+                Expect(clusterController.Sites()).Should(Equal([]string{ "site1", "site2" }))
+            })
         })
     })
 })
@@ -44,6 +44,8 @@ const (
     DeltaRelayAdded ClusterStateDeltaType = iota
     DeltaRelayRemoved ClusterStateDeltaType = iota
     DeltaRelayMoved ClusterStateDeltaType = iota
+    DeltaRelayAddressChanged ClusterStateDeltaType = iota
+    DeltaRelaySubscriptionChanged ClusterStateDeltaType = iota
 )
 
 type ClusterStateDeltaRange []ClusterStateDelta
@@ -132,6 +134,10 @@ func (r ClusterStateDeltaRange) Less(i, j int) bool {
         }
 
         return r[i].Delta.(RelayMoved).SiteID < r[j].Delta.(RelayMoved).SiteID
+    case DeltaRelayAddressChanged:
+        return r[i].Delta.(RelayAddressChanged).RelayID < r[j].Delta.(RelayAddressChanged).RelayID
+    case DeltaRelaySubscriptionChanged:
+        return r[i].Delta.(RelaySubscriptionChanged).RelayID < r[j].Delta.(RelaySubscriptionChanged).RelayID
     }
 
     return false
@@ -209,4 +215,13 @@ type RelayRemoved struct {
 type RelayMoved struct {
     RelayID string
     SiteID string
-}
\ No newline at end of file
+}
+
+type RelayAddressChanged struct {
+    RelayID string
+    Address string
+}
+
+type RelaySubscriptionChanged struct {
+    RelayID string
+}
@@ -133,6 +133,28 @@ type ClusterState struct {
     ClusterSettings ClusterSettings
     Sites map[string]bool
     Relays map[string]string
+    // Maps relay IDs to the key prefixes, per bucket, that are replicated
+    // to that relay. Relays without an entry replicate entire buckets
+    RelaySubscriptions map[string]map[string][]string
+    // Maps relay IDs to the LAN address each relay advertises to its
+    // site siblings
+    RelayAddresses map[string]string
+    // Maps webhook IDs to the webhooks that receive updates made to site
+    // buckets
+    Webhooks map[string]Webhook
+}
+
+// A Webhook subscribes an HTTP endpoint to updates made to keys in a
+// site bucket
+type Webhook struct {
+    // The site whose updates are delivered. Empty for all sites
+    SiteID string
+    Bucket string
+    // Only updates to keys with this prefix are delivered
+    Prefix string
+    URL string
+    // The key used to sign payloads with HMAC-SHA256
+    Secret string
 }
 
 func (clusterState *ClusterState) SiteExists(siteID string) bool {
@@ -164,6 +186,12 @@ func (clusterState *ClusterState) RemoveSite(siteID string) {
         }
     }
 
+    for webhookID, webhook := range clusterState.Webhooks {
+        if webhook.SiteID == siteID {
+            delete(clusterState.Webhooks, webhookID)
+        }
+    }
+
     delete(clusterState.Sites, siteID)
 }
 
@@ -181,6 +209,8 @@ func (clusterState *ClusterState) RemoveRelay(relayID string) {
     }
 
     delete(clusterState.Relays, relayID)
+    delete(clusterState.RelaySubscriptions, relayID)
+    delete(clusterState.RelayAddresses, relayID)
 }
 
 func (clusterState *ClusterState) MoveRelay(relayID, siteID string) {
@@ -199,6 +229,60 @@ func (clusterState *ClusterState) MoveRelay(relayID, siteID string) {
     clusterState.Relays[relayID] = siteID
 }
 
+func (clusterState *ClusterState) SetRelaySubscription(relayID string, subscription map[string][]string) {
+    if _, ok := clusterState.Relays[relayID]; !ok {
+        return
+    }
+
+    if len(subscription) == 0 {
+        delete(clusterState.RelaySubscriptions, relayID)
+
+        return
+    }
+
+    if clusterState.RelaySubscriptions == nil {
+        clusterState.RelaySubscriptions = make(map[string]map[string][]string)
+    }
+
+    clusterState.RelaySubscriptions[relayID] = subscription
+}
+
+func (clusterState *ClusterState) SetRelayAddress(relayID string, address string) {
+    if _, ok := clusterState.Relays[relayID]; !ok {
+        return
+    }
+
+    if address == "" {
+        delete(clusterState.RelayAddresses, relayID)
+
+        return
+    }
+
+    if clusterState.RelayAddresses == nil {
+        clusterState.RelayAddresses = make(map[string]string)
+    }
+
+    clusterState.RelayAddresses[relayID] = address
+}
+
+func (clusterState *ClusterState) SetWebhook(webhookID string, webhook *Webhook) {
+    if webhook == nil {
+        delete(clusterState.Webhooks, webhookID)
+
+        return
+    }
+
+    if webhook.SiteID != "" && !clusterState.SiteExists(webhook.SiteID) {
+        return
+    }
+
+    if clusterState.Webhooks == nil {
+        clusterState.Webhooks = make(map[string]Webhook)
+    }
+
+    clusterState.Webhooks[webhookID] = *webhook
+}
+
 func (clusterState *ClusterState) AddNode(nodeConfig NodeConfig) {
     if clusterState.Nodes == nil {
         // lazy initialization of nodes map
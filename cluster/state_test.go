@@ -406,6 +406,98 @@ var _ = Describe("State", func() {
             })
         })
 
+        Describe("#SetRelaySubscription", func() {
+            It("should do nothing if the relay does not exist", func() {
+                clusterState := &ClusterState{ }
+
+                clusterState.SetRelaySubscription("WWRL000000", map[string][]string{ "default": []string{ "a" } })
+                Expect(clusterState.RelaySubscriptions).Should(BeEmpty())
+            })
+
+            It("should record the subscription for an existing relay", func() {
+                clusterState := &ClusterState{ }
+
+                clusterState.AddRelay("WWRL000000")
+                clusterState.SetRelaySubscription("WWRL000000", map[string][]string{ "default": []string{ "a" } })
+                Expect(clusterState.RelaySubscriptions["WWRL000000"]).Should(Equal(map[string][]string{ "default": []string{ "a" } }))
+            })
+
+            It("should remove the subscription when it is set to an empty subscription or the relay is removed", func() {
+                clusterState := &ClusterState{ }
+
+                clusterState.AddRelay("WWRL000000")
+                clusterState.SetRelaySubscription("WWRL000000", map[string][]string{ "default": []string{ "a" } })
+                clusterState.SetRelaySubscription("WWRL000000", nil)
+                Expect(clusterState.RelaySubscriptions).Should(BeEmpty())
+
+                clusterState.SetRelaySubscription("WWRL000000", map[string][]string{ "default": []string{ "a" } })
+                clusterState.RemoveRelay("WWRL000000")
+                Expect(clusterState.RelaySubscriptions).Should(BeEmpty())
+            })
+        })
+
+        Describe("#SetRelayAddress", func() {
+            It("should do nothing if the relay does not exist", func() {
+                clusterState := &ClusterState{ }
+
+                clusterState.SetRelayAddress("WWRL000000", "10.0.0.1:9090")
+                Expect(clusterState.RelayAddresses).Should(BeEmpty())
+            })
+
+            It("should record the address of an existing relay and forget it when the address is cleared or the relay is removed", func() {
+                clusterState := &ClusterState{ }
+
+                clusterState.AddRelay("WWRL000000")
+                clusterState.SetRelayAddress("WWRL000000", "10.0.0.1:9090")
+                Expect(clusterState.RelayAddresses).Should(Equal(map[string]string{ "WWRL000000": "10.0.0.1:9090" }))
+
+                clusterState.SetRelayAddress("WWRL000000", "")
+                Expect(clusterState.RelayAddresses).Should(BeEmpty())
+
+                clusterState.SetRelayAddress("WWRL000000", "10.0.0.1:9090")
+                clusterState.RemoveRelay("WWRL000000")
+                Expect(clusterState.RelayAddresses).Should(BeEmpty())
+            })
+        })
+
+        Describe("#SetWebhook", func() {
+            It("should do nothing if the webhook is tied to a site that does not exist", func() {
+                clusterState := &ClusterState{ }
+
+                clusterState.SetWebhook("hook1", &Webhook{ SiteID: "site1", Bucket: "default", URL: "http://localhost:8080" })
+                Expect(clusterState.Webhooks).Should(BeEmpty())
+            })
+
+            It("should record a webhook for one site or all sites and remove it when it is set to nil", func() {
+                clusterState := &ClusterState{ }
+
+                clusterState.AddSite("site1")
+                clusterState.SetWebhook("hook1", &Webhook{ SiteID: "site1", Bucket: "default", URL: "http://localhost:8080" })
+                clusterState.SetWebhook("hook2", &Webhook{ Bucket: "cloud", Prefix: "a", URL: "http://localhost:8081" })
+                Expect(clusterState.Webhooks).Should(Equal(map[string]Webhook{
+                    "hook1": Webhook{ SiteID: "site1", Bucket: "default", URL: "http://localhost:8080" },
+                    "hook2": Webhook{ Bucket: "cloud", Prefix: "a", URL: "http://localhost:8081" },
+                }))
+
+                clusterState.SetWebhook("hook1", nil)
+                Expect(clusterState.Webhooks).Should(Equal(map[string]Webhook{
+                    "hook2": Webhook{ Bucket: "cloud", Prefix: "a", URL: "http://localhost:8081" },
+                }))
+            })
+
+            It("should remove the webhooks tied to a site when the site is removed", func() {
+                clusterState := &ClusterState{ }
+
+                clusterState.AddSite("site1")
+                clusterState.SetWebhook("hook1", &Webhook{ SiteID: "site1", Bucket: "default", URL: "http://localhost:8080" })
+                clusterState.SetWebhook("hook2", &Webhook{ Bucket: "default", URL: "http://localhost:8081" })
+                clusterState.RemoveSite("site1")
+                Expect(clusterState.Webhooks).Should(Equal(map[string]Webhook{
+                    "hook2": Webhook{ Bucket: "default", URL: "http://localhost:8081" },
+                }))
+            })
+        })
+
         Describe("#Snapshot + #Recover", func() {
             It("Snapshot should produce a byte array that when parsed by Recover produces a copy of the cluster state", func() {
                 node1 := NodeConfig{ 
@@ -76,6 +76,11 @@ const (
     eSNAPSHOT_IN_PROGRESS = iota
     eSNAPSHOT_OPEN_FAILED = iota
     eSNAPSHOT_READ_FAILED = iota
+    eMERKLE_DEPTH = iota
+    eNO_SUCH_ALERT = iota
+    eNO_SUCH_WEBHOOK = iota
+    eWEBHOOK_BODY = iota
+    eBUNDLE_MISMATCH = iota
 )
 
 var (
@@ -107,6 +112,11 @@ var (
     ESnapshotInProgress    = DBerror{ "The specified snapshot is still in progress", eSNAPSHOT_IN_PROGRESS }
     ESnapshotOpenFailed    = DBerror{ "The snapshot could not be opened.", eSNAPSHOT_OPEN_FAILED }
     ESnapshotReadFailed    = DBerror{ "The snapshot could be opened, but it appears to be incomplete or invalid.", eSNAPSHOT_READ_FAILED }
+    EMerkleDepth           = DBerror{ "The merkle depth is out of range", eMERKLE_DEPTH }
+    EAlertDoesNotExist     = DBerror{ "The specified alert is not firing.", eNO_SUCH_ALERT }
+    EWebhookDoesNotExist   = DBerror{ "The specified webhook does not exist.", eNO_SUCH_WEBHOOK }
+    EWebhookBody           = DBerror{ "Invalid webhook body. A webhook needs a bucket and a URL.", eWEBHOOK_BODY }
+    EBundleMismatch        = DBerror{ "The bundle was exported from a different site or bucket.", eBUNDLE_MISMATCH }
 )
 
 func DBErrorFromJSON(encodedError []byte) (DBerror, error) {
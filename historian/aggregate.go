@@ -0,0 +1,255 @@
+package historian
+//
+ // Copyright (c) 2019 ARM Limited.
+ //
+ // SPDX-License-Identifier: MIT
+ //
+ // Permission is hereby granted, free of charge, to any person obtaining a copy
+ // of this software and associated documentation files (the "Software"), to
+ // deal in the Software without restriction, including without limitation the
+ // rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ // sell copies of the Software, and to permit persons to whom the Software is
+ // furnished to do so, subject to the following conditions:
+ //
+ // The above copyright notice and this permission notice shall be included in all
+ // copies or substantial portions of the Software.
+ //
+ // THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ // IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ // FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ // AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ // LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ // SOFTWARE.
+ //
+
+
+import (
+    "errors"
+    "math"
+    "net/url"
+    "sort"
+    "strconv"
+    "strings"
+
+    . "github.com/armPelionEdge/devicedb/error"
+)
+
+const (
+    AGGREGATE_BY_SOURCE = "source"
+    AGGREGATE_BY_TYPE = "type"
+)
+
+// The widths in milliseconds of the time buckets events can be
+// aggregated into
+var AggregationIntervals = map[string]uint64{
+    "minute": 60 * 1000,
+    "hour": 60 * 60 * 1000,
+    "day": 24 * 60 * 60 * 1000,
+}
+
+// AggregationQuery counts the events matching a history query in
+// fixed width time buckets, optionally split by source or by type
+type AggregationQuery struct {
+    HistoryQuery HistoryQuery
+    // Width of each time bucket in milliseconds
+    Interval uint64
+    // Either empty, AGGREGATE_BY_SOURCE or AGGREGATE_BY_TYPE
+    GroupBy string
+}
+
+// AggregateBucket summarizes the events in one time bucket. Min, Max and
+// Average only cover events whose data is a number and are left out when
+// there are none
+type AggregateBucket struct {
+    Start uint64 `json:"start"`
+    Source string `json:"source,omitempty"`
+    Type string `json:"type,omitempty"`
+    Count uint64 `json:"count"`
+    NumericCount uint64 `json:"numericCount,omitempty"`
+    Min *float64 `json:"min,omitempty"`
+    Max *float64 `json:"max,omitempty"`
+    Average *float64 `json:"average,omitempty"`
+}
+
+func (bucket *AggregateBucket) add(event *Event) {
+    bucket.Count++
+
+    data := strings.TrimLeft(strings.TrimSpace(event.Data), "+-")
+
+    // ParseFloat also accepts hexadecimal floats, infinities and NaN
+    // which are not numbers a relay would report
+    if strings.HasPrefix(data, "0x") || strings.HasPrefix(data, "0X") {
+        return
+    }
+
+    value, err := strconv.ParseFloat(strings.TrimSpace(event.Data), 64)
+
+    if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+        return
+    }
+
+    if bucket.NumericCount == 0 {
+        bucket.Min = new(float64)
+        bucket.Max = new(float64)
+        bucket.Average = new(float64)
+        *bucket.Min = value
+        *bucket.Max = value
+    }
+
+    if value < *bucket.Min {
+        *bucket.Min = value
+    }
+
+    if value > *bucket.Max {
+        *bucket.Max = value
+    }
+
+    // Keep a running average so the sum of many large values can't
+    // overflow. Dividing before subtracting keeps the difference of two
+    // large values of opposite sign from overflowing too
+    bucket.NumericCount++
+    *bucket.Average += value / float64(bucket.NumericCount) - *bucket.Average / float64(bucket.NumericCount)
+}
+
+// Aggregate summarizes the events matching the aggregation query's
+// history query. The query's limit is ignored since every matching event
+// must be counted. Buckets are sorted by start time in the query's order
+// and then by source or type
+func (historian *Historian) Aggregate(query *AggregationQuery) ([]*AggregateBucket, error) {
+    if query.Interval == 0 {
+        return nil, ERequestQuery
+    }
+
+    historyQuery := query.HistoryQuery
+    historyQuery.Limit = 0
+
+    eventIterator, err := historian.Query(&historyQuery)
+
+    if err != nil {
+        return nil, err
+    }
+
+    defer eventIterator.Release()
+
+    return AggregateEvents(query, eventIterator)
+}
+
+// AggregateEvents summarizes the events read from a stream, such as the
+// events matching the aggregation query's history query in several copies
+// of a history log, the same way Aggregate does
+func AggregateEvents(query *AggregationQuery, eventIterator EventStream) ([]*AggregateBucket, error) {
+    if query.Interval == 0 {
+        return nil, ERequestQuery
+    }
+
+    type bucketKey struct {
+        start uint64
+        source string
+        eventType string
+    }
+
+    buckets := make(map[bucketKey]*AggregateBucket)
+    result := make([]*AggregateBucket, 0)
+
+    for eventIterator.Next() {
+        event := eventIterator.Event()
+        key := bucketKey{ start: event.Timestamp - event.Timestamp % query.Interval }
+
+        switch query.GroupBy {
+        case AGGREGATE_BY_SOURCE:
+            key.source = event.SourceID
+        case AGGREGATE_BY_TYPE:
+            key.eventType = event.Type
+        }
+
+        bucket, ok := buckets[key]
+
+        if !ok {
+            bucket = &AggregateBucket{ Start: key.start, Source: key.source, Type: key.eventType }
+            buckets[key] = bucket
+            result = append(result, bucket)
+        }
+
+        bucket.add(event)
+    }
+
+    if eventIterator.Error() != nil {
+        return nil, eventIterator.Error()
+    }
+
+    // Events only come out of the indexes in time order within one
+    // source, type or group so the buckets still need sorting
+    sort.Slice(result, func(i, j int) bool {
+        if result[i].Start != result[j].Start {
+            if query.HistoryQuery.Order == "desc" {
+                return result[i].Start > result[j].Start
+            }
+
+            return result[i].Start < result[j].Start
+        }
+
+        if result[i].Source != result[j].Source {
+            return result[i].Source < result[j].Source
+        }
+
+        return result[i].Type < result[j].Type
+    })
+
+    return result, nil
+}
+
+// ParseAggregationQuery builds an aggregation query from the query
+// parameters of a GET /events/aggregate request. It accepts the same
+// filters as ParseHistoryQuery along with interval (minute, hour or day,
+// defaulting to hour) and groupBy (source or type)
+func ParseAggregationQuery(query url.Values) (AggregationQuery, error) {
+    var aggregationQuery AggregationQuery
+    var err error
+
+    aggregationQuery.HistoryQuery, err = ParseHistoryQuery(query)
+
+    if err != nil {
+        return AggregationQuery{ }, err
+    }
+
+    interval := query.Get("interval")
+
+    if interval == "" {
+        interval = "hour"
+    }
+
+    if _, ok := AggregationIntervals[interval]; !ok {
+        return AggregationQuery{ }, errors.New("Invalid aggregation interval " + interval)
+    }
+
+    aggregationQuery.Interval = AggregationIntervals[interval]
+
+    switch query.Get("groupBy") {
+    case "":
+    case AGGREGATE_BY_SOURCE, AGGREGATE_BY_TYPE:
+        aggregationQuery.GroupBy = query.Get("groupBy")
+    default:
+        return AggregationQuery{ }, errors.New("Invalid aggregation groupBy " + query.Get("groupBy"))
+    }
+
+    return aggregationQuery, nil
+}
+
+// EncodeAggregationQuery turns an aggregation query back into the query
+// parameters that ParseAggregationQuery accepts
+func EncodeAggregationQuery(aggregationQuery AggregationQuery) url.Values {
+    query := EncodeHistoryQuery(aggregationQuery.HistoryQuery)
+
+    for name, interval := range AggregationIntervals {
+        if interval == aggregationQuery.Interval {
+            query.Set("interval", name)
+        }
+    }
+
+    if aggregationQuery.GroupBy != "" {
+        query.Set("groupBy", aggregationQuery.GroupBy)
+    }
+
+    return query
+}
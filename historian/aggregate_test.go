@@ -0,0 +1,174 @@
+package historian_test
+//
+ // Copyright (c) 2019 ARM Limited.
+ //
+ // SPDX-License-Identifier: MIT
+ //
+ // Permission is hereby granted, free of charge, to any person obtaining a copy
+ // of this software and associated documentation files (the "Software"), to
+ // deal in the Software without restriction, including without limitation the
+ // rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ // sell copies of the Software, and to permit persons to whom the Software is
+ // furnished to do so, subject to the following conditions:
+ //
+ // The above copyright notice and this permission notice shall be included in all
+ // copies or substantial portions of the Software.
+ //
+ // THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ // IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ // FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ // AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ // LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ // SOFTWARE.
+ //
+
+import (
+    "encoding/json"
+    "net/url"
+
+    . "github.com/armPelionEdge/devicedb/historian"
+    . "github.com/armPelionEdge/devicedb/storage"
+    . "github.com/armPelionEdge/devicedb/util"
+
+    . "github.com/onsi/ginkgo"
+    . "github.com/onsi/gomega"
+)
+
+var _ = Describe("Aggregate", func() {
+    var (
+        storageEngine StorageDriver
+        historian *Historian
+    )
+
+    BeforeEach(func() {
+        storageEngine = MakeNewStorageDriver()
+        storageEngine.Open()
+
+        historian = NewHistorian(storageEngine, 0, 0, 1000)
+
+        // Two minutes of temperature readings from two sensors plus a
+        // door event that has no numeric data
+        historian.LogEvent(&Event{ Timestamp: 1000, SourceID: "sensor1", Type: "temperature", Data: "20" })
+        historian.LogEvent(&Event{ Timestamp: 2000, SourceID: "sensor2", Type: "temperature", Data: "24" })
+        historian.LogEvent(&Event{ Timestamp: 3000, SourceID: "door1", Type: "door_open", Data: "front" })
+        historian.LogEvent(&Event{ Timestamp: 61000, SourceID: "sensor1", Type: "temperature", Data: "21.5" })
+    })
+
+    AfterEach(func() {
+        storageEngine.Close()
+    })
+
+    It("should count events in each time bucket and summarize their numeric data", func() {
+        buckets, err := historian.Aggregate(&AggregationQuery{ Interval: AggregationIntervals["minute"] })
+
+        Expect(err).Should(BeNil())
+        Expect(len(buckets)).Should(Equal(2))
+        Expect(buckets[0].Start).Should(Equal(uint64(0)))
+        Expect(buckets[0].Count).Should(Equal(uint64(3)))
+        Expect(buckets[0].NumericCount).Should(Equal(uint64(2)))
+        Expect(*buckets[0].Min).Should(Equal(20.0))
+        Expect(*buckets[0].Max).Should(Equal(24.0))
+        Expect(*buckets[0].Average).Should(Equal(22.0))
+        Expect(buckets[1].Start).Should(Equal(uint64(60000)))
+        Expect(buckets[1].Count).Should(Equal(uint64(1)))
+        Expect(*buckets[1].Average).Should(Equal(21.5))
+    })
+
+    It("should treat NaN, infinities and hexadecimal floats as non-numeric data", func() {
+        historian.LogEvent(&Event{ Timestamp: 121000, SourceID: "sensor1", Type: "temperature", Data: "NaN" })
+        historian.LogEvent(&Event{ Timestamp: 122000, SourceID: "sensor1", Type: "temperature", Data: "-Inf" })
+        historian.LogEvent(&Event{ Timestamp: 123000, SourceID: "sensor1", Type: "temperature", Data: "0x1p4" })
+        historian.LogEvent(&Event{ Timestamp: 124000, SourceID: "sensor1", Type: "temperature", Data: "1e400" })
+        historian.LogEvent(&Event{ Timestamp: 125000, SourceID: "sensor1", Type: "temperature", Data: "23" })
+
+        buckets, err := historian.Aggregate(&AggregationQuery{ HistoryQuery: HistoryQuery{ After: 120000 }, Interval: AggregationIntervals["minute"] })
+
+        Expect(err).Should(BeNil())
+        Expect(len(buckets)).Should(Equal(1))
+        Expect(buckets[0].Count).Should(Equal(uint64(5)))
+        Expect(buckets[0].NumericCount).Should(Equal(uint64(1)))
+        Expect(*buckets[0].Min).Should(Equal(23.0))
+        Expect(*buckets[0].Max).Should(Equal(23.0))
+        Expect(*buckets[0].Average).Should(Equal(23.0))
+        Expect(json.Marshal(buckets)).Should(Not(BeEmpty()))
+    })
+
+    It("should not overflow the average of large values of opposite sign", func() {
+        historian.LogEvent(&Event{ Timestamp: 121000, SourceID: "sensor1", Type: "temperature", Data: "1.7e308" })
+        historian.LogEvent(&Event{ Timestamp: 122000, SourceID: "sensor1", Type: "temperature", Data: "-1.7e308" })
+
+        buckets, err := historian.Aggregate(&AggregationQuery{ HistoryQuery: HistoryQuery{ After: 120000 }, Interval: AggregationIntervals["minute"] })
+
+        Expect(err).Should(BeNil())
+        Expect(*buckets[0].Average).Should(Equal(0.0))
+    })
+
+    It("should split buckets by source and leave out statistics for non-numeric data", func() {
+        buckets, err := historian.Aggregate(&AggregationQuery{ Interval: AggregationIntervals["hour"], GroupBy: AGGREGATE_BY_SOURCE })
+
+        Expect(err).Should(BeNil())
+        Expect(len(buckets)).Should(Equal(3))
+        Expect(buckets[0].Source).Should(Equal("door1"))
+        Expect(buckets[0].Count).Should(Equal(uint64(1)))
+        Expect(buckets[0].Min).Should(BeNil())
+        Expect(buckets[1].Source).Should(Equal("sensor1"))
+        Expect(buckets[1].Count).Should(Equal(uint64(2)))
+        Expect(*buckets[1].Min).Should(Equal(20.0))
+        Expect(*buckets[1].Max).Should(Equal(21.5))
+        Expect(buckets[2].Source).Should(Equal("sensor2"))
+    })
+
+    It("should only aggregate events matching the history query", func() {
+        buckets, err := historian.Aggregate(&AggregationQuery{
+            HistoryQuery: HistoryQuery{ Types: []string{ "temperature" }, Limit: 1 },
+            Interval: AggregationIntervals["day"],
+            GroupBy: AGGREGATE_BY_TYPE,
+        })
+
+        Expect(err).Should(BeNil())
+        Expect(len(buckets)).Should(Equal(1))
+        Expect(buckets[0].Type).Should(Equal("temperature"))
+        Expect(buckets[0].Count).Should(Equal(uint64(3)))
+    })
+
+    It("should parse the interval and groupBy query parameters", func() {
+        aggregationQuery, err := ParseAggregationQuery(url.Values{ "interval": []string{ "minute" }, "groupBy": []string{ "type" }, "source": []string{ "sensor1" } })
+
+        Expect(err).Should(BeNil())
+        Expect(aggregationQuery.Interval).Should(Equal(uint64(60000)))
+        Expect(aggregationQuery.GroupBy).Should(Equal(AGGREGATE_BY_TYPE))
+        Expect(aggregationQuery.HistoryQuery.Sources).Should(Equal([]string{ "sensor1" }))
+
+        _, err = ParseAggregationQuery(url.Values{ "interval": []string{ "week" } })
+        Expect(err).Should(Not(BeNil()))
+
+        _, err = ParseAggregationQuery(url.Values{ "groupBy": []string{ "data" } })
+        Expect(err).Should(Not(BeNil()))
+    })
+
+    It("should encode a query so that parsing it again gives the same query", func() {
+        data := "on"
+        minSerial := uint64(4)
+        maxSerial := uint64(9)
+        aggregationQuery := AggregationQuery{
+            HistoryQuery: HistoryQuery{
+                MinSerial: &minSerial,
+                MaxSerial: &maxSerial,
+                Sources: []string{ "sensor1", "sensor2" },
+                Types: []string{ "temperature" },
+                Groups: []string{ "floor1" },
+                Data: &data,
+                Order: "desc",
+                After: 100,
+                Before: 200,
+                Limit: 10,
+            },
+            Interval: AggregationIntervals["day"],
+            GroupBy: AGGREGATE_BY_SOURCE,
+        }
+
+        Expect(ParseAggregationQuery(EncodeAggregationQuery(aggregationQuery))).Should(Equal(aggregationQuery))
+        Expect(ParseHistoryQuery(EncodeHistoryQuery(HistoryQuery{ Sources: []string{ }, Types: []string{ }, Groups: []string{ } }))).Should(Equal(HistoryQuery{ Sources: []string{ }, Types: []string{ }, Groups: []string{ } }))
+    })
+})
@@ -47,6 +47,9 @@ var (
     SEQUENTIAL_COUNTER_PREFIX = []byte{ 4 }
     CURRENT_SIZE_COUNTER_PREFIX = []byte{ 5 }
     HIGHEST_FORWARDED_INDEX_PREFIX = []byte{ 6 }
+    BY_TYPE_AND_TIME_PREFIX = []byte{ 7 }
+    BY_GROUP_AND_TIME_PREFIX = []byte{ 8 }
+    INDEX_VERSION_PREFIX = []byte{ 9 }
     DELIMETER = []byte(".")
 )
 
@@ -68,10 +71,16 @@ func timestampBytes(ts uint64) []byte {
     return bytes
 }
 
+// The version of the indexes kept for each event. Logs written by an
+// older version are reindexed when they are opened
+const INDEX_VERSION = 1
+
 type HistoryQuery struct {
     MinSerial *uint64
     MaxSerial *uint64
     Sources []string
+    Types []string
+    Groups []string
     Data *string
     Order string
     Before uint64
@@ -79,6 +88,48 @@ type HistoryQuery struct {
     Limit int
 }
 
+// matches reports whether an event satisfies every filter in the query
+// except for the serial range
+func (query *HistoryQuery) matches(event *Event) bool {
+    if event.Timestamp < query.After || event.Timestamp >= query.Before {
+        return false
+    }
+
+    if query.Data != nil && event.Data != *query.Data {
+        return false
+    }
+
+    if len(query.Sources) != 0 && !containsString(query.Sources, event.SourceID) {
+        return false
+    }
+
+    if len(query.Types) != 0 && !containsString(query.Types, event.Type) {
+        return false
+    }
+
+    if len(query.Groups) != 0 {
+        for _, group := range event.Groups {
+            if containsString(query.Groups, group) {
+                return true
+            }
+        }
+
+        return false
+    }
+
+    return true
+}
+
+func containsString(list []string, s string) bool {
+    for _, e := range list {
+        if e == s {
+            return true
+        }
+    }
+
+    return false
+}
+
 type Event struct {
     Timestamp uint64 `json:"timestamp"`
     SourceID string `json:"source"`
@@ -157,6 +208,42 @@ func (event *Event) prefixBySourceAndTime() []byte {
     return result
 }
 
+func (event *Event) indexByTypeAndTime() []byte {
+    return append(event.prefixByTypeAndTime(), []byte(event.UUID)...)
+}
+
+func (event *Event) prefixByTypeAndTime() []byte {
+    typeEncoding := []byte(base64.StdEncoding.EncodeToString([]byte(event.Type)))
+    timestampEncoding := timestampBytes(event.Timestamp)
+    result := make([]byte, 0, len(BY_TYPE_AND_TIME_PREFIX) + len(typeEncoding) + len(DELIMETER) + len(timestampEncoding) + len(DELIMETER))
+    
+    result = append(result, BY_TYPE_AND_TIME_PREFIX...)
+    result = append(result, typeEncoding...)
+    result = append(result, DELIMETER...)
+    result = append(result, timestampEncoding...)
+    result = append(result, DELIMETER...)
+    
+    return result
+}
+
+func (event *Event) indexByGroupAndTime(group string) []byte {
+    return append(event.prefixByGroupAndTime(group), []byte(event.UUID)...)
+}
+
+func (event *Event) prefixByGroupAndTime(group string) []byte {
+    groupEncoding := []byte(base64.StdEncoding.EncodeToString([]byte(group)))
+    timestampEncoding := timestampBytes(event.Timestamp)
+    result := make([]byte, 0, len(BY_GROUP_AND_TIME_PREFIX) + len(groupEncoding) + len(DELIMETER) + len(timestampEncoding) + len(DELIMETER))
+    
+    result = append(result, BY_GROUP_AND_TIME_PREFIX...)
+    result = append(result, groupEncoding...)
+    result = append(result, DELIMETER...)
+    result = append(result, timestampEncoding...)
+    result = append(result, DELIMETER...)
+    
+    return result
+}
+
 func (event *Event) indexByDataSourceAndTime() []byte {
     sourceEncoding := []byte(base64.StdEncoding.EncodeToString([]byte(event.SourceID)))
     dataEncoding := []byte(base64.StdEncoding.EncodeToString([]byte(event.Data)))
@@ -212,6 +299,10 @@ type Historian struct {
     // being purged and the purge batch size is 20
     // then 5 batches  will be applied to the data store.
     purgeBatchSize int
+    // retention rules sorted by descending priority
+    retentionRules []RetentionRule
+    // watchers that are sent events as they are logged
+    listeners map[*eventListener]bool
 }
 
 func NewHistorian(storageDriver StorageDriver, eventLimit uint64, eventFloor uint64, purgeBatchSize int) *Historian {
@@ -219,7 +310,9 @@ func NewHistorian(storageDriver StorageDriver, eventLimit uint64, eventFloor uin
     var currentSize uint64
     var forwardIndex uint64
     
-    values, err := storageDriver.Get([][]byte{ SEQUENTIAL_COUNTER_PREFIX, CURRENT_SIZE_COUNTER_PREFIX, HIGHEST_FORWARDED_INDEX_PREFIX })
+    var indexVersion uint64
+    
+    values, err := storageDriver.Get([][]byte{ SEQUENTIAL_COUNTER_PREFIX, CURRENT_SIZE_COUNTER_PREFIX, HIGHEST_FORWARDED_INDEX_PREFIX, INDEX_VERSION_PREFIX })
     
     if err == nil && len(values[0]) == 8 {
         nextID = binary.BigEndian.Uint64(values[0])
@@ -232,6 +325,10 @@ func NewHistorian(storageDriver StorageDriver, eventLimit uint64, eventFloor uin
     if err == nil && len(values[2]) == 8 {
         forwardIndex = binary.BigEndian.Uint64(values[2])
     }
+
+    if err == nil && len(values[3]) == 8 {
+        indexVersion = binary.BigEndian.Uint64(values[3])
+    }
     
     historian := &Historian{
         storageDriver: storageDriver,
@@ -241,6 +338,13 @@ func NewHistorian(storageDriver StorageDriver, eventLimit uint64, eventFloor uin
         eventLimit: eventLimit,
         eventFloor: eventFloor,
         purgeBatchSize: purgeBatchSize,
+        listeners: make(map[*eventListener]bool),
+    }
+
+    if err == nil && indexVersion < INDEX_VERSION {
+        if err := historian.reindex(); err != nil {
+            Log.Errorf("Unable to add type and group indexes to the history log. Queries by type or group will not find events logged before now: %v", err)
+        }
     }
     
     historian.RotateLog()
@@ -248,6 +352,55 @@ func NewHistorian(storageDriver StorageDriver, eventLimit uint64, eventFloor uin
     return historian
 }
 
+// reindex adds the type and group indexes to events logged before
+// those indexes existed
+func (historian *Historian) reindex() error {
+    var minSerial uint64 = 0
+
+    eventIterator, err := historian.Query(&HistoryQuery{ MinSerial: &minSerial })
+
+    if err != nil {
+        return err
+    }
+
+    defer eventIterator.Release()
+
+    batch := NewBatch()
+    batchSize := 0
+
+    for eventIterator.Next() {
+        event := eventIterator.Event()
+        marshaledEvent, _ := json.Marshal(event)
+
+        batch.Put(event.indexByTypeAndTime(), marshaledEvent)
+
+        for _, group := range event.Groups {
+            batch.Put(event.indexByGroupAndTime(group), marshaledEvent)
+        }
+
+        batchSize++
+
+        if batchSize < historian.purgeBatchSize {
+            continue
+        }
+
+        if err := historian.storageDriver.Batch(batch); err != nil {
+            return err
+        }
+
+        batch = NewBatch()
+        batchSize = 0
+    }
+
+    if eventIterator.Error() != nil {
+        return eventIterator.Error()
+    }
+
+    batch.Put(INDEX_VERSION_PREFIX, timestampBytes(INDEX_VERSION))
+
+    return historian.storageDriver.Batch(batch)
+}
+
 func (historian *Historian) LogSize() uint64 {
     return historian.currentSize
 }
@@ -310,10 +463,44 @@ func (historian *Historian) LogEvent(event *Event) error {
     historian.logLock.Lock()
     defer historian.logLock.Unlock()
     
+    event.UUID = randomString()
+
+    return historian.logEvent(event)
+}
+
+// AppendEvent logs an event that was first logged somewhere else, such
+// as in a relay's history log, keeping its UUID. The event is ignored
+// if one with the same UUID and timestamp is already in the log so
+// appending the same event again has no effect
+func (historian *Historian) AppendEvent(event *Event) error {
+    historian.logLock.Lock()
+    defer historian.logLock.Unlock()
+
+    if event.UUID == "" {
+        event.UUID = randomString()
+
+        return historian.logEvent(event)
+    }
+
+    values, err := historian.storageDriver.Get([][]byte{ event.indexByTime() })
+
+    if err != nil {
+        Log.Errorf("Storage driver error in AppendEvent(%v): %s", event, err.Error())
+
+        return EStorage
+    }
+
+    if values[0] != nil {
+        return nil
+    }
+
+    return historian.logEvent(event)
+}
+
+func (historian *Historian) logEvent(event *Event) error {
     // indexed by time
     // indexed by resourceid + time
     // indexed by eventdata + resourceID + time
-    event.UUID = randomString()
     event.Serial = historian.nextID
     
     batch := NewBatch()
@@ -328,6 +515,12 @@ func (historian *Historian) LogEvent(event *Event) error {
     batch.Put(event.indexByTime(), []byte(marshaledEvent))
     batch.Put(event.indexBySourceAndTime(), []byte(marshaledEvent))
     batch.Put(event.indexByDataSourceAndTime(), []byte(marshaledEvent))
+    batch.Put(event.indexByTypeAndTime(), []byte(marshaledEvent))
+
+    for _, group := range event.Groups {
+        batch.Put(event.indexByGroupAndTime(group), []byte(marshaledEvent))
+    }
+
     batch.Put(event.indexBySerial(), []byte(marshaledEvent))
     batch.Put(SEQUENTIAL_COUNTER_PREFIX, timestampBytes(event.Serial))
     batch.Put(CURRENT_SIZE_COUNTER_PREFIX, timestampBytes(historian.currentSize + 1))
@@ -342,6 +535,8 @@ func (historian *Historian) LogEvent(event *Event) error {
     
     historian.nextID += 1
     historian.currentSize += 1
+
+    historian.notifyListeners(event)
     
     err = historian.RotateLog()
     
@@ -352,6 +547,18 @@ func (historian *Historian) LogEvent(event *Event) error {
     return nil
 }
 
+// SetRetention changes the event limit and event floor of the log and
+// rotates it right away if it is already over the new limit
+func (historian *Historian) SetRetention(eventLimit uint64, eventFloor uint64) error {
+    historian.logLock.Lock()
+    defer historian.logLock.Unlock()
+
+    historian.eventLimit = eventLimit
+    historian.eventFloor = eventFloor
+
+    return historian.RotateLog()
+}
+
 func (historian *Historian) Query(query *HistoryQuery) (*EventIterator, error) {
     var ranges [][2][]byte
     var direction int
@@ -371,11 +578,17 @@ func (historian *Historian) Query(query *HistoryQuery) (*EventIterator, error) {
     sort.Strings(query.Sources)
 
     if query.MinSerial != nil {
+        var maxSerial uint64 = math.MaxUint64
+
+        if query.MaxSerial != nil {
+            maxSerial = *query.MaxSerial
+        }
+
         ranges = make([][2][]byte, 1)
         
         ranges[0] = [2][]byte{
             (&Event{ Serial: *query.MinSerial }).prefixBySerial(),
-            (&Event{ Serial: math.MaxUint64 }).prefixBySerial(),
+            (&Event{ Serial: maxSerial }).prefixBySerial(),
         }
     } else if query.MaxSerial != nil {
         ranges = make([][2][]byte, 1)
@@ -384,6 +597,28 @@ func (historian *Historian) Query(query *HistoryQuery) (*EventIterator, error) {
             (&Event{ Serial: 0 }).prefixBySerial(),
             (&Event{ Serial: *query.MaxSerial }).prefixBySerial(),
         }
+    } else if len(query.Groups) != 0 {
+        // groups + time -> indexByGroupAndTime
+        sort.Strings(query.Groups)
+        ranges = make([][2][]byte, 0, len(query.Groups))
+
+        for _, group := range query.Groups {
+            ranges = append(ranges, [2][]byte{
+                (&Event{ Timestamp: query.After }).prefixByGroupAndTime(group),
+                (&Event{ Timestamp: query.Before }).prefixByGroupAndTime(group),
+            })
+        }
+    } else if len(query.Types) != 0 {
+        // types + time -> indexByTypeAndTime
+        sort.Strings(query.Types)
+        ranges = make([][2][]byte, 0, len(query.Types))
+
+        for _, eventType := range query.Types {
+            ranges = append(ranges, [2][]byte{
+                (&Event{ Type: eventType, Timestamp: query.After }).prefixByTypeAndTime(),
+                (&Event{ Type: eventType, Timestamp: query.Before }).prefixByTypeAndTime(),
+            })
+        }
     } else if len(query.Sources) == 0 {
         // time -> indexByTime
         ranges = make([][2][]byte, 1)
@@ -422,7 +657,18 @@ func (historian *Historian) Query(query *HistoryQuery) (*EventIterator, error) {
         return nil, err
     }
     
-    return NewEventIterator(iter, query.Limit), nil
+    eventIterator := NewEventIterator(iter, query.Limit)
+
+    // Each index only narrows the query down by some of the filters so
+    // every event is checked against all of them whichever index is used
+    eventIterator.filter = query.matches
+
+    // An event in more than one of the groups is found in each of them
+    if len(query.Groups) > 1 {
+        eventIterator.seen = make(map[string]bool)
+    }
+    
+    return eventIterator, nil
 }
 
 func (historian *Historian) Purge(query *HistoryQuery) error {
@@ -433,13 +679,26 @@ func (historian *Historian) Purge(query *HistoryQuery) error {
 }
 
 func (historian *Historian) purge(query *HistoryQuery) error {
+    _, err := historian.purgeWhere(query, nil, 0)
+
+    return err
+}
+
+// purgeWhere deletes the events returned by query for which shouldPurge
+// returns true, or all of them if shouldPurge is nil. If limit is not
+// zero it stops after deleting that many events. It returns the number
+// of events deleted
+func (historian *Historian) purgeWhere(query *HistoryQuery, shouldPurge func(*Event) bool, limit uint64) (uint64, error) {
     eventIterator, err := historian.Query(query)
     
     if err != nil {
-        return err
+        return 0, err
     }
 
+    defer eventIterator.Release()
+
     var eventBatch []*Event
+    var purged uint64
 
     if historian.purgeBatchSize <= 0 {
         eventBatch = make([]*Event, 1)
@@ -449,7 +708,11 @@ func (historian *Historian) purge(query *HistoryQuery) error {
 
     var currentBatchSize int = 0
 
-    for eventIterator.Next() {
+    for (limit == 0 || purged + uint64(currentBatchSize) < limit) && eventIterator.Next() {
+        if shouldPurge != nil && !shouldPurge(eventIterator.Event()) {
+            continue
+        }
+
         eventBatch[currentBatchSize] = eventIterator.Event()
         currentBatchSize++
 
@@ -461,17 +724,18 @@ func (historian *Historian) purge(query *HistoryQuery) error {
         err := historian.purgeEvents(eventBatch)
         
         if err != nil {
-            return err
+            return purged, err
         }
 
         // This needs to be reset since the next events belong to a new batch
+        purged += uint64(currentBatchSize)
         currentBatchSize = 0
     }
     
     if eventIterator.Error() != nil {
-        Log.Errorf("Storage driver error in Purge(%v): %s", query, err.Error())
+        Log.Errorf("Storage driver error in Purge(%v): %s", query, eventIterator.Error().Error())
         
-        return eventIterator.Error()
+        return purged, eventIterator.Error()
     }
 
     // This needs to be called after the main loop exits since
@@ -482,10 +746,10 @@ func (historian *Historian) purge(query *HistoryQuery) error {
     err = historian.purgeEvents(eventBatch[:currentBatchSize])
 
     if err != nil {
-        return err
+        return purged, err
     }
     
-    return nil
+    return purged + uint64(currentBatchSize), nil
 }
 
 func (historian *Historian) purgeEvents(events []*Event) error {
@@ -495,6 +759,12 @@ func (historian *Historian) purgeEvents(events []*Event) error {
         batch.Delete(event.indexByTime())
         batch.Delete(event.indexBySourceAndTime())
         batch.Delete(event.indexByDataSourceAndTime())
+        batch.Delete(event.indexByTypeAndTime())
+
+        for _, group := range event.Groups {
+            batch.Delete(event.indexByGroupAndTime(group))
+        }
+
         batch.Delete(event.indexBySerial())
     }
 
@@ -541,12 +811,24 @@ func (historian *Historian) purgeEvents(events []*Event) error {
 // if eventFloor is greater than or equal to
 // eventLimit then eventFloor is ignored and
 // eventLimit is used as the event floor
+//
+// If there are retention rules the events governed
+// by the lowest priority rules are purged first
 func (historian *Historian) RotateLog() error {
     if historian.eventLimit != 0 && historian.currentSize > historian.eventLimit {
         var minSerial uint64 = 0
         var err error
 
-        if historian.eventFloor < historian.eventLimit {
+        if len(historian.retentionRules) != 0 {
+            floor := historian.eventFloor
+
+            if floor >= historian.eventLimit {
+                floor = historian.eventLimit
+            }
+
+            Log.Debugf("Purging %d items from history log by retention priority (currentSize=%d eventFloor=%d)", int(historian.currentSize - floor), historian.currentSize, floor)
+            err = historian.purgeByPriority(historian.currentSize - floor)
+        } else if historian.eventFloor < historian.eventLimit {
             Log.Debugf("Purging oldest %d items from history log (currentSize=%d eventFloor=%d)", int(historian.currentSize - historian.eventFloor), historian.currentSize, historian.eventFloor)
             err = historian.purge(&HistoryQuery{ MinSerial: &minSerial, Limit: int(historian.currentSize - historian.eventFloor) })
         } else {
@@ -568,6 +850,8 @@ type EventIterator struct {
     currentEvent *Event
     limit uint64
     eventsSeen uint64
+    filter func(*Event) bool
+    seen map[string]bool
 }
 
 func NewEventIterator(iterator StorageIterator, limit int) *EventIterator {
@@ -587,27 +871,42 @@ func NewEventIterator(iterator StorageIterator, limit int) *EventIterator {
 func (ei *EventIterator) Next() bool {
     ei.currentEvent = nil
     
-    if !ei.dbIterator.Next() {
-        if ei.dbIterator.Error() != nil {
-            Log.Errorf("Storage driver error in Next(): %s", ei.dbIterator.Error())
+    for ei.currentEvent == nil {
+        if !ei.dbIterator.Next() {
+            if ei.dbIterator.Error() != nil {
+                Log.Errorf("Storage driver error in Next(): %s", ei.dbIterator.Error())
+            }
+            
+            return false
         }
-        
-        return false
-    }
 
-    var event Event
-    
-    ei.parseError = json.Unmarshal(ei.dbIterator.Value(), &event)
-    
-    if ei.parseError != nil {
-        Log.Errorf("Storage driver error in Next() key = %v, value = %v: %s", ei.dbIterator.Key(), ei.dbIterator.Value(), ei.parseError.Error())
+        var event Event
         
-        ei.Release()
+        ei.parseError = json.Unmarshal(ei.dbIterator.Value(), &event)
         
-        return false
+        if ei.parseError != nil {
+            Log.Errorf("Storage driver error in Next() key = %v, value = %v: %s", ei.dbIterator.Key(), ei.dbIterator.Value(), ei.parseError.Error())
+            
+            ei.Release()
+            
+            return false
+        }
+
+        if ei.filter != nil && !ei.filter(&event) {
+            continue
+        }
+
+        if ei.seen != nil {
+            if ei.seen[event.UUID] {
+                continue
+            }
+
+            ei.seen[event.UUID] = true
+        }
+        
+        ei.currentEvent = &event
     }
     
-    ei.currentEvent = &event
     ei.eventsSeen += 1
     
     if ei.limit != 0 && ei.eventsSeen == ei.limit {
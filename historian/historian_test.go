@@ -436,5 +436,202 @@ var _ = Describe("Historian", func() {
                 Expect(iter.Event()).Should(BeNil())
             })
         })
+
+        Describe("performing a query filtering by serial range", func() {
+            It("should return the events with serials in [10, 20)", func() {
+                var minSerial uint64 = 10
+                var maxSerial uint64 = 20
+
+                iter, err := historian.Query(&HistoryQuery{ MinSerial: &minSerial, MaxSerial: &maxSerial })
+
+                Expect(err).Should(BeNil())
+
+                for i := 10; i < 20; i += 1 {
+                    Expect(iter.Next()).Should(BeTrue())
+                    Expect(iter.Event().Serial).Should(Equal(uint64(i)))
+                }
+
+                Expect(iter.Next()).Should(BeFalse())
+                Expect(iter.Error()).Should(BeNil())
+            })
+        })
+    })
+
+    Context("There are logged events of different types in different groups", func() {
+        BeforeEach(func() {
+            for i := 0; i < 20; i += 1 {
+                var groups []string
+
+                if i % 2 == 0 {
+                    groups = append(groups, "floor1")
+                }
+
+                if i % 5 == 0 {
+                    groups = append(groups, "floor2")
+                }
+
+                historian.LogEvent(&Event{
+                    Timestamp: uint64(i),
+                    SourceID: fmt.Sprintf("source-%d", (i % 3)),
+                    Type: fmt.Sprintf("type-%d", (i % 4)),
+                    Groups: groups,
+                })
+            }
+        })
+
+        It("should return only events of the queried type within the time range", func() {
+            iter, err := historian.Query(&HistoryQuery{ Types: []string{ "type-1" }, After: 5, Before: 15 })
+
+            Expect(err).Should(BeNil())
+
+            for _, i := range []int{ 5, 9, 13 } {
+                Expect(iter.Next()).Should(BeTrue())
+                Expect(iter.Event().Timestamp).Should(Equal(uint64(i)))
+            }
+
+            Expect(iter.Next()).Should(BeFalse())
+            Expect(iter.Error()).Should(BeNil())
+        })
+
+        It("should apply the type and source filters along with a serial range", func() {
+            // Serials start at 1 so these are the events logged from timestamp 7
+            var minSerial uint64 = 8
+
+            iter, err := historian.Query(&HistoryQuery{ MinSerial: &minSerial, Types: []string{ "type-1" } })
+
+            Expect(err).Should(BeNil())
+
+            for _, i := range []int{ 9, 13, 17 } {
+                Expect(iter.Next()).Should(BeTrue())
+                Expect(iter.Event().Timestamp).Should(Equal(uint64(i)))
+            }
+
+            Expect(iter.Next()).Should(BeFalse())
+
+            iter, err = historian.Query(&HistoryQuery{ MinSerial: &minSerial, Sources: []string{ "source-0" } })
+
+            Expect(err).Should(BeNil())
+
+            for _, i := range []int{ 9, 12, 15, 18 } {
+                Expect(iter.Next()).Should(BeTrue())
+                Expect(iter.Event().Timestamp).Should(Equal(uint64(i)))
+            }
+
+            Expect(iter.Next()).Should(BeFalse())
+        })
+
+        It("should apply the source filter to events found by type", func() {
+            iter, err := historian.Query(&HistoryQuery{ Types: []string{ "type-1" }, Sources: []string{ "source-0" } })
+
+            Expect(err).Should(BeNil())
+            Expect(iter.Next()).Should(BeTrue())
+            Expect(iter.Event().Timestamp).Should(Equal(uint64(9)))
+            Expect(iter.Next()).Should(BeFalse())
+        })
+
+        It("should return events in any of the queried groups once even if they are in more than one", func() {
+            iter, err := historian.Query(&HistoryQuery{ Groups: []string{ "floor2", "floor1" }, Before: 11 })
+
+            Expect(err).Should(BeNil())
+
+            // events in floor1 come first then those only in floor2
+            for _, i := range []int{ 0, 2, 4, 6, 8, 10, 5 } {
+                Expect(iter.Next()).Should(BeTrue())
+                Expect(iter.Event().Timestamp).Should(Equal(uint64(i)))
+            }
+
+            Expect(iter.Next()).Should(BeFalse())
+        })
+
+        It("should combine the group, type and source filters and apply the limit to matching events", func() {
+            iter, err := historian.Query(&HistoryQuery{ Groups: []string{ "floor1" }, Types: []string{ "type-0", "type-2" }, Sources: []string{ "source-0" }, Limit: 2 })
+
+            Expect(err).Should(BeNil())
+
+            for _, i := range []int{ 0, 6 } {
+                Expect(iter.Next()).Should(BeTrue())
+                Expect(iter.Event().Timestamp).Should(Equal(uint64(i)))
+            }
+
+            Expect(iter.Next()).Should(BeFalse())
+        })
+
+        It("should remove purged events from the type and group indexes", func() {
+            Expect(historian.Purge(&HistoryQuery{ Before: 10 })).Should(BeNil())
+
+            iter, err := historian.Query(&HistoryQuery{ Groups: []string{ "floor2" } })
+
+            Expect(err).Should(BeNil())
+
+            for _, i := range []int{ 10, 15 } {
+                Expect(iter.Next()).Should(BeTrue())
+                Expect(iter.Event().Timestamp).Should(Equal(uint64(i)))
+            }
+
+            Expect(iter.Next()).Should(BeFalse())
+
+            iter, err = historian.Query(&HistoryQuery{ Types: []string{ "type-0" } })
+
+            Expect(err).Should(BeNil())
+
+            for _, i := range []int{ 12, 16 } {
+                Expect(iter.Next()).Should(BeTrue())
+                Expect(iter.Event().Timestamp).Should(Equal(uint64(i)))
+            }
+
+            Expect(iter.Next()).Should(BeFalse())
+        })
+
+        It("should add the type and group indexes to events logged before they existed when the log is opened", func() {
+            batch := NewBatch()
+            batch.Delete(INDEX_VERSION_PREFIX)
+
+            for _, prefix := range [][]byte{ BY_TYPE_AND_TIME_PREFIX, BY_GROUP_AND_TIME_PREFIX } {
+                keys, err := storageEngine.GetMatches([][]byte{ prefix })
+
+                Expect(err).Should(BeNil())
+
+                for keys.Next() {
+                    batch.Delete(append([]byte{ }, keys.Key()...))
+                }
+
+                keys.Release()
+            }
+
+            Expect(storageEngine.Batch(batch)).Should(BeNil())
+
+            iter, err := historian.Query(&HistoryQuery{ Groups: []string{ "floor2" } })
+
+            Expect(err).Should(BeNil())
+            Expect(iter.Next()).Should(BeFalse())
+
+            historian = NewHistorian(storageEngine, 101, 0, 1000)
+            iter, err = historian.Query(&HistoryQuery{ Groups: []string{ "floor2" } })
+
+            Expect(err).Should(BeNil())
+
+            for _, i := range []int{ 0, 5, 10, 15 } {
+                Expect(iter.Next()).Should(BeTrue())
+                Expect(iter.Event().Timestamp).Should(Equal(uint64(i)))
+            }
+
+            Expect(iter.Next()).Should(BeFalse())
+        })
+    })
+
+    Describe("appending an event that was logged somewhere else", func() {
+        It("should keep its UUID and ignore it when it is appended again", func() {
+            Expect(historian.AppendEvent(&Event{ Timestamp: 5, SourceID: "source-0", Type: "type-0", Data: "data-0", UUID: "abc" })).Should(BeNil())
+            Expect(historian.AppendEvent(&Event{ Timestamp: 5, SourceID: "source-0", Type: "type-0", Data: "data-0", UUID: "abc" })).Should(BeNil())
+
+            iter, err := historian.Query(&HistoryQuery{ })
+
+            Expect(err).Should(BeNil())
+            Expect(iter.Next()).Should(BeTrue())
+            Expect(iter.Event().UUID).Should(Equal("abc"))
+            Expect(iter.Event().Serial).Should(Equal(uint64(1)))
+            Expect(iter.Next()).Should(BeFalse())
+            Expect(historian.LogSize()).Should(Equal(uint64(1)))
+        })
     })
 })
@@ -0,0 +1,198 @@
+package historian
+//
+ // Copyright (c) 2019 ARM Limited.
+ //
+ // SPDX-License-Identifier: MIT
+ //
+ // Permission is hereby granted, free of charge, to any person obtaining a copy
+ // of this software and associated documentation files (the "Software"), to
+ // deal in the Software without restriction, including without limitation the
+ // rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ // sell copies of the Software, and to permit persons to whom the Software is
+ // furnished to do so, subject to the following conditions:
+ //
+ // The above copyright notice and this permission notice shall be included in all
+ // copies or substantial portions of the Software.
+ //
+ // THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ // IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ // FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ // AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ // LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ // SOFTWARE.
+ //
+
+
+import (
+    "sort"
+)
+
+// An EventStream iterates over the events that match a query of one copy
+// of a history log. EventIterator is one, as are the events another node
+// streams back from a query of its copy
+type EventStream interface {
+    Next() bool
+    Event() *Event
+    Release()
+    Error() error
+}
+
+// MergedEventIterator merges the results of the same query made of
+// several copies of a history log, such as the copies kept by each owner
+// of a site's partition. Each copy may be missing events the others have.
+// Events come out in the order a single copy would return them and an
+// event found in more than one copy comes out once. The query's limit
+// applies to the merged events
+type MergedEventIterator struct {
+    streams []EventStream
+    heads []*Event
+    done []bool
+    rank func(*Event) int
+    descending bool
+    limit uint64
+    eventsSeen uint64
+    seen map[string]bool
+    currentEvent *Event
+    err error
+}
+
+func NewMergedEventIterator(query *HistoryQuery, streams []EventStream) *MergedEventIterator {
+    iter := &MergedEventIterator{
+        streams: streams,
+        heads: make([]*Event, len(streams)),
+        done: make([]bool, len(streams)),
+        rank: queryRank(query),
+        descending: query.Order == "desc",
+        seen: make(map[string]bool),
+    }
+
+    if query.Limit > 0 {
+        iter.limit = uint64(query.Limit)
+    }
+
+    return iter
+}
+
+// queryRank returns the position in which Query reads the index range
+// that holds an event. A copy returns the events of one range, in time
+// order, before those of the next
+func queryRank(query *HistoryQuery) func(*Event) int {
+    ranks := func(values []string) map[string]int {
+        sorted := append([]string{ }, values...)
+        sort.Strings(sorted)
+        rank := make(map[string]int, len(sorted))
+
+        for i, value := range sorted {
+            rank[value] = i
+        }
+
+        return rank
+    }
+
+    switch {
+    case query.MinSerial != nil || query.MaxSerial != nil:
+        // Each copy numbers its events itself so events read by serial
+        // are merged in time order
+        return func(event *Event) int { return 0 }
+    case len(query.Groups) != 0:
+        groupRanks := ranks(query.Groups)
+
+        return func(event *Event) int {
+            rank := len(groupRanks)
+
+            for _, group := range event.Groups {
+                if r, ok := groupRanks[group]; ok && r < rank {
+                    rank = r
+                }
+            }
+
+            return rank
+        }
+    case len(query.Types) != 0:
+        typeRanks := ranks(query.Types)
+
+        return func(event *Event) int { return typeRanks[event.Type] }
+    case len(query.Sources) != 0:
+        sourceRanks := ranks(query.Sources)
+
+        return func(event *Event) int { return sourceRanks[event.SourceID] }
+    }
+
+    return func(event *Event) int { return 0 }
+}
+
+func (iter *MergedEventIterator) before(a *Event, b *Event) bool {
+    if rankA, rankB := iter.rank(a), iter.rank(b); rankA != rankB {
+        return rankA < rankB
+    }
+
+    if iter.descending {
+        return a.Timestamp > b.Timestamp
+    }
+
+    return a.Timestamp < b.Timestamp
+}
+
+func (iter *MergedEventIterator) Next() bool {
+    iter.currentEvent = nil
+
+    for iter.limit == 0 || iter.eventsSeen < iter.limit {
+        next := -1
+
+        for i, stream := range iter.streams {
+            if iter.heads[i] == nil && !iter.done[i] {
+                if stream.Next() {
+                    iter.heads[i] = stream.Event()
+                } else if stream.Error() != nil {
+                    iter.err = stream.Error()
+
+                    return false
+                } else {
+                    iter.done[i] = true
+                }
+            }
+
+            if iter.heads[i] != nil && (next == -1 || iter.before(iter.heads[i], iter.heads[next])) {
+                next = i
+            }
+        }
+
+        if next == -1 {
+            return false
+        }
+
+        event := iter.heads[next]
+        iter.heads[next] = nil
+
+        // Events logged before they were given UUIDs can't be matched up
+        if event.UUID != "" {
+            if iter.seen[event.UUID] {
+                continue
+            }
+
+            iter.seen[event.UUID] = true
+        }
+
+        iter.currentEvent = event
+        iter.eventsSeen++
+
+        return true
+    }
+
+    return false
+}
+
+func (iter *MergedEventIterator) Event() *Event {
+    return iter.currentEvent
+}
+
+func (iter *MergedEventIterator) Release() {
+    for _, stream := range iter.streams {
+        stream.Release()
+    }
+}
+
+func (iter *MergedEventIterator) Error() error {
+    return iter.err
+}
@@ -0,0 +1,135 @@
+package historian_test
+//
+ // Copyright (c) 2019 ARM Limited.
+ //
+ // SPDX-License-Identifier: MIT
+ //
+ // Permission is hereby granted, free of charge, to any person obtaining a copy
+ // of this software and associated documentation files (the "Software"), to
+ // deal in the Software without restriction, including without limitation the
+ // rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ // sell copies of the Software, and to permit persons to whom the Software is
+ // furnished to do so, subject to the following conditions:
+ //
+ // The above copyright notice and this permission notice shall be included in all
+ // copies or substantial portions of the Software.
+ //
+ // THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ // IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ // FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ // AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ // LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ // SOFTWARE.
+ //
+
+import (
+    . "github.com/armPelionEdge/devicedb/historian"
+    . "github.com/armPelionEdge/devicedb/storage"
+    . "github.com/armPelionEdge/devicedb/util"
+
+    . "github.com/onsi/ginkgo"
+    . "github.com/onsi/gomega"
+)
+
+var _ = Describe("MergedEventIterator", func() {
+    var (
+        storageEngines []StorageDriver
+        owners []*Historian
+    )
+
+    firstBatch := func() []*Event {
+        return []*Event{
+            &Event{ Timestamp: 1, SourceID: "a", Type: "t", Data: "1", UUID: "1" },
+            &Event{ Timestamp: 3, SourceID: "b", Type: "t", Data: "3", UUID: "3" },
+        }
+    }
+
+    secondBatch := func() []*Event {
+        return []*Event{
+            &Event{ Timestamp: 2, SourceID: "b", Type: "t", Data: "2", UUID: "2" },
+            &Event{ Timestamp: 4, SourceID: "a", Type: "t", Data: "4", UUID: "4" },
+        }
+    }
+
+    logBatch := func(owner *Historian, events []*Event) {
+        for _, event := range events {
+            Expect(owner.AppendEvent(event)).Should(BeNil())
+        }
+    }
+
+    merged := func(query HistoryQuery) *MergedEventIterator {
+        streams := make([]EventStream, 0, len(owners))
+
+        for _, owner := range owners {
+            ownerQuery := query
+            eventIterator, err := owner.Query(&ownerQuery)
+
+            Expect(err).Should(BeNil())
+
+            streams = append(streams, eventIterator)
+        }
+
+        return NewMergedEventIterator(&query, streams)
+    }
+
+    uuids := func(iter *MergedEventIterator) []string {
+        defer iter.Release()
+
+        result := []string{ }
+
+        for iter.Next() {
+            result = append(result, iter.Event().UUID)
+        }
+
+        Expect(iter.Error()).Should(BeNil())
+
+        return result
+    }
+
+    BeforeEach(func() {
+        storageEngines = []StorageDriver{ MakeNewStorageDriver(), MakeNewStorageDriver() }
+        owners = make([]*Historian, 0, len(storageEngines))
+
+        for _, storageEngine := range storageEngines {
+            storageEngine.Open()
+            owners = append(owners, NewHistorian(storageEngine, 0, 0, 1000))
+        }
+
+        // The first owner was down while the second batch was logged
+        logBatch(owners[0], firstBatch())
+        logBatch(owners[1], firstBatch())
+        logBatch(owners[1], secondBatch())
+    })
+
+    AfterEach(func() {
+        for _, storageEngine := range storageEngines {
+            storageEngine.Close()
+        }
+    })
+
+    It("should return the events each owner has once in time order", func() {
+        Expect(uuids(merged(HistoryQuery{ }))).Should(Equal([]string{ "1", "2", "3", "4" }))
+        Expect(uuids(merged(HistoryQuery{ Order: "desc" }))).Should(Equal([]string{ "4", "3", "2", "1" }))
+    })
+
+    It("should apply the limit to the merged events", func() {
+        Expect(uuids(merged(HistoryQuery{ Order: "desc", Limit: 3 }))).Should(Equal([]string{ "4", "3", "2" }))
+    })
+
+    It("should return the events of each source together like a single log does", func() {
+        Expect(uuids(merged(HistoryQuery{ Sources: []string{ "b", "a" } }))).Should(Equal([]string{ "1", "4", "2", "3" }))
+    })
+
+    It("should summarize each event once", func() {
+        aggregationQuery := &AggregationQuery{ Interval: 10, GroupBy: AGGREGATE_BY_SOURCE }
+        buckets, err := AggregateEvents(aggregationQuery, merged(aggregationQuery.HistoryQuery))
+
+        Expect(err).Should(BeNil())
+        Expect(buckets).Should(HaveLen(2))
+        Expect(buckets[0].Source).Should(Equal("a"))
+        Expect(buckets[0].Count).Should(Equal(uint64(2)))
+        Expect(buckets[1].Source).Should(Equal("b"))
+        Expect(buckets[1].Count).Should(Equal(uint64(2)))
+    })
+})
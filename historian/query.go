@@ -0,0 +1,194 @@
+package historian
+//
+ // Copyright (c) 2019 ARM Limited.
+ //
+ // SPDX-License-Identifier: MIT
+ //
+ // Permission is hereby granted, free of charge, to any person obtaining a copy
+ // of this software and associated documentation files (the "Software"), to
+ // deal in the Software without restriction, including without limitation the
+ // rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ // sell copies of the Software, and to permit persons to whom the Software is
+ // furnished to do so, subject to the following conditions:
+ //
+ // The above copyright notice and this permission notice shall be included in all
+ // copies or substantial portions of the Software.
+ //
+ // THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ // IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ // FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ // AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ // LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ // SOFTWARE.
+ //
+
+
+import (
+    "errors"
+    "net/url"
+    "strconv"
+    "time"
+)
+
+// ParseHistoryQuery builds a history query from the query parameters of
+// a GET /events request. It accepts source, type and group (all
+// repeatable), data, limit, sortOrder, maxAge or afterTime and beforeTime,
+// and minSerial and maxSerial
+func ParseHistoryQuery(query url.Values) (HistoryQuery, error) {
+    var historyQuery HistoryQuery
+
+    historyQuery.Sources = nonEmptyValues(query["source"])
+    historyQuery.Types = nonEmptyValues(query["type"])
+    historyQuery.Groups = nonEmptyValues(query["group"])
+
+    if _, ok := query["limit"]; ok {
+        limit, err := strconv.Atoi(query.Get("limit"))
+
+        if err != nil {
+            return HistoryQuery{ }, err
+        }
+
+        historyQuery.Limit = limit
+    }
+
+    if sortOrder := query.Get("sortOrder"); sortOrder == "desc" || sortOrder == "asc" {
+        historyQuery.Order = sortOrder
+    }
+
+    if _, ok := query["data"]; ok {
+        data := query.Get("data")
+
+        historyQuery.Data = &data
+    }
+
+    if _, ok := query["maxAge"]; ok {
+        maxAge, err := strconv.Atoi(query.Get("maxAge"))
+
+        if err != nil {
+            return HistoryQuery{ }, err
+        }
+
+        if maxAge <= 0 {
+            return HistoryQuery{ }, errors.New("Non positive age specified")
+        }
+
+        nowMS := uint64(time.Now().UnixNano()) / 1000000
+        historyQuery.After = nowMS - uint64(maxAge)
+    } else {
+        if _, ok := query["afterTime"]; ok {
+            after, err := strconv.Atoi(query.Get("afterTime"))
+
+            if err != nil {
+                return HistoryQuery{ }, err
+            }
+
+            if after < 0 {
+                return HistoryQuery{ }, errors.New("Non positive after specified")
+            }
+
+            historyQuery.After = uint64(after)
+        }
+
+        if _, ok := query["beforeTime"]; ok {
+            before, err := strconv.Atoi(query.Get("beforeTime"))
+
+            if err != nil {
+                return HistoryQuery{ }, err
+            }
+
+            if before < 0 {
+                return HistoryQuery{ }, errors.New("Non positive before specified")
+            }
+
+            historyQuery.Before = uint64(before)
+        }
+    }
+
+    // A serial range picks the events that are looked at and the other
+    // filters still apply to them. minSerial is inclusive and maxSerial
+    // exclusive
+    if _, ok := query["minSerial"]; ok {
+        minSerial, err := strconv.ParseUint(query.Get("minSerial"), 10, 64)
+
+        if err != nil {
+            return HistoryQuery{ }, err
+        }
+
+        historyQuery.MinSerial = &minSerial
+    }
+
+    if _, ok := query["maxSerial"]; ok {
+        maxSerial, err := strconv.ParseUint(query.Get("maxSerial"), 10, 64)
+
+        if err != nil {
+            return HistoryQuery{ }, err
+        }
+
+        historyQuery.MaxSerial = &maxSerial
+    }
+
+    return historyQuery, nil
+}
+
+// EncodeHistoryQuery turns a history query back into the query
+// parameters that ParseHistoryQuery accepts. A query built from maxAge
+// is encoded with afterTime so that it covers the same events when it
+// is parsed again later
+func EncodeHistoryQuery(historyQuery HistoryQuery) url.Values {
+    query := url.Values{ }
+
+    for _, source := range historyQuery.Sources {
+        query.Add("source", source)
+    }
+
+    for _, eventType := range historyQuery.Types {
+        query.Add("type", eventType)
+    }
+
+    for _, group := range historyQuery.Groups {
+        query.Add("group", group)
+    }
+
+    if historyQuery.Limit != 0 {
+        query.Set("limit", strconv.Itoa(historyQuery.Limit))
+    }
+
+    if historyQuery.Order != "" {
+        query.Set("sortOrder", historyQuery.Order)
+    }
+
+    if historyQuery.Data != nil {
+        query.Set("data", *historyQuery.Data)
+    }
+
+    if historyQuery.After != 0 {
+        query.Set("afterTime", strconv.FormatUint(historyQuery.After, 10))
+    }
+
+    if historyQuery.Before != 0 {
+        query.Set("beforeTime", strconv.FormatUint(historyQuery.Before, 10))
+    }
+
+    if historyQuery.MinSerial != nil {
+        query.Set("minSerial", strconv.FormatUint(*historyQuery.MinSerial, 10))
+    }
+
+    if historyQuery.MaxSerial != nil {
+        query.Set("maxSerial", strconv.FormatUint(*historyQuery.MaxSerial, 10))
+    }
+
+    return query
+}
+
+func nonEmptyValues(values []string) []string {
+    result := make([]string, 0, len(values))
+
+    for _, value := range values {
+        if len(value) != 0 {
+            result = append(result, value)
+        }
+    }
+
+    return result
+}
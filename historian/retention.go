@@ -0,0 +1,289 @@
+package historian
+//
+ // Copyright (c) 2019 ARM Limited.
+ //
+ // SPDX-License-Identifier: MIT
+ //
+ // Permission is hereby granted, free of charge, to any person obtaining a copy
+ // of this software and associated documentation files (the "Software"), to
+ // deal in the Software without restriction, including without limitation the
+ // rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ // sell copies of the Software, and to permit persons to whom the Software is
+ // furnished to do so, subject to the following conditions:
+ //
+ // The above copyright notice and this permission notice shall be included in all
+ // copies or substantial portions of the Software.
+ //
+ // THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ // IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ // FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ // AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ // LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ // SOFTWARE.
+ //
+
+import (
+    "path"
+    "sort"
+    "time"
+
+    . "github.com/armPelionEdge/devicedb/logging"
+)
+
+// How many events EnforceRetention looks at each time it takes the log
+// lock so that logging events is never held up for long
+const RETENTION_BATCH_SIZE = 1000
+
+// RetentionRule limits how long and how many of the events whose source
+// and type match its patterns are kept. Patterns use the syntax of
+// path.Match and an empty pattern matches anything. An event is governed
+// by the matching rule with the highest priority, or by the first one
+// listed when several share that priority. When the log is rotated
+// events governed by lower priority rules are purged before those
+// governed by higher priority ones. Events governed by no rule have
+// priority 0
+type RetentionRule struct {
+    Source string `json:"source,omitempty"`
+    Type string `json:"type,omitempty"`
+    // Events older than this many milliseconds are purged. Zero means
+    // events are kept regardless of their age
+    MaxAge uint64 `json:"maxAge,omitempty"`
+    // Only this many of the most recently logged events are kept. Zero
+    // means there is no limit
+    MaxCount uint64 `json:"maxCount,omitempty"`
+    Priority int `json:"priority"`
+}
+
+// Validate ensures the source and type patterns of a rule are well formed
+func (rule *RetentionRule) Validate() error {
+    if _, err := path.Match(rule.Source, ""); err != nil {
+        return err
+    }
+
+    if _, err := path.Match(rule.Type, ""); err != nil {
+        return err
+    }
+
+    return nil
+}
+
+func (rule *RetentionRule) matches(event *Event) bool {
+    if rule.Source != "" {
+        if matched, _ := path.Match(rule.Source, event.SourceID); !matched {
+            return false
+        }
+    }
+
+    if rule.Type != "" {
+        if matched, _ := path.Match(rule.Type, event.Type); !matched {
+            return false
+        }
+    }
+
+    return true
+}
+
+// SetRetentionRules replaces the retention rules of the log and rotates
+// it right away using the new rule priorities if it is over its limit.
+// Rules with a maximum age or count are only enforced by
+// EnforceRetention
+func (historian *Historian) SetRetentionRules(rules []RetentionRule) error {
+    for i, _ := range rules {
+        if err := rules[i].Validate(); err != nil {
+            return err
+        }
+    }
+
+    sortedRules := make([]RetentionRule, len(rules))
+    copy(sortedRules, rules)
+
+    sort.SliceStable(sortedRules, func(i, j int) bool {
+        return sortedRules[i].Priority > sortedRules[j].Priority
+    })
+
+    historian.logLock.Lock()
+    defer historian.logLock.Unlock()
+
+    historian.retentionRules = sortedRules
+
+    return historian.RotateLog()
+}
+
+func (historian *Historian) RetentionRules() []RetentionRule {
+    historian.logLock.Lock()
+    defer historian.logLock.Unlock()
+
+    return historian.retentionRules
+}
+
+// governingRule returns the index of the rule that governs an event or
+// -1 if no rule does
+func (historian *Historian) governingRule(event *Event) int {
+    return governingRetentionRule(historian.retentionRules, event)
+}
+
+// Rules are kept sorted by priority so the rule that governs an event is
+// the first one that matches
+func governingRetentionRule(rules []RetentionRule, event *Event) int {
+    for i, _ := range rules {
+        if rules[i].matches(event) {
+            return i
+        }
+    }
+
+    return -1
+}
+
+func (historian *Historian) retentionPriority(event *Event) int {
+    if i := historian.governingRule(event); i >= 0 {
+        return historian.retentionRules[i].Priority
+    }
+
+    return 0
+}
+
+// EnforceRetention purges every event that is older than the maximum
+// age of the rule governing it or that is not among the most recently
+// logged maximum count events governed by that rule. now is the current
+// time in milliseconds. The log is walked in batches of
+// RETENTION_BATCH_SIZE events and events can be logged in between. Those
+// are left for the next time retention is enforced
+func (historian *Historian) EnforceRetention(now uint64) error {
+    historian.logLock.Lock()
+    // The rules are replaced rather than modified when they change so
+    // these stay the same for the whole walk
+    rules := historian.retentionRules
+    maxSerial := historian.nextID
+    historian.logLock.Unlock()
+
+    if len(rules) == 0 {
+        return nil
+    }
+
+    // Walk the log from newest to oldest so the first MaxCount events
+    // counted for a rule are the ones it keeps
+    counts := make([]uint64, len(rules))
+
+    for {
+        done, err := historian.enforceRetentionBatch(rules, counts, &maxSerial, now)
+
+        if err != nil || done {
+            return err
+        }
+    }
+}
+
+// enforceRetentionBatch looks at the next batch of events logged before
+// maxSerial and moves maxSerial down past them. It returns true once
+// there are no events left
+func (historian *Historian) enforceRetentionBatch(rules []RetentionRule, counts []uint64, maxSerial *uint64, now uint64) (bool, error) {
+    historian.logLock.Lock()
+    defer historian.logLock.Unlock()
+
+    examined := 0
+    before := *maxSerial
+    _, err := historian.purgeWhere(&HistoryQuery{ MaxSerial: &before, Order: "desc", Limit: RETENTION_BATCH_SIZE }, func(event *Event) bool {
+        examined++
+        *maxSerial = event.Serial
+        i := governingRetentionRule(rules, event)
+
+        if i < 0 {
+            return false
+        }
+
+        rule := &rules[i]
+        counts[i]++
+
+        if rule.MaxAge != 0 && event.Timestamp + rule.MaxAge < now {
+            return true
+        }
+
+        return rule.MaxCount != 0 && counts[i] > rule.MaxCount
+    }, 0)
+
+    return examined < RETENTION_BATCH_SIZE, err
+}
+
+// purgeByPriority purges count events from the log, oldest first,
+// starting with events governed by the lowest priority rules
+func (historian *Historian) purgeByPriority(count uint64) error {
+    priorities := []int{ 0 }
+
+    for _, rule := range historian.retentionRules {
+        if !containsInt(priorities, rule.Priority) {
+            priorities = append(priorities, rule.Priority)
+        }
+    }
+
+    sort.Ints(priorities)
+
+    for _, priority := range priorities {
+        var minSerial uint64 = 0
+        p := priority
+
+        purged, err := historian.purgeWhere(&HistoryQuery{ MinSerial: &minSerial }, func(event *Event) bool {
+            return historian.retentionPriority(event) == p
+        }, count)
+
+        if err != nil {
+            return err
+        }
+
+        count -= purged
+
+        if count == 0 {
+            break
+        }
+    }
+
+    return nil
+}
+
+func containsInt(list []int, n int) bool {
+    for _, e := range list {
+        if e == n {
+            return true
+        }
+    }
+
+    return false
+}
+
+// RetentionPurger periodically purges events from a history log that
+// its retention rules no longer allow it to keep
+type RetentionPurger struct {
+    historian *Historian
+    interval time.Duration
+    done chan bool
+}
+
+func NewRetentionPurger(historian *Historian, interval uint64) *RetentionPurger {
+    return &RetentionPurger{
+        historian: historian,
+        interval: time.Millisecond * time.Duration(interval),
+        done: make(chan bool),
+    }
+}
+
+func (purger *RetentionPurger) Start() {
+    go func() {
+        for {
+            select {
+            case <-purger.done:
+                purger.done = make(chan bool)
+                return
+            case <-time.After(purger.interval):
+                nowMS := uint64(time.Now().UnixNano()) / 1000000
+
+                if err := purger.historian.EnforceRetention(nowMS); err != nil {
+                    Log.Warningf("Unable to enforce history retention rules: %v", err)
+                }
+            }
+        }
+    }()
+}
+
+func (purger *RetentionPurger) Stop() {
+    close(purger.done)
+}
@@ -0,0 +1,179 @@
+package historian_test
+//
+ // Copyright (c) 2019 ARM Limited.
+ //
+ // SPDX-License-Identifier: MIT
+ //
+ // Permission is hereby granted, free of charge, to any person obtaining a copy
+ // of this software and associated documentation files (the "Software"), to
+ // deal in the Software without restriction, including without limitation the
+ // rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ // sell copies of the Software, and to permit persons to whom the Software is
+ // furnished to do so, subject to the following conditions:
+ //
+ // The above copyright notice and this permission notice shall be included in all
+ // copies or substantial portions of the Software.
+ //
+ // THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ // IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ // FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ // AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ // LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ // SOFTWARE.
+ //
+
+import (
+    "fmt"
+
+    . "github.com/armPelionEdge/devicedb/historian"
+    . "github.com/armPelionEdge/devicedb/storage"
+    . "github.com/armPelionEdge/devicedb/util"
+
+    . "github.com/onsi/ginkgo"
+    . "github.com/onsi/gomega"
+)
+
+var _ = Describe("Retention", func() {
+    var (
+        storageEngine StorageDriver
+        historian *Historian
+    )
+
+    BeforeEach(func() {
+        storageEngine = MakeNewStorageDriver()
+        storageEngine.Open()
+    })
+
+    AfterEach(func() {
+        storageEngine.Close()
+    })
+
+    countEvents := func(query *HistoryQuery) int {
+        iter, err := historian.Query(query)
+
+        Expect(err).Should(BeNil())
+
+        defer iter.Release()
+
+        count := 0
+
+        for iter.Next() {
+            count++
+        }
+
+        Expect(iter.Error()).Should(BeNil())
+
+        return count
+    }
+
+    It("should reject rules with malformed patterns", func() {
+        historian = NewHistorian(storageEngine, 0, 0, 1000)
+
+        Expect(historian.SetRetentionRules([]RetentionRule{ RetentionRule{ Source: "sensor-[" } })).Should(Not(BeNil()))
+    })
+
+    Describe("enforcing retention rules", func() {
+        BeforeEach(func() {
+            historian = NewHistorian(storageEngine, 0, 0, 3)
+
+            for i := 0; i < 20; i += 1 {
+                historian.LogEvent(&Event{ Timestamp: uint64(i * 1000), SourceID: fmt.Sprintf("sensor-%d", i % 2), Type: "temperature" })
+            }
+
+            historian.LogEvent(&Event{ Timestamp: 500, SourceID: "door1", Type: "tamper" })
+        })
+
+        It("should keep only the most recent events allowed by the rule governing them", func() {
+            Expect(historian.SetRetentionRules([]RetentionRule{
+                RetentionRule{ Source: "sensor-*", MaxCount: 4 },
+            })).Should(BeNil())
+            Expect(historian.EnforceRetention(20000)).Should(BeNil())
+
+            Expect(historian.LogSize()).Should(Equal(uint64(5)))
+            Expect(countEvents(&HistoryQuery{ Types: []string{ "tamper" } })).Should(Equal(1))
+            Expect(countEvents(&HistoryQuery{ After: 16000 })).Should(Equal(4))
+        })
+
+        It("should purge events older than the maximum age of the rule governing them", func() {
+            Expect(historian.SetRetentionRules([]RetentionRule{
+                RetentionRule{ Type: "temperature", MaxAge: 5000 },
+            })).Should(BeNil())
+            Expect(historian.EnforceRetention(20000)).Should(BeNil())
+
+            // Events at 15000 through 19000 are kept along with the tamper event
+            Expect(historian.LogSize()).Should(Equal(uint64(6)))
+            Expect(countEvents(&HistoryQuery{ Types: []string{ "tamper" } })).Should(Equal(1))
+        })
+
+        It("should apply only the highest priority rule matching an event", func() {
+            Expect(historian.SetRetentionRules([]RetentionRule{
+                RetentionRule{ Source: "sensor-*", MaxCount: 2 },
+                RetentionRule{ Source: "sensor-0", MaxCount: 6, Priority: 1 },
+            })).Should(BeNil())
+            Expect(historian.EnforceRetention(20000)).Should(BeNil())
+
+            Expect(countEvents(&HistoryQuery{ Sources: []string{ "sensor-0" } })).Should(Equal(6))
+            Expect(countEvents(&HistoryQuery{ Sources: []string{ "sensor-1" } })).Should(Equal(2))
+        })
+    })
+
+    It("should count the events governed by a rule across every batch of the log it walks", func() {
+        historian = NewHistorian(storageEngine, 0, 0, 100)
+
+        for i := 0; i < RETENTION_BATCH_SIZE * 2 + 500; i += 1 {
+            historian.LogEvent(&Event{ Timestamp: uint64(i), SourceID: "sensor-0", Type: "temperature" })
+        }
+
+        Expect(historian.SetRetentionRules([]RetentionRule{
+            RetentionRule{ Source: "sensor-*", MaxCount: RETENTION_BATCH_SIZE + 200 },
+        })).Should(BeNil())
+        Expect(historian.EnforceRetention(0)).Should(BeNil())
+
+        Expect(historian.LogSize()).Should(Equal(uint64(RETENTION_BATCH_SIZE + 200)))
+        Expect(countEvents(&HistoryQuery{ After: RETENTION_BATCH_SIZE + 300 })).Should(Equal(RETENTION_BATCH_SIZE + 200))
+    })
+
+    Describe("rotating the log", func() {
+        It("should purge events governed by lower priority rules first", func() {
+            historian = NewHistorian(storageEngine, 10, 5, 1000)
+
+            Expect(historian.SetRetentionRules([]RetentionRule{
+                RetentionRule{ Type: "tamper", Priority: 10 },
+                RetentionRule{ Type: "temperature", Priority: -1 },
+            })).Should(BeNil())
+
+            historian.LogEvent(&Event{ Timestamp: 0, SourceID: "door1", Type: "tamper" })
+            historian.LogEvent(&Event{ Timestamp: 1, SourceID: "door1", Type: "door_open" })
+
+            for i := 2; i < 11; i += 1 {
+                historian.LogEvent(&Event{ Timestamp: uint64(i), SourceID: "sensor-0", Type: "temperature" })
+            }
+
+            // 11 events exceeds the limit so 6 are purged, all of them temperature events
+            Expect(historian.LogSize()).Should(Equal(uint64(5)))
+            Expect(countEvents(&HistoryQuery{ Types: []string{ "tamper" } })).Should(Equal(1))
+            Expect(countEvents(&HistoryQuery{ Types: []string{ "door_open" } })).Should(Equal(1))
+            Expect(countEvents(&HistoryQuery{ Types: []string{ "temperature" } })).Should(Equal(3))
+            Expect(countEvents(&HistoryQuery{ After: 8 })).Should(Equal(3))
+        })
+
+        It("should purge higher priority events once lower priority ones run out", func() {
+            historian = NewHistorian(storageEngine, 4, 2, 1000)
+
+            Expect(historian.SetRetentionRules([]RetentionRule{
+                RetentionRule{ Type: "tamper", Priority: 10 },
+            })).Should(BeNil())
+
+            for i := 0; i < 4; i += 1 {
+                historian.LogEvent(&Event{ Timestamp: uint64(i), SourceID: "door1", Type: "tamper" })
+            }
+
+            historian.LogEvent(&Event{ Timestamp: 4, SourceID: "door1", Type: "door_open" })
+
+            Expect(historian.LogSize()).Should(Equal(uint64(2)))
+            Expect(countEvents(&HistoryQuery{ Types: []string{ "door_open" } })).Should(Equal(0))
+            Expect(countEvents(&HistoryQuery{ After: 3 })).Should(Equal(1))
+        })
+    })
+})
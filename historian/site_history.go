@@ -0,0 +1,196 @@
+package historian
+//
+ // Copyright (c) 2019 ARM Limited.
+ //
+ // SPDX-License-Identifier: MIT
+ //
+ // Permission is hereby granted, free of charge, to any person obtaining a copy
+ // of this software and associated documentation files (the "Software"), to
+ // deal in the Software without restriction, including without limitation the
+ // rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ // sell copies of the Software, and to permit persons to whom the Software is
+ // furnished to do so, subject to the following conditions:
+ //
+ // The above copyright notice and this permission notice shall be included in all
+ // copies or substantial portions of the Software.
+ //
+ // THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ // IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ // FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ // AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ // LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ // SOFTWARE.
+ //
+
+
+import (
+    "encoding/base64"
+    "encoding/json"
+    "sync"
+
+    . "github.com/armPelionEdge/devicedb/storage"
+    . "github.com/armPelionEdge/devicedb/error"
+    . "github.com/armPelionEdge/devicedb/logging"
+)
+
+var (
+    SITE_RETENTION_PREFIX = []byte{ 0 }
+    RELAY_LOG_PREFIX = []byte{ 1 }
+)
+
+// HistoryRetention bounds the size of a history log. See RotateLog
+// for how the event limit and event floor are used
+type HistoryRetention struct {
+    EventLimit uint64 `json:"eventLimit"`
+    EventFloor uint64 `json:"eventFloor"`
+    // When the retention was set, in milliseconds. The owners of a site's
+    // partition that missed the latest setting still have an older one
+    Updated uint64 `json:"updated,omitempty"`
+}
+
+// SiteHistory stores the events forwarded by relays in a separate
+// history log for each relay in each site. Retention is set per site
+// and applies to the log of each relay in that site
+type SiteHistory struct {
+    storageDriver StorageDriver
+    defaultRetention HistoryRetention
+    purgeBatchSize int
+    lock sync.Mutex
+    retention map[string]HistoryRetention
+    historians map[string]map[string]*Historian
+}
+
+func NewSiteHistory(storageDriver StorageDriver, defaultRetention HistoryRetention, purgeBatchSize int) (*SiteHistory, error) {
+    siteHistory := &SiteHistory{
+        storageDriver: storageDriver,
+        defaultRetention: defaultRetention,
+        purgeBatchSize: purgeBatchSize,
+        retention: make(map[string]HistoryRetention),
+        historians: make(map[string]map[string]*Historian),
+    }
+
+    iter, err := storageDriver.GetMatches([][]byte{ SITE_RETENTION_PREFIX })
+
+    if err != nil {
+        Log.Errorf("Storage driver error in NewSiteHistory(): %s", err.Error())
+
+        return nil, EStorage
+    }
+
+    defer iter.Release()
+
+    for iter.Next() {
+        var retention HistoryRetention
+
+        if err := json.Unmarshal(iter.Value(), &retention); err != nil {
+            Log.Warningf("Ignoring invalid history retention for site %s: %v", string(iter.Key()[len(SITE_RETENTION_PREFIX):]), err)
+
+            continue
+        }
+
+        siteHistory.retention[string(iter.Key()[len(SITE_RETENTION_PREFIX):])] = retention
+    }
+
+    if iter.Error() != nil {
+        Log.Errorf("Storage driver error in NewSiteHistory(): %s", iter.Error().Error())
+
+        return nil, EStorage
+    }
+
+    return siteHistory, nil
+}
+
+func (siteHistory *SiteHistory) relayLogPrefix(siteID string, relayID string) []byte {
+    // Base64 never contains the delimeter so one site's prefix can't
+    // be a prefix of another's
+    encodedSiteID := base64.StdEncoding.EncodeToString([]byte(siteID))
+    encodedRelayID := base64.StdEncoding.EncodeToString([]byte(relayID))
+    prefix := make([]byte, 0, len(RELAY_LOG_PREFIX) + len(encodedSiteID) + len(DELIMETER) + len(encodedRelayID) + len(DELIMETER))
+
+    prefix = append(prefix, RELAY_LOG_PREFIX...)
+    prefix = append(prefix, []byte(encodedSiteID)...)
+    prefix = append(prefix, DELIMETER...)
+    prefix = append(prefix, []byte(encodedRelayID)...)
+    prefix = append(prefix, DELIMETER...)
+
+    return prefix
+}
+
+// Retention returns the retention that applies to a site
+func (siteHistory *SiteHistory) Retention(siteID string) HistoryRetention {
+    siteHistory.lock.Lock()
+    defer siteHistory.lock.Unlock()
+
+    return siteHistory.siteRetention(siteID)
+}
+
+func (siteHistory *SiteHistory) siteRetention(siteID string) HistoryRetention {
+    if retention, ok := siteHistory.retention[siteID]; ok {
+        return retention
+    }
+
+    return siteHistory.defaultRetention
+}
+
+// SetRetention changes the retention of a site and rotates the logs
+// of its relays to fit within it
+func (siteHistory *SiteHistory) SetRetention(siteID string, retention HistoryRetention) error {
+    siteHistory.lock.Lock()
+    defer siteHistory.lock.Unlock()
+
+    encodedRetention, _ := json.Marshal(retention)
+    batch := NewBatch()
+    batch.Put(append(append([]byte{ }, SITE_RETENTION_PREFIX...), []byte(siteID)...), encodedRetention)
+
+    if err := siteHistory.storageDriver.Batch(batch); err != nil {
+        Log.Errorf("Storage driver error in SetRetention(%s): %s", siteID, err.Error())
+
+        return EStorage
+    }
+
+    siteHistory.retention[siteID] = retention
+
+    for _, historian := range siteHistory.historians[siteID] {
+        if err := historian.SetRetention(retention.EventLimit, retention.EventFloor); err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+
+// Historian returns the history log of a relay in a site
+func (siteHistory *SiteHistory) Historian(siteID string, relayID string) *Historian {
+    siteHistory.lock.Lock()
+    defer siteHistory.lock.Unlock()
+
+    if _, ok := siteHistory.historians[siteID]; !ok {
+        siteHistory.historians[siteID] = make(map[string]*Historian)
+    }
+
+    if historian, ok := siteHistory.historians[siteID][relayID]; ok {
+        return historian
+    }
+
+    retention := siteHistory.siteRetention(siteID)
+    historian := NewHistorian(NewPrefixedStorageDriver(siteHistory.relayLogPrefix(siteID, relayID), siteHistory.storageDriver), retention.EventLimit, retention.EventFloor, siteHistory.purgeBatchSize)
+    siteHistory.historians[siteID][relayID] = historian
+
+    return historian
+}
+
+// LogEvents appends events forwarded by a relay to its history log.
+// Events that were already appended are skipped so a relay can safely
+// forward a batch again after a failed attempt
+func (siteHistory *SiteHistory) LogEvents(siteID string, relayID string, events []*Event) error {
+    historian := siteHistory.Historian(siteID, relayID)
+
+    for _, event := range events {
+        if err := historian.AppendEvent(event); err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
@@ -0,0 +1,93 @@
+package historian_test
+//
+ // Copyright (c) 2019 ARM Limited.
+ //
+ // SPDX-License-Identifier: MIT
+ //
+ // Permission is hereby granted, free of charge, to any person obtaining a copy
+ // of this software and associated documentation files (the "Software"), to
+ // deal in the Software without restriction, including without limitation the
+ // rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ // sell copies of the Software, and to permit persons to whom the Software is
+ // furnished to do so, subject to the following conditions:
+ //
+ // The above copyright notice and this permission notice shall be included in all
+ // copies or substantial portions of the Software.
+ //
+ // THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ // IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ // FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ // AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ // LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ // SOFTWARE.
+ //
+
+
+import (
+    . "github.com/armPelionEdge/devicedb/historian"
+    . "github.com/armPelionEdge/devicedb/storage"
+    . "github.com/armPelionEdge/devicedb/util"
+
+    . "github.com/onsi/ginkgo"
+    . "github.com/onsi/gomega"
+)
+
+var _ = Describe("SiteHistory", func() {
+    var (
+        storageEngine StorageDriver
+        siteHistory *SiteHistory
+    )
+
+    BeforeEach(func() {
+        var err error
+
+        storageEngine = MakeNewStorageDriver()
+        storageEngine.Open()
+
+        siteHistory, err = NewSiteHistory(storageEngine, HistoryRetention{ EventLimit: 10, EventFloor: 5 }, 1000)
+
+        Expect(err).Should(BeNil())
+    })
+
+    AfterEach(func() {
+        storageEngine.Close()
+    })
+
+    It("should keep a separate log for each relay in each site", func() {
+        Expect(siteHistory.LogEvents("site1", "relay1", []*Event{ &Event{ Timestamp: 1, SourceID: "a", UUID: "1" } })).Should(BeNil())
+        Expect(siteHistory.LogEvents("site1", "relay2", []*Event{ &Event{ Timestamp: 2, SourceID: "b", UUID: "2" } })).Should(BeNil())
+        Expect(siteHistory.LogEvents("site2", "relay1", []*Event{ &Event{ Timestamp: 3, SourceID: "c", UUID: "3" } })).Should(BeNil())
+
+        iter, err := siteHistory.Historian("site1", "relay2").Query(&HistoryQuery{ })
+
+        Expect(err).Should(BeNil())
+        Expect(iter.Next()).Should(BeTrue())
+        Expect(iter.Event().SourceID).Should(Equal("b"))
+        Expect(iter.Next()).Should(BeFalse())
+    })
+
+    It("should skip events that were already logged", func() {
+        events := []*Event{ &Event{ Timestamp: 1, SourceID: "a", UUID: "1" }, &Event{ Timestamp: 2, SourceID: "a", UUID: "2" } }
+
+        Expect(siteHistory.LogEvents("site1", "relay1", events)).Should(BeNil())
+        Expect(siteHistory.LogEvents("site1", "relay1", events)).Should(BeNil())
+        Expect(siteHistory.Historian("site1", "relay1").LogSize()).Should(Equal(uint64(2)))
+    })
+
+    It("should rotate the logs of a site to fit a new retention and remember it", func() {
+        for i := 0; i < 8; i += 1 {
+            Expect(siteHistory.LogEvents("site1", "relay1", []*Event{ &Event{ Timestamp: uint64(i), SourceID: "a" } })).Should(BeNil())
+        }
+
+        Expect(siteHistory.Retention("site1")).Should(Equal(HistoryRetention{ EventLimit: 10, EventFloor: 5 }))
+        Expect(siteHistory.SetRetention("site1", HistoryRetention{ EventLimit: 4, EventFloor: 2 })).Should(BeNil())
+        Expect(siteHistory.Historian("site1", "relay1").LogSize()).Should(Equal(uint64(2)))
+
+        reopened, err := NewSiteHistory(storageEngine, HistoryRetention{ EventLimit: 10, EventFloor: 5 }, 1000)
+
+        Expect(err).Should(BeNil())
+        Expect(reopened.Retention("site1")).Should(Equal(HistoryRetention{ EventLimit: 4, EventFloor: 2 }))
+        Expect(reopened.Retention("site2")).Should(Equal(HistoryRetention{ EventLimit: 10, EventFloor: 5 }))
+    })
+})
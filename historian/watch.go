@@ -0,0 +1,183 @@
+package historian
+//
+ // Copyright (c) 2019 ARM Limited.
+ //
+ // SPDX-License-Identifier: MIT
+ //
+ // Permission is hereby granted, free of charge, to any person obtaining a copy
+ // of this software and associated documentation files (the "Software"), to
+ // deal in the Software without restriction, including without limitation the
+ // rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ // sell copies of the Software, and to permit persons to whom the Software is
+ // furnished to do so, subject to the following conditions:
+ //
+ // The above copyright notice and this permission notice shall be included in all
+ // copies or substantial portions of the Software.
+ //
+ // THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ // IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ // FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ // AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ // LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ // SOFTWARE.
+ //
+
+import (
+    "context"
+    "math"
+
+    . "github.com/armPelionEdge/devicedb/logging"
+)
+
+// The number of events that may be waiting to be sent to a watcher.
+// A watcher that falls further behind is disconnected
+const WATCH_BUFFER_SIZE = 1024
+
+type eventListener struct {
+    filter HistoryQuery
+    events chan *Event
+}
+
+// Watch streams the events matching the sources, types, groups and
+// data of query to ch. It first sends every event already in the log
+// whose serial is greater than lastSerial followed by a nil event to
+// mark the end of the replay. After that it sends events as they are
+// logged until ctx is done, at which point ch is closed. Events are
+// always sent in increasing serial order. Logging never waits for a
+// watcher. If a watcher falls more than WATCH_BUFFER_SIZE events behind
+// ch is closed early and the watcher should watch again from the last
+// event it received
+func (historian *Historian) Watch(ctx context.Context, query *HistoryQuery, lastSerial uint64, ch chan *Event) {
+    listener := &eventListener{
+        filter: HistoryQuery{
+            Sources: query.Sources,
+            Types: query.Types,
+            Groups: query.Groups,
+            Data: query.Data,
+            Before: math.MaxUint64,
+        },
+        events: make(chan *Event, WATCH_BUFFER_SIZE),
+    }
+
+    // The log lock is not held during the replay so that a slow watcher
+    // does not hold up logging
+    lastSerial, ok := historian.replay(&listener.filter, lastSerial, func(event *Event) bool {
+        select {
+        case ch <- event:
+            return true
+        case <-ctx.Done():
+            return false
+        }
+    })
+
+    if !ok {
+        close(ch)
+
+        return
+    }
+
+    // Holding the log lock while catching up on the events logged during
+    // the replay ensures no event is logged between the catch up and the
+    // listener being added. The events are queued rather than sent so
+    // the lock is never held waiting for the watcher
+    historian.logLock.Lock()
+
+    _, ok = historian.replay(&listener.filter, lastSerial, func(event *Event) bool {
+        select {
+        case listener.events <- event:
+            return true
+        default:
+            return false
+        }
+    })
+
+    if !ok || len(listener.events) == cap(listener.events) {
+        historian.logLock.Unlock()
+        close(ch)
+
+        return
+    }
+
+    listener.events <- nil
+    historian.listeners[listener] = true
+    historian.logLock.Unlock()
+
+    go func() {
+        defer close(ch)
+
+        for {
+            select {
+            case event, ok := <-listener.events:
+                if !ok {
+                    // notifyListeners disconnected the watcher
+                    return
+                }
+
+                select {
+                case ch <- event:
+                    continue
+                case <-ctx.Done():
+                }
+            case <-ctx.Done():
+            }
+
+            historian.logLock.Lock()
+            delete(historian.listeners, listener)
+            historian.logLock.Unlock()
+
+            return
+        }
+    }()
+}
+
+// replay calls send for each event logged after lastSerial that matches
+// filter until send returns false. It returns the serial of the last
+// event it looked at and whether every matching event was sent
+func (historian *Historian) replay(filter *HistoryQuery, lastSerial uint64, send func(event *Event) bool) (uint64, bool) {
+    minSerial := lastSerial + 1
+    eventIterator, err := historian.Query(&HistoryQuery{ MinSerial: &minSerial })
+
+    if err != nil {
+        return lastSerial, false
+    }
+
+    defer eventIterator.Release()
+
+    for eventIterator.Next() {
+        lastSerial = eventIterator.Event().Serial
+
+        if filter.matches(eventIterator.Event()) && !send(eventIterator.Event()) {
+            return lastSerial, false
+        }
+    }
+
+    if eventIterator.Error() != nil {
+        Log.Errorf("Storage driver error in Watch(): %s", eventIterator.Error().Error())
+
+        return lastSerial, false
+    }
+
+    return lastSerial, true
+}
+
+// notifyListeners must be called with the log lock held. A listener
+// whose queue is full is disconnected rather than waited for
+func (historian *Historian) notifyListeners(event *Event) {
+    for listener, _ := range historian.listeners {
+        if !listener.filter.matches(event) {
+            continue
+        }
+
+        e := *event
+
+        select {
+        case listener.events <- &e:
+        default:
+            Log.Warningf("Disconnecting a history watcher that fell more than %d events behind", WATCH_BUFFER_SIZE)
+
+            delete(historian.listeners, listener)
+            close(listener.events)
+        }
+    }
+}
@@ -0,0 +1,144 @@
+package historian_test
+//
+ // Copyright (c) 2019 ARM Limited.
+ //
+ // SPDX-License-Identifier: MIT
+ //
+ // Permission is hereby granted, free of charge, to any person obtaining a copy
+ // of this software and associated documentation files (the "Software"), to
+ // deal in the Software without restriction, including without limitation the
+ // rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ // sell copies of the Software, and to permit persons to whom the Software is
+ // furnished to do so, subject to the following conditions:
+ //
+ // The above copyright notice and this permission notice shall be included in all
+ // copies or substantial portions of the Software.
+ //
+ // THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ // IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ // FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ // AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ // LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ // SOFTWARE.
+ //
+
+import (
+    "context"
+
+    . "github.com/armPelionEdge/devicedb/historian"
+    . "github.com/armPelionEdge/devicedb/storage"
+    . "github.com/armPelionEdge/devicedb/util"
+
+    . "github.com/onsi/ginkgo"
+    . "github.com/onsi/gomega"
+)
+
+var _ = Describe("Watch", func() {
+    var (
+        storageEngine StorageDriver
+        historian *Historian
+    )
+
+    BeforeEach(func() {
+        storageEngine = MakeNewStorageDriver()
+        storageEngine.Open()
+
+        historian = NewHistorian(storageEngine, 0, 0, 1000)
+    })
+
+    AfterEach(func() {
+        storageEngine.Close()
+    })
+
+    It("should replay matching events after lastSerial, mark the end of the replay, then send new matching events", func() {
+        historian.LogEvent(&Event{ Timestamp: 1, SourceID: "door1", Type: "door_open" })
+        historian.LogEvent(&Event{ Timestamp: 2, SourceID: "door1", Type: "door_open" })
+        historian.LogEvent(&Event{ Timestamp: 3, SourceID: "door2", Type: "door_close" })
+
+        ctx, cancel := context.WithCancel(context.Background())
+        ch := make(chan *Event)
+
+        go historian.Watch(ctx, &HistoryQuery{ Types: []string{ "door_open" } }, 1, ch)
+
+        event := <-ch
+        Expect(event.Serial).Should(Equal(uint64(2)))
+        Expect(<-ch).Should(BeNil())
+
+        go func() {
+            historian.LogEvent(&Event{ Timestamp: 4, SourceID: "door2", Type: "door_close" })
+            historian.LogEvent(&Event{ Timestamp: 5, SourceID: "door2", Type: "door_open" })
+        }()
+
+        event = <-ch
+        Expect(event.Serial).Should(Equal(uint64(5)))
+        Expect(event.SourceID).Should(Equal("door2"))
+
+        cancel()
+
+        Eventually(ch).Should(BeClosed())
+    })
+
+    It("should not block logging while a watcher is slow to read the replay", func() {
+        historian.LogEvent(&Event{ Timestamp: 1, SourceID: "door1", Type: "door_open" })
+        historian.LogEvent(&Event{ Timestamp: 2, SourceID: "door1", Type: "door_open" })
+
+        ctx, cancel := context.WithCancel(context.Background())
+        defer cancel()
+        ch := make(chan *Event)
+
+        go historian.Watch(ctx, &HistoryQuery{ }, 0, ch)
+
+        Expect((<-ch).Serial).Should(Equal(uint64(1)))
+
+        logged := make(chan int)
+
+        go func() {
+            historian.LogEvent(&Event{ Timestamp: 3, SourceID: "door1", Type: "door_open" })
+            logged <- 1
+        }()
+
+        Eventually(logged).Should(Receive())
+
+        Expect((<-ch).Serial).Should(Equal(uint64(2)))
+        Expect((<-ch).Serial).Should(Equal(uint64(3)))
+        Expect(<-ch).Should(BeNil())
+    })
+
+    It("should disconnect a watcher that falls too far behind without blocking logging", func() {
+        ctx, cancel := context.WithCancel(context.Background())
+        defer cancel()
+        ch := make(chan *Event)
+
+        go historian.Watch(ctx, &HistoryQuery{ }, 0, ch)
+
+        Expect(<-ch).Should(BeNil())
+
+        for i := 0; i < WATCH_BUFFER_SIZE + 2; i++ {
+            Expect(historian.LogEvent(&Event{ Timestamp: uint64(i + 1), SourceID: "door1", Type: "door_open" })).Should(BeNil())
+        }
+
+        var lastSerial uint64
+        var received int
+
+        for event := range ch {
+            Expect(event.Serial).Should(Equal(lastSerial + 1))
+            lastSerial = event.Serial
+            received++
+        }
+
+        Expect(received).Should(BeNumerically(">=", WATCH_BUFFER_SIZE - 1))
+        Expect(received).Should(BeNumerically("<", WATCH_BUFFER_SIZE + 2))
+
+        // Watching again from the last event received picks up the rest
+        ch = make(chan *Event)
+
+        go historian.Watch(ctx, &HistoryQuery{ }, lastSerial, ch)
+
+        for event := <-ch; event != nil; event = <-ch {
+            lastSerial = event.Serial
+        }
+
+        Expect(lastSerial).Should(Equal(uint64(WATCH_BUFFER_SIZE + 2)))
+    })
+})
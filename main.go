@@ -40,6 +40,8 @@ import (
     "crypto/x509"
 
     . "github.com/armPelionEdge/devicedb/client"
+    "github.com/armPelionEdge/devicedb/client_relay"
+    "github.com/armPelionEdge/devicedb/bundle"
     . "github.com/armPelionEdge/devicedb/server"
     "github.com/armPelionEdge/devicedb/storage"
     "github.com/armPelionEdge/devicedb/node"
@@ -86,6 +88,14 @@ syncSessionLimit: 2
 # **REQUIRED**
 syncSessionPeriod: 1000
 
+# When set, sync sessions are scheduled per bucket instead of at a fixed
+# rate. A bucket is synced within one syncSessionPeriod after a local write
+# or after a peer reports a different merkle root for it. Each sync session
+# that finds nothing to do doubles the time until the next one, up to this
+# many milliseconds. Delays are randomized to keep relays that reconnect at
+# the same time from syncing in lock step. Must be at least syncSessionPeriod
+# syncSessionPeriodMax: 60000
+
 # This field adjusts the maximum number of objects that can be transferred in
 # one sync session. A higher number will result in faster convergence between
 # database replicas. This field must be positive and defaults to 1000
@@ -125,6 +135,20 @@ gcPurgeAge: 600000
 # alerts:
 #    # How often in milliseconds the latest alerts are forwarded to the cloud
 #    forwardInterval: 60000
+#    # Repeated reports of an alert that change neither its status nor its
+#    # level within this many milliseconds are dropped. Alerts are also held
+#    # back from forwarding until they have not changed for this long so an
+#    # alert that flaps between firing and clear is only forwarded once it
+#    # settles. It defaults to 0 which disables both
+#    dedupWindow: 30000
+#    # How many alert state transitions (raised, updated, acknowledged and
+#    # cleared) are kept in the local alert history. Defaults to 10000
+#    historyLimit: 10000
+#    # How often, in milliseconds, alert rules whose condition must hold
+#    # for some time or that watch for missing events are checked.
+#    # Alert rules are stored in the cloud bucket under the prefix
+#    # devicedb/alerts/rules/. Defaults to 1000
+#    ruleInterval: 1000
 #
 # This field can be used to specify how this node handles time-series data.
 # These settings adjust how and when historical data is purged from the
@@ -173,6 +197,25 @@ gcPurgeAge: 600000
 #    # of 100 logs uploaded to the cloud. It must be >= 0. If the batch size is 0
 #    # then there is no limit on the batch size.
 #    forwardBatchSize: 1000
+#    # Retention rules give events from particular sources or of particular
+#    # types their own limits so that high volume events don't push rare
+#    # but important ones out of the log. source and type are patterns such
+#    # as sensor-* and an empty pattern matches anything. An event follows
+#    # the matching rule with the highest priority. Events older than maxAge
+#    # milliseconds or beyond the maxCount most recent events that follow a
+#    # rule are purged. Zero means no limit. When the log grows past
+#    # eventLimit, events following lower priority rules are purged first.
+#    # Events that follow no rule have priority 0
+#    retentionRules:
+#      - type: tamper
+#        priority: 10
+#      - source: sensor-*
+#        maxAge: 86400000
+#        maxCount: 10000
+#        priority: -1
+#    # How often, in milliseconds, events are purged according to the
+#    # retention rules. It must be at least 1000 and defaults to 60000
+#    retentionInterval: 60000
 
 # The merkle depth adjusts how efficiently the sync process resolves
 # differences between database nodes. A rule of thumb is to set this as high
@@ -201,6 +244,19 @@ gcPurgeAge: 600000
 # **REQUIRED**
 merkleDepth: 19
 
+# Instead of keeping every bucket at merkleDepth the depth of each
+# replicated bucket can be adjusted to the number of keys it holds so
+# that small buckets don't waste memory and large buckets don't end up
+# with overloaded leaves. Every interval (in ms) the depth is checked and
+# the bucket is rebuilt online if it holds too many or too few keys for
+# its depth. A depth chosen this way is remembered across restarts and
+# takes precedence over merkleDepth. The depth of a bucket can also be
+# set by hand with devicedb merkle_depth
+# adaptiveMerkleDepth:
+#     minDepth: 4
+#     maxDepth: 19
+#     interval: 600000
+
 # The peer list specifies a list of other database nodes that are in the same
 # cluster as this node. This database node will contiually try to connect to
 # and sync with the nodes in this list. Alternatively peers can be added at
@@ -217,6 +273,15 @@ peers:
 #      host: 127.0.0.1
 #      port: 9292
 
+# The LAN address, in host:port form, at which the other relays in this
+# relay's site can reach its sync port. It is sent to the cloud, which
+# shares the addresses of all relays in a site with each of them. Relays
+# then connect to their site siblings directly, using the certificates in
+# the tls section, so the default and lww buckets stay in sync locally
+# while the cloud is unreachable. Leave this unset to keep this relay out
+# of the site mesh
+# advertiseAddress: 192.168.1.10:9090
+
 # These are the possible log levels in order from lowest to highest level.
 # Specifying a particular log level means you will see all messages at that
 # level and below. For example, if debug is specified, all log messages will
@@ -265,7 +330,24 @@ logLevel: info
 #     # The URI of the history service that collects history logs
 #     historyURI: https://history.wigwag.com/history
 #     alertsID: *.wigwag.com
+#     # The URI of the service that collects alerts. A devicedb cluster
+#     # started with -alerts accepts them at /alerts on its relay address
 #     alertsURI: https://alerts.wigwag.com/alerts
+#     # On metered links, such as capped LTE plans, the traffic to and from the
+#     # cloud can be limited. Live updates are sent first, then background sync
+#     # traffic, then history and alert forwarding. Background sync stops once 90%
+#     # of the budget is used up and forwarding stops at 80% so the rest is kept
+#     # for live updates. All fields default to 0 which means no limit.
+#     bandwidth:
+#         # The number of bytes that may be used in each budget period
+#         budget: 104857600
+#         # The length of a budget period in milliseconds. It must be at least
+#         # 1000 if a budget is set
+#         budgetPeriod: 86400000
+#         # The sustained rate in bytes per second
+#         rate: 4096
+#         # The number of bytes that can be sent in a burst. Defaults to rate
+#         burst: 65536
 
 # The TLS options specify file paths to PEM encoded SSL certificates and keys
 # All connections between database nodes use TLS to identify and authenticate
@@ -314,12 +396,14 @@ var usage string =
 `Usage: devicedb <command> <arguments> | -version
 
 Commands:
-    start      Start a devicedb relay server
-    conf       Generate a template config file for a relay server
-    upgrade    Upgrade an old database to the latest format on a relay
-    benchmark  Benchmark devicedb performance on a relay
-    compact    Compact underlying disk storage
-    cluster    Manage a devicedb cloud cluster
+    start         Start a devicedb relay server
+    conf          Generate a template config file for a relay server
+    upgrade       Upgrade an old database to the latest format on a relay
+    benchmark     Benchmark devicedb performance on a relay
+    compact       Compact underlying disk storage
+    merkle_depth  Show or change the merkle depth of a bucket on a running relay
+    cluster       Manage a devicedb cloud cluster
+    bundle        Move data to and from air-gapped sites using offline sync bundles
     
 Use devicedb help <command> for more usage information about a command.
 `
@@ -351,6 +435,21 @@ Cluster Commands:
 Use devicedb cluster help <cluster_command> for more usage information about a cluster command.
 `
 
+var bundleUsage string = 
+`Usage: devicedb bundle <bundle_command> <arguments>
+
+Bundle Commands:
+    export  Export a signed bundle from a relay (-uri) or from a site in a cloud cluster (-site)
+    import  Import a signed bundle into a relay (-uri) or into a site in a cloud cluster (-site)
+
+Bundles carry data between a relay and the cloud when no network path exists
+between them. Each bundle includes a summary of the bucket it was exported from.
+Pass the last bundle received from a peer as -known when exporting to send that
+peer only what it is missing.
+    
+Use devicedb bundle help <bundle_command> for more usage information about a bundle command.
+`
+
 var commandUsage string = "Usage: devicedb %s <arguments>\n"
 
 func isValidPartitionCount(p uint64) bool {
@@ -390,6 +489,7 @@ func main() {
     upgradeCommand := flag.NewFlagSet("upgrade", flag.ExitOnError)
     benchmarkCommand := flag.NewFlagSet("benchmark", flag.ExitOnError)
     compactCommand := flag.NewFlagSet("compact", flag.ExitOnError)
+    merkleDepthCommand := flag.NewFlagSet("merkle_depth", flag.ExitOnError)
     helpCommand := flag.NewFlagSet("help", flag.ExitOnError)
     clusterStartCommand := flag.NewFlagSet("start", flag.ExitOnError)
     clusterBenchmarkCommand := flag.NewFlagSet("benchmark", flag.ExitOnError)
@@ -412,6 +512,9 @@ func main() {
     clusterSnapshotCommand := flag.NewFlagSet("snapshot", flag.ExitOnError)
     clusterGetSnapshotCommand := flag.NewFlagSet("get_snapshot", flag.ExitOnError)
     clusterDownloadSnapshotCommand := flag.NewFlagSet("download_snapshot", flag.ExitOnError)
+    bundleExportCommand := flag.NewFlagSet("export", flag.ExitOnError)
+    bundleImportCommand := flag.NewFlagSet("import", flag.ExitOnError)
+    bundleHelpCommand := flag.NewFlagSet("help", flag.ExitOnError)
 
     startConfigFile := startCommand.String("conf", "", "The config file for this server")
 
@@ -430,6 +533,12 @@ func main() {
 
     compactDB := compactCommand.String("db", "", "The directory containing the database data to compact")
 
+    merkleDepthURI := merkleDepthCommand.String("uri", "http://localhost:9090", "The base URI of the relay. (Ex: https://localhost:9090)")
+    merkleDepthServerName := merkleDepthCommand.String("server_name", "", "The server name to expect in the certificate of the relay. This is usually the relay ID.")
+    merkleDepthCA := merkleDepthCommand.String("ca", "", "PEM encoded CA chain used to verify the relay's certificate.")
+    merkleDepthBucket := merkleDepthCommand.String("bucket", "default", "The bucket whose merkle depth to show or change.")
+    merkleDepthDepth := merkleDepthCommand.Uint("depth", 0, "The merkle depth to rebuild the bucket's merkle tree at. The bucket stays online while it is rebuilt. If omitted the current depth is shown.")
+
     clusterStartHost := clusterStartCommand.String("host", "localhost", "HTTP The hostname or ip to listen on. This is the advertised host address for this node.")
     clusterStartPort := clusterStartCommand.Uint("port", defaultPort, "HTTP This is the intra-cluster port used for communication between nodes and between secure clients and the cluster.")
     clusterStartRelayHost := clusterStartCommand.String("relay_host", "localhost", "HTTPS The hostname or ip to listen on for incoming relay connections. Applies only if TLS is terminated by devicedb itself")
@@ -446,9 +555,17 @@ func main() {
     clusterStartSyncMaxSessions := clusterStartCommand.Uint("sync_max_sessions", 10, "The number of sync sessions to allow at the same time.")
     clusterStartSyncPathLimit := clusterStartCommand.Uint("sync_path_limit", 10, "The number of exploration paths to allow in a sync session.")
     clusterStartSyncPeriod := clusterStartCommand.Uint("sync_period", 1000, "The period in milliseconds between sync sessions with individual relays.")
+    clusterStartSyncPeriodMax := clusterStartCommand.Uint("sync_period_max", 0, "If set, sync sessions with relays adapt to changes. Buckets are synced within one sync_period after they change and back off exponentially to this many milliseconds while idle.")
     clusterStartLogLevel := clusterStartCommand.String("log_level", "info", "The log level configures how detailed the output produced by devicedb is. Must be one of { critical, error, warning, notice, info, debug }")
     clusterStartNoValidate := clusterStartCommand.Bool("no_validate", false, "This flag enables relays connecting to this node to decide their own relay ID. It only applies to TLS enabled servers and should only be used for testing.")
     clusterStartSnapshotDirectory := clusterStartCommand.String("snapshot_store", "", "To enable snapshots set this to some directory where database snapshots can be stored")
+    clusterStartHistory := clusterStartCommand.Bool("history", false, "Accept events forwarded by relays at /history and store them so they can be queried per site and relay. Relays should set cloud.historyURI to this node's relay address with the /history path.")
+    clusterStartHistoryEventLimit := clusterStartCommand.Uint64("history_event_limit", 100000, "The number of events kept for each relay before old events are purged. Applies to sites that have not been given a retention of their own.")
+    clusterStartHistoryEventFloor := clusterStartCommand.Uint64("history_event_floor", 90000, "The number of events left for a relay after old events are purged. Applies to sites that have not been given a retention of their own.")
+    clusterStartAlerts := clusterStartCommand.Bool("alerts", false, "Accept alerts forwarded by relays at /alerts and keep the current alerts of each relay so they can be queried per site or across sites. Relays should set cloud.alertsURI to this node's relay address with the /alerts path.")
+    clusterStartAlertsStaleAfter := clusterStartCommand.Uint64("alerts_stale_after", 600000, "Raise a stale relay alert for relays that have not reported to the cluster for this many milliseconds. Set to 0 to disable.")
+    clusterStartWebhooks := clusterStartCommand.Bool("webhooks", false, "Deliver updates made to site buckets to the webhooks configured at /webhooks. Should be set on every node in the cluster since each site is delivered by the first owner of its partition.")
+    clusterStartWebhookMaxAttempts := clusterStartCommand.Uint("webhook_max_attempts", 8, "The number of times delivery of an update to a webhook is attempted before it is moved to the webhook's dead letter list.")
 
     clusterBenchmarkExternalAddresses := clusterBenchmarkCommand.String("external_addresses", "", "A comma separated list of cluster node addresses. Ex: wss://localhost:9090,wss://localhost:8080")
     clusterBenchmarkInternalAddresses := clusterBenchmarkCommand.String("internal_addresses", "", "A comma separated list of cluster node addresses. Ex: localhost:9090,localhost:8080")
@@ -540,6 +657,27 @@ func main() {
     clusterDownloadSnapshotPort := clusterDownloadSnapshotCommand.Uint("port", defaultPort, "The port of the cluster member to contact.")
     clusterDownloadSnapshotSnapshotId := clusterDownloadSnapshotCommand.String("uuid", "", "The UUID of the snapshot to download")
 
+    bundleExportURI := bundleExportCommand.String("uri", "", "The base URI of the relay to export from. (Ex: https://localhost:9090) Use either this or -site.")
+    bundleExportServerName := bundleExportCommand.String("server_name", "", "The server name to expect in the certificate of the relay specified by -uri. This is usually the relay ID.")
+    bundleExportHost := bundleExportCommand.String("host", "localhost", "The hostname or ip of some cluster member to contact when exporting from a site.")
+    bundleExportPort := bundleExportCommand.Uint("port", defaultPort, "The port of the cluster member to contact.")
+    bundleExportSiteID := bundleExportCommand.String("site", "", "The ID of the site to export from. Use either this or -uri.")
+    bundleExportBucket := bundleExportCommand.String("bucket", "default", "The bucket to export.")
+    bundleExportKnown := bundleExportCommand.String("known", "", "A bundle previously received from the peer this bundle is meant for. Only data that peer may be missing is exported. If omitted the whole bucket is exported.")
+    bundleExportCert := bundleExportCommand.String("cert", "", "PEM encoded x509 certificate used to sign the bundle. Its common name must be the ID of the exporting relay or \"cloud\" when exporting from a site. (Required)")
+    bundleExportKey := bundleExportCommand.String("key", "", "PEM encoded x509 key corresponding to the specified 'cert'. (Required)")
+    bundleExportCA := bundleExportCommand.String("ca", "", "PEM encoded CA chain used to verify the -known bundle and the relay's certificate.")
+    bundleExportOut := bundleExportCommand.String("out", "", "The file to write the bundle to. (Required)")
+
+    bundleImportURI := bundleImportCommand.String("uri", "", "The base URI of the relay to import into. (Ex: https://localhost:9090) Use either this or -site.")
+    bundleImportServerName := bundleImportCommand.String("server_name", "", "The server name to expect in the certificate of the relay specified by -uri. This is usually the relay ID.")
+    bundleImportHost := bundleImportCommand.String("host", "localhost", "The hostname or ip of some cluster member to contact when importing into a site.")
+    bundleImportPort := bundleImportCommand.Uint("port", defaultPort, "The port of the cluster member to contact.")
+    bundleImportSiteID := bundleImportCommand.String("site", "", "The ID of the site to import into. Use either this or -uri.")
+    bundleImportBucket := bundleImportCommand.String("bucket", "", "The bucket to import into. Defaults to the bucket the bundle was exported from and must match it if given.")
+    bundleImportCA := bundleImportCommand.String("ca", "", "PEM encoded CA chain used to verify the bundle's signature and the relay's certificate. (Required)")
+    bundleImportIn := bundleImportCommand.String("in", "", "The bundle file to import. (Required)")
+
     if len(os.Args) < 2 {
         fmt.Fprintf(os.Stderr, "Error: %s", "No command specified\n\n")
         fmt.Fprintf(os.Stderr, "%s", usage)
@@ -604,6 +742,27 @@ func main() {
             fmt.Fprintf(os.Stderr, "%s", clusterUsage)
             os.Exit(1)
         }
+    case "bundle":
+        if len(os.Args) < 3 {
+            fmt.Fprintf(os.Stderr, "Error: %s", "No bundle command specified\n\n")
+            fmt.Fprintf(os.Stderr, "%s", bundleUsage)
+            os.Exit(1)
+        }
+
+        switch os.Args[2] {
+        case "export":
+            bundleExportCommand.Parse(os.Args[3:])
+        case "import":
+            bundleImportCommand.Parse(os.Args[3:])
+        case "help":
+            bundleHelpCommand.Parse(os.Args[3:])
+        case "-help":
+            fmt.Fprintf(os.Stderr, "%s", bundleUsage)
+        default:
+            fmt.Fprintf(os.Stderr, "Error: \"%s\" is not a recognized bundle command\n\n", os.Args[2])
+            fmt.Fprintf(os.Stderr, "%s", bundleUsage)
+            os.Exit(1)
+        }
     case "start":
         startCommand.Parse(os.Args[2:])
     case "conf":
@@ -614,6 +773,8 @@ func main() {
         benchmarkCommand.Parse(os.Args[2:])
     case "compact":
         compactCommand.Parse(os.Args[2:])
+    case "merkle_depth":
+        merkleDepthCommand.Parse(os.Args[2:])
     case "help":
         helpCommand.Parse(os.Args[2:])
     case "-help":
@@ -751,6 +912,50 @@ func main() {
         }
     }
 
+    if merkleDepthCommand.Parsed() {
+        if *merkleDepthDepth != 0 && (*merkleDepthDepth < uint(MerkleMinDepth) || *merkleDepthDepth > uint(MerkleMaxDepth)) {
+            fmt.Fprintf(os.Stderr, "Error: -depth must be from %d to %d inclusive\n", MerkleMinDepth, MerkleMaxDepth)
+            os.Exit(1)
+        }
+
+        var rootCAs *x509.CertPool
+
+        if *merkleDepthCA != "" {
+            var err error
+
+            rootCAs, err = loadCertPool(*merkleDepthCA)
+
+            if err != nil {
+                fmt.Fprintf(os.Stderr, "Error: Unable to load the CA from %s: %v\n", *merkleDepthCA, err.Error())
+                os.Exit(1)
+            }
+        }
+
+        relayClient := client_relay.New(client_relay.Config{
+            ServerURI: *merkleDepthURI,
+            TLSConfig: &tls.Config{ RootCAs: rootCAs, ServerName: *merkleDepthServerName },
+        })
+
+        var merkleDepth client_relay.MerkleDepth
+        var err error
+
+        if *merkleDepthDepth == 0 {
+            merkleDepth, err = relayClient.MerkleDepth(context.TODO(), *merkleDepthBucket)
+        } else {
+            fmt.Fprintf(os.Stderr, "Rebuilding the merkle tree of bucket %s at depth %d...\n", *merkleDepthBucket, *merkleDepthDepth)
+
+            merkleDepth, err = relayClient.SetMerkleDepth(context.TODO(), *merkleDepthBucket, uint8(*merkleDepthDepth))
+        }
+
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "Error: %v\n", err.Error())
+            os.Exit(1)
+        }
+
+        fmt.Fprintf(os.Stdout, "Bucket %s holds %d keys in a merkle tree of depth %d\n", *merkleDepthBucket, merkleDepth.KeyCount, merkleDepth.Depth)
+        os.Exit(0)
+    }
+
     if compactCommand.Parsed() {
         if len(*compactDB) == 0 {
             fmt.Fprintf(os.Stderr, "Error: No database directory (-db) specified\n")
@@ -794,9 +999,14 @@ func main() {
             flagSet = upgradeCommand
         case "benchmark":
             flagSet = benchmarkCommand
+        case "merkle_depth":
+            flagSet = merkleDepthCommand
         case "cluster":
             fmt.Fprintf(os.Stderr, commandUsage, "cluster <cluster_command>")
             os.Exit(0)
+        case "bundle":
+            fmt.Fprintf(os.Stderr, commandUsage, "bundle <bundle_command>")
+            os.Exit(0)
         default:
             fmt.Fprintf(os.Stderr, "Error: \"%s\" is not a valid command.\n", os.Args[2])
             os.Exit(1)
@@ -906,6 +1116,11 @@ func main() {
             os.Exit(1)
         }
 
+        if *clusterStartSyncPeriodMax != 0 && *clusterStartSyncPeriodMax < *clusterStartSyncPeriod {
+            fmt.Fprintf(os.Stderr, "Error: The specified max sync period is not valid. It must not be less than the sync period\n")
+            os.Exit(1)
+        }
+
         var seedHost string
         var seedPort int
         var startOptions node.NodeInitializationOptions
@@ -932,7 +1147,14 @@ func main() {
         startOptions.SyncMaxSessions = *clusterStartSyncMaxSessions
         startOptions.SyncPathLimit = uint32(*clusterStartSyncPathLimit)
         startOptions.SyncPeriod = *clusterStartSyncPeriod
+        startOptions.SyncPeriodMax = *clusterStartSyncPeriodMax
         startOptions.SnapshotDirectory = *clusterStartSnapshotDirectory
+        startOptions.HistoryEnabled = *clusterStartHistory
+        startOptions.HistoryRetention = historian.HistoryRetention{ EventLimit: *clusterStartHistoryEventLimit, EventFloor: *clusterStartHistoryEventFloor }
+        startOptions.AlertsEnabled = *clusterStartAlerts
+        startOptions.AlertsStaleAfter = *clusterStartAlertsStaleAfter
+        startOptions.WebhooksEnabled = *clusterStartWebhooks
+        startOptions.WebhookMaxAttempts = int(*clusterStartWebhookMaxAttempts)
         SetLoggingLevel(*clusterStartLogLevel)
 
         cloudNodeStorage := storage.NewLevelDBStorageDriver(*clusterStartStore, nil)
@@ -1248,6 +1470,24 @@ func main() {
             fmt.Fprintf(os.Stderr, "Ping: %v\n", relayStatus.Ping)
         }
 
+        fmt.Fprintf(os.Stderr, "Unacknowledged Pushes: %d", relayStatus.PushQueueDepth)
+
+        if relayStatus.PushQueueDepth != 0 {
+            fmt.Fprintf(os.Stderr, " (oldest waiting %v)", relayStatus.OldestUnacknowledgedPush)
+        }
+
+        fmt.Fprintf(os.Stderr, "\n")
+
+        for bucket, bucketSync := range relayStatus.Sync {
+            fmt.Fprintf(os.Stderr, "Bucket %s: last sync %s at %v", bucket, bucketSync.Outcome, bucketSync.LastSessionStart)
+
+            if bucketSync.AbortReason != "" {
+                fmt.Fprintf(os.Stderr, " (%s)", bucketSync.AbortReason)
+            }
+
+            fmt.Fprintf(os.Stderr, ", %d nodes explored, %d keys pushed, %d keys pulled, %d bytes sent, %d bytes received, roots last matched at %v\n", bucketSync.NodesExplored, bucketSync.KeysPushed, bucketSync.KeysPulled, bucketSync.BytesSent, bucketSync.BytesReceived, bucketSync.LastRootMatch)
+        }
+
         os.Exit(0)
     }
 
@@ -1567,6 +1807,241 @@ func main() {
         flagSet.PrintDefaults()
         os.Exit(0)
     }
+
+    if bundleExportCommand.Parsed() {
+        if (*bundleExportURI == "") == (*bundleExportSiteID == "") {
+            fmt.Fprintf(os.Stderr, "Error: Exactly one of -uri or -site must be specified\n")
+            os.Exit(1)
+        }
+
+        if *bundleExportCert == "" || *bundleExportKey == "" {
+            fmt.Fprintf(os.Stderr, "Error: -cert and -key must be specified to sign the bundle\n")
+            os.Exit(1)
+        }
+
+        if *bundleExportOut == "" {
+            fmt.Fprintf(os.Stderr, "Error: -out must be specified\n")
+            os.Exit(1)
+        }
+
+        certificate, err := tls.LoadX509KeyPair(*bundleExportCert, *bundleExportKey)
+
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "Error: Unable to load the signing certificate and key: %v\n", err.Error())
+            os.Exit(1)
+        }
+
+        var rootCAs *x509.CertPool
+
+        if *bundleExportCA != "" {
+            rootCAs, err = loadCertPool(*bundleExportCA)
+
+            if err != nil {
+                fmt.Fprintf(os.Stderr, "Error: Unable to load the CA from %s: %v\n", *bundleExportCA, err.Error())
+                os.Exit(1)
+            }
+        }
+
+        var exportRequest bundle.ExportRequest
+
+        if *bundleExportKnown != "" {
+            if rootCAs == nil {
+                fmt.Fprintf(os.Stderr, "Error: -ca must be specified to verify the bundle given in -known\n")
+                os.Exit(1)
+            }
+
+            known, _, err := openBundleFile(*bundleExportKnown, rootCAs)
+
+            if err != nil {
+                fmt.Fprintf(os.Stderr, "Error: Unable to open bundle %s: %v\n", *bundleExportKnown, err.Error())
+                os.Exit(1)
+            }
+
+            exportRequest.Peer = known.Source
+            exportRequest.Summary = known.Summary
+        }
+
+        var exported *bundle.Bundle
+
+        if *bundleExportURI != "" {
+            relayClient := client_relay.New(client_relay.Config{
+                ServerURI: *bundleExportURI,
+                TLSConfig: &tls.Config{ RootCAs: rootCAs, ServerName: *bundleExportServerName },
+            })
+
+            exported, err = relayClient.ExportBundle(context.TODO(), *bundleExportBucket, exportRequest)
+        } else {
+            apiClient := New(APIClientConfig{ Servers: []string{ fmt.Sprintf("%s:%d", *bundleExportHost, *bundleExportPort) } })
+
+            exported, err = apiClient.ExportBundle(context.TODO(), *bundleExportSiteID, *bundleExportBucket, exportRequest)
+        }
+
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "Error: Unable to export bundle: %v\n", err.Error())
+            os.Exit(1)
+        }
+
+        signer, err := x509.ParseCertificate(certificate.Certificate[0])
+
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "Error: Unable to parse the signing certificate: %v\n", err.Error())
+            os.Exit(1)
+        }
+
+        if signer.Subject.CommonName != exported.Source {
+            fmt.Fprintf(os.Stderr, "Error: The bundle was exported from %s but the signing certificate belongs to %s\n", exported.Source, signer.Subject.CommonName)
+            os.Exit(1)
+        }
+
+        signedBundle, err := bundle.Sign(exported, certificate)
+
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "Error: Unable to sign bundle: %v\n", err.Error())
+            os.Exit(1)
+        }
+
+        if err := ioutil.WriteFile(*bundleExportOut, signedBundle, 0600); err != nil {
+            fmt.Fprintf(os.Stderr, "Error: Unable to write bundle to %s: %v\n", *bundleExportOut, err.Error())
+            os.Exit(1)
+        }
+
+        fmt.Fprintf(os.Stderr, "Exported %d keys from bucket %s to %s\n", len(exported.SiblingSets), *bundleExportBucket, *bundleExportOut)
+        os.Exit(0)
+    }
+
+    if bundleImportCommand.Parsed() {
+        if (*bundleImportURI == "") == (*bundleImportSiteID == "") {
+            fmt.Fprintf(os.Stderr, "Error: Exactly one of -uri or -site must be specified\n")
+            os.Exit(1)
+        }
+
+        if *bundleImportCA == "" {
+            fmt.Fprintf(os.Stderr, "Error: -ca must be specified to verify the bundle\n")
+            os.Exit(1)
+        }
+
+        if *bundleImportIn == "" {
+            fmt.Fprintf(os.Stderr, "Error: -in must be specified\n")
+            os.Exit(1)
+        }
+
+        rootCAs, err := loadCertPool(*bundleImportCA)
+
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "Error: Unable to load the CA from %s: %v\n", *bundleImportCA, err.Error())
+            os.Exit(1)
+        }
+
+        imported, signedBundle, err := openBundleFile(*bundleImportIn, rootCAs)
+
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "Error: Unable to open bundle %s: %v\n", *bundleImportIn, err.Error())
+            os.Exit(1)
+        }
+
+        if *bundleImportBucket == "" {
+            *bundleImportBucket = imported.Bucket
+        }
+
+        if *bundleImportBucket != imported.Bucket {
+            fmt.Fprintf(os.Stderr, "Error: The bundle was exported from bucket %s and cannot be imported into %s\n", imported.Bucket, *bundleImportBucket)
+            os.Exit(1)
+        }
+
+        if *bundleImportSiteID != "" && imported.Site != "" && *bundleImportSiteID != imported.Site {
+            fmt.Fprintf(os.Stderr, "Error: The bundle was exported from site %s and cannot be imported into %s\n", imported.Site, *bundleImportSiteID)
+            os.Exit(1)
+        }
+
+        if *bundleImportURI != "" {
+            relayClient := client_relay.New(client_relay.Config{
+                ServerURI: *bundleImportURI,
+                TLSConfig: &tls.Config{ RootCAs: rootCAs, ServerName: *bundleImportServerName },
+            })
+
+            err = relayClient.ImportBundle(context.TODO(), *bundleImportBucket, signedBundle)
+        } else {
+            apiClient := New(APIClientConfig{ Servers: []string{ fmt.Sprintf("%s:%d", *bundleImportHost, *bundleImportPort) } })
+
+            var replicas, nApplied int
+
+            replicas, nApplied, err = apiClient.ImportBundle(context.TODO(), *bundleImportSiteID, *bundleImportBucket, signedBundle)
+
+            if err == ENoQuorum {
+                fmt.Fprintf(os.Stderr, "Error: Bundle was only applied to (%d/%d) replicas. Unable to achieve write quorum\n", nApplied, replicas)
+                os.Exit(1)
+            }
+        }
+
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "Error: Unable to import bundle: %v\n", err.Error())
+            os.Exit(1)
+        }
+
+        fmt.Fprintf(os.Stderr, "Imported %d keys exported by %s into bucket %s\n", len(imported.SiblingSets), imported.Source, *bundleImportBucket)
+        os.Exit(0)
+    }
+
+    if bundleHelpCommand.Parsed() {
+        if len(os.Args) < 4 {
+            fmt.Fprintf(os.Stderr, "Error: No bundle command specified for help\n")
+            os.Exit(1)
+        }
+        
+        var flagSet *flag.FlagSet
+
+        switch os.Args[3] {
+        case "export":
+            flagSet = bundleExportCommand
+        case "import":
+            flagSet = bundleImportCommand
+        default:
+            fmt.Fprintf(os.Stderr, "Error: \"%s\" is not a valid bundle command.\n", os.Args[3])
+            os.Exit(1)
+        }
+
+        fmt.Fprintf(os.Stderr, commandUsage + "\n", "bundle " + os.Args[3])
+        flagSet.PrintDefaults()
+        os.Exit(0)
+    }
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+    pemCerts, err := ioutil.ReadFile(file)
+
+    if err != nil {
+        return nil, err
+    }
+
+    certPool := x509.NewCertPool()
+
+    if !certPool.AppendCertsFromPEM(pemCerts) {
+        return nil, errors.New("No valid certificates found")
+    }
+
+    return certPool, nil
+}
+
+func openBundleFile(file string, rootCAs *x509.CertPool) (*bundle.Bundle, []byte, error) {
+    signedBundle, err := ioutil.ReadFile(file)
+
+    if err != nil {
+        return nil, nil, err
+    }
+
+    b, signer, err := bundle.Open(signedBundle, rootCAs)
+
+    if err != nil {
+        return nil, nil, err
+    }
+
+    if signer.Subject.CommonName != b.Source {
+        return nil, nil, fmt.Errorf("Bundle claims to be exported from %s but was signed by %s", b.Source, signer.Subject.CommonName)
+    }
+
+    fmt.Fprintf(os.Stderr, "Bundle %s was exported from %s at %s\n", file, b.Source, b.Created.Format(time.RFC3339))
+
+    return b, signedBundle, nil
 }
 
 func start(configFile string) {
@@ -1592,6 +2067,9 @@ func start(configFile string) {
     sc.Hub.StartForwardingEvents()
     sc.Hub.StartForwardingAlerts()
     server.StartGC()
+    server.StartMerkleDepthTuner()
+    server.StartRetentionPurger()
+    server.StartRuleEngine()
 
     server.Start()
 }
@@ -1832,6 +2310,23 @@ func logEntryToString(logEntry routes.LogEntry) string {
             commandType = "ClusterSnapshot"
             clusterSnapshotCommandBody := commandBody.(cluster.ClusterSnapshotBody)
             commandDetails = fmt.Sprintf("UUID: %s", clusterSnapshotCommandBody.UUID)
+        case cluster.ClusterSetRelaySubscription:
+            commandType = "SetRelaySubscription"
+            setRelaySubscriptionCommandBody := commandBody.(cluster.ClusterSetRelaySubscriptionBody)
+            commandDetails = fmt.Sprintf("Relay ID: %s, Subscription: %v", setRelaySubscriptionCommandBody.RelayID, setRelaySubscriptionCommandBody.Subscription)
+        case cluster.ClusterSetRelayAddress:
+            commandType = "SetRelayAddress"
+            setRelayAddressCommandBody := commandBody.(cluster.ClusterSetRelayAddressBody)
+            commandDetails = fmt.Sprintf("Relay ID: %s, Address: %s", setRelayAddressCommandBody.RelayID, setRelayAddressCommandBody.Address)
+        case cluster.ClusterSetWebhook:
+            commandType = "SetWebhook"
+            setWebhookCommandBody := commandBody.(cluster.ClusterSetWebhookBody)
+
+            if setWebhookCommandBody.Webhook == nil {
+                commandDetails = fmt.Sprintf("Webhook ID: %s, Removed", setWebhookCommandBody.WebhookID)
+            } else {
+                commandDetails = fmt.Sprintf("Webhook ID: %s, Site ID: %s, Bucket: %s, Prefix: %s, URL: %s", setWebhookCommandBody.WebhookID, setWebhookCommandBody.Webhook.SiteID, setWebhookCommandBody.Webhook.Bucket, setWebhookCommandBody.Webhook.Prefix, setWebhookCommandBody.Webhook.URL)
+            }
         }
     } else {
         commandDetails = "<unable to read details>"
@@ -36,12 +36,15 @@ import (
     "sync"
     "time"
 
+    . "github.com/armPelionEdge/devicedb/alerts"
     . "github.com/armPelionEdge/devicedb/bucket"
+    . "github.com/armPelionEdge/devicedb/bundle"
     "github.com/armPelionEdge/devicedb/client"
     . "github.com/armPelionEdge/devicedb/cluster"
     "github.com/armPelionEdge/devicedb/clusterio"
     . "github.com/armPelionEdge/devicedb/data"
     . "github.com/armPelionEdge/devicedb/error"
+    . "github.com/armPelionEdge/devicedb/historian"
     . "github.com/armPelionEdge/devicedb/logging"
     . "github.com/armPelionEdge/devicedb/merkle"
     . "github.com/armPelionEdge/devicedb/partition"
@@ -53,6 +56,7 @@ import (
     ddbSync "github.com/armPelionEdge/devicedb/sync"
     . "github.com/armPelionEdge/devicedb/transfer"
     . "github.com/armPelionEdge/devicedb/util"
+    "github.com/armPelionEdge/devicedb/webhooks"
 
     "github.com/gorilla/websocket"
     "github.com/coreos/etcd/raft"
@@ -63,12 +67,36 @@ const (
     RaftStoreStoragePrefix = iota
     SiteStoreStoragePrefix = iota
     SnapshotMetadataPrefix = iota
+    HistoryStoragePrefix = iota
+    AlertsStoragePrefix = iota
+    WebhooksStoragePrefix = iota
 )
 
 const SnapshotUUIDKey string = "UUID"
 
 const ClusterJoinRetryTimeout = 5
 
+const HistoryPurgeBatchSize = 1000
+
+// How long the stale relay check waits for the cluster to report
+// whether a relay is connected
+const RelayStatusTimeout = 5
+
+// How long in seconds a node waits for each owner of a site's partition
+// to apply or report the alert state of the site's relays
+const RelayAlertsTimeout = 5
+
+// How long in seconds a node waits for each owner of a site's partition
+// to log, summarize or configure the history of the site's relays
+const RelayHistoryTimeout = 10
+
+// How often in seconds the webhooks in the cluster state are matched
+// against the partitions owned by this node
+const WebhookReconcileInterval = 5
+
+// How long a webhook status request waits for each node to report
+const WebhookStatusTimeout = 5
+
 type ClusterNodeConfig struct {
     StorageDriver StorageDriver
     CloudServer *CloudServer
@@ -86,6 +114,7 @@ type ClusterNode struct {
     raftStore RaftNodeStorage
     transferAgent PartitionTransferAgent
     clusterioAgent clusterio.ClusterIOAgent
+    nodeClient *NodeClient
     storageDriver StorageDriver
     partitionFactory PartitionFactory
     partitionPool PartitionPool
@@ -103,9 +132,13 @@ type ClusterNode struct {
     emptyMu sync.Mutex
     relayConnectionsMu sync.Mutex
     hub *Hub
+    bucketProxyFactory *ddbSync.CloudBucketProxyFactory
     noValidate bool
     snapshotsDirectory string
     snapshotter *Snapshotter
+    siteHistory *SiteHistory
+    siteAlerts *SiteAlerts
+    webhookDispatcher *webhooks.Dispatcher
 }
 
 func New(config ClusterNodeConfig) *ClusterNode {
@@ -191,6 +224,33 @@ func (node *ClusterNode) Start(options NodeInitializationOptions) error {
         storageDriver: node.storageDriver,
     }
 
+    if options.HistoryEnabled {
+        node.siteHistory, err = NewSiteHistory(NewPrefixedStorageDriver([]byte{ HistoryStoragePrefix }, node.storageDriver), options.HistoryRetention, HistoryPurgeBatchSize)
+
+        if err != nil {
+            Log.Criticalf("Local node (id = %d) unable to load relay history: %v", nodeID, err.Error())
+
+            return err
+        }
+    }
+
+    if options.AlertsEnabled {
+        node.siteAlerts, err = NewSiteAlerts(NewPrefixedStorageDriver([]byte{ AlertsStoragePrefix }, node.storageDriver))
+
+        if err != nil {
+            Log.Criticalf("Local node (id = %d) unable to load relay alerts: %v", nodeID, err.Error())
+
+            return err
+        }
+    }
+
+    if options.WebhooksEnabled {
+        node.webhookDispatcher = webhooks.NewDispatcher(webhooks.DispatcherConfig{
+            StorageDriver: NewPrefixedStorageDriver([]byte{ WebhooksStoragePrefix }, node.storageDriver),
+            MaxAttempts: options.WebhookMaxAttempts,
+        })
+    }
+
     Log.Infof("Local node (id = %d) starting up...", nodeID)
 
     node.raftTransport.SetLocalPeerID(nodeID)
@@ -226,7 +286,8 @@ func (node *ClusterNode) Start(options NodeInitializationOptions) error {
     // state before changes to its partitions ownership and partition transfers
     // occur
     node.transferAgent = NewDefaultHTTPTransferAgent(node.configController, node.partitionPool)
-    node.clusterioAgent = clusterio.NewAgent(NewNodeClient(node, node.configController), NewPartitionResolver(node.configController))
+    node.nodeClient = NewNodeClient(node, node.configController)
+    node.clusterioAgent = clusterio.NewAgent(node.nodeClient, NewPartitionResolver(node.configController))
 
     if options.SyncPeriod < 1000 {
         options.SyncPeriod = 1000
@@ -237,9 +298,18 @@ func (node *ClusterNode) Start(options NodeInitializationOptions) error {
         ClusterController: node.configController.ClusterController(),
         PartitionPool: node.partitionPool,
         ClusterIOAgent: node.clusterioAgent,
+        ScopedMerkleTrees: ddbSync.NewScopedMerkleTreeCache(),
+    }
+    node.bucketProxyFactory = bucketProxyFactory
+    var syncScheduler ddbSync.SyncScheduler = ddbSync.NewMultiSyncScheduler(time.Millisecond * time.Duration(options.SyncPeriod))
+
+    if options.SyncPeriodMax != 0 {
+        syncScheduler = ddbSync.NewAdaptiveSyncScheduler(time.Millisecond * time.Duration(options.SyncPeriod), time.Millisecond * time.Duration(options.SyncPeriodMax), SYNC_SESSION_JITTER)
     }
-    syncController := NewSyncController(options.SyncMaxSessions, bucketProxyFactory, ddbSync.NewMultiSyncScheduler(time.Millisecond * time.Duration(options.SyncPeriod)), options.SyncPathLimit)
+
+    syncController := NewSyncController(options.SyncMaxSessions, bucketProxyFactory, syncScheduler, options.SyncPathLimit)
     node.hub = NewHub("", syncController, nil)
+    node.hub.SetSiteDirectory(node)
 
     stateCoordinator.InitializeNodeState()
 
@@ -291,6 +361,14 @@ func (node *ClusterNode) Start(options NodeInitializationOptions) error {
 
     node.notifyInitialized()
 
+    if node.siteAlerts != nil && options.AlertsStaleAfter != 0 {
+        go node.checkStaleRelays(options.AlertsStaleAfter)
+    }
+
+    if node.webhookDispatcher != nil {
+        go node.dispatchWebhooks()
+    }
+
     select {
     case <-node.leftCluster:
         Log.Infof("Local node (id = %d) shutting down...", nodeID)
@@ -357,13 +435,13 @@ func (node *ClusterNode) startNetworking() <-chan error {
     clusterEndpoint := &ClusterEndpoint{ ClusterFacade: &ClusterNodeFacade{ node: node } }
     partitionsEndpoint := &PartitionsEndpoint{ ClusterFacade: &ClusterNodeFacade{ node: node } }
     relaysEndpoint := &RelaysEndpoint{ ClusterFacade: &ClusterNodeFacade{ node: node } }
-    sitesEndpoint := &SitesEndpoint{ ClusterFacade: &ClusterNodeFacade{ node: node } }
+    sitesEndpoint := &SitesEndpoint{ ClusterFacade: &ClusterNodeFacade{ node: node }, BundleRoots: node.cloudServer.RelayCAs() }
     syncEndpoint := &SyncEndpoint{ ClusterFacade: &ClusterNodeFacade{ node: node }, Upgrader: websocket.Upgrader{ ReadBufferSize: 1024, WriteBufferSize: 1024 } }
     logDumEndpoint := &LogDumpEndpoint{ ClusterFacade: &ClusterNodeFacade{ node: node } }
     snapshotEndpoint := &SnapshotEndpoint{ ClusterFacade: &ClusterNodeFacade{ node: node } }
     profileEndpoint := &ProfilerEndpoint{ }
     prometheusEndpoint := &PrometheusEndpoint{ }
-    merkleSyncEndpoint := &ddbSync.BucketSyncHTTP{ PartitionPool: node.partitionPool, ClusterConfigController: node.configController }
+    merkleSyncEndpoint := &ddbSync.BucketSyncHTTP{ PartitionPool: node.partitionPool, ClusterConfigController: node.configController, ScopedMerkleTrees: node.bucketProxyFactory.ScopedMerkleTrees }
     kubernetesEndpoint := &KubernetesEndpoint{ }
 
     node.raftTransport.Attach(router)
@@ -375,6 +453,24 @@ func (node *ClusterNode) startNetworking() <-chan error {
     // since sitesEndpoint sets up a PrefixPath route for /sites/
     // which is a prefix the merkleSyncEndpoints share.
     merkleSyncEndpoint.Attach(router)    
+
+    // Note: Must be attached before sitesEndpoint for the same reason
+    if node.siteHistory != nil {
+        historyEndpoint := &HistoryEndpoint{ ClusterFacade: &ClusterNodeFacade{ node: node } }
+        historyEndpoint.Attach(router)
+    }
+
+    // Note: Must be attached before sitesEndpoint for the same reason
+    if node.siteAlerts != nil {
+        alertsEndpoint := &AlertsEndpoint{ ClusterFacade: &ClusterNodeFacade{ node: node } }
+        alertsEndpoint.Attach(router)
+    }
+
+    if node.webhookDispatcher != nil {
+        webhooksEndpoint := &WebhooksEndpoint{ ClusterFacade: &ClusterNodeFacade{ node: node } }
+        webhooksEndpoint.Attach(router)
+    }
+
     sitesEndpoint.Attach(router)
     syncEndpoint.Attach(router)
     logDumEndpoint.Attach(router)
@@ -796,6 +892,93 @@ func (node *ClusterNode) GetMatches(ctx context.Context, partitionNumber uint64,
     return bucket.GetMatches(keys)
 }
 
+// Watch streams updates to the matching keys in the local replica of a site
+// bucket into ch. Serials are local versions of this replica's store so they
+// are only meaningful when resuming a watch against the same node
+func (node *ClusterNode) Watch(ctx context.Context, partitionNumber uint64, siteID string, bucketName string, keys [][]byte, prefixes [][]byte, lastSerial uint64, ch chan Row) error {
+    partition := node.partitionPool.Get(partitionNumber)
+
+    if partition == nil {
+        return ENoSuchPartition
+    }
+
+    site := partition.Sites().Acquire(siteID)
+
+    if site == nil {
+        return ENoSuchSite
+    }
+
+    bucket := site.Buckets().Get(bucketName)
+
+    if bucket == nil {
+        return ENoSuchBucket
+    }
+
+    go bucket.Watch(ctx, keys, prefixes, lastSerial, ch)
+
+    return nil
+}
+
+// watchReplica finds a replica of the site's partition to serve a watch. The
+// preferred replica is tried first so that a client can resume from its last
+// serial. Any other replica has its own serials so its stream starts over from
+// the beginning. It returns the ID of the node serving the watch
+func (node *ClusterNode) watchReplica(ctx context.Context, siteID string, bucketName string, keys [][]byte, prefixes [][]byte, replica uint64, lastSerial uint64, ch chan Row) (uint64, error) {
+    if !node.configController.ClusterController().SiteExists(siteID) {
+        return 0, ENoSuchSite
+    }
+
+    partitionNumber := node.configController.ClusterController().Partition(siteID)
+    owners := node.configController.ClusterController().PartitionOwners(partitionNumber)
+    candidates := make([]uint64, 0, len(owners))
+
+    // Prefer the replica the client was watching before and then the
+    // local node so the stream does not need to be proxied
+    rank := func(nodeID uint64) int {
+        switch nodeID {
+        case replica:
+            return 0
+        case node.ID():
+            return 1
+        default:
+            return 2
+        }
+    }
+
+    for r := 0; r < 3; r++ {
+        for _, nodeID := range owners {
+            if rank(nodeID) == r {
+                candidates = append(candidates, nodeID)
+            }
+        }
+    }
+
+    var err error = ENoQuorum
+
+    for _, nodeID := range candidates {
+        var serial uint64
+
+        if nodeID == replica {
+            serial = lastSerial
+        }
+
+        err = node.nodeClient.Watch(ctx, nodeID, partitionNumber, siteID, bucketName, keys, prefixes, serial, ch)
+
+        switch err {
+        case nil:
+            return nodeID, nil
+        case EBucketDoesNotExist:
+            return 0, ENoSuchBucket
+        case ESiteDoesNotExist:
+            return 0, ENoSuchSite
+        }
+
+        Log.Warningf("Unable to watch site %s bucket %s at node %d: %v", siteID, bucketName, nodeID, err)
+    }
+
+    return 0, err
+}
+
 func (node *ClusterNode) AcceptRelayConnection(conn *websocket.Conn, header http.Header) {
     node.relayConnectionsMu.Lock()
     defer node.relayConnectionsMu.Unlock()
@@ -932,6 +1115,584 @@ func (node *ClusterNode) DisconnectRelayByPartition(partitionNumber uint64) {
     node.hub.ReconnectPeerByPartition(partitionNumber)
 }
 
+// checkStaleRelays periodically raises the stale relay alert for relays
+// that have not reported in staleAfter milliseconds. A relay that is
+// connected to any node in the cluster counts as reporting. Each owner
+// of a site's partition keeps the reports of the site's relays but only
+// one of them checks the site so the alert is raised once
+func (node *ClusterNode) checkStaleRelays(staleAfter uint64) {
+    for {
+        select {
+        case <-node.shutdown:
+            return
+        case <-time.After(time.Millisecond * time.Duration(staleAfter / 2)):
+        }
+
+        now := uint64(time.Now().UnixNano()) / 1000000
+        clusterController := node.configController.ClusterController()
+        reachable := make(map[uint64]bool)
+
+        for _, report := range node.siteAlerts.StaleRelays(now, staleAfter) {
+            partitionNumber := clusterController.Partition(report.SiteID)
+            siteID := report.SiteID
+
+            keepsRelayAlerts := func(owner uint64) bool {
+                ctx, cancel := context.WithTimeout(context.Background(), time.Second * RelayAlertsTimeout)
+                defer cancel()
+
+                _, err := node.nodeClient.RelayAlerts(ctx, owner, siteID, []string{ STALE_RELAY_ALERT_LEVEL })
+
+                return err == nil
+            }
+
+            if !clusterController.LocalNodeHoldsPartition(partitionNumber) || !node.leadsPartition(clusterController.PartitionOwners(partitionNumber), reachable, keepsRelayAlerts) {
+                continue
+            }
+
+            op := RelayAlertsOp{ Op: RelayAlertsMarkStale, Timestamp: now }
+
+            if clusterController.RelaySite(report.RelayID) != report.SiteID {
+                // The relay was removed or moved to another site
+                op.Op = RelayAlertsForget
+            } else {
+                ctx, cancel := context.WithTimeout(context.Background(), time.Second * RelayStatusTimeout)
+                status, err := node.clusterioAgent.RelayStatus(ctx, report.SiteID, report.RelayID)
+                cancel()
+
+                if err == nil && status.Connected {
+                    op.Op = RelayAlertsTouch
+                } else {
+                    Log.Warningf("Relay %s in site %s has not reported since %d", report.RelayID, report.SiteID, report.LastReport)
+                }
+            }
+
+            if err := node.applyRelayAlerts(report.SiteID, report.RelayID, op); err != nil {
+                Log.Errorf("Unable to update the alert state of relay %s in site %s: %v", report.RelayID, report.SiteID, err.Error())
+            }
+        }
+    }
+}
+
+// dispatchWebhooks periodically subscribes the webhook dispatcher to the
+// site buckets that webhooks are interested in. Each site is delivered by
+// the first owner of its partition only, and only while that node holds
+// the partition, so an update is not delivered once per replica
+func (node *ClusterNode) dispatchWebhooks() {
+    knownWebhooks := make(map[string]bool)
+
+    for {
+        clusterController := node.configController.ClusterController()
+        clusterWebhooks := clusterController.Webhooks()
+        subscriptions := make([]webhooks.Subscription, 0)
+        reachable := make(map[uint64]bool)
+        var allSites []string
+
+        for webhookID, webhook := range clusterWebhooks {
+            siteIDs := []string{ webhook.SiteID }
+
+            if webhook.SiteID == "" {
+                if allSites == nil {
+                    allSites = clusterController.Sites()
+                }
+
+                siteIDs = allSites
+            }
+
+            for _, siteID := range siteIDs {
+                partitionNumber := clusterController.Partition(siteID)
+                owners := clusterController.PartitionOwners(partitionNumber)
+
+                if !clusterController.LocalNodeHoldsPartition(partitionNumber) || !node.deliversWebhooks(owners, webhookID, reachable) {
+                    continue
+                }
+
+                partition := node.partitionPool.Get(partitionNumber)
+
+                if partition == nil {
+                    continue
+                }
+
+                site := partition.Sites().Acquire(siteID)
+
+                if site == nil {
+                    continue
+                }
+
+                bucket := site.Buckets().Get(webhook.Bucket)
+
+                if bucket == nil {
+                    continue
+                }
+
+                subscriptions = append(subscriptions, webhooks.Subscription{
+                    WebhookID: webhookID,
+                    Webhook: webhook,
+                    SiteID: siteID,
+                    Bucket: bucket,
+                })
+            }
+        }
+
+        node.webhookDispatcher.Reconcile(subscriptions)
+
+        for webhookID, _ := range knownWebhooks {
+            if _, ok := clusterWebhooks[webhookID]; !ok {
+                if err := node.webhookDispatcher.Forget(webhookID); err != nil {
+                    Log.Errorf("Unable to forget the delivery state of webhook %s: %v", webhookID, err.Error())
+
+                    continue
+                }
+
+                delete(knownWebhooks, webhookID)
+            }
+        }
+
+        for webhookID, _ := range clusterWebhooks {
+            knownWebhooks[webhookID] = true
+        }
+
+        select {
+        case <-node.shutdown:
+            node.webhookDispatcher.Stop()
+
+            return
+        case <-time.After(time.Second * WebhookReconcileInterval):
+        }
+    }
+}
+
+// deliversWebhooks decides whether this node delivers the webhooks of a
+// partition. Owners that don't deliver webhooks are passed over
+func (node *ClusterNode) deliversWebhooks(owners []uint64, webhookID string, reachable map[uint64]bool) bool {
+    return node.leadsPartition(owners, reachable, func(owner uint64) bool {
+        ctx, cancel := context.WithTimeout(context.Background(), time.Second * WebhookStatusTimeout)
+        defer cancel()
+
+        _, err := node.nodeClient.WebhookStatus(ctx, owner, webhookID)
+
+        // A node that doesn't know the webhook yet is still catching up
+        // with the cluster state and will deliver it soon
+        return err == nil || err == EWebhookDoesNotExist
+    })
+}
+
+// leadsPartition decides whether this node does the work in a partition
+// that only one of its owners should do. The first owner that is alive
+// does it. Normally that is the first owner but another owner takes over
+// while the ones before it are down. alive asks another owner whether it
+// can do the work and reachable caches its answers for one round
+func (node *ClusterNode) leadsPartition(owners []uint64, reachable map[uint64]bool, alive func(owner uint64) bool) bool {
+    for _, owner := range owners {
+        if owner == node.ID() {
+            return true
+        }
+
+        if _, ok := reachable[owner]; !ok {
+            reachable[owner] = alive(owner)
+        }
+
+        if reachable[owner] {
+            return false
+        }
+    }
+
+    return false
+}
+
+func (node *ClusterNode) WebhookStatus(webhookID string) (webhooks.Status, error) {
+    if _, ok := node.configController.ClusterController().Webhooks()[webhookID]; !ok {
+        return webhooks.Status{}, EWebhookDoesNotExist
+    }
+
+    if node.webhookDispatcher == nil {
+        return webhooks.Status{ DeadLetters: []webhooks.DeadLetter{ } }, nil
+    }
+
+    return node.webhookDispatcher.Status(webhookID)
+}
+
+func (node *ClusterNode) ApplyRelayAlerts(siteID string, relayID string, op RelayAlertsOp) error {
+    if node.siteAlerts == nil {
+        return EStorage
+    }
+
+    switch op.Op {
+    case RelayAlertsUpdate:
+        return node.siteAlerts.UpdateAlerts(siteID, relayID, op.Alerts, op.Timestamp)
+    case RelayAlertsTouch:
+        return node.siteAlerts.Touch(siteID, relayID, op.Timestamp)
+    case RelayAlertsMarkStale:
+        return node.siteAlerts.MarkStale(siteID, relayID, op.Timestamp)
+    case RelayAlertsForget:
+        return node.siteAlerts.ForgetRelay(siteID, relayID)
+    }
+
+    return EInvalidOp
+}
+
+func (node *ClusterNode) RelayAlerts(siteID string, levels []string) ([]RelayAlert, error) {
+    if node.siteAlerts == nil {
+        return nil, EStorage
+    }
+
+    return node.siteAlerts.Alerts(siteID, levels)
+}
+
+func (node *ClusterNode) RelayAlertStates(siteID string) ([]RelayAlert, error) {
+    if node.siteAlerts == nil {
+        return nil, EStorage
+    }
+
+    return node.siteAlerts.AlertStates(siteID)
+}
+
+func (node *ClusterNode) LogRelayEvents(siteID string, relayID string, events []*Event) error {
+    if node.siteHistory == nil {
+        return EStorage
+    }
+
+    // The owners of a site's partition keep both the history and the
+    // alert state of its relays so the report is recorded here too
+    if node.siteAlerts != nil {
+        node.siteAlerts.Touch(siteID, relayID, uint64(time.Now().UnixNano()) / 1000000)
+    }
+
+    return node.siteHistory.LogEvents(siteID, relayID, events)
+}
+
+func (node *ClusterNode) QueryRelayEvents(siteID string, relayID string, query *HistoryQuery) (*EventIterator, error) {
+    if node.siteHistory == nil {
+        return nil, EStorage
+    }
+
+    return node.siteHistory.Historian(siteID, relayID).Query(query)
+}
+
+func (node *ClusterNode) AggregateRelayEvents(siteID string, relayID string, query *AggregationQuery) ([]*AggregateBucket, error) {
+    if node.siteHistory == nil {
+        return nil, EStorage
+    }
+
+    return node.siteHistory.Historian(siteID, relayID).Aggregate(query)
+}
+
+func (node *ClusterNode) SiteHistoryRetention(siteID string) (HistoryRetention, error) {
+    if node.siteHistory == nil {
+        return HistoryRetention{ }, EStorage
+    }
+
+    return node.siteHistory.Retention(siteID), nil
+}
+
+func (node *ClusterNode) SetSiteHistoryRetention(siteID string, retention HistoryRetention) error {
+    if node.siteHistory == nil {
+        return EStorage
+    }
+
+    return node.siteHistory.SetRetention(siteID, retention)
+}
+
+// siteOwners returns the owners of a site's partition. They keep the
+// history and the alert state of the site's relays
+func (node *ClusterNode) siteOwners(siteID string) []uint64 {
+    clusterController := node.configController.ClusterController()
+
+    return clusterController.PartitionOwners(clusterController.Partition(siteID))
+}
+
+// logRelayEvents logs events from a relay at each owner of its site's
+// partition. It succeeds once a majority of the owners have logged them.
+// The events are given UUIDs first so that each owner keeps the same
+// events and a relay that retries does not log them twice
+func (node *ClusterNode) logRelayEvents(siteID string, relayID string, events []*Event) error {
+    for _, event := range events {
+        if event.UUID != "" {
+            continue
+        }
+
+        uuid, err := UUID()
+
+        if err != nil {
+            return err
+        }
+
+        event.UUID = uuid
+    }
+
+    owners := node.siteOwners(siteID)
+    nLogged := 0
+
+    for _, owner := range owners {
+        ctx, cancel := context.WithTimeout(context.Background(), time.Second * RelayHistoryTimeout)
+        err := node.nodeClient.LogRelayEvents(ctx, owner, siteID, relayID, events)
+        cancel()
+
+        if err != nil {
+            Log.Warningf("Unable to log events from relay %s at node %d: %v", relayID, owner, err)
+
+            continue
+        }
+
+        nLogged++
+    }
+
+    if nLogged < len(owners) / 2 + 1 {
+        return ENoQuorum
+    }
+
+    return nil
+}
+
+// queryRelayEvents queries the history of a relay kept by a majority of
+// the owners of its site's partition. Each batch that was logged is kept
+// by at least one of them so the events they return are merged
+func (node *ClusterNode) queryRelayEvents(ctx context.Context, siteID string, relayID string, query *HistoryQuery) (RelayEventIterator, error) {
+    owners := node.siteOwners(siteID)
+    streams := make([]EventStream, 0, len(owners) / 2 + 1)
+
+    for _, owner := range owners {
+        if len(streams) == len(owners) / 2 + 1 {
+            break
+        }
+
+        eventIterator, err := node.nodeClient.QueryRelayEvents(ctx, owner, siteID, relayID, query)
+
+        if err != nil {
+            Log.Warningf("Unable to query the history of relay %s at node %d: %v", relayID, owner, err)
+
+            continue
+        }
+
+        streams = append(streams, eventIterator)
+    }
+
+    if len(streams) < len(owners) / 2 + 1 {
+        for _, stream := range streams {
+            stream.Release()
+        }
+
+        return nil, ENoQuorum
+    }
+
+    return NewMergedEventIterator(query, streams), nil
+}
+
+// aggregateRelayEvents summarizes the history of a relay kept by a
+// majority of the owners of its site's partition. The owners may each be
+// missing some events so the merged events are summarized here
+func (node *ClusterNode) aggregateRelayEvents(siteID string, relayID string, query *AggregationQuery) ([]*AggregateBucket, error) {
+    if query.Interval == 0 {
+        return nil, ERequestQuery
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), time.Second * RelayHistoryTimeout)
+    defer cancel()
+
+    historyQuery := query.HistoryQuery
+    historyQuery.Limit = 0
+
+    eventIterator, err := node.queryRelayEvents(ctx, siteID, relayID, &historyQuery)
+
+    if err != nil {
+        return nil, err
+    }
+
+    defer eventIterator.Release()
+
+    return AggregateEvents(query, eventIterator)
+}
+
+// siteHistoryRetention reads the history retention of a site from a
+// majority of the owners of its partition and returns the newest setting
+func (node *ClusterNode) siteHistoryRetention(siteID string) (HistoryRetention, error) {
+    owners := node.siteOwners(siteID)
+    nRead := 0
+    var newest HistoryRetention
+
+    for _, owner := range owners {
+        if nRead == len(owners) / 2 + 1 {
+            break
+        }
+
+        ctx, cancel := context.WithTimeout(context.Background(), time.Second * RelayHistoryTimeout)
+        retention, err := node.nodeClient.SiteHistoryRetention(ctx, owner, siteID)
+        cancel()
+
+        if err != nil {
+            Log.Warningf("Unable to get the history retention of site %s from node %d: %v", siteID, owner, err)
+
+            continue
+        }
+
+        if nRead == 0 || retention.Updated > newest.Updated {
+            newest = retention
+        }
+
+        nRead++
+    }
+
+    if nRead < len(owners) / 2 + 1 {
+        return HistoryRetention{ }, ENoQuorum
+    }
+
+    return newest, nil
+}
+
+// setSiteHistoryRetention sets the history retention of a site at each
+// owner of its partition. It succeeds once a majority of the owners
+// have applied it
+func (node *ClusterNode) setSiteHistoryRetention(siteID string, retention HistoryRetention) error {
+    retention.Updated = uint64(time.Now().UnixNano()) / 1000000
+    owners := node.siteOwners(siteID)
+    nApplied := 0
+
+    for _, owner := range owners {
+        ctx, cancel := context.WithTimeout(context.Background(), time.Second * RelayHistoryTimeout)
+        err := node.nodeClient.SetSiteHistoryRetention(ctx, owner, siteID, retention)
+        cancel()
+
+        if err != nil {
+            Log.Warningf("Unable to set the history retention of site %s at node %d: %v", siteID, owner, err)
+
+            continue
+        }
+
+        nApplied++
+    }
+
+    if nApplied < len(owners) / 2 + 1 {
+        return ENoQuorum
+    }
+
+    return nil
+}
+
+// applyRelayAlerts applies a change to the alert state of a relay at
+// each owner of its site's partition. It succeeds once a majority of
+// the owners have applied it
+func (node *ClusterNode) applyRelayAlerts(siteID string, relayID string, op RelayAlertsOp) error {
+    owners := node.siteOwners(siteID)
+    nApplied := 0
+
+    for _, owner := range owners {
+        ctx, cancel := context.WithTimeout(context.Background(), time.Second * RelayAlertsTimeout)
+        err := node.nodeClient.ApplyRelayAlerts(ctx, owner, siteID, relayID, op)
+        cancel()
+
+        if err != nil {
+            Log.Warningf("Unable to apply alerts operation %s for relay %s at node %d: %v", op.Op, relayID, owner, err)
+
+            continue
+        }
+
+        nApplied++
+    }
+
+    if nApplied < len(owners) / 2 + 1 {
+        return ENoQuorum
+    }
+
+    return nil
+}
+
+// relayAlerts reads the firing alerts of the relays in a site, or in
+// every site if siteID is empty. The alert state of a site is read from a
+// majority of the owners of its partition. Each change was applied by at
+// least one of them so the most recent state of each alert is kept
+func (node *ClusterNode) relayAlerts(siteID string, levels []string) ([]RelayAlert, error) {
+    clusterController := node.configController.ClusterController()
+
+    if siteID != "" {
+        owners := node.siteOwners(siteID)
+        states := make([][]RelayAlert, 0, len(owners) / 2 + 1)
+
+        for _, owner := range owners {
+            if len(states) == len(owners) / 2 + 1 {
+                break
+            }
+
+            ctx, cancel := context.WithTimeout(context.Background(), time.Second * RelayAlertsTimeout)
+            alerts, err := node.nodeClient.RelayAlertStates(ctx, owner, siteID)
+            cancel()
+
+            if err != nil {
+                Log.Warningf("Unable to get the alerts of site %s from node %d: %v", siteID, owner, err)
+
+                continue
+            }
+
+            states = append(states, alerts)
+        }
+
+        if len(states) < len(owners) / 2 + 1 {
+            return nil, ENoQuorum
+        }
+
+        return FiringRelayAlerts(node.currentRelayAlerts(MergeRelayAlertStates(states...)), levels), nil
+    }
+
+    // The alert states kept by each node that answers by site
+    nodeStates := make(map[uint64]map[string][]RelayAlert)
+
+    for _, nodeConfig := range clusterController.ClusterNodeConfigs() {
+        ctx, cancel := context.WithTimeout(context.Background(), time.Second * RelayAlertsTimeout)
+        alerts, err := node.nodeClient.RelayAlertStates(ctx, nodeConfig.Address.NodeID, "")
+        cancel()
+
+        if err != nil {
+            Log.Warningf("Unable to get the alerts kept by node %d: %v", nodeConfig.Address.NodeID, err)
+
+            continue
+        }
+
+        siteStates := make(map[string][]RelayAlert)
+
+        for _, relayAlert := range alerts {
+            siteStates[relayAlert.SiteID] = append(siteStates[relayAlert.SiteID], relayAlert)
+        }
+
+        nodeStates[nodeConfig.Address.NodeID] = siteStates
+    }
+
+    var states [][]RelayAlert
+
+    for _, site := range clusterController.Sites() {
+        owners := clusterController.PartitionOwners(clusterController.Partition(site))
+        nRead := 0
+
+        for _, owner := range owners {
+            if siteStates, ok := nodeStates[owner]; ok {
+                states = append(states, siteStates[site])
+                nRead++
+            }
+        }
+
+        if len(owners) != 0 && nRead < len(owners) / 2 + 1 {
+            Log.Warningf("Unable to get the alerts of site %s from a majority of the owners of its partition", site)
+
+            return nil, ENoQuorum
+        }
+    }
+
+    return FiringRelayAlerts(node.currentRelayAlerts(MergeRelayAlertStates(states...)), levels), nil
+}
+
+// currentRelayAlerts leaves out the alerts of relays that are no longer
+// in the site they were raised in. An owner that missed the change that
+// forgot them may still have them
+func (node *ClusterNode) currentRelayAlerts(alerts []RelayAlert) []RelayAlert {
+    clusterController := node.configController.ClusterController()
+    current := make([]RelayAlert, 0, len(alerts))
+
+    for _, relayAlert := range alerts {
+        if clusterController.RelaySite(relayAlert.RelayID) == relayAlert.SiteID {
+            current = append(current, relayAlert)
+        }
+    }
+
+    return current
+}
+
 func (node *ClusterNode) ClusterIO() clusterio.ClusterIOAgent {
     return node.clusterioAgent
 }
@@ -951,10 +1712,128 @@ func (node *ClusterNode) RelayStatus(relayID string) (RelayStatus, error) {
     status.Ping = ping
     status.ConnectedTo = node.ID()
     status.Site = node.configController.ClusterController().RelaySite(relayID)
+    status.PushQueueDepth, status.OldestUnacknowledgedPush = node.hub.PushQueueStats(relayID)
+    status.Sync = make(map[string]RelayBucketSync)
+
+    for bucket, bucketStats := range node.hub.PeerSyncStats(relayID) {
+        if len(bucketStats.Sessions) == 0 {
+            continue
+        }
+
+        lastSession := bucketStats.Sessions[0]
+
+        status.Sync[bucket] = RelayBucketSync{
+            LastSessionStart: lastSession.Start,
+            LastSessionEnd: lastSession.End,
+            Outcome: lastSession.Outcome,
+            AbortReason: lastSession.AbortReason,
+            NodesExplored: lastSession.NodesExplored,
+            KeysPushed: lastSession.KeysPushed,
+            KeysPulled: lastSession.KeysPulled,
+            BytesSent: lastSession.BytesSent,
+            BytesReceived: lastSession.BytesReceived,
+            LastRootMatch: bucketStats.LastRootMatch,
+        }
+    }
 
     return status, nil
 }
 
+func (node *ClusterNode) RelaySubscription(relayID string) (map[string][]string, error) {
+    _, relayAdded := node.configController.ClusterController().State.Relays[relayID]
+
+    if !relayAdded {
+        return nil, ENoSuchRelay
+    }
+
+    return node.configController.ClusterController().RelaySubscription(relayID), nil
+}
+
+func (node *ClusterNode) SiteRoster(siteID string) SiteRoster {
+    return NewSiteRoster(siteID, node.configController.ClusterController().SiteRelays(siteID))
+}
+
+func (node *ClusterNode) AdvertiseRelayAddress(relayID string, address string) {
+    if node.configController.ClusterController().RelayAddress(relayID) == address {
+        return
+    }
+
+    // Called while handling the relay's connection so the proposal can't
+    // hold it up
+    go func() {
+        if err := node.configController.ClusterCommand(context.Background(), ClusterSetRelayAddressBody{ RelayID: relayID, Address: address }); err != nil {
+            Log.Warningf("Local node (id = %d) unable to record address %s for relay %s: %v", node.ID(), address, relayID, err.Error())
+        }
+    }()
+}
+
+// ExportBundle builds an offline sync bundle from this cluster's replica of
+// a site bucket for the peer described by request
+func (node *ClusterNode) ExportBundle(siteID string, bucketName string, request ExportRequest) (*Bundle, error) {
+    if !node.configController.ClusterController().SiteExists(siteID) {
+        return nil, ENoSuchSite
+    }
+
+    if !node.bucketProxyFactory.OutgoingBuckets(request.Peer)[bucketName] {
+        return nil, ENoSuchBucket
+    }
+
+    bucketProxy, err := node.bucketProxyFactory.CreateSiteBucketProxy(siteID, bucketName)
+
+    if err != nil {
+        return nil, err
+    }
+
+    defer bucketProxy.Close()
+
+    merkleTree := bucketProxy.MerkleTree()
+
+    if merkleTree.Error() != nil {
+        return nil, merkleTree.Error()
+    }
+
+    iter, err := bucketProxy.GetSyncChildren(merkleTree.RootNode())
+
+    if err != nil {
+        return nil, err
+    }
+
+    return NewBundle(CLOUD_PEER_ID, siteID, bucketName, iter, request.Summary)
+}
+
+// ImportBundle merges an offline sync bundle into a site bucket through the
+// cluster io agent just as sync sessions with relays do
+func (node *ClusterNode) ImportBundle(siteID string, bucketName string, bundle *Bundle) (BatchResult, error) {
+    // Relays do not know their site so a relay's bundle must be imported into
+    // the site the relay currently belongs to
+    if bundle.Source != CLOUD_PEER_ID && node.configController.ClusterController().RelaySite(bundle.Source) != siteID {
+        return BatchResult{}, EUnauthorized
+    }
+
+    if !node.bucketProxyFactory.IncomingBuckets(bundle.Source)[bucketName] {
+        return BatchResult{}, ENoSuchBucket
+    }
+
+    if len(bundle.SiblingSets) == 0 {
+        return BatchResult{}, nil
+    }
+
+    replicas, nApplied, err := node.clusterioAgent.Merge(context.TODO(), siteID, bucketName, bundle.SiblingSets)
+
+    if err == ESiteDoesNotExist {
+        return BatchResult{}, ENoSuchSite
+    }
+
+    if err == EBucketDoesNotExist {
+        return BatchResult{}, ENoSuchBucket
+    }
+
+    return BatchResult{
+        Replicas: uint64(replicas),
+        NApplied: uint64(nApplied),
+    }, err
+}
+
 func (node *ClusterNode) localSnapshot(snapshotIndex uint64, snapshotId string) error {
     return node.snapshotter.Snapshot(snapshotIndex, snapshotId)
 }
@@ -1056,6 +1935,14 @@ func (clusterFacade *ClusterNodeFacade) GetMatches(siteID string, bucket string,
     return iter, nil
 }
 
+func (clusterFacade *ClusterNodeFacade) Watch(ctx context.Context, siteID string, bucket string, keys [][]byte, prefixes [][]byte, replica uint64, lastSerial uint64, ch chan Row) (uint64, error) {
+    return clusterFacade.node.watchReplica(ctx, siteID, bucket, keys, prefixes, replica, lastSerial, ch)
+}
+
+func (clusterFacade *ClusterNodeFacade) LocalWatch(ctx context.Context, partitionNumber uint64, siteID string, bucketName string, keys [][]byte, prefixes [][]byte, lastSerial uint64, ch chan Row) error {
+    return clusterFacade.node.Watch(ctx, partitionNumber, siteID, bucketName, keys, prefixes, lastSerial, ch)
+}
+
 func (clusterFacade *ClusterNodeFacade) LocalGetMatches(partitionNumber uint64, siteID string, bucketName string, keys [][]byte) (SiblingSetIterator, error) {
     return clusterFacade.node.GetMatches(context.TODO(), partitionNumber, siteID, bucketName, keys)
 }
@@ -1072,6 +1959,14 @@ func (clusterFacade *ClusterNodeFacade) LocalMerge(partitionNumber uint64, siteI
     return clusterFacade.node.Merge(context.TODO(), partitionNumber, siteID, bucketName, patch, broadcastToRelays)
 }
 
+func (clusterFacade *ClusterNodeFacade) ExportBundle(siteID string, bucket string, request ExportRequest) (*Bundle, error) {
+    return clusterFacade.node.ExportBundle(siteID, bucket, request)
+}
+
+func (clusterFacade *ClusterNodeFacade) ImportBundle(siteID string, bucket string, bundle *Bundle) (BatchResult, error) {
+    return clusterFacade.node.ImportBundle(siteID, bucket, bundle)
+}
+
 func (clusterFacade *ClusterNodeFacade) AddRelay(ctx context.Context, relayID string) error {
     return clusterFacade.node.configController.ClusterCommand(ctx, ClusterAddRelayBody{ RelayID: relayID })
 }
@@ -1084,6 +1979,14 @@ func (clusterFacade *ClusterNodeFacade) MoveRelay(ctx context.Context, relayID s
     return clusterFacade.node.configController.ClusterCommand(ctx, ClusterMoveRelayBody{ RelayID: relayID, SiteID: siteID })
 }
 
+func (clusterFacade *ClusterNodeFacade) SetRelaySubscription(ctx context.Context, relayID string, subscription map[string][]string) error {
+    return clusterFacade.node.configController.ClusterCommand(ctx, ClusterSetRelaySubscriptionBody{ RelayID: relayID, Subscription: subscription })
+}
+
+func (clusterFacade *ClusterNodeFacade) GetRelaySubscription(relayID string) (map[string][]string, error) {
+    return clusterFacade.node.RelaySubscription(relayID)
+}
+
 func (clusterFacade *ClusterNodeFacade) AddSite(ctx context.Context, siteID string) error {
     return clusterFacade.node.configController.ClusterCommand(ctx, ClusterAddSiteBody{ SiteID: siteID })
 }
@@ -1232,4 +2135,145 @@ func (clusterFacade *ClusterNodeFacade) CheckLocalSnapshotStatus(snapshotId stri
 
 func (clusterFacade *ClusterNodeFacade) WriteLocalSnapshot(snapshotId string, w io.Writer) error {
     return clusterFacade.node.snapshotter.WriteSnapshot(snapshotId, w)
-}
\ No newline at end of file
+}
+
+func (clusterFacade *ClusterNodeFacade) LogRelayEvents(relayID string, events []*Event) error {
+    siteID := clusterFacade.node.configController.ClusterController().RelaySite(relayID)
+
+    if siteID == "" {
+        return ERelayDoesNotExist
+    }
+
+    return clusterFacade.node.logRelayEvents(siteID, relayID, events)
+}
+
+func (clusterFacade *ClusterNodeFacade) QueryRelayEvents(ctx context.Context, siteID string, relayID string, query *HistoryQuery) (RelayEventIterator, error) {
+    if !clusterFacade.node.configController.ClusterController().SiteExists(siteID) {
+        return nil, ESiteDoesNotExist
+    }
+
+    return clusterFacade.node.queryRelayEvents(ctx, siteID, relayID, query)
+}
+
+func (clusterFacade *ClusterNodeFacade) AggregateRelayEvents(siteID string, relayID string, query *AggregationQuery) ([]*AggregateBucket, error) {
+    if !clusterFacade.node.configController.ClusterController().SiteExists(siteID) {
+        return nil, ESiteDoesNotExist
+    }
+
+    return clusterFacade.node.aggregateRelayEvents(siteID, relayID, query)
+}
+
+func (clusterFacade *ClusterNodeFacade) SiteHistoryRetention(siteID string) (HistoryRetention, error) {
+    if !clusterFacade.node.configController.ClusterController().SiteExists(siteID) {
+        return HistoryRetention{ }, ESiteDoesNotExist
+    }
+
+    return clusterFacade.node.siteHistoryRetention(siteID)
+}
+
+func (clusterFacade *ClusterNodeFacade) SetSiteHistoryRetention(siteID string, retention HistoryRetention) error {
+    if !clusterFacade.node.configController.ClusterController().SiteExists(siteID) {
+        return ESiteDoesNotExist
+    }
+
+    return clusterFacade.node.setSiteHistoryRetention(siteID, retention)
+}
+
+func (clusterFacade *ClusterNodeFacade) LocalLogRelayEvents(siteID string, relayID string, events []*Event) error {
+    return clusterFacade.node.LogRelayEvents(siteID, relayID, events)
+}
+
+func (clusterFacade *ClusterNodeFacade) LocalQueryRelayEvents(siteID string, relayID string, query *HistoryQuery) (RelayEventIterator, error) {
+    eventIterator, err := clusterFacade.node.QueryRelayEvents(siteID, relayID, query)
+
+    if err != nil {
+        return nil, err
+    }
+
+    return eventIterator, nil
+}
+
+func (clusterFacade *ClusterNodeFacade) LocalAggregateRelayEvents(siteID string, relayID string, query *AggregationQuery) ([]*AggregateBucket, error) {
+    return clusterFacade.node.AggregateRelayEvents(siteID, relayID, query)
+}
+
+func (clusterFacade *ClusterNodeFacade) LocalSiteHistoryRetention(siteID string) (HistoryRetention, error) {
+    return clusterFacade.node.SiteHistoryRetention(siteID)
+}
+
+func (clusterFacade *ClusterNodeFacade) LocalSetSiteHistoryRetention(siteID string, retention HistoryRetention) error {
+    return clusterFacade.node.SetSiteHistoryRetention(siteID, retention)
+}
+
+func (clusterFacade *ClusterNodeFacade) LogRelayAlerts(relayID string, alerts []Alert) error {
+    siteID := clusterFacade.node.configController.ClusterController().RelaySite(relayID)
+
+    if siteID == "" {
+        return ERelayDoesNotExist
+    }
+
+    return clusterFacade.node.applyRelayAlerts(siteID, relayID, RelayAlertsOp{ Op: RelayAlertsUpdate, Alerts: alerts, Timestamp: uint64(time.Now().UnixNano()) / 1000000 })
+}
+
+func (clusterFacade *ClusterNodeFacade) SetWebhook(ctx context.Context, webhookID string, webhook *Webhook) error {
+    return clusterFacade.node.configController.ClusterCommand(ctx, ClusterSetWebhookBody{ WebhookID: webhookID, Webhook: webhook })
+}
+
+func (clusterFacade *ClusterNodeFacade) Webhooks() map[string]Webhook {
+    return clusterFacade.node.configController.ClusterController().Webhooks()
+}
+
+// WebhookStatus combines the delivery status of a webhook at every node
+// in the cluster. Nodes that cannot be reached are left out
+func (clusterFacade *ClusterNodeFacade) WebhookStatus(ctx context.Context, webhookID string) (webhooks.Status, error) {
+    if _, ok := clusterFacade.Webhooks()[webhookID]; !ok {
+        return webhooks.Status{}, EWebhookDoesNotExist
+    }
+
+    status := webhooks.Status{ DeadLetters: []webhooks.DeadLetter{ } }
+
+    for _, nodeConfig := range clusterFacade.ClusterNodes() {
+        nodeCtx, cancel := context.WithTimeout(ctx, time.Second * WebhookStatusTimeout)
+        nodeStatus, err := clusterFacade.node.nodeClient.WebhookStatus(nodeCtx, nodeConfig.Address.NodeID, webhookID)
+        cancel()
+
+        if err == EWebhookDoesNotExist {
+            return webhooks.Status{}, err
+        }
+
+        if err != nil {
+            Log.Warningf("Unable to get the status of webhook %s from node %d: %v", webhookID, nodeConfig.Address.NodeID, err)
+
+            continue
+        }
+
+        status.Metrics.Add(nodeStatus.Metrics)
+        status.DeadLetters = append(status.DeadLetters, nodeStatus.DeadLetters...)
+    }
+
+    return status, nil
+}
+
+func (clusterFacade *ClusterNodeFacade) LocalWebhookStatus(webhookID string) (webhooks.Status, error) {
+    return clusterFacade.node.WebhookStatus(webhookID)
+}
+
+func (clusterFacade *ClusterNodeFacade) RelayAlerts(siteID string, levels []string) ([]RelayAlert, error) {
+    if siteID != "" && !clusterFacade.node.configController.ClusterController().SiteExists(siteID) {
+        return nil, ESiteDoesNotExist
+    }
+
+    return clusterFacade.node.relayAlerts(siteID, levels)
+}
+
+func (clusterFacade *ClusterNodeFacade) LocalApplyRelayAlerts(siteID string, relayID string, op RelayAlertsOp) error {
+    return clusterFacade.node.ApplyRelayAlerts(siteID, relayID, op)
+}
+
+func (clusterFacade *ClusterNodeFacade) LocalRelayAlerts(siteID string, levels []string) ([]RelayAlert, error) {
+    return clusterFacade.node.RelayAlerts(siteID, levels)
+}
+
+func (clusterFacade *ClusterNodeFacade) LocalRelayAlertStates(siteID string) ([]RelayAlert, error) {
+    return clusterFacade.node.RelayAlertStates(siteID)
+}
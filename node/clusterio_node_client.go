@@ -25,23 +25,32 @@ package node
 
 
 import (
+    "bufio"
     "bytes"
     "context"
     "encoding/json"
     "fmt"
+    "io"
     "io/ioutil"
     "net/http"
     "net/url"
+    "strings"
 
+    . "github.com/armPelionEdge/devicedb/alerts"
     . "github.com/armPelionEdge/devicedb/bucket"
     . "github.com/armPelionEdge/devicedb/cluster"
     . "github.com/armPelionEdge/devicedb/data"
     . "github.com/armPelionEdge/devicedb/error"
+    . "github.com/armPelionEdge/devicedb/historian"
     . "github.com/armPelionEdge/devicedb/logging"
     . "github.com/armPelionEdge/devicedb/raft"
     . "github.com/armPelionEdge/devicedb/routes"
+    "github.com/armPelionEdge/devicedb/webhooks"
 )
 
+// The largest encoded update that a watch stream from another node may contain
+const MaxWatchUpdateSize = 32 * 1024 * 1024
+
 type NodeClient struct {
     configController ClusterConfigController
     localNode Node
@@ -328,6 +337,106 @@ func (nodeClient *NodeClient) GetMatches(ctx context.Context, nodeID uint64, par
     return newInternalEntrySiblingSetIterator(entries), nil
 }
 
+// Watch starts streaming updates from a node's replica of a site bucket into ch.
+// It returns once the watch has been established. ch is closed when the stream
+// ends, either because ctx was cancelled or because the node went away
+func (nodeClient *NodeClient) Watch(ctx context.Context, nodeID uint64, partition uint64, siteID string, bucket string, keys [][]byte, prefixes [][]byte, lastSerial uint64, ch chan Row) error {
+    var nodeAddress PeerAddress = nodeClient.configController.ClusterController().ClusterMemberAddress(nodeID)
+
+    if nodeAddress.IsEmpty() {
+        return ENoSuchNode
+    }
+
+    if nodeID == nodeClient.localNode.ID() {
+        err := nodeClient.localNode.Watch(ctx, partition, siteID, bucket, keys, prefixes, lastSerial, ch)
+
+        switch err {
+        case ENoSuchBucket:
+            return EBucketDoesNotExist
+        case ENoSuchSite:
+            return ESiteDoesNotExist
+        default:
+            return err
+        }
+    }
+
+    var query url.Values = url.Values{}
+
+    for _, key := range keys {
+        query.Add("key", string(key))
+    }
+
+    for _, prefix := range prefixes {
+        query.Add("prefix", string(prefix))
+    }
+
+    query.Set("lastSerial", fmt.Sprintf("%d", lastSerial))
+
+    request, err := http.NewRequest("GET", fmt.Sprintf("http://%s:%d/partitions/%d/sites/%s/buckets/%s/watch?%s", nodeAddress.Host, nodeAddress.Port, partition, siteID, bucket, query.Encode()), nil)
+
+    if err != nil {
+        return err
+    }
+
+    resp, err := nodeClient.httpClient.Do(request.WithContext(ctx))
+
+    if err != nil {
+        return err
+    }
+
+    switch resp.StatusCode {
+    case 404:
+        defer resp.Body.Close()
+
+        body, err := ioutil.ReadAll(resp.Body)
+
+        if err != nil {
+            return err
+        }
+
+        dbErr, err := DBErrorFromJSON(body)
+
+        if err != nil {
+            return err
+        }
+
+        return dbErr
+    case 200:
+    default:
+        resp.Body.Close()
+
+        Log.Warningf("Watch request to node %d for partition %d at site %s and bucket %s received a %d status code", nodeID, partition, siteID, bucket, resp.StatusCode)
+
+        return EStorage
+    }
+
+    go func() {
+        defer close(ch)
+        defer resp.Body.Close()
+
+        scanner := bufio.NewScanner(resp.Body)
+        scanner.Buffer(nil, MaxWatchUpdateSize)
+
+        for scanner.Scan() {
+            if !strings.HasPrefix(scanner.Text(), "data: ") {
+                continue
+            }
+
+            var row Row
+
+            if err := json.Unmarshal([]byte(scanner.Text()[len("data: "):]), &row); err != nil {
+                Log.Warningf("Watch stream from node %d for partition %d at site %s and bucket %s sent an invalid update: %v", nodeID, partition, siteID, bucket, err)
+
+                return
+            }
+
+            ch <- row
+        }
+    }()
+
+    return nil
+}
+
 func (nodeClient *NodeClient) RelayStatus(ctx context.Context, nodeID uint64, siteID string, relayID string) (RelayStatus, error) {
     var nodeAddress PeerAddress = nodeClient.configController.ClusterController().ClusterMemberAddress(nodeID)
 
@@ -371,6 +480,322 @@ func (nodeClient *NodeClient) RelayStatus(ctx context.Context, nodeID uint64, si
     return relayStatus, nil
 }
 
+func (nodeClient *NodeClient) WebhookStatus(ctx context.Context, nodeID uint64, webhookID string) (webhooks.Status, error) {
+    var nodeAddress PeerAddress = nodeClient.configController.ClusterController().ClusterMemberAddress(nodeID)
+
+    if nodeAddress.IsEmpty() {
+        return webhooks.Status{}, ENoSuchNode
+    }
+
+    if nodeID == nodeClient.localNode.ID() {
+        return nodeClient.localNode.WebhookStatus(webhookID)
+    }
+
+    status, body, err := nodeClient.sendRequest(ctx, "GET", fmt.Sprintf("http://%s:%d/webhooks/%s/status?local=true", nodeAddress.Host, nodeAddress.Port, url.PathEscape(webhookID)), nil)
+
+    if err != nil {
+        return webhooks.Status{}, err
+    }
+
+    switch status {
+    case 404:
+        // Nodes that do not deliver webhooks do not serve this endpoint
+        dbErr, err := DBErrorFromJSON(body)
+
+        if err == nil && dbErr == EWebhookDoesNotExist {
+            return webhooks.Status{}, EWebhookDoesNotExist
+        }
+
+        return webhooks.Status{}, EStorage
+    case 200:
+    default:
+        return webhooks.Status{}, EStorage
+    }
+
+    var webhookStatus webhooks.Status
+
+    err = json.Unmarshal(body, &webhookStatus)
+
+    if err != nil {
+        return webhooks.Status{}, err
+    }
+
+    return webhookStatus, nil
+}
+
+func (nodeClient *NodeClient) ApplyRelayAlerts(ctx context.Context, nodeID uint64, siteID string, relayID string, op RelayAlertsOp) error {
+    var nodeAddress PeerAddress = nodeClient.configController.ClusterController().ClusterMemberAddress(nodeID)
+
+    if nodeAddress.IsEmpty() {
+        return ENoSuchNode
+    }
+
+    if nodeID == nodeClient.localNode.ID() {
+        return nodeClient.localNode.ApplyRelayAlerts(siteID, relayID, op)
+    }
+
+    encodedOp, err := json.Marshal(op)
+
+    if err != nil {
+        return err
+    }
+
+    status, _, err := nodeClient.sendRequest(ctx, "POST", fmt.Sprintf("http://%s:%d/sites/%s/relays/%s/alerts", nodeAddress.Host, nodeAddress.Port, url.PathEscape(siteID), url.PathEscape(relayID)), encodedOp)
+
+    if err != nil {
+        return err
+    }
+
+    switch status {
+    case 200:
+        return nil
+    default:
+        // Nodes that do not keep relay alerts do not serve this endpoint
+        Log.Warningf("Alerts operation %s to node %d for relay %s at site %s received a %d status code", op.Op, nodeID, relayID, siteID, status)
+
+        return EStorage
+    }
+}
+
+func (nodeClient *NodeClient) RelayAlerts(ctx context.Context, nodeID uint64, siteID string, levels []string) ([]RelayAlert, error) {
+    var nodeAddress PeerAddress = nodeClient.configController.ClusterController().ClusterMemberAddress(nodeID)
+
+    if nodeAddress.IsEmpty() {
+        return nil, ENoSuchNode
+    }
+
+    if nodeID == nodeClient.localNode.ID() {
+        return nodeClient.localNode.RelayAlerts(siteID, levels)
+    }
+
+    return nodeClient.relayAlerts(ctx, nodeAddress, siteID, url.Values{ "local": []string{ "true" }, "level": levels })
+}
+
+// RelayAlertStates reads the state of every alert, including cleared
+// ones, of the relays in a site, or in every site if siteID is empty,
+// kept by a node
+func (nodeClient *NodeClient) RelayAlertStates(ctx context.Context, nodeID uint64, siteID string) ([]RelayAlert, error) {
+    var nodeAddress PeerAddress = nodeClient.configController.ClusterController().ClusterMemberAddress(nodeID)
+
+    if nodeAddress.IsEmpty() {
+        return nil, ENoSuchNode
+    }
+
+    if nodeID == nodeClient.localNode.ID() {
+        return nodeClient.localNode.RelayAlertStates(siteID)
+    }
+
+    return nodeClient.relayAlerts(ctx, nodeAddress, siteID, url.Values{ "local": []string{ "true" }, "cleared": []string{ "true" } })
+}
+
+func (nodeClient *NodeClient) relayAlerts(ctx context.Context, nodeAddress PeerAddress, siteID string, query url.Values) ([]RelayAlert, error) {
+    endpointURL := fmt.Sprintf("http://%s:%d/alerts?%s", nodeAddress.Host, nodeAddress.Port, query.Encode())
+
+    if siteID != "" {
+        endpointURL = fmt.Sprintf("http://%s:%d/sites/%s/alerts?%s", nodeAddress.Host, nodeAddress.Port, url.PathEscape(siteID), query.Encode())
+    }
+
+    status, body, err := nodeClient.sendRequest(ctx, "GET", endpointURL, nil)
+
+    if err != nil {
+        return nil, err
+    }
+
+    switch status {
+    case 200:
+    default:
+        return nil, EStorage
+    }
+
+    var alerts []RelayAlert
+
+    if err := json.Unmarshal(body, &alerts); err != nil {
+        return nil, err
+    }
+
+    return alerts, nil
+}
+
+func (nodeClient *NodeClient) LogRelayEvents(ctx context.Context, nodeID uint64, siteID string, relayID string, events []*Event) error {
+    var nodeAddress PeerAddress = nodeClient.configController.ClusterController().ClusterMemberAddress(nodeID)
+
+    if nodeAddress.IsEmpty() {
+        return ENoSuchNode
+    }
+
+    if nodeID == nodeClient.localNode.ID() {
+        return nodeClient.localNode.LogRelayEvents(siteID, relayID, events)
+    }
+
+    encodedEvents, err := json.Marshal(events)
+
+    if err != nil {
+        return err
+    }
+
+    status, _, err := nodeClient.sendRequest(ctx, "POST", fmt.Sprintf("http://%s:%d/sites/%s/relays/%s/events", nodeAddress.Host, nodeAddress.Port, url.PathEscape(siteID), url.PathEscape(relayID)), encodedEvents)
+
+    if err != nil {
+        return err
+    }
+
+    switch status {
+    case 200:
+        return nil
+    default:
+        // Nodes that do not keep relay history do not serve this endpoint
+        Log.Warningf("Log events request to node %d for relay %s at site %s received a %d status code", nodeID, relayID, siteID, status)
+
+        return EStorage
+    }
+}
+
+// QueryRelayEvents queries the history of a relay kept by a node. The
+// events are streamed from the node as the iterator is advanced so the
+// iterator must be released
+func (nodeClient *NodeClient) QueryRelayEvents(ctx context.Context, nodeID uint64, siteID string, relayID string, query *HistoryQuery) (RelayEventIterator, error) {
+    var nodeAddress PeerAddress = nodeClient.configController.ClusterController().ClusterMemberAddress(nodeID)
+
+    if nodeAddress.IsEmpty() {
+        return nil, ENoSuchNode
+    }
+
+    if nodeID == nodeClient.localNode.ID() {
+        eventIterator, err := nodeClient.localNode.QueryRelayEvents(siteID, relayID, query)
+
+        if err != nil {
+            return nil, err
+        }
+
+        return eventIterator, nil
+    }
+
+    encodedQuery := EncodeHistoryQuery(*query)
+    encodedQuery.Set("local", "true")
+
+    request, err := http.NewRequest("GET", fmt.Sprintf("http://%s:%d/sites/%s/relays/%s/events?%s", nodeAddress.Host, nodeAddress.Port, url.PathEscape(siteID), url.PathEscape(relayID), encodedQuery.Encode()), nil)
+
+    if err != nil {
+        return nil, err
+    }
+
+    resp, err := nodeClient.httpClient.Do(request.WithContext(ctx))
+
+    if err != nil {
+        return nil, err
+    }
+
+    if resp.StatusCode != 200 {
+        resp.Body.Close()
+
+        Log.Warningf("Query events request to node %d for relay %s at site %s received a %d status code", nodeID, relayID, siteID, resp.StatusCode)
+
+        return nil, EStorage
+    }
+
+    return newStreamedRelayEventIterator(resp.Body), nil
+}
+
+func (nodeClient *NodeClient) AggregateRelayEvents(ctx context.Context, nodeID uint64, siteID string, relayID string, query *AggregationQuery) ([]*AggregateBucket, error) {
+    var nodeAddress PeerAddress = nodeClient.configController.ClusterController().ClusterMemberAddress(nodeID)
+
+    if nodeAddress.IsEmpty() {
+        return nil, ENoSuchNode
+    }
+
+    if nodeID == nodeClient.localNode.ID() {
+        return nodeClient.localNode.AggregateRelayEvents(siteID, relayID, query)
+    }
+
+    encodedQuery := EncodeAggregationQuery(*query)
+    encodedQuery.Set("local", "true")
+
+    status, body, err := nodeClient.sendRequest(ctx, "GET", fmt.Sprintf("http://%s:%d/sites/%s/relays/%s/events/aggregate?%s", nodeAddress.Host, nodeAddress.Port, url.PathEscape(siteID), url.PathEscape(relayID), encodedQuery.Encode()), nil)
+
+    if err != nil {
+        return nil, err
+    }
+
+    switch status {
+    case 200:
+    default:
+        return nil, EStorage
+    }
+
+    var buckets []*AggregateBucket
+
+    if err := json.Unmarshal(body, &buckets); err != nil {
+        return nil, err
+    }
+
+    return buckets, nil
+}
+
+func (nodeClient *NodeClient) SiteHistoryRetention(ctx context.Context, nodeID uint64, siteID string) (HistoryRetention, error) {
+    var nodeAddress PeerAddress = nodeClient.configController.ClusterController().ClusterMemberAddress(nodeID)
+
+    if nodeAddress.IsEmpty() {
+        return HistoryRetention{ }, ENoSuchNode
+    }
+
+    if nodeID == nodeClient.localNode.ID() {
+        return nodeClient.localNode.SiteHistoryRetention(siteID)
+    }
+
+    status, body, err := nodeClient.sendRequest(ctx, "GET", fmt.Sprintf("http://%s:%d/sites/%s/history/retention?local=true", nodeAddress.Host, nodeAddress.Port, url.PathEscape(siteID)), nil)
+
+    if err != nil {
+        return HistoryRetention{ }, err
+    }
+
+    switch status {
+    case 200:
+    default:
+        return HistoryRetention{ }, EStorage
+    }
+
+    var retention HistoryRetention
+
+    if err := json.Unmarshal(body, &retention); err != nil {
+        return HistoryRetention{ }, err
+    }
+
+    return retention, nil
+}
+
+func (nodeClient *NodeClient) SetSiteHistoryRetention(ctx context.Context, nodeID uint64, siteID string, retention HistoryRetention) error {
+    var nodeAddress PeerAddress = nodeClient.configController.ClusterController().ClusterMemberAddress(nodeID)
+
+    if nodeAddress.IsEmpty() {
+        return ENoSuchNode
+    }
+
+    if nodeID == nodeClient.localNode.ID() {
+        return nodeClient.localNode.SetSiteHistoryRetention(siteID, retention)
+    }
+
+    encodedRetention, err := json.Marshal(retention)
+
+    if err != nil {
+        return err
+    }
+
+    status, _, err := nodeClient.sendRequest(ctx, "PUT", fmt.Sprintf("http://%s:%d/sites/%s/history/retention?local=true", nodeAddress.Host, nodeAddress.Port, url.PathEscape(siteID)), encodedRetention)
+
+    if err != nil {
+        return err
+    }
+
+    switch status {
+    case 200:
+        return nil
+    default:
+        Log.Warningf("Set history retention request to node %d for site %s received a %d status code", nodeID, siteID, status)
+
+        return EStorage
+    }
+}
+
 func (nodeClient *NodeClient) LocalNodeID() uint64 {
     return nodeClient.configController.ClusterController().LocalNodeID
 }
@@ -454,4 +879,59 @@ func (iter *internalEntrySiblingSetIterator) Release() {
 
 func (iter *internalEntrySiblingSetIterator) Error() error {
     return nil
-}
\ No newline at end of file
+}
+
+// streamedRelayEventIterator reads the events that another node writes
+// one per line in response to a history query
+type streamedRelayEventIterator struct {
+    body io.ReadCloser
+    scanner *bufio.Scanner
+    event *Event
+    err error
+}
+
+func newStreamedRelayEventIterator(body io.ReadCloser) *streamedRelayEventIterator {
+    scanner := bufio.NewScanner(body)
+    scanner.Buffer(nil, MaxWatchUpdateSize)
+
+    return &streamedRelayEventIterator{
+        body: body,
+        scanner: scanner,
+    }
+}
+
+func (iter *streamedRelayEventIterator) Next() bool {
+    iter.event = nil
+
+    if iter.err != nil || !iter.scanner.Scan() {
+        if iter.err == nil {
+            iter.err = iter.scanner.Err()
+        }
+
+        return false
+    }
+
+    var event Event
+
+    if err := json.Unmarshal(iter.scanner.Bytes(), &event); err != nil {
+        iter.err = err
+
+        return false
+    }
+
+    iter.event = &event
+
+    return true
+}
+
+func (iter *streamedRelayEventIterator) Event() *Event {
+    return iter.event
+}
+
+func (iter *streamedRelayEventIterator) Release() {
+    iter.body.Close()
+}
+
+func (iter *streamedRelayEventIterator) Error() error {
+    return iter.err
+}
@@ -34,13 +34,16 @@ import (
     "strconv"
     "time"
 
+    . "github.com/armPelionEdge/devicedb/alerts"
     . "github.com/armPelionEdge/devicedb/bucket"
     . "github.com/armPelionEdge/devicedb/cluster"
     . "github.com/armPelionEdge/devicedb/data"
     . "github.com/armPelionEdge/devicedb/error"
+    . "github.com/armPelionEdge/devicedb/historian"
     . "github.com/armPelionEdge/devicedb/node"
     . "github.com/armPelionEdge/devicedb/raft"
     . "github.com/armPelionEdge/devicedb/routes"
+    "github.com/armPelionEdge/devicedb/webhooks"
 
     . "github.com/onsi/ginkgo"
     . "github.com/onsi/gomega"
@@ -1184,4 +1187,372 @@ var _ = Describe("ClusterioNodeClient", func() {
             })
         })
     })
+
+    Describe("#Watch", func() {
+        Context("When the specified nodeID does not refer to a known node", func() {
+            It("Should return an error", func() {
+                Expect(client.Watch(context.TODO(), unknownNodeID, 50, "site1", "default", [][]byte{ }, [][]byte{ }, 0, make(chan Row))).Should(Not(BeNil()))
+            })
+        })
+
+        Context("When the specified nodeID refers to the local node", func() {
+            It("Should invoke Watch() on the local node with the same parameters that were passed to it", func() {
+                var ch chan Row = make(chan Row)
+
+                watchCalled := make(chan int, 1)
+                localNode.watchCB = func(ctx context.Context, partition uint64, siteID string, bucket string, keys [][]byte, prefixes [][]byte, lastSerial uint64, c chan Row) {
+                    Expect(partition).Should(Equal(uint64(50)))
+                    Expect(siteID).Should(Equal("site1"))
+                    Expect(bucket).Should(Equal("default"))
+                    Expect(keys).Should(Equal([][]byte{ []byte("a") }))
+                    Expect(prefixes).Should(Equal([][]byte{ []byte("b") }))
+                    Expect(lastSerial).Should(Equal(uint64(7)))
+                    Expect(c).Should(Equal(ch))
+
+                    watchCalled <- 1
+                }
+
+                Expect(client.Watch(context.TODO(), localNodeID, 50, "site1", "default", [][]byte{ []byte("a") }, [][]byte{ []byte("b") }, 7, ch)).Should(BeNil())
+
+                select {
+                case <-watchCalled:
+                default:
+                    Fail("Did not invoke Watch() on local node")
+                }
+            })
+
+            Context("And if the call to Watch() on the local node returns an ENoSuchBucket error", func() {
+                It("Should return an EBucketDoesNotExist error", func() {
+                    localNode.defaultWatchError = ENoSuchBucket
+                    Expect(client.Watch(context.TODO(), localNodeID, 50, "site1", "default", [][]byte{ }, [][]byte{ }, 0, make(chan Row))).Should(Equal(EBucketDoesNotExist))
+                })
+            })
+
+            Context("And if the call to Watch() on the local node returns an ENoSuchSite error", func() {
+                It("Should return an ESiteDoesNotExist error", func() {
+                    localNode.defaultWatchError = ENoSuchSite
+                    Expect(client.Watch(context.TODO(), localNodeID, 50, "site1", "default", [][]byte{ }, [][]byte{ }, 0, make(chan Row))).Should(Equal(ESiteDoesNotExist))
+                })
+            })
+        })
+
+        Context("When the specified nodeID refers to a known node that is not the local node", func() {
+            It("Should send a GET request to /partitions/{partitionID}/sites/{siteID}/buckets/{bucketID}/watch at that node", func() {
+                server.AppendHandlers(ghttp.CombineHandlers(
+                    ghttp.VerifyRequest("GET", "/partitions/50/sites/site1/buckets/default/watch", "key=a&lastSerial=7&prefix=b"),
+                    ghttp.RespondWith(http.StatusOK, ""),
+                ))
+
+                Expect(client.Watch(context.TODO(), remoteNodeID, 50, "site1", "default", [][]byte{ []byte("a") }, [][]byte{ []byte("b") }, 7, make(chan Row))).Should(BeNil())
+                Expect(server.ReceivedRequests()).Should(HaveLen(1))
+            })
+
+            Context("And the http request responds with a 404 status code", func() {
+                It("Should return the database error in the body", func() {
+                    server.AppendHandlers(ghttp.RespondWith(http.StatusNotFound, ESiteDoesNotExist.JSON()))
+                    Expect(client.Watch(context.TODO(), remoteNodeID, 50, "site1", "default", [][]byte{ }, [][]byte{ }, 0, make(chan Row))).Should(Equal(ESiteDoesNotExist))
+                })
+            })
+
+            Context("And the http request responds with a 500 status code", func() {
+                It("Should return an error", func() {
+                    server.AppendHandlers(ghttp.RespondWith(http.StatusInternalServerError, ""))
+                    Expect(client.Watch(context.TODO(), remoteNodeID, 50, "site1", "default", [][]byte{ }, [][]byte{ }, 0, make(chan Row))).Should(HaveOccurred())
+                })
+            })
+
+            Context("And the http request responds with a 200 status code", func() {
+                It("Should send each row in the stream to the channel and close it when the stream ends", func() {
+                    encodedRow, _ := json.Marshal(Row{ Key: "a", LocalVersion: 8, Siblings: NewSiblingSet(map[*Sibling]bool{ }) })
+                    encodedMarker, _ := json.Marshal(Row{ })
+
+                    server.AppendHandlers(ghttp.RespondWith(http.StatusOK, "data: " + string(encodedMarker) + "\n\ndata: " + string(encodedRow) + "\n\n"))
+
+                    var ch chan Row = make(chan Row)
+
+                    Expect(client.Watch(context.TODO(), remoteNodeID, 50, "site1", "default", [][]byte{ []byte("a") }, [][]byte{ }, 7, ch)).Should(BeNil())
+
+                    var rows []Row
+
+                    for row := range ch {
+                        rows = append(rows, row)
+                    }
+
+                    Expect(rows).Should(HaveLen(2))
+                    Expect(rows[0].Key).Should(Equal(""))
+                    Expect(rows[1].Key).Should(Equal("a"))
+                    Expect(rows[1].LocalVersion).Should(Equal(uint64(8)))
+                })
+            })
+        })
+    })
+
+    Describe("#WebhookStatus", func() {
+        Context("When the specified nodeID does not refer to a known node", func() {
+            It("Should return an error", func() {
+                _, err := client.WebhookStatus(context.TODO(), unknownNodeID, "hook1")
+                Expect(err).Should(Equal(ENoSuchNode))
+            })
+        })
+
+        Context("When the specified nodeID refers to the local node", func() {
+            It("Should return the result of WebhookStatus() on the local node", func() {
+                localNode.defaultWebhookStatus = webhooks.Status{ Metrics: webhooks.Metrics{ Delivered: 2 } }
+                localNode.defaultWebhookStatusError = EWebhookDoesNotExist
+
+                status, err := client.WebhookStatus(context.TODO(), localNodeID, "hook1")
+
+                Expect(status).Should(Equal(localNode.defaultWebhookStatus))
+                Expect(err).Should(Equal(EWebhookDoesNotExist))
+            })
+        })
+
+        Context("When the specified nodeID refers to a known node that is not the local node", func() {
+            It("Should send a GET request to /webhooks/{webhookID}/status at that node and return the decoded status", func() {
+                status := webhooks.Status{ Metrics: webhooks.Metrics{ Delivered: 2, Failed: 1 }, DeadLetters: []webhooks.DeadLetter{ webhooks.DeadLetter{ DeliveryID: "a-1" } } }
+                encodedStatus, _ := json.Marshal(status)
+
+                server.AppendHandlers(ghttp.CombineHandlers(
+                    ghttp.VerifyRequest("GET", "/webhooks/hook1/status", "local=true"),
+                    ghttp.RespondWith(http.StatusOK, encodedStatus),
+                ))
+
+                Expect(client.WebhookStatus(context.TODO(), remoteNodeID, "hook1")).Should(Equal(status))
+                Expect(server.ReceivedRequests()).Should(HaveLen(1))
+            })
+
+            Context("And the http request responds with a 404 status code and EWebhookDoesNotExist", func() {
+                It("Should return EWebhookDoesNotExist", func() {
+                    server.AppendHandlers(ghttp.RespondWith(http.StatusNotFound, EWebhookDoesNotExist.JSON()))
+
+                    _, err := client.WebhookStatus(context.TODO(), remoteNodeID, "hook1")
+                    Expect(err).Should(Equal(EWebhookDoesNotExist))
+                })
+            })
+
+            Context("And the http request responds with a 404 status code because the node does not deliver webhooks", func() {
+                It("Should return an EStorage error", func() {
+                    server.AppendHandlers(ghttp.RespondWith(http.StatusNotFound, "404 page not found"))
+
+                    _, err := client.WebhookStatus(context.TODO(), remoteNodeID, "hook1")
+                    Expect(err).Should(Equal(EStorage))
+                })
+            })
+        })
+    })
+
+    Describe("#ApplyRelayAlerts", func() {
+        Context("When the specified nodeID does not refer to a known node", func() {
+            It("Should return an error", func() {
+                Expect(client.ApplyRelayAlerts(context.TODO(), unknownNodeID, "site1", "WWRL000000", RelayAlertsOp{ Op: RelayAlertsTouch })).Should(Equal(ENoSuchNode))
+            })
+        })
+
+        Context("When the specified nodeID refers to a known node that is not the local node", func() {
+            It("Should send a POST request to /sites/{siteID}/relays/{relayID}/alerts at that node with the encoded operation", func() {
+                op := RelayAlertsOp{ Op: RelayAlertsUpdate, Alerts: []Alert{ Alert{ Key: "door1", Level: "critical", Timestamp: 5, Status: true } }, Timestamp: 6 }
+                encodedOp, _ := json.Marshal(op)
+
+                server.AppendHandlers(ghttp.CombineHandlers(
+                    ghttp.VerifyRequest("POST", "/sites/site1/relays/WWRL000000/alerts"),
+                    ghttp.VerifyBody(encodedOp),
+                    ghttp.RespondWith(http.StatusOK, ""),
+                ))
+
+                Expect(client.ApplyRelayAlerts(context.TODO(), remoteNodeID, "site1", "WWRL000000", op)).Should(BeNil())
+                Expect(server.ReceivedRequests()).Should(HaveLen(1))
+            })
+
+            Context("And the http request responds with a status code other than 200", func() {
+                It("Should return an EStorage error", func() {
+                    server.AppendHandlers(ghttp.RespondWith(http.StatusNotFound, "404 page not found"))
+
+                    Expect(client.ApplyRelayAlerts(context.TODO(), remoteNodeID, "site1", "WWRL000000", RelayAlertsOp{ Op: RelayAlertsTouch })).Should(Equal(EStorage))
+                })
+            })
+        })
+    })
+
+    Describe("#RelayAlerts", func() {
+        Context("When the specified nodeID does not refer to a known node", func() {
+            It("Should return an error", func() {
+                _, err := client.RelayAlerts(context.TODO(), unknownNodeID, "site1", nil)
+                Expect(err).Should(Equal(ENoSuchNode))
+            })
+        })
+
+        Context("When the specified nodeID refers to a known node that is not the local node", func() {
+            It("Should send a GET request to /sites/{siteID}/alerts at that node and return the decoded alerts", func() {
+                alerts := []RelayAlert{ RelayAlert{ Alert: Alert{ Key: "door1", Level: "critical", Timestamp: 5, Status: true }, SiteID: "site1", RelayID: "WWRL000000" } }
+                encodedAlerts, _ := json.Marshal(alerts)
+
+                server.AppendHandlers(ghttp.CombineHandlers(
+                    ghttp.VerifyRequest("GET", "/sites/site1/alerts", "level=critical&local=true"),
+                    ghttp.RespondWith(http.StatusOK, encodedAlerts),
+                ))
+
+                Expect(client.RelayAlerts(context.TODO(), remoteNodeID, "site1", []string{ "critical" })).Should(Equal(alerts))
+                Expect(server.ReceivedRequests()).Should(HaveLen(1))
+            })
+
+            Context("And no site is specified", func() {
+                It("Should send a GET request to /alerts at that node", func() {
+                    server.AppendHandlers(ghttp.CombineHandlers(
+                        ghttp.VerifyRequest("GET", "/alerts", "local=true"),
+                        ghttp.RespondWith(http.StatusOK, "[]"),
+                    ))
+
+                    Expect(client.RelayAlerts(context.TODO(), remoteNodeID, "", nil)).Should(BeEmpty())
+                    Expect(server.ReceivedRequests()).Should(HaveLen(1))
+                })
+            })
+
+            Context("And the http request responds with a status code other than 200", func() {
+                It("Should return an EStorage error", func() {
+                    server.AppendHandlers(ghttp.RespondWith(http.StatusNotFound, "404 page not found"))
+
+                    _, err := client.RelayAlerts(context.TODO(), remoteNodeID, "site1", nil)
+                    Expect(err).Should(Equal(EStorage))
+                })
+            })
+        })
+    })
+
+    Describe("#LogRelayEvents", func() {
+        Context("When the specified nodeID does not refer to a known node", func() {
+            It("Should return an error", func() {
+                Expect(client.LogRelayEvents(context.TODO(), unknownNodeID, "site1", "WWRL000000", []*Event{ })).Should(Equal(ENoSuchNode))
+            })
+        })
+
+        Context("When the specified nodeID refers to a known node that is not the local node", func() {
+            It("Should send a POST request to /sites/{siteID}/relays/{relayID}/events at that node with the encoded events", func() {
+                events := []*Event{ &Event{ Timestamp: 5, SourceID: "d1", Type: "type1", Data: "on", UUID: "abc" } }
+                encodedEvents, _ := json.Marshal(events)
+
+                server.AppendHandlers(ghttp.CombineHandlers(
+                    ghttp.VerifyRequest("POST", "/sites/site1/relays/WWRL000000/events"),
+                    ghttp.VerifyBody(encodedEvents),
+                    ghttp.RespondWith(http.StatusOK, ""),
+                ))
+
+                Expect(client.LogRelayEvents(context.TODO(), remoteNodeID, "site1", "WWRL000000", events)).Should(BeNil())
+                Expect(server.ReceivedRequests()).Should(HaveLen(1))
+            })
+
+            Context("And the http request responds with a status code other than 200", func() {
+                It("Should return an EStorage error", func() {
+                    server.AppendHandlers(ghttp.RespondWith(http.StatusNotFound, "404 page not found"))
+
+                    Expect(client.LogRelayEvents(context.TODO(), remoteNodeID, "site1", "WWRL000000", []*Event{ })).Should(Equal(EStorage))
+                })
+            })
+        })
+    })
+
+    Describe("#QueryRelayEvents", func() {
+        Context("When the specified nodeID does not refer to a known node", func() {
+            It("Should return an error", func() {
+                _, err := client.QueryRelayEvents(context.TODO(), unknownNodeID, "site1", "WWRL000000", &HistoryQuery{ })
+                Expect(err).Should(Equal(ENoSuchNode))
+            })
+        })
+
+        Context("When the specified nodeID refers to a known node that is not the local node", func() {
+            It("Should send a GET request to /sites/{siteID}/relays/{relayID}/events at that node and iterate over the streamed events", func() {
+                server.AppendHandlers(ghttp.CombineHandlers(
+                    ghttp.VerifyRequest("GET", "/sites/site1/relays/WWRL000000/events", "limit=2&local=true&source=d1"),
+                    ghttp.RespondWith(http.StatusOK, `{"timestamp":1,"source":"d1","type":"type1","serial":1}` + "\n" + `{"timestamp":2,"source":"d1","type":"type1","serial":2}` + "\n"),
+                ))
+
+                eventIterator, err := client.QueryRelayEvents(context.TODO(), remoteNodeID, "site1", "WWRL000000", &HistoryQuery{ Sources: []string{ "d1" }, Limit: 2 })
+
+                Expect(err).Should(BeNil())
+
+                defer eventIterator.Release()
+
+                Expect(eventIterator.Next()).Should(BeTrue())
+                Expect(eventIterator.Event()).Should(Equal(&Event{ Timestamp: 1, SourceID: "d1", Type: "type1", Serial: 1 }))
+                Expect(eventIterator.Next()).Should(BeTrue())
+                Expect(eventIterator.Event()).Should(Equal(&Event{ Timestamp: 2, SourceID: "d1", Type: "type1", Serial: 2 }))
+                Expect(eventIterator.Next()).Should(BeFalse())
+                Expect(eventIterator.Error()).Should(BeNil())
+            })
+
+            Context("And the stream contains an invalid event", func() {
+                It("Should stop and return the error from Error()", func() {
+                    server.AppendHandlers(ghttp.RespondWith(http.StatusOK, "asdf\n"))
+
+                    eventIterator, err := client.QueryRelayEvents(context.TODO(), remoteNodeID, "site1", "WWRL000000", &HistoryQuery{ })
+
+                    Expect(err).Should(BeNil())
+
+                    defer eventIterator.Release()
+
+                    Expect(eventIterator.Next()).Should(BeFalse())
+                    Expect(eventIterator.Error()).Should(Not(BeNil()))
+                })
+            })
+
+            Context("And the http request responds with a status code other than 200", func() {
+                It("Should return an EStorage error", func() {
+                    server.AppendHandlers(ghttp.RespondWith(http.StatusNotFound, "404 page not found"))
+
+                    _, err := client.QueryRelayEvents(context.TODO(), remoteNodeID, "site1", "WWRL000000", &HistoryQuery{ })
+                    Expect(err).Should(Equal(EStorage))
+                })
+            })
+        })
+    })
+
+    Describe("#AggregateRelayEvents", func() {
+        Context("When the specified nodeID refers to a known node that is not the local node", func() {
+            It("Should send a GET request to /sites/{siteID}/relays/{relayID}/events/aggregate at that node and return the decoded buckets", func() {
+                buckets := []*AggregateBucket{ &AggregateBucket{ Start: 0, Type: "type1", Count: 2 } }
+                encodedBuckets, _ := json.Marshal(buckets)
+
+                server.AppendHandlers(ghttp.CombineHandlers(
+                    ghttp.VerifyRequest("GET", "/sites/site1/relays/WWRL000000/events/aggregate", "groupBy=type&interval=day&local=true"),
+                    ghttp.RespondWith(http.StatusOK, encodedBuckets),
+                ))
+
+                Expect(client.AggregateRelayEvents(context.TODO(), remoteNodeID, "site1", "WWRL000000", &AggregationQuery{ Interval: AggregationIntervals["day"], GroupBy: AGGREGATE_BY_TYPE })).Should(Equal(buckets))
+            })
+        })
+    })
+
+    Describe("#SiteHistoryRetention", func() {
+        Context("When the specified nodeID refers to a known node that is not the local node", func() {
+            It("Should send a GET request to /sites/{siteID}/history/retention at that node and return the decoded retention", func() {
+                server.AppendHandlers(ghttp.CombineHandlers(
+                    ghttp.VerifyRequest("GET", "/sites/site1/history/retention", "local=true"),
+                    ghttp.RespondWith(http.StatusOK, `{"eventLimit":100,"eventFloor":50}`),
+                ))
+
+                Expect(client.SiteHistoryRetention(context.TODO(), remoteNodeID, "site1")).Should(Equal(HistoryRetention{ EventLimit: 100, EventFloor: 50 }))
+            })
+        })
+    })
+
+    Describe("#SetSiteHistoryRetention", func() {
+        Context("When the specified nodeID refers to a known node that is not the local node", func() {
+            It("Should send a PUT request to /sites/{siteID}/history/retention at that node with the encoded retention", func() {
+                server.AppendHandlers(ghttp.CombineHandlers(
+                    ghttp.VerifyRequest("PUT", "/sites/site1/history/retention", "local=true"),
+                    ghttp.VerifyBody([]byte(`{"eventLimit":100,"eventFloor":50}`)),
+                    ghttp.RespondWith(http.StatusOK, ""),
+                ))
+
+                Expect(client.SetSiteHistoryRetention(context.TODO(), remoteNodeID, "site1", HistoryRetention{ EventLimit: 100, EventFloor: 50 })).Should(BeNil())
+            })
+
+            Context("And the http request responds with a status code other than 200", func() {
+                It("Should return an EStorage error", func() {
+                    server.AppendHandlers(ghttp.RespondWith(http.StatusInternalServerError, ""))
+
+                    Expect(client.SetSiteHistoryRetention(context.TODO(), remoteNodeID, "site1", HistoryRetention{ })).Should(Equal(EStorage))
+                })
+            })
+        })
+    })
 })
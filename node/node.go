@@ -27,9 +27,12 @@ package node
 import (
     "context"
     
+    . "github.com/armPelionEdge/devicedb/alerts"
     . "github.com/armPelionEdge/devicedb/bucket"
     . "github.com/armPelionEdge/devicedb/data"
+    . "github.com/armPelionEdge/devicedb/historian"
     . "github.com/armPelionEdge/devicedb/routes"
+    "github.com/armPelionEdge/devicedb/webhooks"
 )
 
 // A Node coordinates interactions between
@@ -58,5 +61,15 @@ type Node interface {
     Merge(ctx context.Context, partition uint64, siteID string, bucket string, patch map[string]*SiblingSet, broadcastToRelays bool) error
     Get(ctx context.Context, partition uint64, siteID string, bucket string, keys [][]byte) ([]*SiblingSet, error)
     GetMatches(ctx context.Context, partition uint64, siteID string, bucket string, keys [][]byte) (SiblingSetIterator, error)
+    Watch(ctx context.Context, partition uint64, siteID string, bucket string, keys [][]byte, prefixes [][]byte, lastSerial uint64, ch chan Row) error
     RelayStatus(relayID string) (RelayStatus, error)
+    WebhookStatus(webhookID string) (webhooks.Status, error)
+    ApplyRelayAlerts(siteID string, relayID string, op RelayAlertsOp) error
+    RelayAlerts(siteID string, levels []string) ([]RelayAlert, error)
+    RelayAlertStates(siteID string) ([]RelayAlert, error)
+    LogRelayEvents(siteID string, relayID string, events []*Event) error
+    QueryRelayEvents(siteID string, relayID string, query *HistoryQuery) (*EventIterator, error)
+    AggregateRelayEvents(siteID string, relayID string, query *AggregationQuery) ([]*AggregateBucket, error)
+    SiteHistoryRetention(siteID string) (HistoryRetention, error)
+    SetSiteHistoryRetention(siteID string, retention HistoryRetention) error
 }
@@ -128,10 +128,23 @@ func (nodeFacade *NodeCoordinatorFacade) AddRelay(relayID string) {
 
 func (nodeFacade *NodeCoordinatorFacade) RemoveRelay(relayID string) {
     nodeFacade.node.DisconnectRelay(relayID)
+    nodeFacade.node.hub.ForgetPushes(relayID)
+    nodeFacade.node.hub.PublishRelayRosters(relayID, "")
 }
 
 func (nodeFacade *NodeCoordinatorFacade) MoveRelay(relayID string, siteID string) {
     nodeFacade.node.DisconnectRelay(relayID)
+    nodeFacade.node.hub.PublishRelayRosters(relayID, siteID)
+}
+
+func (nodeFacade *NodeCoordinatorFacade) SetRelayAddress(relayID string, address string) {
+    nodeFacade.node.hub.PublishRelayRosters(relayID, nodeFacade.node.configController.ClusterController().RelaySite(relayID))
+}
+
+// The relay is told its scope when it connects. Reconnecting it also
+// ends the sync sessions that were started with the old scope
+func (nodeFacade *NodeCoordinatorFacade) SetRelaySubscription(relayID string) {
+    nodeFacade.node.DisconnectRelay(relayID)
 }
 
 func (nodeFacade *NodeCoordinatorFacade) DisconnectRelays(partitionNumber uint64) {
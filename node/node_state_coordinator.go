@@ -138,6 +138,13 @@ func (coordinator *ClusterNodeStateCoordinator) ProcessClusterUpdates(deltas []C
             relay := delta.Delta.(RelayMoved).RelayID
             site := delta.Delta.(RelayMoved).SiteID
             coordinator.nodeFacade.MoveRelay(relay, site)
+        case DeltaRelayAddressChanged:
+            relay := delta.Delta.(RelayAddressChanged).RelayID
+            address := delta.Delta.(RelayAddressChanged).Address
+            coordinator.nodeFacade.SetRelayAddress(relay, address)
+        case DeltaRelaySubscriptionChanged:
+            relay := delta.Delta.(RelaySubscriptionChanged).RelayID
+            coordinator.nodeFacade.SetRelaySubscription(relay)
         }
     }
 
@@ -95,6 +95,8 @@ type MockNodeCoordinatorFacade struct {
     disconnects map[uint64]bool
     sites map[string]bool
     relays map[string]string
+    relayAddresses map[string]string
+    relaySubscriptionChanges []string
     joinedCluster chan int
     leftCluster chan int
     empty chan int
@@ -117,6 +119,7 @@ func NewMockNodeCoordinatorFacade(id uint64) *MockNodeCoordinatorFacade {
         leftCluster: make(chan int, 1),
         sites: make(map[string]bool, 0),
         relays: make(map[string]string, 0),
+        relayAddresses: make(map[string]string, 0),
         disconnects: make(map[uint64]bool),
     }
 }
@@ -212,6 +215,22 @@ func (nodeFacade *MockNodeCoordinatorFacade) MoveRelay(relayID string, siteID st
     nodeFacade.relays[relayID] = siteID
 }
 
+func (nodeFacade *MockNodeCoordinatorFacade) SetRelayAddress(relayID string, address string) {
+    nodeFacade.relayAddresses[relayID] = address
+}
+
+func (nodeFacade *MockNodeCoordinatorFacade) SetRelaySubscription(relayID string) {
+    nodeFacade.relaySubscriptionChanges = append(nodeFacade.relaySubscriptionChanges, relayID)
+}
+
+func (nodeFacade *MockNodeCoordinatorFacade) RelaySubscriptionChanges() []string {
+    return nodeFacade.relaySubscriptionChanges
+}
+
+func (nodeFacade *MockNodeCoordinatorFacade) RelayAddresses() map[string]string {
+    return nodeFacade.relayAddresses
+}
+
 func (nodeFacade *MockNodeCoordinatorFacade) DisconnectRelays(partitionNumber uint64) {
     nodeFacade.disconnects[partitionNumber] = true
 }
@@ -676,6 +695,30 @@ var _ = Describe("NodeStateCoordinator", func() {
                 })
             })
 
+            Context("When deltas include a DeltaRelayAddressChanged", func() {
+                BeforeEach(func() {
+                    deltas = []ClusterStateDelta{ ClusterStateDelta{ Type: DeltaRelayAddressChanged, Delta: RelayAddressChanged{ RelayID: "WWRL000000", Address: "10.0.0.2:9090" } } }
+                })
+
+                It("Should call SetRelayAddress() for that relay and address on the node facade", func() {
+                    Expect(nodeFacade.RelayAddresses()).Should(Equal(map[string]string{ }))
+                    stateCoordinator.ProcessClusterUpdates(deltas)
+                    Expect(nodeFacade.RelayAddresses()).Should(Equal(map[string]string{ "WWRL000000": "10.0.0.2:9090" }))
+                })
+            })
+
+            Context("When deltas include a DeltaRelaySubscriptionChanged", func() {
+                BeforeEach(func() {
+                    deltas = []ClusterStateDelta{ ClusterStateDelta{ Type: DeltaRelaySubscriptionChanged, Delta: RelaySubscriptionChanged{ RelayID: "WWRL000000" } } }
+                })
+
+                It("Should call SetRelaySubscription() for that relay on the node facade", func() {
+                    Expect(nodeFacade.RelaySubscriptionChanges()).Should(BeEmpty())
+                    stateCoordinator.ProcessClusterUpdates(deltas)
+                    Expect(nodeFacade.RelaySubscriptionChanges()).Should(Equal([]string{ "WWRL000000" }))
+                })
+            })
+
             Context("When the node no longer owns or holds any partition replicas", func() {
                 It("Should call NotifyEmpty() on the node facade", func() {
                     stateCoordinator.ProcessClusterUpdates(deltas)
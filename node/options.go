@@ -26,6 +26,7 @@ package node
 
 import (
     . "github.com/armPelionEdge/devicedb/cluster"
+    . "github.com/armPelionEdge/devicedb/historian"
 )
 
 type NodeInitializationOptions struct {
@@ -41,7 +42,26 @@ type NodeInitializationOptions struct {
     SyncMaxSessions uint
     SyncPathLimit uint32
     SyncPeriod uint
+    SyncPeriodMax uint
     SnapshotDirectory string
+    // When set relays can forward their events to this node instead of
+    // to a separate history service
+    HistoryEnabled bool
+    // How many events are kept for each relay in sites that have not
+    // been given a retention of their own
+    HistoryRetention HistoryRetention
+    // When set relays can forward their alerts to this node instead of
+    // to a separate alerts service
+    AlertsEnabled bool
+    // Relays that have not reported to the cluster for this many
+    // milliseconds get a stale relay alert. Zero disables this
+    AlertsStaleAfter uint64
+    // When set this node delivers updates to webhooks for the sites
+    // whose partitions it owns first
+    WebhooksEnabled bool
+    // How many times delivery of an update to a webhook is attempted
+    // before it is dead lettered. Zero uses the default
+    WebhookMaxAttempts int
 }
 
 func (options NodeInitializationOptions) SnapshotsEnabled() bool {
@@ -27,12 +27,16 @@ package node_test
 import (
     "context"
 
+    . "github.com/armPelionEdge/devicedb/alerts"
     . "github.com/armPelionEdge/devicedb/bucket"
     . "github.com/armPelionEdge/devicedb/cluster"
     . "github.com/armPelionEdge/devicedb/data"
+    . "github.com/armPelionEdge/devicedb/error"
+    . "github.com/armPelionEdge/devicedb/historian"
     . "github.com/armPelionEdge/devicedb/node"
     . "github.com/armPelionEdge/devicedb/raft"
     . "github.com/armPelionEdge/devicedb/routes"
+    "github.com/armPelionEdge/devicedb/webhooks"
 
     "github.com/coreos/etcd/raft/raftpb"
 )
@@ -151,6 +155,10 @@ type MockNode struct {
     getMatchesCB func(ctx context.Context, partition uint64, siteID string, bucket string, keys [][]byte)
     defaultGetMatchesSiblingSetIterator SiblingSetIterator
     defaultGetMatchesError error
+    watchCB func(ctx context.Context, partition uint64, siteID string, bucket string, keys [][]byte, prefixes [][]byte, lastSerial uint64, ch chan Row)
+    defaultWatchError error
+    defaultWebhookStatus webhooks.Status
+    defaultWebhookStatusError error
 }
 
 func NewMockNode(id uint64) *MockNode {
@@ -201,11 +209,55 @@ func (node *MockNode) GetMatches(ctx context.Context, partition uint64, siteID s
 
     return node.defaultGetMatchesSiblingSetIterator, node.defaultGetMatchesError
 }
+
+func (node *MockNode) Watch(ctx context.Context, partition uint64, siteID string, bucket string, keys [][]byte, prefixes [][]byte, lastSerial uint64, ch chan Row) error {
+    if node.watchCB != nil {
+        node.watchCB(ctx, partition, siteID, bucket, keys, prefixes, lastSerial, ch)
+    }
+
+    return node.defaultWatchError
+}
     
 func (node *MockNode) RelayStatus(relayID string) (RelayStatus, error) {
     return RelayStatus{}, nil
 }
 
+func (node *MockNode) WebhookStatus(webhookID string) (webhooks.Status, error) {
+    return node.defaultWebhookStatus, node.defaultWebhookStatusError
+}
+
+func (node *MockNode) ApplyRelayAlerts(siteID string, relayID string, op RelayAlertsOp) error {
+    return nil
+}
+
+func (node *MockNode) RelayAlerts(siteID string, levels []string) ([]RelayAlert, error) {
+    return []RelayAlert{ }, nil
+}
+
+func (node *MockNode) RelayAlertStates(siteID string) ([]RelayAlert, error) {
+    return []RelayAlert{ }, nil
+}
+
+func (node *MockNode) LogRelayEvents(siteID string, relayID string, events []*Event) error {
+    return nil
+}
+
+func (node *MockNode) QueryRelayEvents(siteID string, relayID string, query *HistoryQuery) (*EventIterator, error) {
+    return nil, EStorage
+}
+
+func (node *MockNode) AggregateRelayEvents(siteID string, relayID string, query *AggregationQuery) ([]*AggregateBucket, error) {
+    return []*AggregateBucket{ }, nil
+}
+
+func (node *MockNode) SiteHistoryRetention(siteID string) (HistoryRetention, error) {
+    return HistoryRetention{ }, nil
+}
+
+func (node *MockNode) SetSiteHistoryRetention(siteID string, retention HistoryRetention) error {
+    return nil
+}
+
 type siblingSetIteratorEntry struct {
     Prefix []byte
     Key []byte
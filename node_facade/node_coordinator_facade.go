@@ -65,6 +65,11 @@ type ClusterNodeCoordinatorFacade interface {
     AddRelay(relayID string)
     RemoveRelay(relayID string)
     MoveRelay(relayID string, siteID string)
+    // Record the LAN address that a relay advertises to the other
+    // relays in its site
+    SetRelayAddress(relayID string, address string)
+    // Apply a change to the keys that are replicated to a relay
+    SetRelaySubscription(relayID string)
     DisconnectRelays(partitionNumber uint64)
     // Return a count of cluster members that have non-zero capacity
     NeighborsWithCapacity() int
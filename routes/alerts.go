@@ -0,0 +1,221 @@
+package routes
+//
+ // Copyright (c) 2019 ARM Limited.
+ //
+ // SPDX-License-Identifier: MIT
+ //
+ // Permission is hereby granted, free of charge, to any person obtaining a copy
+ // of this software and associated documentation files (the "Software"), to
+ // deal in the Software without restriction, including without limitation the
+ // rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ // sell copies of the Software, and to permit persons to whom the Software is
+ // furnished to do so, subject to the following conditions:
+ //
+ // The above copyright notice and this permission notice shall be included in all
+ // copies or substantial portions of the Software.
+ //
+ // THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ // IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ // FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ // AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ // LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ // SOFTWARE.
+ //
+
+import (
+    "encoding/json"
+    "io"
+    "net/http"
+    "github.com/gorilla/mux"
+
+    . "github.com/armPelionEdge/devicedb/alerts"
+    . "github.com/armPelionEdge/devicedb/error"
+    . "github.com/armPelionEdge/devicedb/logging"
+)
+
+// AlertsEndpoint lets the cluster stand in for the alerts service that
+// relays forward their alerts to. Relays should have their alertsURI
+// pointed at /alerts on the relay port
+type AlertsEndpoint struct {
+    ClusterFacade ClusterFacade
+}
+
+func (alertsEndpoint *AlertsEndpoint) Attach(router *mux.Router) {
+    // Accept a batch of alerts forwarded by a relay
+    router.HandleFunc("/alerts", func(w http.ResponseWriter, r *http.Request) {
+        relayID := relayIdentity(r)
+
+        if relayID == "" {
+            Log.Warningf("POST /alerts: Unable to identify relay")
+
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusUnauthorized)
+            io.WriteString(w, string(EUnauthorized.JSON()) + "\n")
+
+            return
+        }
+
+        var alerts []Alert
+
+        if err := json.NewDecoder(r.Body).Decode(&alerts); err != nil {
+            Log.Warningf("POST /alerts: Unable to parse alerts from relay %s: %v", relayID, err)
+
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusBadRequest)
+            io.WriteString(w, string(EReadBody.JSON()) + "\n")
+
+            return
+        }
+
+        err := alertsEndpoint.ClusterFacade.LogRelayAlerts(relayID, alerts)
+
+        if err == ERelayDoesNotExist {
+            Log.Warningf("POST /alerts: Relay %s does not belong to a site", relayID)
+
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusNotFound)
+            io.WriteString(w, string(ERelayDoesNotExist.JSON()) + "\n")
+
+            return
+        }
+
+        if err != nil {
+            Log.Warningf("POST /alerts: Unable to record alerts from relay %s: %v", relayID, err)
+
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusInternalServerError)
+            io.WriteString(w, "\n")
+
+            return
+        }
+
+        w.Header().Set("Content-Type", "application/json; charset=utf8")
+        w.WriteHeader(http.StatusOK)
+        io.WriteString(w, "\n")
+    }).Methods("POST")
+
+    // List the firing alerts of relays in every site. Filter by level
+    // with one or more level parameters. With local set only the alert
+    // state kept by this node is used, and with cleared set as well every
+    // alert it keeps is listed whatever its status or level
+    router.HandleFunc("/alerts", func(w http.ResponseWriter, r *http.Request) {
+        var alerts []RelayAlert
+        var err error
+
+        _, local := r.URL.Query()["local"]
+        _, cleared := r.URL.Query()["cleared"]
+
+        if local && cleared {
+            alerts, err = alertsEndpoint.ClusterFacade.LocalRelayAlertStates("")
+        } else if local {
+            alerts, err = alertsEndpoint.ClusterFacade.LocalRelayAlerts("", r.URL.Query()["level"])
+        } else {
+            alerts, err = alertsEndpoint.ClusterFacade.RelayAlerts("", r.URL.Query()["level"])
+        }
+
+        if err != nil {
+            Log.Warningf("GET /alerts: %v", err)
+
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusInternalServerError)
+            io.WriteString(w, "\n")
+
+            return
+        }
+
+        encodedAlerts, _ := json.Marshal(alerts)
+
+        w.Header().Set("Content-Type", "application/json; charset=utf8")
+        w.WriteHeader(http.StatusOK)
+        io.WriteString(w, string(encodedAlerts) + "\n")
+    }).Methods("GET")
+
+    // List the firing alerts of the relays in a site. With local set
+    // only the alert state kept by this node is used, and with cleared set
+    // as well every alert it keeps is listed whatever its status or level
+    router.HandleFunc("/sites/{siteID}/alerts", func(w http.ResponseWriter, r *http.Request) {
+        var alerts []RelayAlert
+        var err error
+
+        _, local := r.URL.Query()["local"]
+        _, cleared := r.URL.Query()["cleared"]
+
+        if local && cleared {
+            alerts, err = alertsEndpoint.ClusterFacade.LocalRelayAlertStates(mux.Vars(r)["siteID"])
+        } else if local {
+            alerts, err = alertsEndpoint.ClusterFacade.LocalRelayAlerts(mux.Vars(r)["siteID"], r.URL.Query()["level"])
+        } else {
+            alerts, err = alertsEndpoint.ClusterFacade.RelayAlerts(mux.Vars(r)["siteID"], r.URL.Query()["level"])
+        }
+
+        if err == ESiteDoesNotExist {
+            Log.Warningf("GET /sites/{siteID}/alerts: Site does not exist")
+
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusNotFound)
+            io.WriteString(w, string(ESiteDoesNotExist.JSON()) + "\n")
+
+            return
+        }
+
+        if err != nil {
+            Log.Warningf("GET /sites/{siteID}/alerts: %v", err)
+
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusInternalServerError)
+            io.WriteString(w, "\n")
+
+            return
+        }
+
+        encodedAlerts, _ := json.Marshal(alerts)
+
+        w.Header().Set("Content-Type", "application/json; charset=utf8")
+        w.WriteHeader(http.StatusOK)
+        io.WriteString(w, string(encodedAlerts) + "\n")
+    }).Methods("GET")
+
+    // Apply a change to the alert state of a relay kept by this node.
+    // The node that received the change from the relay sends it to each
+    // owner of the site's partition
+    router.HandleFunc("/sites/{siteID}/relays/{relayID}/alerts", func(w http.ResponseWriter, r *http.Request) {
+        var op RelayAlertsOp
+
+        if err := json.NewDecoder(r.Body).Decode(&op); err != nil {
+            Log.Warningf("POST /sites/{siteID}/relays/{relayID}/alerts: Unable to parse alerts operation: %v", err)
+
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusBadRequest)
+            io.WriteString(w, string(EReadBody.JSON()) + "\n")
+
+            return
+        }
+
+        err := alertsEndpoint.ClusterFacade.LocalApplyRelayAlerts(mux.Vars(r)["siteID"], mux.Vars(r)["relayID"], op)
+
+        if err == EInvalidOp {
+            Log.Warningf("POST /sites/{siteID}/relays/{relayID}/alerts: Invalid operation %s", op.Op)
+
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusBadRequest)
+            io.WriteString(w, string(EInvalidOp.JSON()) + "\n")
+
+            return
+        }
+
+        if err != nil {
+            Log.Warningf("POST /sites/{siteID}/relays/{relayID}/alerts: %v", err)
+
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusInternalServerError)
+            io.WriteString(w, "\n")
+
+            return
+        }
+
+        w.Header().Set("Content-Type", "application/json; charset=utf8")
+        w.WriteHeader(http.StatusOK)
+        io.WriteString(w, "\n")
+    }).Methods("POST")
+}
@@ -0,0 +1,317 @@
+package routes_test
+//
+ // Copyright (c) 2019 ARM Limited.
+ //
+ // SPDX-License-Identifier: MIT
+ //
+ // Permission is hereby granted, free of charge, to any person obtaining a copy
+ // of this software and associated documentation files (the "Software"), to
+ // deal in the Software without restriction, including without limitation the
+ // rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ // sell copies of the Software, and to permit persons to whom the Software is
+ // furnished to do so, subject to the following conditions:
+ //
+ // The above copyright notice and this permission notice shall be included in all
+ // copies or substantial portions of the Software.
+ //
+ // THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ // IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ // FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ // AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ // LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ // SOFTWARE.
+ //
+
+import (
+    "encoding/json"
+    "errors"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+
+    . "github.com/armPelionEdge/devicedb/alerts"
+    . "github.com/armPelionEdge/devicedb/error"
+    . "github.com/armPelionEdge/devicedb/routes"
+
+    . "github.com/onsi/ginkgo"
+    . "github.com/onsi/gomega"
+
+    "github.com/gorilla/mux"
+)
+
+var _ = Describe("Alerts", func() {
+    var router *mux.Router
+    var alertsEndpoint *AlertsEndpoint
+    var clusterFacade *MockClusterFacade
+
+    BeforeEach(func() {
+        clusterFacade = &MockClusterFacade{ }
+        router = mux.NewRouter()
+        alertsEndpoint = &AlertsEndpoint{
+            ClusterFacade: clusterFacade,
+        }
+        alertsEndpoint.Attach(router)
+    })
+
+    Describe("/alerts", func() {
+        Describe("POST", func() {
+            Context("When the relay cannot be identified", func() {
+                It("Should respond with status code http.StatusUnauthorized", func() {
+                    req, err := http.NewRequest("POST", "/alerts", strings.NewReader("[]"))
+
+                    Expect(err).Should(BeNil())
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    Expect(rr.Code).Should(Equal(http.StatusUnauthorized))
+                })
+            })
+
+            Context("When the request body cannot be parsed", func() {
+                It("Should respond with status code http.StatusBadRequest", func() {
+                    req, err := http.NewRequest("POST", "/alerts", strings.NewReader("asdf"))
+                    req.Header.Set("X-WigWag-RelayID", "WWRL000000")
+
+                    Expect(err).Should(BeNil())
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    Expect(rr.Code).Should(Equal(http.StatusBadRequest))
+                })
+            })
+
+            Context("When the request body is a batch of alerts", func() {
+                It("Should call LogRelayAlerts() on the node facade with the decoded alerts", func() {
+                    req, err := http.NewRequest("POST", "/alerts", strings.NewReader(`[{"key":"door1","level":"critical","timestamp":5,"metadata":"open","status":true}]`))
+                    req.Header.Set("X-WigWag-RelayID", "WWRL000000")
+
+                    Expect(err).Should(BeNil())
+
+                    logRelayAlertsCalled := make(chan int, 1)
+                    clusterFacade.logRelayAlertsCB = func(relayID string, alerts []Alert) {
+                        Expect(relayID).Should(Equal("WWRL000000"))
+                        Expect(alerts).Should(Equal([]Alert{ Alert{ Key: "door1", Level: "critical", Timestamp: 5, Metadata: "open", Status: true } }))
+                        logRelayAlertsCalled <- 1
+                    }
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    select {
+                    case <-logRelayAlertsCalled:
+                    default:
+                        Fail("Should have invoked LogRelayAlerts()")
+                    }
+
+                    Expect(rr.Code).Should(Equal(http.StatusOK))
+                })
+            })
+
+            Context("When LogRelayAlerts() returns ERelayDoesNotExist", func() {
+                It("Should respond with status code http.StatusNotFound", func() {
+                    req, err := http.NewRequest("POST", "/alerts", strings.NewReader("[]"))
+                    req.Header.Set("X-WigWag-RelayID", "WWRL000000")
+                    clusterFacade.defaultLogRelayAlertsResponse = ERelayDoesNotExist
+
+                    Expect(err).Should(BeNil())
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    Expect(rr.Code).Should(Equal(http.StatusNotFound))
+                })
+            })
+
+            Context("When LogRelayAlerts() returns any other error", func() {
+                It("Should respond with status code http.StatusInternalServerError", func() {
+                    req, err := http.NewRequest("POST", "/alerts", strings.NewReader("[]"))
+                    req.Header.Set("X-WigWag-RelayID", "WWRL000000")
+                    clusterFacade.defaultLogRelayAlertsResponse = errors.New("Some error")
+
+                    Expect(err).Should(BeNil())
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    Expect(rr.Code).Should(Equal(http.StatusInternalServerError))
+                })
+            })
+        })
+
+        Describe("GET", func() {
+            It("Should query the alerts of every site at the requested levels", func() {
+                clusterFacade.defaultRelayAlertsResponse = []RelayAlert{ RelayAlert{ Alert: Alert{ Key: "door1", Level: "critical", Status: true }, SiteID: "site1", RelayID: "WWRL000000" } }
+                clusterFacade.relayAlertsCB = func(siteID string, levels []string) {
+                    Expect(siteID).Should(Equal(""))
+                    Expect(levels).Should(Equal([]string{ "critical" }))
+                }
+
+                req, err := http.NewRequest("GET", "/alerts?level=critical", nil)
+
+                Expect(err).Should(BeNil())
+
+                rr := httptest.NewRecorder()
+                router.ServeHTTP(rr, req)
+
+                var alerts []RelayAlert
+
+                Expect(rr.Code).Should(Equal(http.StatusOK))
+                Expect(json.Unmarshal(rr.Body.Bytes(), &alerts)).Should(BeNil())
+                Expect(alerts).Should(Equal(clusterFacade.defaultRelayAlertsResponse))
+            })
+
+            Context("When the local parameter is set", func() {
+                It("Should query the alerts kept by this node with LocalRelayAlerts()", func() {
+                    clusterFacade.defaultLocalRelayAlertsResponse = []RelayAlert{ RelayAlert{ Alert: Alert{ Key: "door1", Level: "critical", Status: true }, SiteID: "site1", RelayID: "WWRL000000" } }
+                    clusterFacade.relayAlertsCB = func(siteID string, levels []string) {
+                        Fail("Should not have invoked RelayAlerts()")
+                    }
+                    clusterFacade.localRelayAlertsCB = func(siteID string, levels []string) {
+                        Expect(siteID).Should(Equal(""))
+                        Expect(levels).Should(Equal([]string{ "critical" }))
+                    }
+
+                    req, err := http.NewRequest("GET", "/alerts?local=true&level=critical", nil)
+
+                    Expect(err).Should(BeNil())
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    var alerts []RelayAlert
+
+                    Expect(rr.Code).Should(Equal(http.StatusOK))
+                    Expect(json.Unmarshal(rr.Body.Bytes(), &alerts)).Should(BeNil())
+                    Expect(alerts).Should(Equal(clusterFacade.defaultLocalRelayAlertsResponse))
+                })
+            })
+
+            Context("When RelayAlerts() returns an error", func() {
+                It("Should respond with status code http.StatusInternalServerError", func() {
+                    clusterFacade.defaultRelayAlertsError = errors.New("Some error")
+
+                    req, err := http.NewRequest("GET", "/alerts", nil)
+
+                    Expect(err).Should(BeNil())
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    Expect(rr.Code).Should(Equal(http.StatusInternalServerError))
+                })
+            })
+        })
+    })
+
+    Describe("/sites/{siteID}/alerts", func() {
+        Describe("GET", func() {
+            It("Should query the alerts of the site", func() {
+                clusterFacade.defaultRelayAlertsResponse = []RelayAlert{ }
+                clusterFacade.relayAlertsCB = func(siteID string, levels []string) {
+                    Expect(siteID).Should(Equal("site1"))
+                    Expect(levels).Should(BeEmpty())
+                }
+
+                req, err := http.NewRequest("GET", "/sites/site1/alerts", nil)
+
+                Expect(err).Should(BeNil())
+
+                rr := httptest.NewRecorder()
+                router.ServeHTTP(rr, req)
+
+                Expect(rr.Code).Should(Equal(http.StatusOK))
+                Expect(rr.Body.String()).Should(Equal("[]\n"))
+            })
+
+            Context("When the site does not exist", func() {
+                It("Should respond with status code http.StatusNotFound", func() {
+                    clusterFacade.defaultRelayAlertsError = ESiteDoesNotExist
+
+                    req, err := http.NewRequest("GET", "/sites/site1/alerts", nil)
+
+                    Expect(err).Should(BeNil())
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    Expect(rr.Code).Should(Equal(http.StatusNotFound))
+                })
+            })
+        })
+    })
+
+    Describe("/sites/{siteID}/relays/{relayID}/alerts", func() {
+        Describe("POST", func() {
+            It("Should apply the decoded operation with LocalApplyRelayAlerts()", func() {
+                localApplyRelayAlertsCalled := make(chan int, 1)
+                clusterFacade.localApplyRelayAlertsCB = func(siteID string, relayID string, op RelayAlertsOp) {
+                    Expect(siteID).Should(Equal("site1"))
+                    Expect(relayID).Should(Equal("WWRL000000"))
+                    Expect(op).Should(Equal(RelayAlertsOp{ Op: RelayAlertsUpdate, Alerts: []Alert{ Alert{ Key: "door1", Level: "critical", Timestamp: 5, Status: true } }, Timestamp: 6 }))
+                    localApplyRelayAlertsCalled <- 1
+                }
+
+                req, err := http.NewRequest("POST", "/sites/site1/relays/WWRL000000/alerts", strings.NewReader(`{"op":"update","alerts":[{"key":"door1","level":"critical","timestamp":5,"status":true}],"timestamp":6}`))
+
+                Expect(err).Should(BeNil())
+
+                rr := httptest.NewRecorder()
+                router.ServeHTTP(rr, req)
+
+                Expect(rr.Code).Should(Equal(http.StatusOK))
+
+                select {
+                case <-localApplyRelayAlertsCalled:
+                default:
+                    Fail("Should have invoked LocalApplyRelayAlerts()")
+                }
+            })
+
+            Context("When the request body cannot be parsed", func() {
+                It("Should respond with status code http.StatusBadRequest", func() {
+                    req, err := http.NewRequest("POST", "/sites/site1/relays/WWRL000000/alerts", strings.NewReader("asdf"))
+
+                    Expect(err).Should(BeNil())
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    Expect(rr.Code).Should(Equal(http.StatusBadRequest))
+                })
+            })
+
+            Context("When LocalApplyRelayAlerts() returns EInvalidOp", func() {
+                It("Should respond with status code http.StatusBadRequest", func() {
+                    clusterFacade.defaultLocalApplyRelayAlertsResponse = EInvalidOp
+
+                    req, err := http.NewRequest("POST", "/sites/site1/relays/WWRL000000/alerts", strings.NewReader(`{"op":"asdf"}`))
+
+                    Expect(err).Should(BeNil())
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    Expect(rr.Code).Should(Equal(http.StatusBadRequest))
+                })
+            })
+
+            Context("When LocalApplyRelayAlerts() returns any other error", func() {
+                It("Should respond with status code http.StatusInternalServerError", func() {
+                    clusterFacade.defaultLocalApplyRelayAlertsResponse = errors.New("Some error")
+
+                    req, err := http.NewRequest("POST", "/sites/site1/relays/WWRL000000/alerts", strings.NewReader(`{"op":"touch"}`))
+
+                    Expect(err).Should(BeNil())
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    Expect(rr.Code).Should(Equal(http.StatusInternalServerError))
+                })
+            })
+        })
+    })
+})
@@ -30,12 +30,25 @@ import (
     "io"
     "net/http"
 
+    . "github.com/armPelionEdge/devicedb/alerts"
     . "github.com/armPelionEdge/devicedb/bucket"
+    . "github.com/armPelionEdge/devicedb/bundle"
     . "github.com/armPelionEdge/devicedb/data"
     . "github.com/armPelionEdge/devicedb/cluster"
+    . "github.com/armPelionEdge/devicedb/historian"
     . "github.com/armPelionEdge/devicedb/raft"
+    "github.com/armPelionEdge/devicedb/webhooks"
 )
 
+// RelayEventIterator iterates over the events that match a query of a
+// relay's history
+type RelayEventIterator interface {
+    Next() bool
+    Event() *Event
+    Release()
+    Error() error
+}
+
 type ClusterFacade interface {
     AddNode(ctx context.Context, nodeConfig NodeConfig) error
     RemoveNode(ctx context.Context, nodeID uint64) error
@@ -47,15 +60,21 @@ type ClusterFacade interface {
     AddRelay(ctx context.Context, relayID string) error
     RemoveRelay(ctx context.Context, relayID string) error
     MoveRelay(ctx context.Context, relayID string, siteID string) error
+    SetRelaySubscription(ctx context.Context, relayID string, subscription map[string][]string) error
+    GetRelaySubscription(relayID string) (map[string][]string, error)
     AddSite(ctx context.Context, siteID string) error
     RemoveSite(ctx context.Context, siteID string) error
     Batch(siteID string, bucket string, updateBatch *UpdateBatch) (BatchResult, error)
+    ExportBundle(siteID string, bucket string, request ExportRequest) (*Bundle, error)
+    ImportBundle(siteID string, bucket string, bundle *Bundle) (BatchResult, error)
     LocalBatch(partition uint64, siteID string, bucket string, updateBatch *UpdateBatch) (map[string]*SiblingSet, error)
     LocalMerge(partition uint64, siteID string, bucket string, patch map[string]*SiblingSet, broadcastToRelays bool) error
     Get(siteID string, bucket string, keys [][]byte) ([]*SiblingSet, error)
     LocalGet(partition uint64, siteID string, bucket string, keys [][]byte) ([]*SiblingSet, error)
     GetMatches(siteID string, bucket string, keys [][]byte) (SiblingSetIterator, error)
     LocalGetMatches(partition uint64, siteID string, bucket string, keys [][]byte) (SiblingSetIterator, error)
+    Watch(ctx context.Context, siteID string, bucket string, keys [][]byte, prefixes [][]byte, replica uint64, lastSerial uint64, ch chan Row) (uint64, error)
+    LocalWatch(ctx context.Context, partition uint64, siteID string, bucket string, keys [][]byte, prefixes [][]byte, lastSerial uint64, ch chan Row) error
     AcceptRelayConnection(conn *websocket.Conn, header http.Header)
     ClusterNodes() []NodeConfig
     ClusterSettings() ClusterSettings
@@ -67,4 +86,23 @@ type ClusterFacade interface {
     ClusterSnapshot(ctx context.Context) (Snapshot, error)
     CheckLocalSnapshotStatus(snapshotId string) error
     WriteLocalSnapshot(snapshotId string, w io.Writer) error
+    LogRelayEvents(relayID string, events []*Event) error
+    QueryRelayEvents(ctx context.Context, siteID string, relayID string, query *HistoryQuery) (RelayEventIterator, error)
+    AggregateRelayEvents(siteID string, relayID string, query *AggregationQuery) ([]*AggregateBucket, error)
+    SiteHistoryRetention(siteID string) (HistoryRetention, error)
+    SetSiteHistoryRetention(siteID string, retention HistoryRetention) error
+    LocalLogRelayEvents(siteID string, relayID string, events []*Event) error
+    LocalQueryRelayEvents(siteID string, relayID string, query *HistoryQuery) (RelayEventIterator, error)
+    LocalAggregateRelayEvents(siteID string, relayID string, query *AggregationQuery) ([]*AggregateBucket, error)
+    LocalSiteHistoryRetention(siteID string) (HistoryRetention, error)
+    LocalSetSiteHistoryRetention(siteID string, retention HistoryRetention) error
+    LogRelayAlerts(relayID string, alerts []Alert) error
+    RelayAlerts(siteID string, levels []string) ([]RelayAlert, error)
+    LocalApplyRelayAlerts(siteID string, relayID string, op RelayAlertsOp) error
+    LocalRelayAlerts(siteID string, levels []string) ([]RelayAlert, error)
+    LocalRelayAlertStates(siteID string) ([]RelayAlert, error)
+    SetWebhook(ctx context.Context, webhookID string, webhook *Webhook) error
+    Webhooks() map[string]Webhook
+    WebhookStatus(ctx context.Context, webhookID string) (webhooks.Status, error)
+    LocalWebhookStatus(webhookID string) (webhooks.Status, error)
 }
\ No newline at end of file
@@ -0,0 +1,390 @@
+package routes
+//
+ // Copyright (c) 2019 ARM Limited.
+ //
+ // SPDX-License-Identifier: MIT
+ //
+ // Permission is hereby granted, free of charge, to any person obtaining a copy
+ // of this software and associated documentation files (the "Software"), to
+ // deal in the Software without restriction, including without limitation the
+ // rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ // sell copies of the Software, and to permit persons to whom the Software is
+ // furnished to do so, subject to the following conditions:
+ //
+ // The above copyright notice and this permission notice shall be included in all
+ // copies or substantial portions of the Software.
+ //
+ // THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ // IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ // FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ // AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ // LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ // SOFTWARE.
+ //
+
+
+import (
+    "compress/gzip"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net/http"
+    "github.com/gorilla/mux"
+
+    . "github.com/armPelionEdge/devicedb/error"
+    . "github.com/armPelionEdge/devicedb/historian"
+    . "github.com/armPelionEdge/devicedb/logging"
+)
+
+// HistoryEndpoint lets the cluster stand in for the history service
+// that relays forward their events to. Relays should have their
+// historyURI pointed at /history on the relay port
+type HistoryEndpoint struct {
+    ClusterFacade ClusterFacade
+}
+
+// relayIdentity is the ID of the relay that made a request. It comes
+// from the relay's client certificate when the request was made over
+// TLS. Otherwise the request came through the internal port and the
+// relay is named in the same header used for proxied sync connections
+func relayIdentity(r *http.Request) string {
+    if r.TLS != nil && len(r.TLS.VerifiedChains) == 1 {
+        return r.TLS.VerifiedChains[0][0].Subject.CommonName
+    }
+
+    return r.Header.Get("X-WigWag-RelayID")
+}
+
+func (historyEndpoint *HistoryEndpoint) Attach(router *mux.Router) {
+    // Accept a batch of events forwarded by a relay
+    router.HandleFunc("/history", func(w http.ResponseWriter, r *http.Request) {
+        relayID := relayIdentity(r)
+
+        if relayID == "" {
+            Log.Warningf("POST /history: Unable to identify relay")
+
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusUnauthorized)
+            io.WriteString(w, string(EUnauthorized.JSON()) + "\n")
+
+            return
+        }
+
+        var body io.Reader = r.Body
+
+        if r.Header.Get("Content-Encoding") == "gzip" {
+            gzipReader, err := gzip.NewReader(r.Body)
+
+            if err != nil {
+                Log.Warningf("POST /history: Unable to decompress body: %v", err)
+
+                w.Header().Set("Content-Type", "application/json; charset=utf8")
+                w.WriteHeader(http.StatusBadRequest)
+                io.WriteString(w, string(EReadBody.JSON()) + "\n")
+
+                return
+            }
+
+            defer gzipReader.Close()
+
+            body = gzipReader
+        }
+
+        var forwardedEvents []ForwardedEvent
+
+        if err := json.NewDecoder(body).Decode(&forwardedEvents); err != nil {
+            Log.Warningf("POST /history: Unable to parse events from relay %s: %v", relayID, err)
+
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusBadRequest)
+            io.WriteString(w, string(EReadBody.JSON()) + "\n")
+
+            return
+        }
+
+        var events []*Event = make([]*Event, len(forwardedEvents))
+
+        for i, _ := range forwardedEvents {
+            events[i] = forwardedEvents[i].ToEvent()
+        }
+
+        err := historyEndpoint.ClusterFacade.LogRelayEvents(relayID, events)
+
+        if err == ERelayDoesNotExist {
+            Log.Warningf("POST /history: Relay %s does not belong to a site", relayID)
+
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusNotFound)
+            io.WriteString(w, string(ERelayDoesNotExist.JSON()) + "\n")
+
+            return
+        }
+
+        if err != nil {
+            Log.Warningf("POST /history: Unable to log events from relay %s: %v", relayID, err)
+
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusInternalServerError)
+            io.WriteString(w, "\n")
+
+            return
+        }
+
+        w.Header().Set("Content-Type", "application/json; charset=utf8")
+        w.WriteHeader(http.StatusOK)
+        io.WriteString(w, "\n")
+    }).Methods("POST")
+
+    // Query the events forwarded by a relay. Takes the same query
+    // parameters as GET /events on a relay. With local set only the
+    // history kept by this node is queried
+    router.HandleFunc("/sites/{siteID}/relays/{relayID}/events", func(w http.ResponseWriter, r *http.Request) {
+        historyQuery, err := ParseHistoryQuery(r.URL.Query())
+
+        if err != nil {
+            Log.Warningf("GET /sites/{siteID}/relays/{relayID}/events: %v", err)
+
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusBadRequest)
+            io.WriteString(w, string(ERequestQuery.JSON()) + "\n")
+
+            return
+        }
+
+        var eventIterator RelayEventIterator
+
+        _, local := r.URL.Query()["local"]
+
+        if local {
+            eventIterator, err = historyEndpoint.ClusterFacade.LocalQueryRelayEvents(mux.Vars(r)["siteID"], mux.Vars(r)["relayID"], &historyQuery)
+        } else {
+            eventIterator, err = historyEndpoint.ClusterFacade.QueryRelayEvents(r.Context(), mux.Vars(r)["siteID"], mux.Vars(r)["relayID"], &historyQuery)
+        }
+
+        if err == ESiteDoesNotExist {
+            Log.Warningf("GET /sites/{siteID}/relays/{relayID}/events: Site does not exist")
+
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusNotFound)
+            io.WriteString(w, string(ESiteDoesNotExist.JSON()) + "\n")
+
+            return
+        }
+
+        if err != nil {
+            Log.Warningf("GET /sites/{siteID}/relays/{relayID}/events: %v", err)
+
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusInternalServerError)
+            io.WriteString(w, "\n")
+
+            return
+        }
+
+        defer eventIterator.Release()
+
+        flusher, _ := w.(http.Flusher)
+
+        w.Header().Set("Content-Type", "application/json; charset=utf8")
+        w.Header().Set("X-Content-Type-Options", "nosniff")
+        w.WriteHeader(http.StatusOK)
+
+        for eventIterator.Next() {
+            eventJSON, _ := json.Marshal(eventIterator.Event())
+
+            if _, err := fmt.Fprintf(w, "%s\n", string(eventJSON)); err != nil {
+                return
+            }
+
+            if flusher != nil {
+                flusher.Flush()
+            }
+        }
+    }).Methods("GET")
+
+    // Summarize the events forwarded by a relay in time buckets. Takes
+    // the same query parameters as GET /events/aggregate on a relay. With
+    // local set only the history kept by this node is summarized
+    router.HandleFunc("/sites/{siteID}/relays/{relayID}/events/aggregate", func(w http.ResponseWriter, r *http.Request) {
+        aggregationQuery, err := ParseAggregationQuery(r.URL.Query())
+
+        if err != nil {
+            Log.Warningf("GET /sites/{siteID}/relays/{relayID}/events/aggregate: %v", err)
+
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusBadRequest)
+            io.WriteString(w, string(ERequestQuery.JSON()) + "\n")
+
+            return
+        }
+
+        var buckets []*AggregateBucket
+
+        _, local := r.URL.Query()["local"]
+
+        if local {
+            buckets, err = historyEndpoint.ClusterFacade.LocalAggregateRelayEvents(mux.Vars(r)["siteID"], mux.Vars(r)["relayID"], &aggregationQuery)
+        } else {
+            buckets, err = historyEndpoint.ClusterFacade.AggregateRelayEvents(mux.Vars(r)["siteID"], mux.Vars(r)["relayID"], &aggregationQuery)
+        }
+
+        if err == ESiteDoesNotExist {
+            Log.Warningf("GET /sites/{siteID}/relays/{relayID}/events/aggregate: Site does not exist")
+
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusNotFound)
+            io.WriteString(w, string(ESiteDoesNotExist.JSON()) + "\n")
+
+            return
+        }
+
+        if err != nil {
+            Log.Warningf("GET /sites/{siteID}/relays/{relayID}/events/aggregate: %v", err)
+
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusInternalServerError)
+            io.WriteString(w, "\n")
+
+            return
+        }
+
+        encodedBuckets, err := json.Marshal(buckets)
+
+        if err != nil {
+            Log.Warningf("GET /sites/{siteID}/relays/{relayID}/events/aggregate: Unable to encode aggregate buckets: %v", err)
+
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusInternalServerError)
+            io.WriteString(w, "\n")
+
+            return
+        }
+
+        w.Header().Set("Content-Type", "application/json; charset=utf8")
+        w.WriteHeader(http.StatusOK)
+        io.WriteString(w, string(encodedBuckets) + "\n")
+    }).Methods("GET")
+
+    // Get how many events are kept for each relay in a site. With local
+    // set the setting kept by this node is returned
+    router.HandleFunc("/sites/{siteID}/history/retention", func(w http.ResponseWriter, r *http.Request) {
+        var retention HistoryRetention
+        var err error
+
+        _, local := r.URL.Query()["local"]
+
+        if local {
+            retention, err = historyEndpoint.ClusterFacade.LocalSiteHistoryRetention(mux.Vars(r)["siteID"])
+        } else {
+            retention, err = historyEndpoint.ClusterFacade.SiteHistoryRetention(mux.Vars(r)["siteID"])
+        }
+
+        if err == ESiteDoesNotExist {
+            Log.Warningf("GET /sites/{siteID}/history/retention: Site does not exist")
+
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusNotFound)
+            io.WriteString(w, string(ESiteDoesNotExist.JSON()) + "\n")
+
+            return
+        }
+
+        if err != nil {
+            Log.Warningf("GET /sites/{siteID}/history/retention: %v", err)
+
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusInternalServerError)
+            io.WriteString(w, "\n")
+
+            return
+        }
+
+        encodedRetention, _ := json.Marshal(retention)
+
+        w.Header().Set("Content-Type", "application/json; charset=utf8")
+        w.WriteHeader(http.StatusOK)
+        io.WriteString(w, string(encodedRetention) + "\n")
+    }).Methods("GET")
+
+    // Set how many events are kept for each relay in a site. With local
+    // set only the setting kept by this node is changed
+    router.HandleFunc("/sites/{siteID}/history/retention", func(w http.ResponseWriter, r *http.Request) {
+        var retention HistoryRetention
+
+        if err := json.NewDecoder(r.Body).Decode(&retention); err != nil {
+            Log.Warningf("PUT /sites/{siteID}/history/retention: Unable to parse retention body: %v", err)
+
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusBadRequest)
+            io.WriteString(w, string(EReadBody.JSON()) + "\n")
+
+            return
+        }
+
+        var err error
+
+        _, local := r.URL.Query()["local"]
+
+        if local {
+            err = historyEndpoint.ClusterFacade.LocalSetSiteHistoryRetention(mux.Vars(r)["siteID"], retention)
+        } else {
+            err = historyEndpoint.ClusterFacade.SetSiteHistoryRetention(mux.Vars(r)["siteID"], retention)
+        }
+
+        if err == ESiteDoesNotExist {
+            Log.Warningf("PUT /sites/{siteID}/history/retention: Site does not exist")
+
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusNotFound)
+            io.WriteString(w, string(ESiteDoesNotExist.JSON()) + "\n")
+
+            return
+        }
+
+        if err != nil {
+            Log.Warningf("PUT /sites/{siteID}/history/retention: %v", err)
+
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusInternalServerError)
+            io.WriteString(w, "\n")
+
+            return
+        }
+
+        w.Header().Set("Content-Type", "application/json; charset=utf8")
+        w.WriteHeader(http.StatusOK)
+        io.WriteString(w, "\n")
+    }).Methods("PUT")
+
+    // Append events to the history of a relay kept by this node. The
+    // node that received the events from the relay sends them to each
+    // owner of the site's partition
+    router.HandleFunc("/sites/{siteID}/relays/{relayID}/events", func(w http.ResponseWriter, r *http.Request) {
+        var events []*Event
+
+        if err := json.NewDecoder(r.Body).Decode(&events); err != nil {
+            Log.Warningf("POST /sites/{siteID}/relays/{relayID}/events: Unable to parse events: %v", err)
+
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusBadRequest)
+            io.WriteString(w, string(EReadBody.JSON()) + "\n")
+
+            return
+        }
+
+        if err := historyEndpoint.ClusterFacade.LocalLogRelayEvents(mux.Vars(r)["siteID"], mux.Vars(r)["relayID"], events); err != nil {
+            Log.Warningf("POST /sites/{siteID}/relays/{relayID}/events: %v", err)
+
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusInternalServerError)
+            io.WriteString(w, "\n")
+
+            return
+        }
+
+        w.Header().Set("Content-Type", "application/json; charset=utf8")
+        w.WriteHeader(http.StatusOK)
+        io.WriteString(w, "\n")
+    }).Methods("POST")
+}
@@ -0,0 +1,521 @@
+package routes_test
+//
+ // Copyright (c) 2019 ARM Limited.
+ //
+ // SPDX-License-Identifier: MIT
+ //
+ // Permission is hereby granted, free of charge, to any person obtaining a copy
+ // of this software and associated documentation files (the "Software"), to
+ // deal in the Software without restriction, including without limitation the
+ // rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ // sell copies of the Software, and to permit persons to whom the Software is
+ // furnished to do so, subject to the following conditions:
+ //
+ // The above copyright notice and this permission notice shall be included in all
+ // copies or substantial portions of the Software.
+ //
+ // THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ // IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ // FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ // AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ // LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ // SOFTWARE.
+ //
+
+
+import (
+    "bytes"
+    "compress/gzip"
+    "encoding/json"
+    "errors"
+    "math"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+
+    . "github.com/armPelionEdge/devicedb/error"
+    . "github.com/armPelionEdge/devicedb/historian"
+    . "github.com/armPelionEdge/devicedb/routes"
+    . "github.com/armPelionEdge/devicedb/storage"
+    . "github.com/armPelionEdge/devicedb/util"
+
+    . "github.com/onsi/ginkgo"
+    . "github.com/onsi/gomega"
+
+    "github.com/gorilla/mux"
+)
+
+var _ = Describe("History", func() {
+    var router *mux.Router
+    var historyEndpoint *HistoryEndpoint
+    var clusterFacade *MockClusterFacade
+
+    BeforeEach(func() {
+        clusterFacade = &MockClusterFacade{ }
+        router = mux.NewRouter()
+        historyEndpoint = &HistoryEndpoint{
+            ClusterFacade: clusterFacade,
+        }
+        historyEndpoint.Attach(router)
+    })
+
+    Describe("/history", func() {
+        Describe("POST", func() {
+            Context("When the relay cannot be identified", func() {
+                It("Should respond with status code http.StatusUnauthorized", func() {
+                    req, err := http.NewRequest("POST", "/history", strings.NewReader("[]"))
+
+                    Expect(err).Should(BeNil())
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    Expect(rr.Code).Should(Equal(http.StatusUnauthorized))
+                })
+            })
+
+            Context("When the request body cannot be parsed", func() {
+                It("Should respond with status code http.StatusBadRequest", func() {
+                    req, err := http.NewRequest("POST", "/history", strings.NewReader("asdf"))
+                    req.Header.Set("X-WigWag-RelayID", "WWRL000000")
+
+                    Expect(err).Should(BeNil())
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    Expect(rr.Code).Should(Equal(http.StatusBadRequest))
+                })
+            })
+
+            Context("When the request body is a gzip compressed batch of events", func() {
+                It("Should call LogRelayEvents() on the node facade with the decoded events", func() {
+                    var body bytes.Buffer
+                    gzipWriter := gzip.NewWriter(&body)
+                    gzipWriter.Write([]byte(`[{"device":"d1","event":"type1","metadata":{"a":1},"timestamp":5,"uuid":"abc"},{"device":"d2","event":"type2","metadata":"text","timestamp":6}]`))
+                    gzipWriter.Close()
+
+                    req, err := http.NewRequest("POST", "/history", &body)
+                    req.Header.Set("X-WigWag-RelayID", "WWRL000000")
+                    req.Header.Set("Content-Encoding", "gzip")
+
+                    Expect(err).Should(BeNil())
+
+                    logRelayEventsCalled := make(chan int, 1)
+                    clusterFacade.logRelayEventsCB = func(relayID string, events []*Event) {
+                        Expect(relayID).Should(Equal("WWRL000000"))
+                        Expect(events).Should(Equal([]*Event{
+                            &Event{ SourceID: "d1", Type: "type1", Data: `{"a":1}`, Timestamp: 5, UUID: "abc" },
+                            &Event{ SourceID: "d2", Type: "type2", Data: "text", Timestamp: 6 },
+                        }))
+                        logRelayEventsCalled <- 1
+                    }
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    select {
+                    case <-logRelayEventsCalled:
+                    default:
+                        Fail("Should have invoked LogRelayEvents()")
+                    }
+
+                    Expect(rr.Code).Should(Equal(http.StatusOK))
+                })
+            })
+
+            Context("When LogRelayEvents() returns ERelayDoesNotExist", func() {
+                It("Should respond with status code http.StatusNotFound", func() {
+                    req, err := http.NewRequest("POST", "/history", strings.NewReader("[]"))
+                    req.Header.Set("X-WigWag-RelayID", "WWRL000000")
+                    clusterFacade.defaultLogRelayEventsResponse = ERelayDoesNotExist
+
+                    Expect(err).Should(BeNil())
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    Expect(rr.Code).Should(Equal(http.StatusNotFound))
+                })
+            })
+
+            Context("When LogRelayEvents() returns any other error", func() {
+                It("Should respond with status code http.StatusInternalServerError", func() {
+                    req, err := http.NewRequest("POST", "/history", strings.NewReader("[]"))
+                    req.Header.Set("X-WigWag-RelayID", "WWRL000000")
+                    clusterFacade.defaultLogRelayEventsResponse = errors.New("Some error")
+
+                    Expect(err).Should(BeNil())
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    Expect(rr.Code).Should(Equal(http.StatusInternalServerError))
+                })
+            })
+        })
+    })
+
+    Describe("/sites/{siteID}/relays/{relayID}/events", func() {
+        Describe("GET", func() {
+            var storageDriver StorageDriver
+
+            BeforeEach(func() {
+                storageDriver = MakeNewStorageDriver()
+                storageDriver.Open()
+            })
+
+            AfterEach(func() {
+                storageDriver.Close()
+            })
+
+            Context("When the query parameters are invalid", func() {
+                It("Should respond with status code http.StatusBadRequest", func() {
+                    req, err := http.NewRequest("GET", "/sites/site1/relays/WWRL000000/events?minSerial=abc", nil)
+
+                    Expect(err).Should(BeNil())
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    Expect(rr.Code).Should(Equal(http.StatusBadRequest))
+                })
+            })
+
+            Context("When the site does not exist", func() {
+                It("Should respond with status code http.StatusNotFound", func() {
+                    req, err := http.NewRequest("GET", "/sites/site1/relays/WWRL000000/events", nil)
+                    clusterFacade.defaultQueryRelayEventsError = ESiteDoesNotExist
+
+                    Expect(err).Should(BeNil())
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    Expect(rr.Code).Should(Equal(http.StatusNotFound))
+                })
+            })
+
+            Context("When the query succeeds", func() {
+                It("Should pass the parsed query to QueryRelayEvents() and write one event per line", func() {
+                    historian := NewHistorian(storageDriver, 0, 0, 1000)
+                    historian.LogEvent(&Event{ Timestamp: 1, SourceID: "d1", Type: "type1" })
+                    historian.LogEvent(&Event{ Timestamp: 2, SourceID: "d1", Type: "type1" })
+                    eventIterator, _ := historian.Query(&HistoryQuery{ })
+                    clusterFacade.defaultQueryRelayEventsResponse = eventIterator
+                    clusterFacade.queryRelayEventsCB = func(siteID string, relayID string, query *HistoryQuery) {
+                        Expect(siteID).Should(Equal("site1"))
+                        Expect(relayID).Should(Equal("WWRL000000"))
+                        Expect(query.Sources).Should(Equal([]string{ "d1" }))
+                        Expect(*query.MinSerial).Should(Equal(uint64(1)))
+                        Expect(*query.MaxSerial).Should(Equal(uint64(3)))
+                    }
+
+                    req, err := http.NewRequest("GET", "/sites/site1/relays/WWRL000000/events?source=d1&minSerial=1&maxSerial=3", nil)
+
+                    Expect(err).Should(BeNil())
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    Expect(rr.Code).Should(Equal(http.StatusOK))
+                    Expect(strings.Count(rr.Body.String(), "\n")).Should(Equal(2))
+                })
+            })
+
+            Context("When the local parameter is set", func() {
+                It("Should query the history kept by this node with LocalQueryRelayEvents()", func() {
+                    historian := NewHistorian(storageDriver, 0, 0, 1000)
+                    historian.LogEvent(&Event{ Timestamp: 1, SourceID: "d1", Type: "type1" })
+                    eventIterator, _ := historian.Query(&HistoryQuery{ })
+                    clusterFacade.defaultLocalQueryRelayEventsResponse = eventIterator
+                    clusterFacade.queryRelayEventsCB = func(siteID string, relayID string, query *HistoryQuery) {
+                        Fail("Should not have invoked QueryRelayEvents()")
+                    }
+                    clusterFacade.localQueryRelayEventsCB = func(siteID string, relayID string, query *HistoryQuery) {
+                        Expect(siteID).Should(Equal("site1"))
+                        Expect(relayID).Should(Equal("WWRL000000"))
+                        Expect(query.Sources).Should(Equal([]string{ "d1" }))
+                    }
+
+                    req, err := http.NewRequest("GET", "/sites/site1/relays/WWRL000000/events?source=d1&local=true", nil)
+
+                    Expect(err).Should(BeNil())
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    Expect(rr.Code).Should(Equal(http.StatusOK))
+                    Expect(strings.Count(rr.Body.String(), "\n")).Should(Equal(1))
+                })
+            })
+        })
+
+        Describe("POST", func() {
+            Context("When the request body cannot be parsed", func() {
+                It("Should respond with status code http.StatusBadRequest", func() {
+                    req, err := http.NewRequest("POST", "/sites/site1/relays/WWRL000000/events", strings.NewReader("asdf"))
+
+                    Expect(err).Should(BeNil())
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    Expect(rr.Code).Should(Equal(http.StatusBadRequest))
+                })
+            })
+
+            It("Should log the decoded events with LocalLogRelayEvents()", func() {
+                localLogRelayEventsCalled := make(chan int, 1)
+                clusterFacade.localLogRelayEventsCB = func(siteID string, relayID string, events []*Event) {
+                    Expect(siteID).Should(Equal("site1"))
+                    Expect(relayID).Should(Equal("WWRL000000"))
+                    Expect(events).Should(Equal([]*Event{ &Event{ Timestamp: 5, SourceID: "d1", Type: "type1", Data: "on", UUID: "abc" } }))
+                    localLogRelayEventsCalled <- 1
+                }
+
+                req, err := http.NewRequest("POST", "/sites/site1/relays/WWRL000000/events", strings.NewReader(`[{"timestamp":5,"source":"d1","type":"type1","data":"on","uuid":"abc"}]`))
+
+                Expect(err).Should(BeNil())
+
+                rr := httptest.NewRecorder()
+                router.ServeHTTP(rr, req)
+
+                Expect(rr.Code).Should(Equal(http.StatusOK))
+
+                select {
+                case <-localLogRelayEventsCalled:
+                default:
+                    Fail("Should have invoked LocalLogRelayEvents()")
+                }
+            })
+
+            Context("When LocalLogRelayEvents() returns an error", func() {
+                It("Should respond with status code http.StatusInternalServerError", func() {
+                    clusterFacade.defaultLocalLogRelayEventsResponse = errors.New("Some error")
+
+                    req, err := http.NewRequest("POST", "/sites/site1/relays/WWRL000000/events", strings.NewReader("[]"))
+
+                    Expect(err).Should(BeNil())
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    Expect(rr.Code).Should(Equal(http.StatusInternalServerError))
+                })
+            })
+        })
+    })
+
+    Describe("/sites/{siteID}/relays/{relayID}/events/aggregate", func() {
+        Describe("GET", func() {
+            Context("When the query parameters are invalid", func() {
+                It("Should respond with status code http.StatusBadRequest", func() {
+                    req, err := http.NewRequest("GET", "/sites/site1/relays/WWRL000000/events/aggregate?interval=week", nil)
+
+                    Expect(err).Should(BeNil())
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    Expect(rr.Code).Should(Equal(http.StatusBadRequest))
+                })
+            })
+
+            Context("When the site does not exist", func() {
+                It("Should respond with status code http.StatusNotFound", func() {
+                    req, err := http.NewRequest("GET", "/sites/site1/relays/WWRL000000/events/aggregate", nil)
+                    clusterFacade.defaultAggregateRelayEventsError = ESiteDoesNotExist
+
+                    Expect(err).Should(BeNil())
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    Expect(rr.Code).Should(Equal(http.StatusNotFound))
+                })
+            })
+
+            Context("When the aggregation succeeds", func() {
+                It("Should pass the parsed query to AggregateRelayEvents() and respond with the buckets", func() {
+                    clusterFacade.defaultAggregateRelayEventsResponse = []*AggregateBucket{ &AggregateBucket{ Start: 0, Type: "temperature", Count: 2 } }
+                    clusterFacade.aggregateRelayEventsCB = func(siteID string, relayID string, query *AggregationQuery) {
+                        Expect(siteID).Should(Equal("site1"))
+                        Expect(relayID).Should(Equal("WWRL000000"))
+                        Expect(query.Interval).Should(Equal(AggregationIntervals["day"]))
+                        Expect(query.GroupBy).Should(Equal(AGGREGATE_BY_TYPE))
+                    }
+
+                    req, err := http.NewRequest("GET", "/sites/site1/relays/WWRL000000/events/aggregate?interval=day&groupBy=type", nil)
+
+                    Expect(err).Should(BeNil())
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    var buckets []AggregateBucket
+
+                    Expect(rr.Code).Should(Equal(http.StatusOK))
+                    Expect(json.Unmarshal(rr.Body.Bytes(), &buckets)).Should(BeNil())
+                    Expect(buckets).Should(Equal([]AggregateBucket{ AggregateBucket{ Start: 0, Type: "temperature", Count: 2 } }))
+                })
+            })
+
+            Context("When the buckets cannot be encoded", func() {
+                It("Should respond with status code http.StatusInternalServerError", func() {
+                    nan := math.NaN()
+                    clusterFacade.defaultAggregateRelayEventsResponse = []*AggregateBucket{ &AggregateBucket{ Start: 0, Count: 1, NumericCount: 1, Min: &nan, Max: &nan, Average: &nan } }
+
+                    req, err := http.NewRequest("GET", "/sites/site1/relays/WWRL000000/events/aggregate", nil)
+
+                    Expect(err).Should(BeNil())
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    Expect(rr.Code).Should(Equal(http.StatusInternalServerError))
+                })
+            })
+
+            Context("When the local parameter is set", func() {
+                It("Should summarize the history kept by this node with LocalAggregateRelayEvents()", func() {
+                    clusterFacade.defaultLocalAggregateRelayEventsResponse = []*AggregateBucket{ &AggregateBucket{ Start: 0, Count: 1 } }
+                    clusterFacade.aggregateRelayEventsCB = func(siteID string, relayID string, query *AggregationQuery) {
+                        Fail("Should not have invoked AggregateRelayEvents()")
+                    }
+
+                    req, err := http.NewRequest("GET", "/sites/site1/relays/WWRL000000/events/aggregate?local=true", nil)
+
+                    Expect(err).Should(BeNil())
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    var buckets []AggregateBucket
+
+                    Expect(rr.Code).Should(Equal(http.StatusOK))
+                    Expect(json.Unmarshal(rr.Body.Bytes(), &buckets)).Should(BeNil())
+                    Expect(buckets).Should(Equal([]AggregateBucket{ AggregateBucket{ Start: 0, Count: 1 } }))
+                })
+            })
+        })
+    })
+
+    Describe("/sites/{siteID}/history/retention", func() {
+        Describe("GET", func() {
+            It("Should respond with the retention returned by SiteHistoryRetention()", func() {
+                clusterFacade.defaultSiteHistoryRetentionResponse = HistoryRetention{ EventLimit: 100, EventFloor: 50 }
+
+                req, err := http.NewRequest("GET", "/sites/site1/history/retention", nil)
+
+                Expect(err).Should(BeNil())
+
+                rr := httptest.NewRecorder()
+                router.ServeHTTP(rr, req)
+
+                Expect(rr.Code).Should(Equal(http.StatusOK))
+                Expect(rr.Body.String()).Should(Equal(`{"eventLimit":100,"eventFloor":50}` + "\n"))
+            })
+
+            Context("When the local parameter is set", func() {
+                It("Should respond with the retention returned by LocalSiteHistoryRetention()", func() {
+                    clusterFacade.defaultSiteHistoryRetentionResponse = HistoryRetention{ EventLimit: 100, EventFloor: 50 }
+                    clusterFacade.defaultLocalSiteHistoryRetentionResponse = HistoryRetention{ EventLimit: 10, EventFloor: 5 }
+
+                    req, err := http.NewRequest("GET", "/sites/site1/history/retention?local=true", nil)
+
+                    Expect(err).Should(BeNil())
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    Expect(rr.Code).Should(Equal(http.StatusOK))
+                    Expect(rr.Body.String()).Should(Equal(`{"eventLimit":10,"eventFloor":5}` + "\n"))
+                })
+            })
+        })
+
+        Describe("PUT", func() {
+            Context("When the request body cannot be parsed", func() {
+                It("Should respond with status code http.StatusBadRequest", func() {
+                    req, err := http.NewRequest("PUT", "/sites/site1/history/retention", strings.NewReader("asdf"))
+
+                    Expect(err).Should(BeNil())
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    Expect(rr.Code).Should(Equal(http.StatusBadRequest))
+                })
+            })
+
+            Context("When the site does not exist", func() {
+                It("Should respond with status code http.StatusNotFound", func() {
+                    req, err := http.NewRequest("PUT", "/sites/site1/history/retention", strings.NewReader(`{"eventLimit":100,"eventFloor":50}`))
+                    clusterFacade.defaultSetSiteHistoryRetentionResponse = ESiteDoesNotExist
+
+                    Expect(err).Should(BeNil())
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    Expect(rr.Code).Should(Equal(http.StatusNotFound))
+                })
+            })
+
+            It("Should call SetSiteHistoryRetention() on the node facade with the parsed retention", func() {
+                req, err := http.NewRequest("PUT", "/sites/site1/history/retention", strings.NewReader(`{"eventLimit":100,"eventFloor":50}`))
+
+                Expect(err).Should(BeNil())
+
+                setSiteHistoryRetentionCalled := make(chan int, 1)
+                clusterFacade.setSiteHistoryRetentionCB = func(siteID string, retention HistoryRetention) {
+                    Expect(siteID).Should(Equal("site1"))
+                    Expect(retention).Should(Equal(HistoryRetention{ EventLimit: 100, EventFloor: 50 }))
+                    setSiteHistoryRetentionCalled <- 1
+                }
+
+                rr := httptest.NewRecorder()
+                router.ServeHTTP(rr, req)
+
+                select {
+                case <-setSiteHistoryRetentionCalled:
+                default:
+                    Fail("Should have invoked SetSiteHistoryRetention()")
+                }
+
+                Expect(rr.Code).Should(Equal(http.StatusOK))
+            })
+
+            Context("When the local parameter is set", func() {
+                It("Should call LocalSetSiteHistoryRetention() on the node facade with the parsed retention", func() {
+                    req, err := http.NewRequest("PUT", "/sites/site1/history/retention?local=true", strings.NewReader(`{"eventLimit":100,"eventFloor":50}`))
+
+                    Expect(err).Should(BeNil())
+
+                    localSetSiteHistoryRetentionCalled := make(chan int, 1)
+                    clusterFacade.setSiteHistoryRetentionCB = func(siteID string, retention HistoryRetention) {
+                        Fail("Should not have invoked SetSiteHistoryRetention()")
+                    }
+                    clusterFacade.localSetSiteHistoryRetentionCB = func(siteID string, retention HistoryRetention) {
+                        Expect(siteID).Should(Equal("site1"))
+                        Expect(retention).Should(Equal(HistoryRetention{ EventLimit: 100, EventFloor: 50 }))
+                        localSetSiteHistoryRetentionCalled <- 1
+                    }
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    select {
+                    case <-localSetSiteHistoryRetentionCalled:
+                    default:
+                        Fail("Should have invoked LocalSetSiteHistoryRetention()")
+                    }
+
+                    Expect(rr.Code).Should(Equal(http.StatusOK))
+                })
+            })
+        })
+    })
+})
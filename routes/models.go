@@ -25,10 +25,13 @@ package routes
 
 
 import (
+    "encoding/json"
     "time"
 
+    . "github.com/armPelionEdge/devicedb/alerts"
     . "github.com/armPelionEdge/devicedb/cluster"
     . "github.com/armPelionEdge/devicedb/data"
+    . "github.com/armPelionEdge/devicedb/historian"
     . "github.com/armPelionEdge/devicedb/transport"
 )
 
@@ -44,6 +47,25 @@ type RelayStatus struct {
     ConnectedTo uint64
     Ping time.Duration
     Site string
+    // The number of pushes the relay has yet to acknowledge and how long
+    // the oldest of them has been waiting
+    PushQueueDepth int
+    OldestUnacknowledgedPush time.Duration
+    // The most recent sync session with the relay in each bucket
+    Sync map[string]RelayBucketSync `json:",omitempty"`
+}
+
+type RelayBucketSync struct {
+    LastSessionStart time.Time
+    LastSessionEnd time.Time
+    Outcome string
+    AbortReason string `json:",omitempty"`
+    NodesExplored uint64
+    KeysPushed uint64
+    KeysPulled uint64
+    BytesSent uint64
+    BytesReceived uint64
+    LastRootMatch time.Time
 }
 
 type ClusterOverview struct {
@@ -93,6 +115,12 @@ type RelaySettingsPatch struct {
     Site string `json:"site"`
 }
 
+type RelaySubscription struct {
+    // Maps bucket names to the key prefixes a relay replicates from that
+    // bucket. Buckets that are not listed are replicated in full
+    Buckets map[string][]string `json:"buckets"`
+}
+
 type LogSnapshot struct {
     Index uint64
     State ClusterState
@@ -112,4 +140,52 @@ type LogDump struct {
 type Snapshot struct {
     UUID string `json:"uuid"`
     Status string `json:"status"`
-}
\ No newline at end of file
+}
+
+// ForwardedEvent is the encoding relays use for the events they forward
+// to the history service
+type ForwardedEvent struct {
+    Device string `json:"device"`
+    Event string `json:"event"`
+    Metadata interface{} `json:"metadata"`
+    Timestamp uint64 `json:"timestamp"`
+    UUID string `json:"uuid,omitempty"`
+    Groups []string `json:"groups,omitempty"`
+}
+
+func (forwardedEvent *ForwardedEvent) ToEvent() *Event {
+    var data string
+
+    if metadata, ok := forwardedEvent.Metadata.(string); ok {
+        data = metadata
+    } else if forwardedEvent.Metadata != nil {
+        encodedMetadata, _ := json.Marshal(forwardedEvent.Metadata)
+        data = string(encodedMetadata)
+    }
+
+    return &Event{
+        Timestamp: forwardedEvent.Timestamp,
+        SourceID: forwardedEvent.Device,
+        Type: forwardedEvent.Event,
+        Data: data,
+        UUID: forwardedEvent.UUID,
+        Groups: forwardedEvent.Groups,
+    }
+}
+
+// The operations that keep the alert state of a relay the same at each
+// owner of its site's partition
+const (
+    RelayAlertsUpdate string = "update"
+    RelayAlertsTouch string = "touch"
+    RelayAlertsMarkStale string = "stale"
+    RelayAlertsForget string = "forget"
+)
+
+// RelayAlertsOp is sent to each owner of a site's partition to apply
+// the same change to the alert state of a relay at each of them
+type RelayAlertsOp struct {
+    Op string `json:"op"`
+    Alerts []Alert `json:"alerts,omitempty"`
+    Timestamp uint64 `json:"timestamp"`
+}
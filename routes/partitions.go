@@ -26,6 +26,7 @@ package routes
 
 import (
     "encoding/json"
+    "fmt"
     "github.com/gorilla/mux"
     "io"
     "net/http"
@@ -368,4 +369,103 @@ func (partitionsEndpoint *PartitionsEndpoint) Attach(router *mux.Router) {
             return
         }
     }).Methods("GET")
+
+    // Stream updates from the local replica of a site bucket
+    router.HandleFunc("/partitions/{partitionID}/sites/{siteID}/buckets/{bucketID}/watch", func(w http.ResponseWriter, r *http.Request) {
+        query := r.URL.Query()
+        partitionID, err := strconv.ParseUint(mux.Vars(r)["partitionID"], 10, 64)
+
+        if err != nil {
+            Log.Warningf("GET /partitions/{partitionID}/sites/{siteID}/buckets/{bucketID}/watch: Unable to parse partition ID as uint64: %v", err)
+            
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusBadRequest)
+            io.WriteString(w, "\n")
+            
+            return
+        }
+
+        var keys [][]byte = make([][]byte, len(query["key"]))
+        var prefixes [][]byte = make([][]byte, len(query["prefix"]))
+        var lastSerial uint64
+
+        for i, key := range query["key"] {
+            keys[i] = []byte(key)
+        }
+
+        for i, prefix := range query["prefix"] {
+            prefixes[i] = []byte(prefix)
+        }
+
+        if query.Get("lastSerial") != "" {
+            lastSerial, err = strconv.ParseUint(query.Get("lastSerial"), 10, 64)
+
+            if err != nil {
+                Log.Warningf("GET /partitions/{partitionID}/sites/{siteID}/buckets/{bucketID}/watch: Invalid lastSerial specified")
+
+                w.Header().Set("Content-Type", "application/json; charset=utf8")
+                w.WriteHeader(http.StatusBadRequest)
+                io.WriteString(w, string(EInvalidKey.JSON()) + "\n")
+                
+                return
+            }
+        }
+
+        var ch chan Row = make(chan Row)
+
+        err = partitionsEndpoint.ClusterFacade.LocalWatch(r.Context(), partitionID, mux.Vars(r)["siteID"], mux.Vars(r)["bucketID"], keys, prefixes, lastSerial, ch)
+
+        if err == ENoSuchPartition || err == ENoSuchBucket || err == ENoSuchSite {
+            var responseBody string
+
+            switch err {
+            case ENoSuchBucket:
+                responseBody = string(EBucketDoesNotExist.JSON())
+            case ENoSuchSite:
+                responseBody = string(ESiteDoesNotExist.JSON())
+            }
+
+            Log.Warningf("GET /partitions/{partitionID}/sites/{siteID}/buckets/{bucketID}/watch: %v", err)
+            
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusNotFound)
+            io.WriteString(w, responseBody + "\n")
+
+            return
+        }
+
+        if err != nil {
+            Log.Warningf("GET /partitions/{partitionID}/sites/{siteID}/buckets/{bucketID}/watch: %v", err.Error())
+
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusInternalServerError)
+            io.WriteString(w, "\n")
+            
+            return
+        }
+
+        flusher, _ := w.(http.Flusher)
+
+        w.Header().Set("Content-Type", "text/event-stream")
+        w.Header().Set("Cache-Control", "no-cache")
+        w.Header().Set("Connection", "keep-alive")
+        w.WriteHeader(http.StatusOK)
+        flusher.Flush()
+
+        // Rows are forwarded as they are, including empty markers, so
+        // the node serving the public watch can treat them exactly like
+        // rows from a local replica. The channel must be read until it
+        // is closed or it will block future updates
+        for row := range ch {
+            encodedRow, err := json.Marshal(row)
+
+            if err != nil {
+                Log.Errorf("Encountered an error while encoding an update to JSON: %v", err)
+                continue
+            }
+
+            fmt.Fprintf(w, "data: %s\n\n", string(encodedRow))
+            flusher.Flush()
+        }
+    }).Methods("GET")
 }
\ No newline at end of file
@@ -25,6 +25,7 @@ package routes_test
 
 
 import (
+    "context"
     "errors"
     "encoding/json"
     "net/http"
@@ -974,4 +975,86 @@ var _ = Describe("Partitions", func() {
             })
         })
     })
+
+    Describe("/partitions/{partitionID}/sites/{siteID}/buckets/{bucketID}/watch", func() {
+        Describe("GET", func() {
+            Context("When the partition ID cannot be parsed as a base 10 encoded uint64", func() {
+                It("Should respond with status code http.StatusBadRequest", func() {
+                    req, err := http.NewRequest("GET", "/partitions/asdf/sites/site1/buckets/default/watch", nil)
+
+                    Expect(err).Should(BeNil())
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    Expect(rr.Code).Should(Equal(http.StatusBadRequest))
+                })
+            })
+
+            Context("When LocalWatch() returns ENoSuchSite", func() {
+                It("Should respond with status code http.StatusNotFound and an ESiteDoesNotExist body", func() {
+                    req, err := http.NewRequest("GET", "/partitions/45/sites/site1/buckets/default/watch", nil)
+                    clusterFacade.defaultLocalWatchError = ENoSuchSite
+
+                    Expect(err).Should(BeNil())
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    var encodedDBError DBerror
+
+                    Expect(rr.Code).Should(Equal(http.StatusNotFound))
+                    Expect(json.Unmarshal(rr.Body.Bytes(), &encodedDBError)).Should(BeNil())
+                    Expect(encodedDBError).Should(Equal(ESiteDoesNotExist))
+                })
+            })
+
+            Context("When LocalWatch() returns some other error", func() {
+                It("Should respond with status code http.StatusInternalServerError", func() {
+                    req, err := http.NewRequest("GET", "/partitions/45/sites/site1/buckets/default/watch", nil)
+                    clusterFacade.defaultLocalWatchError = errors.New("Some error")
+
+                    Expect(err).Should(BeNil())
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    Expect(rr.Code).Should(Equal(http.StatusInternalServerError))
+                })
+            })
+
+            Context("When LocalWatch() succeeds", func() {
+                It("Should stream every row it receives, including empty markers, as JSON encoded server-sent events", func() {
+                    req, err := http.NewRequest("GET", "/partitions/45/sites/site1/buckets/default/watch?key=a&lastSerial=7", nil)
+
+                    Expect(err).Should(BeNil())
+
+                    var row Row = Row{ Key: "a", LocalVersion: 8, Siblings: NewSiblingSet(map[*Sibling]bool{ }) }
+                    encodedRow, _ := json.Marshal(row)
+                    encodedMarker, _ := json.Marshal(Row{ })
+
+                    clusterFacade.localWatchCB = func(ctx context.Context, partition uint64, siteID string, bucket string, keys [][]byte, prefixes [][]byte, lastSerial uint64, ch chan Row) {
+                        Expect(partition).Should(Equal(uint64(45)))
+                        Expect(siteID).Should(Equal("site1"))
+                        Expect(bucket).Should(Equal("default"))
+                        Expect(keys).Should(Equal([][]byte{ []byte("a") }))
+                        Expect(prefixes).Should(BeEmpty())
+                        Expect(lastSerial).Should(Equal(uint64(7)))
+
+                        go func() {
+                            ch <- Row{ }
+                            ch <- row
+                            close(ch)
+                        }()
+                    }
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    Expect(rr.Code).Should(Equal(http.StatusOK))
+                    Expect(rr.Body.String()).Should(Equal("data: " + string(encodedMarker) + "\n\ndata: " + string(encodedRow) + "\n\n"))
+                })
+            })
+        })
+    })
 })
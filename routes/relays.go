@@ -181,4 +181,97 @@ func (relaysEndpoint *RelaysEndpoint) Attach(router *mux.Router) {
         w.WriteHeader(http.StatusOK)
         io.WriteString(w, string(encodedStatus) + "\n")
     }).Methods("GET")
-}
\ No newline at end of file
+
+    // Get the key prefixes that are replicated to a relay
+    router.HandleFunc("/relays/{relayID}/subscription", func(w http.ResponseWriter, r *http.Request) {
+        subscription, err := relaysEndpoint.ClusterFacade.GetRelaySubscription(mux.Vars(r)["relayID"])
+
+        if err == ENoSuchRelay {
+            Log.Warningf("GET /relays/{relayID}/subscription: Relay does not exist")
+            
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusNotFound)
+            io.WriteString(w, string(ERelayDoesNotExist.JSON()) + "\n")
+            
+            return
+        }
+
+        if err != nil {
+            Log.Warningf("GET /relays/{relayID}/subscription: %v", err.Error())
+            
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusInternalServerError)
+            io.WriteString(w, "\n")
+            
+            return
+        }
+
+        encodedSubscription, _ := json.Marshal(RelaySubscription{ Buckets: subscription })
+
+        w.Header().Set("Content-Type", "application/json; charset=utf8")
+        w.WriteHeader(http.StatusOK)
+        io.WriteString(w, string(encodedSubscription) + "\n")
+    }).Methods("GET")
+
+    // Restrict replication to a relay to a set of key prefixes per bucket
+    router.HandleFunc("/relays/{relayID}/subscription", func(w http.ResponseWriter, r *http.Request) {
+        body, err := ioutil.ReadAll(r.Body)
+
+        if err != nil {
+            Log.Warningf("PUT /relays/{relayID}/subscription: %v", err)
+            
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusBadRequest)
+            io.WriteString(w, string(EReadBody.JSON()) + "\n")
+            
+            return
+        }
+
+        var subscription RelaySubscription
+
+        if err := json.Unmarshal(body, &subscription); err != nil {
+            Log.Warningf("PUT /relays/{relayID}/subscription: Unable to parse relay subscription body")
+            
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusBadRequest)
+            io.WriteString(w, string(EReadBody.JSON()) + "\n")
+            
+            return
+        }
+
+        relaysEndpoint.setSubscription(w, r, "PUT", subscription.Buckets)
+    }).Methods("PUT")
+
+    // Remove any restriction so the relay replicates entire buckets again
+    router.HandleFunc("/relays/{relayID}/subscription", func(w http.ResponseWriter, r *http.Request) {
+        relaysEndpoint.setSubscription(w, r, "DELETE", nil)
+    }).Methods("DELETE")
+}
+
+func (relaysEndpoint *RelaysEndpoint) setSubscription(w http.ResponseWriter, r *http.Request, method string, subscription map[string][]string) {
+    err := relaysEndpoint.ClusterFacade.SetRelaySubscription(r.Context(), mux.Vars(r)["relayID"], subscription)
+
+    if err == ENoSuchRelay {
+        Log.Warningf("%s /relays/{relayID}/subscription: Relay does not exist", method)
+        
+        w.Header().Set("Content-Type", "application/json; charset=utf8")
+        w.WriteHeader(http.StatusNotFound)
+        io.WriteString(w, string(ERelayDoesNotExist.JSON()) + "\n")
+        
+        return
+    }
+
+    if err != nil {
+        Log.Warningf("%s /relays/{relayID}/subscription: %v", method, err.Error())
+        
+        w.Header().Set("Content-Type", "application/json; charset=utf8")
+        w.WriteHeader(http.StatusInternalServerError)
+        io.WriteString(w, "\n")
+        
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json; charset=utf8")
+    w.WriteHeader(http.StatusOK)
+    io.WriteString(w, "\n")
+}
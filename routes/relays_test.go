@@ -352,4 +352,139 @@ var _ = Describe("Relays", func() {
             })
         })
     })
+
+    Describe("/relays/{relayID}/subscription", func() {
+        Describe("GET", func() {
+            Context("And if GetRelaySubscription() returns ENoSuchRelay", func() {
+                It("Should respond with status code http.StatusNotFound", func() {
+                    req, err := http.NewRequest("GET", "/relays/WWRL000000/subscription", nil)
+
+                    clusterFacade.defaultGetRelaySubscriptionError = ENoSuchRelay
+
+                    Expect(err).Should(BeNil())
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    Expect(rr.Code).Should(Equal(http.StatusNotFound))
+                    Expect(strings.TrimSpace(rr.Body.String())).Should(Equal(string(ERelayDoesNotExist.JSON())))
+                })
+            })
+
+            Context("And if GetRelaySubscription() is successful", func() {
+                It("Should respond with status code http.StatusOK and the encoded subscription", func() {
+                    req, err := http.NewRequest("GET", "/relays/WWRL000000/subscription", nil)
+
+                    clusterFacade.defaultGetRelaySubscriptionResponse = map[string][]string{ "default": []string{ "config." } }
+
+                    Expect(err).Should(BeNil())
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    Expect(rr.Code).Should(Equal(http.StatusOK))
+
+                    var subscription RelaySubscription
+
+                    Expect(json.Unmarshal(rr.Body.Bytes(), &subscription)).Should(BeNil())
+                    Expect(subscription.Buckets).Should(Equal(map[string][]string{ "default": []string{ "config." } }))
+                })
+            })
+        })
+
+        Describe("PUT", func() {
+            Context("When the request body cannot be parsed as a RelaySubscription", func() {
+                It("Should respond with status code http.StatusBadRequest", func() {
+                    req, err := http.NewRequest("PUT", "/relays/WWRL000000/subscription", strings.NewReader("asdf"))
+
+                    Expect(err).Should(BeNil())
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    Expect(rr.Code).Should(Equal(http.StatusBadRequest))
+                })
+            })
+
+            It("Should call SetRelaySubscription() on the node facade with the relay ID in the path and the buckets in the body", func() {
+                req, err := http.NewRequest("PUT", "/relays/WWRL000000/subscription", strings.NewReader(`{"buckets":{"default":["config.","schedule."],"lww":[]}}`))
+
+                setRelaySubscriptionCalled := make(chan int, 1)
+                clusterFacade.setRelaySubscriptionCB = func(ctx context.Context, relayID string, subscription map[string][]string) {
+                    Expect(relayID).Should(Equal("WWRL000000"))
+                    Expect(subscription).Should(Equal(map[string][]string{ "default": []string{ "config.", "schedule." }, "lww": []string{ } }))
+                    setRelaySubscriptionCalled <- 1
+                }
+
+                Expect(err).Should(BeNil())
+
+                rr := httptest.NewRecorder()
+                router.ServeHTTP(rr, req)
+
+                select {
+                case <-setRelaySubscriptionCalled:
+                default:
+                    Fail("Should have invoked SetRelaySubscription()")
+                }
+
+                Expect(rr.Code).Should(Equal(http.StatusOK))
+            })
+
+            Context("And if SetRelaySubscription() returns ENoSuchRelay", func() {
+                It("Should respond with status code http.StatusNotFound", func() {
+                    req, err := http.NewRequest("PUT", "/relays/WWRL000000/subscription", strings.NewReader(`{"buckets":{}}`))
+
+                    clusterFacade.defaultSetRelaySubscriptionResponse = ENoSuchRelay
+
+                    Expect(err).Should(BeNil())
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    Expect(rr.Code).Should(Equal(http.StatusNotFound))
+                })
+            })
+
+            Context("And if SetRelaySubscription() returns some other error", func() {
+                It("Should respond with status code http.StatusInternalServerError", func() {
+                    req, err := http.NewRequest("PUT", "/relays/WWRL000000/subscription", strings.NewReader(`{"buckets":{}}`))
+
+                    clusterFacade.defaultSetRelaySubscriptionResponse = errors.New("Some error")
+
+                    Expect(err).Should(BeNil())
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    Expect(rr.Code).Should(Equal(http.StatusInternalServerError))
+                })
+            })
+        })
+
+        Describe("DELETE", func() {
+            It("Should call SetRelaySubscription() on the node facade with an empty subscription", func() {
+                req, err := http.NewRequest("DELETE", "/relays/WWRL000000/subscription", nil)
+
+                setRelaySubscriptionCalled := make(chan int, 1)
+                clusterFacade.setRelaySubscriptionCB = func(ctx context.Context, relayID string, subscription map[string][]string) {
+                    Expect(relayID).Should(Equal("WWRL000000"))
+                    Expect(subscription).Should(BeEmpty())
+                    setRelaySubscriptionCalled <- 1
+                }
+
+                Expect(err).Should(BeNil())
+
+                rr := httptest.NewRecorder()
+                router.ServeHTTP(rr, req)
+
+                select {
+                case <-setRelaySubscriptionCalled:
+                default:
+                    Fail("Should have invoked SetRelaySubscription()")
+                }
+
+                Expect(rr.Code).Should(Equal(http.StatusOK))
+            })
+        })
+    })
 })
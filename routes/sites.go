@@ -25,16 +25,21 @@ package routes
 
 
 import (
+    "crypto/x509"
     "encoding/json"
+    "fmt"
     "io"
     "io/ioutil"
     "github.com/gorilla/mux"
     "github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
     "net/http"
+    "strconv"
 
     . "github.com/armPelionEdge/devicedb/bucket"
+    . "github.com/armPelionEdge/devicedb/bundle"
     . "github.com/armPelionEdge/devicedb/cluster"
+    . "github.com/armPelionEdge/devicedb/data"
     . "github.com/armPelionEdge/devicedb/error"
     . "github.com/armPelionEdge/devicedb/logging"
     . "github.com/armPelionEdge/devicedb/transport"
@@ -67,8 +72,17 @@ func init() {
     prometheus.MustRegister(prometheusRequestDurations, prometheusRequestCounts)
 }
 
+// The response header of a site bucket watch naming the node whose replica
+// serves the stream. Serials in the stream are only meaningful for that
+// replica so clients resume by passing both back in the replica and
+// lastSerial query parameters
+const ReplicaIDHeader = "X-WigWag-ReplicaID"
+
 type SitesEndpoint struct {
     ClusterFacade ClusterFacade
+    // BundleRoots verifies the signatures of imported bundles. Imports
+    // are refused if it is nil
+    BundleRoots *x509.CertPool
 }
 
 func (sitesEndpoint *SitesEndpoint) Attach(outerRouter *mux.Router) {
@@ -216,6 +230,203 @@ func (sitesEndpoint *SitesEndpoint) Attach(outerRouter *mux.Router) {
         io.WriteString(w, string(encodedBatchResult) + "\n")
     }).Methods("POST").Name("update_bucket")
 
+    // Export an offline sync bundle from a bucket
+    router.HandleFunc("/sites/{siteID}/buckets/{bucket}/bundle/export", func(w http.ResponseWriter, r *http.Request) {
+        body, err := ioutil.ReadAll(r.Body)
+
+        if err != nil {
+            Log.Warningf("POST /sites/{siteID}/buckets/{bucket}/bundle/export: %v", err)
+            
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusBadRequest)
+            io.WriteString(w, string(EReadBody.JSON()) + "\n")
+            
+            return
+        }
+
+        var exportRequest ExportRequest
+
+        if len(body) != 0 {
+            if err := json.Unmarshal(body, &exportRequest); err != nil {
+                Log.Warningf("POST /sites/{siteID}/buckets/{bucket}/bundle/export: Unable to parse export request")
+                
+                w.Header().Set("Content-Type", "application/json; charset=utf8")
+                w.WriteHeader(http.StatusBadRequest)
+                io.WriteString(w, string(EReadBody.JSON()) + "\n")
+                
+                return
+            }
+        }
+
+        bundle, err := sitesEndpoint.ClusterFacade.ExportBundle(mux.Vars(r)["siteID"], mux.Vars(r)["bucket"], exportRequest)
+
+        if err == ENoSuchSite {
+            Log.Warningf("POST /sites/{siteID}/buckets/{bucket}/bundle/export: Site does not exist")
+            
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusNotFound)
+            io.WriteString(w, string(ESiteDoesNotExist.JSON()) + "\n")
+            
+            return
+        }
+
+        if err == ENoSuchBucket {
+            Log.Warningf("POST /sites/{siteID}/buckets/{bucket}/bundle/export: Bucket does not exist")
+            
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusNotFound)
+            io.WriteString(w, string(EBucketDoesNotExist.JSON()) + "\n")
+            
+            return
+        }
+
+        if err == EBundleSummary {
+            Log.Warningf("POST /sites/{siteID}/buckets/{bucket}/bundle/export: %v", err)
+            
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusBadRequest)
+            io.WriteString(w, string(EReadBody.JSON()) + "\n")
+            
+            return
+        }
+
+        if err != nil {
+            Log.Warningf("POST /sites/{siteID}/buckets/{bucket}/bundle/export: Internal server error: %v", err)
+            
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusInternalServerError)
+            io.WriteString(w, string(EStorage.JSON()) + "\n")
+            
+            return
+        }
+
+        encodedBundle, _ := json.Marshal(bundle)
+
+        w.Header().Set("Content-Type", "application/json; charset=utf8")
+        w.WriteHeader(http.StatusOK)
+        io.WriteString(w, string(encodedBundle) + "\n")
+    }).Methods("POST").Name("export_bundle")
+
+    // Import an offline sync bundle into a bucket
+    router.HandleFunc("/sites/{siteID}/buckets/{bucket}/bundle/import", func(w http.ResponseWriter, r *http.Request) {
+        if sitesEndpoint.BundleRoots == nil {
+            Log.Warningf("POST /sites/{siteID}/buckets/{bucket}/bundle/import: No CA is configured to verify bundles")
+            
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusUnauthorized)
+            io.WriteString(w, string(EUnauthorized.JSON()) + "\n")
+            
+            return
+        }
+
+        signedBundle, err := ioutil.ReadAll(r.Body)
+
+        if err != nil {
+            Log.Warningf("POST /sites/{siteID}/buckets/{bucket}/bundle/import: Unable to read bundle: %v", err)
+            
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusBadRequest)
+            io.WriteString(w, string(EReadBody.JSON()) + "\n")
+            
+            return
+        }
+
+        bundle, signer, err := Open(signedBundle, sitesEndpoint.BundleRoots)
+
+        if err != nil {
+            Log.Warningf("POST /sites/{siteID}/buckets/{bucket}/bundle/import: Unable to open bundle: %v", err)
+            
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+
+            switch err.(type) {
+            case *json.SyntaxError, *json.UnmarshalTypeError:
+                w.WriteHeader(http.StatusBadRequest)
+                io.WriteString(w, string(EReadBody.JSON()) + "\n")
+            default:
+                w.WriteHeader(http.StatusUnauthorized)
+                io.WriteString(w, string(EUnauthorized.JSON()) + "\n")
+            }
+            
+            return
+        }
+
+        if bundle.Source != signer.Subject.CommonName {
+            Log.Warningf("POST /sites/{siteID}/buckets/{bucket}/bundle/import: Bundle claims to come from %s but was signed by %s", bundle.Source, signer.Subject.CommonName)
+            
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusUnauthorized)
+            io.WriteString(w, string(EUnauthorized.JSON()) + "\n")
+            
+            return
+        }
+
+        // Bundles exported by a relay leave the site empty since relays do not
+        // know which site they belong to. ImportBundle() checks those against
+        // the relay's site instead
+        if (bundle.Site != "" && bundle.Site != mux.Vars(r)["siteID"]) || bundle.Bucket != mux.Vars(r)["bucket"] {
+            Log.Warningf("POST /sites/{siteID}/buckets/{bucket}/bundle/import: Bundle was exported from site %s bucket %s", bundle.Site, bundle.Bucket)
+            
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusBadRequest)
+            io.WriteString(w, string(EBundleMismatch.JSON()) + "\n")
+            
+            return
+        }
+
+        batchResult, err := sitesEndpoint.ClusterFacade.ImportBundle(mux.Vars(r)["siteID"], mux.Vars(r)["bucket"], bundle)
+
+        if err == ENoSuchSite {
+            Log.Warningf("POST /sites/{siteID}/buckets/{bucket}/bundle/import: Site does not exist")
+            
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusNotFound)
+            io.WriteString(w, string(ESiteDoesNotExist.JSON()) + "\n")
+            
+            return
+        }
+
+        if err == ENoSuchBucket {
+            Log.Warningf("POST /sites/{siteID}/buckets/{bucket}/bundle/import: Bucket does not exist")
+            
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusNotFound)
+            io.WriteString(w, string(EBucketDoesNotExist.JSON()) + "\n")
+            
+            return
+        }
+
+        if err == EUnauthorized {
+            Log.Warningf("POST /sites/{siteID}/buckets/{bucket}/bundle/import: Bundle source %s does not belong to the site", bundle.Source)
+            
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusUnauthorized)
+            io.WriteString(w, string(EUnauthorized.JSON()) + "\n")
+            
+            return
+        }
+
+        batchResult.Quorum = true
+        
+        if err == ENoQuorum {
+            Log.Warningf("POST /sites/{siteID}/buckets/{bucket}/bundle/import: Write failed at some replicas")
+            batchResult.Quorum = false
+        } else if err != nil {
+            Log.Warningf("POST /sites/{siteID}/buckets/{bucket}/bundle/import: Internal server error: %v", err)
+            
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusInternalServerError)
+            io.WriteString(w, string(EStorage.JSON()) + "\n")
+            
+            return
+        }
+
+        encodedBatchResult, _ := json.Marshal(batchResult)
+
+        w.Header().Set("Content-Type", "application/json; charset=utf8")
+        w.WriteHeader(http.StatusOK)
+        io.WriteString(w, string(encodedBatchResult) + "\n")
+    }).Methods("POST").Name("import_bundle")
+
     // Query keys in bucket
     router.HandleFunc("/sites/{siteID}/buckets/{bucket}/keys", func(w http.ResponseWriter, r *http.Request) {
         //sitesEndpoint.ClusterFacade.Get(siteID, bucket, keys)
@@ -403,4 +614,127 @@ func (sitesEndpoint *SitesEndpoint) Attach(outerRouter *mux.Router) {
             return
         }
     }).Methods("GET").Name("read_bucket")
+
+    // Watch keys in bucket
+    router.HandleFunc("/sites/{siteID}/buckets/{bucket}/watch", func(w http.ResponseWriter, r *http.Request) {
+        query := r.URL.Query()
+
+        var keys [][]byte = make([][]byte, len(query["key"]))
+        var prefixes [][]byte = make([][]byte, len(query["prefix"]))
+        var replica uint64
+        var lastSerial uint64
+
+        for i, key := range query["key"] {
+            keys[i] = []byte(key)
+        }
+
+        for i, prefix := range query["prefix"] {
+            prefixes[i] = []byte(prefix)
+        }
+
+        if query.Get("replica") != "" {
+            nodeID, err := strconv.ParseUint(query.Get("replica"), 10, 64)
+
+            if err != nil {
+                Log.Warningf("GET /sites/{siteID}/buckets/{bucket}/watch: Invalid replica specified")
+
+                w.Header().Set("Content-Type", "application/json; charset=utf8")
+                w.WriteHeader(http.StatusBadRequest)
+                io.WriteString(w, string(EInvalidKey.JSON()) + "\n")
+                
+                return
+            }
+
+            replica = nodeID
+        }
+
+        if query.Get("lastSerial") != "" {
+            ls, err := strconv.ParseUint(query.Get("lastSerial"), 10, 64)
+
+            if err != nil {
+                Log.Warningf("GET /sites/{siteID}/buckets/{bucket}/watch: Invalid lastSerial specified")
+
+                w.Header().Set("Content-Type", "application/json; charset=utf8")
+                w.WriteHeader(http.StatusBadRequest)
+                io.WriteString(w, string(EInvalidKey.JSON()) + "\n")
+                
+                return
+            }
+
+            lastSerial = ls
+        }
+
+        var ch chan Row = make(chan Row)
+
+        replica, err := sitesEndpoint.ClusterFacade.Watch(r.Context(), mux.Vars(r)["siteID"], mux.Vars(r)["bucket"], keys, prefixes, replica, lastSerial, ch)
+
+        if err == ENoSuchSite {
+            Log.Warningf("GET /sites/{siteID}/buckets/{bucket}/watch: Site does not exist")
+            
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusNotFound)
+            io.WriteString(w, string(ESiteDoesNotExist.JSON()) + "\n")
+            
+            return
+        }
+
+        if err == ENoSuchBucket {
+            Log.Warningf("GET /sites/{siteID}/buckets/{bucket}/watch: Bucket does not exist")
+            
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusNotFound)
+            io.WriteString(w, string(EBucketDoesNotExist.JSON()) + "\n")
+            
+            return
+        }
+
+        if err != nil {
+            Log.Warningf("GET /sites/{siteID}/buckets/{bucket}/watch: No replica could serve the watch: %v", err)
+            
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusInternalServerError)
+            io.WriteString(w, string(ENoQuorum.JSON()) + "\n")
+            
+            return
+        }
+
+        flusher, _ := w.(http.Flusher)
+
+        w.Header().Set("Content-Type", "text/event-stream")
+        w.Header().Set("Cache-Control", "no-cache")
+        w.Header().Set("Connection", "keep-alive")
+        w.Header().Set(ReplicaIDHeader, fmt.Sprintf("%d", replica))
+        w.WriteHeader(http.StatusOK)
+        flusher.Flush()
+
+        // As with the relay watch endpoint it is important
+        // not to break out of this loop early. The channel
+        // has to be read until it is closed
+        for update := range ch {
+            // Marks the end of the updates missed since
+            // lastSerial
+            if update.Key == "" {
+                fmt.Fprintf(w, "data: \n\n")
+                flusher.Flush()
+                continue
+            }
+
+            var transportUpdate TransportRow
+            
+            if err := transportUpdate.FromRow(&update); err != nil {
+                Log.Errorf("Encountered an error while converting an update to its transport format: %v", err)
+                continue
+            }
+
+            encodedUpdate, err := json.Marshal(transportUpdate)
+
+            if err != nil {
+                Log.Errorf("Encountered an error while encoding an update to JSON: %v", err)
+                continue
+            }
+
+            fmt.Fprintf(w, "data: %s\n\n", string(encodedUpdate))
+            flusher.Flush()
+        }
+    }).Methods("GET").Name("watch_bucket")
 }
\ No newline at end of file
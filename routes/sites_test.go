@@ -25,14 +25,23 @@ package routes_test
 
 
 import (
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
     "encoding/json"
     "context"
+    "math/big"
     "errors"
     "net/http"
     "net/http/httptest"
     "strings"
+    "time"
 
     . "github.com/armPelionEdge/devicedb/bucket"
+    . "github.com/armPelionEdge/devicedb/bundle"
     . "github.com/armPelionEdge/devicedb/error"
     . "github.com/armPelionEdge/devicedb/cluster"
     . "github.com/armPelionEdge/devicedb/data"
@@ -45,16 +54,71 @@ import (
     "github.com/gorilla/mux"
 )
 
+// newBundleCA creates a throwaway CA for signing bundles so the tests do not
+// depend on the expiry dates of the certificates checked into test_certs
+func newBundleCA() (*x509.Certificate, *ecdsa.PrivateKey) {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+    Expect(err).Should(BeNil())
+
+    template := &x509.Certificate{
+        SerialNumber: big.NewInt(1),
+        Subject: pkix.Name{ CommonName: "Test CA" },
+        NotBefore: time.Now().Add(-time.Hour),
+        NotAfter: time.Now().Add(time.Hour),
+        IsCA: true,
+        BasicConstraintsValid: true,
+        KeyUsage: x509.KeyUsageCertSign,
+    }
+
+    der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+
+    Expect(err).Should(BeNil())
+
+    ca, err := x509.ParseCertificate(der)
+
+    Expect(err).Should(BeNil())
+
+    return ca, key
+}
+
+func newBundleSigner(id string, ca *x509.Certificate, caKey *ecdsa.PrivateKey) tls.Certificate {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+    Expect(err).Should(BeNil())
+
+    template := &x509.Certificate{
+        SerialNumber: big.NewInt(2),
+        Subject: pkix.Name{ CommonName: id },
+        NotBefore: time.Now().Add(-time.Hour),
+        NotAfter: time.Now().Add(time.Hour),
+        KeyUsage: x509.KeyUsageDigitalSignature,
+        ExtKeyUsage: []x509.ExtKeyUsage{ x509.ExtKeyUsageClientAuth },
+    }
+
+    der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+
+    Expect(err).Should(BeNil())
+
+    return tls.Certificate{ Certificate: [][]byte{ der }, PrivateKey: key }
+}
+
 var _ = Describe("Sites", func() {
     var router *mux.Router
     var sitesEndpoint *SitesEndpoint
     var clusterFacade *MockClusterFacade
+    var bundleCA *x509.Certificate
+    var bundleCAKey *ecdsa.PrivateKey
 
     BeforeEach(func() {
+        bundleCA, bundleCAKey = newBundleCA()
+        bundleRoots := x509.NewCertPool()
+        bundleRoots.AddCert(bundleCA)
         clusterFacade = &MockClusterFacade{ }
         router = mux.NewRouter()
         sitesEndpoint = &SitesEndpoint{
             ClusterFacade: clusterFacade,
+            BundleRoots: bundleRoots,
         }
         sitesEndpoint.Attach(router)
     })
@@ -536,6 +600,367 @@ var _ = Describe("Sites", func() {
         })
     })
 
+    Describe("/sites/{siteID}/buckets/{bucketID}/bundle/export", func() {
+        Describe("POST", func() {
+            Context("When the provided body of the request cannot be parsed as an ExportRequest", func() {
+                It("Should respond with status code http.StatusBadRequest", func() {
+                    req, err := http.NewRequest("POST", "/sites/site1/buckets/default/bundle/export", strings.NewReader("asdf"))
+
+                    Expect(err).Should(BeNil())
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    Expect(rr.Code).Should(Equal(http.StatusBadRequest))
+                })
+            })
+
+            It("Should call ExportBundle() on the node facade with the site ID and bucket specified in the path and the export request in the body", func() {
+                summary := NewSummary()
+                encodedExportRequest, _ := json.Marshal(ExportRequest{ Peer: "WWRL000000", Summary: summary })
+                req, err := http.NewRequest("POST", "/sites/site1/buckets/default/bundle/export", strings.NewReader(string(encodedExportRequest)))
+
+                Expect(err).Should(BeNil())
+
+                exportBundleCalled := make(chan int, 1)
+                clusterFacade.exportBundleCB = func(siteID string, bucket string, request ExportRequest) {
+                    Expect(siteID).Should(Equal("site1"))
+                    Expect(bucket).Should(Equal("default"))
+                    Expect(request.Peer).Should(Equal("WWRL000000"))
+                    Expect(request.Summary).Should(Equal(summary))
+
+                    exportBundleCalled <- 1
+                }
+
+                rr := httptest.NewRecorder()
+                router.ServeHTTP(rr, req)
+
+                select {
+                case <-exportBundleCalled:
+                default:
+                    Fail("Should have invoked ExportBundle()")
+                }
+            })
+
+            Context("When ExportBundle() returns ENoSuchSite", func() {
+                It("Should respond with status code http.StatusNotFound and an ESiteDoesNotExist body", func() {
+                    req, err := http.NewRequest("POST", "/sites/site1/buckets/default/bundle/export", strings.NewReader(""))
+                    clusterFacade.defaultExportBundleError = ENoSuchSite
+
+                    Expect(err).Should(BeNil())
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    var encodedDBError DBerror
+
+                    Expect(rr.Code).Should(Equal(http.StatusNotFound))
+                    Expect(json.Unmarshal(rr.Body.Bytes(), &encodedDBError)).Should(BeNil())
+                    Expect(encodedDBError).Should(Equal(ESiteDoesNotExist))
+                })
+            })
+
+            Context("When ExportBundle() returns ENoSuchBucket", func() {
+                It("Should respond with status code http.StatusNotFound and an EBucketDoesNotExist body", func() {
+                    req, err := http.NewRequest("POST", "/sites/site1/buckets/default/bundle/export", strings.NewReader(""))
+                    clusterFacade.defaultExportBundleError = ENoSuchBucket
+
+                    Expect(err).Should(BeNil())
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    var encodedDBError DBerror
+
+                    Expect(rr.Code).Should(Equal(http.StatusNotFound))
+                    Expect(json.Unmarshal(rr.Body.Bytes(), &encodedDBError)).Should(BeNil())
+                    Expect(encodedDBError).Should(Equal(EBucketDoesNotExist))
+                })
+            })
+
+            Context("When ExportBundle() returns some other error", func() {
+                It("Should respond with status code http.StatusInternalServerError and an EStorage body", func() {
+                    req, err := http.NewRequest("POST", "/sites/site1/buckets/default/bundle/export", strings.NewReader(""))
+                    clusterFacade.defaultExportBundleError = errors.New("Some error")
+
+                    Expect(err).Should(BeNil())
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    var encodedDBError DBerror
+
+                    Expect(rr.Code).Should(Equal(http.StatusInternalServerError))
+                    Expect(json.Unmarshal(rr.Body.Bytes(), &encodedDBError)).Should(BeNil())
+                    Expect(encodedDBError).Should(Equal(EStorage))
+                })
+            })
+
+            Context("When ExportBundle() succeeds", func() {
+                It("Should respond with status code http.StatusOK and the bundle in the body", func() {
+                    req, err := http.NewRequest("POST", "/sites/site1/buckets/default/bundle/export", strings.NewReader(""))
+                    clusterFacade.defaultExportBundleResponse = &Bundle{ Version: BUNDLE_VERSION, Source: "cloud", Site: "site1", Bucket: "default" }
+
+                    Expect(err).Should(BeNil())
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    var bundle Bundle
+
+                    Expect(rr.Code).Should(Equal(http.StatusOK))
+                    Expect(json.Unmarshal(rr.Body.Bytes(), &bundle)).Should(BeNil())
+                    Expect(bundle.Source).Should(Equal("cloud"))
+                    Expect(bundle.Site).Should(Equal("site1"))
+                    Expect(bundle.Bucket).Should(Equal("default"))
+                })
+            })
+        })
+    })
+
+    Describe("/sites/{siteID}/buckets/{bucketID}/bundle/import", func() {
+        Describe("POST", func() {
+            var bundle Bundle
+            var encodedBundle []byte
+
+            sign := func(bundle Bundle, signerID string) []byte {
+                signedBundle, err := Sign(&bundle, newBundleSigner(signerID, bundleCA, bundleCAKey))
+
+                Expect(err).Should(BeNil())
+
+                return signedBundle
+            }
+
+            BeforeEach(func() {
+                bundle = Bundle{
+                    Version: BUNDLE_VERSION,
+                    Source: "WWRL000000",
+                    Bucket: "default",
+                    SiblingSets: map[string]*SiblingSet{
+                        "key1": NewSiblingSet(map[*Sibling]bool{ }),
+                    },
+                }
+                encodedBundle = sign(bundle, "WWRL000000")
+            })
+
+            Context("When the provided body of the request cannot be parsed as a Bundle", func() {
+                It("Should respond with status code http.StatusBadRequest", func() {
+                    req, err := http.NewRequest("POST", "/sites/site1/buckets/default/bundle/import", strings.NewReader("asdf"))
+
+                    Expect(err).Should(BeNil())
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    Expect(rr.Code).Should(Equal(http.StatusBadRequest))
+                })
+            })
+
+            Context("When the bundle is not signed", func() {
+                It("Should respond with status code http.StatusUnauthorized and an EUnauthorized body", func() {
+                    unsignedBundle, _ := json.Marshal(bundle)
+                    req, err := http.NewRequest("POST", "/sites/site1/buckets/default/bundle/import", strings.NewReader(string(unsignedBundle)))
+
+                    Expect(err).Should(BeNil())
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    var encodedDBError DBerror
+
+                    Expect(rr.Code).Should(Equal(http.StatusUnauthorized))
+                    Expect(json.Unmarshal(rr.Body.Bytes(), &encodedDBError)).Should(BeNil())
+                    Expect(encodedDBError).Should(Equal(EUnauthorized))
+                })
+            })
+
+            Context("When no CA is configured to verify bundles", func() {
+                It("Should respond with status code http.StatusUnauthorized", func() {
+                    sitesEndpoint.BundleRoots = nil
+                    req, err := http.NewRequest("POST", "/sites/site1/buckets/default/bundle/import", strings.NewReader(string(encodedBundle)))
+
+                    Expect(err).Should(BeNil())
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    Expect(rr.Code).Should(Equal(http.StatusUnauthorized))
+                })
+            })
+
+            Context("When the bundle source is not the signer", func() {
+                It("Should respond with status code http.StatusUnauthorized and an EUnauthorized body", func() {
+                    req, err := http.NewRequest("POST", "/sites/site1/buckets/default/bundle/import", strings.NewReader(string(sign(bundle, "WWRL000001"))))
+
+                    Expect(err).Should(BeNil())
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    var encodedDBError DBerror
+
+                    Expect(rr.Code).Should(Equal(http.StatusUnauthorized))
+                    Expect(json.Unmarshal(rr.Body.Bytes(), &encodedDBError)).Should(BeNil())
+                    Expect(encodedDBError).Should(Equal(EUnauthorized))
+                })
+            })
+
+            Context("When the bundle was exported from a different bucket", func() {
+                It("Should respond with status code http.StatusBadRequest and an EBundleMismatch body", func() {
+                    req, err := http.NewRequest("POST", "/sites/site1/buckets/lww/bundle/import", strings.NewReader(string(encodedBundle)))
+
+                    Expect(err).Should(BeNil())
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    var encodedDBError DBerror
+
+                    Expect(rr.Code).Should(Equal(http.StatusBadRequest))
+                    Expect(json.Unmarshal(rr.Body.Bytes(), &encodedDBError)).Should(BeNil())
+                    Expect(encodedDBError).Should(Equal(EBundleMismatch))
+                })
+            })
+
+            Context("When the bundle was exported from a different site", func() {
+                It("Should respond with status code http.StatusBadRequest and an EBundleMismatch body", func() {
+                    bundle.Source = "cloud"
+                    bundle.Site = "site2"
+                    req, err := http.NewRequest("POST", "/sites/site1/buckets/default/bundle/import", strings.NewReader(string(sign(bundle, "cloud"))))
+
+                    Expect(err).Should(BeNil())
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    var encodedDBError DBerror
+
+                    Expect(rr.Code).Should(Equal(http.StatusBadRequest))
+                    Expect(json.Unmarshal(rr.Body.Bytes(), &encodedDBError)).Should(BeNil())
+                    Expect(encodedDBError).Should(Equal(EBundleMismatch))
+                })
+            })
+
+            Context("When ImportBundle() returns EUnauthorized", func() {
+                It("Should respond with status code http.StatusUnauthorized and an EUnauthorized body", func() {
+                    req, err := http.NewRequest("POST", "/sites/site1/buckets/default/bundle/import", strings.NewReader(string(encodedBundle)))
+                    clusterFacade.defaultImportBundleError = EUnauthorized
+
+                    Expect(err).Should(BeNil())
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    var encodedDBError DBerror
+
+                    Expect(rr.Code).Should(Equal(http.StatusUnauthorized))
+                    Expect(json.Unmarshal(rr.Body.Bytes(), &encodedDBError)).Should(BeNil())
+                    Expect(encodedDBError).Should(Equal(EUnauthorized))
+                })
+            })
+
+            It("Should call ImportBundle() on the node facade with the site ID and bucket specified in the path and the bundle in the body", func() {
+                req, err := http.NewRequest("POST", "/sites/site1/buckets/default/bundle/import", strings.NewReader(string(encodedBundle)))
+
+                Expect(err).Should(BeNil())
+
+                importBundleCalled := make(chan int, 1)
+                clusterFacade.importBundleCB = func(siteID string, bucket string, bundle *Bundle) {
+                    Expect(siteID).Should(Equal("site1"))
+                    Expect(bucket).Should(Equal("default"))
+                    Expect(bundle.Source).Should(Equal("WWRL000000"))
+                    Expect(bundle.SiblingSets).Should(HaveKey("key1"))
+
+                    importBundleCalled <- 1
+                }
+
+                rr := httptest.NewRecorder()
+                router.ServeHTTP(rr, req)
+
+                select {
+                case <-importBundleCalled:
+                default:
+                    Fail("Should have invoked ImportBundle()")
+                }
+            })
+
+            Context("When ImportBundle() returns ENoSuchSite", func() {
+                It("Should respond with status code http.StatusNotFound and an ESiteDoesNotExist body", func() {
+                    req, err := http.NewRequest("POST", "/sites/site1/buckets/default/bundle/import", strings.NewReader(string(encodedBundle)))
+                    clusterFacade.defaultImportBundleError = ENoSuchSite
+
+                    Expect(err).Should(BeNil())
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    var encodedDBError DBerror
+
+                    Expect(rr.Code).Should(Equal(http.StatusNotFound))
+                    Expect(json.Unmarshal(rr.Body.Bytes(), &encodedDBError)).Should(BeNil())
+                    Expect(encodedDBError).Should(Equal(ESiteDoesNotExist))
+                })
+            })
+
+            Context("When ImportBundle() returns ENoSuchBucket", func() {
+                It("Should respond with status code http.StatusNotFound and an EBucketDoesNotExist body", func() {
+                    req, err := http.NewRequest("POST", "/sites/site1/buckets/default/bundle/import", strings.NewReader(string(encodedBundle)))
+                    clusterFacade.defaultImportBundleError = ENoSuchBucket
+
+                    Expect(err).Should(BeNil())
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    var encodedDBError DBerror
+
+                    Expect(rr.Code).Should(Equal(http.StatusNotFound))
+                    Expect(json.Unmarshal(rr.Body.Bytes(), &encodedDBError)).Should(BeNil())
+                    Expect(encodedDBError).Should(Equal(EBucketDoesNotExist))
+                })
+            })
+
+            Context("When ImportBundle() returns ENoQuorum", func() {
+                It("Should respond with status code http.StatusOK and a BatchResult body that indicates no quorum was reached", func() {
+                    req, err := http.NewRequest("POST", "/sites/site1/buckets/default/bundle/import", strings.NewReader(string(encodedBundle)))
+                    clusterFacade.defaultImportBundleError = ENoQuorum
+                    clusterFacade.defaultImportBundleResponse = BatchResult{ NApplied: 1, Replicas: 3 }
+
+                    Expect(err).Should(BeNil())
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    var batchResult BatchResult
+
+                    Expect(rr.Code).Should(Equal(http.StatusOK))
+                    Expect(json.Unmarshal(rr.Body.Bytes(), &batchResult)).Should(BeNil())
+                    Expect(batchResult.Quorum).Should(BeFalse())
+                    Expect(batchResult.NApplied).Should(Equal(uint64(1)))
+                })
+            })
+
+            Context("When ImportBundle() succeeds", func() {
+                It("Should respond with status code http.StatusOK and a BatchResult body", func() {
+                    req, err := http.NewRequest("POST", "/sites/site1/buckets/default/bundle/import", strings.NewReader(string(encodedBundle)))
+                    clusterFacade.defaultImportBundleResponse = BatchResult{ NApplied: 3, Replicas: 3 }
+
+                    Expect(err).Should(BeNil())
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    var batchResult BatchResult
+
+                    Expect(rr.Code).Should(Equal(http.StatusOK))
+                    Expect(json.Unmarshal(rr.Body.Bytes(), &batchResult)).Should(BeNil())
+                    Expect(batchResult.Quorum).Should(BeTrue())
+                    Expect(batchResult.NApplied).Should(Equal(uint64(3)))
+                })
+            })
+        })
+    })
+
     Describe("/sites/{siteID}/buckets/{bucketID}/keys", func() {
         Describe("GET", func() {
             Context("When the request includes both \"key\" and \"prefix\" query parameters", func() {
@@ -993,4 +1418,130 @@ var _ = Describe("Sites", func() {
             })
         })
     })
+
+    Describe("/sites/{siteID}/buckets/{bucketID}/watch", func() {
+        Describe("GET", func() {
+            Context("When the lastSerial query parameter is not a base 10 encoded uint64", func() {
+                It("Should respond with status code http.StatusBadRequest", func() {
+                    req, err := http.NewRequest("GET", "/sites/site1/buckets/default/watch?lastSerial=asdf", nil)
+
+                    Expect(err).Should(BeNil())
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    Expect(rr.Code).Should(Equal(http.StatusBadRequest))
+                })
+            })
+
+            It("Should call Watch() on the node facade with the site, bucket, filters, replica and last serial from the request", func() {
+                req, err := http.NewRequest("GET", "/sites/site1/buckets/default/watch?key=a&key=b&prefix=c&replica=22&lastSerial=7", nil)
+
+                Expect(err).Should(BeNil())
+
+                watchCalled := make(chan int, 1)
+                clusterFacade.watchCB = func(ctx context.Context, siteID string, bucket string, keys [][]byte, prefixes [][]byte, replica uint64, lastSerial uint64, ch chan Row) {
+                    Expect(siteID).Should(Equal("site1"))
+                    Expect(bucket).Should(Equal("default"))
+                    Expect(keys).Should(Equal([][]byte{ []byte("a"), []byte("b") }))
+                    Expect(prefixes).Should(Equal([][]byte{ []byte("c") }))
+                    Expect(replica).Should(Equal(uint64(22)))
+                    Expect(lastSerial).Should(Equal(uint64(7)))
+
+                    close(ch)
+                    watchCalled <- 1
+                }
+
+                rr := httptest.NewRecorder()
+                router.ServeHTTP(rr, req)
+
+                select {
+                case <-watchCalled:
+                default:
+                    Fail("Request did not cause Watch() to be invoked")
+                }
+            })
+
+            Context("When Watch() returns ENoSuchSite", func() {
+                It("Should respond with status code http.StatusNotFound and an ESiteDoesNotExist body", func() {
+                    req, err := http.NewRequest("GET", "/sites/site1/buckets/default/watch", nil)
+                    clusterFacade.defaultWatchError = ENoSuchSite
+
+                    Expect(err).Should(BeNil())
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    var encodedDBError DBerror
+
+                    Expect(rr.Code).Should(Equal(http.StatusNotFound))
+                    Expect(json.Unmarshal(rr.Body.Bytes(), &encodedDBError)).Should(BeNil())
+                    Expect(encodedDBError).Should(Equal(ESiteDoesNotExist))
+                })
+            })
+
+            Context("When Watch() returns ENoSuchBucket", func() {
+                It("Should respond with status code http.StatusNotFound and an EBucketDoesNotExist body", func() {
+                    req, err := http.NewRequest("GET", "/sites/site1/buckets/default/watch", nil)
+                    clusterFacade.defaultWatchError = ENoSuchBucket
+
+                    Expect(err).Should(BeNil())
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    var encodedDBError DBerror
+
+                    Expect(rr.Code).Should(Equal(http.StatusNotFound))
+                    Expect(json.Unmarshal(rr.Body.Bytes(), &encodedDBError)).Should(BeNil())
+                    Expect(encodedDBError).Should(Equal(EBucketDoesNotExist))
+                })
+            })
+
+            Context("When Watch() returns some other error", func() {
+                It("Should respond with status code http.StatusInternalServerError", func() {
+                    req, err := http.NewRequest("GET", "/sites/site1/buckets/default/watch", nil)
+                    clusterFacade.defaultWatchError = errors.New("Some error")
+
+                    Expect(err).Should(BeNil())
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    Expect(rr.Code).Should(Equal(http.StatusInternalServerError))
+                })
+            })
+
+            Context("When Watch() succeeds", func() {
+                It("Should stream the updates it receives as server-sent events and name the replica serving them in the response header", func() {
+                    req, err := http.NewRequest("GET", "/sites/site1/buckets/default/watch?prefix=a", nil)
+
+                    Expect(err).Should(BeNil())
+
+                    var row Row = Row{ Key: "a1", LocalVersion: 8, Siblings: NewSiblingSet(map[*Sibling]bool{ }) }
+                    var transportRow TransportRow
+
+                    Expect(transportRow.FromRow(&row)).Should(BeNil())
+
+                    encodedTransportRow, _ := json.Marshal(transportRow)
+
+                    clusterFacade.defaultWatchReplica = 22
+                    clusterFacade.watchCB = func(ctx context.Context, siteID string, bucket string, keys [][]byte, prefixes [][]byte, replica uint64, lastSerial uint64, ch chan Row) {
+                        go func() {
+                            ch <- Row{ }
+                            ch <- row
+                            close(ch)
+                        }()
+                    }
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    Expect(rr.Code).Should(Equal(http.StatusOK))
+                    Expect(rr.Header().Get(ReplicaIDHeader)).Should(Equal("22"))
+                    Expect(rr.Body.String()).Should(Equal("data: \n\ndata: " + string(encodedTransportRow) + "\n\n"))
+                })
+            })
+        })
+    })
 })
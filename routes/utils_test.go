@@ -30,11 +30,15 @@ import (
     "io"
     "net/http"
 
+    . "github.com/armPelionEdge/devicedb/alerts"
     . "github.com/armPelionEdge/devicedb/bucket"
+    . "github.com/armPelionEdge/devicedb/bundle"
     . "github.com/armPelionEdge/devicedb/cluster"
     . "github.com/armPelionEdge/devicedb/data"
+    . "github.com/armPelionEdge/devicedb/historian"
     . "github.com/armPelionEdge/devicedb/raft"
     . "github.com/armPelionEdge/devicedb/routes"
+    "github.com/armPelionEdge/devicedb/webhooks"
 )
 
 type MockClusterFacade struct {
@@ -48,10 +52,17 @@ type MockClusterFacade struct {
     defaultAddRelayResponse error
     defaultRemoveRelayResponse error
     defaultMoveRelayResponse error
+    defaultSetRelaySubscriptionResponse error
+    defaultGetRelaySubscriptionResponse map[string][]string
+    defaultGetRelaySubscriptionError error
     defaultAddSiteResponse error
     defaultRemoveSiteResponse error
     defaultBatchResponse BatchResult
     defaultBatchError error
+    defaultExportBundleResponse *Bundle
+    defaultExportBundleError error
+    defaultImportBundleResponse BatchResult
+    defaultImportBundleError error
     defaultLocalBatchPatch map[string]*SiblingSet
     defaultLocalBatchError error
     defaultLocalMergeResponse error
@@ -63,28 +74,81 @@ type MockClusterFacade struct {
     defaultGetMatchesResponseError error
     defaultLocalGetMatchesResponse SiblingSetIterator
     defaultLocalGetMatchesResponseError error
+    defaultWatchReplica uint64
+    defaultWatchError error
+    defaultLocalWatchError error
     defaultLocalLogDumpResponse LogDump
     defaultLocalLogDumpError error
     defaultLocalSnapshotResponse Snapshot
     defaultLocalSnapshotError error
+    defaultLogRelayEventsResponse error
+    defaultQueryRelayEventsResponse RelayEventIterator
+    defaultQueryRelayEventsError error
+    defaultAggregateRelayEventsResponse []*AggregateBucket
+    defaultAggregateRelayEventsError error
+    defaultSiteHistoryRetentionResponse HistoryRetention
+    defaultSiteHistoryRetentionError error
+    defaultSetSiteHistoryRetentionResponse error
+    defaultLocalLogRelayEventsResponse error
+    defaultLocalQueryRelayEventsResponse RelayEventIterator
+    defaultLocalQueryRelayEventsError error
+    defaultLocalAggregateRelayEventsResponse []*AggregateBucket
+    defaultLocalAggregateRelayEventsError error
+    defaultLocalSiteHistoryRetentionResponse HistoryRetention
+    defaultLocalSiteHistoryRetentionError error
+    defaultLocalSetSiteHistoryRetentionResponse error
+    defaultLogRelayAlertsResponse error
+    defaultRelayAlertsResponse []RelayAlert
+    defaultRelayAlertsError error
+    defaultLocalApplyRelayAlertsResponse error
+    defaultLocalRelayAlertsResponse []RelayAlert
+    defaultLocalRelayAlertsError error
+    defaultLocalRelayAlertStatesResponse []RelayAlert
+    defaultSetWebhookResponse error
+    defaultWebhooksResponse map[string]Webhook
+    defaultWebhookStatusResponse webhooks.Status
+    defaultWebhookStatusError error
+    defaultLocalWebhookStatusResponse webhooks.Status
+    defaultLocalWebhookStatusError error
     addNodeCB func(ctx context.Context, nodeConfig NodeConfig)
     replaceNodeCB func(ctx context.Context, nodeID uint64, replacementNodeID uint64)
     removeNodeCB func(ctx context.Context, nodeID uint64)
     decommisionCB func()
     decommisionPeerCB func(nodeID uint64)
     batchCB func(siteID string, bucket string, updateBatch *UpdateBatch)
+    exportBundleCB func(siteID string, bucket string, request ExportRequest)
+    importBundleCB func(siteID string, bucket string, bundle *Bundle)
     getCB func(siteID string, bucket string, keys [][]byte)
     getMatchesCB func(siteID string, bucket string, keys [][]byte)
     localBatchCB func(partition uint64, siteID string, bucket string, updateBatch *UpdateBatch)
     localMergeCB func(partition uint64, siteID string, bucket string, patch map[string]*SiblingSet, broadcastToRelays bool)
     localGetCB func(partition uint64, siteID string, bucket string, keys [][]byte)
     localGetMatchesCB func(partition uint64, siteID string, bucket string, keys [][]byte)
+    watchCB func(ctx context.Context, siteID string, bucket string, keys [][]byte, prefixes [][]byte, replica uint64, lastSerial uint64, ch chan Row)
+    localWatchCB func(ctx context.Context, partition uint64, siteID string, bucket string, keys [][]byte, prefixes [][]byte, lastSerial uint64, ch chan Row)
     addRelayCB func(ctx context.Context, relayID string)
     removeRelayCB func(ctx context.Context, relayID string)
     moveRelayCB func(ctx context.Context, relayID string, siteID string)
+    setRelaySubscriptionCB func(ctx context.Context, relayID string, subscription map[string][]string)
     addSiteCB func(ctx context.Context, siteID string)
     removeSiteCB func(ctx context.Context, siteID string)
     acceptRelayConnectionCB func(conn *websocket.Conn)
+    logRelayEventsCB func(relayID string, events []*Event)
+    queryRelayEventsCB func(siteID string, relayID string, query *HistoryQuery)
+    aggregateRelayEventsCB func(siteID string, relayID string, query *AggregationQuery)
+    setSiteHistoryRetentionCB func(siteID string, retention HistoryRetention)
+    localLogRelayEventsCB func(siteID string, relayID string, events []*Event)
+    localQueryRelayEventsCB func(siteID string, relayID string, query *HistoryQuery)
+    localAggregateRelayEventsCB func(siteID string, relayID string, query *AggregationQuery)
+    localSetSiteHistoryRetentionCB func(siteID string, retention HistoryRetention)
+    logRelayAlertsCB func(relayID string, alerts []Alert)
+    relayAlertsCB func(siteID string, levels []string)
+    localApplyRelayAlertsCB func(siteID string, relayID string, op RelayAlertsOp)
+    localRelayAlertsCB func(siteID string, levels []string)
+    localRelayAlertStatesCB func(siteID string)
+    setWebhookCB func(ctx context.Context, webhookID string, webhook *Webhook)
+    webhookStatusCB func(ctx context.Context, webhookID string)
+    localWebhookStatusCB func(webhookID string)
 }
 
 func (clusterFacade *MockClusterFacade) AddNode(ctx context.Context, nodeConfig NodeConfig) error {
@@ -159,6 +223,18 @@ func (clusterFacade *MockClusterFacade) MoveRelay(ctx context.Context, relayID s
     return clusterFacade.defaultMoveRelayResponse
 }
 
+func (clusterFacade *MockClusterFacade) SetRelaySubscription(ctx context.Context, relayID string, subscription map[string][]string) error {
+    if clusterFacade.setRelaySubscriptionCB != nil {
+        clusterFacade.setRelaySubscriptionCB(ctx, relayID, subscription)
+    }
+
+    return clusterFacade.defaultSetRelaySubscriptionResponse
+}
+
+func (clusterFacade *MockClusterFacade) GetRelaySubscription(relayID string) (map[string][]string, error) {
+    return clusterFacade.defaultGetRelaySubscriptionResponse, clusterFacade.defaultGetRelaySubscriptionError
+}
+
 func (clusterFacade *MockClusterFacade) AddSite(ctx context.Context, siteID string) error {
     if clusterFacade.addSiteCB != nil {
         clusterFacade.addSiteCB(ctx, siteID)
@@ -183,6 +259,22 @@ func (clusterFacade *MockClusterFacade) Batch(siteID string, bucket string, upda
     return clusterFacade.defaultBatchResponse, clusterFacade.defaultBatchError
 }
 
+func (clusterFacade *MockClusterFacade) ExportBundle(siteID string, bucket string, request ExportRequest) (*Bundle, error) {
+    if clusterFacade.exportBundleCB != nil {
+        clusterFacade.exportBundleCB(siteID, bucket, request)
+    }
+
+    return clusterFacade.defaultExportBundleResponse, clusterFacade.defaultExportBundleError
+}
+
+func (clusterFacade *MockClusterFacade) ImportBundle(siteID string, bucket string, bundle *Bundle) (BatchResult, error) {
+    if clusterFacade.importBundleCB != nil {
+        clusterFacade.importBundleCB(siteID, bucket, bundle)
+    }
+
+    return clusterFacade.defaultImportBundleResponse, clusterFacade.defaultImportBundleError
+}
+
 func (clusterFacade *MockClusterFacade) LocalBatch(partition uint64, siteID string, bucket string, updateBatch *UpdateBatch) (map[string]*SiblingSet, error) {
     if clusterFacade.localBatchCB != nil {
         clusterFacade.localBatchCB(partition, siteID, bucket, updateBatch)
@@ -231,6 +323,22 @@ func (clusterFacade *MockClusterFacade) LocalGetMatches(partition uint64, siteID
     return clusterFacade.defaultLocalGetMatchesResponse, clusterFacade.defaultLocalGetMatchesResponseError
 }
 
+func (clusterFacade *MockClusterFacade) Watch(ctx context.Context, siteID string, bucket string, keys [][]byte, prefixes [][]byte, replica uint64, lastSerial uint64, ch chan Row) (uint64, error) {
+    if clusterFacade.watchCB != nil {
+        clusterFacade.watchCB(ctx, siteID, bucket, keys, prefixes, replica, lastSerial, ch)
+    }
+
+    return clusterFacade.defaultWatchReplica, clusterFacade.defaultWatchError
+}
+
+func (clusterFacade *MockClusterFacade) LocalWatch(ctx context.Context, partition uint64, siteID string, bucket string, keys [][]byte, prefixes [][]byte, lastSerial uint64, ch chan Row) error {
+    if clusterFacade.localWatchCB != nil {
+        clusterFacade.localWatchCB(ctx, partition, siteID, bucket, keys, prefixes, lastSerial, ch)
+    }
+
+    return clusterFacade.defaultLocalWatchError
+}
+
 func (clusterFacade *MockClusterFacade) AcceptRelayConnection(conn *websocket.Conn, header http.Header) {
     if clusterFacade.acceptRelayConnectionCB != nil {
         clusterFacade.acceptRelayConnectionCB(conn)
@@ -277,6 +385,146 @@ func (clusterFacade *MockClusterFacade) WriteLocalSnapshot(snapshotId string, w
     return nil
 }
 
+func (clusterFacade *MockClusterFacade) LogRelayEvents(relayID string, events []*Event) error {
+    if clusterFacade.logRelayEventsCB != nil {
+        clusterFacade.logRelayEventsCB(relayID, events)
+    }
+
+    return clusterFacade.defaultLogRelayEventsResponse
+}
+
+func (clusterFacade *MockClusterFacade) QueryRelayEvents(ctx context.Context, siteID string, relayID string, query *HistoryQuery) (RelayEventIterator, error) {
+    if clusterFacade.queryRelayEventsCB != nil {
+        clusterFacade.queryRelayEventsCB(siteID, relayID, query)
+    }
+
+    return clusterFacade.defaultQueryRelayEventsResponse, clusterFacade.defaultQueryRelayEventsError
+}
+
+func (clusterFacade *MockClusterFacade) AggregateRelayEvents(siteID string, relayID string, query *AggregationQuery) ([]*AggregateBucket, error) {
+    if clusterFacade.aggregateRelayEventsCB != nil {
+        clusterFacade.aggregateRelayEventsCB(siteID, relayID, query)
+    }
+
+    return clusterFacade.defaultAggregateRelayEventsResponse, clusterFacade.defaultAggregateRelayEventsError
+}
+
+func (clusterFacade *MockClusterFacade) SiteHistoryRetention(siteID string) (HistoryRetention, error) {
+    return clusterFacade.defaultSiteHistoryRetentionResponse, clusterFacade.defaultSiteHistoryRetentionError
+}
+
+func (clusterFacade *MockClusterFacade) SetSiteHistoryRetention(siteID string, retention HistoryRetention) error {
+    if clusterFacade.setSiteHistoryRetentionCB != nil {
+        clusterFacade.setSiteHistoryRetentionCB(siteID, retention)
+    }
+
+    return clusterFacade.defaultSetSiteHistoryRetentionResponse
+}
+
+func (clusterFacade *MockClusterFacade) LocalLogRelayEvents(siteID string, relayID string, events []*Event) error {
+    if clusterFacade.localLogRelayEventsCB != nil {
+        clusterFacade.localLogRelayEventsCB(siteID, relayID, events)
+    }
+
+    return clusterFacade.defaultLocalLogRelayEventsResponse
+}
+
+func (clusterFacade *MockClusterFacade) LocalQueryRelayEvents(siteID string, relayID string, query *HistoryQuery) (RelayEventIterator, error) {
+    if clusterFacade.localQueryRelayEventsCB != nil {
+        clusterFacade.localQueryRelayEventsCB(siteID, relayID, query)
+    }
+
+    return clusterFacade.defaultLocalQueryRelayEventsResponse, clusterFacade.defaultLocalQueryRelayEventsError
+}
+
+func (clusterFacade *MockClusterFacade) LocalAggregateRelayEvents(siteID string, relayID string, query *AggregationQuery) ([]*AggregateBucket, error) {
+    if clusterFacade.localAggregateRelayEventsCB != nil {
+        clusterFacade.localAggregateRelayEventsCB(siteID, relayID, query)
+    }
+
+    return clusterFacade.defaultLocalAggregateRelayEventsResponse, clusterFacade.defaultLocalAggregateRelayEventsError
+}
+
+func (clusterFacade *MockClusterFacade) LocalSiteHistoryRetention(siteID string) (HistoryRetention, error) {
+    return clusterFacade.defaultLocalSiteHistoryRetentionResponse, clusterFacade.defaultLocalSiteHistoryRetentionError
+}
+
+func (clusterFacade *MockClusterFacade) LocalSetSiteHistoryRetention(siteID string, retention HistoryRetention) error {
+    if clusterFacade.localSetSiteHistoryRetentionCB != nil {
+        clusterFacade.localSetSiteHistoryRetentionCB(siteID, retention)
+    }
+
+    return clusterFacade.defaultLocalSetSiteHistoryRetentionResponse
+}
+
+func (clusterFacade *MockClusterFacade) LogRelayAlerts(relayID string, alerts []Alert) error {
+    if clusterFacade.logRelayAlertsCB != nil {
+        clusterFacade.logRelayAlertsCB(relayID, alerts)
+    }
+
+    return clusterFacade.defaultLogRelayAlertsResponse
+}
+
+func (clusterFacade *MockClusterFacade) RelayAlerts(siteID string, levels []string) ([]RelayAlert, error) {
+    if clusterFacade.relayAlertsCB != nil {
+        clusterFacade.relayAlertsCB(siteID, levels)
+    }
+
+    return clusterFacade.defaultRelayAlertsResponse, clusterFacade.defaultRelayAlertsError
+}
+
+func (clusterFacade *MockClusterFacade) LocalApplyRelayAlerts(siteID string, relayID string, op RelayAlertsOp) error {
+    if clusterFacade.localApplyRelayAlertsCB != nil {
+        clusterFacade.localApplyRelayAlertsCB(siteID, relayID, op)
+    }
+
+    return clusterFacade.defaultLocalApplyRelayAlertsResponse
+}
+
+func (clusterFacade *MockClusterFacade) LocalRelayAlerts(siteID string, levels []string) ([]RelayAlert, error) {
+    if clusterFacade.localRelayAlertsCB != nil {
+        clusterFacade.localRelayAlertsCB(siteID, levels)
+    }
+
+    return clusterFacade.defaultLocalRelayAlertsResponse, clusterFacade.defaultLocalRelayAlertsError
+}
+
+func (clusterFacade *MockClusterFacade) LocalRelayAlertStates(siteID string) ([]RelayAlert, error) {
+    if clusterFacade.localRelayAlertStatesCB != nil {
+        clusterFacade.localRelayAlertStatesCB(siteID)
+    }
+
+    return clusterFacade.defaultLocalRelayAlertStatesResponse, nil
+}
+
+func (clusterFacade *MockClusterFacade) SetWebhook(ctx context.Context, webhookID string, webhook *Webhook) error {
+    if clusterFacade.setWebhookCB != nil {
+        clusterFacade.setWebhookCB(ctx, webhookID, webhook)
+    }
+
+    return clusterFacade.defaultSetWebhookResponse
+}
+
+func (clusterFacade *MockClusterFacade) Webhooks() map[string]Webhook {
+    return clusterFacade.defaultWebhooksResponse
+}
+
+func (clusterFacade *MockClusterFacade) WebhookStatus(ctx context.Context, webhookID string) (webhooks.Status, error) {
+    if clusterFacade.webhookStatusCB != nil {
+        clusterFacade.webhookStatusCB(ctx, webhookID)
+    }
+
+    return clusterFacade.defaultWebhookStatusResponse, clusterFacade.defaultWebhookStatusError
+}
+
+func (clusterFacade *MockClusterFacade) LocalWebhookStatus(webhookID string) (webhooks.Status, error) {
+    if clusterFacade.localWebhookStatusCB != nil {
+        clusterFacade.localWebhookStatusCB(webhookID)
+    }
+
+    return clusterFacade.defaultLocalWebhookStatusResponse, clusterFacade.defaultLocalWebhookStatusError
+}
+
 type siblingSetIteratorEntry struct {
     Prefix []byte
     Key []byte
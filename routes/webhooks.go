@@ -0,0 +1,216 @@
+package routes
+//
+ // Copyright (c) 2019 ARM Limited.
+ //
+ // SPDX-License-Identifier: MIT
+ //
+ // Permission is hereby granted, free of charge, to any person obtaining a copy
+ // of this software and associated documentation files (the "Software"), to
+ // deal in the Software without restriction, including without limitation the
+ // rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ // sell copies of the Software, and to permit persons to whom the Software is
+ // furnished to do so, subject to the following conditions:
+ //
+ // The above copyright notice and this permission notice shall be included in all
+ // copies or substantial portions of the Software.
+ //
+ // THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ // IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ // FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ // AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ // LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ // SOFTWARE.
+ //
+
+import (
+    "encoding/json"
+    "io"
+    "net/http"
+    "net/url"
+    "github.com/gorilla/mux"
+
+    . "github.com/armPelionEdge/devicedb/cluster"
+    . "github.com/armPelionEdge/devicedb/error"
+    . "github.com/armPelionEdge/devicedb/logging"
+    "github.com/armPelionEdge/devicedb/webhooks"
+)
+
+// WebhookBody describes a webhook in requests and responses. The secret
+// is never included in responses
+type WebhookBody struct {
+    // The site whose updates are delivered. Leave empty for all sites
+    SiteID string `json:"siteID"`
+    Bucket string `json:"bucket"`
+    // Only updates to keys with this prefix are delivered
+    Prefix string `json:"prefix"`
+    URL string `json:"url"`
+    // Used to sign payloads. See webhooks.SIGNATURE_HEADER
+    Secret string `json:"secret,omitempty"`
+}
+
+// WebhooksEndpoint configures the webhooks that updates made to site
+// buckets are delivered to
+type WebhooksEndpoint struct {
+    ClusterFacade ClusterFacade
+}
+
+func (webhooksEndpoint *WebhooksEndpoint) Attach(router *mux.Router) {
+    // List the webhooks in the cluster
+    router.HandleFunc("/webhooks", func(w http.ResponseWriter, r *http.Request) {
+        webhookBodies := make(map[string]WebhookBody)
+
+        for webhookID, webhook := range webhooksEndpoint.ClusterFacade.Webhooks() {
+            webhookBodies[webhookID] = WebhookBody{
+                SiteID: webhook.SiteID,
+                Bucket: webhook.Bucket,
+                Prefix: webhook.Prefix,
+                URL: webhook.URL,
+            }
+        }
+
+        encodedWebhooks, _ := json.Marshal(webhookBodies)
+
+        w.Header().Set("Content-Type", "application/json; charset=utf8")
+        w.WriteHeader(http.StatusOK)
+        io.WriteString(w, string(encodedWebhooks) + "\n")
+    }).Methods("GET")
+
+    // Add a webhook or replace its configuration
+    router.HandleFunc("/webhooks/{webhookID}", func(w http.ResponseWriter, r *http.Request) {
+        var webhookBody WebhookBody
+
+        if err := json.NewDecoder(r.Body).Decode(&webhookBody); err != nil {
+            Log.Warningf("PUT /webhooks/{webhookID}: Unable to parse webhook body: %v", err)
+
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusBadRequest)
+            io.WriteString(w, string(EReadBody.JSON()) + "\n")
+
+            return
+        }
+
+        if webhookURL, err := url.Parse(webhookBody.URL); err != nil || (webhookURL.Scheme != "http" && webhookURL.Scheme != "https") || webhookURL.Host == "" {
+            Log.Warningf("PUT /webhooks/{webhookID}: Invalid webhook URL %s", webhookBody.URL)
+
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusBadRequest)
+            io.WriteString(w, string(EWebhookBody.JSON()) + "\n")
+
+            return
+        }
+
+        err := webhooksEndpoint.ClusterFacade.SetWebhook(r.Context(), mux.Vars(r)["webhookID"], &Webhook{
+            SiteID: webhookBody.SiteID,
+            Bucket: webhookBody.Bucket,
+            Prefix: webhookBody.Prefix,
+            URL: webhookBody.URL,
+            Secret: webhookBody.Secret,
+        })
+
+        if err == EInvalidWebhook {
+            Log.Warningf("PUT /webhooks/{webhookID}: Invalid webhook")
+
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusBadRequest)
+            io.WriteString(w, string(EWebhookBody.JSON()) + "\n")
+
+            return
+        }
+
+        if err == ENoSuchSite {
+            Log.Warningf("PUT /webhooks/{webhookID}: Site does not exist")
+
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusNotFound)
+            io.WriteString(w, string(ESiteDoesNotExist.JSON()) + "\n")
+
+            return
+        }
+
+        if err != nil {
+            Log.Warningf("PUT /webhooks/{webhookID}: %v", err.Error())
+
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusInternalServerError)
+            io.WriteString(w, "\n")
+
+            return
+        }
+
+        w.Header().Set("Content-Type", "application/json; charset=utf8")
+        w.WriteHeader(http.StatusOK)
+        io.WriteString(w, "\n")
+    }).Methods("PUT")
+
+    // Remove a webhook. Its delivery state is discarded
+    router.HandleFunc("/webhooks/{webhookID}", func(w http.ResponseWriter, r *http.Request) {
+        webhookID := mux.Vars(r)["webhookID"]
+
+        if _, ok := webhooksEndpoint.ClusterFacade.Webhooks()[webhookID]; !ok {
+            Log.Warningf("DELETE /webhooks/{webhookID}: Webhook does not exist")
+
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusNotFound)
+            io.WriteString(w, string(EWebhookDoesNotExist.JSON()) + "\n")
+
+            return
+        }
+
+        if err := webhooksEndpoint.ClusterFacade.SetWebhook(r.Context(), webhookID, nil); err != nil {
+            Log.Warningf("DELETE /webhooks/{webhookID}: %v", err.Error())
+
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusInternalServerError)
+            io.WriteString(w, "\n")
+
+            return
+        }
+
+        w.Header().Set("Content-Type", "application/json; charset=utf8")
+        w.WriteHeader(http.StatusOK)
+        io.WriteString(w, "\n")
+    }).Methods("DELETE")
+
+    // Get the delivery metrics and dead letters of a webhook across the
+    // cluster. With local set only the deliveries made by this node are
+    // included
+    router.HandleFunc("/webhooks/{webhookID}/status", func(w http.ResponseWriter, r *http.Request) {
+        var status webhooks.Status
+        var err error
+
+        _, local := r.URL.Query()["local"]
+
+        if local {
+            status, err = webhooksEndpoint.ClusterFacade.LocalWebhookStatus(mux.Vars(r)["webhookID"])
+        } else {
+            status, err = webhooksEndpoint.ClusterFacade.WebhookStatus(r.Context(), mux.Vars(r)["webhookID"])
+        }
+
+        if err == EWebhookDoesNotExist {
+            Log.Warningf("GET /webhooks/{webhookID}/status: Webhook does not exist")
+
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusNotFound)
+            io.WriteString(w, string(EWebhookDoesNotExist.JSON()) + "\n")
+
+            return
+        }
+
+        if err != nil {
+            Log.Warningf("GET /webhooks/{webhookID}/status: %v", err.Error())
+
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusInternalServerError)
+            io.WriteString(w, "\n")
+
+            return
+        }
+
+        encodedStatus, _ := json.Marshal(status)
+
+        w.Header().Set("Content-Type", "application/json; charset=utf8")
+        w.WriteHeader(http.StatusOK)
+        io.WriteString(w, string(encodedStatus) + "\n")
+    }).Methods("GET")
+}
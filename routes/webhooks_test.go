@@ -0,0 +1,326 @@
+package routes_test
+//
+ // Copyright (c) 2019 ARM Limited.
+ //
+ // SPDX-License-Identifier: MIT
+ //
+ // Permission is hereby granted, free of charge, to any person obtaining a copy
+ // of this software and associated documentation files (the "Software"), to
+ // deal in the Software without restriction, including without limitation the
+ // rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ // sell copies of the Software, and to permit persons to whom the Software is
+ // furnished to do so, subject to the following conditions:
+ //
+ // The above copyright notice and this permission notice shall be included in all
+ // copies or substantial portions of the Software.
+ //
+ // THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ // IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ // FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ // AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ // LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ // SOFTWARE.
+ //
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+
+    . "github.com/armPelionEdge/devicedb/cluster"
+    . "github.com/armPelionEdge/devicedb/error"
+    . "github.com/armPelionEdge/devicedb/routes"
+    "github.com/armPelionEdge/devicedb/webhooks"
+
+    . "github.com/onsi/ginkgo"
+    . "github.com/onsi/gomega"
+
+    "github.com/gorilla/mux"
+)
+
+var _ = Describe("Webhooks", func() {
+    var router *mux.Router
+    var webhooksEndpoint *WebhooksEndpoint
+    var clusterFacade *MockClusterFacade
+
+    BeforeEach(func() {
+        clusterFacade = &MockClusterFacade{ }
+        router = mux.NewRouter()
+        webhooksEndpoint = &WebhooksEndpoint{
+            ClusterFacade: clusterFacade,
+        }
+        webhooksEndpoint.Attach(router)
+    })
+
+    Describe("/webhooks", func() {
+        Describe("GET", func() {
+            It("Should respond with the webhooks in the cluster without their secrets", func() {
+                req, err := http.NewRequest("GET", "/webhooks", nil)
+
+                Expect(err).Should(BeNil())
+
+                clusterFacade.defaultWebhooksResponse = map[string]Webhook{
+                    "hook1": Webhook{ SiteID: "site1", Bucket: "default", Prefix: "a", URL: "http://localhost:8080", Secret: "secret" },
+                }
+
+                rr := httptest.NewRecorder()
+                router.ServeHTTP(rr, req)
+
+                Expect(rr.Code).Should(Equal(http.StatusOK))
+                Expect(rr.Body.String()).ShouldNot(ContainSubstring("secret"))
+
+                var webhookBodies map[string]WebhookBody
+
+                Expect(json.Unmarshal(rr.Body.Bytes(), &webhookBodies)).Should(BeNil())
+                Expect(webhookBodies).Should(Equal(map[string]WebhookBody{
+                    "hook1": WebhookBody{ SiteID: "site1", Bucket: "default", Prefix: "a", URL: "http://localhost:8080" },
+                }))
+            })
+        })
+    })
+
+    Describe("/webhooks/{webhookID}", func() {
+        Describe("PUT", func() {
+            Context("When the request body cannot be parsed", func() {
+                It("Should respond with status code http.StatusBadRequest", func() {
+                    req, err := http.NewRequest("PUT", "/webhooks/hook1", strings.NewReader("asdf"))
+
+                    Expect(err).Should(BeNil())
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    Expect(rr.Code).Should(Equal(http.StatusBadRequest))
+                })
+            })
+
+            Context("When the URL is not an absolute http or https URL", func() {
+                It("Should respond with status code http.StatusBadRequest", func() {
+                    req, err := http.NewRequest("PUT", "/webhooks/hook1", strings.NewReader(`{"bucket":"default","url":"ftp://localhost"}`))
+
+                    Expect(err).Should(BeNil())
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    Expect(rr.Code).Should(Equal(http.StatusBadRequest))
+
+                    var dbError DBerror
+
+                    Expect(json.Unmarshal(rr.Body.Bytes(), &dbError)).Should(BeNil())
+                    Expect(dbError).Should(Equal(EWebhookBody))
+                })
+            })
+
+            Context("When the body is valid", func() {
+                It("Should call SetWebhook() on the node facade with the decoded webhook", func() {
+                    req, err := http.NewRequest("PUT", "/webhooks/hook1", strings.NewReader(`{"siteID":"site1","bucket":"default","prefix":"a","url":"https://example.com/hook","secret":"secret"}`))
+
+                    Expect(err).Should(BeNil())
+
+                    setWebhookCalled := make(chan int, 1)
+                    clusterFacade.setWebhookCB = func(ctx context.Context, webhookID string, webhook *Webhook) {
+                        Expect(webhookID).Should(Equal("hook1"))
+                        Expect(webhook).Should(Equal(&Webhook{ SiteID: "site1", Bucket: "default", Prefix: "a", URL: "https://example.com/hook", Secret: "secret" }))
+                        setWebhookCalled <- 1
+                    }
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    select {
+                    case <-setWebhookCalled:
+                    default:
+                        Fail("Should have invoked SetWebhook()")
+                    }
+
+                    Expect(rr.Code).Should(Equal(http.StatusOK))
+                })
+            })
+
+            Context("When SetWebhook() returns EInvalidWebhook", func() {
+                It("Should respond with status code http.StatusBadRequest", func() {
+                    req, err := http.NewRequest("PUT", "/webhooks/hook1", strings.NewReader(`{"url":"https://example.com/hook"}`))
+
+                    Expect(err).Should(BeNil())
+
+                    clusterFacade.defaultSetWebhookResponse = EInvalidWebhook
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    Expect(rr.Code).Should(Equal(http.StatusBadRequest))
+                })
+            })
+
+            Context("When SetWebhook() returns ENoSuchSite", func() {
+                It("Should respond with status code http.StatusNotFound", func() {
+                    req, err := http.NewRequest("PUT", "/webhooks/hook1", strings.NewReader(`{"siteID":"site1","bucket":"default","url":"https://example.com/hook"}`))
+
+                    Expect(err).Should(BeNil())
+
+                    clusterFacade.defaultSetWebhookResponse = ENoSuchSite
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    Expect(rr.Code).Should(Equal(http.StatusNotFound))
+
+                    var dbError DBerror
+
+                    Expect(json.Unmarshal(rr.Body.Bytes(), &dbError)).Should(BeNil())
+                    Expect(dbError).Should(Equal(ESiteDoesNotExist))
+                })
+            })
+
+            Context("When SetWebhook() returns any other error", func() {
+                It("Should respond with status code http.StatusInternalServerError", func() {
+                    req, err := http.NewRequest("PUT", "/webhooks/hook1", strings.NewReader(`{"bucket":"default","url":"https://example.com/hook"}`))
+
+                    Expect(err).Should(BeNil())
+
+                    clusterFacade.defaultSetWebhookResponse = errors.New("Some error")
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    Expect(rr.Code).Should(Equal(http.StatusInternalServerError))
+                })
+            })
+        })
+
+        Describe("DELETE", func() {
+            Context("When the webhook does not exist", func() {
+                It("Should respond with status code http.StatusNotFound", func() {
+                    req, err := http.NewRequest("DELETE", "/webhooks/hook1", nil)
+
+                    Expect(err).Should(BeNil())
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    Expect(rr.Code).Should(Equal(http.StatusNotFound))
+
+                    var dbError DBerror
+
+                    Expect(json.Unmarshal(rr.Body.Bytes(), &dbError)).Should(BeNil())
+                    Expect(dbError).Should(Equal(EWebhookDoesNotExist))
+                })
+            })
+
+            Context("When the webhook exists", func() {
+                It("Should call SetWebhook() on the node facade with a nil webhook", func() {
+                    req, err := http.NewRequest("DELETE", "/webhooks/hook1", nil)
+
+                    Expect(err).Should(BeNil())
+
+                    clusterFacade.defaultWebhooksResponse = map[string]Webhook{ "hook1": Webhook{ Bucket: "default", URL: "http://localhost:8080" } }
+                    setWebhookCalled := make(chan int, 1)
+                    clusterFacade.setWebhookCB = func(ctx context.Context, webhookID string, webhook *Webhook) {
+                        Expect(webhookID).Should(Equal("hook1"))
+                        Expect(webhook).Should(BeNil())
+                        setWebhookCalled <- 1
+                    }
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    select {
+                    case <-setWebhookCalled:
+                    default:
+                        Fail("Should have invoked SetWebhook()")
+                    }
+
+                    Expect(rr.Code).Should(Equal(http.StatusOK))
+                })
+            })
+        })
+    })
+
+    Describe("/webhooks/{webhookID}/status", func() {
+        Describe("GET", func() {
+            Context("When the local parameter is set", func() {
+                It("Should respond with the result of LocalWebhookStatus()", func() {
+                    req, err := http.NewRequest("GET", "/webhooks/hook1/status?local=true", nil)
+
+                    Expect(err).Should(BeNil())
+
+                    clusterFacade.defaultLocalWebhookStatusResponse = webhooks.Status{ Metrics: webhooks.Metrics{ Delivered: 3 }, DeadLetters: []webhooks.DeadLetter{ } }
+                    clusterFacade.webhookStatusCB = func(ctx context.Context, webhookID string) {
+                        Fail("Should not have invoked WebhookStatus()")
+                    }
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    Expect(rr.Code).Should(Equal(http.StatusOK))
+
+                    var status webhooks.Status
+
+                    Expect(json.Unmarshal(rr.Body.Bytes(), &status)).Should(BeNil())
+                    Expect(status).Should(Equal(clusterFacade.defaultLocalWebhookStatusResponse))
+                })
+            })
+
+            Context("When the local parameter is not set", func() {
+                It("Should respond with the result of WebhookStatus()", func() {
+                    req, err := http.NewRequest("GET", "/webhooks/hook1/status", nil)
+
+                    Expect(err).Should(BeNil())
+
+                    clusterFacade.defaultWebhookStatusResponse = webhooks.Status{
+                        Metrics: webhooks.Metrics{ Delivered: 3, Failed: 1, DeadLettered: 1 },
+                        DeadLetters: []webhooks.DeadLetter{ webhooks.DeadLetter{ DeliveryID: "a-1", Payload: webhooks.Payload{ Key: "a" }, Attempts: 8 } },
+                    }
+                    clusterFacade.localWebhookStatusCB = func(webhookID string) {
+                        Fail("Should not have invoked LocalWebhookStatus()")
+                    }
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    Expect(rr.Code).Should(Equal(http.StatusOK))
+
+                    var status webhooks.Status
+
+                    Expect(json.Unmarshal(rr.Body.Bytes(), &status)).Should(BeNil())
+                    Expect(status).Should(Equal(clusterFacade.defaultWebhookStatusResponse))
+                })
+            })
+
+            Context("When the webhook does not exist", func() {
+                It("Should respond with status code http.StatusNotFound", func() {
+                    req, err := http.NewRequest("GET", "/webhooks/hook1/status", nil)
+
+                    Expect(err).Should(BeNil())
+
+                    clusterFacade.defaultWebhookStatusError = EWebhookDoesNotExist
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    Expect(rr.Code).Should(Equal(http.StatusNotFound))
+                })
+            })
+
+            Context("When WebhookStatus() returns any other error", func() {
+                It("Should respond with status code http.StatusInternalServerError", func() {
+                    req, err := http.NewRequest("GET", "/webhooks/hook1/status", nil)
+
+                    Expect(err).Should(BeNil())
+
+                    clusterFacade.defaultWebhookStatusError = errors.New("Some error")
+
+                    rr := httptest.NewRecorder()
+                    router.ServeHTTP(rr, req)
+
+                    Expect(rr.Code).Should(Equal(http.StatusInternalServerError))
+                })
+            })
+        })
+    })
+})
@@ -0,0 +1,264 @@
+package server
+//
+ // Copyright (c) 2019 ARM Limited.
+ //
+ // SPDX-License-Identifier: MIT
+ //
+ // Permission is hereby granted, free of charge, to any person obtaining a copy
+ // of this software and associated documentation files (the "Software"), to
+ // deal in the Software without restriction, including without limitation the
+ // rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ // sell copies of the Software, and to permit persons to whom the Software is
+ // furnished to do so, subject to the following conditions:
+ //
+ // The above copyright notice and this permission notice shall be included in all
+ // copies or substantial portions of the Software.
+ //
+ // THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ // IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ // FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ // AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ // LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ // SOFTWARE.
+ //
+
+
+import (
+    "sync"
+    "time"
+
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+// Traffic classes on a metered link, most important first. When traffic
+// of several classes is waiting for bandwidth the more important class is
+// served first.
+const (
+    BANDWIDTH_PRIORITY_LIVE = iota
+    BANDWIDTH_PRIORITY_ANTI_ENTROPY = iota
+    BANDWIDTH_PRIORITY_FORWARD = iota
+)
+
+// The share of the period budget, in percent, that each priority is
+// allowed to use up. What is left over once anti-entropy and forwarding
+// have been cut off stays available for live updates
+var bandwidthBudgetShares = [...]uint64{ 100, 90, 80 }
+
+var bandwidthPriorityNames = [...]string{ "live", "anti_entropy", "forward" }
+
+const bandwidthPollInterval = time.Millisecond * 10
+
+// The budget period used when a budget is set without one
+const BANDWIDTH_DEFAULT_BUDGET_PERIOD = time.Hour * 24
+
+var (
+    prometheusBandwidthBudgetRemainingGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+        Namespace: "relays",
+        Subsystem: "devicedb_internal",
+        Name: "bandwidth_budget_remaining_bytes",
+        Help: "The number of bytes left in the current bandwidth budget period for the cloud connection",
+    })
+
+    prometheusBandwidthBytesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+        Namespace: "relays",
+        Subsystem: "devicedb_internal",
+        Name: "bandwidth_bytes",
+        Help: "The number of bytes sent to or received from the cloud counted against the bandwidth budget",
+    }, []string{ "priority" })
+)
+
+func init() {
+    prometheus.MustRegister(prometheusBandwidthBudgetRemainingGauge, prometheusBandwidthBytesCounter)
+}
+
+// A BandwidthGovernor meters traffic on the link between a relay and the
+// cloud. It combines a budget of bytes per period, for links with a data
+// cap, with a token bucket that limits the rate at which bytes are sent.
+// A zero budget or rate disables that limit
+type BandwidthGovernor struct {
+    lock sync.Mutex
+    budget uint64
+    budgetPeriod time.Duration
+    periodStart time.Time
+    spent uint64
+    rate float64
+    burst float64
+    tokens float64
+    lastRefill time.Time
+    waiting [len(bandwidthPriorityNames)]int
+}
+
+func NewBandwidthGovernor(budget uint64, budgetPeriod time.Duration, rate uint64, burst uint64) *BandwidthGovernor {
+    if burst == 0 {
+        burst = rate
+    }
+
+    // Without a period the budget would never be refilled
+    if budget != 0 && budgetPeriod <= 0 {
+        budgetPeriod = BANDWIDTH_DEFAULT_BUDGET_PERIOD
+    }
+
+    now := time.Now()
+    governor := &BandwidthGovernor{
+        budget: budget,
+        budgetPeriod: budgetPeriod,
+        periodStart: now,
+        rate: float64(rate),
+        burst: float64(burst),
+        tokens: float64(burst),
+        lastRefill: now,
+    }
+
+    if budget != 0 {
+        prometheusBandwidthBudgetRemainingGauge.Set(float64(budget))
+    }
+
+    return governor
+}
+
+// Must be called with the lock held
+func (governor *BandwidthGovernor) refill(now time.Time) {
+    if governor.budget != 0 && governor.budgetPeriod > 0 && now.Sub(governor.periodStart) >= governor.budgetPeriod {
+        periods := now.Sub(governor.periodStart) / governor.budgetPeriod
+        governor.periodStart = governor.periodStart.Add(periods * governor.budgetPeriod)
+
+        // Bytes spent beyond the budget are a debt paid off by the periods
+        // that follow
+        if debt := uint64(periods) * governor.budget; governor.spent > debt {
+            governor.spent -= debt
+        } else {
+            governor.spent = 0
+        }
+    }
+
+    if governor.rate != 0 {
+        governor.tokens += now.Sub(governor.lastRefill).Seconds() * governor.rate
+
+        if governor.tokens > governor.burst {
+            governor.tokens = governor.burst
+        }
+    }
+
+    governor.lastRefill = now
+}
+
+// Must be called with the lock held. Returns how long a caller must wait
+// before sending n bytes at the given priority, or zero if it may send now
+func (governor *BandwidthGovernor) delay(priority int, n int, now time.Time) time.Duration {
+    for p := 0; p < priority; p++ {
+        if governor.waiting[p] > 0 {
+            return bandwidthPollInterval
+        }
+    }
+
+    // A message larger than its share of the budget can never fit. Let it
+    // through at the start of a fresh period and go into debt for the rest
+    share := governor.budget * bandwidthBudgetShares[priority] / 100
+
+    if governor.budget != 0 && governor.spent + uint64(n) > share && (governor.spent > 0 || uint64(n) <= share) {
+        if wait := governor.periodStart.Add(governor.budgetPeriod).Sub(now); wait > 0 {
+            return wait
+        }
+
+        return bandwidthPollInterval
+    }
+
+    // A message larger than the bucket can never be covered in full. Let it
+    // through once the bucket is full and go into debt for the rest
+    if governor.rate != 0 && governor.tokens < float64(n) && governor.tokens < governor.burst {
+        needed := float64(n)
+
+        if needed > governor.burst {
+            needed = governor.burst
+        }
+
+        return time.Duration((needed - governor.tokens) / governor.rate * float64(time.Second)) + time.Millisecond
+    }
+
+    return 0
+}
+
+// Must be called with the lock held
+func (governor *BandwidthGovernor) spend(priority int, n int) {
+    governor.spent += uint64(n)
+
+    if governor.rate != 0 {
+        governor.tokens -= float64(n)
+    }
+
+    prometheusBandwidthBytesCounter.WithLabelValues(bandwidthPriorityNames[priority]).Add(float64(n))
+
+    if governor.budget != 0 {
+        prometheusBandwidthBudgetRemainingGauge.Set(float64(governor.remaining()))
+    }
+}
+
+// Must be called with the lock held
+func (governor *BandwidthGovernor) remaining() uint64 {
+    if governor.spent >= governor.budget {
+        return 0
+    }
+
+    return governor.budget - governor.spent
+}
+
+// Acquire blocks until n bytes may be sent at the given priority. It
+// returns false without using any bandwidth if cancel is closed first
+func (governor *BandwidthGovernor) Acquire(priority int, n int, cancel <-chan bool) bool {
+    governor.lock.Lock()
+    governor.waiting[priority]++
+
+    for {
+        now := time.Now()
+        governor.refill(now)
+        wait := governor.delay(priority, n, now)
+
+        if wait <= 0 {
+            governor.waiting[priority]--
+            governor.spend(priority, n)
+            governor.lock.Unlock()
+
+            return true
+        }
+
+        governor.lock.Unlock()
+
+        select {
+        case <-time.After(wait):
+        case <-cancel:
+            governor.lock.Lock()
+            governor.waiting[priority]--
+            governor.lock.Unlock()
+
+            return false
+        }
+
+        governor.lock.Lock()
+    }
+}
+
+// Record counts bytes that have already crossed the link, such as data
+// received from the cloud, against the budget without waiting
+func (governor *BandwidthGovernor) Record(priority int, n int) {
+    governor.lock.Lock()
+    defer governor.lock.Unlock()
+
+    governor.refill(time.Now())
+    governor.spend(priority, n)
+}
+
+// Remaining returns the number of bytes left in the current budget period.
+// ok is false if no budget is configured
+func (governor *BandwidthGovernor) Remaining() (remaining uint64, ok bool) {
+    governor.lock.Lock()
+    defer governor.lock.Unlock()
+
+    if governor.budget == 0 {
+        return 0, false
+    }
+
+    governor.refill(time.Now())
+
+    return governor.remaining(), true
+}
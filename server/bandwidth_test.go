@@ -0,0 +1,144 @@
+package server_test
+//
+ // Copyright (c) 2019 ARM Limited.
+ //
+ // SPDX-License-Identifier: MIT
+ //
+ // Permission is hereby granted, free of charge, to any person obtaining a copy
+ // of this software and associated documentation files (the "Software"), to
+ // deal in the Software without restriction, including without limitation the
+ // rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ // sell copies of the Software, and to permit persons to whom the Software is
+ // furnished to do so, subject to the following conditions:
+ //
+ // The above copyright notice and this permission notice shall be included in all
+ // copies or substantial portions of the Software.
+ //
+ // THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ // IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ // FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ // AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ // LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ // SOFTWARE.
+ //
+
+
+import (
+    "time"
+
+    . "github.com/armPelionEdge/devicedb/server"
+
+    . "github.com/onsi/ginkgo"
+    . "github.com/onsi/gomega"
+)
+
+var _ = Describe("BandwidthGovernor", func() {
+    Describe("#Acquire", func() {
+        It("should count sent bytes against the budget", func() {
+            governor := NewBandwidthGovernor(1000, time.Hour, 0, 0)
+
+            Expect(governor.Acquire(BANDWIDTH_PRIORITY_LIVE, 300, nil)).Should(BeTrue())
+            governor.Record(BANDWIDTH_PRIORITY_ANTI_ENTROPY, 200)
+
+            remaining, ok := governor.Remaining()
+
+            Expect(ok).Should(BeTrue())
+            Expect(remaining).Should(Equal(uint64(500)))
+        })
+
+        It("should hold back lower priority traffic before the budget is used up so it remains available for live updates", func() {
+            governor := NewBandwidthGovernor(1000, time.Hour, 0, 0)
+            cancel := make(chan bool)
+
+            Expect(governor.Acquire(BANDWIDTH_PRIORITY_LIVE, 850, nil)).Should(BeTrue())
+
+            close(cancel)
+
+            Expect(governor.Acquire(BANDWIDTH_PRIORITY_FORWARD, 1, cancel)).Should(BeFalse())
+            Expect(governor.Acquire(BANDWIDTH_PRIORITY_ANTI_ENTROPY, 50, nil)).Should(BeTrue())
+            Expect(governor.Acquire(BANDWIDTH_PRIORITY_ANTI_ENTROPY, 1, cancel)).Should(BeFalse())
+            Expect(governor.Acquire(BANDWIDTH_PRIORITY_LIVE, 100, nil)).Should(BeTrue())
+            Expect(governor.Acquire(BANDWIDTH_PRIORITY_LIVE, 1, cancel)).Should(BeFalse())
+
+            remaining, _ := governor.Remaining()
+
+            Expect(remaining).Should(Equal(uint64(0)))
+        })
+
+        It("should refill the budget when a new period starts", func() {
+            governor := NewBandwidthGovernor(100, time.Millisecond * 200, 0, 0)
+
+            Expect(governor.Acquire(BANDWIDTH_PRIORITY_LIVE, 100, nil)).Should(BeTrue())
+
+            start := time.Now()
+
+            Expect(governor.Acquire(BANDWIDTH_PRIORITY_LIVE, 50, nil)).Should(BeTrue())
+            Expect(time.Since(start)).Should(BeNumerically(">", time.Millisecond * 100))
+
+            remaining, _ := governor.Remaining()
+
+            Expect(remaining).Should(Equal(uint64(50)))
+        })
+
+        It("should let a message larger than its share of the budget through at the start of a period and carry the excess over", func() {
+            governor := NewBandwidthGovernor(100, time.Millisecond * 200, 0, 0)
+
+            start := time.Now()
+
+            Expect(governor.Acquire(BANDWIDTH_PRIORITY_FORWARD, 250, nil)).Should(BeTrue())
+            Expect(time.Since(start)).Should(BeNumerically("<", time.Millisecond * 100))
+
+            // The 150 bytes over budget use up the next period as well
+            Expect(governor.Acquire(BANDWIDTH_PRIORITY_LIVE, 10, nil)).Should(BeTrue())
+            Expect(time.Since(start)).Should(BeNumerically(">=", time.Millisecond * 400))
+
+            remaining, _ := governor.Remaining()
+
+            Expect(remaining).Should(Equal(uint64(40)))
+        })
+
+        It("should limit the rate at which bytes are sent once the burst is used up", func() {
+            governor := NewBandwidthGovernor(0, 0, 1000, 1000)
+
+            start := time.Now()
+
+            Expect(governor.Acquire(BANDWIDTH_PRIORITY_LIVE, 1000, nil)).Should(BeTrue())
+            Expect(time.Since(start)).Should(BeNumerically("<", time.Millisecond * 100))
+            Expect(governor.Acquire(BANDWIDTH_PRIORITY_LIVE, 300, nil)).Should(BeTrue())
+            Expect(time.Since(start)).Should(BeNumerically(">=", time.Millisecond * 250))
+
+            _, ok := governor.Remaining()
+
+            Expect(ok).Should(BeFalse())
+        })
+
+        It("should let a message larger than the burst through once the bucket is full", func() {
+            governor := NewBandwidthGovernor(0, 0, 1000, 1000)
+
+            Expect(governor.Acquire(BANDWIDTH_PRIORITY_LIVE, 5000, nil)).Should(BeTrue())
+        })
+
+        It("should serve waiting higher priority traffic first", func() {
+            governor := NewBandwidthGovernor(0, 0, 1000, 100)
+            order := make(chan int, 2)
+
+            Expect(governor.Acquire(BANDWIDTH_PRIORITY_LIVE, 100, nil)).Should(BeTrue())
+
+            go func() {
+                governor.Acquire(BANDWIDTH_PRIORITY_FORWARD, 100, nil)
+                order <- BANDWIDTH_PRIORITY_FORWARD
+            }()
+
+            time.Sleep(time.Millisecond * 20)
+
+            go func() {
+                governor.Acquire(BANDWIDTH_PRIORITY_LIVE, 100, nil)
+                order <- BANDWIDTH_PRIORITY_LIVE
+            }()
+
+            Eventually(order).Should(Receive(Equal(BANDWIDTH_PRIORITY_LIVE)))
+            Eventually(order).Should(Receive(Equal(BANDWIDTH_PRIORITY_FORWARD)))
+        })
+    })
+})
@@ -26,6 +26,7 @@ package server
 
 import (
     "crypto/tls"
+    "crypto/x509"
     "net"
     "net/http"
     "time"
@@ -96,6 +97,16 @@ func (server *CloudServer) Router() *mux.Router {
     return server.router
 }
 
+// RelayCAs returns the certificate authorities that issue relay
+// certificates or nil if none were configured
+func (server *CloudServer) RelayCAs() *x509.CertPool {
+    if server.relayTLSConfig == nil {
+        return nil
+    }
+
+    return server.relayTLSConfig.ClientCAs
+}
+
 func (server *CloudServer) IsHTTPOnly() bool {
     return server.externalHost == ""
 }
@@ -34,6 +34,8 @@ type event struct {
 	Event          string      `json:"event"`
 	Metadata       interface{} `json:"metadata"`
 	Timestamp      uint64      `json:"timestamp"`
+	UUID           string      `json:"uuid,omitempty"`
+	Groups         []string    `json:"groups,omitempty"`
 }
 
 func MakeeventsFromEvents(es []*historian.Event) []*event {
@@ -51,6 +53,8 @@ func MakeeventsFromEvents(es []*historian.Event) []*event {
 			Event: e.Type,
 			Metadata: metadata,
 			Timestamp: e.Timestamp,
+			UUID: e.UUID,
+			Groups: e.Groups,
 		}
 	}
 
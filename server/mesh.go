@@ -0,0 +1,303 @@
+package server
+
+//
+ // Copyright (c) 2019 ARM Limited.
+ //
+ // SPDX-License-Identifier: MIT
+ //
+ // Permission is hereby granted, free of charge, to any person obtaining a copy
+ // of this software and associated documentation files (the "Software"), to
+ // deal in the Software without restriction, including without limitation the
+ // rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ // sell copies of the Software, and to permit persons to whom the Software is
+ // furnished to do so, subject to the following conditions:
+ //
+ // The above copyright notice and this permission notice shall be included in all
+ // copies or substantial portions of the Software.
+ //
+ // THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ // IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ // FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ // AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ // LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ // SOFTWARE.
+ //
+
+
+import (
+    "net"
+    "sort"
+    "strconv"
+    "time"
+
+    . "github.com/armPelionEdge/devicedb/logging"
+)
+
+// How long to wait before dialing a site sibling again after the
+// connection to its previous address was torn down
+const SITE_MESH_RECONCILE_DELAY = time.Second
+
+type SiteRosterRelay struct {
+    ID string
+    Address string
+}
+
+// The relays that belong to a site and the LAN addresses they advertise.
+// The cloud sends it to every relay in the site whenever it changes so
+// the relays can sync with each other directly while the cloud link is down
+type SiteRoster struct {
+    SiteID string
+    Relays []SiteRosterRelay
+}
+
+// A SiteDirectory tells a cloud hub which relays belong to a site and
+// records the addresses that relays advertise when they connect
+type SiteDirectory interface {
+    SiteRoster(siteID string) SiteRoster
+    AdvertiseRelayAddress(relayID string, address string)
+}
+
+func NewSiteRoster(siteID string, relays map[string]string) SiteRoster {
+    roster := SiteRoster{ SiteID: siteID, Relays: make([]SiteRosterRelay, 0, len(relays)) }
+
+    for relayID, address := range relays {
+        roster.Relays = append(roster.Relays, SiteRosterRelay{ ID: relayID, Address: address })
+    }
+
+    sort.Slice(roster.Relays, func(i, j int) bool {
+        return roster.Relays[i].ID < roster.Relays[j].ID
+    })
+
+    return roster
+}
+
+func (hub *Hub) SetSiteDirectory(siteDirectory SiteDirectory) {
+    hub.siteDirectory = siteDirectory
+}
+
+// Sets the LAN address that this relay advertises to the cloud so that
+// other relays in its site can connect to it
+func (hub *Hub) SetAdvertiseAddress(address string) {
+    hub.advertiseAddress = address
+}
+
+// Sends the current roster to the connected relays of every site that a
+// change to a relay affects: the site it belongs to now, which is empty
+// if it was removed, and any site whose last roster still listed it
+func (hub *Hub) PublishRelayRosters(relayID string, siteID string) {
+    sites := make(map[string]bool)
+
+    if siteID != "" {
+        sites[siteID] = true
+    }
+
+    hub.peerMapLock.Lock()
+
+    for rosterSiteID, relays := range hub.publishedRosters {
+        if relays[relayID] {
+            sites[rosterSiteID] = true
+        }
+    }
+
+    hub.peerMapLock.Unlock()
+
+    for rosterSiteID, _ := range sites {
+        hub.PublishSiteRoster(rosterSiteID)
+    }
+}
+
+// Sends the current roster for a site to the relays in that site
+func (hub *Hub) PublishSiteRoster(siteID string) {
+    if hub.siteDirectory == nil || siteID == "" {
+        return
+    }
+
+    var peers []*Peer
+
+    hub.peerMapLock.Lock()
+
+    for _, peer := range hub.peerMapBySiteID[siteID] {
+        peers = append(peers, peer)
+    }
+
+    if len(peers) == 0 {
+        delete(hub.publishedRosters, siteID)
+    }
+
+    hub.peerMapLock.Unlock()
+
+    for _, peer := range peers {
+        hub.sendSiteRoster(peer)
+    }
+}
+
+func (hub *Hub) relayHello(peer *Peer, hello Hello) {
+    // The hello is handled by the peer's reader so sending the scope or
+    // the roster can't wait on it
+    go hub.sendRelayScope(peer)
+
+    if hub.siteDirectory == nil || !peer.hasCapability(SYNC_CAPABILITY_ROSTER) {
+        return
+    }
+
+    hub.siteDirectory.AdvertiseRelayAddress(peer.id, hello.Address)
+
+    go hub.sendSiteRoster(peer)
+}
+
+func (hub *Hub) sendSiteRoster(peer *Peer) {
+    if hub.siteDirectory == nil || peer.siteID == "" || !peer.hasCapability(SYNC_CAPABILITY_ROSTER) {
+        return
+    }
+
+    roster := hub.siteDirectory.SiteRoster(peer.siteID)
+    relays := make(map[string]bool, len(roster.Relays))
+
+    for _, relay := range roster.Relays {
+        relays[relay.ID] = true
+    }
+
+    // Remembers who the site's relays were told about so that they hear
+    // about it when one of them leaves the site
+    hub.peerMapLock.Lock()
+    hub.publishedRosters[roster.SiteID] = relays
+    hub.peerMapLock.Unlock()
+
+    hub.syncController.sendSiteRoster(peer.id, roster)
+}
+
+// Relays that understand scopes leave the keys outside their subscription
+// out of the merkle trees they compare with the cloud
+func (hub *Hub) sendRelayScope(peer *Peer) {
+    if !peer.hasCapability(SYNC_CAPABILITY_SCOPE) {
+        return
+    }
+
+    hub.syncController.sendRelayScope(peer.id)
+}
+
+func (hub *Hub) updateSiteMesh(roster SiteRoster) {
+    if hub.tlsConfig == nil {
+        Log.Warningf("Ignoring the relay roster for site %s since connections to site siblings require TLS", roster.SiteID)
+
+        return
+    }
+
+    hub.meshLock.Lock()
+    hub.siteRoster = &roster
+    hub.meshLock.Unlock()
+
+    hub.reconcileSiteMesh()
+}
+
+// Connects to the site siblings listed in the latest roster and
+// disconnects from siblings that were removed from the site or that
+// moved to a different address
+func (hub *Hub) reconcileSiteMesh() {
+    hub.meshLock.Lock()
+    defer hub.meshLock.Unlock()
+
+    if hub.siteRoster == nil {
+        return
+    }
+
+    siblings := make(map[string]string)
+
+    for _, relay := range hub.siteRoster.Relays {
+        // Only the sibling with the lower ID dials so that the two don't
+        // reject each other's connection as a duplicate
+        if relay.Address == "" || relay.ID == CLOUD_PEER_ID || relay.ID <= hub.id {
+            continue
+        }
+
+        siblings[relay.ID] = relay.Address
+    }
+
+    for peerID, address := range hub.meshPeers {
+        if siblings[peerID] == address {
+            continue
+        }
+
+        Log.Infof("Disconnecting from site sibling %s at %s since it is no longer in the roster for site %s at that address", peerID, address, hub.siteRoster.SiteID)
+
+        hub.Disconnect(peerID)
+        delete(hub.meshPeers, peerID)
+    }
+
+    retry := false
+
+    for peerID, address := range siblings {
+        if _, ok := hub.meshPeers[peerID]; ok {
+            continue
+        }
+
+        if peer := hub.registeredPeer(peerID); peer != nil {
+            // A closed peer is still shutting down and will be unregistered
+            // shortly. Any other peer with this ID is either configured
+            // statically or already connected to this relay
+            if peer.isClosed() {
+                retry = true
+            }
+
+            continue
+        }
+
+        host, portString, err := net.SplitHostPort(address)
+
+        if err != nil {
+            Log.Warningf("Site sibling %s advertised an invalid address %s: %v", peerID, address, err)
+
+            continue
+        }
+
+        port, err := strconv.Atoi(portString)
+
+        if err != nil {
+            Log.Warningf("Site sibling %s advertised an invalid port in address %s", peerID, address)
+
+            continue
+        }
+
+        siblingID := peerID
+
+        if err := hub.connect(peerID, host, port, func() { hub.siteSiblingDisconnected(siblingID) }); err != nil {
+            Log.Warningf("Unable to connect to site sibling %s at %s: %v", peerID, address, err)
+
+            continue
+        }
+
+        Log.Infof("Connecting to site sibling %s at %s", peerID, address)
+
+        hub.meshPeers[peerID] = address
+    }
+
+    if retry {
+        time.AfterFunc(SITE_MESH_RECONCILE_DELAY, hub.reconcileSiteMesh)
+    }
+}
+
+// Forgets a site sibling once the connection to it is given up so that
+// the next reconciliation connects to it again if it is still in the
+// roster
+func (hub *Hub) siteSiblingDisconnected(peerID string) {
+    hub.meshLock.Lock()
+
+    // A newer connection to the sibling may already have replaced this one
+    if hub.registeredPeer(peerID) == nil {
+        delete(hub.meshPeers, peerID)
+    }
+
+    hub.meshLock.Unlock()
+
+    // Waits before reconnecting so a sibling that keeps closing the
+    // connection isn't redialed in a tight loop
+    time.AfterFunc(SITE_MESH_RECONCILE_DELAY, hub.reconcileSiteMesh)
+}
+
+func (hub *Hub) registeredPeer(peerID string) *Peer {
+    hub.peerMapLock.Lock()
+    defer hub.peerMapLock.Unlock()
+
+    return hub.peerMap[peerID]
+}
@@ -0,0 +1,454 @@
+package server_test
+
+//
+ // Copyright (c) 2019 ARM Limited.
+ //
+ // SPDX-License-Identifier: MIT
+ //
+ // Permission is hereby granted, free of charge, to any person obtaining a copy
+ // of this software and associated documentation files (the "Software"), to
+ // deal in the Software without restriction, including without limitation the
+ // rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ // sell copies of the Software, and to permit persons to whom the Software is
+ // furnished to do so, subject to the following conditions:
+ //
+ // The above copyright notice and this permission notice shall be included in all
+ // copies or substantial portions of the Software.
+ //
+ // THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ // IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ // FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ // AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ // LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ // SOFTWARE.
+ //
+
+
+import (
+    "crypto/tls"
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/gorilla/websocket"
+
+    . "github.com/armPelionEdge/devicedb/server"
+    . "github.com/armPelionEdge/devicedb/util"
+    ddbSync "github.com/armPelionEdge/devicedb/sync"
+
+    . "github.com/onsi/ginkgo"
+    . "github.com/onsi/gomega"
+)
+
+type mockSiteDirectory struct {
+    lock sync.Mutex
+    relays map[string]string
+}
+
+func (siteDirectory *mockSiteDirectory) SiteRoster(siteID string) SiteRoster {
+    siteDirectory.lock.Lock()
+    defer siteDirectory.lock.Unlock()
+
+    return NewSiteRoster(siteID, siteDirectory.relays)
+}
+
+func (siteDirectory *mockSiteDirectory) AdvertiseRelayAddress(relayID string, address string) {
+    siteDirectory.lock.Lock()
+    defer siteDirectory.lock.Unlock()
+
+    siteDirectory.relays[relayID] = address
+}
+
+func (siteDirectory *mockSiteDirectory) Address(relayID string) string {
+    siteDirectory.lock.Lock()
+    defer siteDirectory.lock.Unlock()
+
+    return siteDirectory.relays[relayID]
+}
+
+// Scopes the default bucket of every relay to the keys under zone.1.
+type scopedBucketProxyFactory struct {
+}
+
+func (factory *scopedBucketProxyFactory) IncomingBuckets(peerID string) map[string]bool {
+    return map[string]bool{ "default": true }
+}
+
+func (factory *scopedBucketProxyFactory) OutgoingBuckets(peerID string) map[string]bool {
+    return map[string]bool{ "default": true, "cloud": true }
+}
+
+func (factory *scopedBucketProxyFactory) CreateBucketProxy(peerID string, bucket string) (ddbSync.BucketProxy, error) {
+    return nil, ddbSync.ENoLocalBucket
+}
+
+func (factory *scopedBucketProxyFactory) KeyScope(peerID string, bucket string) *ddbSync.KeyScope {
+    if bucket != "default" {
+        return nil
+    }
+
+    return ddbSync.NewKeyScope([]string{ "zone.1." })
+}
+
+var _ = Describe("Site mesh", func() {
+    type meshMessage struct {
+        MessageType int `json:"type"`
+        MessageBody json.RawMessage `json:"body"`
+    }
+
+    // Reads messages until one of the given type arrives
+    readMessage := func(conn *websocket.Conn, messageType int) json.RawMessage {
+        for {
+            var message meshMessage
+
+            conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+            Expect(conn.ReadJSON(&message)).Should(BeNil())
+
+            if message.MessageType == messageType {
+                return message.MessageBody
+            }
+        }
+    }
+
+    peerIDs := func(hub *Hub) func() []string {
+        return func() []string {
+            var ids []string
+
+            for _, peer := range hub.Peers() {
+                ids = append(ids, peer.ID)
+            }
+
+            return ids
+        }
+    }
+
+    Describe("cloud", func() {
+        var hub *Hub
+        var siteDirectory *mockSiteDirectory
+        var httpServer *httptest.Server
+        var wsURL string
+
+        BeforeEach(func() {
+            siteDirectory = &mockSiteDirectory{ relays: map[string]string{ "WWRL000001": "", "WWRL000002": "10.0.0.2:9090" } }
+            hub = NewHub("", NewSyncController(2, nil, ddbSync.NewPeriodicSyncScheduler(SYNC_PERIOD_MS), 1000), nil)
+            hub.SetSiteDirectory(siteDirectory)
+            // the server is never started. It only sets up the buckets that peers sync
+            _, _ = NewServer(ServerConfig{
+                DBFile: "/tmp/testdb-" + RandomString(),
+                Port: 8383,
+                Hub: hub,
+            })
+            httpServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                conn, err := (&websocket.Upgrader{ }).Upgrade(w, r, nil)
+
+                if err != nil {
+                    return
+                }
+
+                hub.Accept(conn, 0, "WWRL000001", "site1", true)
+            }))
+            wsURL = "ws" + strings.TrimPrefix(httpServer.URL, "http")
+        })
+
+        AfterEach(func() {
+            hub.Disconnect("WWRL000001")
+            httpServer.Close()
+        })
+
+        It("should record the address a relay advertises and send it the roster for its site", func() {
+            conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+
+            Expect(err).Should(BeNil())
+
+            defer conn.Close()
+
+            readMessage(conn, SYNC_HELLO)
+
+            Expect(conn.WriteJSON(&SyncMessageWrapper{
+                MessageType: SYNC_HELLO,
+                MessageBody: Hello{
+                    MinProtocolVersion: MIN_PROTOCOL_VERSION,
+                    MaxProtocolVersion: PROTOCOL_VERSION,
+                    Capabilities: []string{ SYNC_CAPABILITY_ROSTER },
+                    Address: "10.0.0.1:9090",
+                },
+                Direction: PUSH,
+            })).Should(BeNil())
+
+            var roster SiteRoster
+
+            Expect(json.Unmarshal(readMessage(conn, SYNC_SITE_ROSTER), &roster)).Should(BeNil())
+            Expect(roster.SiteID).Should(Equal("site1"))
+            Expect(siteDirectory.Address("WWRL000001")).Should(Equal("10.0.0.1:9090"))
+
+            hub.PublishSiteRoster("site1")
+
+            Expect(json.Unmarshal(readMessage(conn, SYNC_SITE_ROSTER), &roster)).Should(BeNil())
+            Expect(roster).Should(Equal(SiteRoster{
+                SiteID: "site1",
+                Relays: []SiteRosterRelay{
+                    SiteRosterRelay{ ID: "WWRL000001", Address: "10.0.0.1:9090" },
+                    SiteRosterRelay{ ID: "WWRL000002", Address: "10.0.0.2:9090" },
+                },
+            }))
+        })
+
+        It("should only send rosters to the relays in the sites a relay change affects", func() {
+            conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+
+            Expect(err).Should(BeNil())
+
+            defer conn.Close()
+
+            readMessage(conn, SYNC_HELLO)
+
+            Expect(conn.WriteJSON(&SyncMessageWrapper{
+                MessageType: SYNC_HELLO,
+                MessageBody: Hello{
+                    MinProtocolVersion: MIN_PROTOCOL_VERSION,
+                    MaxProtocolVersion: PROTOCOL_VERSION,
+                    Capabilities: []string{ SYNC_CAPABILITY_ROSTER },
+                    Address: "10.0.0.1:9090",
+                },
+                Direction: PUSH,
+            })).Should(BeNil())
+
+            readMessage(conn, SYNC_SITE_ROSTER)
+
+            hub.PublishSiteRoster("site2")
+            hub.PublishRelayRosters("WWRL000003", "site2")
+
+            var message meshMessage
+
+            conn.SetReadDeadline(time.Now().Add(time.Millisecond * 500))
+            Expect(conn.ReadJSON(&message)).ShouldNot(BeNil())
+        })
+
+        It("should send a new roster to the site a relay moved out of", func() {
+            conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+
+            Expect(err).Should(BeNil())
+
+            defer conn.Close()
+
+            readMessage(conn, SYNC_HELLO)
+
+            Expect(conn.WriteJSON(&SyncMessageWrapper{
+                MessageType: SYNC_HELLO,
+                MessageBody: Hello{
+                    MinProtocolVersion: MIN_PROTOCOL_VERSION,
+                    MaxProtocolVersion: PROTOCOL_VERSION,
+                    Capabilities: []string{ SYNC_CAPABILITY_ROSTER },
+                    Address: "10.0.0.1:9090",
+                },
+                Direction: PUSH,
+            })).Should(BeNil())
+
+            readMessage(conn, SYNC_SITE_ROSTER)
+
+            siteDirectory.lock.Lock()
+            delete(siteDirectory.relays, "WWRL000002")
+            siteDirectory.lock.Unlock()
+
+            hub.PublishRelayRosters("WWRL000002", "site2")
+
+            var roster SiteRoster
+
+            Expect(json.Unmarshal(readMessage(conn, SYNC_SITE_ROSTER), &roster)).Should(BeNil())
+            Expect(roster).Should(Equal(SiteRoster{
+                SiteID: "site1",
+                Relays: []SiteRosterRelay{
+                    SiteRosterRelay{ ID: "WWRL000001", Address: "10.0.0.1:9090" },
+                },
+            }))
+        })
+
+        It("should not send rosters to relays that don't understand them", func() {
+            conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+
+            Expect(err).Should(BeNil())
+
+            defer conn.Close()
+
+            readMessage(conn, SYNC_HELLO)
+
+            Eventually(peerIDs(hub)).Should(Equal([]string{ "WWRL000001" }))
+
+            hub.PublishSiteRoster("site1")
+
+            var message meshMessage
+
+            conn.SetReadDeadline(time.Now().Add(time.Millisecond * 500))
+            Expect(conn.ReadJSON(&message)).ShouldNot(BeNil())
+        })
+    })
+
+    Describe("cloud with relay subscriptions", func() {
+        var hub *Hub
+        var httpServer *httptest.Server
+        var wsURL string
+
+        BeforeEach(func() {
+            hub = NewHub("", NewSyncController(2, &scopedBucketProxyFactory{ }, ddbSync.NewPeriodicSyncScheduler(SYNC_PERIOD_MS), 1000), nil)
+            httpServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                conn, err := (&websocket.Upgrader{ }).Upgrade(w, r, nil)
+
+                if err != nil {
+                    return
+                }
+
+                hub.Accept(conn, 0, "WWRL000001", "site1", true)
+            }))
+            wsURL = "ws" + strings.TrimPrefix(httpServer.URL, "http")
+        })
+
+        AfterEach(func() {
+            hub.Disconnect("WWRL000001")
+            httpServer.Close()
+        })
+
+        It("should send a relay that understands scopes the prefixes it is subscribed to", func() {
+            conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+
+            Expect(err).Should(BeNil())
+
+            defer conn.Close()
+
+            readMessage(conn, SYNC_HELLO)
+
+            Expect(conn.WriteJSON(&SyncMessageWrapper{
+                MessageType: SYNC_HELLO,
+                MessageBody: Hello{
+                    MinProtocolVersion: MIN_PROTOCOL_VERSION,
+                    MaxProtocolVersion: PROTOCOL_VERSION,
+                    Capabilities: []string{ SYNC_CAPABILITY_SCOPE },
+                },
+                Direction: PUSH,
+            })).Should(BeNil())
+
+            var scope RelayScope
+
+            Expect(json.Unmarshal(readMessage(conn, SYNC_RELAY_SCOPE), &scope)).Should(BeNil())
+            Expect(scope).Should(Equal(RelayScope{ Buckets: map[string][]string{ "default": []string{ "zone.1." } } }))
+        })
+
+        It("should not send scopes to relays that don't understand them", func() {
+            conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+
+            Expect(err).Should(BeNil())
+
+            defer conn.Close()
+
+            readMessage(conn, SYNC_HELLO)
+
+            Eventually(peerIDs(hub)).Should(Equal([]string{ "WWRL000001" }))
+
+            var message meshMessage
+
+            conn.SetReadDeadline(time.Now().Add(time.Millisecond * 500))
+            Expect(conn.ReadJSON(&message)).ShouldNot(BeNil())
+        })
+    })
+
+    Describe("relay", func() {
+        var hub *Hub
+        var httpServer *httptest.Server
+        var cloudConns chan *websocket.Conn
+
+        BeforeEach(func() {
+            cloudConns = make(chan *websocket.Conn, 1)
+            hub = NewHub("WWRL000001", NewSyncController(2, nil, ddbSync.NewPeriodicSyncScheduler(SYNC_PERIOD_MS), 1000), &tls.Config{ })
+            hub.SetAdvertiseAddress("10.0.0.1:9090")
+            _, _ = NewServer(ServerConfig{
+                DBFile: "/tmp/testdb-" + RandomString(),
+                Port: 8383,
+                Hub: hub,
+            })
+            httpServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                conn, err := (&websocket.Upgrader{ }).Upgrade(w, r, nil)
+
+                if err != nil {
+                    return
+                }
+
+                cloudConns <- conn
+            }))
+
+            Expect(hub.ConnectCloud("cloud", "ws" + strings.TrimPrefix(httpServer.URL, "http"), "", "", "", "", true)).Should(BeNil())
+        })
+
+        AfterEach(func() {
+            for _, peerID := range peerIDs(hub)() {
+                hub.Disconnect(peerID)
+            }
+
+            httpServer.Close()
+        })
+
+        sendRoster := func(conn *websocket.Conn, relays []SiteRosterRelay) {
+            Expect(conn.WriteJSON(&SyncMessageWrapper{
+                MessageType: SYNC_SITE_ROSTER,
+                MessageBody: SiteRoster{ SiteID: "site1", Relays: relays },
+                Direction: PUSH,
+            })).Should(BeNil())
+        }
+
+        It("should connect to the site siblings in the roster and drop siblings that leave the site", func() {
+            var conn *websocket.Conn
+
+            Eventually(cloudConns).Should(Receive(&conn))
+
+            defer conn.Close()
+
+            var hello Hello
+
+            Expect(json.Unmarshal(readMessage(conn, SYNC_HELLO), &hello)).Should(BeNil())
+            Expect(hello.Address).Should(Equal("10.0.0.1:9090"))
+            Expect(hello.Capabilities).Should(ContainElement(SYNC_CAPABILITY_ROSTER))
+
+            sendRoster(conn, []SiteRosterRelay{
+                SiteRosterRelay{ ID: "WWRL000000", Address: "127.0.0.1:1" },
+                SiteRosterRelay{ ID: "WWRL000001", Address: "10.0.0.1:9090" },
+                SiteRosterRelay{ ID: "WWRL000002", Address: "127.0.0.1:1" },
+                SiteRosterRelay{ ID: "WWRL000003", Address: "" },
+            })
+
+            // WWRL000000 dials this relay since its ID is lower and WWRL000003
+            // hasn't advertised an address
+            Eventually(peerIDs(hub)).Should(ConsistOf("cloud", "WWRL000002"))
+            Consistently(peerIDs(hub), time.Millisecond * 500).Should(ConsistOf("cloud", "WWRL000002"))
+
+            sendRoster(conn, []SiteRosterRelay{
+                SiteRosterRelay{ ID: "WWRL000001", Address: "10.0.0.1:9090" },
+            })
+
+            Eventually(peerIDs(hub), time.Second * 5).Should(ConsistOf("cloud"))
+        })
+
+        It("should connect to a site sibling again once the connection to it is closed", func() {
+            var conn *websocket.Conn
+
+            Eventually(cloudConns).Should(Receive(&conn))
+
+            defer conn.Close()
+
+            readMessage(conn, SYNC_HELLO)
+
+            sendRoster(conn, []SiteRosterRelay{
+                SiteRosterRelay{ ID: "WWRL000001", Address: "10.0.0.1:9090" },
+                SiteRosterRelay{ ID: "WWRL000002", Address: "127.0.0.1:1" },
+            })
+
+            Eventually(peerIDs(hub)).Should(ConsistOf("cloud", "WWRL000002"))
+
+            hub.Disconnect("WWRL000002")
+
+            Eventually(peerIDs(hub)).Should(ConsistOf("cloud"))
+            Eventually(peerIDs(hub), time.Second * 5).Should(ConsistOf("cloud", "WWRL000002"))
+        })
+    })
+})
@@ -0,0 +1,146 @@
+package server
+//
+ // Copyright (c) 2019 ARM Limited.
+ //
+ // SPDX-License-Identifier: MIT
+ //
+ // Permission is hereby granted, free of charge, to any person obtaining a copy
+ // of this software and associated documentation files (the "Software"), to
+ // deal in the Software without restriction, including without limitation the
+ // rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ // sell copies of the Software, and to permit persons to whom the Software is
+ // furnished to do so, subject to the following conditions:
+ //
+ // The above copyright notice and this permission notice shall be included in all
+ // copies or substantial portions of the Software.
+ //
+ // THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ // IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ // FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ // AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ // LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ // SOFTWARE.
+ //
+
+
+import (
+    . "github.com/armPelionEdge/devicedb/logging"
+
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+    prometheusBucketWatchersGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+        Namespace: "relays",
+        Subsystem: "devicedb_internal",
+        Name: "bucket_watchers",
+        Help: "The number of clients watching a bucket for updates",
+    }, []string{ "bucket" })
+)
+
+func init() {
+    prometheus.MustRegister(prometheusBucketWatchersGauge)
+}
+
+var (
+    bucketKeysDesc = prometheus.NewDesc(
+        prometheus.BuildFQName("relays", "devicedb_internal", "bucket_keys"),
+        "The number of keys in a bucket, tombstones included",
+        []string{ "bucket" }, nil,
+    )
+
+    bucketSizeDesc = prometheus.NewDesc(
+        prometheus.BuildFQName("relays", "devicedb_internal", "bucket_size_bytes"),
+        "The approximate number of bytes a bucket takes up on disk",
+        []string{ "bucket" }, nil,
+    )
+
+    bucketMerkleRootChangesDesc = prometheus.NewDesc(
+        prometheus.BuildFQName("relays", "devicedb_internal", "bucket_merkle_root_changes"),
+        "The number of writes that changed the merkle root hash of a bucket since the relay started",
+        []string{ "bucket" }, nil,
+    )
+
+    historyLogSizeDesc = prometheus.NewDesc(
+        prometheus.BuildFQName("relays", "devicedb_internal", "history_log_size"),
+        "The number of events in the history log",
+        nil, nil,
+    )
+
+    historyForwardLagDesc = prometheus.NewDesc(
+        prometheus.BuildFQName("relays", "devicedb_internal", "history_forward_lag"),
+        "The number of logged events not yet forwarded to the cloud",
+        nil, nil,
+    )
+
+    alertsPendingDesc = prometheus.NewDesc(
+        prometheus.BuildFQName("relays", "devicedb_internal", "alerts_pending"),
+        "The number of alerts waiting to be forwarded to the cloud",
+        nil, nil,
+    )
+)
+
+// serverCollector reads metrics that describe the state of a server
+// when they are scraped rather than tracking them as they change. It
+// is registered with a registry of its own for each server so that
+// more than one server can run in the same process
+type serverCollector struct {
+    server *Server
+}
+
+func (collector *serverCollector) Describe(ch chan<- *prometheus.Desc) {
+    ch <- bucketKeysDesc
+    ch <- bucketSizeDesc
+    ch <- bucketMerkleRootChangesDesc
+    ch <- historyLogSizeDesc
+    ch <- historyForwardLagDesc
+    ch <- alertsPendingDesc
+}
+
+func (collector *serverCollector) Collect(ch chan<- prometheus.Metric) {
+    for _, bucket := range collector.server.bucketList.All() {
+        ch <- prometheus.MustNewConstMetric(bucketKeysDesc, prometheus.GaugeValue, float64(bucket.KeyCount()), bucket.Name())
+        ch <- prometheus.MustNewConstMetric(bucketMerkleRootChangesDesc, prometheus.CounterValue, float64(bucket.MerkleRootChanges()), bucket.Name())
+
+        prefix, ok := collector.server.bucketPrefixes[bucket.Name()]
+
+        if !ok {
+            continue
+        }
+
+        size, err := collector.server.storageDriver.ApproximateSize([]byte{ prefix })
+
+        if err != nil {
+            Log.Warningf("Unable to determine the size of bucket %s: %v", bucket.Name(), err)
+
+            continue
+        }
+
+        ch <- prometheus.MustNewConstMetric(bucketSizeDesc, prometheus.GaugeValue, float64(size), bucket.Name())
+    }
+
+    if historian := collector.server.historian; historian != nil {
+        var forwardLag uint64
+
+        // LogSerial is the serial the next event will be logged with
+        if historian.LogSerial() > historian.ForwardIndex() + 1 {
+            forwardLag = historian.LogSerial() - historian.ForwardIndex() - 1
+        }
+
+        ch <- prometheus.MustNewConstMetric(historyLogSizeDesc, prometheus.GaugeValue, float64(historian.LogSize()))
+        ch <- prometheus.MustNewConstMetric(historyForwardLagDesc, prometheus.GaugeValue, float64(forwardLag))
+    }
+
+    if collector.server.alertsMap != nil {
+        alerts, err := collector.server.alertsMap.GetAlerts()
+
+        if err != nil {
+            Log.Warningf("Unable to count pending alerts: %v", err)
+
+            return
+        }
+
+        ch <- prometheus.MustNewConstMetric(alertsPendingDesc, prometheus.GaugeValue, float64(len(alerts)))
+    }
+}
@@ -39,6 +39,9 @@ import (
     "net/http"
     "io/ioutil"
     "bytes"
+    "compress/gzip"
+    "crypto/sha256"
+    "encoding/hex"
 
     . "github.com/armPelionEdge/devicedb/data"
     . "github.com/armPelionEdge/devicedb/historian"
@@ -58,6 +61,10 @@ const WRITE_WAIT_SECONDS = 10
 const PONG_WAIT_SECONDS = 60
 const PING_PERIOD_SECONDS = 40
 const CLOUD_PEER_ID = "cloud"
+// Fraction by which adaptive sync delays are randomly stretched or shrunk
+const SYNC_SESSION_JITTER = 0.25
+// How long the event forwarder waits before its first retry after a failure
+const FORWARD_RETRY_WAIT_MIN_SECONDS = 1
 
 var (
     prometheusRelayConnectionsGauge = prometheus.NewGauge(prometheus.GaugeOpts{
@@ -66,10 +73,31 @@ var (
         Name: "connections",
         Help: "The number of current relay connections",
     })
+
+    prometheusHistoryForwardedEventsCounter = prometheus.NewCounter(prometheus.CounterOpts{
+        Namespace: "relays",
+        Subsystem: "devicedb_internal",
+        Name: "history_forwarded_events",
+        Help: "The number of events forwarded to the cloud",
+    })
+
+    prometheusHistoryForwardFailuresCounter = prometheus.NewCounter(prometheus.CounterOpts{
+        Namespace: "relays",
+        Subsystem: "devicedb_internal",
+        Name: "history_forward_failures",
+        Help: "The number of event forwarding attempts that failed and had to be retried",
+    })
+
+    prometheusHistoryLastForwardGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+        Namespace: "relays",
+        Subsystem: "devicedb_internal",
+        Name: "history_last_forward_timestamp_seconds",
+        Help: "The last time a batch of events was forwarded to the cloud",
+    })
 )
 
 func init() {
-    prometheus.MustRegister(prometheusRelayConnectionsGauge)
+    prometheus.MustRegister(prometheusRelayConnectionsGauge, prometheusHistoryForwardedEventsCounter, prometheusHistoryForwardFailuresCounter, prometheusHistoryLastForwardGauge)
 }
 
 func randomID() string {
@@ -86,6 +114,11 @@ type PeerJSON struct {
     Direction string `json:"direction"`
     ID string `json:"id"`
     Status string `json:"status"`
+    ProtocolVersion uint `json:"protocolVersion,omitempty"`
+    Capabilities []string `json:"capabilities,omitempty"`
+    BandwidthRemaining *uint64 `json:"bandwidthRemaining,omitempty"`
+    PushQueueDepth int `json:"pushQueueDepth"`
+    OldestUnacknowledgedPush time.Duration `json:"oldestUnacknowledgedPush"`
 }
 
 type Peer struct {
@@ -108,6 +141,15 @@ type Peer struct {
     httpHistoryClient *http.Client
     httpAlertsClient *http.Client
     identityHeader string
+    governor *BandwidthGovernor
+    negotiationLock sync.Mutex
+    protocolVersion uint
+    capabilities map[string]bool
+    advertiseAddress string
+    helloHandler func(hello Hello)
+    rosterHandler func(roster SiteRoster)
+    scopeHandler func(scope RelayScope)
+    liveQueue *FrameQueue
 }
 
 func NewPeer(id string, direction int) *Peer {
@@ -191,53 +233,130 @@ func (peer *Peer) connect(dialer *websocket.Dialer, uri string) (chan *SyncMessa
 
 func (peer *Peer) establishChannels() (chan *SyncMessageWrapper, chan *SyncMessageWrapper) {
     connection := peer.connection
-    peer.doneChan = make(chan bool, 1)
+    doneChan := make(chan bool, 1)
+    // Callers hold csLock so done() sees either the old or the new channel
+    peer.doneChan = doneChan
     
     incoming := make(chan *SyncMessageWrapper)
     outgoing := make(chan *SyncMessageWrapper)
     
+    peer.setNegotiatedProtocol(MIN_PROTOCOL_VERSION, nil)
+    
+    // Pings have their own goroutine so they keep the connection alive while
+    // the writers are held back by the bandwidth governor
     go func() {
         pingTicker := time.NewTicker(time.Second * PING_PERIOD_SECONDS)
+        defer pingTicker.Stop()
 
         for {
             select {
-            case msg, ok := <-outgoing:
+            case <-pingTicker.C:
                 // this lock ensures mutual exclusion with close message sending in peer.close()
+                Log.Infof("Sending a ping to peer %s", peer.id)
                 peer.csLock.Lock()
                 connection.SetWriteDeadline(time.Now().Add(time.Second * WRITE_WAIT_SECONDS))
 
-                if !ok {
-                    connection.Close()
-                    peer.csLock.Unlock()
-                    return
+                encodedPingTime, _ := time.Now().MarshalJSON()
+                if err := connection.WriteMessage(websocket.PingMessage, encodedPingTime); err != nil {
+                    Log.Errorf("Unable to send ping to peer %s: %v", peer.id, err.Error())
                 }
 
-                err := connection.WriteJSON(msg)
                 peer.csLock.Unlock()
+            case <-doneChan:
+                return
+            }
+        }
+    }()
+    
+    // Each priority has its own queue and writer so session messages that
+    // wait for bandwidth don't hold up live pushes behind them
+    queues := [...]*FrameQueue{
+        BANDWIDTH_PRIORITY_LIVE: NewFrameQueue(0),
+        BANDWIDTH_PRIORITY_ANTI_ENTROPY: NewFrameQueue(SYNC_ANTI_ENTROPY_QUEUE_MAX_MESSAGES),
+    }
+    peer.liveQueue = queues[BANDWIDTH_PRIORITY_LIVE]
+    // Closed once outgoing is closed or the connection goes down. Writers
+    // waiting for bandwidth give up then
+    stopWriters := make(chan bool)
+    outgoingClosed := make(chan bool)
+    var writers sync.WaitGroup
 
-                if err != nil {
-                    Log.Errorf("Error writing to websocket for peer %s: %v", peer.id, err)
-                    //return
+    go func() {
+        select {
+        case <-outgoingClosed:
+        case <-doneChan:
+        }
+
+        close(stopWriters)
+    }()
+
+    go func() {
+        // Let the other side know which transport features this node
+        // understands. Peers that don't know about this message ignore it.
+        // It goes out before anything else
+        peer.writeFrame(connection, []*SyncMessageWrapper{ &SyncMessageWrapper{
+            MessageType: SYNC_HELLO,
+            MessageBody: Hello{
+                MinProtocolVersion: MIN_PROTOCOL_VERSION,
+                MaxProtocolVersion: PROTOCOL_VERSION,
+                Capabilities: localSyncCapabilities,
+                Address: peer.advertiseAddress,
+            },
+            Direction: PUSH,
+        } }, stopWriters)
+
+        for _, queue := range queues {
+            writers.Add(1)
+
+            go func(queue *FrameQueue) {
+                defer writers.Done()
+
+                for {
+                    select {
+                    case <-queue.Ready():
+                    case <-stopWriters:
+                        return
+                    }
+
+                    for _, frame := range frameMessages(queue.Pop(), peer.hasCapability(SYNC_CAPABILITY_BATCH)) {
+                        prometheusSyncMessagesCoalescedCounter.Add(float64(len(frame) - 1))
+                        peer.writeFrame(connection, frame, stopWriters)
+                    }
                 }
-            case <-pingTicker.C:
-                // this lock ensures mutual exclusion with close message sending in peer.close()
-                Log.Infof("Sending a ping to peer %s", peer.id)
-                peer.csLock.Lock()
-                connection.SetWriteDeadline(time.Now().Add(time.Second * WRITE_WAIT_SECONDS))
+            }(queue)
+        }
 
-                encodedPingTime, _ := time.Now().MarshalJSON()
-                if err := connection.WriteMessage(websocket.PingMessage, encodedPingTime); err != nil {
-                    Log.Errorf("Unable to send ping to peer %s: %v", peer.id, err.Error())
+        for {
+            var pending []*SyncMessageWrapper
+            msg, open := <-outgoing
+
+            if open {
+                pending, open = drainMessages([]*SyncMessageWrapper{ msg }, outgoing)
+            }
+
+            for _, msg := range pending {
+                if dropped := queues[bandwidthPriority(msg)].Push(msg); dropped != 0 {
+                    Log.Warningf("Dropped a sync message of type %d for peer %s since too many messages are waiting for bandwidth", msg.MessageType, peer.id)
+                    prometheusSyncMessagesDroppedCounter.Add(float64(dropped))
                 }
+            }
+
+            if !open {
+                close(outgoingClosed)
+                writers.Wait()
 
+                // this lock ensures mutual exclusion with close message sending in peer.close()
+                peer.csLock.Lock()
+                connection.Close()
                 peer.csLock.Unlock()
+                return
             }
         }
     }()
     
     // incoming, outgoing, err
     go func() {
-        defer close(peer.doneChan)
+        defer close(doneChan)
 
         connection.SetPongHandler(func(encodedPingTime string) error {
             var pingTime time.Time
@@ -255,22 +374,21 @@ func (peer *Peer) establishChannels() (chan *SyncMessageWrapper, chan *SyncMessa
         })
         
         for {
-            var nextRawMessage rawSyncMessageWrapper
-            var nextMessage SyncMessageWrapper
-
-            // The pong handler is invoked in the same goroutine as ReadJSON (ReadJSON calls NextReader which calls advanceFrame which will invoke the pong handler
+            // The pong handler is invoked in the same goroutine as ReadMessage (ReadMessage calls NextReader which calls advanceFrame which will invoke the pong handler
             // if it receives a pong frame). If the pong handler is invoked it will call SetReadDeadline in the same goroutine. In case a pong is never received
-            // to reset the read deadline it it necessary to set the read deadline before every call to ReadJSON(). There was a bug where connections that were broken
+            // to reset the read deadline it it necessary to set the read deadline before every call to ReadMessage(). There was a bug where connections that were broken
             // were never receiving any data but kept attempting writes. This was because the read deadline was met by receiving a data frame right before the connection
-            // broke and then no pong was ever received to again set the read deadline for the next call to ReadJSON() so ReadJSON() just hung so the broken connections
+            // broke and then no pong was ever received to again set the read deadline for the next call to ReadMessage() so ReadMessage() just hung so the broken connections
             // were never cleaned up.
             connection.SetReadDeadline(time.Now().Add(time.Second * PONG_WAIT_SECONDS))
 
-            err := connection.ReadJSON(&nextRawMessage)
+            messageType, data, err := connection.ReadMessage()
             
             if err != nil {
                 if err.Error() == "websocket: close 1000 (normal)" {
                     Log.Infof("Received a normal websocket close message from peer %s", peer.id)
+                } else if websocket.IsCloseError(err, SYNC_CLOSE_UNSUPPORTED_PROTOCOL) {
+                    Log.Errorf("Peer %s closed the connection because it does not support any protocol version between %d and %d: %v", peer.id, MIN_PROTOCOL_VERSION, PROTOCOL_VERSION, err)
                 } else {
                     Log.Errorf("Peer %s sent a misformatted message. Unable to parse: %v", peer.id, err)
                 }
@@ -281,30 +399,191 @@ func (peer *Peer) establishChannels() (chan *SyncMessageWrapper, chan *SyncMessa
             
                 return
             }
-            
-            nextMessage.SessionID = nextRawMessage.SessionID
-            nextMessage.MessageType = nextRawMessage.MessageType
-            nextMessage.Direction = nextRawMessage.Direction
-            
-            err = peer.typeCheck(&nextRawMessage, &nextMessage)
-            
+
+            rawMessages, err := decodeFrame(messageType, data)
+
+            if peer.governor != nil {
+                peer.governor.Record(receivedFramePriority(rawMessages), len(data))
+            }
+
             if err != nil {
+                Log.Errorf("Peer %s sent a misformatted message. Unable to parse: %v", peer.id, err)
+
                 peer.result = err
-                
+
                 close(incoming)
-                
+
                 return
             }
             
-            nextMessage.nodeID = peer.id
-            
-            incoming <- &nextMessage
+            for i := range rawMessages {
+                var nextRawMessage *rawSyncMessageWrapper = &rawMessages[i]
+                var nextMessage SyncMessageWrapper
+
+                nextMessage.SessionID = nextRawMessage.SessionID
+                nextMessage.MessageType = nextRawMessage.MessageType
+                nextMessage.Direction = nextRawMessage.Direction
+                nextMessage.size = frameShare(len(data), len(rawMessages))
+                
+                err = peer.typeCheck(nextRawMessage, &nextMessage)
+                
+                if err != nil {
+                    peer.result = err
+                    
+                    close(incoming)
+                    
+                    return
+                }
+
+                if nextMessage.MessageType == SYNC_HELLO {
+                    hello := nextMessage.MessageBody.(Hello)
+                    protocolVersion, err := negotiateProtocolVersion(hello)
+
+                    if err != nil {
+                        Log.Errorf("Closing connection to peer %s: %v", peer.id, err)
+
+                        peer.csLock.Lock()
+                        connection.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(SYNC_CLOSE_UNSUPPORTED_PROTOCOL, "unsupported protocol version"))
+                        peer.csLock.Unlock()
+
+                        peer.result = &websocket.CloseError{ Code: SYNC_CLOSE_UNSUPPORTED_PROTOCOL, Text: err.Error() }
+
+                        close(incoming)
+
+                        return
+                    }
+
+                    Log.Infof("Peer %s negotiated sync protocol version %d with transport features %v", peer.id, protocolVersion, hello.Capabilities)
+
+                    peer.setNegotiatedProtocol(protocolVersion, hello.Capabilities)
+
+                    if peer.helloHandler != nil {
+                        peer.helloHandler(hello)
+                    }
+
+                    continue
+                }
+
+                if nextMessage.MessageType == SYNC_SITE_ROSTER {
+                    if peer.rosterHandler != nil {
+                        peer.rosterHandler(nextMessage.MessageBody.(SiteRoster))
+                    }
+
+                    continue
+                }
+
+                if nextMessage.MessageType == SYNC_RELAY_SCOPE {
+                    if peer.scopeHandler != nil {
+                        peer.scopeHandler(nextMessage.MessageBody.(RelayScope))
+                    }
+
+                    continue
+                }
+                
+                nextMessage.nodeID = peer.id
+                
+                incoming <- &nextMessage
+            }
         }    
     }()
     
     return incoming, outgoing
 }
 
+func (peer *Peer) writeFrame(connection *websocket.Conn, frame []*SyncMessageWrapper, done chan bool) {
+    messageType, encoded, err := encodeFrame(frame, peer.hasCapability(SYNC_CAPABILITY_DEFLATE))
+
+    if err != nil {
+        Log.Errorf("Unable to encode message for peer %s: %v", peer.id, err)
+
+        return
+    }
+
+    if peer.governor != nil && !peer.governor.Acquire(framePriority(frame), len(encoded), done) {
+        return
+    }
+
+    // this lock ensures mutual exclusion with close message sending in peer.close()
+    peer.csLock.Lock()
+    connection.SetWriteDeadline(time.Now().Add(time.Second * WRITE_WAIT_SECONDS))
+    err = connection.WriteMessage(messageType, encoded)
+    peer.csLock.Unlock()
+
+    if err != nil {
+        Log.Errorf("Error writing to websocket for peer %s: %v", peer.id, err)
+
+        return
+    }
+
+    for _, msg := range frame {
+        if msg.session != nil {
+            msg.session.AddBytesSent(uint64(frameShare(len(encoded), len(frame))))
+        }
+    }
+}
+
+// Records the protocol version agreed on with the remote peer and the
+// transport features it announced. Only features this node supports as
+// well are enabled
+func (peer *Peer) setNegotiatedProtocol(protocolVersion uint, remoteCapabilities []string) {
+    peer.negotiationLock.Lock()
+    defer peer.negotiationLock.Unlock()
+
+    peer.protocolVersion = protocolVersion
+    peer.capabilities = make(map[string]bool)
+
+    for _, remoteCapability := range remoteCapabilities {
+        for _, localCapability := range localSyncCapabilities {
+            if remoteCapability == localCapability {
+                peer.capabilities[remoteCapability] = true
+            }
+        }
+    }
+}
+
+func (peer *Peer) hasCapability(capability string) bool {
+    peer.negotiationLock.Lock()
+    defer peer.negotiationLock.Unlock()
+
+    return peer.capabilities[capability]
+}
+
+func (peer *Peer) negotiatedProtocol() (uint, []string) {
+    peer.negotiationLock.Lock()
+    defer peer.negotiationLock.Unlock()
+
+    capabilities := make([]string, 0, len(peer.capabilities))
+
+    for _, capability := range localSyncCapabilities {
+        if peer.capabilities[capability] {
+            capabilities = append(capabilities, capability)
+        }
+    }
+
+    return peer.protocolVersion, capabilities
+}
+
+func (peer *Peer) negotiatedProtocolVersion() uint {
+    peer.negotiationLock.Lock()
+    defer peer.negotiationLock.Unlock()
+
+    return peer.protocolVersion
+}
+
+// Returns the number of live messages on the current connection that are
+// still waiting for bandwidth
+func (peer *Peer) liveBacklog() int {
+    peer.csLock.Lock()
+    liveQueue := peer.liveQueue
+    peer.csLock.Unlock()
+
+    if liveQueue == nil {
+        return 0
+    }
+
+    return liveQueue.Len()
+}
+
 func (peer *Peer) setRoundTripTime(duration time.Duration) {
     peer.rttLock.Lock()
     defer peer.rttLock.Unlock()
@@ -347,6 +626,22 @@ func (peer *Peer) typeCheck(rawMsg *rawSyncMessageWrapper, msg *SyncMessageWrapp
         var pushDoneMessage PushDone
         err = json.Unmarshal(rawMsg.MessageBody, &pushDoneMessage)
         msg.MessageBody = pushDoneMessage
+    case SYNC_HELLO:
+        var hello Hello
+        err = json.Unmarshal(rawMsg.MessageBody, &hello)
+        msg.MessageBody = hello
+    case SYNC_SITE_ROSTER:
+        var roster SiteRoster
+        err = json.Unmarshal(rawMsg.MessageBody, &roster)
+        msg.MessageBody = roster
+    case SYNC_PUSH_ACK:
+        var pushAck PushAck
+        err = json.Unmarshal(rawMsg.MessageBody, &pushAck)
+        msg.MessageBody = pushAck
+    case SYNC_RELAY_SCOPE:
+        var scope RelayScope
+        err = json.Unmarshal(rawMsg.MessageBody, &scope)
+        msg.MessageBody = scope
     }
     
     return err
@@ -377,6 +672,15 @@ func (peer *Peer) close(closeCode int) {
     }
 }
 
+// done returns a channel that is closed once the current connection to the
+// peer goes down
+func (peer *Peer) done() <-chan bool {
+    peer.csLock.Lock()
+    defer peer.csLock.Unlock()
+
+    return peer.doneChan
+}
+
 func (peer *Peer) isClosed() bool {
     return peer.closed
 }
@@ -396,12 +700,24 @@ func (peer *Peer) toJSON(peerID string) *PeerJSON {
     } else {
         status = "up"
     }
-    
-    return &PeerJSON{
+
+    peerJSON := &PeerJSON{
         Direction: direction,
         Status: status,
         ID: peerID,
     }
+
+    if status == "up" {
+        peerJSON.ProtocolVersion, peerJSON.Capabilities = peer.negotiatedProtocol()
+    }
+
+    if peer.governor != nil {
+        if remaining, ok := peer.governor.Remaining(); ok {
+            peerJSON.BandwidthRemaining = &remaining
+        }
+    }
+    
+    return peerJSON
 }
 
 func (peer *Peer) useHistoryServer(tlsBaseConfig *tls.Config, historyServerName string, historyURI string, alertsServerName string, alertsURI string, noValidate bool) {
@@ -427,16 +743,39 @@ func (peer *Peer) useHistoryServer(tlsBaseConfig *tls.Config, historyServerName
         peer.httpAlertsClient = &http.Client{ Transport: &http.Transport{ TLSClientConfig: &tlsConfig } }
 }
 
-func (peer *Peer) pushEvents(events []*Event) error {
+// pushEvents gives up waiting for bandwidth once cancel is closed
+func (peer *Peer) pushEvents(events []*Event, cancel <-chan bool) error {
     // try to forward event to the cloud if failed or error response then return
     eventsJSON, _ := json.Marshal(MakeeventsFromEvents(events))
-    request, err := http.NewRequest("POST", peer.historyURI, bytes.NewReader(eventsJSON))
+
+    var body bytes.Buffer
+    gzipWriter := gzip.NewWriter(&body)
+
+    if _, err := gzipWriter.Write(eventsJSON); err != nil {
+        return err
+    }
+
+    if err := gzipWriter.Close(); err != nil {
+        return err
+    }
+
+    if peer.governor != nil && !peer.governor.Acquire(BANDWIDTH_PRIORITY_FORWARD, body.Len(), cancel) {
+        return errors.New("Event forwarding was stopped while waiting for bandwidth")
+    }
+
+    request, err := http.NewRequest("POST", peer.historyURI, &body)
     
     if err != nil {
         return err
     }
     
     request.Header.Add("Content-Type", "application/json")
+    request.Header.Add("Content-Encoding", "gzip")
+    request.Header.Add("Idempotency-Key", eventsIdempotencyKey(events))
+
+    if peer.identityHeader != "" {
+        request.Header.Set("X-WigWag-RelayID", peer.identityHeader)
+    }
     
     resp, err := peer.httpHistoryClient.Do(request)
     
@@ -459,7 +798,22 @@ func (peer *Peer) pushEvents(events []*Event) error {
     return nil
 }
 
-func (peer *Peer) pushAlerts(alerts map[string]Alert) error {
+// eventsIdempotencyKey derives a key from the UUIDs of a batch of events.
+// A batch that is retried after a failed push has the same key so the
+// history server can tell it has already stored it
+func eventsIdempotencyKey(events []*Event) string {
+    hash := sha256.New()
+
+    for _, event := range events {
+        hash.Write([]byte(event.UUID))
+        hash.Write([]byte{ 0 })
+    }
+
+    return hex.EncodeToString(hash.Sum(nil))
+}
+
+// pushAlerts gives up waiting for bandwidth once cancel is closed
+func (peer *Peer) pushAlerts(alerts map[string]Alert, cancel <-chan bool) error {
     var alertsList []Alert = make([]Alert, 0, len(alerts))
 
     for _, alert := range alerts {
@@ -467,6 +821,11 @@ func (peer *Peer) pushAlerts(alerts map[string]Alert) error {
     }
 
     alertsJSON, _ := json.Marshal(alertsList)
+
+    if peer.governor != nil && !peer.governor.Acquire(BANDWIDTH_PRIORITY_FORWARD, len(alertsJSON), cancel) {
+        return errors.New("Alert forwarding was stopped while waiting for bandwidth")
+    }
+
     request, err := http.NewRequest("POST", peer.alertsURI, bytes.NewReader(alertsJSON))
     
     if err != nil {
@@ -474,6 +833,10 @@ func (peer *Peer) pushAlerts(alerts map[string]Alert) error {
     }
     
     request.Header.Add("Content-Type", "application/json")
+
+    if peer.identityHeader != "" {
+        request.Header.Set("X-WigWag-RelayID", peer.identityHeader)
+    }
     
     resp, err := peer.httpHistoryClient.Do(request)
     
@@ -534,7 +897,10 @@ type Hub struct {
     peerMapBySiteID map[string]map[string]*Peer
     syncController *SyncController
     forwardEvents chan int
+    flushEvents chan int
     forwardAlerts chan int
+    // Closed by StopForwarding to end event and alert forwarding
+    stopForwarding chan bool
     historian *Historian
     alertsMap *AlertMap
     purgeOnForward bool
@@ -542,6 +908,13 @@ type Hub struct {
     forwardThreshold uint64
     forwardInterval uint64
     alertsForwardInterval uint64
+    bandwidthGovernor *BandwidthGovernor
+    siteDirectory SiteDirectory
+    advertiseAddress string
+    meshLock sync.Mutex
+    siteRoster *SiteRoster
+    meshPeers map[string]string
+    publishedRosters map[string]map[string]bool
 }
 
 func NewHub(id string, syncController *SyncController, tlsConfig *tls.Config) *Hub {
@@ -553,7 +926,11 @@ func NewHub(id string, syncController *SyncController, tlsConfig *tls.Config) *H
         peerMapBySiteID: make(map[string]map[string]*Peer),
         id: id,
         forwardEvents: make(chan int, 1),
+        flushEvents: make(chan int, 1),
         forwardAlerts: make(chan int, 1),
+        stopForwarding: make(chan bool),
+        meshPeers: make(map[string]string),
+        publishedRosters: make(map[string]map[string]bool),
     }
     
     return hub
@@ -600,6 +977,9 @@ func (hub *Hub) Accept(connection *websocket.Conn, partitionNumber uint64, relay
             peer := NewPeer(peerID, INCOMING)
             peer.partitionNumber = partitionNumber
             peer.siteID = siteID
+            peer.helloHandler = func(hello Hello) {
+                hub.relayHello(peer, hello)
+            }
             
             if !hub.register(peer) {
                 Log.Warningf("Rejected peer connection from %s because that peer is already connected", peerID)
@@ -623,7 +1003,11 @@ func (hub *Hub) Accept(connection *websocket.Conn, partitionNumber uint64, relay
             
             Log.Infof("Accepted peer connection from %s", peerID)
             
-            hub.syncController.addPeer(peer.id, outgoing)
+            hub.syncController.addPeer(peer.id, outgoing, peer.negotiatedProtocolVersion, peer.liveBacklog)
+            // The hello may have been processed before the peer was added
+            // in which case the roster and scope couldn't be sent then
+            hub.sendSiteRoster(peer)
+            hub.sendRelayScope(peer)
                 
             for msg := range incoming {
                 hub.syncController.incoming <- msg
@@ -654,6 +1038,12 @@ func (hub *Hub) ConnectCloud(serverName, uri, historyServerName, historyURI, ale
     
     go func() {
         peer := NewPeer(CLOUD_PEER_ID, OUTGOING)
+        peer.governor = hub.bandwidthGovernor
+        peer.advertiseAddress = hub.advertiseAddress
+        peer.rosterHandler = hub.updateSiteMesh
+        peer.scopeHandler = func(scope RelayScope) {
+            hub.syncController.setKeyScopes(peer.id, scope)
+        }
     
         // simply try to reserve a spot in the peer map
         if !hub.register(peer) {
@@ -672,7 +1062,7 @@ func (hub *Hub) ConnectCloud(serverName, uri, historyServerName, historyURI, ale
             
             Log.Infof("Connected to devicedb cloud")
             
-            hub.syncController.addPeer(peer.id, outgoing)
+            hub.syncController.addPeer(peer.id, outgoing, peer.negotiatedProtocolVersion, peer.liveBacklog)
         
             // incoming is closed when the peer is disconnected from either end
             for msg := range incoming {
@@ -680,6 +1070,8 @@ func (hub *Hub) ConnectCloud(serverName, uri, historyServerName, historyURI, ale
             }
         
             hub.syncController.removePeer(peer.id)
+            // The cloud sends the scope again once it reconnects
+            hub.syncController.setKeyScopes(peer.id, RelayScope{ })
             
             if websocket.IsCloseError(peer.errors(), websocket.CloseNormalClosure) {
                 Log.Infof("Disconnected from devicedb cloud")
@@ -687,6 +1079,19 @@ func (hub *Hub) ConnectCloud(serverName, uri, historyServerName, historyURI, ale
                 break
             }
             
+            if websocket.IsCloseError(peer.errors(), SYNC_CLOSE_UNSUPPORTED_PROTOCOL) {
+                // Retrying right away won't help until one side is upgraded
+                Log.Errorf("Disconnected from devicedb cloud because there is no protocol version both sides support. Reconnecting in %ds...", RECONNECT_WAIT_MAX_SECONDS)
+                
+                select {
+                case <-time.After(time.Second * RECONNECT_WAIT_MAX_SECONDS):
+                    continue
+                case <-peer.closeChan:
+                }
+
+                break
+            }
+            
             Log.Infof("Disconnected from devicedb cloud. Reconnecting...")
             <-time.After(time.Second)
         }
@@ -698,6 +1103,12 @@ func (hub *Hub) ConnectCloud(serverName, uri, historyServerName, historyURI, ale
 }
 
 func (hub *Hub) Connect(peerID, host string, port int) error {
+    return hub.connect(peerID, host, port, nil)
+}
+
+// connect calls disconnected, if set, once it stops reconnecting to the
+// peer and the peer is unregistered
+func (hub *Hub) connect(peerID, host string, port int, disconnected func()) error {
     dialer, err := hub.dialer(peerID, false, false)
     
     if peerID == CLOUD_PEER_ID {
@@ -710,14 +1121,14 @@ func (hub *Hub) Connect(peerID, host string, port int) error {
         return err
     }    
     
+    peer := NewPeer(peerID, OUTGOING)
+
+    // simply try to reserve a spot in the peer map
+    if !hub.register(peer) {
+        return errors.New("Already connected to peer " + peerID)
+    }
+
     go func() {
-        peer := NewPeer(peerID, OUTGOING)
-    
-        // simply try to reserve a spot in the peer map
-        if !hub.register(peer) {
-            return
-        }
-    
         for {
             // connect will return an error once the peer is disconnected for good
             incoming, outgoing, err := peer.connect(dialer, "wss://" + host + ":" + strconv.Itoa(port) + "/sync")
@@ -728,7 +1139,7 @@ func (hub *Hub) Connect(peerID, host string, port int) error {
             
             Log.Infof("Connected to peer %s", peer.id)
             
-            hub.syncController.addPeer(peer.id, outgoing)
+            hub.syncController.addPeer(peer.id, outgoing, peer.negotiatedProtocolVersion, peer.liveBacklog)
         
             // incoming is closed when the peer is disconnected from either end
             for msg := range incoming {
@@ -743,11 +1154,28 @@ func (hub *Hub) Connect(peerID, host string, port int) error {
                 break
             }
             
+            if websocket.IsCloseError(peer.errors(), SYNC_CLOSE_UNSUPPORTED_PROTOCOL) {
+                // Retrying right away won't help until one side is upgraded
+                Log.Errorf("Disconnected from peer %s because there is no protocol version both sides support. Reconnecting in %ds...", peer.id, RECONNECT_WAIT_MAX_SECONDS)
+                
+                select {
+                case <-time.After(time.Second * RECONNECT_WAIT_MAX_SECONDS):
+                    continue
+                case <-peer.closeChan:
+                }
+
+                break
+            }
+            
             Log.Infof("Disconnected from peer %s. Reconnecting...", peer.id)
             <-time.After(time.Second)
         }
         
         hub.unregister(peer)
+
+        if disconnected != nil {
+            disconnected()
+        }
     }()
     
     return nil
@@ -884,12 +1312,25 @@ func (hub *Hub) Peers() []*PeerJSON {
     peers := make([]*PeerJSON, 0, len(hub.peerMap))
     
     for peerID, ps := range hub.peerMap {
-        peers = append(peers, ps.toJSON(peerID))
+        peerJSON := ps.toJSON(peerID)
+        peerJSON.PushQueueDepth, peerJSON.OldestUnacknowledgedPush = hub.syncController.PushQueueStats(peerID)
+        peers = append(peers, peerJSON)
     }
     
     return peers
 }
 
+// ForgetPushes drops the pushes a peer has yet to acknowledge
+func (hub *Hub) ForgetPushes(peerID string) {
+    hub.syncController.ForgetPushes(peerID)
+}
+
+// PushQueueStats returns the number of pushes a peer has yet to
+// acknowledge and how long the oldest of them has been waiting
+func (hub *Hub) PushQueueStats(peerID string) (int, time.Duration) {
+    return hub.syncController.PushQueueStats(peerID)
+}
+
 func (hub *Hub) ExtractPeerID(conn *tls.Conn) (string, error) {
     // VerifyClientCertIfGiven
     verifiedChains := conn.ConnectionState().VerifiedChains
@@ -907,6 +1348,12 @@ func (hub *Hub) SyncController() *SyncController {
     return hub.syncController
 }
 
+// PeerSyncStats returns the recent sync sessions with a peer keyed by
+// bucket. History is still returned after the peer disconnects
+func (hub *Hub) PeerSyncStats(peerID string) map[string]BucketSyncStats {
+    return hub.syncController.PeerSyncStats(peerID)
+}
+
 func (hub *Hub) ForwardEvents() {
     if hub.historian.LogSerial() - hub.historian.ForwardIndex() - 1 >= hub.forwardThreshold {
         select {
@@ -916,12 +1363,37 @@ func (hub *Hub) ForwardEvents() {
     }
 }
 
+// FlushEvents makes the forwarder push any events that haven't been
+// forwarded to the cloud yet without waiting for the forward threshold
+// or interval. It also cuts short any wait before retrying a failed push
+func (hub *Hub) FlushEvents() {
+    select {
+    case hub.flushEvents <- 1:
+    default:
+    }
+}
+
 func (hub *Hub) StartForwardingEvents() {
     go func() {
+        var retryDelay time.Duration
+
         for {
+            var forwardEvents chan int = hub.forwardEvents
+            var wait time.Duration = time.Millisecond * time.Duration(hub.forwardInterval)
+
+            if retryDelay != 0 {
+                // Reaching the forward threshold shouldn't cut the backoff
+                // short or every logged event would trigger another retry
+                forwardEvents = nil
+                wait = retryDelay
+            }
+
             select {
-            case <-hub.forwardEvents:
-            case <-time.After(time.Millisecond * time.Duration(hub.forwardInterval)):
+            case <-forwardEvents:
+            case <-hub.flushEvents:
+            case <-time.After(wait):
+            case <-hub.stopForwarding:
+                return
             }
 
             Log.Info("Begin event forwarding to the cloud")
@@ -938,59 +1410,91 @@ func (hub *Hub) StartForwardingEvents() {
                 continue
             }
 
-            for hub.historian.ForwardIndex() < hub.historian.LogSerial() - 1 {
-                minSerial := hub.historian.ForwardIndex() + 1
-                eventIterator, err := hub.historian.Query(&HistoryQuery{ MinSerial: &minSerial, Limit: int(hub.forwardBatchSize) })
-                
-                if err != nil {
-                    Log.Criticalf("Unable to query event history: %v. No more events will be forwarded to the cloud", err)
-                    
-                    return
-                }
+            if err := hub.forwardEventBatches(cloudPeer); err != nil {
+                prometheusHistoryForwardFailuresCounter.Inc()
 
-                var highestIndex uint64 = minSerial
-                var batch []*Event = make([]*Event, 0, int(hub.forwardBatchSize))
-                
-                for eventIterator.Next() {
-                    if eventIterator.Event().Serial > highestIndex {
-                        highestIndex = eventIterator.Event().Serial
-                    }
+                retryDelay = nextForwardRetryDelay(retryDelay, time.Millisecond * time.Duration(hub.forwardInterval))
 
-                    batch = append(batch, eventIterator.Event())
-                }
+                Log.Warningf("Unable to forward events to the cloud: %v. Event forwarding will be retried in %v", err, retryDelay)
 
-                if eventIterator.Error() != nil {
-                    Log.Criticalf("Unable to query event history. Event iterator error: %v. No more events will be forwarded to the cloud.", eventIterator.Error())
-                    
-                    return
-                }
+                continue
+            }
+
+            retryDelay = 0
+            
+            Log.Info("History forwarding complete. Sleeping...")
+        }
+    }()
+}
 
-                Log.Debugf("Forwarding events %d to %d (inclusive) to the cloud.", minSerial, highestIndex)
+// nextForwardRetryDelay doubles the delay before retrying event forwarding
+// after each failure. It never exceeds the forward interval since there
+// is no reason to wait longer than it would take to try again anyway
+func nextForwardRetryDelay(retryDelay time.Duration, forwardInterval time.Duration) time.Duration {
+    retryDelay *= 2
 
-                if err := cloudPeer.pushEvents(batch); err != nil {
-                    Log.Warningf("Unable to push events to the cloud: %v. Event forwarding process will resume later.", err)
+    if retryDelay < time.Second * FORWARD_RETRY_WAIT_MIN_SECONDS {
+        retryDelay = time.Second * FORWARD_RETRY_WAIT_MIN_SECONDS
+    }
 
-                    break
-                }
+    if retryDelay > forwardInterval {
+        retryDelay = forwardInterval
+    }
 
-                if err := hub.historian.SetForwardIndex(highestIndex); err != nil {
-                    Log.Criticalf("Unable to update forwarding index after push: %v. No more events will be forwarded to the cloud", err)
+    return retryDelay
+}
 
-                    return
-                }
+// forwardEventBatches pushes events to the cloud in batches starting
+// at the forward index until it catches up with the log. The forward
+// index only advances once the cloud accepts a batch so a failed batch
+// is pushed again, with the same events, on the next attempt
+func (hub *Hub) forwardEventBatches(cloudPeer *Peer) error {
+    for hub.historian.ForwardIndex() < hub.historian.LogSerial() - 1 {
+        minSerial := hub.historian.ForwardIndex() + 1
+        eventIterator, err := hub.historian.Query(&HistoryQuery{ MinSerial: &minSerial, Limit: int(hub.forwardBatchSize) })
+        
+        if err != nil {
+            return fmt.Errorf("Unable to query event history: %v", err)
+        }
 
-                if hub.purgeOnForward {
-                    maxSerial := highestIndex + 1
-                    
-                    if err := hub.historian.Purge(&HistoryQuery{ MaxSerial: &maxSerial }); err != nil {
-                        Log.Warningf("Unable to purge events after push: %v.")
-                    }
-                }
+        var highestIndex uint64 = minSerial
+        var batch []*Event = make([]*Event, 0, int(hub.forwardBatchSize))
+        
+        for eventIterator.Next() {
+            if eventIterator.Event().Serial > highestIndex {
+                highestIndex = eventIterator.Event().Serial
             }
+
+            batch = append(batch, eventIterator.Event())
+        }
+
+        if eventIterator.Error() != nil {
+            return fmt.Errorf("Unable to query event history. Event iterator error: %v", eventIterator.Error())
+        }
+
+        Log.Debugf("Forwarding events %d to %d (inclusive) to the cloud.", minSerial, highestIndex)
+
+        if err := cloudPeer.pushEvents(batch, hub.stopForwarding); err != nil {
+            return fmt.Errorf("Unable to push events to the cloud: %v", err)
+        }
+
+        prometheusHistoryForwardedEventsCounter.Add(float64(len(batch)))
+        prometheusHistoryLastForwardGauge.SetToCurrentTime()
+
+        if err := hub.historian.SetForwardIndex(highestIndex); err != nil {
+            return fmt.Errorf("Unable to update forwarding index after push: %v", err)
+        }
+
+        if hub.purgeOnForward {
+            maxSerial := highestIndex + 1
             
-            Log.Info("History forwarding complete. Sleeping...")
+            if err := hub.historian.Purge(&HistoryQuery{ MaxSerial: &maxSerial }); err != nil {
+                Log.Warningf("Unable to purge events after push: %v.", err)
+            }
         }
-    }()
+    }
+
+    return nil
 }
 
 func (hub *Hub) ForwardAlerts() {
@@ -1006,6 +1510,8 @@ func (hub *Hub) StartForwardingAlerts() {
             select {
             case <-hub.forwardAlerts:
             case <-time.After(time.Millisecond * time.Duration(hub.alertsForwardInterval)):
+            case <-hub.stopForwarding:
+                return
             }
 
             Log.Info("Begin alert forwarding to the cloud")
@@ -1022,7 +1528,7 @@ func (hub *Hub) StartForwardingAlerts() {
                 continue
             }
             
-            alerts, err := hub.alertsMap.GetAlerts()
+            alerts, err := hub.alertsMap.ForwardableAlerts(uint64(time.Now().UnixNano()) / 1000000)
 
             if err != nil {
                 Log.Criticalf("Unable to query alerts map: %v. No more alerts will be forwarded to the cloud", err)
@@ -1036,7 +1542,7 @@ func (hub *Hub) StartForwardingAlerts() {
                 continue
             }
 
-            if err := cloudPeer.pushAlerts(alerts); err != nil {
+            if err := cloudPeer.pushAlerts(alerts, hub.stopForwarding); err != nil {
                 Log.Warningf("Unable to push alerts to the cloud: %v. Alert forwarding process will resume later.", err)
 
                 continue
@@ -1053,6 +1559,12 @@ func (hub *Hub) StartForwardingAlerts() {
     }()
 }
 
+// StopForwarding ends event and alert forwarding. A push waiting for
+// bandwidth gives up right away. It must only be called once
+func (hub *Hub) StopForwarding() {
+    close(hub.stopForwarding)
+}
+
 func (hub *Hub) BroadcastUpdate(siteID string, bucket string, update map[string]*SiblingSet, n uint64) {
     // broadcast the specified update to at most n peers, or all peers if n is non-positive
     var count uint64 = 0
@@ -1062,16 +1574,19 @@ func (hub *Hub) BroadcastUpdate(siteID string, bucket string, update map[string]
 
     peers := hub.peerMapBySiteID[siteID]
 
-    for peerID, _ := range peers {
+    for peerID, peer := range peers {
         if !hub.syncController.bucketProxyFactory.OutgoingBuckets(peerID)[bucket] {
             continue
         }
 
         if n != 0 && count == n {
-            break
+            // Peers that the update isn't pushed to still need to sync it
+            hub.syncController.MarkDirty(peerID, bucket)
+
+            continue
         }
 
-        hub.syncController.BroadcastUpdate(peerID, bucket, update, n)
+        hub.syncController.broadcastUpdate(peerID, bucket, update, peer.hasCapability(SYNC_CAPABILITY_ACK))
         count += 1
     }
 }
@@ -1089,6 +1604,12 @@ type SyncController struct {
     bucketProxyFactory ddbSync.BucketProxyFactory
     incoming chan *SyncMessageWrapper
     peers map[string]chan *SyncMessageWrapper
+    // Report the protocol version negotiated with each peer. Sessions
+    // announce it so that peers speaking an older version accept them
+    protocolVersions map[string]func() uint
+    // Report how many live messages wait for bandwidth on the link to
+    // each peer. Pushes are not sent again while any do
+    liveBacklogs map[string]func() int
     waitGroups map[string]*sync.WaitGroup
     initiatorSessionsMap map[string]map[uint]*SyncSession
     responderSessionsMap map[string]map[uint]*SyncSession
@@ -1099,6 +1620,9 @@ type SyncController struct {
     mapMutex sync.RWMutex
     syncScheduler ddbSync.SyncScheduler
     explorationPathLimit uint32
+    syncCursors *SyncCursors
+    syncStats *SyncStats
+    pushQueue *PushQueue
 }
 
 func NewSyncController(maxSyncSessions uint, bucketProxyFactory ddbSync.BucketProxyFactory, syncScheduler ddbSync.SyncScheduler, explorationPathLimit uint32) *SyncController {
@@ -1106,6 +1630,8 @@ func NewSyncController(maxSyncSessions uint, bucketProxyFactory ddbSync.BucketPr
         bucketProxyFactory: bucketProxyFactory,
         incoming: make(chan *SyncMessageWrapper),
         peers: make(map[string]chan *SyncMessageWrapper),
+        protocolVersions: make(map[string]func() uint),
+        liveBacklogs: make(map[string]func() int),
         waitGroups: make(map[string]*sync.WaitGroup),
         initiatorSessionsMap: make(map[string]map[uint]*SyncSession),
         responderSessionsMap: make(map[string]map[uint]*SyncSession),
@@ -1115,6 +1641,9 @@ func NewSyncController(maxSyncSessions uint, bucketProxyFactory ddbSync.BucketPr
         nextSessionID: 1,
         syncScheduler: syncScheduler,
         explorationPathLimit: explorationPathLimit,
+        syncCursors: NewSyncCursors(),
+        syncStats: NewSyncStats(),
+        pushQueue: NewPushQueue(),
     }
     
     go func() {
@@ -1127,7 +1656,7 @@ func NewSyncController(maxSyncSessions uint, bucketProxyFactory ddbSync.BucketPr
     return syncController
 }
 
-func (s *SyncController) addPeer(peerID string, w chan *SyncMessageWrapper) error {
+func (s *SyncController) addPeer(peerID string, w chan *SyncMessageWrapper, protocolVersion func() uint, liveBacklog func() int) error {
     prometheusRelayConnectionsGauge.Inc()
     s.mapMutex.Lock()
     defer s.mapMutex.Unlock()
@@ -1137,6 +1666,8 @@ func (s *SyncController) addPeer(peerID string, w chan *SyncMessageWrapper) erro
     }
     
     s.peers[peerID] = w
+    s.protocolVersions[peerID] = protocolVersion
+    s.liveBacklogs[peerID] = liveBacklog
     s.waitGroups[peerID] = &sync.WaitGroup{ }
     s.initiatorSessionsMap[peerID] = make(map[uint]*SyncSession)
     s.responderSessionsMap[peerID] = make(map[uint]*SyncSession)
@@ -1149,6 +1680,9 @@ func (s *SyncController) addPeer(peerID string, w chan *SyncMessageWrapper) erro
 
     s.syncScheduler.AddPeer(peerID, buckets)
     s.syncScheduler.Schedule(peerID)
+
+    // Pushes that were in flight when the peer disconnected were lost
+    s.pushQueue.Reset(peerID, time.Now())
     
     return nil
 }
@@ -1182,6 +1716,8 @@ func (s *SyncController) removePeer(peerID string) {
     s.mapMutex.Lock()
     close(s.peers[peerID])
     delete(s.peers, peerID)
+    delete(s.protocolVersions, peerID)
+    delete(s.liveBacklogs, peerID)
     delete(s.waitGroups, peerID)
     s.mapMutex.Unlock()
 }
@@ -1216,10 +1752,13 @@ func (s *SyncController) addResponderSession(peerID string, sessionID uint, buck
         return false
     }
     
+    responderSyncSession := NewResponderSyncSession(bucketProxy)
+    responderSyncSession.SetProtocolVersion(s.protocolVersions[peerID]())
+
     newResponderSession := &SyncSession{
         receiver: make(chan *SyncMessageWrapper, 1),
         sender: s.peers[peerID],
-        sessionState: NewResponderSyncSession(bucketProxy),
+        sessionState: responderSyncSession,
         waitGroup: s.waitGroups[peerID],
         peerID: peerID,
         sessionID: sessionID,
@@ -1266,10 +1805,19 @@ func (s *SyncController) addInitiatorSession(peerID string, sessionID uint, buck
         return false
     }
     
+    initiatorSyncSession := NewInitiatorSyncSession(sessionID, bucketProxy, s.explorationPathLimit, s.bucketProxyFactory.OutgoingBuckets(peerID)[bucketName])
+    initiatorSyncSession.SetProtocolVersion(s.protocolVersions[peerID]())
+    cursor := s.syncCursors.Cursor(peerID, bucketName)
+    initiatorSyncSession.SetLogPositions(cursor.Positions)
+
+    if cursor.Agreed() {
+        initiatorSyncSession.SetAgreement(cursor.RootHash, cursor.LocalLogID, cursor.LocalPosition)
+    }
+
     newInitiatorSession := &SyncSession{
         receiver: make(chan *SyncMessageWrapper, 1),
         sender: s.peers[peerID],
-        sessionState: NewInitiatorSyncSession(sessionID, bucketProxy, s.explorationPathLimit, s.bucketProxyFactory.OutgoingBuckets(peerID)[bucketName]),
+        sessionState: initiatorSyncSession,
         waitGroup: s.waitGroups[peerID],
         peerID: peerID,
         sessionID: sessionID,
@@ -1422,8 +1970,34 @@ func (s *SyncController) receiveMessage(msg *SyncMessageWrapper) {
         
         if err != nil {
             Log.Errorf("Unable to merge object from peer %s into key %s in bucket %s: %v", nodeID, key, pushMessage.Bucket, err)
-        } else {
-            Log.Infof("Merged object from peer %s into key %s in bucket %s", nodeID, key, pushMessage.Bucket)
+
+            return
+        }
+
+        Log.Infof("Merged object from peer %s into key %s in bucket %s", nodeID, key, pushMessage.Bucket)
+
+        if pushMessage.ID != 0 {
+            s.sendPushAck(nodeID, PushAck{ Bucket: pushMessage.Bucket, Key: key, ID: pushMessage.ID })
+        }
+    } else if msg.MessageType == SYNC_PUSH_ACK {
+        pushAck := msg.MessageBody.(PushAck)
+
+        s.pushQueue.Ack(nodeID, pushAck.Bucket, pushAck.Key, pushAck.ID)
+    }
+}
+
+func (s *SyncController) sendPushAck(peerID string, pushAck PushAck) {
+    s.mapMutex.RLock()
+    defer s.mapMutex.RUnlock()
+
+    w := s.peers[peerID]
+
+    if w != nil {
+        w <- &SyncMessageWrapper{
+            SessionID: 0,
+            MessageType: SYNC_PUSH_ACK,
+            MessageBody: pushAck,
+            Direction: PUSH,
         }
     }
 }
@@ -1431,21 +2005,38 @@ func (s *SyncController) receiveMessage(msg *SyncMessageWrapper) {
 func (s *SyncController) runInitiatorSession() {
     for initiatorSession := range s.initiatorSessions {
         state := initiatorSession.sessionState.(*InitiatorSyncSession)
+        record := s.syncStats.StartSession(initiatorSession.peerID, state.bucketProxy.Name(), initiatorSession.sessionID, SYNC_ROLE_INITIATOR)
+        disconnected := false
         
         for {
             var receivedMessage *SyncMessageWrapper
+            var open bool
             
             select {
-            case receivedMessage = <-initiatorSession.receiver:
+            case receivedMessage, open = <-initiatorSession.receiver:
+                disconnected = !open
             case <-time.After(time.Second * SYNC_SESSION_WAIT_TIMEOUT_SECONDS):
                 Log.Warningf("[%s-%d] timeout", initiatorSession.peerID, initiatorSession.sessionID)
             }
+
+            if receivedMessage != nil {
+                record.AddBytesReceived(uint64(receivedMessage.size))
+            }
             
             initialState := state.State()
             
             var m *SyncMessageWrapper = state.NextState(receivedMessage)
             
             m.Direction = REQUEST
+            m.session = record
+
+            if m.MessageType == SYNC_NODE_HASH {
+                record.AddNodesExplored(1)
+            }
+
+            if receivedMessage != nil && receivedMessage.MessageType == SYNC_PUSH_MESSAGE && state.AbortReason() == "" {
+                record.AddKeysPulled(1)
+            }
     
             if receivedMessage == nil {
                 Log.Debugf("[%s-%d] nil : (%s -> %s) : %s", initiatorSession.peerID, initiatorSession.sessionID, StateName(initialState), StateName(state.State()), MessageTypeName(m.MessageType))
@@ -1461,6 +2052,20 @@ func (s *SyncController) runInitiatorSession() {
                 break
             }
         }
+
+        if logID, position, ok := state.LogPosition(); ok {
+            s.syncCursors.Advance(initiatorSession.peerID, state.bucketProxy.Name(), logID, position)
+        }
+
+        if rootHash, localLogID, localPosition, ok := state.Agreement(); ok {
+            s.syncCursors.Agree(initiatorSession.peerID, state.bucketProxy.Name(), rootHash, localLogID, localPosition)
+        }
+
+        if changeAware, ok := s.syncScheduler.(ddbSync.ChangeAwareSyncScheduler); ok {
+            changeAware.SyncCompleted(initiatorSession.peerID, state.bucketProxy.Name(), state.Idle())
+        }
+
+        s.endSession(initiatorSession.peerID, record, state.AbortReason(), disconnected, state.RootMatched())
         
         s.removeInitiatorSession(initiatorSession)
     }
@@ -1469,21 +2074,37 @@ func (s *SyncController) runInitiatorSession() {
 func (s *SyncController) runResponderSession() {
     for responderSession := range s.responderSessions {
         state := responderSession.sessionState.(*ResponderSyncSession)
+        record := s.syncStats.StartSession(responderSession.peerID, state.bucketProxy.Name(), responderSession.sessionID, SYNC_ROLE_RESPONDER)
+        disconnected := false
         
         for {
             var receivedMessage *SyncMessageWrapper
+            var open bool
             
             select {
-            case receivedMessage = <-responderSession.receiver:
+            case receivedMessage, open = <-responderSession.receiver:
+                disconnected = !open
             case <-time.After(time.Second * SYNC_SESSION_WAIT_TIMEOUT_SECONDS):
                 Log.Warningf("[%s-%d] timeout", responderSession.peerID, responderSession.sessionID)
             }
+
+            if receivedMessage != nil {
+                record.AddBytesReceived(uint64(receivedMessage.size))
+            }
             
             initialState := state.State()
             
             var m *SyncMessageWrapper = state.NextState(receivedMessage)
         
             m.Direction = RESPONSE
+            m.session = record
+
+            switch m.MessageType {
+            case SYNC_NODE_HASH:
+                record.AddNodesExplored(1)
+            case SYNC_PUSH_MESSAGE:
+                record.AddKeysPushed(1)
+            }
             
             if receivedMessage == nil {
                 Log.Debugf("[%s-%d] nil : (%s -> %s) : %s", responderSession.peerID, responderSession.sessionID, StateName(initialState), StateName(state.State()), MessageTypeName(m.MessageType))
@@ -1499,11 +2120,35 @@ func (s *SyncController) runResponderSession() {
                 break
             }
         }
+
+        if state.Diverged() {
+            // The initiator has something this node doesn't or vice versa.
+            // Sync this bucket from our side soon instead of waiting
+            s.MarkDirty(responderSession.peerID, state.bucketProxy.Name())
+        }
+
+        s.endSession(responderSession.peerID, record, state.AbortReason(), disconnected, state.RootMatched())
         
         s.removeResponderSession(responderSession)
     }
 }
 
+func (s *SyncController) endSession(peerID string, record *SyncSessionRecord, abortReason string, disconnected bool, rootMatch bool) {
+    if abortReason != "" && disconnected {
+        // The session gave up on a message that never came because the
+        // connection closed rather than because the peer was slow
+        abortReason = SYNC_ABORT_REASON_DISCONNECTED
+    }
+
+    s.syncStats.EndSession(peerID, record, abortReason, rootMatch)
+}
+
+// PeerSyncStats returns the recent sync sessions with a peer keyed by
+// bucket
+func (s *SyncController) PeerSyncStats(peerID string) map[string]BucketSyncStats {
+    return s.syncStats.Peer(peerID)
+}
+
 func (s *SyncController) StartInitiatorSessions() {
     for i := 0; i < int(s.maxSyncSessions); i += 1 {
         go s.runInitiatorSession()
@@ -1537,32 +2182,224 @@ func (s *SyncController) StartResponderSessions() {
     }    
 }
 
+// StartPushRetries periodically sends pushes that peers have not
+// acknowledged in time again
+func (s *SyncController) StartPushRetries() {
+    go func() {
+        for {
+            <-time.After(SYNC_PUSH_RETRY_INTERVAL)
+
+            s.RetryPushes(time.Now())
+        }
+    }()
+}
+
+// RetryPushes sends the pushes that are due as of now to the peers that
+// are connected and drops those that have waited too long
+func (s *SyncController) RetryPushes(now time.Time) {
+    for _, peerID := range s.pushQueue.Peers() {
+        // Pushes expire whether or not the peer is connected so that a peer
+        // that never comes back doesn't hold on to them
+        for bucket, _ := range s.pushQueue.Expire(peerID, now) {
+            Log.Warningf("Peer %s did not acknowledge pushes to bucket %s in time. Leaving them to anti-entropy", peerID, bucket)
+
+            prometheusPushExpiredCounter.Inc()
+            s.MarkDirty(peerID, bucket)
+        }
+
+        s.mapMutex.RLock()
+        w := s.peers[peerID]
+        liveBacklog := s.liveBacklogs[peerID]
+        s.mapMutex.RUnlock()
+
+        // Pushes sent again while earlier ones still wait for bandwidth
+        // would only replace them in the queue and use up their attempts
+        if w != nil && liveBacklog() == 0 {
+            for _, push := range s.pushQueue.Due(peerID, now) {
+                Log.Debugf("Push object at key %s in bucket %s to peer %s again since it was not acknowledged", push.Key, push.Bucket, peerID)
+
+                prometheusPushRetriesCounter.Inc()
+                s.sendPush(peerID, push.Bucket, push.Key, push.Value, push.ID)
+            }
+        }
+
+        s.updatePushQueueMetrics(peerID, now)
+    }
+}
+
+func (s *SyncController) updatePushQueueMetrics(peerID string, now time.Time) {
+    depth, oldest := s.pushQueue.Stats(peerID, now)
+
+    if depth == 0 {
+        prometheusPushQueueDepthGauge.DeleteLabelValues(peerID)
+        prometheusPushQueueAgeGauge.DeleteLabelValues(peerID)
+        s.pushQueue.Forget(peerID)
+
+        return
+    }
+
+    prometheusPushQueueDepthGauge.WithLabelValues(peerID).Set(float64(depth))
+    prometheusPushQueueAgeGauge.WithLabelValues(peerID).Set(oldest.Seconds())
+}
+
+// ForgetPushes drops the pushes a peer has yet to acknowledge. It is
+// called once a relay is removed since it will never acknowledge them
+func (s *SyncController) ForgetPushes(peerID string) {
+    s.pushQueue.Clear(peerID)
+    s.updatePushQueueMetrics(peerID, time.Now())
+}
+
+// PushQueueStats returns the number of pushes a peer has yet to
+// acknowledge and how long the oldest of them has been waiting
+func (s *SyncController) PushQueueStats(peerID string) (int, time.Duration) {
+    return s.pushQueue.Stats(peerID, time.Now())
+}
+
 func (s *SyncController) Start() {
     s.StartInitiatorSessions()
     s.StartResponderSessions()
+    s.StartPushRetries()
+}
+
+// MarkDirty tells the sync scheduler that a bucket may have diverged
+// from its replica at a peer. Schedulers that sync at a fixed rate
+// ignore it
+func (s *SyncController) MarkDirty(peerID string, bucket string) {
+    if changeAware, ok := s.syncScheduler.(ddbSync.ChangeAwareSyncScheduler); ok {
+        changeAware.MarkDirty(peerID, bucket)
+    }
+}
+
+func (s *SyncController) sendSiteRoster(peerID string, roster SiteRoster) {
+    Log.Debugf("Send roster for site %s to peer %s", roster.SiteID, peerID)
+
+    s.sendControlMessage(peerID, &SyncMessageWrapper{
+        SessionID: 0,
+        MessageType: SYNC_SITE_ROSTER,
+        MessageBody: roster,
+        Direction: PUSH,
+    })
+}
+
+// Sends a message that doesn't belong to a sync session to a peer. The
+// send can wait on the peer's writer so it is made without holding
+// mapMutex. Like a session, it holds the peer's wait group so that
+// removePeer doesn't close the channel until the send is done
+func (s *SyncController) sendControlMessage(peerID string, msg *SyncMessageWrapper) {
+    s.mapMutex.RLock()
+
+    w := s.peers[peerID]
+    wg := s.waitGroups[peerID]
+
+    // removePeer deletes the session maps before it waits on the wait
+    // group so a peer without them is already being removed
+    if _, ok := s.initiatorSessionsMap[peerID]; w == nil || !ok {
+        s.mapMutex.RUnlock()
+
+        return
+    }
+
+    wg.Add(1)
+    s.mapMutex.RUnlock()
+
+    defer wg.Done()
+
+    w <- msg
+}
+
+// Tells a relay which keys of each bucket it replicates with this node
+func (s *SyncController) sendRelayScope(peerID string) {
+    scopedFactory, ok := s.bucketProxyFactory.(ddbSync.ScopedBucketProxyFactory)
+
+    if !ok {
+        return
+    }
+
+    scope := RelayScope{ Buckets: make(map[string][]string) }
+
+    for _, buckets := range []map[string]bool{ s.bucketProxyFactory.IncomingBuckets(peerID), s.bucketProxyFactory.OutgoingBuckets(peerID) } {
+        for bucket, _ := range buckets {
+            if keyScope := scopedFactory.KeyScope(peerID, bucket); keyScope != nil {
+                scope.Buckets[bucket] = keyScope.Prefixes
+            }
+        }
+    }
+
+    Log.Debugf("Send scope %v to peer %s", scope.Buckets, peerID)
+
+    s.sendControlMessage(peerID, &SyncMessageWrapper{
+        SessionID: 0,
+        MessageType: SYNC_RELAY_SCOPE,
+        MessageBody: scope,
+        Direction: PUSH,
+    })
+}
+
+// Records the keys of each bucket that a peer replicates with this relay
+func (s *SyncController) setKeyScopes(peerID string, scope RelayScope) {
+    scopeAssignable, ok := s.bucketProxyFactory.(ddbSync.ScopeAssignableBucketProxyFactory)
+
+    if !ok {
+        return
+    }
+
+    keyScopes := make(map[string]*ddbSync.KeyScope, len(scope.Buckets))
+
+    for bucket, prefixes := range scope.Buckets {
+        keyScopes[bucket] = ddbSync.NewKeyScope(prefixes)
+    }
+
+    scopeAssignable.SetKeyScopes(peerID, keyScopes)
 }
 
 func (s *SyncController) BroadcastUpdate(peerID string, bucket string, update map[string]*SiblingSet, n uint64) {
+    s.broadcastUpdate(peerID, bucket, update, false)
+}
+
+// Pushes an update to a peer. If acknowledged is true the peer
+// acknowledges each key it merges and keys that it doesn't acknowledge
+// in time are pushed again
+func (s *SyncController) broadcastUpdate(peerID string, bucket string, update map[string]*SiblingSet, acknowledged bool) {
+    var scope *ddbSync.KeyScope
+
+    if scopedFactory, ok := s.bucketProxyFactory.(ddbSync.ScopedBucketProxyFactory); ok {
+        scope = scopedFactory.KeyScope(peerID, bucket)
+    }
+
+    for key, value := range update {
+        if !scope.Contains([]byte(key)) {
+            continue
+        }
+
+        var id uint64
+
+        if acknowledged {
+            id = s.pushQueue.Push(peerID, bucket, key, value, time.Now())
+        }
+
+        Log.Debugf("Push object at key %s in bucket %s to peer %s", key, bucket, peerID)
+
+        s.sendPush(peerID, bucket, key, value, id)
+    }
+}
+
+func (s *SyncController) sendPush(peerID string, bucket string, key string, value *SiblingSet, id uint64) {
     s.mapMutex.RLock()
     defer s.mapMutex.RUnlock()
-   
-    for key, value := range update {
-        msg := &SyncMessageWrapper{
+
+    w := s.peers[peerID]
+
+    if w != nil {
+        w <- &SyncMessageWrapper{
             SessionID: 0,
             MessageType: SYNC_PUSH_MESSAGE,
             MessageBody: PushMessage{
                 Key: key,
                 Value: value,
                 Bucket: bucket,
+                ID: id,
             },
             Direction: PUSH,
         }
-       
-        w := s.peers[peerID]
-
-        if w != nil {
-            Log.Debugf("Push object at key %s in bucket %s to peer %s", key, bucket, peerID)
-            w <- msg
-        }
     }
 }
@@ -31,6 +31,15 @@ import (
     "crypto/tls"
     "crypto/x509"
     "io/ioutil"
+    "strings"
+    "bytes"
+    "compress/flate"
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "sync"
+    
+    "github.com/gorilla/websocket"
     
     . "github.com/armPelionEdge/devicedb/server"
     . "github.com/armPelionEdge/devicedb/util"
@@ -42,6 +51,30 @@ import (
     . "github.com/onsi/gomega"
 )
 
+// Records the buckets that the sync controller marks dirty
+type dirtyRecordingSyncScheduler struct {
+    *ddbSync.PeriodicSyncScheduler
+    lock sync.Mutex
+    dirty []string
+}
+
+func (syncScheduler *dirtyRecordingSyncScheduler) MarkDirty(peerID string, bucket string) {
+    syncScheduler.lock.Lock()
+    defer syncScheduler.lock.Unlock()
+
+    syncScheduler.dirty = append(syncScheduler.dirty, peerID + "/" + bucket)
+}
+
+func (syncScheduler *dirtyRecordingSyncScheduler) SyncCompleted(peerID string, bucket string, idle bool) {
+}
+
+func (syncScheduler *dirtyRecordingSyncScheduler) Dirty() []string {
+    syncScheduler.lock.Lock()
+    defer syncScheduler.lock.Unlock()
+
+    return append([]string{ }, syncScheduler.dirty...)
+}
+
 func loadCerts(id string) (*tls.Config, *tls.Config, error) {
     clientCertificate, err := tls.LoadX509KeyPair("../test_certs/" + id + ".client.cert.pem", "../test_certs/" + id + ".client.key.pem")
     
@@ -87,9 +120,7 @@ var _ = Describe("Hub", func() {
     var initiatorSyncController *SyncController
     var responderSyncController *SyncController
     var neutralSyncController *SyncController
-    var initiatorServer *Server
     var responderServer *Server
-    var neutralServer *Server
     
     responderServerTLS, responderClientTLS, err := loadCerts("WWRL000000")
 
@@ -121,7 +152,7 @@ var _ = Describe("Hub", func() {
         
         initiatorSyncController = NewSyncController(2, nil, ddbSync.NewPeriodicSyncScheduler(SYNC_PERIOD_MS), 1000)
         initiatorHub = NewHub("", initiatorSyncController, initiatorClientTLS)
-        initiatorServer, _ = NewServer(ServerConfig{
+        _, _ = NewServer(ServerConfig{
             DBFile: "/tmp/testdb-" + RandomString(),
             Port: 8181,
             ServerTLS: initiatorServerTLS,
@@ -130,7 +161,7 @@ var _ = Describe("Hub", func() {
         
         neutralSyncController = NewSyncController(2, nil, ddbSync.NewPeriodicSyncScheduler(SYNC_PERIOD_MS), 1000)
         neutralHub = NewHub("", neutralSyncController, initiatorClientTLS) // WWRL000001
-        neutralServer, _ = NewServer(ServerConfig{
+        _, _ = NewServer(ServerConfig{
             DBFile: "/tmp/testdb-" + RandomString(),
             Port: 8282,
             ServerTLS: initiatorServerTLS,
@@ -191,4 +222,573 @@ var _ = Describe("Hub", func() {
             Expect(true).Should(BeTrue())
         })
     })
-})
\ No newline at end of file
+})
+
+var _ = Describe("Peer transport", func() {
+    var syncController *SyncController
+    var hub *Hub
+    var httpServer *httptest.Server
+    var wsURL string
+    
+    type frameMessage struct {
+        MessageType int `json:"type"`
+        MessageBody json.RawMessage `json:"body"`
+    }
+    
+    readFrame := func(conn *websocket.Conn) (int, []frameMessage) {
+        conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+        messageType, data, err := conn.ReadMessage()
+        
+        Expect(err).Should(BeNil())
+        
+        if messageType == websocket.BinaryMessage {
+            data, err = ioutil.ReadAll(flate.NewReader(bytes.NewReader(data)))
+            
+            Expect(err).Should(BeNil())
+        }
+        
+        var messages []frameMessage
+        
+        if data[0] == '[' {
+            Expect(json.Unmarshal(data, &messages)).Should(BeNil())
+        } else {
+            var message frameMessage
+            
+            Expect(json.Unmarshal(data, &message)).Should(BeNil())
+            
+            messages = append(messages, message)
+        }
+        
+        return messageType, messages
+    }
+    
+    // Sends count large, easily compressed updates to the connected peer and
+    // collects frames until all of them have been received
+    broadcastAndRead := func(conn *websocket.Conn, count int) ([]int, int) {
+        update := make(map[string]*SiblingSet)
+        
+        for i := 0; i < count; i += 1 {
+            update[fmt.Sprintf("key%d", i)] = NewSiblingSet(map[*Sibling]bool{ NewSibling(NewDVV(NewDot("", 0), map[string]uint64{ }), []byte(strings.Repeat("value", 200)), 0): true })
+        }
+        
+        go syncController.BroadcastUpdate("WWRL000001", "default", update, 1)
+        
+        var frameTypes []int
+        var received int
+        
+        for received < count {
+            messageType, messages := readFrame(conn)
+            
+            for _, message := range messages {
+                if message.MessageType == SYNC_PUSH_MESSAGE {
+                    received += 1
+                }
+            }
+            
+            frameTypes = append(frameTypes, messageType)
+        }
+        
+        return frameTypes, received
+    }
+    
+    BeforeEach(func() {
+        syncController = NewSyncController(2, nil, ddbSync.NewPeriodicSyncScheduler(SYNC_PERIOD_MS), 1000)
+        hub = NewHub("", syncController, nil)
+        // the server is never started. It only provides the buckets that updates are pushed from
+        _, _ = NewServer(ServerConfig{
+            DBFile: "/tmp/testdb-" + RandomString(),
+            Port: 8383,
+            Hub: hub,
+        })
+        httpServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            conn, err := (&websocket.Upgrader{ }).Upgrade(w, r, nil)
+            
+            if err != nil {
+                return
+            }
+            
+            hub.Accept(conn, 0, "WWRL000001", "", true)
+        }))
+        wsURL = "ws" + strings.TrimPrefix(httpServer.URL, "http")
+    })
+    
+    AfterEach(func() {
+        hub.Disconnect("WWRL000001")
+        httpServer.Close()
+    })
+    
+    It("should announce its capabilities as soon as the connection is established", func() {
+        conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+        
+        Expect(err).Should(BeNil())
+        
+        defer conn.Close()
+        
+        messageType, messages := readFrame(conn)
+        
+        Expect(messageType).Should(Equal(websocket.TextMessage))
+        Expect(len(messages)).Should(Equal(1))
+        Expect(messages[0].MessageType).Should(Equal(SYNC_HELLO))
+        
+        var hello Hello
+        
+        Expect(json.Unmarshal(messages[0].MessageBody, &hello)).Should(BeNil())
+        Expect(hello.MinProtocolVersion).Should(Equal(MIN_PROTOCOL_VERSION))
+        Expect(hello.MaxProtocolVersion).Should(Equal(PROTOCOL_VERSION))
+        Expect(hello.Capabilities).Should(ConsistOf(SYNC_CAPABILITY_DEFLATE, SYNC_CAPABILITY_BATCH, SYNC_CAPABILITY_ROSTER, SYNC_CAPABILITY_ACK, SYNC_CAPABILITY_SCOPE))
+    })
+    
+    It("should report the oldest supported protocol version for a peer that never sent hello", func() {
+        conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+        
+        Expect(err).Should(BeNil())
+        
+        defer conn.Close()
+        
+        readFrame(conn)
+        
+        Eventually(hub.Peers).Should(HaveLen(1))
+        Expect(hub.Peers()[0].ProtocolVersion).Should(Equal(MIN_PROTOCOL_VERSION))
+        Expect(hub.Peers()[0].Capabilities).Should(BeEmpty())
+    })
+    
+    It("should agree on the highest protocol version both peers support", func() {
+        conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+        
+        Expect(err).Should(BeNil())
+        
+        defer conn.Close()
+        
+        readFrame(conn)
+        
+        Expect(conn.WriteJSON(&SyncMessageWrapper{
+            MessageType: SYNC_HELLO,
+            MessageBody: Hello{
+                MinProtocolVersion: MIN_PROTOCOL_VERSION,
+                MaxProtocolVersion: PROTOCOL_VERSION + 5,
+                Capabilities: []string{ SYNC_CAPABILITY_BATCH, "unknown" },
+            },
+            Direction: PUSH,
+        })).Should(BeNil())
+        
+        Eventually(func() uint {
+            peers := hub.Peers()
+            
+            if len(peers) != 1 {
+                return 0
+            }
+            
+            return peers[0].ProtocolVersion
+        }).Should(Equal(PROTOCOL_VERSION))
+        
+        Expect(hub.Peers()[0].Capabilities).Should(Equal([]string{ SYNC_CAPABILITY_BATCH }))
+    })
+    
+    It("should close the connection with a distinct close code if there is no common protocol version", func() {
+        conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+        
+        Expect(err).Should(BeNil())
+        
+        defer conn.Close()
+        
+        readFrame(conn)
+        
+        Expect(conn.WriteJSON(&SyncMessageWrapper{
+            MessageType: SYNC_HELLO,
+            MessageBody: Hello{
+                MinProtocolVersion: PROTOCOL_VERSION + 1,
+                MaxProtocolVersion: PROTOCOL_VERSION + 2,
+            },
+            Direction: PUSH,
+        })).Should(BeNil())
+        
+        conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+        _, _, err = conn.ReadMessage()
+        
+        Expect(websocket.IsCloseError(err, SYNC_CLOSE_UNSUPPORTED_PROTOCOL)).Should(BeTrue())
+    })
+    
+    It("should send plain uncompressed messages to a peer that never announced its capabilities", func() {
+        conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+        
+        Expect(err).Should(BeNil())
+        
+        defer conn.Close()
+        
+        readFrame(conn)
+        
+        frameTypes, received := broadcastAndRead(conn, 10)
+        
+        Expect(received).Should(Equal(10))
+        Expect(len(frameTypes)).Should(Equal(10))
+        
+        for _, frameType := range frameTypes {
+            Expect(frameType).Should(Equal(websocket.TextMessage))
+        }
+    })
+    
+    It("should compress and coalesce messages for a peer that announced support for it", func() {
+        conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+        
+        Expect(err).Should(BeNil())
+        
+        defer conn.Close()
+        
+        readFrame(conn)
+        
+        Expect(conn.WriteJSON(&SyncMessageWrapper{
+            MessageType: SYNC_HELLO,
+            MessageBody: Hello{
+                MinProtocolVersion: MIN_PROTOCOL_VERSION,
+                MaxProtocolVersion: PROTOCOL_VERSION,
+                Capabilities: []string{ SYNC_CAPABILITY_DEFLATE, SYNC_CAPABILITY_BATCH },
+            },
+            Direction: PUSH,
+        })).Should(BeNil())
+        
+        // give the reader a moment to process the hello
+        time.Sleep(time.Millisecond * 100)
+        
+        frameTypes, received := broadcastAndRead(conn, 10)
+        
+        Expect(received).Should(Equal(10))
+        
+        for _, frameType := range frameTypes {
+            Expect(frameType).Should(Equal(websocket.BinaryMessage))
+        }
+    })
+    
+    It("should disconnect a peer that sends a frame that is too large once decompressed", func() {
+        conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+        
+        Expect(err).Should(BeNil())
+        
+        defer conn.Close()
+        
+        readFrame(conn)
+        
+        // a push that would be merged if it were small enough
+        frame, err := json.Marshal(&SyncMessageWrapper{
+            MessageType: SYNC_PUSH_MESSAGE,
+            MessageBody: PushMessage{
+                Bucket: "default",
+                Key: "key1",
+                Value: NewSiblingSet(map[*Sibling]bool{ NewSibling(NewDVV(NewDot("", 0), map[string]uint64{ }), bytes.Repeat([]byte("a"), SYNC_FRAME_MAX_BYTES), 0): true }),
+            },
+            Direction: PUSH,
+        })
+        
+        Expect(err).Should(BeNil())
+        
+        var compressed bytes.Buffer
+        
+        writer, _ := flate.NewWriter(&compressed, flate.BestCompression)
+        writer.Write(frame)
+        writer.Close()
+        
+        Expect(conn.WriteMessage(websocket.BinaryMessage, compressed.Bytes())).Should(BeNil())
+        
+        for {
+            conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+            
+            if _, _, err := conn.ReadMessage(); err != nil {
+                Expect(websocket.IsUnexpectedCloseError(err) || websocket.IsCloseError(err, websocket.CloseNormalClosure)).Should(BeTrue())
+                
+                break
+            }
+        }
+    })
+    
+    It("should acknowledge pushes that carry an ID once they are merged", func() {
+        conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+        
+        Expect(err).Should(BeNil())
+        
+        defer conn.Close()
+        
+        readFrame(conn)
+        
+        Expect(conn.WriteJSON(&SyncMessageWrapper{
+            MessageType: SYNC_PUSH_MESSAGE,
+            MessageBody: PushMessage{
+                Bucket: "default",
+                Key: "key1",
+                Value: NewSiblingSet(map[*Sibling]bool{ NewSibling(NewDVV(NewDot("", 0), map[string]uint64{ }), []byte("value"), 0): true }),
+                ID: 42,
+            },
+            Direction: PUSH,
+        })).Should(BeNil())
+        
+        _, messages := readFrame(conn)
+        
+        Expect(messages[0].MessageType).Should(Equal(SYNC_PUSH_ACK))
+        
+        var pushAck PushAck
+        
+        Expect(json.Unmarshal(messages[0].MessageBody, &pushAck)).Should(BeNil())
+        Expect(pushAck).Should(Equal(PushAck{ Bucket: "default", Key: "key1", ID: 42 }))
+    })
+    
+    It("should push again until a peer that acknowledges pushes does so", func() {
+        syncController.StartPushRetries()
+        
+        conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+        
+        Expect(err).Should(BeNil())
+        
+        defer conn.Close()
+        
+        readFrame(conn)
+        
+        Expect(conn.WriteJSON(&SyncMessageWrapper{
+            MessageType: SYNC_HELLO,
+            MessageBody: Hello{
+                MinProtocolVersion: MIN_PROTOCOL_VERSION,
+                MaxProtocolVersion: PROTOCOL_VERSION,
+                Capabilities: []string{ SYNC_CAPABILITY_ACK },
+            },
+            Direction: PUSH,
+        })).Should(BeNil())
+        
+        Eventually(func() []string {
+            peers := hub.Peers()
+            
+            if len(peers) == 0 {
+                return nil
+            }
+            
+            return peers[0].Capabilities
+        }).Should(ContainElement(SYNC_CAPABILITY_ACK))
+        
+        update := map[string]*SiblingSet{
+            "key1": NewSiblingSet(map[*Sibling]bool{ NewSibling(NewDVV(NewDot("", 0), map[string]uint64{ }), []byte("value"), 0): true }),
+        }
+        
+        go hub.BroadcastUpdate("", "default", update, 1)
+        
+        var pushes []PushMessage
+        
+        for len(pushes) < 2 {
+            conn.SetReadDeadline(time.Now().Add(SYNC_PUSH_RETRY_MIN * 2))
+            
+            var message frameMessage
+            
+            Expect(conn.ReadJSON(&message)).Should(BeNil())
+            Expect(message.MessageType).Should(Equal(SYNC_PUSH_MESSAGE))
+            
+            var push PushMessage
+            
+            Expect(json.Unmarshal(message.MessageBody, &push)).Should(BeNil())
+            
+            pushes = append(pushes, push)
+        }
+        
+        Expect(pushes[0].ID).ShouldNot(Equal(uint64(0)))
+        Expect(pushes[1].ID).Should(Equal(pushes[0].ID))
+        
+        depth, _ := hub.PushQueueStats("WWRL000001")
+        
+        Expect(depth).Should(Equal(1))
+        
+        Expect(conn.WriteJSON(&SyncMessageWrapper{
+            MessageType: SYNC_PUSH_ACK,
+            MessageBody: PushAck{ Bucket: "default", Key: "key1", ID: pushes[0].ID },
+            Direction: PUSH,
+        })).Should(BeNil())
+        
+        Eventually(func() int {
+            depth, _ := hub.PushQueueStats("WWRL000001")
+            
+            return depth
+        }).Should(Equal(0))
+    })
+    
+    It("should drop pushes that a disconnected peer never acknowledged once they are too old", func() {
+        conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+        
+        Expect(err).Should(BeNil())
+        
+        readFrame(conn)
+        
+        Expect(conn.WriteJSON(&SyncMessageWrapper{
+            MessageType: SYNC_HELLO,
+            MessageBody: Hello{
+                MinProtocolVersion: MIN_PROTOCOL_VERSION,
+                MaxProtocolVersion: PROTOCOL_VERSION,
+                Capabilities: []string{ SYNC_CAPABILITY_ACK },
+            },
+            Direction: PUSH,
+        })).Should(BeNil())
+        
+        Eventually(func() []string {
+            peers := hub.Peers()
+            
+            if len(peers) == 0 {
+                return nil
+            }
+            
+            return peers[0].Capabilities
+        }).Should(ContainElement(SYNC_CAPABILITY_ACK))
+        
+        update := map[string]*SiblingSet{
+            "key1": NewSiblingSet(map[*Sibling]bool{ NewSibling(NewDVV(NewDot("", 0), map[string]uint64{ }), []byte("value"), 0): true }),
+            "key2": NewSiblingSet(map[*Sibling]bool{ NewSibling(NewDVV(NewDot("", 0), map[string]uint64{ }), []byte("value"), 0): true }),
+        }
+        
+        go hub.BroadcastUpdate("", "default", update, 1)
+        
+        Eventually(func() int {
+            depth, _ := hub.PushQueueStats("WWRL000001")
+            
+            return depth
+        }).Should(Equal(2))
+        
+        conn.Close()
+        
+        Eventually(hub.Peers).Should(BeEmpty())
+        
+        syncController.RetryPushes(time.Now().Add(SYNC_PUSH_MAX_AGE - time.Second))
+        
+        depth, _ := hub.PushQueueStats("WWRL000001")
+        
+        Expect(depth).Should(Equal(2))
+        
+        syncController.RetryPushes(time.Now().Add(SYNC_PUSH_MAX_AGE))
+        
+        depth, oldest := hub.PushQueueStats("WWRL000001")
+        
+        Expect(depth).Should(Equal(0))
+        Expect(oldest).Should(Equal(time.Duration(0)))
+    })
+    
+    It("should record the sync sessions a peer starts", func() {
+        syncController.StartResponderSessions()
+        
+        conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+        
+        Expect(err).Should(BeNil())
+        
+        defer conn.Close()
+        
+        readFrame(conn)
+        
+        Expect(conn.WriteJSON(&SyncMessageWrapper{
+            SessionID: 1,
+            MessageType: SYNC_START,
+            MessageBody: Start{
+                ProtocolVersion: PROTOCOL_VERSION,
+                MerkleDepth: 4,
+                Bucket: "default",
+            },
+            Direction: REQUEST,
+        })).Should(BeNil())
+        
+        _, messages := readFrame(conn)
+        
+        Expect(messages[0].MessageType).Should(Equal(SYNC_START))
+        
+        var start Start
+        
+        Expect(json.Unmarshal(messages[0].MessageBody, &start)).Should(BeNil())
+        
+        // Both buckets are empty so their root hashes match
+        Expect(conn.WriteJSON(&SyncMessageWrapper{
+            SessionID: 1,
+            MessageType: SYNC_NODE_HASH,
+            MessageBody: MerkleNodeHash{
+                NodeID: 1 << (start.MerkleDepth - 1),
+            },
+            Direction: REQUEST,
+        })).Should(BeNil())
+        
+        _, messages = readFrame(conn)
+        
+        Expect(messages[0].MessageType).Should(Equal(SYNC_NODE_HASH))
+        
+        Expect(conn.WriteJSON(&SyncMessageWrapper{
+            SessionID: 1,
+            MessageType: SYNC_ABORT,
+            MessageBody: Abort{ },
+            Direction: REQUEST,
+        })).Should(BeNil())
+        
+        Eventually(func() string {
+            sessions := hub.PeerSyncStats("WWRL000001")["default"].Sessions
+            
+            if len(sessions) == 0 {
+                return ""
+            }
+            
+            return sessions[0].Outcome
+        }).Should(Equal(SYNC_OUTCOME_COMPLETED))
+        
+        stats := hub.PeerSyncStats("WWRL000001")["default"]
+        
+        Expect(stats.LastRootMatch).ShouldNot(BeZero())
+        Expect(stats.Sessions[0].SessionID).Should(Equal(uint(1)))
+        Expect(stats.Sessions[0].Role).Should(Equal(SYNC_ROLE_RESPONDER))
+        Expect(stats.Sessions[0].AbortReason).Should(Equal(""))
+        Expect(stats.Sessions[0].NodesExplored).Should(Equal(uint64(1)))
+        Expect(stats.Sessions[0].KeysPushed).Should(Equal(uint64(0)))
+        Expect(stats.Sessions[0].BytesReceived).Should(BeNumerically(">", 0))
+        Expect(stats.Sessions[0].BytesSent).Should(BeNumerically(">", 0))
+    })
+})
+
+var _ = Describe("Hub broadcast", func() {
+    var syncScheduler *dirtyRecordingSyncScheduler
+    var hub *Hub
+    var httpServer *httptest.Server
+    var wsURL string
+    
+    BeforeEach(func() {
+        syncScheduler = &dirtyRecordingSyncScheduler{ PeriodicSyncScheduler: ddbSync.NewPeriodicSyncScheduler(SYNC_PERIOD_MS) }
+        hub = NewHub("", NewSyncController(2, nil, syncScheduler, 1000), nil)
+        // the server is never started. It only provides the buckets that updates are pushed from
+        _, _ = NewServer(ServerConfig{
+            DBFile: "/tmp/testdb-" + RandomString(),
+            Port: 8383,
+            Hub: hub,
+        })
+        httpServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            conn, err := (&websocket.Upgrader{ }).Upgrade(w, r, nil)
+            
+            if err != nil {
+                return
+            }
+            
+            hub.Accept(conn, 0, r.URL.Query().Get("id"), "site1", true)
+        }))
+        wsURL = "ws" + strings.TrimPrefix(httpServer.URL, "http")
+    })
+    
+    AfterEach(func() {
+        hub.Disconnect("WWRL000001")
+        hub.Disconnect("WWRL000002")
+        httpServer.Close()
+    })
+    
+    It("should only mark the bucket dirty for peers that the update isn't pushed to", func() {
+        for _, relayID := range []string{ "WWRL000001", "WWRL000002" } {
+            conn, _, err := websocket.DefaultDialer.Dial(wsURL + "?id=" + relayID, nil)
+            
+            Expect(err).Should(BeNil())
+            
+            defer conn.Close()
+        }
+        
+        Eventually(hub.Peers).Should(HaveLen(2))
+        
+        update := map[string]*SiblingSet{
+            "key1": NewSiblingSet(map[*Sibling]bool{ NewSibling(NewDVV(NewDot("", 0), map[string]uint64{ }), []byte("value"), 0): true }),
+        }
+        
+        hub.BroadcastUpdate("site1", "default", update, 1)
+        
+        Expect(syncScheduler.Dirty()).Should(HaveLen(1))
+        
+        hub.BroadcastUpdate("site1", "default", update, 0)
+        
+        Expect(syncScheduler.Dirty()).Should(HaveLen(1))
+    })
+})
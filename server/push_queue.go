@@ -0,0 +1,277 @@
+package server
+//
+ // Copyright (c) 2019 ARM Limited.
+ //
+ // SPDX-License-Identifier: MIT
+ //
+ // Permission is hereby granted, free of charge, to any person obtaining a copy
+ // of this software and associated documentation files (the "Software"), to
+ // deal in the Software without restriction, including without limitation the
+ // rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ // sell copies of the Software, and to permit persons to whom the Software is
+ // furnished to do so, subject to the following conditions:
+ //
+ // The above copyright notice and this permission notice shall be included in all
+ // copies or substantial portions of the Software.
+ //
+ // THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ // IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ // FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ // AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ // LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ // SOFTWARE.
+ //
+
+
+import (
+    "sync"
+    "time"
+
+    . "github.com/armPelionEdge/devicedb/data"
+
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+// How long to wait for a push to be acknowledged before it is sent
+// again. The wait doubles with every attempt up to SYNC_PUSH_RETRY_MAX
+const SYNC_PUSH_RETRY_MIN = time.Second * 2
+const SYNC_PUSH_RETRY_MAX = time.Minute
+// Pushes that are still unacknowledged after this long are dropped. By
+// then anti-entropy will have had a chance to sync the keys instead
+const SYNC_PUSH_MAX_AGE = time.Minute * 10
+// How often the queue is checked for pushes that are due to be sent again
+const SYNC_PUSH_RETRY_INTERVAL = time.Millisecond * 500
+
+var (
+    prometheusPushQueueDepthGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+        Namespace: "relays",
+        Subsystem: "devicedb_internal",
+        Name: "sync_push_queue_depth",
+        Help: "The number of pushed keys a peer has not yet acknowledged",
+    }, []string{ "peer" })
+
+    prometheusPushQueueAgeGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+        Namespace: "relays",
+        Subsystem: "devicedb_internal",
+        Name: "sync_push_oldest_unacknowledged_seconds",
+        Help: "How long the oldest push a peer has not yet acknowledged has been waiting",
+    }, []string{ "peer" })
+
+    prometheusPushRetriesCounter = prometheus.NewCounter(prometheus.CounterOpts{
+        Namespace: "relays",
+        Subsystem: "devicedb_internal",
+        Name: "sync_push_retries",
+        Help: "The number of pushes sent again because the peer did not acknowledge them in time",
+    })
+
+    prometheusPushExpiredCounter = prometheus.NewCounter(prometheus.CounterOpts{
+        Namespace: "relays",
+        Subsystem: "devicedb_internal",
+        Name: "sync_push_expired",
+        Help: "The number of pushes dropped because the peer never acknowledged them",
+    })
+)
+
+func init() {
+    prometheus.MustRegister(prometheusPushQueueDepthGauge, prometheusPushQueueAgeGauge, prometheusPushRetriesCounter, prometheusPushExpiredCounter)
+}
+
+type pushKey struct {
+    bucket string
+    key string
+}
+
+type pendingPush struct {
+    id uint64
+    value *SiblingSet
+    queued time.Time
+    attempts uint
+    nextAttempt time.Time
+}
+
+// A push that is waiting to be acknowledged
+type QueuedPush struct {
+    ID uint64
+    Bucket string
+    Key string
+    Value *SiblingSet
+}
+
+// PushQueue holds, for each peer, the pushes that it has not acknowledged
+// yet. A peer has at most one pending push per key. Pushing a key again
+// before the peer acknowledged it replaces the pending value so only the
+// latest sibling set is sent again. Queues are kept while a peer is
+// disconnected so that its pending pushes go out again once it is back
+type PushQueue struct {
+    lock sync.Mutex
+    nextID uint64
+    peers map[string]map[pushKey]*pendingPush
+}
+
+func NewPushQueue() *PushQueue {
+    return &PushQueue{
+        nextID: 1,
+        peers: make(map[string]map[pushKey]*pendingPush),
+    }
+}
+
+// Push adds a push to the queue of a peer and returns the ID that the
+// peer acknowledges it with
+func (pushQueue *PushQueue) Push(peerID string, bucket string, key string, value *SiblingSet, now time.Time) uint64 {
+    pushQueue.lock.Lock()
+    defer pushQueue.lock.Unlock()
+
+    if _, ok := pushQueue.peers[peerID]; !ok {
+        pushQueue.peers[peerID] = make(map[pushKey]*pendingPush)
+    }
+
+    id := pushQueue.nextID
+    pushQueue.nextID += 1
+
+    pending, ok := pushQueue.peers[peerID][pushKey{ bucket, key }]
+
+    if !ok {
+        // The key has been waiting on the peer since its first
+        // unacknowledged push, not since the latest one
+        pending = &pendingPush{ queued: now }
+        pushQueue.peers[peerID][pushKey{ bucket, key }] = pending
+    }
+
+    pending.id = id
+    pending.value = value
+    pending.attempts = 0
+    pending.nextAttempt = now.Add(SYNC_PUSH_RETRY_MIN)
+
+    return id
+}
+
+// Ack removes a push from the queue of a peer. Acknowledgements for a
+// value that has since been replaced are ignored
+func (pushQueue *PushQueue) Ack(peerID string, bucket string, key string, id uint64) {
+    pushQueue.lock.Lock()
+    defer pushQueue.lock.Unlock()
+
+    pending, ok := pushQueue.peers[peerID][pushKey{ bucket, key }]
+
+    if !ok || pending.id != id {
+        return
+    }
+
+    delete(pushQueue.peers[peerID], pushKey{ bucket, key })
+}
+
+// Due returns the pushes for a peer that have waited too long for an
+// acknowledgement and schedules their next attempt
+func (pushQueue *PushQueue) Due(peerID string, now time.Time) []QueuedPush {
+    pushQueue.lock.Lock()
+    defer pushQueue.lock.Unlock()
+
+    var due []QueuedPush
+
+    for k, pending := range pushQueue.peers[peerID] {
+        if now.Before(pending.nextAttempt) {
+            continue
+        }
+
+        pending.attempts += 1
+        pending.nextAttempt = now.Add(pushRetryDelay(pending.attempts))
+
+        due = append(due, QueuedPush{ ID: pending.id, Bucket: k.bucket, Key: k.key, Value: pending.value })
+    }
+
+    return due
+}
+
+// Expire drops the pushes for a peer that are older than
+// SYNC_PUSH_MAX_AGE and returns the buckets they belong to
+func (pushQueue *PushQueue) Expire(peerID string, now time.Time) map[string]bool {
+    pushQueue.lock.Lock()
+    defer pushQueue.lock.Unlock()
+
+    expired := make(map[string]bool)
+
+    for k, pending := range pushQueue.peers[peerID] {
+        if now.Sub(pending.queued) >= SYNC_PUSH_MAX_AGE {
+            delete(pushQueue.peers[peerID], k)
+            expired[k.bucket] = true
+        }
+    }
+
+    return expired
+}
+
+// Reset makes every push queued for a peer due right away. It is
+// called when the peer reconnects since anything that was in flight
+// when the connection dropped was lost
+func (pushQueue *PushQueue) Reset(peerID string, now time.Time) {
+    pushQueue.lock.Lock()
+    defer pushQueue.lock.Unlock()
+
+    for _, pending := range pushQueue.peers[peerID] {
+        pending.nextAttempt = now
+    }
+}
+
+// Forget stops listing a peer in Peers once it has acknowledged all
+// of its pushes
+func (pushQueue *PushQueue) Forget(peerID string) {
+    pushQueue.lock.Lock()
+    defer pushQueue.lock.Unlock()
+
+    if len(pushQueue.peers[peerID]) == 0 {
+        delete(pushQueue.peers, peerID)
+    }
+}
+
+// Clear drops every push queued for a peer
+func (pushQueue *PushQueue) Clear(peerID string) {
+    pushQueue.lock.Lock()
+    defer pushQueue.lock.Unlock()
+
+    delete(pushQueue.peers, peerID)
+}
+
+// Peers returns the IDs of all peers that have had pushes queued since
+// they were last forgotten
+func (pushQueue *PushQueue) Peers() []string {
+    pushQueue.lock.Lock()
+    defer pushQueue.lock.Unlock()
+
+    peers := make([]string, 0, len(pushQueue.peers))
+
+    for peerID, _ := range pushQueue.peers {
+        peers = append(peers, peerID)
+    }
+
+    return peers
+}
+
+// Stats returns the number of pushes a peer has yet to acknowledge and
+// how long the oldest of them has been waiting
+func (pushQueue *PushQueue) Stats(peerID string, now time.Time) (depth int, oldest time.Duration) {
+    pushQueue.lock.Lock()
+    defer pushQueue.lock.Unlock()
+
+    for _, pending := range pushQueue.peers[peerID] {
+        if now.Sub(pending.queued) > oldest {
+            oldest = now.Sub(pending.queued)
+        }
+    }
+
+    return len(pushQueue.peers[peerID]), oldest
+}
+
+func pushRetryDelay(attempts uint) time.Duration {
+    delay := SYNC_PUSH_RETRY_MIN
+
+    for i := uint(0); i < attempts && delay < SYNC_PUSH_RETRY_MAX; i++ {
+        delay *= 2
+    }
+
+    if delay > SYNC_PUSH_RETRY_MAX {
+        delay = SYNC_PUSH_RETRY_MAX
+    }
+
+    return delay
+}
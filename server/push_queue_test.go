@@ -0,0 +1,150 @@
+package server_test
+//
+ // Copyright (c) 2019 ARM Limited.
+ //
+ // SPDX-License-Identifier: MIT
+ //
+ // Permission is hereby granted, free of charge, to any person obtaining a copy
+ // of this software and associated documentation files (the "Software"), to
+ // deal in the Software without restriction, including without limitation the
+ // rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ // sell copies of the Software, and to permit persons to whom the Software is
+ // furnished to do so, subject to the following conditions:
+ //
+ // The above copyright notice and this permission notice shall be included in all
+ // copies or substantial portions of the Software.
+ //
+ // THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ // IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ // FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ // AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ // LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ // SOFTWARE.
+ //
+
+
+import (
+    "time"
+
+    . "github.com/armPelionEdge/devicedb/data"
+    . "github.com/armPelionEdge/devicedb/server"
+
+    . "github.com/onsi/ginkgo"
+    . "github.com/onsi/gomega"
+)
+
+var _ = Describe("PushQueue", func() {
+    var pushQueue *PushQueue
+    var now time.Time
+
+    siblingSet := func(value string) *SiblingSet {
+        return NewSiblingSet(map[*Sibling]bool{ NewSibling(NewDVV(NewDot("", 0), map[string]uint64{ }), []byte(value), 0): true })
+    }
+
+    BeforeEach(func() {
+        pushQueue = NewPushQueue()
+        now = time.Now()
+    })
+
+    It("should forget a push once the peer acknowledges it", func() {
+        id := pushQueue.Push("peer1", "default", "key1", siblingSet("a"), now)
+
+        depth, _ := pushQueue.Stats("peer1", now)
+        Expect(depth).Should(Equal(1))
+
+        pushQueue.Ack("peer1", "default", "key1", id)
+
+        depth, oldest := pushQueue.Stats("peer1", now)
+        Expect(depth).Should(Equal(0))
+        Expect(oldest).Should(Equal(time.Duration(0)))
+    })
+
+    It("should keep only the latest value of a key and ignore acknowledgements of older values", func() {
+        firstID := pushQueue.Push("peer1", "default", "key1", siblingSet("a"), now)
+        secondID := pushQueue.Push("peer1", "default", "key1", siblingSet("b"), now.Add(time.Second))
+
+        Expect(secondID).ShouldNot(Equal(firstID))
+
+        pushQueue.Ack("peer1", "default", "key1", firstID)
+
+        depth, oldest := pushQueue.Stats("peer1", now.Add(time.Second * 3))
+        Expect(depth).Should(Equal(1))
+        // The key has been waiting since its first push
+        Expect(oldest).Should(Equal(time.Second * 3))
+
+        due := pushQueue.Due("peer1", now.Add(time.Second * 3))
+
+        Expect(due).Should(HaveLen(1))
+        Expect(due[0].ID).Should(Equal(secondID))
+        Expect(due[0].Value.Value()).Should(Equal([]byte("b")))
+    })
+
+    It("should back off between attempts", func() {
+        pushQueue.Push("peer1", "default", "key1", siblingSet("a"), now)
+
+        due := pushQueue.Due("peer1", now.Add(SYNC_PUSH_RETRY_MIN - time.Millisecond))
+        Expect(due).Should(BeEmpty())
+
+        now = now.Add(SYNC_PUSH_RETRY_MIN)
+        due = pushQueue.Due("peer1", now)
+        Expect(due).Should(HaveLen(1))
+
+        due = pushQueue.Due("peer1", now.Add(SYNC_PUSH_RETRY_MIN))
+        Expect(due).Should(BeEmpty())
+
+        now = now.Add(SYNC_PUSH_RETRY_MIN * 2)
+        due = pushQueue.Due("peer1", now)
+        Expect(due).Should(HaveLen(1))
+    })
+
+    It("should make every push due right away when the peer reconnects", func() {
+        pushQueue.Push("peer1", "default", "key1", siblingSet("a"), now)
+        pushQueue.Push("peer1", "lww", "key1", siblingSet("a"), now)
+        pushQueue.Push("peer2", "default", "key1", siblingSet("a"), now)
+
+        pushQueue.Reset("peer1", now)
+
+        due := pushQueue.Due("peer1", now)
+        Expect(due).Should(HaveLen(2))
+
+        due = pushQueue.Due("peer2", now)
+        Expect(due).Should(BeEmpty())
+    })
+
+    It("should drop pushes that were never acknowledged", func() {
+        pushQueue.Push("peer1", "default", "key1", siblingSet("a"), now)
+        pushQueue.Push("peer1", "lww", "key1", siblingSet("a"), now.Add(time.Second))
+
+        Expect(pushQueue.Expire("peer1", now.Add(SYNC_PUSH_MAX_AGE))).Should(Equal(map[string]bool{ "default": true }))
+
+        depth, _ := pushQueue.Stats("peer1", now)
+        Expect(depth).Should(Equal(1))
+        Expect(pushQueue.Due("peer1", now.Add(SYNC_PUSH_MAX_AGE))).Should(HaveLen(1))
+    })
+
+    It("should drop every push of a peer that is cleared", func() {
+        pushQueue.Push("peer1", "default", "key1", siblingSet("a"), now)
+        pushQueue.Push("peer2", "default", "key1", siblingSet("a"), now)
+
+        pushQueue.Clear("peer1")
+
+        Expect(pushQueue.Peers()).Should(ConsistOf("peer2"))
+
+        depth, _ := pushQueue.Stats("peer1", now)
+        Expect(depth).Should(Equal(0))
+    })
+
+    It("should list a peer until it is forgotten with an empty queue", func() {
+        id := pushQueue.Push("peer1", "default", "key1", siblingSet("a"), now)
+
+        pushQueue.Forget("peer1")
+        Expect(pushQueue.Peers()).Should(ConsistOf("peer1"))
+
+        pushQueue.Ack("peer1", "default", "key1", id)
+        Expect(pushQueue.Peers()).Should(ConsistOf("peer1"))
+
+        pushQueue.Forget("peer1")
+        Expect(pushQueue.Peers()).Should(BeEmpty())
+    })
+})
@@ -40,9 +40,12 @@ import (
     "github.com/gorilla/mux"
     "github.com/gorilla/websocket"
     "net/http/pprof"
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/promhttp"
 
     . "github.com/armPelionEdge/devicedb/bucket"
     . "github.com/armPelionEdge/devicedb/bucket/builtin"
+    . "github.com/armPelionEdge/devicedb/bundle"
     . "github.com/armPelionEdge/devicedb/data"
     . "github.com/armPelionEdge/devicedb/merkle"
     . "github.com/armPelionEdge/devicedb/shared"
@@ -63,6 +66,9 @@ const (
     localNodePrefix = iota
     historianPrefix = iota
     alertsMapPrefix = iota
+    syncCursorsPrefix = iota
+    alertStatesPrefix = iota
+    alertHistoryPrefix = iota
 )
 
 type peerAddress struct {
@@ -79,11 +85,24 @@ type cloudAddress struct {
     URI string `json:"uri"`
 }
 
+// MerkleDepthJSON describes the merkle tree of a bucket. Only the
+// depth is read when it is used to change the depth of a bucket
+type MerkleDepthJSON struct {
+    Depth uint8 `json:"depth"`
+    KeyCount uint64 `json:"keyCount"`
+}
+
 type AlertEventData struct {
     Metadata interface{} `json:"metadata"`
     Status bool `json:"status"`
 }
 
+// AlertBody raises or updates an alert through PUT /alerts/{key}
+type AlertBody struct {
+    Level string `json:"level"`
+    Metadata interface{} `json:"metadata"`
+}
+
 type ServerConfig struct {
     DBFile string
     Port int
@@ -91,10 +110,16 @@ type ServerConfig struct {
     NodeID string
     Hub *Hub
     ServerTLS *tls.Config
+    BundleRoots *x509.CertPool
     PeerAddresses map[string]peerAddress
+    AdvertiseAddress string
     SyncPushBroadcastLimit uint64
     GCInterval uint64
     GCPurgeAge uint64
+    AdaptiveMerkleDepth bool
+    AdaptiveMerkleMinDepth uint8
+    AdaptiveMerkleMaxDepth uint8
+    AdaptiveMerkleInterval uint64
     Cloud *cloudAddress
     History *cloudAddress
     Alerts *cloudAddress
@@ -105,8 +130,17 @@ type ServerConfig struct {
     HistoryForwardBatchSize uint64
     HistoryForwardInterval uint64
     HistoryForwardThreshold uint64
+    HistoryRetentionRules []RetentionRule
+    HistoryRetentionInterval uint64
     AlertsForwardInterval uint64
+    AlertsDedupWindow uint64
+    AlertsHistoryLimit uint64
+    AlertsRuleInterval uint64
     SyncExplorationPathLimit uint32
+    CloudBandwidthBudget uint64
+    CloudBandwidthBudgetPeriod uint64
+    CloudBandwidthRate uint64
+    CloudBandwidthBurst uint64
 }
 
 func (sc *ServerConfig) LoadFromFile(file string) error {
@@ -123,8 +157,17 @@ func (sc *ServerConfig) LoadFromFile(file string) error {
     sc.DBFile = ysc.DBFile
     sc.Port = ysc.Port
     sc.MerkleDepth = ysc.MerkleDepth
+
+    if ysc.AdaptiveMerkleDepth != nil {
+        sc.AdaptiveMerkleDepth = true
+        sc.AdaptiveMerkleMinDepth = ysc.AdaptiveMerkleDepth.MinDepth
+        sc.AdaptiveMerkleMaxDepth = ysc.AdaptiveMerkleDepth.MaxDepth
+        sc.AdaptiveMerkleInterval = ysc.AdaptiveMerkleDepth.Interval
+    }
+
     sc.SyncPushBroadcastLimit = ysc.SyncPushBroadcastLimit
     sc.SyncExplorationPathLimit = ysc.SyncExplorationPathLimit
+    sc.AdvertiseAddress = ysc.AdvertiseAddress
     sc.PeerAddresses = make(map[string]peerAddress)
     for _, yamlPeer := range ysc.Peers {
         if _, ok := sc.PeerAddresses[yamlPeer.ID]; ok {
@@ -156,6 +199,13 @@ func (sc *ServerConfig) LoadFromFile(file string) error {
             NoValidate: ysc.Cloud.NoValidate,
             URI: ysc.Cloud.AlertsURI,
         }
+
+        if ysc.Cloud.Bandwidth != nil {
+            sc.CloudBandwidthBudget = ysc.Cloud.Bandwidth.Budget
+            sc.CloudBandwidthBudgetPeriod = ysc.Cloud.Bandwidth.BudgetPeriod
+            sc.CloudBandwidthRate = ysc.Cloud.Bandwidth.Rate
+            sc.CloudBandwidthBurst = ysc.Cloud.Bandwidth.Burst
+        }
     }
     
     sc.HistoryPurgeOnForward = ysc.History.PurgeOnForward
@@ -165,7 +215,22 @@ func (sc *ServerConfig) LoadFromFile(file string) error {
     sc.HistoryForwardBatchSize = ysc.History.ForwardBatchSize
     sc.HistoryForwardInterval = ysc.History.ForwardInterval
     sc.HistoryForwardThreshold = ysc.History.ForwardThreshold
+    sc.HistoryRetentionInterval = ysc.History.RetentionInterval
+
+    for _, rule := range ysc.History.RetentionRules {
+        sc.HistoryRetentionRules = append(sc.HistoryRetentionRules, RetentionRule{
+            Source: rule.Source,
+            Type: rule.Type,
+            MaxAge: rule.MaxAge,
+            MaxCount: rule.MaxCount,
+            Priority: rule.Priority,
+        })
+    }
+
     sc.AlertsForwardInterval = ysc.Alerts.ForwardInterval
+    sc.AlertsDedupWindow = ysc.Alerts.DedupWindow
+    sc.AlertsHistoryLimit = ysc.Alerts.HistoryLimit
+    sc.AlertsRuleInterval = ysc.Alerts.RuleInterval
 
     var clientTLSConfig *tls.Config = nil
     sc.NodeID = ysc.NodeID
@@ -192,6 +257,7 @@ func (sc *ServerConfig) LoadFromFile(file string) error {
         }
         
         sc.ServerTLS = serverTLSConfig
+        sc.BundleRoots = rootCAs
         
         
         clientCertX509, _ := x509.ParseCertificate(clientCertificate.Certificate[0])
@@ -215,7 +281,13 @@ func (sc *ServerConfig) LoadFromFile(file string) error {
         }
         Log.Infof(" No TLS Config provided. Http mode\n")
     }
-    sc.Hub = NewHub(sc.NodeID, NewSyncController(uint(ysc.MaxSyncSessions), nil, ddbSync.NewPeriodicSyncScheduler(time.Millisecond * time.Duration(ysc.SyncSessionPeriod)), sc.SyncExplorationPathLimit), clientTLSConfig)
+    var syncScheduler ddbSync.SyncScheduler = ddbSync.NewPeriodicSyncScheduler(time.Millisecond * time.Duration(ysc.SyncSessionPeriod))
+
+    if ysc.SyncSessionPeriodMax != 0 {
+        syncScheduler = ddbSync.NewAdaptiveSyncScheduler(time.Millisecond * time.Duration(ysc.SyncSessionPeriod), time.Millisecond * time.Duration(ysc.SyncSessionPeriodMax), SYNC_SESSION_JITTER)
+    }
+
+    sc.Hub = NewHub(sc.NodeID, NewSyncController(uint(ysc.MaxSyncSessions), nil, syncScheduler, sc.SyncExplorationPathLimit), clientTLSConfig)
     return nil
 }
 
@@ -234,6 +306,12 @@ type Server struct {
     historian *Historian
     alertsMap *AlertMap
     merkleDepth uint8
+    merkleDepthTuner *MerkleDepthTuner
+    retentionPurger *RetentionPurger
+    ruleEngine *RuleEngine
+    bundleRoots *x509.CertPool
+    // The storage prefix each bucket is kept under by bucket name
+    bucketPrefixes map[string]byte
 }
 
 func NewServer(serverConfig ServerConfig) (*Server, error) {
@@ -252,7 +330,7 @@ func NewServer(serverConfig ServerConfig) (*Server, error) {
     
     storageDriver := NewLevelDBStorageDriver(serverConfig.DBFile, nil)
     nodeID := serverConfig.NodeID
-    server := &Server{ NewBucketList(), nil, nil, storageDriver, serverConfig.Port, upgrader, serverConfig.Hub, serverConfig.ServerTLS, nodeID, serverConfig.SyncPushBroadcastLimit, nil, nil, nil, serverConfig.MerkleDepth }
+    server := &Server{ NewBucketList(), nil, nil, storageDriver, serverConfig.Port, upgrader, serverConfig.Hub, serverConfig.ServerTLS, nodeID, serverConfig.SyncPushBroadcastLimit, nil, nil, nil, serverConfig.MerkleDepth, nil, nil, nil, serverConfig.BundleRoots, nil }
     err := server.storageDriver.Open()
     
     if err != nil {
@@ -276,13 +354,31 @@ func NewServer(serverConfig ServerConfig) (*Server, error) {
         Log.Info("Database recovery successful!")
     }
     
-    defaultBucket, _ := NewDefaultBucket(nodeID, NewPrefixedStorageDriver([]byte{ defaultNodePrefix }, storageDriver), serverConfig.MerkleDepth)
-    cloudBucket, _ := NewCloudBucket(nodeID, NewPrefixedStorageDriver([]byte{ cloudNodePrefix }, storageDriver), serverConfig.MerkleDepth, RelayMode)
-    lwwBucket, _ := NewLWWBucket(nodeID, NewPrefixedStorageDriver([]byte{ lwwNodePrefix }, storageDriver), serverConfig.MerkleDepth)
-    localBucket, _ := NewLocalBucket(nodeID, NewPrefixedStorageDriver([]byte{ localNodePrefix }, storageDriver), MerkleMinDepth)
+    server.bucketPrefixes = map[string]byte{
+        "default": defaultNodePrefix,
+        "cloud": cloudNodePrefix,
+        "lww": lwwNodePrefix,
+        "local": localNodePrefix,
+    }
+
+    defaultBucket, _ := NewDefaultBucket(nodeID, NewPrefixedStorageDriver([]byte{ server.bucketPrefixes["default"] }, storageDriver), serverConfig.MerkleDepth)
+    cloudBucket, _ := NewCloudBucket(nodeID, NewPrefixedStorageDriver([]byte{ server.bucketPrefixes["cloud"] }, storageDriver), serverConfig.MerkleDepth, RelayMode)
+    lwwBucket, _ := NewLWWBucket(nodeID, NewPrefixedStorageDriver([]byte{ server.bucketPrefixes["lww"] }, storageDriver), serverConfig.MerkleDepth)
+    localBucket, _ := NewLocalBucket(nodeID, NewPrefixedStorageDriver([]byte{ server.bucketPrefixes["local"] }, storageDriver), MerkleMinDepth)
     
     server.historian = NewHistorian(NewPrefixedStorageDriver([]byte{ historianPrefix }, storageDriver), serverConfig.HistoryEventLimit, serverConfig.HistoryEventFloor, serverConfig.HistoryPurgeBatchSize)
-    server.alertsMap = NewAlertMap(NewAlertStore(NewPrefixedStorageDriver([]byte{ alertsMapPrefix }, storageDriver)))
+    alertHistory := NewHistorian(NewPrefixedStorageDriver([]byte{ alertHistoryPrefix }, storageDriver), serverConfig.AlertsHistoryLimit, serverConfig.AlertsHistoryLimit * 9 / 10, serverConfig.HistoryPurgeBatchSize)
+    server.alertsMap = NewAlertLifecycleMap(NewAlertStore(NewPrefixedStorageDriver([]byte{ alertsMapPrefix }, storageDriver)), NewAlertStore(NewPrefixedStorageDriver([]byte{ alertStatesPrefix }, storageDriver)), alertHistory, serverConfig.AlertsDedupWindow)
+
+    if len(serverConfig.HistoryRetentionRules) != 0 {
+        if err := server.historian.SetRetentionRules(serverConfig.HistoryRetentionRules); err != nil {
+            Log.Errorf("Error creating server: Invalid history retention rules: %v", err.Error())
+
+            return nil, err
+        }
+
+        server.retentionPurger = NewRetentionPurger(server.historian, serverConfig.HistoryRetentionInterval)
+    }
     
     server.bucketList.AddBucket(defaultBucket)
     server.bucketList.AddBucket(lwwBucket)
@@ -290,6 +386,17 @@ func NewServer(serverConfig ServerConfig) (*Server, error) {
     server.bucketList.AddBucket(localBucket)
     
     server.garbageCollector = NewGarbageCollector(server.bucketList, serverConfig.GCInterval, serverConfig.GCPurgeAge)
+    server.ruleEngine = NewRuleEngine(server.bucketList, server.historian, server.alertsMap, serverConfig.AlertsRuleInterval)
+
+    if serverConfig.AdaptiveMerkleDepth {
+        // The local bucket never syncs so the size of its merkle tree doesn't matter
+        replicatedBuckets := NewBucketList()
+        replicatedBuckets.AddBucket(defaultBucket)
+        replicatedBuckets.AddBucket(lwwBucket)
+        replicatedBuckets.AddBucket(cloudBucket)
+
+        server.merkleDepthTuner = NewMerkleDepthTuner(replicatedBuckets, serverConfig.AdaptiveMerkleInterval, serverConfig.AdaptiveMerkleMinDepth, serverConfig.AdaptiveMerkleMaxDepth)
+    }
     
     if server.hub != nil && server.hub.syncController != nil {
         server.hub.historian = server.historian
@@ -306,6 +413,10 @@ func NewServer(serverConfig ServerConfig) (*Server, error) {
         sitePool := &RelayNodeSitePool{ Site: site }
         bucketProxyFactory := &ddbSync.RelayBucketProxyFactory{ SitePool: sitePool }
         server.hub.syncController.bucketProxyFactory = bucketProxyFactory
+
+        if err := server.hub.syncController.syncCursors.Load(NewPrefixedStorageDriver([]byte{ syncCursorsPrefix }, storageDriver)); err != nil {
+            Log.Warningf("Unable to load saved sync cursors. Buckets will be fully synced with each peer again: %v", err)
+        }
     }
     
     if server.hub != nil && serverConfig.PeerAddresses != nil {
@@ -315,6 +426,11 @@ func NewServer(serverConfig ServerConfig) (*Server, error) {
     }
     
     if server.hub != nil && serverConfig.Cloud != nil {
+        if serverConfig.CloudBandwidthBudget != 0 || serverConfig.CloudBandwidthRate != 0 {
+            server.hub.bandwidthGovernor = NewBandwidthGovernor(serverConfig.CloudBandwidthBudget, time.Millisecond * time.Duration(serverConfig.CloudBandwidthBudgetPeriod), serverConfig.CloudBandwidthRate, serverConfig.CloudBandwidthBurst)
+        }
+
+        server.hub.SetAdvertiseAddress(serverConfig.AdvertiseAddress)
         server.hub.ConnectCloud(serverConfig.Cloud.ID, serverConfig.Cloud.URI, serverConfig.History.ID, serverConfig.History.URI, serverConfig.Alerts.ID, serverConfig.Alerts.URI, serverConfig.Cloud.NoValidate)
     }
     
@@ -345,6 +461,46 @@ func (server *Server) StopGC() {
     server.garbageCollector.Stop()
 }
 
+// StartMerkleDepthTuner starts adjusting the merkle depth of the
+// replicated buckets to the number of keys they hold. It does nothing
+// unless adaptive merkle depth is enabled in the server config
+func (server *Server) StartMerkleDepthTuner() {
+    if server.merkleDepthTuner != nil {
+        server.merkleDepthTuner.Start()
+    }
+}
+
+func (server *Server) StopMerkleDepthTuner() {
+    if server.merkleDepthTuner != nil {
+        server.merkleDepthTuner.Stop()
+    }
+}
+
+// StartRetentionPurger starts purging events that the history retention
+// rules no longer allow the history log to keep. It does nothing unless
+// retention rules are set in the server config
+func (server *Server) StartRetentionPurger() {
+    if server.retentionPurger != nil {
+        server.retentionPurger.Start()
+    }
+}
+
+func (server *Server) StopRetentionPurger() {
+    if server.retentionPurger != nil {
+        server.retentionPurger.Stop()
+    }
+}
+
+// StartRuleEngine starts raising and clearing alerts according to the
+// alert rules stored in the cloud bucket
+func (server *Server) StartRuleEngine() {
+    server.ruleEngine.Start()
+}
+
+func (server *Server) StopRuleEngine() {
+    server.ruleEngine.Stop()
+}
+
 func (server *Server) recover() error {
     recoverError := server.storageDriver.Recover()
 
@@ -401,6 +557,83 @@ func (server *Server) Start() error {
         io.WriteString(w, hex.EncodeToString(hashBytes[:]))
     }).Methods("GET")
 
+    r.HandleFunc("/{bucket}/merkleDepth", func(w http.ResponseWriter, r *http.Request) {
+        bucket := mux.Vars(r)["bucket"]
+        
+        if !server.bucketList.HasBucket(bucket) {
+            Log.Warningf("GET /{bucket}/merkleDepth: Invalid bucket")
+            
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusNotFound)
+            io.WriteString(w, string(EInvalidBucket.JSON()) + "\n")
+            
+            return
+        }
+        
+        merkleDepthJSON, _ := json.Marshal(MerkleDepthJSON{
+            Depth: server.bucketList.Get(bucket).MerkleTree().Depth(),
+            KeyCount: server.bucketList.Get(bucket).KeyCount(),
+        })
+        
+        w.Header().Set("Content-Type", "application/json; charset=utf8")
+        w.WriteHeader(http.StatusOK)
+        io.WriteString(w, string(merkleDepthJSON) + "\n")
+    }).Methods("GET")
+
+    r.HandleFunc("/{bucket}/merkleDepth", func(w http.ResponseWriter, r *http.Request) {
+        bucket := mux.Vars(r)["bucket"]
+        
+        if !server.bucketList.HasBucket(bucket) {
+            Log.Warningf("PUT /{bucket}/merkleDepth: Invalid bucket")
+            
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusNotFound)
+            io.WriteString(w, string(EInvalidBucket.JSON()) + "\n")
+            
+            return
+        }
+        
+        var merkleDepth MerkleDepthJSON
+        decoder := json.NewDecoder(r.Body)
+        
+        if err := decoder.Decode(&merkleDepth); err != nil {
+            Log.Warningf("PUT /{bucket}/merkleDepth: %v", err)
+            
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusBadRequest)
+            io.WriteString(w, string(EReadBody.JSON()) + "\n")
+            
+            return
+        }
+        
+        // The rebuild runs to completion before the response is sent. Writes
+        // keep being accepted while it runs
+        if err := server.bucketList.Get(bucket).Redepth(merkleDepth.Depth); err != nil {
+            Log.Warningf("PUT /{bucket}/merkleDepth: Unable to change merkle depth of bucket %s to %d: %v", bucket, merkleDepth.Depth, err)
+            
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            
+            if err == EMerkleDepth {
+                w.WriteHeader(http.StatusBadRequest)
+            } else {
+                w.WriteHeader(http.StatusInternalServerError)
+            }
+            
+            io.WriteString(w, string(err.(DBerror).JSON()) + "\n")
+            
+            return
+        }
+        
+        merkleDepthJSON, _ := json.Marshal(MerkleDepthJSON{
+            Depth: server.bucketList.Get(bucket).MerkleTree().Depth(),
+            KeyCount: server.bucketList.Get(bucket).KeyCount(),
+        })
+        
+        w.Header().Set("Content-Type", "application/json; charset=utf8")
+        w.WriteHeader(http.StatusOK)
+        io.WriteString(w, string(merkleDepthJSON) + "\n")
+    }).Methods("PUT")
+
     r.HandleFunc("/{bucket}/watch", func(w http.ResponseWriter, r *http.Request) {
         query := r.URL.Query()
         
@@ -455,6 +688,9 @@ func (server *Server) Start() error {
         var ch chan Row = make(chan Row)
         go server.bucketList.Get(bucket).Watch(r.Context(), keys, prefixes, lastSerial, ch)
 
+        prometheusBucketWatchersGauge.WithLabelValues(bucket).Inc()
+        defer prometheusBucketWatchersGauge.WithLabelValues(bucket).Dec()
+
         flusher, _ := w.(http.Flusher)
 
         w.Header().Set("Content-Type", "text/event-stream")
@@ -816,53 +1052,157 @@ func (server *Server) Start() error {
     }).Methods("PUT")
     
     r.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
-        query := r.URL.Query()
+        historyQuery, err := ParseHistoryQuery(r.URL.Query())
         
-        var historyQuery HistoryQuery
-    
-        if sources, ok := query["source"]; ok {
-            historyQuery.Sources = make([]string, 0, len(sources))
+        if err != nil {
+            Log.Warningf("GET /events: %v", err)
+        
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusBadRequest)
+            io.WriteString(w, string(ERequestQuery.JSON()) + "\n")
             
-            for _, source := range sources {
-                if len(source) != 0 {
-                    historyQuery.Sources = append(historyQuery.Sources, source)
-                }
-            }
-        } else {
-            historyQuery.Sources = make([]string, 0)
+            return
         }
         
-        if _, ok := query["limit"]; ok {
-            limitString := query.Get("limit")
-            limit, err := strconv.Atoi(limitString)
+        eventIterator, err := server.historian.Query(&historyQuery)
+        
+        if err != nil {
+            Log.Warningf("GET /events: Internal server error")
+        
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusInternalServerError)
+            io.WriteString(w, string(err.(DBerror).JSON()) + "\n")
             
-            if err != nil {
-                Log.Warningf("GET /events: %v", err)
+            return
+        }
+        
+        defer eventIterator.Release()
+    
+        flusher, _ := w.(http.Flusher)
+        
+        w.Header().Set("Content-Type", "application/json; charset=utf8")
+        w.Header().Set("X-Content-Type-Options", "nosniff")
+        w.WriteHeader(http.StatusOK)
+        
+        for eventIterator.Next() {
+            event := eventIterator.Event()
+            eventJSON, _ := json.Marshal(&event)
             
-                w.Header().Set("Content-Type", "application/json; charset=utf8")
-                w.WriteHeader(http.StatusBadRequest)
-                io.WriteString(w, string(ERequestQuery.JSON()) + "\n")
-                
+            _, err = fmt.Fprintf(w, "%s\n", string(eventJSON))
+            flusher.Flush()
+            
+            if err != nil {
                 return
             }
-            
-            historyQuery.Limit = limit
         }
-        
-        if _, ok := query["sortOrder"]; ok {
-            sortOrder := query.Get("sortOrder")
-            
-            if sortOrder == "desc" || sortOrder == "asc" {
-                historyQuery.Order = sortOrder
+    }).Methods("GET")
+
+    r.HandleFunc("/events/stream", func(w http.ResponseWriter, r *http.Request) {
+        var lastSerial uint64
+
+        // Only the source, type, group and data filters apply to the stream
+        historyQuery, err := ParseHistoryQuery(r.URL.Query())
+
+        if err == nil && r.URL.Query().Get("lastSerial") != "" {
+            lastSerial, err = strconv.ParseUint(r.URL.Query().Get("lastSerial"), 10, 64)
+        }
+
+        if err != nil {
+            Log.Warningf("GET /events/stream: %v", err)
+
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusBadRequest)
+            io.WriteString(w, string(ERequestQuery.JSON()) + "\n")
+
+            return
+        }
+
+        var ch chan *Event = make(chan *Event)
+        go server.historian.Watch(r.Context(), &historyQuery, lastSerial, ch)
+
+        flusher, _ := w.(http.Flusher)
+
+        w.Header().Set("Content-Type", "text/event-stream")
+        w.Header().Set("Cache-Control", "no-cache")
+        w.Header().Set("Connection", "keep-alive")
+
+        // The channel is closed early if this watcher falls too far
+        // behind. The client should watch again from the last serial
+        // it received
+        for event := range ch {
+            // Marks the end of the events logged after lastSerial
+            // that were missed
+            if event == nil {
+                fmt.Fprintf(w, "data: \n\n")
+                flusher.Flush()
+                continue
+            }
+
+            encodedEvent, err := json.Marshal(event)
+
+            if err != nil {
+                Log.Errorf("Encountered an error while encoding an event to JSON: %v", err)
+                continue
+            }
+
+            _, err = fmt.Fprintf(w, "data: %s\n\n", string(encodedEvent))
+
+            flusher.Flush()
+
+            if err != nil {
+                Log.Errorf("Encountered an error while writing an event to the event stream for a watcher: %v", err)
+                continue
             }
         }
-        
-        if _, ok := query["data"]; ok {
-            data := query.Get("data")
-            
-            historyQuery.Data = &data
+    }).Methods("GET")
+
+    r.HandleFunc("/events/aggregate", func(w http.ResponseWriter, r *http.Request) {
+        aggregationQuery, err := ParseAggregationQuery(r.URL.Query())
+
+        if err != nil {
+            Log.Warningf("GET /events/aggregate: %v", err)
+
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusBadRequest)
+            io.WriteString(w, string(ERequestQuery.JSON()) + "\n")
+
+            return
+        }
+
+        buckets, err := server.historian.Aggregate(&aggregationQuery)
+
+        if err != nil {
+            Log.Warningf("GET /events/aggregate: Internal server error")
+
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusInternalServerError)
+            io.WriteString(w, string(err.(DBerror).JSON()) + "\n")
+
+            return
+        }
+
+        bucketsJSON, err := json.Marshal(buckets)
+
+        if err != nil {
+            Log.Warningf("GET /events/aggregate: Unable to encode aggregate buckets: %v", err)
+
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusInternalServerError)
+            io.WriteString(w, string(EStorage.JSON()) + "\n")
+
+            return
         }
+
+        w.Header().Set("Content-Type", "application/json; charset=utf8")
+        w.WriteHeader(http.StatusOK)
+        io.WriteString(w, string(bucketsJSON) + "\n")
+    }).Methods("GET")
+
+    r.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+        query := r.URL.Query()
         
+        var historyQuery HistoryQuery
+    
         if _, ok := query["maxAge"]; ok {
             maxAgeString := query.Get("maxAge")
             maxAge, err := strconv.Atoi(maxAgeString)
@@ -945,7 +1285,7 @@ func (server *Server) Start() error {
             }
         }
         
-        eventIterator, err := server.historian.Query(&historyQuery)
+        err := server.historian.Purge(&historyQuery)
         
         if err != nil {
             Log.Warningf("GET /events: Internal server error")
@@ -957,130 +1297,194 @@ func (server *Server) Start() error {
             return
         }
         
-        defer eventIterator.Release()
-    
-        flusher, _ := w.(http.Flusher)
-        
         w.Header().Set("Content-Type", "application/json; charset=utf8")
-        w.Header().Set("X-Content-Type-Options", "nosniff")
         w.WriteHeader(http.StatusOK)
-        
-        for eventIterator.Next() {
-            event := eventIterator.Event()
-            eventJSON, _ := json.Marshal(&event)
-            
-            _, err = fmt.Fprintf(w, "%s\n", string(eventJSON))
-            flusher.Flush()
-            
-            if err != nil {
-                return
-            }
+        io.WriteString(w, "\n")
+    }).Methods("DELETE")
+
+    r.HandleFunc("/alerts", func(w http.ResponseWriter, r *http.Request) {
+        alerts, err := server.alertsMap.CurrentAlerts(r.URL.Query()["level"])
+
+        if err != nil {
+            Log.Warningf("GET /alerts: %v", err)
+
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusInternalServerError)
+            io.WriteString(w, string(EStorage.JSON()) + "\n")
+
+            return
         }
+
+        alertsJSON, _ := json.Marshal(alerts)
+
+        w.Header().Set("Content-Type", "application/json; charset=utf8")
+        w.WriteHeader(http.StatusOK)
+        io.WriteString(w, string(alertsJSON) + "\n")
     }).Methods("GET")
-    
-    r.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
-        query := r.URL.Query()
-        
-        var historyQuery HistoryQuery
-    
-        if _, ok := query["maxAge"]; ok {
-            maxAgeString := query.Get("maxAge")
-            maxAge, err := strconv.Atoi(maxAgeString)
-            
+
+    r.HandleFunc("/alerts/history", func(w http.ResponseWriter, r *http.Request) {
+        // source filters by alert key and type by transition
+        historyQuery, err := ParseHistoryQuery(r.URL.Query())
+
+        if err != nil {
+            Log.Warningf("GET /alerts/history: %v", err)
+
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusBadRequest)
+            io.WriteString(w, string(ERequestQuery.JSON()) + "\n")
+
+            return
+        }
+
+        eventIterator, err := server.alertsMap.History(&historyQuery)
+
+        if err != nil {
+            Log.Warningf("GET /alerts/history: Internal server error")
+
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusInternalServerError)
+            io.WriteString(w, string(err.(DBerror).JSON()) + "\n")
+
+            return
+        }
+
+        defer eventIterator.Release()
+
+        flusher, _ := w.(http.Flusher)
+
+        w.Header().Set("Content-Type", "application/json; charset=utf8")
+        w.Header().Set("X-Content-Type-Options", "nosniff")
+        w.WriteHeader(http.StatusOK)
+
+        for eventIterator.Next() {
+            eventJSON, _ := json.Marshal(eventIterator.Event())
+
+            _, err = fmt.Fprintf(w, "%s\n", string(eventJSON))
+            flusher.Flush()
+
             if err != nil {
-                Log.Warningf("GET /events: %v", err)
-            
-                w.Header().Set("Content-Type", "application/json; charset=utf8")
-                w.WriteHeader(http.StatusBadRequest)
-                io.WriteString(w, string(ERequestQuery.JSON()) + "\n")
-                
-                return
-            }
-            
-            if maxAge <= 0 {
-                Log.Warningf("GET /events: Non positive age specified")
-            
-                w.Header().Set("Content-Type", "application/json; charset=utf8")
-                w.WriteHeader(http.StatusBadRequest)
-                io.WriteString(w, string(ERequestQuery.JSON()) + "\n")
-                
                 return
             }
-            
-            nowMS := NanoToMilli(uint64(time.Now().UnixNano()))
-            historyQuery.After = nowMS - uint64(maxAge)
-        } else {
-            if _, ok := query["afterTime"]; ok {
-                afterString := query.Get("afterTime")
-                after, err := strconv.Atoi(afterString)
-            
-                if err != nil {
-                    Log.Warningf("GET /events: %v", err)
-                
-                    w.Header().Set("Content-Type", "application/json; charset=utf8")
-                    w.WriteHeader(http.StatusBadRequest)
-                    io.WriteString(w, string(ERequestQuery.JSON()) + "\n")
-                    
-                    return
-                }
-                
-                if after < 0 {
-                    Log.Warningf("GET /events: Non positive after specified")
-            
-                    w.Header().Set("Content-Type", "application/json; charset=utf8")
-                    w.WriteHeader(http.StatusBadRequest)
-                    io.WriteString(w, string(ERequestQuery.JSON()) + "\n")
-                    
-                    return
-                }
-                
-                historyQuery.After = uint64(after)
-            }
-            
-            if _, ok := query["beforeTime"]; ok {
-                beforeString := query.Get("beforeTime")
-                before, err := strconv.Atoi(beforeString)
-            
-                if err != nil {
-                    Log.Warningf("GET /events: %v", err)
-                
-                    w.Header().Set("Content-Type", "application/json; charset=utf8")
-                    w.WriteHeader(http.StatusBadRequest)
-                    io.WriteString(w, string(ERequestQuery.JSON()) + "\n")
-                    
-                    return
-                }
-                
-                if before < 0 {
-                    Log.Warningf("GET /events: Non positive before specified")
-            
-                    w.Header().Set("Content-Type", "application/json; charset=utf8")
-                    w.WriteHeader(http.StatusBadRequest)
-                    io.WriteString(w, string(ERequestQuery.JSON()) + "\n")
-                    
-                    return
-                }
-                
-                historyQuery.Before = uint64(before)
-            }
         }
-        
-        err := server.historian.Purge(&historyQuery)
-        
+    }).Methods("GET")
+
+    r.HandleFunc("/alerts/{key}", func(w http.ResponseWriter, r *http.Request) {
+        var alertBody AlertBody
+
+        if err := json.NewDecoder(r.Body).Decode(&alertBody); err != nil {
+            Log.Warningf("PUT /alerts/{key}: Unable to parse alert body: %v", err)
+
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusBadRequest)
+            io.WriteString(w, string(EReadBody.JSON()) + "\n")
+
+            return
+        }
+
+        if len(alertBody.Level) == 0 {
+            Log.Warningf("PUT /alerts/{key}: Empty alert level")
+
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusBadRequest)
+            io.WriteString(w, string(EEmpty.JSON()) + "\n")
+
+            return
+        }
+
+        err := server.alertsMap.UpdateAlert(Alert{
+            Key: mux.Vars(r)["key"],
+            Level: alertBody.Level,
+            Timestamp: NanoToMilli(uint64(time.Now().UnixNano())),
+            Metadata: alertBody.Metadata,
+            Status: true,
+        })
+
         if err != nil {
-            Log.Warningf("GET /events: Internal server error")
-        
+            Log.Warningf("PUT /alerts/{key}: %v", err)
+
             w.Header().Set("Content-Type", "application/json; charset=utf8")
             w.WriteHeader(http.StatusInternalServerError)
-            io.WriteString(w, string(err.(DBerror).JSON()) + "\n")
-            
+            io.WriteString(w, string(EStorage.JSON()) + "\n")
+
             return
         }
-        
+
+        server.hub.ForwardAlerts()
+
+        w.Header().Set("Content-Type", "application/json; charset=utf8")
+        w.WriteHeader(http.StatusOK)
+        io.WriteString(w, "\n")
+    }).Methods("PUT")
+
+    r.HandleFunc("/alerts/{key}", func(w http.ResponseWriter, r *http.Request) {
+        err := server.alertsMap.ClearAlert(mux.Vars(r)["key"], NanoToMilli(uint64(time.Now().UnixNano())))
+
+        if err == EAlertDoesNotExist {
+            Log.Warningf("DELETE /alerts/{key}: Alert is not firing")
+
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusNotFound)
+            io.WriteString(w, string(EAlertDoesNotExist.JSON()) + "\n")
+
+            return
+        }
+
+        if err != nil {
+            Log.Warningf("DELETE /alerts/{key}: %v", err)
+
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusInternalServerError)
+            io.WriteString(w, string(EStorage.JSON()) + "\n")
+
+            return
+        }
+
+        server.hub.ForwardAlerts()
+
         w.Header().Set("Content-Type", "application/json; charset=utf8")
         w.WriteHeader(http.StatusOK)
         io.WriteString(w, "\n")
     }).Methods("DELETE")
+
+    r.HandleFunc("/alerts/{key}/acknowledge", func(w http.ResponseWriter, r *http.Request) {
+        err := server.alertsMap.AcknowledgeAlert(mux.Vars(r)["key"], NanoToMilli(uint64(time.Now().UnixNano())))
+
+        if err == EAlertDoesNotExist {
+            Log.Warningf("POST /alerts/{key}/acknowledge: Alert is not firing")
+
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusNotFound)
+            io.WriteString(w, string(EAlertDoesNotExist.JSON()) + "\n")
+
+            return
+        }
+
+        if err != nil {
+            Log.Warningf("POST /alerts/{key}/acknowledge: %v", err)
+
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusInternalServerError)
+            io.WriteString(w, string(EStorage.JSON()) + "\n")
+
+            return
+        }
+
+        w.Header().Set("Content-Type", "application/json; charset=utf8")
+        w.WriteHeader(http.StatusOK)
+        io.WriteString(w, "\n")
+    }).Methods("POST")
+
+    r.HandleFunc("/events/flush", func(w http.ResponseWriter, r *http.Request) {
+        // Forwarding happens in the background. The forward lag metric
+        // shows when it has caught up
+        if server.hub != nil {
+            server.hub.FlushEvents()
+        }
+        
+        w.Header().Set("Content-Type", "application/json; charset=utf8")
+        w.WriteHeader(http.StatusAccepted)
+        io.WriteString(w, "\n")
+    }).Methods("POST")
     
     r.HandleFunc("/{bucket}/batch", func(w http.ResponseWriter, r *http.Request) {
         startTime := time.Now()
@@ -1156,6 +1560,199 @@ func (server *Server) Start() error {
         Log.Debugf("Batch update to bucket %s took %s", bucket, time.Since(startTime))
     }).Methods("POST")
     
+    r.HandleFunc("/{bucket}/bundle/export", func(w http.ResponseWriter, r *http.Request) {
+        bucket := mux.Vars(r)["bucket"]
+        
+        if !server.bucketList.HasBucket(bucket) {
+            Log.Warningf("POST /{bucket}/bundle/export: Invalid bucket")
+            
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusNotFound)
+            io.WriteString(w, string(EInvalidBucket.JSON()) + "\n")
+            
+            return
+        }
+        
+        var exportRequest ExportRequest
+        body, err := ioutil.ReadAll(r.Body)
+        
+        if err == nil && len(body) != 0 {
+            err = json.Unmarshal(body, &exportRequest)
+        }
+        
+        if err != nil {
+            Log.Warningf("POST /{bucket}/bundle/export: %v", err)
+            
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusBadRequest)
+            io.WriteString(w, string(EReadBody.JSON()) + "\n")
+            
+            return
+        }
+        
+        if exportRequest.Peer == "" {
+            exportRequest.Peer = CLOUD_PEER_ID
+        }
+        
+        if !server.bucketList.Get(bucket).ShouldReplicateOutgoing(exportRequest.Peer) {
+            Log.Warningf("POST /{bucket}/bundle/export: Bucket %s is not replicated to %s", bucket, exportRequest.Peer)
+            
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusUnauthorized)
+            io.WriteString(w, string(EUnauthorized.JSON()) + "\n")
+            
+            return
+        }
+        
+        merkleTree := server.bucketList.Get(bucket).MerkleTree()
+        iter, err := server.bucketList.Get(bucket).GetSyncChildren(merkleTree.RootNode())
+        
+        if err != nil {
+            Log.Warningf("POST /{bucket}/bundle/export: Internal server error")
+            
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusInternalServerError)
+            io.WriteString(w, string(err.(DBerror).JSON()) + "\n")
+            
+            return
+        }
+        
+        bundle, err := NewBundle(server.id, "", bucket, iter, exportRequest.Summary)
+        
+        if err == EBundleSummary {
+            Log.Warningf("POST /{bucket}/bundle/export: %v", err)
+            
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusBadRequest)
+            io.WriteString(w, string(EReadBody.JSON()) + "\n")
+            
+            return
+        }
+        
+        if err != nil {
+            Log.Warningf("POST /{bucket}/bundle/export: Internal server error: %v", err)
+            
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusInternalServerError)
+            io.WriteString(w, string(EStorage.JSON()) + "\n")
+            
+            return
+        }
+        
+        encodedBundle, _ := json.Marshal(bundle)
+        
+        w.Header().Set("Content-Type", "application/json; charset=utf8")
+        w.WriteHeader(http.StatusOK)
+        io.WriteString(w, string(encodedBundle) + "\n")
+    }).Methods("POST")
+    
+    r.HandleFunc("/{bucket}/bundle/import", func(w http.ResponseWriter, r *http.Request) {
+        bucket := mux.Vars(r)["bucket"]
+        
+        if !server.bucketList.HasBucket(bucket) {
+            Log.Warningf("POST /{bucket}/bundle/import: Invalid bucket")
+            
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusNotFound)
+            io.WriteString(w, string(EInvalidBucket.JSON()) + "\n")
+            
+            return
+        }
+        
+        if server.bundleRoots == nil {
+            Log.Warningf("POST /{bucket}/bundle/import: No CA is configured to verify bundles")
+            
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusUnauthorized)
+            io.WriteString(w, string(EUnauthorized.JSON()) + "\n")
+            
+            return
+        }
+        
+        signedBundle, err := ioutil.ReadAll(r.Body)
+        
+        if err != nil {
+            Log.Warningf("POST /{bucket}/bundle/import: %v", err)
+            
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusBadRequest)
+            io.WriteString(w, string(EReadBody.JSON()) + "\n")
+            
+            return
+        }
+        
+        bundle, signer, err := Open(signedBundle, server.bundleRoots)
+        
+        if err != nil {
+            Log.Warningf("POST /{bucket}/bundle/import: %v", err)
+            
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            
+            switch err.(type) {
+            case *json.SyntaxError, *json.UnmarshalTypeError:
+                w.WriteHeader(http.StatusBadRequest)
+                io.WriteString(w, string(EReadBody.JSON()) + "\n")
+            default:
+                w.WriteHeader(http.StatusUnauthorized)
+                io.WriteString(w, string(EUnauthorized.JSON()) + "\n")
+            }
+            
+            return
+        }
+        
+        // The signer vouches for the source so a bundle can only claim to
+        // come from the peer whose certificate signed it
+        source := signer.Subject.CommonName
+        
+        if bundle.Source != source {
+            Log.Warningf("POST /{bucket}/bundle/import: Bundle claims to come from %s but was signed by %s", bundle.Source, source)
+            
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusUnauthorized)
+            io.WriteString(w, string(EUnauthorized.JSON()) + "\n")
+            
+            return
+        }
+        
+        if bundle.Bucket != bucket {
+            Log.Warningf("POST /{bucket}/bundle/import: Bundle was exported from bucket %s not %s", bundle.Bucket, bucket)
+            
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusBadRequest)
+            io.WriteString(w, string(EBundleMismatch.JSON()) + "\n")
+            
+            return
+        }
+        
+        if !server.bucketList.Get(bucket).ShouldReplicateIncoming(source) {
+            Log.Warningf("POST /{bucket}/bundle/import: Bucket %s does not accept updates from %s", bucket, source)
+            
+            w.Header().Set("Content-Type", "application/json; charset=utf8")
+            w.WriteHeader(http.StatusUnauthorized)
+            io.WriteString(w, string(EUnauthorized.JSON()) + "\n")
+            
+            return
+        }
+        
+        if len(bundle.SiblingSets) != 0 {
+            if err := server.bucketList.Get(bucket).Merge(bundle.SiblingSets); err != nil {
+                Log.Warningf("POST /{bucket}/bundle/import: Internal server error")
+                
+                w.Header().Set("Content-Type", "application/json; charset=utf8")
+                w.WriteHeader(http.StatusInternalServerError)
+                io.WriteString(w, string(err.(DBerror).JSON()) + "\n")
+                
+                return
+            }
+        }
+        
+        Log.Infof("Imported %d keys into bucket %s from a bundle exported by %s", len(bundle.SiblingSets), bucket, bundle.Source)
+        
+        w.Header().Set("Content-Type", "application/json; charset=utf8")
+        w.WriteHeader(http.StatusOK)
+        io.WriteString(w, "\n")
+    }).Methods("POST")
+    
     r.HandleFunc("/peers", func(w http.ResponseWriter, r *http.Request) {
         // { id: peerID, direction: direction, status: status }
         var peers []*PeerJSON
@@ -1172,6 +1769,22 @@ func (server *Server) Start() error {
         w.WriteHeader(http.StatusOK)
         io.WriteString(w, string(peersJSON) + "\n")
     }).Methods("GET")
+
+    r.HandleFunc("/peers/{peerID}/sync", func(w http.ResponseWriter, r *http.Request) {
+        var syncStats map[string]BucketSyncStats
+
+        if server.hub != nil {
+            syncStats = server.hub.PeerSyncStats(mux.Vars(r)["peerID"])
+        } else {
+            syncStats = make(map[string]BucketSyncStats)
+        }
+
+        syncStatsJSON, _ := json.Marshal(syncStats)
+
+        w.Header().Set("Content-Type", "application/json; charset=utf8")
+        w.WriteHeader(http.StatusOK)
+        io.WriteString(w, string(syncStatsJSON) + "\n")
+    }).Methods("GET")
     
     r.HandleFunc("/peers/{peerID}", func(w http.ResponseWriter, r *http.Request) {
         peerID := mux.Vars(r)["peerID"]
@@ -1227,6 +1840,11 @@ func (server *Server) Start() error {
         server.hub.Accept(conn, 0, "", "", false)
     }).Methods("GET")
 
+    metricsRegistry := prometheus.NewRegistry()
+    metricsRegistry.MustRegister(&serverCollector{ server: server })
+
+    r.Handle("/metrics", promhttp.HandlerFor(prometheus.Gatherers{ prometheus.DefaultGatherer, metricsRegistry }, promhttp.HandlerOpts{ })).Methods("GET")
+
     r.HandleFunc("/debug/pprof/", pprof.Index)
     r.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
     r.HandleFunc("/debug/pprof/profile", pprof.Profile)
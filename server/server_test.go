@@ -25,17 +25,32 @@ package server_test
 
 
 import (
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
     "fmt"
+    "math/big"
     "time"
     "net/http"
     "bytes"
     "encoding/json"
     "bufio"
+    "compress/gzip"
+    "io/ioutil"
+    "net/http/httptest"
+    "strings"
+    "sync"
     
     . "github.com/armPelionEdge/devicedb/server"
+    . "github.com/armPelionEdge/devicedb/alerts"
     . "github.com/armPelionEdge/devicedb/data"
     . "github.com/armPelionEdge/devicedb/bucket"
+    . "github.com/armPelionEdge/devicedb/bundle"
     . "github.com/armPelionEdge/devicedb/error"
+    . "github.com/armPelionEdge/devicedb/historian"
     . "github.com/armPelionEdge/devicedb/util"
     . "github.com/armPelionEdge/devicedb/transport"
     ddbSync "github.com/armPelionEdge/devicedb/sync"
@@ -52,11 +67,62 @@ func buffer(j string) *bytes.Buffer {
     return bytes.NewBuffer([]byte(j))
 }
 
+// newBundleCA creates a throwaway CA for signing bundles so the tests do not
+// depend on the expiry dates of the certificates checked into test_certs
+func newBundleCA() (*x509.Certificate, *ecdsa.PrivateKey) {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+    Expect(err).Should(BeNil())
+
+    template := &x509.Certificate{
+        SerialNumber: big.NewInt(1),
+        Subject: pkix.Name{ CommonName: "Test CA" },
+        NotBefore: time.Now().Add(-time.Hour),
+        NotAfter: time.Now().Add(time.Hour),
+        IsCA: true,
+        BasicConstraintsValid: true,
+        KeyUsage: x509.KeyUsageCertSign,
+    }
+
+    der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+
+    Expect(err).Should(BeNil())
+
+    ca, err := x509.ParseCertificate(der)
+
+    Expect(err).Should(BeNil())
+
+    return ca, key
+}
+
+func newBundleSigner(id string, ca *x509.Certificate, caKey *ecdsa.PrivateKey) tls.Certificate {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+    Expect(err).Should(BeNil())
+
+    template := &x509.Certificate{
+        SerialNumber: big.NewInt(2),
+        Subject: pkix.Name{ CommonName: id },
+        NotBefore: time.Now().Add(-time.Hour),
+        NotAfter: time.Now().Add(time.Hour),
+        KeyUsage: x509.KeyUsageDigitalSignature,
+        ExtKeyUsage: []x509.ExtKeyUsage{ x509.ExtKeyUsageClientAuth },
+    }
+
+    der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+
+    Expect(err).Should(BeNil())
+
+    return tls.Certificate{ Certificate: [][]byte{ der }, PrivateKey: key }
+}
+
 var _ = Describe("Server", func() {
     var client *http.Client
     var server *Server
     var hub *Hub
     var syncController *SyncController
+    var bundleCA *x509.Certificate
+    var bundleCAKey *ecdsa.PrivateKey
     stop := make(chan int)
     
     BeforeEach(func() {
@@ -66,12 +132,16 @@ var _ = Describe("Server", func() {
 
         syncController = NewSyncController(2, nil, ddbSync.NewPeriodicSyncScheduler(SYNC_PERIOD_MS), 1000)
         hub = NewHub("", syncController, clientTLS)
+        bundleCA, bundleCAKey = newBundleCA()
+        bundleRoots := x509.NewCertPool()
+        bundleRoots.AddCert(bundleCA)
 
         client = &http.Client{ Transport: &http.Transport{ DisableKeepAlives: true } }
         server, _ = NewServer(ServerConfig{
             DBFile: "/tmp/testdb-" + RandomString(),
             Port: 8080,
             Hub: hub,
+            BundleRoots: bundleRoots,
         })
         
         go func() {
@@ -379,4 +449,627 @@ var _ = Describe("Server", func() {
             })
         })
     })
+    
+    Describe("GET /peers/{peerID}/sync", func() {
+        It("should return no buckets for a peer this node has never synced with", func() {
+            resp, err := client.Get(url("/peers/WWRL000001/sync", server))
+            
+            Expect(err).Should(BeNil())
+            defer resp.Body.Close()
+            Expect(resp.StatusCode).Should(Equal(http.StatusOK))
+            
+            var syncStats map[string]BucketSyncStats
+            Expect(json.NewDecoder(resp.Body).Decode(&syncStats)).Should(BeNil())
+            Expect(syncStats).Should(BeEmpty())
+        })
+    })
+    
+    Describe("GET /events", func() {
+        It("should filter events by type and group", func() {
+            Expect(server.History().LogEvent(&Event{ Timestamp: 1, SourceID: "door1", Type: "door_open", Groups: []string{ "floor2" } })).Should(BeNil())
+            Expect(server.History().LogEvent(&Event{ Timestamp: 2, SourceID: "door2", Type: "door_open", Groups: []string{ "floor1" } })).Should(BeNil())
+            Expect(server.History().LogEvent(&Event{ Timestamp: 3, SourceID: "door1", Type: "door_close", Groups: []string{ "floor2" } })).Should(BeNil())
+
+            resp, err := client.Get(url("/events?type=door_open&group=floor2", server))
+            
+            Expect(err).Should(BeNil())
+            defer resp.Body.Close()
+            Expect(resp.StatusCode).Should(Equal(http.StatusOK))
+
+            var event Event
+            decoder := json.NewDecoder(resp.Body)
+
+            Expect(decoder.Decode(&event)).Should(BeNil())
+            Expect(event.Timestamp).Should(Equal(uint64(1)))
+            Expect(decoder.Decode(&event)).ShouldNot(BeNil())
+        })
+    })
+
+    Describe("GET /events/stream", func() {
+        It("should replay events logged after lastSerial and then stream new ones", func() {
+            Expect(server.History().LogEvent(&Event{ Timestamp: 1, SourceID: "door1", Type: "door_open" })).Should(BeNil())
+            Expect(server.History().LogEvent(&Event{ Timestamp: 2, SourceID: "door2", Type: "door_open" })).Should(BeNil())
+
+            resp, err := client.Get(url("/events/stream?source=door2&lastSerial=0", server))
+
+            Expect(err).Should(BeNil())
+            defer resp.Body.Close()
+            Expect(resp.StatusCode).Should(Equal(http.StatusOK))
+            Expect(resp.Header.Get("Content-Type")).Should(Equal("text/event-stream"))
+
+            scanner := bufio.NewScanner(resp.Body)
+            nextData := func() string {
+                Expect(scanner.Scan()).Should(BeTrue())
+                data := scanner.Text()
+                Expect(scanner.Scan()).Should(BeTrue())
+
+                return data
+            }
+
+            var event Event
+
+            Expect(json.Unmarshal([]byte(strings.TrimPrefix(nextData(), "data: ")), &event)).Should(BeNil())
+            Expect(event.SourceID).Should(Equal("door2"))
+            Expect(nextData()).Should(Equal("data: "))
+
+            Expect(server.History().LogEvent(&Event{ Timestamp: 3, SourceID: "door1", Type: "door_close" })).Should(BeNil())
+            Expect(server.History().LogEvent(&Event{ Timestamp: 4, SourceID: "door2", Type: "door_close" })).Should(BeNil())
+
+            Expect(json.Unmarshal([]byte(strings.TrimPrefix(nextData(), "data: ")), &event)).Should(BeNil())
+            Expect(event.Type).Should(Equal("door_close"))
+            Expect(event.Serial).Should(Equal(uint64(4)))
+        })
+
+        It("should reject an invalid lastSerial", func() {
+            resp, err := client.Get(url("/events/stream?lastSerial=abc", server))
+
+            Expect(err).Should(BeNil())
+            defer resp.Body.Close()
+            Expect(resp.StatusCode).Should(Equal(http.StatusBadRequest))
+        })
+    })
+
+    Describe("GET /events/aggregate", func() {
+        It("should summarize events by time bucket and source", func() {
+            Expect(server.History().LogEvent(&Event{ Timestamp: 1000, SourceID: "sensor1", Type: "temperature", Data: "20" })).Should(BeNil())
+            Expect(server.History().LogEvent(&Event{ Timestamp: 2000, SourceID: "sensor1", Type: "temperature", Data: "22" })).Should(BeNil())
+            Expect(server.History().LogEvent(&Event{ Timestamp: 3000, SourceID: "sensor2", Type: "temperature", Data: "30" })).Should(BeNil())
+
+            resp, err := client.Get(url("/events/aggregate?interval=minute&groupBy=source", server))
+
+            Expect(err).Should(BeNil())
+            defer resp.Body.Close()
+            Expect(resp.StatusCode).Should(Equal(http.StatusOK))
+
+            var buckets []AggregateBucket
+
+            Expect(json.NewDecoder(resp.Body).Decode(&buckets)).Should(BeNil())
+            Expect(len(buckets)).Should(Equal(2))
+            Expect(buckets[0].Source).Should(Equal("sensor1"))
+            Expect(buckets[0].Count).Should(Equal(uint64(2)))
+            Expect(*buckets[0].Average).Should(Equal(21.0))
+            Expect(buckets[1].Source).Should(Equal("sensor2"))
+        })
+
+        It("should reject an unknown interval", func() {
+            resp, err := client.Get(url("/events/aggregate?interval=week", server))
+
+            Expect(err).Should(BeNil())
+            defer resp.Body.Close()
+            Expect(resp.StatusCode).Should(Equal(http.StatusBadRequest))
+        })
+    })
+
+    Describe("POST /alerts/{key}/acknowledge", func() {
+        It("should acknowledge a firing alert and record it in the alert history", func() {
+            req, err := http.NewRequest("PUT", url("/events/door1/tamper?category=alerts", server), buffer(`{ "status": true }`))
+
+            Expect(err).Should(BeNil())
+
+            resp, err := client.Do(req)
+
+            Expect(err).Should(BeNil())
+            resp.Body.Close()
+            Expect(resp.StatusCode).Should(Equal(http.StatusOK))
+
+            resp, err = client.Post(url("/alerts/door1/acknowledge", server), "application/json", nil)
+
+            Expect(err).Should(BeNil())
+            resp.Body.Close()
+            Expect(resp.StatusCode).Should(Equal(http.StatusOK))
+
+            resp, err = client.Get(url("/alerts/history?source=door1", server))
+
+            Expect(err).Should(BeNil())
+            defer resp.Body.Close()
+            Expect(resp.StatusCode).Should(Equal(http.StatusOK))
+
+            var event Event
+            decoder := json.NewDecoder(resp.Body)
+
+            Expect(decoder.Decode(&event)).Should(BeNil())
+            Expect(event.Type).Should(Equal(ALERT_RAISED))
+            Expect(decoder.Decode(&event)).Should(BeNil())
+            Expect(event.Type).Should(Equal(ALERT_ACKNOWLEDGED))
+        })
+
+        It("should respond with 404 if the alert is not firing", func() {
+            resp, err := client.Post(url("/alerts/door1/acknowledge", server), "application/json", nil)
+
+            Expect(err).Should(BeNil())
+            defer resp.Body.Close()
+            Expect(resp.StatusCode).Should(Equal(http.StatusNotFound))
+        })
+    })
+
+    Describe("/alerts/{key}", func() {
+        It("should raise, list and clear an alert", func() {
+            req, err := http.NewRequest("PUT", url("/alerts/door1", server), buffer(`{ "level": "critical", "metadata": "door open" }`))
+
+            Expect(err).Should(BeNil())
+
+            resp, err := client.Do(req)
+
+            Expect(err).Should(BeNil())
+            resp.Body.Close()
+            Expect(resp.StatusCode).Should(Equal(http.StatusOK))
+
+            resp, err = client.Get(url("/alerts?level=critical", server))
+
+            Expect(err).Should(BeNil())
+
+            var alerts []Alert
+
+            Expect(json.NewDecoder(resp.Body).Decode(&alerts)).Should(BeNil())
+            resp.Body.Close()
+            Expect(alerts).Should(HaveLen(1))
+            Expect(alerts[0].Key).Should(Equal("door1"))
+            Expect(alerts[0].Metadata).Should(Equal("door open"))
+
+            req, err = http.NewRequest("DELETE", url("/alerts/door1", server), nil)
+
+            Expect(err).Should(BeNil())
+
+            resp, err = client.Do(req)
+
+            Expect(err).Should(BeNil())
+            resp.Body.Close()
+            Expect(resp.StatusCode).Should(Equal(http.StatusOK))
+
+            resp, err = client.Get(url("/alerts", server))
+
+            Expect(err).Should(BeNil())
+            Expect(json.NewDecoder(resp.Body).Decode(&alerts)).Should(BeNil())
+            resp.Body.Close()
+            Expect(alerts).Should(BeEmpty())
+        })
+
+        It("should respond with 400 if no level is given", func() {
+            req, err := http.NewRequest("PUT", url("/alerts/door1", server), buffer(`{ "metadata": "door open" }`))
+
+            Expect(err).Should(BeNil())
+
+            resp, err := client.Do(req)
+
+            Expect(err).Should(BeNil())
+            resp.Body.Close()
+            Expect(resp.StatusCode).Should(Equal(http.StatusBadRequest))
+        })
+
+        It("should respond with 404 when clearing an alert that is not firing", func() {
+            req, err := http.NewRequest("DELETE", url("/alerts/door1", server), nil)
+
+            Expect(err).Should(BeNil())
+
+            resp, err := client.Do(req)
+
+            Expect(err).Should(BeNil())
+            resp.Body.Close()
+            Expect(resp.StatusCode).Should(Equal(http.StatusNotFound))
+        })
+    })
+
+    Describe("POST /events/flush", func() {
+        It("should accept the request even when no cloud is connected", func() {
+            resp, err := client.Post(url("/events/flush", server), "application/json", nil)
+            
+            Expect(err).Should(BeNil())
+            defer resp.Body.Close()
+            Expect(resp.StatusCode).Should(Equal(http.StatusAccepted))
+        })
+    })
+    
+    Describe("GET /metrics", func() {
+        It("should export the state of each bucket along with the sync metrics", func() {
+            updateBatch := NewUpdateBatch()
+            updateBatch.Put([]byte("key1"), []byte("value1"), NewDVV(NewDot("", 0), map[string]uint64{ }))
+            updateBatch.Put([]byte("key2"), []byte("value2"), NewDVV(NewDot("", 0), map[string]uint64{ }))
+            _, err := server.Buckets().Get("default").Batch(updateBatch)
+
+            Expect(err).Should(BeNil())
+
+            resp, err := client.Get(url("/metrics", server))
+            
+            Expect(err).Should(BeNil())
+            defer resp.Body.Close()
+            Expect(resp.StatusCode).Should(Equal(http.StatusOK))
+
+            body, err := ioutil.ReadAll(resp.Body)
+
+            Expect(err).Should(BeNil())
+            Expect(string(body)).Should(ContainSubstring(`relays_devicedb_internal_bucket_keys{bucket="default"} 2`))
+            Expect(string(body)).Should(ContainSubstring(`relays_devicedb_internal_bucket_merkle_root_changes{bucket="default"} 1`))
+            Expect(string(body)).Should(ContainSubstring(`relays_devicedb_internal_bucket_size_bytes{bucket="default"}`))
+            Expect(string(body)).Should(ContainSubstring(`relays_devicedb_internal_history_forward_lag 0`))
+            Expect(string(body)).Should(ContainSubstring(`relays_devicedb_internal_alerts_pending 0`))
+        })
+    })
+    
+    Describe("POST /{bucket}/bundle/export", func() {
+        BeforeEach(func() {
+            updateBatch := NewUpdateBatch()
+            updateBatch.Put([]byte("key1"), []byte("value1"), NewDVV(NewDot("", 0), map[string]uint64{ }))
+            updateBatch.Put([]byte("key2"), []byte("value2"), NewDVV(NewDot("", 0), map[string]uint64{ }))
+            var transportUpdateBatch TransportUpdateBatch = make([]TransportUpdateOp, len(updateBatch.Batch().Ops()))
+            transportUpdateBatch.FromUpdateBatch(updateBatch)
+            
+            jsonBytes, _ := json.Marshal(transportUpdateBatch)
+            resp, err := client.Post(url("/default/batch", server), "application/json", bytes.NewBuffer(jsonBytes))
+            
+            Expect(err).Should(BeNil())
+            resp.Body.Close()
+            Expect(resp.StatusCode).Should(Equal(http.StatusOK))
+        })
+        
+        It("should export every key in the bucket if no summary is given", func() {
+            resp, err := client.Post(url("/default/bundle/export", server), "application/json", buffer(``))
+            
+            Expect(err).Should(BeNil())
+            defer resp.Body.Close()
+            Expect(resp.StatusCode).Should(Equal(http.StatusOK))
+            
+            var bundle Bundle
+            Expect(json.NewDecoder(resp.Body).Decode(&bundle)).Should(BeNil())
+            Expect(bundle.Bucket).Should(Equal("default"))
+            Expect(bundle.SiblingSets).Should(HaveLen(2))
+            Expect(bundle.SiblingSets).Should(HaveKey("key1"))
+            Expect(bundle.SiblingSets).Should(HaveKey("key2"))
+        })
+        
+        It("should export nothing if the peer's summary matches the bucket", func() {
+            resp, err := client.Post(url("/default/bundle/export", server), "application/json", buffer(``))
+            
+            Expect(err).Should(BeNil())
+            
+            var bundle Bundle
+            Expect(json.NewDecoder(resp.Body).Decode(&bundle)).Should(BeNil())
+            resp.Body.Close()
+            
+            jsonBytes, _ := json.Marshal(ExportRequest{ Peer: "WWRL000001", Summary: bundle.Summary })
+            resp, err = client.Post(url("/default/bundle/export", server), "application/json", bytes.NewBuffer(jsonBytes))
+            
+            Expect(err).Should(BeNil())
+            defer resp.Body.Close()
+            Expect(resp.StatusCode).Should(Equal(http.StatusOK))
+            
+            var incremental Bundle
+            Expect(json.NewDecoder(resp.Body).Decode(&incremental)).Should(BeNil())
+            Expect(incremental.SiblingSets).Should(BeEmpty())
+        })
+        
+        It("should return 404 with EInvalidBucket in the body if the bucket specified is invalid", func() {
+            resp, err := client.Post(url("/invalidbucket/bundle/export", server), "application/json", buffer(``))
+            
+            Expect(err).Should(BeNil())
+            defer resp.Body.Close()
+            Expect(resp.StatusCode).Should(Equal(http.StatusNotFound))
+            
+            var dberr DBerror
+            Expect(json.NewDecoder(resp.Body).Decode(&dberr)).Should(BeNil())
+            Expect(dberr).Should(Equal(EInvalidBucket))
+        })
+        
+        It("should return 401 with EUnauthorized in the body if the bucket is not replicated to the peer", func() {
+            resp, err := client.Post(url("/local/bundle/export", server), "application/json", buffer(``))
+            
+            Expect(err).Should(BeNil())
+            defer resp.Body.Close()
+            Expect(resp.StatusCode).Should(Equal(http.StatusUnauthorized))
+            
+            var dberr DBerror
+            Expect(json.NewDecoder(resp.Body).Decode(&dberr)).Should(BeNil())
+            Expect(dberr).Should(Equal(EUnauthorized))
+        })
+    })
+    
+    Describe("POST /{bucket}/bundle/import", func() {
+        var bundle Bundle
+        
+        BeforeEach(func() {
+            bundle = Bundle{
+                Version: BUNDLE_VERSION,
+                Source: "cloud",
+                Bucket: "default",
+                SiblingSets: map[string]*SiblingSet{
+                    "key1": NewSiblingSet(map[*Sibling]bool{
+                        NewSibling(NewDVV(NewDot("cloud", 1), map[string]uint64{ }), []byte("value1"), 0): true,
+                    }),
+                },
+            }
+        })
+        
+        sign := func(bundle Bundle, signerID string) *bytes.Buffer {
+            signedBundle, err := Sign(&bundle, newBundleSigner(signerID, bundleCA, bundleCAKey))
+            
+            Expect(err).Should(BeNil())
+            
+            return bytes.NewBuffer(signedBundle)
+        }
+        
+        It("should merge the bundle into the bucket", func() {
+            resp, err := client.Post(url("/default/bundle/import", server), "application/json", sign(bundle, "cloud"))
+            
+            Expect(err).Should(BeNil())
+            resp.Body.Close()
+            Expect(resp.StatusCode).Should(Equal(http.StatusOK))
+            
+            resp, err = client.Post(url("/default/values", server), "application/json", buffer(`[ "key1" ]`))
+            
+            Expect(err).Should(BeNil())
+            defer resp.Body.Close()
+            
+            siblingSets := make([]*TransportSiblingSet, 0)
+            Expect(json.NewDecoder(resp.Body).Decode(&siblingSets)).Should(BeNil())
+            Expect(siblingSets[0].Siblings).Should(Equal([]string{ "value1" }))
+        })
+        
+        It("should return 401 with EUnauthorized in the body if the bucket does not accept updates from the source", func() {
+            bundle.Source = "WWRL000001"
+            bundle.Bucket = "cloud"
+            resp, err := client.Post(url("/cloud/bundle/import", server), "application/json", sign(bundle, "WWRL000001"))
+            
+            Expect(err).Should(BeNil())
+            defer resp.Body.Close()
+            Expect(resp.StatusCode).Should(Equal(http.StatusUnauthorized))
+            
+            var dberr DBerror
+            Expect(json.NewDecoder(resp.Body).Decode(&dberr)).Should(BeNil())
+            Expect(dberr).Should(Equal(EUnauthorized))
+        })
+        
+        It("should return 401 with EUnauthorized in the body if the bundle is not signed", func() {
+            jsonBytes, _ := json.Marshal(bundle)
+            resp, err := client.Post(url("/default/bundle/import", server), "application/json", bytes.NewBuffer(jsonBytes))
+            
+            Expect(err).Should(BeNil())
+            defer resp.Body.Close()
+            Expect(resp.StatusCode).Should(Equal(http.StatusUnauthorized))
+            
+            var dberr DBerror
+            Expect(json.NewDecoder(resp.Body).Decode(&dberr)).Should(BeNil())
+            Expect(dberr).Should(Equal(EUnauthorized))
+        })
+        
+        It("should return 401 with EUnauthorized in the body if the bundle is signed by a certificate from another CA", func() {
+            otherCA, otherCAKey := newBundleCA()
+            signedBundle, err := Sign(&bundle, newBundleSigner("cloud", otherCA, otherCAKey))
+            
+            Expect(err).Should(BeNil())
+            
+            resp, err := client.Post(url("/default/bundle/import", server), "application/json", bytes.NewBuffer(signedBundle))
+            
+            Expect(err).Should(BeNil())
+            defer resp.Body.Close()
+            Expect(resp.StatusCode).Should(Equal(http.StatusUnauthorized))
+        })
+        
+        It("should return 401 with EUnauthorized in the body if the source is not the signer", func() {
+            resp, err := client.Post(url("/default/bundle/import", server), "application/json", sign(bundle, "WWRL000001"))
+            
+            Expect(err).Should(BeNil())
+            defer resp.Body.Close()
+            Expect(resp.StatusCode).Should(Equal(http.StatusUnauthorized))
+            
+            var dberr DBerror
+            Expect(json.NewDecoder(resp.Body).Decode(&dberr)).Should(BeNil())
+            Expect(dberr).Should(Equal(EUnauthorized))
+        })
+        
+        It("should return 400 with EBundleMismatch in the body if the bundle was exported from another bucket", func() {
+            resp, err := client.Post(url("/lww/bundle/import", server), "application/json", sign(bundle, "cloud"))
+            
+            Expect(err).Should(BeNil())
+            defer resp.Body.Close()
+            Expect(resp.StatusCode).Should(Equal(http.StatusBadRequest))
+            
+            var dberr DBerror
+            Expect(json.NewDecoder(resp.Body).Decode(&dberr)).Should(BeNil())
+            Expect(dberr).Should(Equal(EBundleMismatch))
+        })
+        
+        It("should return 400 with EReadBody in the body if the bundle cannot be decoded", func() {
+            resp, err := client.Post(url("/default/bundle/import", server), "application/json", buffer(`[ ]`))
+            
+            Expect(err).Should(BeNil())
+            defer resp.Body.Close()
+            Expect(resp.StatusCode).Should(Equal(http.StatusBadRequest))
+        })
+    })
+})
+
+// A history server that rejects the first few pushes it receives
+type mockHistoryServer struct {
+    lock sync.Mutex
+    failures int
+    requests []historyRequest
+}
+
+type historyRequest struct {
+    time time.Time
+    contentEncoding string
+    idempotencyKey string
+    body []byte
+}
+
+func (historyServer *mockHistoryServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    body, _ := ioutil.ReadAll(r.Body)
+
+    historyServer.lock.Lock()
+    defer historyServer.lock.Unlock()
+
+    historyServer.requests = append(historyServer.requests, historyRequest{
+        time: time.Now(),
+        contentEncoding: r.Header.Get("Content-Encoding"),
+        idempotencyKey: r.Header.Get("Idempotency-Key"),
+        body: body,
+    })
+
+    if len(historyServer.requests) <= historyServer.failures {
+        w.WriteHeader(http.StatusInternalServerError)
+        w.Write([]byte("unavailable"))
+
+        return
+    }
+
+    w.WriteHeader(http.StatusOK)
+}
+
+func (historyServer *mockHistoryServer) Requests() []historyRequest {
+    historyServer.lock.Lock()
+    defer historyServer.lock.Unlock()
+
+    return append([]historyRequest{ }, historyServer.requests...)
+}
+
+var _ = Describe("Event forwarding", func() {
+    var client *http.Client
+    var server *Server
+    var hub *Hub
+    var historyServer *mockHistoryServer
+    var historyHTTPServer *httptest.Server
+    stop := make(chan int)
+
+    gunzip := func(body []byte) []map[string]interface{} {
+        reader, err := gzip.NewReader(bytes.NewReader(body))
+
+        Expect(err).Should(BeNil())
+
+        var events []map[string]interface{}
+
+        Expect(json.NewDecoder(reader).Decode(&events)).Should(BeNil())
+
+        return events
+    }
+
+    flush := func() {
+        resp, err := client.Post(url("/events/flush", server), "application/json", nil)
+
+        Expect(err).Should(BeNil())
+        defer resp.Body.Close()
+        Expect(resp.StatusCode).Should(Equal(http.StatusAccepted))
+    }
+
+    BeforeEach(func() {
+        historyServer = &mockHistoryServer{ failures: 2 }
+        historyHTTPServer = httptest.NewServer(historyServer)
+        hub = NewHub("", NewSyncController(2, nil, ddbSync.NewPeriodicSyncScheduler(SYNC_PERIOD_MS), 1000), nil)
+        client = &http.Client{ Transport: &http.Transport{ DisableKeepAlives: true } }
+        server, _ = NewServer(ServerConfig{
+            DBFile: "/tmp/testdb-" + RandomString(),
+            Port: 8484,
+            Hub: hub,
+            HistoryForwardBatchSize: 10,
+            // long enough that only flushes and retries push events
+            HistoryForwardInterval: 60000,
+            HistoryForwardThreshold: 1000,
+        })
+
+        Expect(server.History().LogEvent(&Event{ Timestamp: 1, SourceID: "door1", Type: "door_open" })).Should(BeNil())
+        Expect(server.History().LogEvent(&Event{ Timestamp: 2, SourceID: "door2", Type: "door_open" })).Should(BeNil())
+
+        // the cloud peer is registered right away even though its sync
+        // connection never comes up so events are forwarded to the history server
+        hub.ConnectCloud("", "ws://127.0.0.1:1/sync", "", historyHTTPServer.URL, "", historyHTTPServer.URL, false)
+        hub.StartForwardingEvents()
+
+        go func() {
+            server.Start()
+            stop <- 1
+        }()
+
+        time.Sleep(time.Millisecond * 100)
+    })
+
+    AfterEach(func() {
+        hub.Disconnect(CLOUD_PEER_ID)
+        historyHTTPServer.Close()
+        server.Stop()
+        <-stop
+    })
+
+    It("should keep retrying with a growing delay until the history server accepts the events", func() {
+        flush()
+
+        Eventually(func() []historyRequest { return historyServer.Requests() }, time.Second * 10).Should(HaveLen(3))
+        Eventually(server.History().ForwardIndex).Should(Equal(uint64(2)))
+
+        requests := historyServer.Requests()
+
+        // the first retry waits FORWARD_RETRY_WAIT_MIN_SECONDS and the delay doubles after each failure
+        Expect(requests[1].time.Sub(requests[0].time)).Should(BeNumerically(">=", time.Millisecond * 900))
+        Expect(requests[2].time.Sub(requests[1].time)).Should(BeNumerically(">=", time.Millisecond * 1900))
+
+        for _, request := range requests {
+            Expect(request.contentEncoding).Should(Equal("gzip"))
+            Expect(request.idempotencyKey).ShouldNot(BeEmpty())
+            Expect(request.idempotencyKey).Should(Equal(requests[0].idempotencyKey))
+
+            events := gunzip(request.body)
+
+            Expect(events).Should(HaveLen(2))
+            Expect(events[0]["device"]).Should(Equal("door1"))
+            Expect(events[1]["device"]).Should(Equal("door2"))
+        }
+
+        // nothing is pushed again once the history server has the events
+        flush()
+
+        Consistently(func() []historyRequest { return historyServer.Requests() }, time.Millisecond * 500).Should(HaveLen(3))
+    })
+
+    It("should retry right away when flushed while waiting to retry", func() {
+        flush()
+
+        Eventually(func() []historyRequest { return historyServer.Requests() }).Should(HaveLen(1))
+
+        flush()
+
+        Eventually(func() []historyRequest { return historyServer.Requests() }, time.Millisecond * 500).Should(HaveLen(2))
+
+        requests := historyServer.Requests()
+
+        Expect(requests[1].time.Sub(requests[0].time)).Should(BeNumerically("<", time.Millisecond * 900))
+        Expect(requests[1].idempotencyKey).Should(Equal(requests[0].idempotencyKey))
+    })
+
+    It("should give a new batch a new idempotency key", func() {
+        historyServer.lock.Lock()
+        historyServer.failures = 0
+        historyServer.lock.Unlock()
+
+        flush()
+
+        Eventually(server.History().ForwardIndex).Should(Equal(uint64(2)))
+
+        Expect(server.History().LogEvent(&Event{ Timestamp: 3, SourceID: "door1", Type: "door_close" })).Should(BeNil())
+
+        flush()
+
+        Eventually(func() []historyRequest { return historyServer.Requests() }).Should(HaveLen(2))
+
+        requests := historyServer.Requests()
+
+        Expect(gunzip(requests[1].body)).Should(HaveLen(1))
+        Expect(requests[1].idempotencyKey).ShouldNot(Equal(requests[0].idempotencyKey))
+    })
 })
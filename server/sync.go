@@ -26,9 +26,11 @@ package server
 
 import (
     "encoding/json"
+    "fmt"
 
     . "github.com/armPelionEdge/devicedb/data"
     . "github.com/armPelionEdge/devicedb/logging"
+    . "github.com/armPelionEdge/devicedb/merkle"
     ddbSync "github.com/armPelionEdge/devicedb/sync"
 )
 
@@ -40,6 +42,7 @@ const (
     RIGHT_HASH_COMPARE = iota
     HASH_COMPARE = iota
     DB_OBJECT_PUSH = iota
+    LOG_OBJECT_PUSH = iota
     END = iota
 )
 
@@ -52,18 +55,30 @@ func StateName(s int) string {
         RIGHT_HASH_COMPARE: "RIGHT_HASH_COMPARE",
         HASH_COMPARE: "HASH_COMPARE",
         DB_OBJECT_PUSH: "DB_OBJECT_PUSH",
+        LOG_OBJECT_PUSH: "LOG_OBJECT_PUSH",
         END: "END",
     }
     
     return names[s]
 }
 
-const PROTOCOL_VERSION uint = 2
+// The newest sync protocol version this node speaks. Version 3 added the
+// SYNC_HELLO handshake. Peers that don't send a hello are assumed to speak
+// MIN_PROTOCOL_VERSION, the oldest version this node still supports
+const PROTOCOL_VERSION uint = 3
+const MIN_PROTOCOL_VERSION uint = 2
+
+// Sessions accept a SYNC_START message from a peer speaking any protocol
+// version this node still supports
+func supportsProtocolVersion(protocolVersion uint) bool {
+    return protocolVersion >= MIN_PROTOCOL_VERSION && protocolVersion <= PROTOCOL_VERSION
+}
 
 // the state machine
 type InitiatorSyncSession struct {
     sessionID uint
     currentState int
+    depth uint8
     maxDepth uint8
     theirDepth uint8
     explorationQueue []uint32
@@ -71,20 +86,44 @@ type InitiatorSyncSession struct {
     bucketProxy ddbSync.BucketProxy
     replicatesOutgoing bool
     currentNodeKeys map[string]bool
+    logPositions map[string]uint64
+    logID string
+    logPosition uint64
+    logSynced bool
+    localLogID string
+    localPosition uint64
+    agreedRootHash Hash
+    agreedLogID string
+    agreedPosition uint64
+    explorationTruncated bool
+    diverged bool
+    rootMatched bool
+    rootHash Hash
+    abortReason string
+    protocolVersion uint
 }
 
 func NewInitiatorSyncSession(id uint, bucketProxy ddbSync.BucketProxy, explorationPathLimit uint32, replicatesOutgoing bool) *InitiatorSyncSession {
     return &InitiatorSyncSession{
         sessionID: id,
         currentState: START,
+        depth: bucketProxy.MerkleTree().Depth(),
         maxDepth: bucketProxy.MerkleTree().Depth(),
         explorationQueue: make([]uint32, 0),
         explorationPathLimit: explorationPathLimit,
         bucketProxy: bucketProxy,
         replicatesOutgoing: replicatesOutgoing,
+        protocolVersion: PROTOCOL_VERSION,
     }
 }
 
+// SetProtocolVersion sets the protocol version announced in the SYNC_START
+// message. It should be the version negotiated with the peer so that peers
+// which only speak an older version accept the session
+func (syncSession *InitiatorSyncSession) SetProtocolVersion(protocolVersion uint) {
+    syncSession.protocolVersion = protocolVersion
+}
+
 func (syncSession *InitiatorSyncSession) State() int {
     return syncSession.currentState
 }
@@ -143,6 +182,66 @@ func (syncSession *InitiatorSyncSession) ExplorationPathLimit() uint32 {
     return syncSession.explorationPathLimit
 }
 
+// SetLogPositions tells the session how far into the responder's
+// change log this node has already read, keyed by change log ID.
+// If the responder recognizes one of these positions it streams
+// the rows written since then instead of exploring the merkle tree
+func (syncSession *InitiatorSyncSession) SetLogPositions(logPositions map[string]uint64) {
+    syncSession.logPositions = logPositions
+}
+
+// SetAgreement tells the session the last merkle root hash that this
+// node and the responder both reported for the bucket and the position
+// of the local change log at that moment. If the responder still
+// reports that root hash only the parts of the merkle tree holding
+// keys written locally since then need to be explored
+func (syncSession *InitiatorSyncSession) SetAgreement(rootHash Hash, localLogID string, localPosition uint64) {
+    syncSession.agreedRootHash = rootHash
+    syncSession.agreedLogID = localLogID
+    syncSession.agreedPosition = localPosition
+}
+
+// Agreement returns the merkle root hash that both sides reported during
+// this session along with the position the local change log was at no
+// later than when the hashes were compared. ok is false if the root
+// hashes didn't match or the bucket has no change log
+func (syncSession *InitiatorSyncSession) Agreement() (rootHash Hash, localLogID string, localPosition uint64, ok bool) {
+    if !syncSession.rootMatched || syncSession.localLogID == "" {
+        return Hash{ }, "", 0, false
+    }
+
+    return syncSession.rootHash, syncSession.localLogID, syncSession.localPosition, true
+}
+
+// LogPosition returns the position in the responder's change log that
+// this node has caught up to. ok is false unless the session ended with
+// every row below that position merged into the local bucket
+func (syncSession *InitiatorSyncSession) LogPosition() (logID string, position uint64, ok bool) {
+    if syncSession.currentState != END || !syncSession.logSynced || syncSession.logID == "" {
+        return "", 0, false
+    }
+
+    return syncSession.logID, syncSession.logPosition, true
+}
+
+// Idle is true if the session completed and found the bucket
+// already in sync with the responder
+func (syncSession *InitiatorSyncSession) Idle() bool {
+    return syncSession.currentState == END && syncSession.logSynced && !syncSession.diverged
+}
+
+// RootMatched is true if the responder reported the same merkle root
+// hash for the bucket as the one this node has
+func (syncSession *InitiatorSyncSession) RootMatched() bool {
+    return syncSession.rootMatched
+}
+
+// AbortReason explains why the session ended before it could finish. It
+// is empty if the session is still running or completed
+func (syncSession *InitiatorSyncSession) AbortReason() string {
+    return syncSession.abortReason
+}
+
 func (syncSession *InitiatorSyncSession) getNodeKeys() error {
     if syncSession.replicatesOutgoing {
         return nil
@@ -170,6 +269,65 @@ func (syncSession *InitiatorSyncSession) getNodeKeys() error {
     return nil
 }
 
+// dirtyNodes returns the nodes at the depth this session explores down
+// to that hold keys written locally since the last agreement with the
+// responder. If the responder reports the agreed root hash again its
+// bucket has not changed since so the two trees can only differ below
+// these nodes. ok is false if the whole tree has to be explored instead
+func (syncSession *InitiatorSyncSession) dirtyNodes(responderHash MerkleNodeHash) (nodes []uint32, ok bool) {
+    if syncSession.agreedLogID == "" || responderHash.HashHigh != syncSession.agreedRootHash.High() || responderHash.HashLow != syncSession.agreedRootHash.Low() {
+        return nil, false
+    }
+
+    changeLog, ok := syncSession.bucketProxy.(ddbSync.ChangeLogBucketProxy)
+
+    // Tombstones purged since the agreement change the merkle tree without
+    // leaving a trace in the change log
+    if !ok || changeLog.ChangeLogID() != syncSession.agreedLogID || syncSession.agreedPosition < changeLog.ChangeLogHorizon() {
+        return nil, false
+    }
+
+    iter, _, err := changeLog.ChangesSince(syncSession.agreedPosition)
+
+    if err != nil {
+        Log.Warningf("Initiator session %d: unable to read the local change log from position %d. Exploring the whole merkle tree: %v", syncSession.sessionID, syncSession.agreedPosition, err)
+
+        return nil, false
+    }
+
+    defer iter.Release()
+
+    merkleTree := syncSession.bucketProxy.MerkleTree()
+    dirty := make(map[uint32]bool)
+
+    for iter.Next() {
+        keyHash := NewHash(iter.Key())
+        node := LeafNode(&keyHash, merkleTree.Depth())
+
+        for merkleTree.Level(node) > syncSession.maxDepth {
+            node = ParentNode(node)
+        }
+
+        dirty[node] = true
+
+        if uint32(len(dirty)) > syncSession.explorationPathLimit {
+            return nil, false
+        }
+    }
+
+    if iter.Error() != nil || len(dirty) == 0 {
+        return nil, false
+    }
+
+    nodes = make([]uint32, 0, len(dirty))
+
+    for node, _ := range dirty {
+        nodes = append(nodes, node)
+    }
+
+    return nodes, true
+}
+
 func (syncSession *InitiatorSyncSession) forgetNonAuthoritativeKeys() error {
     if syncSession.replicatesOutgoing {
         return nil
@@ -192,20 +350,29 @@ func (syncSession *InitiatorSyncSession) NextState(syncMessageWrapper *SyncMessa
     switch syncSession.currentState {
     case START:
         syncSession.currentState = HANDSHAKE
+
+        if changeLog, ok := syncSession.bucketProxy.(ddbSync.ChangeLogBucketProxy); ok {
+            // Read before the root hash is so that any change the hash
+            // includes is at or after this position
+            syncSession.localLogID = changeLog.ChangeLogID()
+            syncSession.localPosition = changeLog.ChangeLogPosition()
+        }
     
         messageWrapper = &SyncMessageWrapper{
             SessionID: syncSession.sessionID,
             MessageType: SYNC_START,
             MessageBody: Start{
-                ProtocolVersion: PROTOCOL_VERSION,
+                ProtocolVersion: syncSession.protocolVersion,
                 MerkleDepth: syncSession.bucketProxy.MerkleTree().Depth(),
                 Bucket: syncSession.bucketProxy.Name(),
+                LogPositions: syncSession.logPositions,
             },
         }
 
         break
     case HANDSHAKE:
         if syncMessageWrapper == nil || syncMessageWrapper.MessageType != SYNC_START {
+            syncSession.abortReason = unexpectedMessageReason(syncMessageWrapper)
             syncSession.currentState = END
             
             messageWrapper = &SyncMessageWrapper{
@@ -217,9 +384,10 @@ func (syncSession *InitiatorSyncSession) NextState(syncMessageWrapper *SyncMessa
             break
         }
 
-        if syncMessageWrapper.MessageBody.(Start).ProtocolVersion != PROTOCOL_VERSION {
+        if !supportsProtocolVersion(syncMessageWrapper.MessageBody.(Start).ProtocolVersion) {
             Log.Warningf("Initiator Session %d: responder protocol version is at %d which is unsupported by this database peer. Aborting...", syncSession.sessionID, syncMessageWrapper.MessageBody.(Start).ProtocolVersion)
             
+            syncSession.abortReason = fmt.Sprintf("unsupported protocol version %d", syncMessageWrapper.MessageBody.(Start).ProtocolVersion)
             syncSession.currentState = END
             
             messageWrapper = &SyncMessageWrapper{
@@ -236,6 +404,25 @@ func (syncSession *InitiatorSyncSession) NextState(syncMessageWrapper *SyncMessa
         }
         
         syncSession.theirDepth = syncMessageWrapper.MessageBody.(Start).MerkleDepth
+        syncSession.logID = syncMessageWrapper.MessageBody.(Start).LogID
+        syncSession.logPosition = syncMessageWrapper.MessageBody.(Start).LogPosition
+
+        if syncMessageWrapper.MessageBody.(Start).Delta && syncSession.logID != "" {
+            // The responder recognized our position in its change log and
+            // will stream the rows written since then
+            syncSession.currentState = LOG_OBJECT_PUSH
+
+            messageWrapper = &SyncMessageWrapper{
+                SessionID: syncSession.sessionID,
+                MessageType: SYNC_OBJECT_NEXT,
+                MessageBody: ObjectNext{
+                    NodeID: 0,
+                },
+            }
+
+            break
+        }
+
         syncSession.currentState = ROOT_HASH_COMPARE
         syncSession.PushExplorationQueue(syncSession.bucketProxy.MerkleTree().RootNode())
     
@@ -254,6 +441,7 @@ func (syncSession *InitiatorSyncSession) NextState(syncMessageWrapper *SyncMessa
         myHash := syncSession.bucketProxy.MerkleTree().NodeHash(syncSession.PeekExplorationQueue())
         
         if syncMessageWrapper == nil || syncMessageWrapper.MessageType != SYNC_NODE_HASH {
+            syncSession.abortReason = unexpectedMessageReason(syncMessageWrapper)
             syncSession.currentState = END
             
             messageWrapper = &SyncMessageWrapper{
@@ -265,6 +453,9 @@ func (syncSession *InitiatorSyncSession) NextState(syncMessageWrapper *SyncMessa
             break
         } else if syncMessageWrapper.MessageBody.(MerkleNodeHash).HashHigh == myHash.High() && syncMessageWrapper.MessageBody.(MerkleNodeHash).HashLow == myHash.Low() {
             syncSession.currentState = END
+            syncSession.logSynced = true
+            syncSession.rootMatched = true
+            syncSession.rootHash = myHash
             
             messageWrapper = &SyncMessageWrapper{
                 SessionID: syncSession.sessionID,
@@ -272,9 +463,44 @@ func (syncSession *InitiatorSyncSession) NextState(syncMessageWrapper *SyncMessa
                 MessageBody: Abort{ },
             }
 
+            break
+        } else if dirtyNodes, ok := syncSession.dirtyNodes(syncMessageWrapper.MessageBody.(MerkleNodeHash)); ok {
+            syncSession.diverged = true
+            syncSession.PopExplorationQueue()
+
+            for _, node := range dirtyNodes {
+                syncSession.PushExplorationQueue(node)
+            }
+
+            err := syncSession.getNodeKeys()
+
+            if err != nil {
+                syncSession.abortReason = fmt.Sprintf("unable to read keys: %v", err)
+                syncSession.currentState = END
+                
+                messageWrapper = &SyncMessageWrapper{
+                    SessionID: syncSession.sessionID,
+                    MessageType: SYNC_ABORT,
+                    MessageBody: Abort{ },
+                }
+
+                break
+            }
+
+            syncSession.currentState = DB_OBJECT_PUSH
+
+            messageWrapper = &SyncMessageWrapper{
+                SessionID: syncSession.sessionID,
+                MessageType: SYNC_OBJECT_NEXT,
+                MessageBody: ObjectNext{
+                    NodeID: syncSession.bucketProxy.MerkleTree().TranslateNode(syncSession.PeekExplorationQueue(), syncSession.theirDepth),
+                },
+            }
+
             break
         } else if syncSession.bucketProxy.MerkleTree().Level(syncSession.PeekExplorationQueue()) != syncSession.maxDepth {
             syncSession.currentState = LEFT_HASH_COMPARE
+            syncSession.diverged = true
             
             messageWrapper = &SyncMessageWrapper{
                 SessionID: syncSession.sessionID,
@@ -289,6 +515,7 @@ func (syncSession *InitiatorSyncSession) NextState(syncMessageWrapper *SyncMessa
             break
         } else {
             syncSession.currentState = DB_OBJECT_PUSH
+            syncSession.diverged = true
                 
             messageWrapper = &SyncMessageWrapper{
                 SessionID: syncSession.sessionID,
@@ -304,6 +531,7 @@ func (syncSession *InitiatorSyncSession) NextState(syncMessageWrapper *SyncMessa
         myLeftChildHash := syncSession.bucketProxy.MerkleTree().NodeHash(syncSession.bucketProxy.MerkleTree().LeftChild(syncSession.PeekExplorationQueue()))
         
         if syncMessageWrapper == nil || syncMessageWrapper.MessageType != SYNC_NODE_HASH {
+            syncSession.abortReason = unexpectedMessageReason(syncMessageWrapper)
             syncSession.currentState = END
             
             messageWrapper = &SyncMessageWrapper{
@@ -336,6 +564,7 @@ func (syncSession *InitiatorSyncSession) NextState(syncMessageWrapper *SyncMessa
         myRightChildHash := syncSession.bucketProxy.MerkleTree().NodeHash(syncSession.bucketProxy.MerkleTree().RightChild(syncSession.PeekExplorationQueue()))
         
         if syncMessageWrapper == nil || syncMessageWrapper.MessageType != SYNC_NODE_HASH {
+            syncSession.abortReason = unexpectedMessageReason(syncMessageWrapper)
             syncSession.currentState = END
             
             messageWrapper = &SyncMessageWrapper{
@@ -350,6 +579,8 @@ func (syncSession *InitiatorSyncSession) NextState(syncMessageWrapper *SyncMessa
         if syncMessageWrapper.MessageBody.(MerkleNodeHash).HashHigh != myRightChildHash.High() || syncMessageWrapper.MessageBody.(MerkleNodeHash).HashLow != myRightChildHash.Low() {
             if syncSession.ExplorationQueueSize() <= syncSession.ExplorationPathLimit() {
                 syncSession.PushExplorationQueue(syncSession.bucketProxy.MerkleTree().RightChild(syncSession.PeekExplorationQueue()))
+            } else {
+                syncSession.explorationTruncated = true
             }
         }
 
@@ -358,6 +589,7 @@ func (syncSession *InitiatorSyncSession) NextState(syncMessageWrapper *SyncMessa
         if syncSession.ExplorationQueueSize() == 0 {
             // no more nodes to explore. abort
             syncSession.currentState = END
+            syncSession.logSynced = !syncSession.explorationTruncated
             
             messageWrapper = &SyncMessageWrapper{
                 SessionID: syncSession.sessionID,
@@ -371,6 +603,7 @@ func (syncSession *InitiatorSyncSession) NextState(syncMessageWrapper *SyncMessa
             err := syncSession.getNodeKeys()
 
             if err != nil {
+                syncSession.abortReason = fmt.Sprintf("unable to read keys: %v", err)
                 syncSession.currentState = END
                 
                 messageWrapper = &SyncMessageWrapper{
@@ -410,6 +643,7 @@ func (syncSession *InitiatorSyncSession) NextState(syncMessageWrapper *SyncMessa
         break
     case DB_OBJECT_PUSH:
         if syncMessageWrapper == nil || syncMessageWrapper.MessageType != SYNC_PUSH_MESSAGE && syncMessageWrapper.MessageType != SYNC_PUSH_DONE {
+            syncSession.abortReason = unexpectedMessageReason(syncMessageWrapper)
             syncSession.currentState = END
             
             messageWrapper = &SyncMessageWrapper{
@@ -427,7 +661,12 @@ func (syncSession *InitiatorSyncSession) NextState(syncMessageWrapper *SyncMessa
             err := syncSession.forgetNonAuthoritativeKeys()
 
             if err != nil || syncSession.ExplorationQueueSize() == 0 {
+                if err != nil {
+                    syncSession.abortReason = fmt.Sprintf("unable to forget keys: %v", err)
+                }
+
                 syncSession.currentState = END
+                syncSession.logSynced = err == nil && !syncSession.explorationTruncated
                 
                 messageWrapper = &SyncMessageWrapper{
                     SessionID: syncSession.sessionID,
@@ -441,6 +680,7 @@ func (syncSession *InitiatorSyncSession) NextState(syncMessageWrapper *SyncMessa
             err = syncSession.getNodeKeys()
 
             if err != nil {
+                syncSession.abortReason = fmt.Sprintf("unable to read keys: %v", err)
                 syncSession.currentState = END
                 
                 messageWrapper = &SyncMessageWrapper{
@@ -471,6 +711,7 @@ func (syncSession *InitiatorSyncSession) NextState(syncMessageWrapper *SyncMessa
         err := syncSession.bucketProxy.Merge(map[string]*SiblingSet{ key: siblingSet })
         
         if err != nil {
+            syncSession.abortReason = fmt.Sprintf("unable to merge key %s: %v", key, err)
             syncSession.currentState = END
         
             messageWrapper = &SyncMessageWrapper{
@@ -490,6 +731,63 @@ func (syncSession *InitiatorSyncSession) NextState(syncMessageWrapper *SyncMessa
             },
         }
 
+        break
+    case LOG_OBJECT_PUSH:
+        if syncMessageWrapper == nil || syncMessageWrapper.MessageType != SYNC_PUSH_MESSAGE && syncMessageWrapper.MessageType != SYNC_PUSH_DONE {
+            syncSession.abortReason = unexpectedMessageReason(syncMessageWrapper)
+            syncSession.currentState = END
+            
+            messageWrapper = &SyncMessageWrapper{
+                SessionID: syncSession.sessionID,
+                MessageType: SYNC_ABORT,
+                MessageBody: Abort{ },
+            }
+
+            break
+        }
+
+        if syncMessageWrapper.MessageType == SYNC_PUSH_DONE {
+            // Every row up to the responder's log position has been merged
+            syncSession.currentState = END
+            syncSession.logSynced = true
+
+            messageWrapper = &SyncMessageWrapper{
+                SessionID: syncSession.sessionID,
+                MessageType: SYNC_ABORT,
+                MessageBody: Abort{ },
+            }
+
+            break
+        }
+
+        var key string = syncMessageWrapper.MessageBody.(PushMessage).Key
+        var siblingSet *SiblingSet = syncMessageWrapper.MessageBody.(PushMessage).Value
+
+        syncSession.diverged = true
+
+        err := syncSession.bucketProxy.Merge(map[string]*SiblingSet{ key: siblingSet })
+        
+        if err != nil {
+            syncSession.abortReason = fmt.Sprintf("unable to merge key %s: %v", key, err)
+            syncSession.currentState = END
+        
+            messageWrapper = &SyncMessageWrapper{
+                SessionID: syncSession.sessionID,
+                MessageType: SYNC_ABORT,
+                MessageBody: Abort{ },
+            }
+
+            break
+        }
+
+        messageWrapper = &SyncMessageWrapper{
+            SessionID: syncSession.sessionID,
+            MessageType: SYNC_OBJECT_NEXT,
+            MessageBody: ObjectNext{
+                NodeID: 0,
+            },
+        }
+
         break
     case END:
         return nil
@@ -500,7 +798,23 @@ func (syncSession *InitiatorSyncSession) NextState(syncMessageWrapper *SyncMessa
 
         // Encountered a proxy error with the merkle tree
         // need to abort
+        syncSession.abortReason = fmt.Sprintf("merkle tree error: %v", syncSession.bucketProxy.MerkleTree().Error())
+        syncSession.currentState = END
+        syncSession.logSynced = false
+
+        messageWrapper = &SyncMessageWrapper{
+            SessionID: syncSession.sessionID,
+            MessageType: SYNC_ABORT,
+            MessageBody: Abort{ },
+        }
+    } else if syncSession.bucketProxy.MerkleTree().Depth() != syncSession.depth {
+        // The bucket was re-depthed since this session started. Node IDs
+        // exchanged so far refer to the old tree
+        Log.Infof("Initiator sync session %d: merkle tree depth changed from %d to %d. Aborting...", syncSession.sessionID, syncSession.depth, syncSession.bucketProxy.MerkleTree().Depth())
+
+        syncSession.abortReason = SYNC_ABORT_REASON_REDEPTH
         syncSession.currentState = END
+        syncSession.logSynced = false
 
         messageWrapper = &SyncMessageWrapper{
             SessionID: syncSession.sessionID,
@@ -517,11 +831,16 @@ type ResponderSyncSession struct {
     sessionID uint
     currentState int
     node uint32
+    depth uint8
     maxDepth uint8
     theirDepth uint8
     bucketProxy ddbSync.BucketProxy
     iter SiblingSetIterator
     currentIterationNode uint32
+    diverged bool
+    rootMatched bool
+    abortReason string
+    protocolVersion uint
 }
 
 func NewResponderSyncSession(bucketProxy ddbSync.BucketProxy) *ResponderSyncSession {
@@ -529,12 +848,21 @@ func NewResponderSyncSession(bucketProxy ddbSync.BucketProxy) *ResponderSyncSess
         sessionID: 0,
         currentState: START,
         node: bucketProxy.MerkleTree().RootNode(),
+        depth: bucketProxy.MerkleTree().Depth(),
         maxDepth: bucketProxy.MerkleTree().Depth(),
         bucketProxy: bucketProxy,
         iter: nil,
+        protocolVersion: PROTOCOL_VERSION,
     }
 }
 
+// SetProtocolVersion sets the highest protocol version announced in the
+// SYNC_START reply. The reply never announces a newer version than the
+// initiator did
+func (syncSession *ResponderSyncSession) SetProtocolVersion(protocolVersion uint) {
+    syncSession.protocolVersion = protocolVersion
+}
+
 func (syncSession *ResponderSyncSession) State() int {
     return syncSession.currentState
 }
@@ -543,6 +871,34 @@ func (syncSession *ResponderSyncSession) SetState(state int) {
     syncSession.currentState = state
 }
 
+// Diverged is true if the initiator reported a different merkle root
+// hash for the bucket than the one this node has
+func (syncSession *ResponderSyncSession) Diverged() bool {
+    return syncSession.diverged
+}
+
+// RootMatched is true if the initiator reported the same merkle root
+// hash for the bucket as the one this node has
+func (syncSession *ResponderSyncSession) RootMatched() bool {
+    return syncSession.rootMatched
+}
+
+// AbortReason explains why the session ended before the initiator
+// finished it. It is empty if the session is still running or completed
+func (syncSession *ResponderSyncSession) AbortReason() string {
+    return syncSession.abortReason
+}
+
+// The initiator ends every session, successful or not, with SYNC_ABORT
+// so only the absence of a message or any other message is a failure
+func (syncSession *ResponderSyncSession) unexpectedMessage(syncMessageWrapper *SyncMessageWrapper) {
+    if syncMessageWrapper != nil && syncMessageWrapper.MessageType == SYNC_ABORT {
+        return
+    }
+
+    syncSession.abortReason = unexpectedMessageReason(syncMessageWrapper)
+}
+
 func (syncSession *ResponderSyncSession) SetInitiatorDepth(d uint8) {
     syncSession.theirDepth = d
 }
@@ -551,6 +907,53 @@ func (syncSession *ResponderSyncSession) InitiatorDepth() uint8 {
     return syncSession.theirDepth
 }
 
+// startChangeLog fills in the change log fields of the responder's start
+// message. If the initiator already holds a position in this bucket's change
+// log that has not been garbage collected the session streams every row
+// written since that position. Otherwise the initiator falls back to merkle
+// exploration and can record the returned position once it completes
+func (syncSession *ResponderSyncSession) startChangeLog(changeLog ddbSync.ChangeLogBucketProxy, logPositions map[string]uint64, start *Start) {
+    start.LogID = changeLog.ChangeLogID()
+
+    if start.LogID == "" {
+        return
+    }
+
+    position, ok := logPositions[start.LogID]
+
+    if !ok || position < changeLog.ChangeLogHorizon() {
+        start.LogPosition = changeLog.ChangeLogPosition()
+
+        return
+    }
+
+    iter, end, err := changeLog.ChangesSince(position)
+
+    if err != nil {
+        Log.Warningf("Responder session %d: unable to read change log from position %d. Falling back to merkle exploration: %v", syncSession.sessionID, position, err)
+
+        start.LogPosition = changeLog.ChangeLogPosition()
+
+        return
+    }
+
+    if position > end {
+        // The initiator claims to have seen rows that this log has not
+        // written. Its position must belong to a log that was restored
+        // from an older copy
+        iter.Release()
+
+        start.LogPosition = end
+
+        return
+    }
+
+    syncSession.iter = iter
+    syncSession.currentState = LOG_OBJECT_PUSH
+    start.LogPosition = end
+    start.Delta = true
+}
+
 func (syncSession *ResponderSyncSession) NextState(syncMessageWrapper *SyncMessageWrapper) *SyncMessageWrapper {
     var messageWrapper *SyncMessageWrapper
 
@@ -561,6 +964,7 @@ func (syncSession *ResponderSyncSession) NextState(syncMessageWrapper *SyncMessa
         }
         
         if syncMessageWrapper == nil || syncMessageWrapper.MessageType != SYNC_START {
+            syncSession.unexpectedMessage(syncMessageWrapper)
             syncSession.currentState = END
         
             messageWrapper = &SyncMessageWrapper{
@@ -572,9 +976,10 @@ func (syncSession *ResponderSyncSession) NextState(syncMessageWrapper *SyncMessa
             break
         }
 
-        if syncMessageWrapper.MessageBody.(Start).ProtocolVersion != PROTOCOL_VERSION {
+        if !supportsProtocolVersion(syncMessageWrapper.MessageBody.(Start).ProtocolVersion) {
             Log.Warningf("Responder Session %d: responder protocol version is at %d which is unsupported by this database peer. Aborting...", syncSession.sessionID, syncMessageWrapper.MessageBody.(Start).ProtocolVersion)
             
+            syncSession.abortReason = fmt.Sprintf("unsupported protocol version %d", syncMessageWrapper.MessageBody.(Start).ProtocolVersion)
             syncSession.currentState = END
         
             messageWrapper = &SyncMessageWrapper{
@@ -588,20 +993,31 @@ func (syncSession *ResponderSyncSession) NextState(syncMessageWrapper *SyncMessa
     
         syncSession.theirDepth = syncMessageWrapper.MessageBody.(Start).MerkleDepth
         syncSession.currentState = HASH_COMPARE
+
+        if syncMessageWrapper.MessageBody.(Start).ProtocolVersion < syncSession.protocolVersion {
+            syncSession.protocolVersion = syncMessageWrapper.MessageBody.(Start).ProtocolVersion
+        }
+
+        start := Start{
+            ProtocolVersion: syncSession.protocolVersion,
+            MerkleDepth: syncSession.bucketProxy.MerkleTree().Depth(),
+            Bucket: syncSession.bucketProxy.Name(),
+        }
+
+        if changeLog, ok := syncSession.bucketProxy.(ddbSync.ChangeLogBucketProxy); ok {
+            syncSession.startChangeLog(changeLog, syncMessageWrapper.MessageBody.(Start).LogPositions, &start)
+        }
     
         messageWrapper = &SyncMessageWrapper{
             SessionID: syncSession.sessionID,
             MessageType: SYNC_START,
-            MessageBody: Start{
-                ProtocolVersion: PROTOCOL_VERSION,
-                MerkleDepth: syncSession.bucketProxy.MerkleTree().Depth(),
-                Bucket: syncSession.bucketProxy.Name(),
-            },
+            MessageBody: start,
         }
 
         break
     case HASH_COMPARE:
         if syncMessageWrapper == nil || syncMessageWrapper.MessageType != SYNC_NODE_HASH && syncMessageWrapper.MessageType != SYNC_OBJECT_NEXT {
+            syncSession.unexpectedMessage(syncMessageWrapper)
             syncSession.currentState = END
             
             messageWrapper = &SyncMessageWrapper{
@@ -617,6 +1033,7 @@ func (syncSession *ResponderSyncSession) NextState(syncMessageWrapper *SyncMessa
             nodeID := syncMessageWrapper.MessageBody.(MerkleNodeHash).NodeID
             
             if nodeID >= syncSession.bucketProxy.MerkleTree().NodeLimit() || nodeID == 0 {
+                syncSession.abortReason = fmt.Sprintf("invalid merkle node %d", nodeID)
                 syncSession.currentState = END
                 
                 messageWrapper = &SyncMessageWrapper{
@@ -629,6 +1046,14 @@ func (syncSession *ResponderSyncSession) NextState(syncMessageWrapper *SyncMessa
             }
             
             nodeHash := syncSession.bucketProxy.MerkleTree().NodeHash(nodeID)
+
+            if nodeID == syncSession.bucketProxy.MerkleTree().RootNode() {
+                if syncMessageWrapper.MessageBody.(MerkleNodeHash).HashHigh != nodeHash.High() || syncMessageWrapper.MessageBody.(MerkleNodeHash).HashLow != nodeHash.Low() {
+                    syncSession.diverged = true
+                } else {
+                    syncSession.rootMatched = true
+                }
+            }
             
             messageWrapper = &SyncMessageWrapper{
                 SessionID: syncSession.sessionID,
@@ -649,6 +1074,7 @@ func (syncSession *ResponderSyncSession) NextState(syncMessageWrapper *SyncMessa
         iter, err := syncSession.bucketProxy.GetSyncChildren(nodeID)
         
         if err != nil {
+            syncSession.abortReason = fmt.Sprintf("unable to read keys: %v", err)
             syncSession.currentState = END
             
             messageWrapper = &SyncMessageWrapper{
@@ -676,6 +1102,7 @@ func (syncSession *ResponderSyncSession) NextState(syncMessageWrapper *SyncMessa
                 break
             }
             
+            syncSession.abortReason = fmt.Sprintf("unable to read keys: %v", err)
             syncSession.currentState = END
             
             messageWrapper = &SyncMessageWrapper{
@@ -706,6 +1133,7 @@ func (syncSession *ResponderSyncSession) NextState(syncMessageWrapper *SyncMessa
                 syncSession.iter.Release()
             }
                 
+            syncSession.unexpectedMessage(syncMessageWrapper)
             syncSession.currentState = END
             
             messageWrapper = &SyncMessageWrapper{
@@ -718,6 +1146,7 @@ func (syncSession *ResponderSyncSession) NextState(syncMessageWrapper *SyncMessa
         }
 
         if syncSession.iter == nil {
+            syncSession.abortReason = unexpectedMessageReason(syncMessageWrapper)
             syncSession.currentState = END
                 
             messageWrapper = &SyncMessageWrapper{
@@ -738,6 +1167,7 @@ func (syncSession *ResponderSyncSession) NextState(syncMessageWrapper *SyncMessa
             iter, err := syncSession.bucketProxy.GetSyncChildren(syncSession.currentIterationNode)
 
             if err != nil {
+                syncSession.abortReason = fmt.Sprintf("unable to read keys: %v", err)
                 syncSession.currentState = END
                 
                 messageWrapper = &SyncMessageWrapper{
@@ -767,6 +1197,8 @@ func (syncSession *ResponderSyncSession) NextState(syncMessageWrapper *SyncMessa
 
                     break
                 }
+
+                syncSession.abortReason = fmt.Sprintf("unable to read keys: %v", err)
             }
             
             syncSession.currentState = END
@@ -789,6 +1221,61 @@ func (syncSession *ResponderSyncSession) NextState(syncMessageWrapper *SyncMessa
             },
         }
 
+        break
+    case LOG_OBJECT_PUSH:
+        if syncMessageWrapper == nil || syncMessageWrapper.MessageType != SYNC_OBJECT_NEXT || syncSession.iter == nil {
+            if syncSession.iter != nil {
+                syncSession.iter.Release()
+            }
+
+            syncSession.unexpectedMessage(syncMessageWrapper)
+            syncSession.currentState = END
+            
+            messageWrapper = &SyncMessageWrapper{
+                SessionID: syncSession.sessionID,
+                MessageType: SYNC_ABORT,
+                MessageBody: Abort{ },
+            }
+
+            break
+        }
+
+        if !syncSession.iter.Next() {
+            err := syncSession.iter.Error()
+
+            syncSession.iter.Release()
+            syncSession.currentState = END
+
+            if err == nil {
+                messageWrapper = &SyncMessageWrapper{
+                    SessionID: syncSession.sessionID,
+                    MessageType: SYNC_PUSH_DONE,
+                    MessageBody: PushDone{ },
+                }
+
+                break
+            }
+
+            syncSession.abortReason = fmt.Sprintf("unable to read change log: %v", err)
+
+            messageWrapper = &SyncMessageWrapper{
+                SessionID: syncSession.sessionID,
+                MessageType: SYNC_ABORT,
+                MessageBody: Abort{ },
+            }
+
+            break
+        }
+
+        messageWrapper = &SyncMessageWrapper{
+            SessionID: syncSession.sessionID,
+            MessageType: SYNC_PUSH_MESSAGE,
+            MessageBody: PushMessage{
+                Key: string(syncSession.iter.Key()),
+                Value: syncSession.iter.Value(),
+            },
+        }
+
         break
     case END:
         return nil
@@ -799,6 +1286,18 @@ func (syncSession *ResponderSyncSession) NextState(syncMessageWrapper *SyncMessa
         // need to abort
         Log.Errorf("Initiator sync session %d encountered a merkle tree error: %v", syncSession.sessionID, syncSession.bucketProxy.MerkleTree().Error())
         
+        syncSession.abortReason = fmt.Sprintf("merkle tree error: %v", syncSession.bucketProxy.MerkleTree().Error())
+        syncSession.currentState = END
+
+        messageWrapper = &SyncMessageWrapper{
+            SessionID: syncSession.sessionID,
+            MessageType: SYNC_ABORT,
+            MessageBody: Abort{ },
+        }
+    } else if syncSession.bucketProxy.MerkleTree().Depth() != syncSession.depth {
+        Log.Infof("Responder sync session %d: merkle tree depth changed from %d to %d. Aborting...", syncSession.sessionID, syncSession.depth, syncSession.bucketProxy.MerkleTree().Depth())
+
+        syncSession.abortReason = SYNC_ABORT_REASON_REDEPTH
         syncSession.currentState = END
 
         messageWrapper = &SyncMessageWrapper{
@@ -821,6 +1320,10 @@ const (
     RESPONSE = iota
     PUSH = iota
     SYNC_PUSH_DONE = iota
+    SYNC_HELLO = iota
+    SYNC_SITE_ROSTER = iota
+    SYNC_PUSH_ACK = iota
+    SYNC_RELAY_SCOPE = iota
 )
 
 func MessageTypeName(m int) string {
@@ -831,11 +1334,29 @@ func MessageTypeName(m int) string {
         SYNC_OBJECT_NEXT: "SYNC_OBJECT_NEXT",
         SYNC_PUSH_MESSAGE: "SYNC_PUSH_MESSAGE",
         SYNC_PUSH_DONE: "SYNC_PUSH_DONE",
+        SYNC_HELLO: "SYNC_HELLO",
+        SYNC_SITE_ROSTER: "SYNC_SITE_ROSTER",
+        SYNC_PUSH_ACK: "SYNC_PUSH_ACK",
+        SYNC_RELAY_SCOPE: "SYNC_RELAY_SCOPE",
     }
     
     return names[m]
 }
 
+// Describes why a session gave up waiting on its peer when it received
+// msg instead of the message it expected
+func unexpectedMessageReason(msg *SyncMessageWrapper) string {
+    if msg == nil {
+        return SYNC_ABORT_REASON_TIMEOUT
+    }
+
+    if msg.MessageType == SYNC_ABORT {
+        return SYNC_ABORT_REASON_PEER
+    }
+
+    return fmt.Sprintf("unexpected %s message", MessageTypeName(msg.MessageType))
+}
+
 type rawSyncMessageWrapper struct {
     SessionID uint `json:"sessionID"`
     MessageType int `json:"type"`
@@ -850,12 +1371,27 @@ type SyncMessageWrapper struct {
     MessageBody interface{ } `json:"body"`
     Direction uint `json:"dir"`
     nodeID string
+    // The encoded size of the message body as it was received
+    size int
+    // The session that sent this message, if any. Its byte count is
+    // updated once the message is written
+    session *SyncSessionRecord
 }
 
 type Start struct {
     ProtocolVersion uint
     MerkleDepth uint8
     Bucket string
+    // Sent by the initiator. The positions it has reached in change
+    // logs of this bucket, keyed by change log ID
+    LogPositions map[string]uint64 `json:",omitempty"`
+    // Sent by the responder. Identifies its change log and the position
+    // the initiator will have reached once this session completes
+    LogID string `json:",omitempty"`
+    LogPosition uint64 `json:",omitempty"`
+    // Sent by the responder when it will stream rows from its change
+    // log rather than answer merkle tree queries
+    Delta bool `json:",omitempty"`
 }
 
 type Abort struct {
@@ -875,7 +1411,22 @@ type PushMessage struct {
     Bucket string
     Key string
     Value *SiblingSet
+    // Set on pushes that the sender wants acknowledged with a
+    // SYNC_PUSH_ACK message once they are merged
+    ID uint64 `json:",omitempty"`
+}
+
+type PushAck struct {
+    Bucket string
+    Key string
+    ID uint64
 }
 
 type PushDone struct {
+}
+
+// Sent by the cloud to a relay with the key prefixes, per bucket, of the
+// relay's subscription. Buckets that aren't listed are replicated in full
+type RelayScope struct {
+    Buckets map[string][]string
 }
\ No newline at end of file
@@ -0,0 +1,219 @@
+package server
+//
+ // Copyright (c) 2019 ARM Limited.
+ //
+ // SPDX-License-Identifier: MIT
+ //
+ // Permission is hereby granted, free of charge, to any person obtaining a copy
+ // of this software and associated documentation files (the "Software"), to
+ // deal in the Software without restriction, including without limitation the
+ // rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ // sell copies of the Software, and to permit persons to whom the Software is
+ // furnished to do so, subject to the following conditions:
+ //
+ // The above copyright notice and this permission notice shall be included in all
+ // copies or substantial portions of the Software.
+ //
+ // THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ // IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ // FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ // AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ // LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ // SOFTWARE.
+ //
+
+
+import (
+    "encoding/json"
+    "sync"
+
+    . "github.com/armPelionEdge/devicedb/data"
+    . "github.com/armPelionEdge/devicedb/logging"
+    . "github.com/armPelionEdge/devicedb/storage"
+)
+
+// SyncCursor is what this node remembers about syncing one bucket
+// with a peer.
+//
+// Positions tracks how far into the peer's change logs this node
+// has read. A bucket may be served by more than one change log since
+// a cloud site replica can be read from any node that owns its
+// partition so positions are keyed by change log ID.
+//
+// The agreement fields record the last merkle root hash that both
+// sides reported for the bucket along with the position of the local
+// change log at that moment. Every local change since then is in the
+// local change log from LocalPosition on unless the log has since
+// been garbage collected past that point
+type SyncCursor struct {
+    Peer string `json:"peer"`
+    Bucket string `json:"bucket"`
+    Positions map[string]uint64 `json:"positions,omitempty"`
+    RootHash Hash `json:"rootHash"`
+    LocalLogID string `json:"localLogID,omitempty"`
+    LocalPosition uint64 `json:"localPosition"`
+}
+
+// Agreed is true if the cursor records a root hash both sides agreed on
+func (cursor SyncCursor) Agreed() bool {
+    return cursor.LocalLogID != ""
+}
+
+// SyncCursors holds the sync cursor of every peer and bucket. Once
+// loaded from a storage driver every change to a cursor is saved to
+// it so that a node picks up where it left off after a restart
+// instead of exploring the whole merkle tree of every bucket again
+type SyncCursors struct {
+    lock sync.Mutex
+    cursors map[string]map[string]*SyncCursor
+    storageDriver StorageDriver
+}
+
+func NewSyncCursors() *SyncCursors {
+    return &SyncCursors{
+        cursors: make(map[string]map[string]*SyncCursor),
+    }
+}
+
+// Load restores the cursors saved in storageDriver and saves
+// any later changes there
+func (syncCursors *SyncCursors) Load(storageDriver StorageDriver) error {
+    syncCursors.lock.Lock()
+    defer syncCursors.lock.Unlock()
+
+    iter, err := storageDriver.GetMatches([][]byte{ []byte{ } })
+
+    if err != nil {
+        return err
+    }
+
+    defer iter.Release()
+
+    for iter.Next() {
+        var cursor SyncCursor
+
+        if err := json.Unmarshal(iter.Value(), &cursor); err != nil {
+            Log.Warningf("Ignoring saved sync cursor %s: %v", string(iter.Key()), err)
+
+            continue
+        }
+
+        *syncCursors.cursor(cursor.Peer, cursor.Bucket) = cursor
+    }
+
+    if iter.Error() != nil {
+        return iter.Error()
+    }
+
+    syncCursors.storageDriver = storageDriver
+
+    return nil
+}
+
+func (syncCursors *SyncCursors) cursor(peerID string, bucket string) *SyncCursor {
+    if _, ok := syncCursors.cursors[peerID]; !ok {
+        syncCursors.cursors[peerID] = make(map[string]*SyncCursor)
+    }
+
+    if _, ok := syncCursors.cursors[peerID][bucket]; !ok {
+        syncCursors.cursors[peerID][bucket] = &SyncCursor{ Peer: peerID, Bucket: bucket }
+    }
+
+    return syncCursors.cursors[peerID][bucket]
+}
+
+func (syncCursors *SyncCursors) save(cursor *SyncCursor) {
+    if syncCursors.storageDriver == nil {
+        return
+    }
+
+    encodedCursor, err := json.Marshal(cursor)
+
+    if err != nil {
+        Log.Warningf("Unable to encode the sync cursor for peer %s and bucket %s: %v", cursor.Peer, cursor.Bucket, err)
+
+        return
+    }
+
+    batch := NewBatch()
+    batch.Put([]byte(cursor.Bucket + "." + cursor.Peer), encodedCursor)
+
+    if err := syncCursors.storageDriver.Batch(batch); err != nil {
+        // The cursor is still kept in memory. The worst that can happen
+        // after a restart is a full merkle sync of the bucket
+        Log.Warningf("Unable to save the sync cursor for peer %s and bucket %s: %v", cursor.Peer, cursor.Bucket, err)
+    }
+}
+
+// Cursor returns a copy of the cursor for this peer and bucket
+func (syncCursors *SyncCursors) Cursor(peerID string, bucket string) SyncCursor {
+    syncCursors.lock.Lock()
+    defer syncCursors.lock.Unlock()
+
+    if _, ok := syncCursors.cursors[peerID][bucket]; !ok {
+        return SyncCursor{ Peer: peerID, Bucket: bucket }
+    }
+
+    cursor := *syncCursors.cursors[peerID][bucket]
+    cursor.Positions = syncCursors.positions(peerID, bucket)
+
+    return cursor
+}
+
+func (syncCursors *SyncCursors) positions(peerID string, bucket string) map[string]uint64 {
+    if _, ok := syncCursors.cursors[peerID][bucket]; !ok {
+        return nil
+    }
+
+    if len(syncCursors.cursors[peerID][bucket].Positions) == 0 {
+        return nil
+    }
+
+    positions := make(map[string]uint64, len(syncCursors.cursors[peerID][bucket].Positions))
+
+    for logID, position := range syncCursors.cursors[peerID][bucket].Positions {
+        positions[logID] = position
+    }
+
+    return positions
+}
+
+// Positions returns a copy of the change log positions known
+// for this peer and bucket
+func (syncCursors *SyncCursors) Positions(peerID string, bucket string) map[string]uint64 {
+    syncCursors.lock.Lock()
+    defer syncCursors.lock.Unlock()
+
+    return syncCursors.positions(peerID, bucket)
+}
+
+// Advance records that every row in the change log below position
+// has been merged into the local bucket
+func (syncCursors *SyncCursors) Advance(peerID string, bucket string, logID string, position uint64) {
+    syncCursors.lock.Lock()
+    defer syncCursors.lock.Unlock()
+
+    cursor := syncCursors.cursor(peerID, bucket)
+
+    if cursor.Positions == nil {
+        cursor.Positions = make(map[string]uint64)
+    }
+
+    cursor.Positions[logID] = position
+    syncCursors.save(cursor)
+}
+
+// Agree records that both sides reported rootHash as the merkle root of
+// the bucket while the local change log with ID localLogID was at
+// localPosition
+func (syncCursors *SyncCursors) Agree(peerID string, bucket string, rootHash Hash, localLogID string, localPosition uint64) {
+    syncCursors.lock.Lock()
+    defer syncCursors.lock.Unlock()
+
+    cursor := syncCursors.cursor(peerID, bucket)
+    cursor.RootHash = rootHash
+    cursor.LocalLogID = localLogID
+    cursor.LocalPosition = localPosition
+    syncCursors.save(cursor)
+}
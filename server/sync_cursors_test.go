@@ -0,0 +1,89 @@
+package server_test
+//
+ // Copyright (c) 2019 ARM Limited.
+ //
+ // SPDX-License-Identifier: MIT
+ //
+ // Permission is hereby granted, free of charge, to any person obtaining a copy
+ // of this software and associated documentation files (the "Software"), to
+ // deal in the Software without restriction, including without limitation the
+ // rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ // sell copies of the Software, and to permit persons to whom the Software is
+ // furnished to do so, subject to the following conditions:
+ //
+ // The above copyright notice and this permission notice shall be included in all
+ // copies or substantial portions of the Software.
+ //
+ // THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ // IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ // FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ // AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ // LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ // SOFTWARE.
+ //
+
+
+import (
+    . "github.com/armPelionEdge/devicedb/data"
+    . "github.com/armPelionEdge/devicedb/server"
+    . "github.com/armPelionEdge/devicedb/storage"
+    . "github.com/armPelionEdge/devicedb/util"
+
+    . "github.com/onsi/ginkgo"
+    . "github.com/onsi/gomega"
+)
+
+var _ = Describe("SyncCursors", func() {
+    var storageDriver StorageDriver
+
+    BeforeEach(func() {
+        storageDriver = NewLevelDBStorageDriver("/tmp/testdb-" + RandomString(), nil)
+        Expect(storageDriver.Open()).Should(BeNil())
+    })
+
+    AfterEach(func() {
+        storageDriver.Close()
+    })
+
+    It("should return an empty cursor for a peer it has not synced with", func() {
+        syncCursors := NewSyncCursors()
+        cursor := syncCursors.Cursor("peer1", "default")
+
+        Expect(cursor.Positions).Should(BeNil())
+        Expect(cursor.Agreed()).Should(BeFalse())
+    })
+
+    It("should restore the cursors it saved", func() {
+        syncCursors := NewSyncCursors()
+
+        Expect(syncCursors.Load(storageDriver)).Should(BeNil())
+
+        syncCursors.Advance("peer1", "default", "log1", 5)
+        syncCursors.Advance("peer1", "default", "log2", 7)
+        syncCursors.Agree("peer1", "default", NewHash([]byte("root")), "locallog", 3)
+        syncCursors.Advance("peer2", "lww", "log1", 1)
+
+        syncCursors = NewSyncCursors()
+
+        Expect(syncCursors.Load(storageDriver)).Should(BeNil())
+        Expect(syncCursors.Positions("peer1", "default")).Should(Equal(map[string]uint64{ "log1": 5, "log2": 7 }))
+        Expect(syncCursors.Positions("peer2", "lww")).Should(Equal(map[string]uint64{ "log1": 1 }))
+
+        cursor := syncCursors.Cursor("peer1", "default")
+
+        Expect(cursor.Agreed()).Should(BeTrue())
+        Expect(cursor.RootHash).Should(Equal(NewHash([]byte("root"))))
+        Expect(cursor.LocalLogID).Should(Equal("locallog"))
+        Expect(cursor.LocalPosition).Should(Equal(uint64(3)))
+        Expect(syncCursors.Cursor("peer2", "lww").Agreed()).Should(BeFalse())
+    })
+
+    It("should hand out copies of its positions", func() {
+        syncCursors := NewSyncCursors()
+        syncCursors.Advance("peer1", "default", "log1", 5)
+        syncCursors.Cursor("peer1", "default").Positions["log1"] = 10
+
+        Expect(syncCursors.Positions("peer1", "default")).Should(Equal(map[string]uint64{ "log1": 5 }))
+    })
+})
@@ -0,0 +1,438 @@
+package server
+//
+ // Copyright (c) 2019 ARM Limited.
+ //
+ // SPDX-License-Identifier: MIT
+ //
+ // Permission is hereby granted, free of charge, to any person obtaining a copy
+ // of this software and associated documentation files (the "Software"), to
+ // deal in the Software without restriction, including without limitation the
+ // rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ // sell copies of the Software, and to permit persons to whom the Software is
+ // furnished to do so, subject to the following conditions:
+ //
+ // The above copyright notice and this permission notice shall be included in all
+ // copies or substantial portions of the Software.
+ //
+ // THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ // IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ // FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ // AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ // LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ // SOFTWARE.
+ //
+
+
+import (
+    "bytes"
+    "compress/flate"
+    "encoding/json"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "sort"
+    "sync"
+
+    "github.com/gorilla/websocket"
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+// Optional features of the sync transport. Each peer announces the
+// features it understands in a SYNC_HELLO message as soon as the
+// connection is established. A feature is only used once the other side
+// has announced it as well, so peers that predate the hello message,
+// which ignore it, keep receiving one uncompressed JSON message per frame
+const (
+    SYNC_CAPABILITY_DEFLATE = "deflate"
+    SYNC_CAPABILITY_BATCH = "batch"
+    // The peer understands SYNC_SITE_ROSTER messages
+    SYNC_CAPABILITY_ROSTER = "roster"
+    // The peer acknowledges pushes that carry an ID
+    SYNC_CAPABILITY_ACK = "ack"
+    // The peer understands SYNC_RELAY_SCOPE messages
+    SYNC_CAPABILITY_SCOPE = "scope"
+)
+
+// Sent to a peer whose supported protocol versions don't overlap with
+// those of this node
+const SYNC_CLOSE_UNSUPPORTED_PROTOCOL = 4001
+
+// Frames smaller than this are sent as is since deflate rarely shrinks them
+const SYNC_COMPRESSION_MIN_BYTES = 256
+// The most messages that will be coalesced into a single frame
+const SYNC_BATCH_MAX_MESSAGES = 64
+// The largest a frame may be once it is decompressed. Peers that send
+// larger ones are disconnected rather than allowed to exhaust memory
+const SYNC_FRAME_MAX_BYTES = 32 * 1024 * 1024
+// The most session messages that wait for bandwidth before further ones
+// are dropped. Sessions that lose a message time out and are retried later
+const SYNC_ANTI_ENTROPY_QUEUE_MAX_MESSAGES = 1024
+
+var localSyncCapabilities = []string{ SYNC_CAPABILITY_DEFLATE, SYNC_CAPABILITY_BATCH, SYNC_CAPABILITY_ROSTER, SYNC_CAPABILITY_ACK, SYNC_CAPABILITY_SCOPE }
+
+var (
+    prometheusSyncBytesSavedCounter = prometheus.NewCounter(prometheus.CounterOpts{
+        Namespace: "relays",
+        Subsystem: "devicedb_internal",
+        Name: "sync_compression_bytes_saved",
+        Help: "The number of bytes saved by compressing sync frames",
+    })
+
+    prometheusSyncMessagesSupersededCounter = prometheus.NewCounter(prometheus.CounterOpts{
+        Namespace: "relays",
+        Subsystem: "devicedb_internal",
+        Name: "sync_messages_superseded",
+        Help: "The number of pushes and push acknowledgements replaced by a newer one for the same key before they were sent",
+    })
+
+    prometheusSyncMessagesCoalescedCounter = prometheus.NewCounter(prometheus.CounterOpts{
+        Namespace: "relays",
+        Subsystem: "devicedb_internal",
+        Name: "sync_messages_coalesced",
+        Help: "The number of sync messages that shared a frame with a preceding message",
+    })
+
+    prometheusSyncMessagesDroppedCounter = prometheus.NewCounter(prometheus.CounterOpts{
+        Namespace: "relays",
+        Subsystem: "devicedb_internal",
+        Name: "sync_messages_dropped",
+        Help: "The number of sync messages dropped because too many were waiting for bandwidth",
+    })
+)
+
+func init() {
+    prometheus.MustRegister(prometheusSyncBytesSavedCounter, prometheusSyncMessagesSupersededCounter, prometheusSyncMessagesCoalescedCounter, prometheusSyncMessagesDroppedCounter)
+}
+
+type Hello struct {
+    MinProtocolVersion uint
+    MaxProtocolVersion uint
+    Capabilities []string
+    // The LAN address, host:port, at which a relay accepts sync
+    // connections from the other relays in its site. Empty if the relay
+    // doesn't take part in the site mesh
+    Address string `json:",omitempty"`
+}
+
+// Picks the highest protocol version supported by both this node and a
+// peer that sent hello
+func negotiateProtocolVersion(hello Hello) (uint, error) {
+    version := PROTOCOL_VERSION
+
+    if hello.MaxProtocolVersion < version {
+        version = hello.MaxProtocolVersion
+    }
+
+    if version < MIN_PROTOCOL_VERSION || version < hello.MinProtocolVersion {
+        return 0, fmt.Errorf("Peer supports protocol versions %d to %d but this node supports versions %d to %d", hello.MinProtocolVersion, hello.MaxProtocolVersion, MIN_PROTOCOL_VERSION, PROTOCOL_VERSION)
+    }
+
+    return version, nil
+}
+
+// Only the messages that make up the bulk of a sync session are coalesced.
+// Anything else is written in its own frame
+func isBatchable(msg *SyncMessageWrapper) bool {
+    switch msg.MessageType {
+    case SYNC_OBJECT_NEXT, SYNC_PUSH_MESSAGE, SYNC_NODE_HASH, SYNC_PUSH_ACK:
+        return true
+    }
+
+    return false
+}
+
+// Reads any messages that are already waiting on outgoing without
+// blocking, up to SYNC_BATCH_MAX_MESSAGES in total. open is false if
+// outgoing was closed
+func drainMessages(pending []*SyncMessageWrapper, outgoing chan *SyncMessageWrapper) (drained []*SyncMessageWrapper, open bool) {
+    for len(pending) < SYNC_BATCH_MAX_MESSAGES {
+        select {
+        case msg, ok := <-outgoing:
+            if !ok {
+                return pending, false
+            }
+
+            pending = append(pending, msg)
+        default:
+            return pending, true
+        }
+    }
+
+    return pending, true
+}
+
+// Pushes broadcast as soon as an update happens take precedence over the
+// traffic of background sync sessions. So do their acknowledgements since
+// a push that isn't acknowledged in time is sent again. Hellos, rosters
+// and scopes are small and the connection is of little use until they arrive
+func bandwidthPriority(msg *SyncMessageWrapper) int {
+    return messageBandwidthPriority(msg.MessageType, msg.Direction)
+}
+
+func messageBandwidthPriority(messageType int, direction uint) int {
+    if direction == PUSH && (messageType == SYNC_PUSH_MESSAGE || messageType == SYNC_PUSH_ACK || messageType == SYNC_HELLO || messageType == SYNC_SITE_ROSTER || messageType == SYNC_RELAY_SCOPE) {
+        return BANDWIDTH_PRIORITY_LIVE
+    }
+
+    return BANDWIDTH_PRIORITY_ANTI_ENTROPY
+}
+
+// The priority that a received frame is counted against the bandwidth
+// budget with, following the same rules as frames that are sent
+func receivedFramePriority(frame []rawSyncMessageWrapper) int {
+    priority := BANDWIDTH_PRIORITY_ANTI_ENTROPY
+
+    for _, msg := range frame {
+        if messageBandwidthPriority(msg.MessageType, msg.Direction) < priority {
+            priority = messageBandwidthPriority(msg.MessageType, msg.Direction)
+        }
+    }
+
+    return priority
+}
+
+func framePriority(frame []*SyncMessageWrapper) int {
+    priority := BANDWIDTH_PRIORITY_ANTI_ENTROPY
+
+    for _, msg := range frame {
+        if bandwidthPriority(msg) < priority {
+            priority = bandwidthPriority(msg)
+        }
+    }
+
+    return priority
+}
+
+// A FrameQueue holds outgoing messages of one priority until the writer for
+// that priority gets bandwidth to send them. Each priority has its own
+// queue and writer so that session traffic held back by the bandwidth
+// governor never delays live pushes. Pushing never blocks. A push or push
+// acknowledgement replaces the one for the same key that is still waiting
+// so a throttled link only ever holds the latest value of each key. A
+// queue with a limit drops messages that arrive while it is full
+type FrameQueue struct {
+    lock sync.Mutex
+    messages []*SyncMessageWrapper
+    queuedKeys map[frameQueueKey]int
+    limit int
+    ready chan bool
+}
+
+type frameQueueKey struct {
+    messageType int
+    bucket string
+    key string
+}
+
+func NewFrameQueue(limit int) *FrameQueue {
+    return &FrameQueue{
+        queuedKeys: make(map[frameQueueKey]int),
+        limit: limit,
+        ready: make(chan bool, 1),
+    }
+}
+
+// Push adds messages to the queue and returns how many of them had to be
+// dropped because the queue is full
+func (queue *FrameQueue) Push(messages ...*SyncMessageWrapper) int {
+    queue.lock.Lock()
+    defer queue.lock.Unlock()
+
+    dropped := 0
+
+    for _, msg := range messages {
+        key, keyed := frameQueueKeyOf(msg)
+
+        if keyed {
+            if i, ok := queue.queuedKeys[key]; ok {
+                queue.messages[i] = msg
+                prometheusSyncMessagesSupersededCounter.Inc()
+
+                continue
+            }
+        }
+
+        if queue.limit > 0 && len(queue.messages) >= queue.limit {
+            dropped++
+
+            continue
+        }
+
+        if keyed {
+            queue.queuedKeys[key] = len(queue.messages)
+        }
+
+        queue.messages = append(queue.messages, msg)
+    }
+
+    if len(queue.messages) > 0 {
+        select {
+        case queue.ready <- true:
+        default:
+        }
+    }
+
+    return dropped
+}
+
+// Len returns the number of messages waiting in the queue
+func (queue *FrameQueue) Len() int {
+    queue.lock.Lock()
+    defer queue.lock.Unlock()
+
+    return len(queue.messages)
+}
+
+// Ready receives a value once messages are waiting in the queue
+func (queue *FrameQueue) Ready() <-chan bool {
+    return queue.ready
+}
+
+// Pop removes and returns every message waiting in the queue
+func (queue *FrameQueue) Pop() []*SyncMessageWrapper {
+    queue.lock.Lock()
+    defer queue.lock.Unlock()
+
+    messages := queue.messages
+    queue.messages = nil
+    queue.queuedKeys = make(map[frameQueueKey]int)
+
+    return messages
+}
+
+// Pushes and their acknowledgements are keyed by the bucket and key they
+// are for. Replacing one that is waiting with a newer one is safe since
+// pushes of the same key merge regardless of order and an acknowledgement
+// for a replaced push is ignored by the sender
+func frameQueueKeyOf(msg *SyncMessageWrapper) (frameQueueKey, bool) {
+    if msg.Direction != PUSH {
+        return frameQueueKey{ }, false
+    }
+
+    switch body := msg.MessageBody.(type) {
+    case PushMessage:
+        return frameQueueKey{ messageType: msg.MessageType, bucket: body.Bucket, key: body.Key }, true
+    case PushAck:
+        return frameQueueKey{ messageType: msg.MessageType, bucket: body.Bucket, key: body.Key }, true
+    }
+
+    return frameQueueKey{ }, false
+}
+
+// Splits pending messages into the frames they will be written in. Live
+// pushes are moved ahead of session messages. Reordering is safe since a
+// session never has more than one message in flight and pushes of the
+// same key merge regardless of order. If batch is true consecutive
+// batchable messages of the same priority share a frame
+func frameMessages(pending []*SyncMessageWrapper, batch bool) [][]*SyncMessageWrapper {
+    sort.SliceStable(pending, func(i, j int) bool {
+        return bandwidthPriority(pending[i]) < bandwidthPriority(pending[j])
+    })
+
+    frames := make([][]*SyncMessageWrapper, 0, len(pending))
+
+    for _, msg := range pending {
+        if batch && len(frames) > 0 {
+            last := frames[len(frames) - 1]
+
+            if isBatchable(last[0]) && isBatchable(msg) && bandwidthPriority(last[0]) == bandwidthPriority(msg) {
+                frames[len(frames) - 1] = append(last, msg)
+
+                continue
+            }
+        }
+
+        frames = append(frames, []*SyncMessageWrapper{ msg })
+    }
+
+    return frames
+}
+
+// Encodes a frame as either a single JSON message or, if it contains more
+// than one message, a JSON array of messages. Binary frames hold the same
+// encoding compressed with deflate
+func encodeFrame(frame []*SyncMessageWrapper, compress bool) (int, []byte, error) {
+    var encoded []byte
+    var err error
+
+    if len(frame) == 1 {
+        encoded, err = json.Marshal(frame[0])
+    } else {
+        encoded, err = json.Marshal(frame)
+    }
+
+    if err != nil {
+        return 0, nil, err
+    }
+
+    if !compress || len(encoded) < SYNC_COMPRESSION_MIN_BYTES {
+        return websocket.TextMessage, encoded, nil
+    }
+
+    var compressed bytes.Buffer
+    writer, _ := flate.NewWriter(&compressed, flate.DefaultCompression)
+
+    if _, err := writer.Write(encoded); err != nil {
+        return 0, nil, err
+    }
+
+    if err := writer.Close(); err != nil {
+        return 0, nil, err
+    }
+
+    if compressed.Len() >= len(encoded) {
+        return websocket.TextMessage, encoded, nil
+    }
+
+    prometheusSyncBytesSavedCounter.Add(float64(len(encoded) - compressed.Len()))
+
+    return websocket.BinaryMessage, compressed.Bytes(), nil
+}
+
+// The number of bytes of a frame attributed to each of the messages it
+// holds. Messages of a compressed frame can't be told apart on the wire
+// so the frame is split evenly between them
+func frameShare(frameSize int, messages int) int {
+    if messages == 0 {
+        return 0
+    }
+
+    return frameSize / messages
+}
+
+func decodeFrame(messageType int, data []byte) ([]rawSyncMessageWrapper, error) {
+    if messageType == websocket.BinaryMessage {
+        decompressed, err := ioutil.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(data)), SYNC_FRAME_MAX_BYTES + 1))
+
+        if err != nil {
+            return nil, err
+        }
+
+        if len(decompressed) > SYNC_FRAME_MAX_BYTES {
+            return nil, fmt.Errorf("Frame is larger than %d bytes once decompressed", SYNC_FRAME_MAX_BYTES)
+        }
+
+        data = bytes.TrimSpace(decompressed)
+    } else {
+        data = bytes.TrimSpace(data)
+    }
+
+    if len(data) > 0 && data[0] == '[' {
+        var messages []rawSyncMessageWrapper
+
+        if err := json.Unmarshal(data, &messages); err != nil {
+            return nil, err
+        }
+
+        return messages, nil
+    }
+
+    var message rawSyncMessageWrapper
+
+    if err := json.Unmarshal(data, &message); err != nil {
+        return nil, err
+    }
+
+    return []rawSyncMessageWrapper{ message }, nil
+}
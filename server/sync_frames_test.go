@@ -0,0 +1,96 @@
+package server_test
+//
+ // Copyright (c) 2019 ARM Limited.
+ //
+ // SPDX-License-Identifier: MIT
+ //
+ // Permission is hereby granted, free of charge, to any person obtaining a copy
+ // of this software and associated documentation files (the "Software"), to
+ // deal in the Software without restriction, including without limitation the
+ // rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ // sell copies of the Software, and to permit persons to whom the Software is
+ // furnished to do so, subject to the following conditions:
+ //
+ // The above copyright notice and this permission notice shall be included in all
+ // copies or substantial portions of the Software.
+ //
+ // THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ // IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ // FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ // AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ // LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ // SOFTWARE.
+ //
+import (
+    . "github.com/armPelionEdge/devicedb/server"
+    . "github.com/armPelionEdge/devicedb/data"
+
+    . "github.com/onsi/ginkgo"
+    . "github.com/onsi/gomega"
+)
+
+var _ = Describe("FrameQueue", func() {
+    message := func(sessionID uint) *SyncMessageWrapper {
+        return &SyncMessageWrapper{ SessionID: sessionID, MessageType: SYNC_NODE_HASH, Direction: REQUEST }
+    }
+
+    It("should signal that messages are ready without blocking the pusher", func() {
+        queue := NewFrameQueue(0)
+
+        Expect(queue.Push(message(1))).Should(Equal(0))
+        Expect(queue.Push(message(2), message(3))).Should(Equal(0))
+        Eventually(queue.Ready()).Should(Receive())
+        Consistently(queue.Ready()).ShouldNot(Receive())
+
+        messages := queue.Pop()
+
+        Expect(messages).Should(HaveLen(3))
+        Expect(messages[0].SessionID).Should(Equal(uint(1)))
+        Expect(messages[2].SessionID).Should(Equal(uint(3)))
+        Expect(queue.Pop()).Should(BeEmpty())
+    })
+
+    It("should drop messages that arrive while the queue is full", func() {
+        queue := NewFrameQueue(2)
+
+        Expect(queue.Push(message(1))).Should(Equal(0))
+        Expect(queue.Push(message(2), message(3), message(4))).Should(Equal(2))
+        Expect(queue.Push(message(5))).Should(Equal(1))
+
+        messages := queue.Pop()
+
+        Expect(messages).Should(HaveLen(2))
+        Expect(messages[0].SessionID).Should(Equal(uint(1)))
+        Expect(messages[1].SessionID).Should(Equal(uint(2)))
+        Expect(queue.Push(message(6))).Should(Equal(0))
+    })
+
+    It("should replace a waiting push or acknowledgement with a newer one for the same key", func() {
+        push := func(key string, value string) *SyncMessageWrapper {
+            return &SyncMessageWrapper{ MessageType: SYNC_PUSH_MESSAGE, MessageBody: PushMessage{ Bucket: "default", Key: key, Value: NewSiblingSet(map[*Sibling]bool{ NewSibling(NewDVV(NewDot("r1", 1), map[string]uint64{ }), []byte(value), 0): true }) }, Direction: PUSH }
+        }
+
+        ack := func(key string, id uint64) *SyncMessageWrapper {
+            return &SyncMessageWrapper{ MessageType: SYNC_PUSH_ACK, MessageBody: PushAck{ Bucket: "default", Key: key, ID: id }, Direction: PUSH }
+        }
+
+        queue := NewFrameQueue(3)
+
+        Expect(queue.Push(push("key1", "a"), push("key2", "a"), ack("key1", 1))).Should(Equal(0))
+        Expect(queue.Push(push("key1", "b"), ack("key1", 2), push("key2", "b"))).Should(Equal(0))
+        Expect(queue.Len()).Should(Equal(3))
+
+        messages := queue.Pop()
+
+        Expect(messages).Should(HaveLen(3))
+        Expect(messages[0].MessageBody.(PushMessage).Key).Should(Equal("key1"))
+        Expect(messages[0].MessageBody.(PushMessage).Value.Value()).Should(Equal([]byte("b")))
+        Expect(messages[1].MessageBody.(PushMessage).Value.Value()).Should(Equal([]byte("b")))
+        Expect(messages[2].MessageBody.(PushAck).ID).Should(Equal(uint64(2)))
+
+        // Keys that were sent are queued again as new messages
+        Expect(queue.Push(push("key1", "c"))).Should(Equal(0))
+        Expect(queue.Pop()).Should(HaveLen(1))
+    })
+})
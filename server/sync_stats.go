@@ -0,0 +1,286 @@
+package server
+//
+ // Copyright (c) 2019 ARM Limited.
+ //
+ // SPDX-License-Identifier: MIT
+ //
+ // Permission is hereby granted, free of charge, to any person obtaining a copy
+ // of this software and associated documentation files (the "Software"), to
+ // deal in the Software without restriction, including without limitation the
+ // rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ // sell copies of the Software, and to permit persons to whom the Software is
+ // furnished to do so, subject to the following conditions:
+ //
+ // The above copyright notice and this permission notice shall be included in all
+ // copies or substantial portions of the Software.
+ //
+ // THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ // IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ // FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ // AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ // LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ // SOFTWARE.
+ //
+
+
+import (
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+// The number of sessions remembered for each peer and bucket
+const SYNC_STATS_HISTORY_SIZE = 10
+
+const (
+    SYNC_ROLE_INITIATOR = "initiator"
+    SYNC_ROLE_RESPONDER = "responder"
+)
+
+const (
+    SYNC_OUTCOME_RUNNING = "running"
+    SYNC_OUTCOME_COMPLETED = "completed"
+    SYNC_OUTCOME_ABORTED = "aborted"
+)
+
+const (
+    SYNC_ABORT_REASON_TIMEOUT = "timed out waiting for peer"
+    SYNC_ABORT_REASON_PEER = "aborted by peer"
+    SYNC_ABORT_REASON_DISCONNECTED = "peer disconnected"
+    SYNC_ABORT_REASON_REDEPTH = "merkle tree depth changed"
+)
+
+var (
+    prometheusSyncSessionsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+        Namespace: "relays",
+        Subsystem: "devicedb_internal",
+        Name: "sync_sessions",
+        Help: "The number of sync sessions that have ended, by role and outcome",
+    }, []string{ "bucket", "role", "outcome" })
+
+    prometheusSyncNodesExploredCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+        Namespace: "relays",
+        Subsystem: "devicedb_internal",
+        Name: "sync_nodes_explored",
+        Help: "The number of merkle nodes compared during sync sessions",
+    }, []string{ "bucket" })
+
+    prometheusSyncKeysCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+        Namespace: "relays",
+        Subsystem: "devicedb_internal",
+        Name: "sync_keys",
+        Help: "The number of keys pushed to or pulled from peers during sync sessions",
+    }, []string{ "bucket", "direction" })
+
+    prometheusSyncSessionBytesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+        Namespace: "relays",
+        Subsystem: "devicedb_internal",
+        Name: "sync_session_bytes",
+        Help: "The number of bytes of sync session messages sent to or received from peers",
+    }, []string{ "bucket", "direction" })
+
+    prometheusSyncLastRootMatchGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+        Namespace: "relays",
+        Subsystem: "devicedb_internal",
+        Name: "sync_last_root_match_timestamp_seconds",
+        Help: "The last time a sync session found this node's merkle root equal to a peer's",
+    }, []string{ "bucket" })
+
+    prometheusSyncSessionDurationHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+        Namespace: "relays",
+        Subsystem: "devicedb_internal",
+        Name: "sync_session_duration_seconds",
+        Help: "How long sync sessions took from start to end, by role and outcome",
+        Buckets: prometheus.ExponentialBuckets(0.01, 4, 8),
+    }, []string{ "bucket", "role", "outcome" })
+)
+
+func init() {
+    prometheus.MustRegister(prometheusSyncSessionsCounter, prometheusSyncNodesExploredCounter, prometheusSyncKeysCounter, prometheusSyncSessionBytesCounter, prometheusSyncLastRootMatchGauge, prometheusSyncSessionDurationHistogram)
+}
+
+// SyncSessionStats describes one sync session with a peer
+type SyncSessionStats struct {
+    SessionID uint `json:"sessionID"`
+    Role string `json:"role"`
+    Start time.Time `json:"start"`
+    End time.Time `json:"end"`
+    Outcome string `json:"outcome"`
+    AbortReason string `json:"abortReason,omitempty"`
+    NodesExplored uint64 `json:"nodesExplored"`
+    KeysPushed uint64 `json:"keysPushed"`
+    KeysPulled uint64 `json:"keysPulled"`
+    BytesSent uint64 `json:"bytesSent"`
+    BytesReceived uint64 `json:"bytesReceived"`
+}
+
+// BucketSyncStats is the recent sync history of one bucket with a peer.
+// Sessions are listed most recent first
+type BucketSyncStats struct {
+    LastRootMatch time.Time `json:"lastRootMatch"`
+    Sessions []SyncSessionStats `json:"sessions"`
+}
+
+// SyncSessionRecord tracks a session that is running or has ended. The
+// counters come first so that they stay 64-bit aligned for atomic access
+// on 32-bit platforms. They are updated by the session as well as by the
+// writer of the peer connection, which may still be sending the last
+// messages of a session after it ended
+type SyncSessionRecord struct {
+    nodesExplored uint64
+    keysPushed uint64
+    keysPulled uint64
+    bytesSent uint64
+    bytesReceived uint64
+    bucket string
+    sessionID uint
+    role string
+    start time.Time
+    end time.Time
+    outcome string
+    abortReason string
+}
+
+func (record *SyncSessionRecord) AddNodesExplored(n uint64) {
+    atomic.AddUint64(&record.nodesExplored, n)
+    prometheusSyncNodesExploredCounter.WithLabelValues(record.bucket).Add(float64(n))
+}
+
+func (record *SyncSessionRecord) AddKeysPushed(n uint64) {
+    atomic.AddUint64(&record.keysPushed, n)
+    prometheusSyncKeysCounter.WithLabelValues(record.bucket, "pushed").Add(float64(n))
+}
+
+func (record *SyncSessionRecord) AddKeysPulled(n uint64) {
+    atomic.AddUint64(&record.keysPulled, n)
+    prometheusSyncKeysCounter.WithLabelValues(record.bucket, "pulled").Add(float64(n))
+}
+
+func (record *SyncSessionRecord) AddBytesSent(n uint64) {
+    atomic.AddUint64(&record.bytesSent, n)
+    prometheusSyncSessionBytesCounter.WithLabelValues(record.bucket, "sent").Add(float64(n))
+}
+
+func (record *SyncSessionRecord) AddBytesReceived(n uint64) {
+    atomic.AddUint64(&record.bytesReceived, n)
+    prometheusSyncSessionBytesCounter.WithLabelValues(record.bucket, "received").Add(float64(n))
+}
+
+type bucketSyncHistory struct {
+    lastRootMatch time.Time
+    sessions []*SyncSessionRecord
+}
+
+// SyncStats keeps the recent sync sessions this node has had with each
+// peer and bucket. History is kept after a peer disconnects so that it
+// is still available when diagnosing why the peer went away
+type SyncStats struct {
+    lock sync.Mutex
+    history map[string]map[string]*bucketSyncHistory
+}
+
+func NewSyncStats() *SyncStats {
+    return &SyncStats{
+        history: make(map[string]map[string]*bucketSyncHistory),
+    }
+}
+
+func (syncStats *SyncStats) bucketHistory(peerID string, bucket string) *bucketSyncHistory {
+    if _, ok := syncStats.history[peerID]; !ok {
+        syncStats.history[peerID] = make(map[string]*bucketSyncHistory)
+    }
+
+    if _, ok := syncStats.history[peerID][bucket]; !ok {
+        syncStats.history[peerID][bucket] = &bucketSyncHistory{ }
+    }
+
+    return syncStats.history[peerID][bucket]
+}
+
+// StartSession records the start of a session with a peer. The returned
+// record is updated as the session progresses and passed to EndSession
+// once it is over
+func (syncStats *SyncStats) StartSession(peerID string, bucket string, sessionID uint, role string) *SyncSessionRecord {
+    syncStats.lock.Lock()
+    defer syncStats.lock.Unlock()
+
+    record := &SyncSessionRecord{
+        bucket: bucket,
+        sessionID: sessionID,
+        role: role,
+        start: time.Now(),
+        outcome: SYNC_OUTCOME_RUNNING,
+    }
+
+    history := syncStats.bucketHistory(peerID, bucket)
+    history.sessions = append([]*SyncSessionRecord{ record }, history.sessions...)
+
+    if len(history.sessions) > SYNC_STATS_HISTORY_SIZE {
+        history.sessions = history.sessions[:SYNC_STATS_HISTORY_SIZE]
+    }
+
+    return record
+}
+
+// EndSession records the outcome of a session. An empty abortReason means
+// the session completed. rootMatch is true if the session found the
+// merkle root of the bucket to be the same on both sides
+func (syncStats *SyncStats) EndSession(peerID string, record *SyncSessionRecord, abortReason string, rootMatch bool) {
+    syncStats.lock.Lock()
+    defer syncStats.lock.Unlock()
+
+    record.end = time.Now()
+    record.abortReason = abortReason
+
+    if abortReason == "" {
+        record.outcome = SYNC_OUTCOME_COMPLETED
+    } else {
+        record.outcome = SYNC_OUTCOME_ABORTED
+    }
+
+    if rootMatch {
+        syncStats.bucketHistory(peerID, record.bucket).lastRootMatch = record.end
+        prometheusSyncLastRootMatchGauge.WithLabelValues(record.bucket).Set(float64(record.end.Unix()))
+    }
+
+    prometheusSyncSessionsCounter.WithLabelValues(record.bucket, record.role, record.outcome).Inc()
+    prometheusSyncSessionDurationHistogram.WithLabelValues(record.bucket, record.role, record.outcome).Observe(record.end.Sub(record.start).Seconds())
+}
+
+// Peer returns the sync history with a peer keyed by bucket
+func (syncStats *SyncStats) Peer(peerID string) map[string]BucketSyncStats {
+    syncStats.lock.Lock()
+    defer syncStats.lock.Unlock()
+
+    buckets := make(map[string]BucketSyncStats, len(syncStats.history[peerID]))
+
+    for bucket, history := range syncStats.history[peerID] {
+        bucketStats := BucketSyncStats{
+            LastRootMatch: history.lastRootMatch,
+            Sessions: make([]SyncSessionStats, 0, len(history.sessions)),
+        }
+
+        for _, record := range history.sessions {
+            bucketStats.Sessions = append(bucketStats.Sessions, SyncSessionStats{
+                SessionID: record.sessionID,
+                Role: record.role,
+                Start: record.start,
+                End: record.end,
+                Outcome: record.outcome,
+                AbortReason: record.abortReason,
+                NodesExplored: atomic.LoadUint64(&record.nodesExplored),
+                KeysPushed: atomic.LoadUint64(&record.keysPushed),
+                KeysPulled: atomic.LoadUint64(&record.keysPulled),
+                BytesSent: atomic.LoadUint64(&record.bytesSent),
+                BytesReceived: atomic.LoadUint64(&record.bytesReceived),
+            })
+        }
+
+        buckets[bucket] = bucketStats
+    }
+
+    return buckets
+}
@@ -0,0 +1,121 @@
+package server_test
+//
+ // Copyright (c) 2019 ARM Limited.
+ //
+ // SPDX-License-Identifier: MIT
+ //
+ // Permission is hereby granted, free of charge, to any person obtaining a copy
+ // of this software and associated documentation files (the "Software"), to
+ // deal in the Software without restriction, including without limitation the
+ // rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ // sell copies of the Software, and to permit persons to whom the Software is
+ // furnished to do so, subject to the following conditions:
+ //
+ // The above copyright notice and this permission notice shall be included in all
+ // copies or substantial portions of the Software.
+ //
+ // THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ // IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ // FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ // AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ // LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ // SOFTWARE.
+ //
+
+
+import (
+    "time"
+
+    . "github.com/armPelionEdge/devicedb/server"
+
+    . "github.com/onsi/ginkgo"
+    . "github.com/onsi/gomega"
+)
+
+var _ = Describe("SyncStats", func() {
+    var syncStats *SyncStats
+
+    BeforeEach(func() {
+        syncStats = NewSyncStats()
+    })
+
+    It("should be empty for a peer it has not synced with", func() {
+        Expect(syncStats.Peer("peer1")).Should(BeEmpty())
+    })
+
+    It("should record a running session", func() {
+        record := syncStats.StartSession("peer1", "default", 1, SYNC_ROLE_INITIATOR)
+        record.AddNodesExplored(3)
+        record.AddKeysPulled(2)
+        record.AddBytesSent(100)
+        record.AddBytesReceived(200)
+
+        stats := syncStats.Peer("peer1")
+
+        Expect(stats).Should(HaveKey("default"))
+        Expect(stats["default"].Sessions).Should(HaveLen(1))
+
+        session := stats["default"].Sessions[0]
+
+        Expect(session.SessionID).Should(Equal(uint(1)))
+        Expect(session.Role).Should(Equal(SYNC_ROLE_INITIATOR))
+        Expect(session.Outcome).Should(Equal(SYNC_OUTCOME_RUNNING))
+        Expect(session.Start).ShouldNot(BeZero())
+        Expect(session.End).Should(BeZero())
+        Expect(session.NodesExplored).Should(Equal(uint64(3)))
+        Expect(session.KeysPushed).Should(Equal(uint64(0)))
+        Expect(session.KeysPulled).Should(Equal(uint64(2)))
+        Expect(session.BytesSent).Should(Equal(uint64(100)))
+        Expect(session.BytesReceived).Should(Equal(uint64(200)))
+        Expect(syncStats.Peer("peer2")).Should(BeEmpty())
+    })
+
+    It("should record the outcome of a session once it ends", func() {
+        completed := syncStats.StartSession("peer1", "default", 1, SYNC_ROLE_INITIATOR)
+        syncStats.EndSession("peer1", completed, "", true)
+        aborted := syncStats.StartSession("peer1", "default", 2, SYNC_ROLE_RESPONDER)
+        aborted.AddKeysPushed(1)
+        syncStats.EndSession("peer1", aborted, SYNC_ABORT_REASON_DISCONNECTED, false)
+
+        stats := syncStats.Peer("peer1")["default"]
+
+        Expect(stats.Sessions).Should(HaveLen(2))
+        Expect(stats.Sessions[0].SessionID).Should(Equal(uint(2)))
+        Expect(stats.Sessions[0].Role).Should(Equal(SYNC_ROLE_RESPONDER))
+        Expect(stats.Sessions[0].Outcome).Should(Equal(SYNC_OUTCOME_ABORTED))
+        Expect(stats.Sessions[0].AbortReason).Should(Equal(SYNC_ABORT_REASON_DISCONNECTED))
+        Expect(stats.Sessions[0].KeysPushed).Should(Equal(uint64(1)))
+        Expect(stats.Sessions[1].SessionID).Should(Equal(uint(1)))
+        Expect(stats.Sessions[1].Outcome).Should(Equal(SYNC_OUTCOME_COMPLETED))
+        Expect(stats.Sessions[1].AbortReason).Should(Equal(""))
+        Expect(stats.Sessions[1].End).ShouldNot(BeZero())
+        Expect(stats.LastRootMatch).Should(Equal(stats.Sessions[1].End))
+    })
+
+    It("should keep the last root match when later sessions diverge", func() {
+        matched := syncStats.StartSession("peer1", "default", 1, SYNC_ROLE_INITIATOR)
+        syncStats.EndSession("peer1", matched, "", true)
+        lastRootMatch := syncStats.Peer("peer1")["default"].LastRootMatch
+
+        time.Sleep(time.Millisecond)
+
+        diverged := syncStats.StartSession("peer1", "default", 2, SYNC_ROLE_INITIATOR)
+        syncStats.EndSession("peer1", diverged, "", false)
+
+        Expect(syncStats.Peer("peer1")["default"].LastRootMatch).Should(Equal(lastRootMatch))
+    })
+
+    It("should only remember the most recent sessions", func() {
+        for i := 0; i < SYNC_STATS_HISTORY_SIZE + 5; i++ {
+            record := syncStats.StartSession("peer1", "default", uint(i), SYNC_ROLE_INITIATOR)
+            syncStats.EndSession("peer1", record, "", false)
+        }
+
+        sessions := syncStats.Peer("peer1")["default"].Sessions
+
+        Expect(sessions).Should(HaveLen(SYNC_STATS_HISTORY_SIZE))
+        Expect(sessions[0].SessionID).Should(Equal(uint(SYNC_STATS_HISTORY_SIZE + 4)))
+        Expect(sessions[SYNC_STATS_HISTORY_SIZE - 1].SessionID).Should(Equal(uint(5)))
+    })
+})
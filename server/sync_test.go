@@ -32,6 +32,7 @@ import (
     . "github.com/armPelionEdge/devicedb/util"
     ddbSync "github.com/armPelionEdge/devicedb/sync"
     
+    "fmt"
     "time"
 
     . "github.com/onsi/ginkgo"
@@ -112,6 +113,12 @@ var _ = Describe("Sync", func() {
                     
                     Expect(initiatorStateTransitions).Should(Equal([]int{ }))
                     Expect(responderStateTransitions).Should(Equal([]int{ }))
+                    Expect(initiatorSyncSession.Idle()).Should(BeTrue())
+                    Expect(responderSyncSession.Diverged()).Should(BeFalse())
+                    Expect(initiatorSyncSession.RootMatched()).Should(BeTrue())
+                    Expect(responderSyncSession.RootMatched()).Should(BeTrue())
+                    Expect(initiatorSyncSession.AbortReason()).Should(Equal(""))
+                    Expect(responderSyncSession.AbortReason()).Should(Equal(""))
                 })
             })
             
@@ -154,6 +161,92 @@ var _ = Describe("Sync", func() {
                     }
                     
                     Expect(server1.Buckets().Get("default").MerkleTree().RootHash()).Should(Not(Equal(NewHash([]byte{ }).SetLow(0).SetHigh(0))))
+                    Expect(initiatorSyncSession.Idle()).Should(BeFalse())
+                    Expect(responderSyncSession.Diverged()).Should(BeTrue())
+                    Expect(initiatorSyncSession.RootMatched()).Should(BeFalse())
+                    Expect(initiatorSyncSession.AbortReason()).Should(Equal(""))
+                    Expect(responderSyncSession.AbortReason()).Should(Equal(""))
+                })
+            })
+            
+            Context("A node speaking the current protocol syncs with a peer that only speaks the oldest supported version", func() {
+                // Older peers abort any session whose SYNC_START doesn't carry
+                // exactly their version
+                checkStart := func(message *SyncMessageWrapper) {
+                    if message != nil && message.MessageType == SYNC_START {
+                        Expect(message.MessageBody.(Start).ProtocolVersion).Should(Equal(MIN_PROTOCOL_VERSION))
+                    }
+                }
+
+                It("should transfer the object when the node initiates the session", func() {
+                    updateBatch := NewUpdateBatch()
+                    updateBatch.Put([]byte("OBJ1"), []byte("hello"), NewDVV(NewDot("", 0), map[string]uint64{ }))
+                    _, err := server2.Buckets().Get("default").Batch(updateBatch)
+                    
+                    Expect(err).Should(BeNil())
+                    
+                    var message *SyncMessageWrapper = nil
+                    direction := 0
+                    
+                    initiatorSyncSession := NewInitiatorSyncSession(123, server1BucketProxy, MERKLE_EXPLORATION_PATH_LIMIT, true)
+                    initiatorSyncSession.SetProtocolVersion(MIN_PROTOCOL_VERSION)
+                    responderSyncSession := NewResponderSyncSession(server2BucketProxy)
+                    responderSyncSession.SetProtocolVersion(MIN_PROTOCOL_VERSION)
+                    
+                    for initiatorSyncSession.State() != END || responderSyncSession.State() != END {
+                        if direction == 0 {
+                            message = initiatorSyncSession.NextState(message)
+                            direction = 1
+                        } else {
+                            message = responderSyncSession.NextState(message)
+                            direction = 0
+                        }
+
+                        checkStart(message)
+                    }
+                    
+                    siblingSets, err := server1.Buckets().Get("default").Get([][]byte{ []byte("OBJ1") })
+                    
+                    Expect(err).Should(BeNil())
+                    Expect(siblingSets[0].Value()).Should(Equal([]byte("hello")))
+                    Expect(initiatorSyncSession.AbortReason()).Should(Equal(""))
+                    Expect(responderSyncSession.AbortReason()).Should(Equal(""))
+                })
+
+                It("should transfer the object when the peer initiates the session", func() {
+                    updateBatch := NewUpdateBatch()
+                    updateBatch.Put([]byte("OBJ1"), []byte("hello"), NewDVV(NewDot("", 0), map[string]uint64{ }))
+                    _, err := server2.Buckets().Get("default").Batch(updateBatch)
+                    
+                    Expect(err).Should(BeNil())
+                    
+                    var message *SyncMessageWrapper = nil
+                    direction := 0
+                    
+                    initiatorSyncSession := NewInitiatorSyncSession(123, server1BucketProxy, MERKLE_EXPLORATION_PATH_LIMIT, true)
+                    initiatorSyncSession.SetProtocolVersion(MIN_PROTOCOL_VERSION)
+                    // The peer's hello has not been seen yet so the node
+                    // still assumes the current version
+                    responderSyncSession := NewResponderSyncSession(server2BucketProxy)
+                    
+                    for initiatorSyncSession.State() != END || responderSyncSession.State() != END {
+                        if direction == 0 {
+                            message = initiatorSyncSession.NextState(message)
+                            direction = 1
+                        } else {
+                            message = responderSyncSession.NextState(message)
+                            direction = 0
+                        }
+
+                        checkStart(message)
+                    }
+                    
+                    siblingSets, err := server1.Buckets().Get("default").Get([][]byte{ []byte("OBJ1") })
+                    
+                    Expect(err).Should(BeNil())
+                    Expect(siblingSets[0].Value()).Should(Equal([]byte("hello")))
+                    Expect(initiatorSyncSession.AbortReason()).Should(Equal(""))
+                    Expect(responderSyncSession.AbortReason()).Should(Equal(""))
                 })
             })
             
@@ -221,6 +314,194 @@ var _ = Describe("Sync", func() {
                     }
                 })
             })
+
+            Context("The initiator has a position in the responder's change log", func() {
+                put := func(b Bucket, key string, value string) {
+                    updateBatch := NewUpdateBatch()
+                    updateBatch.Put([]byte(key), []byte(value), NewDVV(NewDot("", 0), map[string]uint64{ }))
+                    _, err := b.Batch(updateBatch)
+
+                    Expect(err).Should(BeNil())
+                }
+
+                get := func(b Bucket, key string) string {
+                    siblingSets, _ := b.Get([][]byte{ []byte(key) })
+
+                    if siblingSets[0] == nil {
+                        return ""
+                    }
+                    
+                    return string(siblingSets[0].Value())
+                }
+
+                sync := func(logPositions map[string]uint64) (*InitiatorSyncSession, []int) {
+                    var message *SyncMessageWrapper = nil
+                    var initiatorStates []int
+                    direction := 0
+                    
+                    initiatorSyncSession := NewInitiatorSyncSession(123, server1BucketProxy, MERKLE_EXPLORATION_PATH_LIMIT, true)
+                    initiatorSyncSession.SetLogPositions(logPositions)
+                    responderSyncSession := NewResponderSyncSession(server2BucketProxy)
+                    
+                    for initiatorSyncSession.State() != END || responderSyncSession.State() != END {
+                        if direction == 0 {
+                            initiatorStates = append(initiatorStates, initiatorSyncSession.State())
+                            message = initiatorSyncSession.NextState(message)
+                            direction = 1
+                        } else {
+                            message = responderSyncSession.NextState(message)
+                            direction = 0
+                        }
+                    }
+
+                    return initiatorSyncSession, initiatorStates
+                }
+
+                It("should stream only the rows written since that position", func() {
+                    put(server2.Buckets().Get("default"), "OBJ1", "hello")
+
+                    initiatorSyncSession, initiatorStates := sync(nil)
+                    logID, position, ok := initiatorSyncSession.LogPosition()
+
+                    Expect(initiatorStates).Should(ContainElement(ROOT_HASH_COMPARE))
+                    Expect(get(server1.Buckets().Get("default"), "OBJ1")).Should(Equal("hello"))
+                    Expect(ok).Should(BeTrue())
+                    Expect(logID).Should(Equal(server2.Buckets().Get("default").ChangeLogID()))
+                    Expect(position).Should(Equal(uint64(1)))
+
+                    put(server2.Buckets().Get("default"), "OBJ2", "world")
+
+                    initiatorSyncSession, initiatorStates = sync(map[string]uint64{ logID: position })
+                    logID, position, ok = initiatorSyncSession.LogPosition()
+
+                    Expect(initiatorStates).Should(Equal([]int{ START, HANDSHAKE, LOG_OBJECT_PUSH, LOG_OBJECT_PUSH }))
+                    Expect(get(server1.Buckets().Get("default"), "OBJ2")).Should(Equal("world"))
+                    Expect(ok).Should(BeTrue())
+                    Expect(position).Should(Equal(uint64(2)))
+                    Expect(server1.Buckets().Get("default").MerkleTree().RootHash()).Should(Equal(server2.Buckets().Get("default").MerkleTree().RootHash()))
+                })
+
+                It("should fall back to merkle exploration if the position belongs to a different change log", func() {
+                    put(server2.Buckets().Get("default"), "OBJ1", "hello")
+
+                    initiatorSyncSession, initiatorStates := sync(map[string]uint64{ "someotherlog": 1 })
+                    logID, _, ok := initiatorSyncSession.LogPosition()
+
+                    Expect(initiatorStates).Should(ContainElement(ROOT_HASH_COMPARE))
+                    Expect(initiatorStates).ShouldNot(ContainElement(LOG_OBJECT_PUSH))
+                    Expect(get(server1.Buckets().Get("default"), "OBJ1")).Should(Equal("hello"))
+                    Expect(ok).Should(BeTrue())
+                    Expect(logID).Should(Equal(server2.Buckets().Get("default").ChangeLogID()))
+                })
+
+                It("should fall back to merkle exploration if the position is behind the change log horizon", func() {
+                    put(server2.Buckets().Get("default"), "OBJ1", "hello")
+                    updateBatch := NewUpdateBatch()
+                    updateBatch.Delete([]byte("OBJ1"), NewDVV(NewDot("", 0), map[string]uint64{ }))
+                    _, err := server2.Buckets().Get("default").Batch(updateBatch)
+
+                    Expect(err).Should(BeNil())
+
+                    time.Sleep(time.Millisecond * 10)
+
+                    Expect(server2.Buckets().Get("default").GarbageCollect(0)).Should(BeNil())
+
+                    put(server2.Buckets().Get("default"), "OBJ2", "world")
+
+                    _, initiatorStates := sync(map[string]uint64{ server2.Buckets().Get("default").ChangeLogID(): 0 })
+
+                    Expect(initiatorStates).Should(ContainElement(ROOT_HASH_COMPARE))
+                    Expect(initiatorStates).ShouldNot(ContainElement(LOG_OBJECT_PUSH))
+                    Expect(get(server1.Buckets().Get("default"), "OBJ2")).Should(Equal("world"))
+                })
+            })
+
+            Context("The initiator and responder agreed on a root hash before", func() {
+                put := func(b Bucket, key string, value string) {
+                    updateBatch := NewUpdateBatch()
+                    updateBatch.Put([]byte(key), []byte(value), NewDVV(NewDot("", 0), map[string]uint64{ }))
+                    _, err := b.Batch(updateBatch)
+
+                    Expect(err).Should(BeNil())
+                }
+
+                sync := func(cursor *SyncCursor) (*InitiatorSyncSession, []int) {
+                    var message *SyncMessageWrapper = nil
+                    var initiatorStates []int
+                    direction := 0
+                    
+                    initiatorSyncSession := NewInitiatorSyncSession(123, server1BucketProxy, MERKLE_EXPLORATION_PATH_LIMIT, true)
+
+                    if cursor != nil {
+                        initiatorSyncSession.SetAgreement(cursor.RootHash, cursor.LocalLogID, cursor.LocalPosition)
+                    }
+
+                    responderSyncSession := NewResponderSyncSession(server2BucketProxy)
+                    
+                    for initiatorSyncSession.State() != END || responderSyncSession.State() != END {
+                        if direction == 0 {
+                            initiatorStates = append(initiatorStates, initiatorSyncSession.State())
+                            message = initiatorSyncSession.NextState(message)
+                            direction = 1
+                        } else {
+                            message = responderSyncSession.NextState(message)
+                            direction = 0
+                        }
+                    }
+
+                    return initiatorSyncSession, initiatorStates
+                }
+
+                agree := func() *SyncCursor {
+                    sync(nil)
+                    initiatorSyncSession, _ := sync(nil)
+                    rootHash, localLogID, localPosition, ok := initiatorSyncSession.Agreement()
+
+                    Expect(ok).Should(BeTrue())
+                    Expect(rootHash).Should(Equal(server2.Buckets().Get("default").MerkleTree().RootHash()))
+                    Expect(localLogID).Should(Equal(server1.Buckets().Get("default").ChangeLogID()))
+
+                    return &SyncCursor{ RootHash: rootHash, LocalLogID: localLogID, LocalPosition: localPosition }
+                }
+
+                BeforeEach(func() {
+                    put(server2.Buckets().Get("default"), "OBJ1", "hello")
+                })
+
+                It("should only explore the parts of the merkle tree written locally since then if the responder did not change", func() {
+                    cursor := agree()
+
+                    put(server1.Buckets().Get("default"), "OBJ2", "world")
+
+                    initiatorSyncSession, initiatorStates := sync(cursor)
+
+                    Expect(initiatorStates).Should(Equal([]int{ START, HANDSHAKE, ROOT_HASH_COMPARE, DB_OBJECT_PUSH }))
+                    Expect(initiatorSyncSession.AbortReason()).Should(Equal(""))
+                    Expect(initiatorSyncSession.Idle()).Should(BeFalse())
+                })
+
+                It("should explore the whole merkle tree if the responder changed", func() {
+                    cursor := agree()
+
+                    put(server1.Buckets().Get("default"), "OBJ2", "world")
+                    put(server2.Buckets().Get("default"), "OBJ3", "!")
+
+                    _, initiatorStates := sync(cursor)
+
+                    Expect(initiatorStates).Should(ContainElement(LEFT_HASH_COMPARE))
+                })
+
+                It("should explore the whole merkle tree if the agreement belongs to a different change log", func() {
+                    cursor := agree()
+                    cursor.LocalLogID = "someotherlog"
+
+                    put(server1.Buckets().Get("default"), "OBJ2", "world")
+
+                    _, initiatorStates := sync(cursor)
+
+                    Expect(initiatorStates).Should(ContainElement(LEFT_HASH_COMPARE))
+                })
+            })
         })
             
         Context("Initiator has a smaller merkle depth", func() {
@@ -436,6 +717,16 @@ var _ = Describe("Sync", func() {
                 Expect(initiatorSyncSession.State()).Should(Equal(HANDSHAKE))
             })
             
+            It("START -> HANDSHAKE announces the protocol version negotiated with the peer", func() {
+                initiatorSyncSession := NewInitiatorSyncSession(123, server1BucketProxy, MERKLE_EXPLORATION_PATH_LIMIT, true)
+                initiatorSyncSession.SetProtocolVersion(MIN_PROTOCOL_VERSION)
+                
+                req := initiatorSyncSession.NextState(nil)
+                
+                Expect(req.MessageType).Should(Equal(SYNC_START))
+                Expect(req.MessageBody.(Start).ProtocolVersion).Should(Equal(MIN_PROTOCOL_VERSION))
+            })
+            
             It("HANDSHAKE -> ROOT_HASH_COMPARE", func() {
                 initiatorSyncSession := NewInitiatorSyncSession(123, server1BucketProxy, MERKLE_EXPLORATION_PATH_LIMIT, true)
                 
@@ -464,6 +755,45 @@ var _ = Describe("Sync", func() {
                 Expect(initiatorSyncSession.PeekExplorationQueue()).Should(Equal(server1.Buckets().Get("default").MerkleTree().RootNode()))
             })
             
+            It("HANDSHAKE -> ROOT_HASH_COMPARE responder at an older supported protocol version", func() {
+                initiatorSyncSession := NewInitiatorSyncSession(123, server1BucketProxy, MERKLE_EXPLORATION_PATH_LIMIT, true)
+                
+                initiatorSyncSession.SetState(HANDSHAKE)
+                
+                req := initiatorSyncSession.NextState(&SyncMessageWrapper{
+                    SessionID: 123,
+                    MessageType: SYNC_START,
+                    MessageBody: Start{
+                        ProtocolVersion: MIN_PROTOCOL_VERSION,
+                        MerkleDepth: 50,
+                        Bucket: "default",
+                    },
+                })
+                
+                Expect(req.MessageType).Should(Equal(SYNC_NODE_HASH))
+                Expect(initiatorSyncSession.State()).Should(Equal(ROOT_HASH_COMPARE))
+            })
+            
+            It("HANDSHAKE -> END unsupported protocol version", func() {
+                initiatorSyncSession := NewInitiatorSyncSession(123, server1BucketProxy, MERKLE_EXPLORATION_PATH_LIMIT, true)
+                
+                initiatorSyncSession.SetState(HANDSHAKE)
+                
+                req := initiatorSyncSession.NextState(&SyncMessageWrapper{
+                    SessionID: 123,
+                    MessageType: SYNC_START,
+                    MessageBody: Start{
+                        ProtocolVersion: PROTOCOL_VERSION + 1,
+                        MerkleDepth: 50,
+                        Bucket: "default",
+                    },
+                })
+                
+                Expect(req.MessageType).Should(Equal(SYNC_ABORT))
+                Expect(initiatorSyncSession.State()).Should(Equal(END))
+                Expect(initiatorSyncSession.AbortReason()).Should(Equal(fmt.Sprintf("unsupported protocol version %d", PROTOCOL_VERSION + 1)))
+            })
+            
             It("HANDSHAKE -> END nil message", func() {
                 initiatorSyncSession := NewInitiatorSyncSession(123, server1BucketProxy, MERKLE_EXPLORATION_PATH_LIMIT, true)
                 
@@ -475,6 +805,7 @@ var _ = Describe("Sync", func() {
                 Expect(req.MessageType).Should(Equal(SYNC_ABORT))
                 Expect(initiatorSyncSession.State()).Should(Equal(END))
                 Expect(initiatorSyncSession.ResponderDepth()).Should(Equal(uint8(0)))
+                Expect(initiatorSyncSession.AbortReason()).Should(Equal(SYNC_ABORT_REASON_TIMEOUT))
             })
             
             It("HANDSHAKE -> END non nil message", func() {
@@ -496,6 +827,7 @@ var _ = Describe("Sync", func() {
                 Expect(req.MessageType).Should(Equal(SYNC_ABORT))
                 Expect(initiatorSyncSession.State()).Should(Equal(END))
                 Expect(initiatorSyncSession.ResponderDepth()).Should(Equal(uint8(0)))
+                Expect(initiatorSyncSession.AbortReason()).Should(Equal("unexpected SYNC_PUSH_MESSAGE message"))
             })
             
             It("ROOT_HASH_COMPARE -> END nil message", func() {
@@ -551,6 +883,9 @@ var _ = Describe("Sync", func() {
                 Expect(req.SessionID).Should(Equal(uint(123)))
                 Expect(req.MessageType).Should(Equal(SYNC_ABORT))
                 Expect(initiatorSyncSession.State()).Should(Equal(END))
+                Expect(initiatorSyncSession.Idle()).Should(BeTrue())
+                Expect(initiatorSyncSession.RootMatched()).Should(BeTrue())
+                Expect(initiatorSyncSession.AbortReason()).Should(Equal(""))
             })
             
             It("ROOT_HASH_COMPARE -> LEFT_HASH_COMPARE", func() {
@@ -581,6 +916,7 @@ var _ = Describe("Sync", func() {
                 Expect(req.MessageBody.(MerkleNodeHash).HashHigh).Should(Equal(rootNodeLeftChildHash.High()))
                 Expect(req.MessageBody.(MerkleNodeHash).HashLow).Should(Equal(rootNodeLeftChildHash.Low()))
                 Expect(initiatorSyncSession.State()).Should(Equal(LEFT_HASH_COMPARE))
+                Expect(initiatorSyncSession.Idle()).Should(BeFalse())
             })
             
             It("ROOT_HASH_COMPARE -> DB_OBJECT_PUSH", func() {
@@ -1015,6 +1351,7 @@ var _ = Describe("Sync", func() {
                 Expect(req.SessionID).Should(Equal(uint(0)))
                 Expect(req.MessageType).Should(Equal(SYNC_ABORT))
                 Expect(responderSyncSession.State()).Should(Equal(END))
+                Expect(responderSyncSession.AbortReason()).Should(Equal(SYNC_ABORT_REASON_TIMEOUT))
             })
             
             It("START -> END non nil message", func() {
@@ -1057,6 +1394,45 @@ var _ = Describe("Sync", func() {
                 Expect(responderSyncSession.InitiatorDepth()).Should(Equal(uint8(10)))
             })
             
+            It("START -> HASH_COMPARE initiator at an older supported protocol version", func() {
+                responderSyncSession := NewResponderSyncSession(server1BucketProxy)
+                
+                responderSyncSession.SetState(START)
+                
+                req := responderSyncSession.NextState(&SyncMessageWrapper{
+                    SessionID: 123,
+                    MessageType: SYNC_START,
+                    MessageBody: Start{
+                        ProtocolVersion: MIN_PROTOCOL_VERSION,
+                        MerkleDepth: 10,
+                        Bucket: "default",
+                    },
+                })
+                
+                Expect(req.MessageType).Should(Equal(SYNC_START))
+                Expect(req.MessageBody.(Start).ProtocolVersion).Should(Equal(MIN_PROTOCOL_VERSION))
+                Expect(responderSyncSession.State()).Should(Equal(HASH_COMPARE))
+            })
+            
+            It("START -> END unsupported protocol version", func() {
+                responderSyncSession := NewResponderSyncSession(server1BucketProxy)
+                
+                responderSyncSession.SetState(START)
+                
+                req := responderSyncSession.NextState(&SyncMessageWrapper{
+                    SessionID: 123,
+                    MessageType: SYNC_START,
+                    MessageBody: Start{
+                        ProtocolVersion: MIN_PROTOCOL_VERSION - 1,
+                        MerkleDepth: 10,
+                        Bucket: "default",
+                    },
+                })
+                
+                Expect(req.MessageType).Should(Equal(SYNC_ABORT))
+                Expect(responderSyncSession.State()).Should(Equal(END))
+            })
+            
             It("HASH_COMPARE -> END nil message", func() {
                 responderSyncSession := NewResponderSyncSession(server1BucketProxy)
                 
@@ -1196,6 +1572,8 @@ var _ = Describe("Sync", func() {
                 Expect(req.SessionID).Should(Equal(uint(0)))
                 Expect(req.MessageType).Should(Equal(SYNC_ABORT))
                 Expect(responderSyncSession.State()).Should(Equal(END))
+                // The initiator ends every session this way
+                Expect(responderSyncSession.AbortReason()).Should(Equal(""))
             })
         })
     })
@@ -30,7 +30,10 @@ import (
     "errors"
     "fmt"
     "gopkg.in/yaml.v2"
+    "net"
+    "path"
     "path/filepath"
+    "strconv"
 
     . "github.com/armPelionEdge/devicedb/logging"
     . "github.com/armPelionEdge/devicedb/merkle"
@@ -41,13 +44,16 @@ type YAMLServerConfig struct {
     Port int `yaml:"port"`
     MaxSyncSessions int `yaml:"syncSessionLimit"`
     SyncSessionPeriod uint64 `yaml:"syncSessionPeriod"`
+    SyncSessionPeriodMax uint64 `yaml:"syncSessionPeriodMax"`
     SyncPushBroadcastLimit uint64 `yaml:"syncPushBroadcastLimit"`
     SyncExplorationPathLimit uint32 `yaml:"syncExplorationPathLimit"`
     GCInterval uint64 `yaml:"gcInterval"`
     GCPurgeAge uint64 `yaml:"gcPurgeAge"`
     MerkleDepth uint8 `yaml:"merkleDepth"`
+    AdaptiveMerkleDepth *YAMLAdaptiveMerkleDepth `yaml:"adaptiveMerkleDepth"`
     NodeID string `yaml:"nodeid"`
     Peers []YAMLPeer `yaml:"peers"`
+    AdvertiseAddress string `yaml:"advertiseAddress"`
     TLS YAMLTLSFiles `yaml:"tls"`
     LogLevel string `yaml:"logLevel"`
     Cloud *YAMLCloud `yaml:"cloud"`
@@ -55,6 +61,12 @@ type YAMLServerConfig struct {
     Alerts *YAMLAlerts `yaml:"alerts"`
 }
 
+type YAMLAdaptiveMerkleDepth struct {
+    MinDepth uint8 `yaml:"minDepth"`
+    MaxDepth uint8 `yaml:"maxDepth"`
+    Interval uint64 `yaml:"interval"`
+}
+
 type YAMLHistory struct {
     PurgeOnForward bool `yaml:"purgeOnForward"`
     EventLimit uint64 `yaml:"eventLimit"`
@@ -63,10 +75,23 @@ type YAMLHistory struct {
     ForwardInterval uint64 `yaml:"forwardInterval"`
     ForwardBatchSize uint64 `yaml:"forwardBatchSize"`
     ForwardThreshold uint64 `yaml:"forwardThreshold"`
+    RetentionRules []YAMLRetentionRule `yaml:"retentionRules"`
+    RetentionInterval uint64 `yaml:"retentionInterval"`
+}
+
+type YAMLRetentionRule struct {
+    Source string `yaml:"source"`
+    Type string `yaml:"type"`
+    MaxAge uint64 `yaml:"maxAge"`
+    MaxCount uint64 `yaml:"maxCount"`
+    Priority int `yaml:"priority"`
 }
 
 type YAMLAlerts struct {
     ForwardInterval uint64 `yaml:"forwardInterval"`
+    DedupWindow uint64 `yaml:"dedupWindow"`
+    HistoryLimit uint64 `yaml:"historyLimit"`
+    RuleInterval uint64 `yaml:"ruleInterval"`
 }
 
 type YAMLPeer struct {
@@ -83,6 +108,14 @@ type YAMLCloud struct {
     AlertsID string `yaml:"alertsID"`
     AlertsURI string `yaml:"alertsURI"`
     NoValidate bool `yaml:"noValidate"`
+    Bandwidth *YAMLBandwidth `yaml:"bandwidth"`
+}
+
+type YAMLBandwidth struct {
+    Budget uint64 `yaml:"budget"`
+    BudgetPeriod uint64 `yaml:"budgetPeriod"`
+    Rate uint64 `yaml:"rate"`
+    Burst uint64 `yaml:"burst"`
 }
 
 type YAMLTLSFiles struct {
@@ -116,6 +149,24 @@ func (ysc *YAMLServerConfig) LoadFromFile(file string) error {
         return errors.New(fmt.Sprintf("Invalid merkle depth specified. Valid ranges are from %d to %d inclusive", MerkleMinDepth, MerkleMaxDepth))
     }
     
+    if ysc.AdaptiveMerkleDepth != nil {
+        if ysc.AdaptiveMerkleDepth.MinDepth == 0 {
+            ysc.AdaptiveMerkleDepth.MinDepth = MerkleMinDepth
+        }
+
+        if ysc.AdaptiveMerkleDepth.MaxDepth == 0 {
+            ysc.AdaptiveMerkleDepth.MaxDepth = MerkleDefaultDepth
+        }
+
+        if ysc.AdaptiveMerkleDepth.MinDepth < MerkleMinDepth || ysc.AdaptiveMerkleDepth.MaxDepth > MerkleMaxDepth || ysc.AdaptiveMerkleDepth.MinDepth > ysc.AdaptiveMerkleDepth.MaxDepth {
+            return errors.New(fmt.Sprintf("Invalid adaptiveMerkleDepth range. minDepth and maxDepth must be from %d to %d inclusive and minDepth must not exceed maxDepth", MerkleMinDepth, MerkleMaxDepth))
+        }
+
+        if ysc.AdaptiveMerkleDepth.Interval < 1000 {
+            return errors.New(fmt.Sprintf("adaptiveMerkleDepth.interval must be at least 1000"))
+        }
+    }
+    
     if ysc.MaxSyncSessions <= 0 {
         return errors.New("syncSessionLimit must be at least 1")
     }
@@ -124,6 +175,10 @@ func (ysc *YAMLServerConfig) LoadFromFile(file string) error {
         return errors.New("syncSessionPeriod must be positive")
     }
 
+    if ysc.SyncSessionPeriodMax != 0 && ysc.SyncSessionPeriodMax < ysc.SyncSessionPeriod {
+        return errors.New("syncSessionPeriodMax must not be less than syncSessionPeriod")
+    }
+
     if ysc.Peers != nil {
         for _, peer := range ysc.Peers {
             if len(peer.ID) == 0 {
@@ -140,6 +195,18 @@ func (ysc *YAMLServerConfig) LoadFromFile(file string) error {
         }
     }
     
+    if ysc.AdvertiseAddress != "" {
+        host, portString, err := net.SplitHostPort(ysc.AdvertiseAddress)
+
+        if err != nil || len(host) == 0 {
+            return errors.New(fmt.Sprintf("advertiseAddress must be of the form host:port"))
+        }
+
+        if port, err := strconv.Atoi(portString); err != nil || !isValidPort(port) {
+            return errors.New(fmt.Sprintf("%s is an invalid port in advertiseAddress", portString))
+        }
+    }
+
     if ysc.Cloud != nil {
         if len(ysc.Cloud.URI) == 0 {
             return errors.New(fmt.Sprintf("The cloud.uri is empty"))
@@ -152,6 +219,10 @@ func (ysc *YAMLServerConfig) LoadFromFile(file string) error {
         if len(ysc.Cloud.AlertsID) == 0 {
             ysc.Cloud.AlertsID = ysc.Cloud.ID
         }
+
+        if ysc.Cloud.Bandwidth != nil && ysc.Cloud.Bandwidth.Budget != 0 && ysc.Cloud.Bandwidth.BudgetPeriod < 1000 {
+            return errors.New(fmt.Sprintf("cloud.bandwidth.budgetPeriod must be at least 1000 when a budget is set"))
+        }
     }
     
     if ysc.History == nil {
@@ -166,9 +237,35 @@ func (ysc *YAMLServerConfig) LoadFromFile(file string) error {
         return errors.New(fmt.Sprintf("history.forwardInterval must be at least 1000"))
     }
 
+    for _, rule := range ysc.History.RetentionRules {
+        if _, err := path.Match(rule.Source, ""); err != nil {
+            return errors.New(fmt.Sprintf("Invalid history retention rule source pattern %s", rule.Source))
+        }
+
+        if _, err := path.Match(rule.Type, ""); err != nil {
+            return errors.New(fmt.Sprintf("Invalid history retention rule type pattern %s", rule.Type))
+        }
+    }
+
+    if ysc.History.RetentionInterval == 0 {
+        ysc.History.RetentionInterval = 60000
+    }
+
+    if ysc.History.RetentionInterval < 1000 {
+        return errors.New(fmt.Sprintf("history.retentionInterval must be at least 1000"))
+    }
+
     if ysc.Alerts.ForwardInterval < 1000 {
         return errors.New(fmt.Sprintf("alerts.forwardInterval must be at least 1000"))
     }
+
+    if ysc.Alerts.HistoryLimit == 0 {
+        ysc.Alerts.HistoryLimit = 10000
+    }
+
+    if ysc.Alerts.RuleInterval == 0 {
+        ysc.Alerts.RuleInterval = 1000
+    }
     
     if (YAMLTLSFiles{}) != ysc.TLS {
         if len(ysc.TLS.ClientCertificate) == 0 {
@@ -29,8 +29,24 @@ import (
 
     . "github.com/armPelionEdge/devicedb/logging"
     . "github.com/armPelionEdge/devicedb/bucket"
+
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+    prometheusGCSweepDurationHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+        Namespace: "relays",
+        Subsystem: "devicedb_internal",
+        Name: "gc_sweep_duration_seconds",
+        Help: "How long garbage collection sweeps of a bucket take",
+        Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+    }, []string{ "bucket" })
 )
 
+func init() {
+    prometheus.MustRegister(prometheusGCSweepDurationHistogram)
+}
+
 type GarbageCollector struct {
     buckets *BucketList
     gcInterval time.Duration
@@ -57,7 +73,9 @@ func (garbageCollector *GarbageCollector) Start() {
             case <-time.After(garbageCollector.gcInterval):
                 for _, bucket := range garbageCollector.buckets.All() {
                     Log.Infof("Performing garbage collection sweep on %s bucket", bucket.Name())
+                    sweepStart := time.Now()
                     bucket.GarbageCollect(garbageCollector.gcPurgeAge)
+                    prometheusGCSweepDurationHistogram.WithLabelValues(bucket.Name()).Observe(time.Since(sweepStart).Seconds())
                 }
             }
         }
@@ -0,0 +1,118 @@
+package shared
+//
+ // Copyright (c) 2019 ARM Limited.
+ //
+ // SPDX-License-Identifier: MIT
+ //
+ // Permission is hereby granted, free of charge, to any person obtaining a copy
+ // of this software and associated documentation files (the "Software"), to
+ // deal in the Software without restriction, including without limitation the
+ // rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ // sell copies of the Software, and to permit persons to whom the Software is
+ // furnished to do so, subject to the following conditions:
+ //
+ // The above copyright notice and this permission notice shall be included in all
+ // copies or substantial portions of the Software.
+ //
+ // THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ // IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ // FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ // AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ // LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ // SOFTWARE.
+ //
+
+
+import (
+    "time"
+
+    . "github.com/armPelionEdge/devicedb/bucket"
+    . "github.com/armPelionEdge/devicedb/logging"
+    . "github.com/armPelionEdge/devicedb/merkle"
+)
+
+// The number of keys a merkle leaf should hold on average once the
+// depth of a bucket has been adjusted to the number of keys it holds
+const MerkleLeafKeysTarget = 32
+
+// AdaptiveMerkleDepth returns the merkle depth that a bucket holding
+// keyCount keys should use. The leafs of a tree of depth d hold on
+// average keyCount / 2^(d-1) keys. A bucket stays at its current
+// depth as long as that is within one level of the ideal depth so a
+// bucket whose size hovers around a threshold isn't rebuilt over and
+// over
+func AdaptiveMerkleDepth(keyCount uint64, currentDepth uint8, minDepth uint8, maxDepth uint8) uint8 {
+    depth := MerkleMinDepth
+
+    for depth < MerkleMaxDepth && (uint64(1) << (depth - 1)) * MerkleLeafKeysTarget < keyCount {
+        depth++
+    }
+
+    if depth < minDepth {
+        depth = minDepth
+    }
+
+    if depth > maxDepth {
+        depth = maxDepth
+    }
+
+    if currentDepth >= minDepth && currentDepth <= maxDepth && currentDepth + 1 >= depth && currentDepth <= depth + 1 {
+        return currentDepth
+    }
+
+    return depth
+}
+
+type MerkleDepthTuner struct {
+    buckets *BucketList
+    interval time.Duration
+    minDepth uint8
+    maxDepth uint8
+    done chan bool
+}
+
+func NewMerkleDepthTuner(buckets *BucketList, interval uint64, minDepth uint8, maxDepth uint8) *MerkleDepthTuner {
+    return &MerkleDepthTuner{
+        buckets: buckets,
+        interval: time.Millisecond * time.Duration(interval),
+        minDepth: minDepth,
+        maxDepth: maxDepth,
+        done: make(chan bool),
+    }
+}
+
+func (tuner *MerkleDepthTuner) Start() {
+    go func() {
+        for {
+            select {
+            case <-tuner.done:
+                tuner.done = make(chan bool)
+                return
+            case <-time.After(tuner.interval):
+                for _, bucket := range tuner.buckets.All() {
+                    tuner.Tune(bucket)
+                }
+            }
+        }
+    }()
+}
+
+func (tuner *MerkleDepthTuner) Stop() {
+    close(tuner.done)
+}
+
+// Tune re-depths a bucket if the number of keys it holds calls for a
+// different merkle depth
+func (tuner *MerkleDepthTuner) Tune(bucket Bucket) error {
+    currentDepth := bucket.MerkleTree().Depth()
+    depth := AdaptiveMerkleDepth(bucket.KeyCount(), currentDepth, tuner.minDepth, tuner.maxDepth)
+
+    if depth == currentDepth {
+        return nil
+    }
+
+    Log.Infof("Bucket %s holds %d keys. Adjusting its merkle depth from %d to %d", bucket.Name(), bucket.KeyCount(), currentDepth, depth)
+
+    return bucket.Redepth(depth)
+}
@@ -0,0 +1,54 @@
+package shared_test
+//
+ // Copyright (c) 2019 ARM Limited.
+ //
+ // SPDX-License-Identifier: MIT
+ //
+ // Permission is hereby granted, free of charge, to any person obtaining a copy
+ // of this software and associated documentation files (the "Software"), to
+ // deal in the Software without restriction, including without limitation the
+ // rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ // sell copies of the Software, and to permit persons to whom the Software is
+ // furnished to do so, subject to the following conditions:
+ //
+ // The above copyright notice and this permission notice shall be included in all
+ // copies or substantial portions of the Software.
+ //
+ // THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ // IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ // FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ // AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ // LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ // SOFTWARE.
+ //
+
+
+import (
+    . "github.com/armPelionEdge/devicedb/merkle"
+    . "github.com/armPelionEdge/devicedb/shared"
+
+    . "github.com/onsi/ginkgo"
+    . "github.com/onsi/gomega"
+)
+
+var _ = Describe("AdaptiveMerkleDepth", func() {
+    It("should pick the shallowest depth whose leafs hold no more than the target number of keys", func() {
+        Expect(AdaptiveMerkleDepth(0, 0, MerkleMinDepth, MerkleMaxDepth)).Should(Equal(MerkleMinDepth))
+        Expect(AdaptiveMerkleDepth(MerkleLeafKeysTarget, 0, MerkleMinDepth, MerkleMaxDepth)).Should(Equal(uint8(1)))
+        Expect(AdaptiveMerkleDepth(MerkleLeafKeysTarget + 1, 0, MerkleMinDepth, MerkleMaxDepth)).Should(Equal(uint8(2)))
+        Expect(AdaptiveMerkleDepth(MerkleLeafKeysTarget * 1024, 0, MerkleMinDepth, MerkleMaxDepth)).Should(Equal(uint8(11)))
+    })
+
+    It("should stay within the configured range", func() {
+        Expect(AdaptiveMerkleDepth(0, 0, 4, 8)).Should(Equal(uint8(4)))
+        Expect(AdaptiveMerkleDepth(MerkleLeafKeysTarget * 1024, 0, 4, 8)).Should(Equal(uint8(8)))
+    })
+
+    It("should keep the current depth while it is within one level of the ideal depth", func() {
+        Expect(AdaptiveMerkleDepth(MerkleLeafKeysTarget * 1024, 10, MerkleMinDepth, MerkleMaxDepth)).Should(Equal(uint8(10)))
+        Expect(AdaptiveMerkleDepth(MerkleLeafKeysTarget * 1024, 12, MerkleMinDepth, MerkleMaxDepth)).Should(Equal(uint8(12)))
+        Expect(AdaptiveMerkleDepth(MerkleLeafKeysTarget * 1024, 13, MerkleMinDepth, MerkleMaxDepth)).Should(Equal(uint8(11)))
+        Expect(AdaptiveMerkleDepth(MerkleLeafKeysTarget * 1024, 10, 4, 8)).Should(Equal(uint8(8)))
+    })
+})
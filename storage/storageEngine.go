@@ -242,6 +242,10 @@ func (psd *PrefixedStorageDriver) Batch(batch *Batch) error {
     return psd.storageDriver.Batch(newBatch)
 }
 
+func (psd *PrefixedStorageDriver) ApproximateSize(prefix []byte) (uint64, error) {
+    return psd.storageDriver.ApproximateSize(psd.addPrefix(prefix))
+}
+
 func (psd *PrefixedStorageDriver) Snapshot(snapshotDirectory string, metadataPrefix []byte, metadata map[string]string) error {
     return psd.storageDriver.Snapshot(snapshotDirectory, metadataPrefix, metadata)
 }
@@ -297,6 +301,7 @@ type StorageDriver interface {
     GetRange([]byte, []byte) (StorageIterator, error)
     GetRanges([][2][]byte, int) (StorageIterator, error)
     Batch(*Batch) error
+    ApproximateSize(prefix []byte) (uint64, error)
     Snapshot(snapshotDirectory string, metadataPrefix []byte, metadata map[string]string) error
     OpenSnapshot(snapshotDirectory string) (StorageDriver, error)
     Restore(storageDriver StorageDriver) error
@@ -659,6 +664,25 @@ func (levelDriver *LevelDBStorageDriver) Batch(batch *Batch) error {
 }
 
 
+// ApproximateSize estimates the number of bytes on disk taken up by keys
+// starting with prefix. Recent writes still held in the memtable are not
+// counted
+func (levelDriver *LevelDBStorageDriver) ApproximateSize(prefix []byte) (uint64, error) {
+    if levelDriver.db == nil {
+        return 0, errors.New("Driver is closed")
+    }
+
+    sizes, err := levelDriver.db.SizeOf([]util.Range{ *util.BytesPrefix(prefix) })
+
+    if err != nil {
+        prometheusRecordStorageError("approximateSize()", levelDriver.file)
+
+        return 0, err
+    }
+
+    return uint64(sizes.Sum()), nil
+}
+
 func (levelDriver *LevelDBStorageDriver) Snapshot(snapshotDirectory string, metadataPrefix []byte, metadata map[string]string) error {
     if levelDriver.db == nil {
         return errors.New("Driver is closed")
@@ -28,6 +28,7 @@ import (
     "context"
     "errors"
     "math/rand"
+    "sync"
 
     . "github.com/armPelionEdge/devicedb/bucket"
     . "github.com/armPelionEdge/devicedb/client"
@@ -58,6 +59,10 @@ type BucketProxyFactory interface {
 type RelayBucketProxyFactory struct {
     // The site pool for this node
     SitePool SitePool
+    scopesLock sync.Mutex
+    // The scopes that peers have assigned to this relay, per bucket
+    scopes map[string]map[string]*KeyScope
+    scopedMerkleTrees *ScopedMerkleTreeCache
 }
 
 func (relayBucketProxyFactory *RelayBucketProxyFactory) CreateBucketProxy(peerID string, bucketName string) (BucketProxy, error) {
@@ -67,13 +72,42 @@ func (relayBucketProxyFactory *RelayBucketProxyFactory) CreateBucketProxy(peerID
         return nil, ENoLocalBucket
     }
 
+    relayBucketProxyFactory.scopesLock.Lock()
+    defer relayBucketProxyFactory.scopesLock.Unlock()
+
     return &RelayBucketProxy{
         Bucket: site.Buckets().Get(bucketName),
         SitePool: relayBucketProxyFactory.SitePool,
         SiteID: "",
+        Scope: relayBucketProxyFactory.scopes[peerID][bucketName],
+        ScopedMerkleTrees: relayBucketProxyFactory.scopedMerkleTrees,
     }, nil
 }
 
+// SetKeyScopes records the keys of each bucket that a peer replicates
+// with this relay. The merkle trees this relay compares with that peer
+// leave out the keys of a bucket that are not in its scope so they can
+// match the scoped trees of the peer. Updates this relay makes outside
+// the scope are still pushed to the peer. Buckets without a scope are
+// replicated in full and a nil map clears all scopes for the peer
+func (relayBucketProxyFactory *RelayBucketProxyFactory) SetKeyScopes(peerID string, scopes map[string]*KeyScope) {
+    relayBucketProxyFactory.scopesLock.Lock()
+    defer relayBucketProxyFactory.scopesLock.Unlock()
+
+    if relayBucketProxyFactory.scopes == nil {
+        relayBucketProxyFactory.scopes = make(map[string]map[string]*KeyScope)
+        relayBucketProxyFactory.scopedMerkleTrees = NewScopedMerkleTreeCache()
+    }
+
+    if len(scopes) == 0 {
+        delete(relayBucketProxyFactory.scopes, peerID)
+
+        return
+    }
+
+    relayBucketProxyFactory.scopes[peerID] = scopes
+}
+
 func (relayBucketProxyFactory *RelayBucketProxyFactory) IncomingBuckets(peerID string) map[string]bool {
     var buckets map[string]bool = make(map[string]bool)
 
@@ -107,10 +141,23 @@ type CloudBucketProxyFactory struct {
     PartitionPool PartitionPool
     // The cluster io agent for this node
     ClusterIOAgent ClusterIOAgent
+    // The merkle trees of scoped relays that sync with this node
+    ScopedMerkleTrees *ScopedMerkleTreeCache
 }
 
 func (cloudBucketProxyFactory *CloudBucketProxyFactory) CreateBucketProxy(peerID string, bucketName string) (BucketProxy, error) {
     siteID := cloudBucketProxyFactory.ClusterController.RelaySite(peerID)
+
+    return cloudBucketProxyFactory.createBucketProxy(siteID, bucketName, cloudBucketProxyFactory.KeyScope(peerID, bucketName))
+}
+
+// CreateSiteBucketProxy returns a proxy for a bucket in a site's replica
+// that is not tied to any relay so it sees every key in the bucket
+func (cloudBucketProxyFactory *CloudBucketProxyFactory) CreateSiteBucketProxy(siteID string, bucketName string) (BucketProxy, error) {
+    return cloudBucketProxyFactory.createBucketProxy(siteID, bucketName, nil)
+}
+
+func (cloudBucketProxyFactory *CloudBucketProxyFactory) createBucketProxy(siteID string, bucketName string, scope *KeyScope) (BucketProxy, error) {
     partitionNumber := cloudBucketProxyFactory.ClusterController.Partition(siteID)
     nodeIDs := cloudBucketProxyFactory.ClusterController.PartitionOwners(partitionNumber)
 
@@ -139,6 +186,8 @@ func (cloudBucketProxyFactory *CloudBucketProxyFactory) CreateBucketProxy(peerID
             SitePool: partition.Sites(),
             SiteID: siteID,
             ClusterIOAgent: cloudBucketProxyFactory.ClusterIOAgent,
+            Scope: scope,
+            ScopedMerkleTrees: cloudBucketProxyFactory.ScopedMerkleTrees,
         }
 
         return localBucket, nil
@@ -150,9 +199,23 @@ func (cloudBucketProxyFactory *CloudBucketProxyFactory) CreateBucketProxy(peerID
         SiteID: siteID,
         BucketName: bucketName,
         ClusterIOAgent: cloudBucketProxyFactory.ClusterIOAgent,
+        Scope: scope,
     }, nil
 }
 
+// KeyScope returns the prefixes of a bucket that a relay is subscribed to
+// or nil if the relay has no subscription for that bucket and receives
+// all of it
+func (cloudBucketProxyFactory *CloudBucketProxyFactory) KeyScope(peerID string, bucketName string) *KeyScope {
+    prefixes, ok := cloudBucketProxyFactory.ClusterController.RelaySubscription(peerID)[bucketName]
+
+    if !ok {
+        return nil
+    }
+
+    return NewKeyScope(prefixes)
+}
+
 func (cloudBucketProxyFactory *CloudBucketProxyFactory) IncomingBuckets(peerID string) map[string]bool {
     return map[string]bool{ "default": true, "lww": true }
 }
@@ -170,10 +233,25 @@ type BucketProxy interface {
     Close()
 }
 
+// ChangeLogBucketProxy is implemented by bucket proxies with direct
+// access to the change log of a bucket. Sync sessions use it to stream
+// only the rows written since a peer last synced rather than exploring
+// the merkle tree
+type ChangeLogBucketProxy interface {
+    ChangeLogID() string
+    ChangeLogPosition() uint64
+    ChangeLogHorizon() uint64
+    ChangesSince(position uint64) (SiblingSetIterator, uint64, error)
+}
+
 type RelayBucketProxy struct {
     Bucket Bucket
     SiteID string
     SitePool SitePool
+    // Restricts the keys the peer sees. A nil scope includes all keys
+    Scope *KeyScope
+    ScopedMerkleTrees *ScopedMerkleTreeCache
+    scopedMerkleTree *ScopedMerkleTreeProxy
 }
 
 func (relayBucketProxy *RelayBucketProxy) Name() string {
@@ -181,13 +259,27 @@ func (relayBucketProxy *RelayBucketProxy) Name() string {
 }
 
 func (relayBucketProxy *RelayBucketProxy) MerkleTree() MerkleTreeProxy {
-    return &DirectMerkleTreeProxy{
-        merkleTree: relayBucketProxy.Bucket.MerkleTree(),
+    if relayBucketProxy.Scope == nil {
+        return &DirectMerkleTreeProxy{
+            merkleTree: relayBucketProxy.Bucket.MerkleTree(),
+        }
+    }
+
+    if relayBucketProxy.scopedMerkleTree == nil {
+        relayBucketProxy.scopedMerkleTree = relayBucketProxy.ScopedMerkleTrees.Get(relayBucketProxy.SiteID, relayBucketProxy.Bucket, relayBucketProxy.Scope)
     }
+
+    return relayBucketProxy.scopedMerkleTree
 }
 
 func (relayBucketProxy *RelayBucketProxy) GetSyncChildren(nodeID uint32) (SiblingSetIterator, error) {
-    return relayBucketProxy.Bucket.GetSyncChildren(nodeID)
+    iter, err := relayBucketProxy.Bucket.GetSyncChildren(nodeID)
+
+    if err != nil || relayBucketProxy.Scope == nil {
+        return iter, err
+    }
+
+    return NewScopedSiblingSetIterator(iter, relayBucketProxy.Scope), nil
 }
 
 func (relayBucketProxy *RelayBucketProxy) Close() {
@@ -202,6 +294,32 @@ func (relayBucketProxy *RelayBucketProxy) Forget(keys [][]byte) error {
     return relayBucketProxy.Bucket.Forget(keys)
 }
 
+func (relayBucketProxy *RelayBucketProxy) ChangeLogID() string {
+    if relayBucketProxy.Scope == nil {
+        return relayBucketProxy.Bucket.ChangeLogID()
+    }
+
+    return relayBucketProxy.Bucket.ChangeLogID() + "-" + relayBucketProxy.Scope.Fingerprint()
+}
+
+func (relayBucketProxy *RelayBucketProxy) ChangeLogPosition() uint64 {
+    return relayBucketProxy.Bucket.ChangeLogPosition()
+}
+
+func (relayBucketProxy *RelayBucketProxy) ChangeLogHorizon() uint64 {
+    return relayBucketProxy.Bucket.ChangeLogHorizon()
+}
+
+func (relayBucketProxy *RelayBucketProxy) ChangesSince(position uint64) (SiblingSetIterator, uint64, error) {
+    iter, nextPosition, err := relayBucketProxy.Bucket.ChangesSince(position)
+
+    if err != nil || relayBucketProxy.Scope == nil {
+        return iter, nextPosition, err
+    }
+
+    return NewScopedSiblingSetIterator(iter, relayBucketProxy.Scope), nextPosition, nil
+}
+
 type CloudResponderMerkleNodeIterator struct {
     MerkleKeys rest.MerkleKeys
     CurrentIndex int
@@ -255,6 +373,10 @@ type CloudLocalBucketProxy struct {
     SiteID string
     SitePool SitePool
     ClusterIOAgent ClusterIOAgent
+    // Restricts the keys this peer sees. A nil scope includes all keys
+    Scope *KeyScope
+    ScopedMerkleTrees *ScopedMerkleTreeCache
+    scopedMerkleTree *ScopedMerkleTreeProxy
 }
 
 func (bucketProxy *CloudLocalBucketProxy) Name() string {
@@ -262,13 +384,27 @@ func (bucketProxy *CloudLocalBucketProxy) Name() string {
 }
 
 func (bucketProxy *CloudLocalBucketProxy) MerkleTree() MerkleTreeProxy {
-    return &DirectMerkleTreeProxy{
-        merkleTree: bucketProxy.Bucket.MerkleTree(),
+    if bucketProxy.Scope == nil {
+        return &DirectMerkleTreeProxy{
+            merkleTree: bucketProxy.Bucket.MerkleTree(),
+        }
     }
+
+    if bucketProxy.scopedMerkleTree == nil {
+        bucketProxy.scopedMerkleTree = bucketProxy.ScopedMerkleTrees.Get(bucketProxy.SiteID, bucketProxy.Bucket, bucketProxy.Scope)
+    }
+
+    return bucketProxy.scopedMerkleTree
 }
 
 func (bucketProxy *CloudLocalBucketProxy) GetSyncChildren(nodeID uint32) (SiblingSetIterator, error) {
-    return bucketProxy.Bucket.GetSyncChildren(nodeID)
+    iter, err := bucketProxy.Bucket.GetSyncChildren(nodeID)
+
+    if err != nil || bucketProxy.Scope == nil {
+        return iter, err
+    }
+
+    return NewScopedSiblingSetIterator(iter, bucketProxy.Scope), nil
 }
 
 func (bucketProxy *CloudLocalBucketProxy) Merge(mergedKeys map[string]*SiblingSet) error {
@@ -285,12 +421,40 @@ func (bucketProxy *CloudLocalBucketProxy) Close() {
     bucketProxy.SitePool.Release(bucketProxy.SiteID)
 }
 
+func (bucketProxy *CloudLocalBucketProxy) ChangeLogID() string {
+    if bucketProxy.Scope == nil {
+        return bucketProxy.Bucket.ChangeLogID()
+    }
+
+    return bucketProxy.Bucket.ChangeLogID() + "-" + bucketProxy.Scope.Fingerprint()
+}
+
+func (bucketProxy *CloudLocalBucketProxy) ChangeLogPosition() uint64 {
+    return bucketProxy.Bucket.ChangeLogPosition()
+}
+
+func (bucketProxy *CloudLocalBucketProxy) ChangeLogHorizon() uint64 {
+    return bucketProxy.Bucket.ChangeLogHorizon()
+}
+
+func (bucketProxy *CloudLocalBucketProxy) ChangesSince(position uint64) (SiblingSetIterator, uint64, error) {
+    iter, nextPosition, err := bucketProxy.Bucket.ChangesSince(position)
+
+    if err != nil || bucketProxy.Scope == nil {
+        return iter, nextPosition, err
+    }
+
+    return NewScopedSiblingSetIterator(iter, bucketProxy.Scope), nextPosition, nil
+}
+
 type CloudRemoteBucketProxy struct {
     Client Client
     PeerAddress PeerAddress
     SiteID string
     BucketName string
     ClusterIOAgent ClusterIOAgent
+    // Restricts the keys this peer sees. A nil scope includes all keys
+    Scope *KeyScope
     merkleTreeProxy MerkleTreeProxy
 }
 
@@ -330,6 +494,7 @@ func (bucketProxy *CloudRemoteBucketProxy) MerkleTree() MerkleTreeProxy {
         siteID: bucketProxy.SiteID,
         bucketName: bucketProxy.BucketName,
         merkleTree: dummyMerkleTree,
+        scope: bucketProxy.Scope,
     }
 
     return bucketProxy.merkleTreeProxy
@@ -342,10 +507,16 @@ func (bucketProxy *CloudRemoteBucketProxy) GetSyncChildren(nodeID uint32) (Sibli
         return nil, err
     }
 
-    return &CloudResponderMerkleNodeIterator{
+    iter := &CloudResponderMerkleNodeIterator{
         MerkleKeys: merkleKeys,
         CurrentIndex: -1,
-    }, nil
+    }
+
+    if bucketProxy.Scope == nil {
+        return iter, nil
+    }
+
+    return NewScopedSiblingSetIterator(iter, bucketProxy.Scope), nil
 }
 
 func (bucketProxy *CloudRemoteBucketProxy) Merge(mergedKeys map[string]*SiblingSet) error {
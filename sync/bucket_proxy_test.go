@@ -155,10 +155,22 @@ func (dummyBucket *DummyBucket) RebuildMerkleLeafs() error {
     return nil
 }
 
+func (dummyBucket *DummyBucket) Redepth(depth uint8) error {
+    return nil
+}
+
 func (dummyBucket *DummyBucket) MerkleTree() *MerkleTree {
     return dummyBucket.merkleTree
 }
 
+func (dummyBucket *DummyBucket) KeyCount() uint64 {
+    return 0
+}
+
+func (dummyBucket *DummyBucket) MerkleRootChanges() uint64 {
+    return 0
+}
+
 func (dummyBucket *DummyBucket) GarbageCollect(tombstonePurgeAge uint64) error {
     return nil
 }
@@ -183,6 +195,22 @@ func (dummyBucket *DummyBucket) Watch(ctx context.Context, keys [][]byte, prefix
 
 }
 
+func (dummyBucket *DummyBucket) ChangeLogID() string {
+    return ""
+}
+
+func (dummyBucket *DummyBucket) ChangeLogPosition() uint64 {
+    return 0
+}
+
+func (dummyBucket *DummyBucket) ChangeLogHorizon() uint64 {
+    return 0
+}
+
+func (dummyBucket *DummyBucket) ChangesSince(position uint64) (SiblingSetIterator, uint64, error) {
+    return nil, 0, nil
+}
+
 func (dummyBucket *DummyBucket) LockReads() {
 }
 
@@ -378,6 +406,53 @@ var _ = Describe("BucketProxy", func() {
                 Expect(bucketProxy).Should(Not(BeNil()))
                 Expect(err).Should(BeNil())
             })
+
+            Specify("If a peer assigned a scope to the bucket the proxy for that peer should only see the keys in scope", func() {
+                merkleTree, _ := NewMerkleTree(MerkleMinDepth)
+                bucket := &DummyBucket{
+                    name: "dummy",
+                    merkleTree: merkleTree,
+                    syncChildren: map[uint32]SiblingSetIterator{
+                        merkleTree.RootNode(): &CloudResponderMerkleNodeIterator{
+                            CurrentIndex: -1,
+                            MerkleKeys: makeMerkleKeys("config.1", "state.1"),
+                        },
+                    },
+                }
+
+                bucketList := NewBucketList()
+                bucketList.AddBucket(bucket)
+
+                relayBucketProxyFactory := &RelayBucketProxyFactory{
+                    SitePool: &DummySitePool{
+                        sites: map[string]Site{
+                            "": &DummySite{ 
+                                bucketList: bucketList,
+                            },
+                        },
+                    },
+                }
+
+                relayBucketProxyFactory.SetKeyScopes("cloud", map[string]*KeyScope{ "dummy": NewKeyScope([]string{ "config." }) })
+
+                bucketProxy, err := relayBucketProxyFactory.CreateBucketProxy("cloud", "dummy")
+                expectedMerkleTree := makeMerkleTree(makeMerkleKeys("config.1"))
+
+                Expect(err).Should(BeNil())
+                Expect(bucketProxy.MerkleTree().NodeHash(bucketProxy.MerkleTree().RootNode())).Should(Equal(expectedMerkleTree.NodeHash(expectedMerkleTree.RootNode())))
+
+                bucketProxy, err = relayBucketProxyFactory.CreateBucketProxy("WWRL000002", "dummy")
+
+                Expect(err).Should(BeNil())
+                Expect(bucketProxy.(*RelayBucketProxy).Scope).Should(BeNil())
+
+                relayBucketProxyFactory.SetKeyScopes("cloud", nil)
+
+                bucketProxy, err = relayBucketProxyFactory.CreateBucketProxy("cloud", "dummy")
+
+                Expect(err).Should(BeNil())
+                Expect(bucketProxy.(*RelayBucketProxy).Scope).Should(BeNil())
+            })
         })
     })
 
@@ -606,6 +681,67 @@ var _ = Describe("BucketProxy", func() {
             })
         })
 
+        Describe("#MerkleTree with a scope", func() {
+            var httpServer *TestHTTPServer
+            var remoteBucketProxy *CloudRemoteBucketProxy
+
+            BeforeEach(func() {
+                // A different port from the other tests keeps the client from
+                // reusing a connection to a server that one of them started
+                httpServer = NewTestHTTPServer(9002)
+                bucketList := NewBucketList()
+                merkleTree, _ := NewMerkleTree(MerkleMinDepth)
+                bucketList.AddBucket(&DummyBucket{
+                    name: "default",
+                    merkleTree: merkleTree,
+                    syncChildren: map[uint32]SiblingSetIterator{
+                        merkleTree.RootNode(): &CloudResponderMerkleNodeIterator{
+                            CurrentIndex: -1,
+                            MerkleKeys: makeMerkleKeys("config.1", "state.1"),
+                        },
+                    },
+                })
+
+                partitions := NewDefaultPartitionPool()
+                partitions.Add(NewDefaultPartition(0, &DummySitePool{
+                    sites: map[string]Site{
+                        "site1": &DummySite{ bucketList: bucketList },
+                    },
+                }))
+
+                clusterController := &ClusterController{ PartitioningStrategy: &SimplePartitioningStrategy{ } }
+                clusterController.AddNode(ClusterAddNodeBody{ NodeID: 1, NodeConfig: NodeConfig{ Capacity: 1, Address: PeerAddress{ NodeID: 1 } } })
+
+                bucketSyncHTTP := &BucketSyncHTTP{
+                    PartitionPool: partitions,
+                    ClusterConfigController: NewMockConfigController(clusterController),
+                }
+
+                bucketSyncHTTP.Attach(httpServer.Router())
+                httpServer.Start()
+
+                remoteBucketProxy = &CloudRemoteBucketProxy{
+                    SiteID: "site1",
+                    BucketName: "default",
+                    Client: *NewClient(ClientConfig{ }),
+                    PeerAddress: PeerAddress{ Host: "localhost", Port: 9002 },
+                    Scope: NewKeyScope([]string{ "config." }),
+                }
+            })
+
+            AfterEach(func() {
+                httpServer.Stop()
+            })
+
+            It("should return a CloudResponderMerkleTreeProxy whose NodeHash() method returns node hashes that only include the keys in scope", func() {
+                merkleTreeProxy := remoteBucketProxy.MerkleTree()
+                expectedMerkleTree := makeMerkleTree(makeMerkleKeys("config.1"))
+
+                Expect(merkleTreeProxy.NodeHash(merkleTreeProxy.RootNode())).Should(Equal(expectedMerkleTree.NodeHash(expectedMerkleTree.RootNode())))
+                Expect(merkleTreeProxy.Error()).Should(BeNil())
+            })
+        })
+
         Describe("#GetSyncChildren", func() {
             var httpServer *TestHTTPServer
             var bucketSyncHTTP *BucketSyncHTTP
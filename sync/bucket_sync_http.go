@@ -41,6 +41,8 @@ import (
 type BucketSyncHTTP struct {
     PartitionPool PartitionPool
     ClusterConfigController ClusterConfigController
+    // Answers requests for the merkle trees of scoped relays
+    ScopedMerkleTrees *ScopedMerkleTreeCache
 }
 
 func (bucketSync *BucketSyncHTTP) Attach(router *mux.Router) {
@@ -265,6 +267,22 @@ func (bucketSync *BucketSyncHTTP) Attach(router *mux.Router) {
 
         nodeHash := site.Buckets().Get(bucketName).MerkleTree().NodeHash(uint32(nodeID))
 
+        if r.URL.Query().Get("scoped") == "true" {
+            scopedMerkleTree := bucketSync.ScopedMerkleTrees.Get(siteID, site.Buckets().Get(bucketName), NewKeyScope(r.URL.Query()["prefix"]))
+
+            if scopedMerkleTree.Error() != nil {
+                Log.Warningf("GET /sites/{siteID}/buckets/{bucket}/merkle/nodes/{nodeID}: Unable to build scoped merkle tree: %v", siteID, bucketName, mux.Vars(r)["nodeID"], scopedMerkleTree.Error())
+
+                w.Header().Set("Content-Type", "application/json; charset=utf8")
+                w.WriteHeader(http.StatusInternalServerError)
+                io.WriteString(w, string(EStorage.JSON()) + "\n")
+
+                return
+            }
+
+            nodeHash = scopedMerkleTree.NodeHash(uint32(nodeID))
+        }
+
         responseMerkleNodeHash := MerkleNode{
             Hash: nodeHash,
         }
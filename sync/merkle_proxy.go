@@ -96,6 +96,8 @@ type CloudResponderMerkleTreeProxy struct {
     siteID string
     bucketName string
     merkleTree *MerkleTree
+    // When set only keys in scope contribute to node hashes
+    scope *KeyScope
 }
 
 func (cloudResponderMerkleProxy *CloudResponderMerkleTreeProxy) RootNode() uint32 {
@@ -151,6 +153,10 @@ func (cloudResponderMerkleProxy *CloudResponderMerkleTreeProxy) NodeHash(nodeID
         return Hash{}
     }
 
+    if cloudResponderMerkleProxy.scope != nil {
+        return cloudResponderMerkleProxy.scopedNodeHash(nodeID)
+    }
+
     merkleNode, err := cloudResponderMerkleProxy.client.MerkleTreeNode(context.TODO(), cloudResponderMerkleProxy.peerAddress, cloudResponderMerkleProxy.siteID, cloudResponderMerkleProxy.bucketName, nodeID)
 
     if err != nil {
@@ -162,6 +168,20 @@ func (cloudResponderMerkleProxy *CloudResponderMerkleTreeProxy) NodeHash(nodeID
     return merkleNode.Hash
 }
 
+// The node that holds the bucket keeps its scoped merkle tree up to date
+// so only the hashes of the nodes that are explored cross the network
+func (cloudResponderMerkleProxy *CloudResponderMerkleTreeProxy) scopedNodeHash(nodeID uint32) Hash {
+    merkleNode, err := cloudResponderMerkleProxy.client.ScopedMerkleTreeNode(context.TODO(), cloudResponderMerkleProxy.peerAddress, cloudResponderMerkleProxy.siteID, cloudResponderMerkleProxy.bucketName, nodeID, cloudResponderMerkleProxy.scope.Prefixes)
+
+    if err != nil {
+        cloudResponderMerkleProxy.err = err
+
+        return Hash{}
+    }
+
+    return merkleNode.Hash
+}
+
 func (cloudResponderMerkleProxy *CloudResponderMerkleTreeProxy) TranslateNode(nodeID uint32, depth uint8) uint32 {
     if cloudResponderMerkleProxy.err != nil {
         return 0
@@ -0,0 +1,435 @@
+package sync
+//
+ // Copyright (c) 2019 ARM Limited.
+ //
+ // SPDX-License-Identifier: MIT
+ //
+ // Permission is hereby granted, free of charge, to any person obtaining a copy
+ // of this software and associated documentation files (the "Software"), to
+ // deal in the Software without restriction, including without limitation the
+ // rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ // sell copies of the Software, and to permit persons to whom the Software is
+ // furnished to do so, subject to the following conditions:
+ //
+ // The above copyright notice and this permission notice shall be included in all
+ // copies or substantial portions of the Software.
+ //
+ // THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ // IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ // FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ // AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ // LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ // SOFTWARE.
+ //
+
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "encoding/hex"
+    "sort"
+    "sync"
+    "time"
+
+    . "github.com/armPelionEdge/devicedb/bucket"
+    . "github.com/armPelionEdge/devicedb/data"
+    . "github.com/armPelionEdge/devicedb/merkle"
+)
+
+// A KeyScope limits replication of a bucket to the keys that start with
+// one of its prefixes. A nil scope contains every key while a scope with
+// no prefixes contains none
+type KeyScope struct {
+    Prefixes []string
+}
+
+func NewKeyScope(prefixes []string) *KeyScope {
+    sortedPrefixes := append([]string{ }, prefixes...)
+    sort.Strings(sortedPrefixes)
+
+    return &KeyScope{ Prefixes: sortedPrefixes }
+}
+
+func (scope *KeyScope) Contains(key []byte) bool {
+    if scope == nil {
+        return true
+    }
+
+    for _, prefix := range scope.Prefixes {
+        if bytes.HasPrefix(key, []byte(prefix)) {
+            return true
+        }
+    }
+
+    return false
+}
+
+// Fingerprint identifies the set of prefixes in the scope. Change log
+// positions are only meaningful for the scope they were reached with so
+// the fingerprint becomes part of the change log ID a scoped peer sees
+func (scope *KeyScope) Fingerprint() string {
+    hash := sha256.New()
+
+    for _, prefix := range scope.Prefixes {
+        hash.Write([]byte(prefix))
+        hash.Write([]byte{ 0 })
+    }
+
+    return hex.EncodeToString(hash.Sum(nil)[:8])
+}
+
+// Implemented by bucket proxy factories that can restrict the keys
+// replicated to a peer
+type ScopedBucketProxyFactory interface {
+    KeyScope(peerID string, bucket string) *KeyScope
+}
+
+// Implemented by bucket proxy factories that are told by a peer which
+// keys it replicates with them
+type ScopeAssignableBucketProxyFactory interface {
+    SetKeyScopes(peerID string, scopes map[string]*KeyScope)
+}
+
+// Skips over any keys that are not in scope
+type ScopedSiblingSetIterator struct {
+    SiblingSetIterator
+    scope *KeyScope
+}
+
+func NewScopedSiblingSetIterator(iter SiblingSetIterator, scope *KeyScope) *ScopedSiblingSetIterator {
+    return &ScopedSiblingSetIterator{
+        SiblingSetIterator: iter,
+        scope: scope,
+    }
+}
+
+func (iter *ScopedSiblingSetIterator) Next() bool {
+    for iter.SiblingSetIterator.Next() {
+        if iter.scope.Contains(iter.SiblingSetIterator.Key()) {
+            return true
+        }
+    }
+
+    return false
+}
+
+// A ScopedMerkleTreeProxy answers merkle queries as if the keys outside a
+// scope did not exist. Key hashes can't be split back out of the hashes
+// stored in a merkle tree so node hashes are derived from the hashes of
+// the in scope keys. A proxy is a snapshot. ScopedMerkleTreeCache keeps
+// it up to date between sync sessions
+type ScopedMerkleTreeProxy struct {
+    merkleTree *MerkleTree
+    // in scope leaf nodes in ascending order
+    leaves []uint32
+    // leafHashes[i] is the xor of the hashes of leaves[0] through leaves[i - 1]
+    leafHashes []Hash
+    err error
+}
+
+func NewScopedMerkleTreeProxy(depth uint8, iter SiblingSetIterator, scope *KeyScope) *ScopedMerkleTreeProxy {
+    merkleTree, err := NewDummyMerkleTree(depth)
+
+    if err != nil {
+        return &ScopedMerkleTreeProxy{ err: err }
+    }
+
+    defer iter.Release()
+
+    leafHashMap := make(map[uint32]Hash)
+
+    for iter.Next() {
+        if !scope.Contains(iter.Key()) || iter.Value() == nil {
+            continue
+        }
+
+        leaf := merkleTree.LeafNode(iter.Key())
+        leafHashMap[leaf] = leafHashMap[leaf].Xor(iter.Value().Hash(iter.Key()))
+    }
+
+    if iter.Error() != nil {
+        return &ScopedMerkleTreeProxy{ err: iter.Error() }
+    }
+
+    return newScopedMerkleTreeProxy(merkleTree, leafHashMap)
+}
+
+func newScopedMerkleTreeProxy(merkleTree *MerkleTree, leafHashMap map[uint32]Hash) *ScopedMerkleTreeProxy {
+    proxy := &ScopedMerkleTreeProxy{
+        merkleTree: merkleTree,
+        leaves: make([]uint32, 0, len(leafHashMap)),
+        leafHashes: make([]Hash, 1, len(leafHashMap) + 1),
+    }
+
+    for leaf, _ := range leafHashMap {
+        proxy.leaves = append(proxy.leaves, leaf)
+    }
+
+    sort.Slice(proxy.leaves, func(i, j int) bool { return proxy.leaves[i] < proxy.leaves[j] })
+
+    for i, leaf := range proxy.leaves {
+        proxy.leafHashes = append(proxy.leafHashes, proxy.leafHashes[i].Xor(leafHashMap[leaf]))
+    }
+
+    return proxy
+}
+
+func (proxy *ScopedMerkleTreeProxy) RootNode() uint32 {
+    if proxy.err != nil {
+        return 0
+    }
+
+    return proxy.merkleTree.RootNode()
+}
+
+func (proxy *ScopedMerkleTreeProxy) Depth() uint8 {
+    if proxy.err != nil {
+        return 0
+    }
+
+    return proxy.merkleTree.Depth()
+}
+
+func (proxy *ScopedMerkleTreeProxy) NodeLimit() uint32 {
+    if proxy.err != nil {
+        return 0
+    }
+
+    return proxy.merkleTree.NodeLimit()
+}
+
+func (proxy *ScopedMerkleTreeProxy) Level(nodeID uint32) uint8 {
+    if proxy.err != nil {
+        return 0
+    }
+
+    return proxy.merkleTree.Level(nodeID)
+}
+
+func (proxy *ScopedMerkleTreeProxy) LeftChild(nodeID uint32) uint32 {
+    if proxy.err != nil {
+        return 0
+    }
+
+    return proxy.merkleTree.LeftChild(nodeID)
+}
+
+func (proxy *ScopedMerkleTreeProxy) RightChild(nodeID uint32) uint32 {
+    if proxy.err != nil {
+        return 0
+    }
+
+    return proxy.merkleTree.RightChild(nodeID)
+}
+
+// The hash of a node is the xor of the hashes of the leaves below it,
+// which lie strictly between SubRangeMin and SubRangeMax
+func (proxy *ScopedMerkleTreeProxy) NodeHash(nodeID uint32) Hash {
+    if proxy.err != nil || nodeID == 0 || nodeID >= proxy.merkleTree.NodeLimit() {
+        return Hash{}
+    }
+
+    rangeMin := proxy.merkleTree.SubRangeMin(nodeID)
+    rangeMax := proxy.merkleTree.SubRangeMax(nodeID)
+    first := sort.Search(len(proxy.leaves), func(i int) bool { return proxy.leaves[i] > rangeMin })
+    last := sort.Search(len(proxy.leaves), func(i int) bool { return proxy.leaves[i] >= rangeMax })
+
+    return proxy.leafHashes[last].Xor(proxy.leafHashes[first])
+}
+
+func (proxy *ScopedMerkleTreeProxy) TranslateNode(nodeID uint32, depth uint8) uint32 {
+    if proxy.err != nil {
+        return 0
+    }
+
+    return proxy.merkleTree.TranslateNode(nodeID, depth)
+}
+
+func (proxy *ScopedMerkleTreeProxy) Error() error {
+    return proxy.err
+}
+
+// How long a scoped merkle tree stays cached once no sync session uses it
+const SCOPED_MERKLE_TREE_IDLE_TIMEOUT = 10 * time.Minute
+
+// A ScopedMerkleTreeCache keeps the scoped merkle trees of the buckets
+// that scoped peers sync with. A tree is built by reading the whole bucket
+// the first time it is needed. After that only the keys written to the
+// bucket's change log since the tree was last used are read
+type ScopedMerkleTreeCache struct {
+    lock sync.Mutex
+    trees map[string]*cachedScopedMerkleTree
+}
+
+type cachedScopedMerkleTree struct {
+    lock sync.Mutex
+    lastUsed time.Time
+    changeLogID string
+    // Tombstones purged by garbage collection leave no trace in the change
+    // log but they move its horizon so the tree is rebuilt when it moves
+    changeLogHorizon uint64
+    changeLogPosition uint64
+    merkleTree *MerkleTree
+    // The hash of each in scope key that contributes to the tree
+    keyHashes map[string]Hash
+    leafHashes map[uint32]Hash
+    proxy *ScopedMerkleTreeProxy
+}
+
+func NewScopedMerkleTreeCache() *ScopedMerkleTreeCache {
+    return &ScopedMerkleTreeCache{
+        trees: make(map[string]*cachedScopedMerkleTree),
+    }
+}
+
+// Get returns a snapshot of the merkle tree of a bucket that only includes
+// the keys in scope. A nil cache reads the whole bucket every time
+func (cache *ScopedMerkleTreeCache) Get(siteID string, bucket Bucket, scope *KeyScope) *ScopedMerkleTreeProxy {
+    if cache == nil {
+        tree := &cachedScopedMerkleTree{ }
+
+        if err := tree.rebuild(bucket, scope); err != nil {
+            return &ScopedMerkleTreeProxy{ err: err }
+        }
+
+        return tree.proxy
+    }
+
+    now := time.Now()
+    cacheKey := siteID + "/" + bucket.Name() + "/" + scope.Fingerprint()
+
+    cache.lock.Lock()
+
+    for key, tree := range cache.trees {
+        tree.lock.Lock()
+
+        if key != cacheKey && now.Sub(tree.lastUsed) > SCOPED_MERKLE_TREE_IDLE_TIMEOUT {
+            delete(cache.trees, key)
+        }
+
+        tree.lock.Unlock()
+    }
+
+    tree, ok := cache.trees[cacheKey]
+
+    if !ok {
+        tree = &cachedScopedMerkleTree{ }
+        cache.trees[cacheKey] = tree
+    }
+
+    cache.lock.Unlock()
+
+    tree.lock.Lock()
+    defer tree.lock.Unlock()
+
+    tree.lastUsed = now
+
+    if err := tree.update(bucket, scope); err != nil {
+        // Start over the next time the tree is needed
+        tree.proxy = nil
+
+        return &ScopedMerkleTreeProxy{ err: err }
+    }
+
+    return tree.proxy
+}
+
+func (tree *cachedScopedMerkleTree) update(bucket Bucket, scope *KeyScope) error {
+    if tree.proxy == nil || tree.changeLogID != bucket.ChangeLogID() || tree.changeLogHorizon != bucket.ChangeLogHorizon() || tree.merkleTree.Depth() != bucket.MerkleTree().Depth() {
+        return tree.rebuild(bucket, scope)
+    }
+
+    iter, position, err := bucket.ChangesSince(tree.changeLogPosition)
+
+    if err != nil {
+        return err
+    }
+
+    changed, err := tree.apply(iter, scope)
+
+    if err != nil {
+        return err
+    }
+
+    tree.changeLogPosition = position
+
+    if changed {
+        tree.proxy = newScopedMerkleTreeProxy(tree.merkleTree, tree.leafHashes)
+    }
+
+    return nil
+}
+
+func (tree *cachedScopedMerkleTree) rebuild(bucket Bucket, scope *KeyScope) error {
+    merkleTree, err := NewDummyMerkleTree(bucket.MerkleTree().Depth())
+
+    if err != nil {
+        return err
+    }
+
+    tree.changeLogID = bucket.ChangeLogID()
+    tree.changeLogHorizon = bucket.ChangeLogHorizon()
+    // Keys written while the bucket is read are read again from the change
+    // log the next time the tree is updated
+    tree.changeLogPosition = bucket.ChangeLogPosition()
+    tree.merkleTree = merkleTree
+    tree.keyHashes = make(map[string]Hash)
+    tree.leafHashes = make(map[uint32]Hash)
+
+    iter, err := bucket.GetSyncChildren(merkleTree.RootNode())
+
+    if err != nil {
+        return err
+    }
+
+    if _, err := tree.apply(iter, scope); err != nil {
+        return err
+    }
+
+    tree.proxy = newScopedMerkleTreeProxy(tree.merkleTree, tree.leafHashes)
+
+    return nil
+}
+
+// Replaces the hashes of the in scope keys that iter visits and reports
+// whether any of them changed
+func (tree *cachedScopedMerkleTree) apply(iter SiblingSetIterator, scope *KeyScope) (bool, error) {
+    defer iter.Release()
+
+    changed := false
+
+    for iter.Next() {
+        if !scope.Contains(iter.Key()) {
+            continue
+        }
+
+        var hash Hash
+
+        if iter.Value() != nil {
+            hash = iter.Value().Hash(iter.Key())
+        }
+
+        key := string(iter.Key())
+
+        if tree.keyHashes[key] == hash {
+            continue
+        }
+
+        leaf := tree.merkleTree.LeafNode(iter.Key())
+        tree.leafHashes[leaf] = tree.leafHashes[leaf].Xor(tree.keyHashes[key]).Xor(hash)
+        changed = true
+
+        if tree.leafHashes[leaf] == (Hash{}) {
+            delete(tree.leafHashes, leaf)
+        }
+
+        if hash == (Hash{}) {
+            delete(tree.keyHashes, key)
+        } else {
+            tree.keyHashes[key] = hash
+        }
+    }
+
+    return changed, iter.Error()
+}
@@ -0,0 +1,261 @@
+package sync_test
+//
+ // Copyright (c) 2019 ARM Limited.
+ //
+ // SPDX-License-Identifier: MIT
+ //
+ // Permission is hereby granted, free of charge, to any person obtaining a copy
+ // of this software and associated documentation files (the "Software"), to
+ // deal in the Software without restriction, including without limitation the
+ // rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ // sell copies of the Software, and to permit persons to whom the Software is
+ // furnished to do so, subject to the following conditions:
+ //
+ // The above copyright notice and this permission notice shall be included in all
+ // copies or substantial portions of the Software.
+ //
+ // THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ // IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ // FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ // AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ // LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ // SOFTWARE.
+ //
+
+
+import (
+    "fmt"
+
+    . "github.com/armPelionEdge/devicedb/bucket"
+    . "github.com/armPelionEdge/devicedb/bucket/builtin"
+    . "github.com/armPelionEdge/devicedb/data"
+    . "github.com/armPelionEdge/devicedb/merkle"
+    . "github.com/armPelionEdge/devicedb/storage"
+    rest "github.com/armPelionEdge/devicedb/rest"
+    . "github.com/armPelionEdge/devicedb/sync"
+    . "github.com/armPelionEdge/devicedb/util"
+
+    . "github.com/onsi/ginkgo"
+    . "github.com/onsi/gomega"
+)
+
+func makeMerkleKeys(keys ...string) rest.MerkleKeys {
+    merkleKeys := rest.MerkleKeys{ Keys: []rest.Key{ } }
+
+    for _, key := range keys {
+        siblingSet := NewSiblingSet(map[*Sibling]bool{
+            NewSibling(NewDVV(NewDot("r1", 1), map[string]uint64{ }), []byte(key), 0): true,
+        })
+
+        merkleKeys.Keys = append(merkleKeys.Keys, rest.Key{ Key: key, Value: siblingSet })
+    }
+
+    return merkleKeys
+}
+
+func makeMerkleTree(merkleKeys rest.MerkleKeys) *MerkleTree {
+    merkleTree, _ := NewMerkleTree(MerkleMinDepth)
+
+    for _, key := range merkleKeys.Keys {
+        leaf := merkleTree.LeafNode([]byte(key.Key))
+        merkleTree.UpdateLeafHash(leaf, merkleTree.NodeHash(leaf).Xor(key.Value.Hash([]byte(key.Key))))
+    }
+
+    return merkleTree
+}
+
+var _ = Describe("Scope", func() {
+    Describe("KeyScope", func() {
+        Describe("#Contains", func() {
+            It("should contain every key if the scope is nil", func() {
+                var scope *KeyScope
+
+                Expect(scope.Contains([]byte("a"))).Should(BeTrue())
+            })
+
+            It("should contain no keys if the scope has no prefixes", func() {
+                Expect(NewKeyScope([]string{ }).Contains([]byte("a"))).Should(BeFalse())
+            })
+
+            It("should contain only keys that start with one of its prefixes", func() {
+                scope := NewKeyScope([]string{ "config.", "schedule." })
+
+                Expect(scope.Contains([]byte("config.light"))).Should(BeTrue())
+                Expect(scope.Contains([]byte("schedule.1"))).Should(BeTrue())
+                Expect(scope.Contains([]byte("state.light"))).Should(BeFalse())
+            })
+        })
+
+        Describe("#Fingerprint", func() {
+            It("should not depend on the order of the prefixes", func() {
+                Expect(NewKeyScope([]string{ "a", "b" }).Fingerprint()).Should(Equal(NewKeyScope([]string{ "b", "a" }).Fingerprint()))
+                Expect(NewKeyScope([]string{ "a" }).Fingerprint()).Should(Not(Equal(NewKeyScope([]string{ "ab" }).Fingerprint())))
+            })
+        })
+    })
+
+    Describe("ScopedSiblingSetIterator", func() {
+        It("should skip keys that are not in scope", func() {
+            iter := NewScopedSiblingSetIterator(&CloudResponderMerkleNodeIterator{
+                MerkleKeys: makeMerkleKeys("a1", "b1", "a2", "b2"),
+                CurrentIndex: -1,
+            }, NewKeyScope([]string{ "a" }))
+
+            Expect(iter.Next()).Should(BeTrue())
+            Expect(iter.Key()).Should(Equal([]byte("a1")))
+            Expect(iter.Next()).Should(BeTrue())
+            Expect(iter.Key()).Should(Equal([]byte("a2")))
+            Expect(iter.Next()).Should(BeFalse())
+        })
+    })
+
+    Describe("ScopedMerkleTreeProxy", func() {
+        var allKeys []string
+        var inScopeKeys []string
+
+        BeforeEach(func() {
+            allKeys = []string{ }
+            inScopeKeys = []string{ }
+
+            for i := 0; i < 200; i++ {
+                allKeys = append(allKeys, fmt.Sprintf("config.%d", i), fmt.Sprintf("state.%d", i))
+                inScopeKeys = append(inScopeKeys, fmt.Sprintf("config.%d", i))
+            }
+        })
+
+        It("should report the same node hashes as the full merkle tree when the scope is nil", func() {
+            merkleTree := makeMerkleTree(makeMerkleKeys(allKeys...))
+            proxy := NewScopedMerkleTreeProxy(MerkleMinDepth, &CloudResponderMerkleNodeIterator{ MerkleKeys: makeMerkleKeys(allKeys...), CurrentIndex: -1 }, nil)
+
+            Expect(proxy.Error()).Should(BeNil())
+
+            for node := uint32(1); node < merkleTree.NodeLimit(); node++ {
+                Expect(proxy.NodeHash(node)).Should(Equal(merkleTree.NodeHash(node)))
+            }
+        })
+
+        It("should report node hashes as if keys that are out of scope did not exist", func() {
+            merkleTree := makeMerkleTree(makeMerkleKeys(inScopeKeys...))
+            proxy := NewScopedMerkleTreeProxy(MerkleMinDepth, &CloudResponderMerkleNodeIterator{ MerkleKeys: makeMerkleKeys(allKeys...), CurrentIndex: -1 }, NewKeyScope([]string{ "config." }))
+
+            Expect(proxy.Error()).Should(BeNil())
+            Expect(proxy.RootNode()).Should(Equal(merkleTree.RootNode()))
+            Expect(proxy.Depth()).Should(Equal(merkleTree.Depth()))
+
+            for node := uint32(1); node < merkleTree.NodeLimit(); node++ {
+                Expect(proxy.NodeHash(node)).Should(Equal(merkleTree.NodeHash(node)))
+            }
+        })
+    })
+
+    Describe("ScopedMerkleTreeCache", func() {
+        var storageDriver StorageDriver
+        var bucket Bucket
+        var scope *KeyScope
+
+        write := func(keys ...string) {
+            updateBatch := NewUpdateBatch()
+
+            for _, key := range keys {
+                updateBatch.Put([]byte(key), []byte("value"), NewDVV(NewDot("", 0), map[string]uint64{ }))
+            }
+
+            _, err := bucket.Batch(updateBatch)
+
+            Expect(err).Should(BeNil())
+        }
+
+        // Reads the whole bucket to find what the scoped tree should be
+        expectedMerkleTree := func() *ScopedMerkleTreeProxy {
+            iter, err := bucket.GetSyncChildren(bucket.MerkleTree().RootNode())
+
+            Expect(err).Should(BeNil())
+
+            return NewScopedMerkleTreeProxy(bucket.MerkleTree().Depth(), iter, scope)
+        }
+
+        expectSameNodeHashes := func(proxy *ScopedMerkleTreeProxy, expected *ScopedMerkleTreeProxy) {
+            Expect(proxy.Error()).Should(BeNil())
+
+            for node := uint32(1); node < proxy.NodeLimit(); node++ {
+                Expect(proxy.NodeHash(node)).Should(Equal(expected.NodeHash(node)))
+            }
+        }
+
+        BeforeEach(func() {
+            storageDriver = NewLevelDBStorageDriver("/tmp/testdb-scope-" + RandomString(), nil)
+            storageDriver.Open()
+            bucket, _ = NewDefaultBucket("nodeA", storageDriver, MerkleMinDepth)
+            scope = NewKeyScope([]string{ "config." })
+
+            for i := 0; i < 50; i++ {
+                write(fmt.Sprintf("config.%d", i), fmt.Sprintf("state.%d", i))
+            }
+        })
+
+        AfterEach(func() {
+            storageDriver.Close()
+        })
+
+        It("should build a tree that only includes the keys in scope", func() {
+            cache := NewScopedMerkleTreeCache()
+
+            expectSameNodeHashes(cache.Get("site1", bucket, scope), expectedMerkleTree())
+        })
+
+        It("should bring a cached tree up to date with the keys written since it was last used", func() {
+            cache := NewScopedMerkleTreeCache()
+            before := cache.Get("site1", bucket, scope)
+            beforeRoot := before.NodeHash(before.RootNode())
+
+            write("config.1", "config.100", "state.1", "state.100")
+
+            updateBatch := NewUpdateBatch()
+            updateBatch.Delete([]byte("config.2"), NewDVV(NewDot("", 0), map[string]uint64{ }))
+            _, err := bucket.Batch(updateBatch)
+
+            Expect(err).Should(BeNil())
+
+            after := cache.Get("site1", bucket, scope)
+
+            expectSameNodeHashes(after, expectedMerkleTree())
+            // Sessions that are still using the old tree keep seeing it as it was
+            Expect(before.NodeHash(before.RootNode())).Should(Equal(beforeRoot))
+            Expect(after.NodeHash(after.RootNode())).Should(Not(Equal(beforeRoot)))
+        })
+
+        It("should drop keys that are forgotten from a cached tree", func() {
+            cache := NewScopedMerkleTreeCache()
+            before := cache.Get("site1", bucket, scope)
+            beforeRoot := before.NodeHash(before.RootNode())
+
+            Expect(bucket.Forget([][]byte{ []byte("config.1") })).Should(BeNil())
+
+            after := cache.Get("site1", bucket, scope)
+
+            expectSameNodeHashes(after, expectedMerkleTree())
+            Expect(after.NodeHash(after.RootNode())).Should(Not(Equal(beforeRoot)))
+        })
+
+        It("should return the same tree when only keys out of scope were written", func() {
+            cache := NewScopedMerkleTreeCache()
+            before := cache.Get("site1", bucket, scope)
+
+            write("state.1", "state.100")
+
+            Expect(cache.Get("site1", bucket, scope)).Should(BeIdenticalTo(before))
+        })
+
+        It("should keep a separate tree for each scope", func() {
+            cache := NewScopedMerkleTreeCache()
+            cache.Get("site1", bucket, scope)
+            otherScope := NewKeyScope([]string{ "state." })
+            proxy := cache.Get("site1", bucket, otherScope)
+
+            scope = otherScope
+
+            expectSameNodeHashes(proxy, expectedMerkleTree())
+        })
+    })
+})
@@ -26,6 +26,7 @@ package sync
 
 import (
     "container/heap"
+    "math/rand"
     "sync"
     "time"
 )
@@ -96,6 +97,16 @@ type SyncScheduler interface {
     Schedule(peerID string)
 }
 
+// Implemented by sync schedulers that sync buckets when they change rather
+// than at a fixed rate. The sync controller reports local writes and merkle
+// root differences it notices through MarkDirty and the outcome of each
+// initiator session through SyncCompleted
+type ChangeAwareSyncScheduler interface {
+    SyncScheduler
+    MarkDirty(peerID string, bucket string)
+    SyncCompleted(peerID string, bucket string, idle bool)
+}
+
 // Sync queue optimized for relays
 // that provides a new sync partner
 // at a fixed rate
@@ -302,4 +313,279 @@ func (syncScheduler *MultiSyncScheduler) Schedule(peerID string) {
     // Schedule the next sync with this peer after syncPeriod duration
     syncScheduler.peers[peerID].nextSyncTime = time.Now().Add(syncScheduler.syncPeriod)
     heap.Push(syncScheduler.heap, syncScheduler.peers[peerID])
-}
\ No newline at end of file
+}
+
+type syncTarget struct {
+    peerID string
+    bucket string
+    interval time.Duration
+    nextSyncTime time.Time
+    dirty bool
+    inFlight bool
+    // position in the heap or -1 if it is not scheduled
+    index int
+}
+
+type syncTargetHeap []*syncTarget
+
+func (h syncTargetHeap) Len() int {
+    return len(h)
+}
+
+func (h syncTargetHeap) Less(i, j int) bool {
+    return h[i].nextSyncTime.Before(h[j].nextSyncTime)
+}
+
+func (h syncTargetHeap) Swap(i, j int) {
+    h[i], h[j] = h[j], h[i]
+    h[i].index = i
+    h[j].index = j
+}
+
+func (h *syncTargetHeap) Push(x interface{}) {
+    target := x.(*syncTarget)
+    target.index = len(*h)
+    *h = append(*h, target)
+}
+
+func (h *syncTargetHeap) Pop() interface{} {
+    old := *h
+    n := len(old)
+    x := old[n - 1]
+    x.index = -1
+    *h = old[0 : n - 1]
+
+    return x
+}
+
+// Schedules each bucket of each peer on its own. A bucket that
+// is marked dirty is synced within one sync period. Each sync
+// session that finds nothing to do doubles the time until the
+// next session for that bucket up to the maximum sync period
+// and any session that finds changes resets it to the minimum.
+// Every delay is randomized by a jitter factor so peers that
+// connect at the same time, such as after an outage, do not
+// keep syncing in lock step.
+type AdaptiveSyncScheduler struct {
+    syncPeriod time.Duration
+    maxSyncPeriod time.Duration
+    jitter float64
+    peers map[string]map[string]*syncTarget
+    heap *syncTargetHeap
+    lastTarget *syncTarget
+    wakeup chan bool
+    random *rand.Rand
+    mu sync.Mutex
+}
+
+func NewAdaptiveSyncScheduler(syncPeriod time.Duration, maxSyncPeriod time.Duration, jitter float64) *AdaptiveSyncScheduler {
+    if maxSyncPeriod < syncPeriod {
+        maxSyncPeriod = syncPeriod
+    }
+
+    if jitter < 0 {
+        jitter = 0
+    } else if jitter > 1 {
+        jitter = 1
+    }
+
+    return &AdaptiveSyncScheduler{
+        syncPeriod: syncPeriod,
+        maxSyncPeriod: maxSyncPeriod,
+        jitter: jitter,
+        peers: make(map[string]map[string]*syncTarget),
+        heap: &syncTargetHeap{ },
+        wakeup: make(chan bool, 1),
+        random: rand.New(rand.NewSource(time.Now().UnixNano())),
+    }
+}
+
+func (syncScheduler *AdaptiveSyncScheduler) AddPeer(peerID string, buckets []string) {
+    syncScheduler.mu.Lock()
+    defer syncScheduler.mu.Unlock()
+
+    if _, ok := syncScheduler.peers[peerID]; ok {
+        return
+    }
+
+    targets := make(map[string]*syncTarget, len(buckets))
+
+    for _, bucket := range buckets {
+        targets[bucket] = &syncTarget{
+            peerID: peerID,
+            bucket: bucket,
+            interval: syncScheduler.syncPeriod,
+            index: -1,
+        }
+    }
+
+    syncScheduler.peers[peerID] = targets
+}
+
+func (syncScheduler *AdaptiveSyncScheduler) RemovePeer(peerID string) {
+    syncScheduler.mu.Lock()
+    defer syncScheduler.mu.Unlock()
+
+    for _, target := range syncScheduler.peers[peerID] {
+        if target.index >= 0 {
+            heap.Remove(syncScheduler.heap, target.index)
+        }
+
+        if syncScheduler.lastTarget == target {
+            syncScheduler.lastTarget = nil
+        }
+    }
+
+    delete(syncScheduler.peers, peerID)
+    syncScheduler.notify()
+}
+
+func (syncScheduler *AdaptiveSyncScheduler) Next() (string, string) {
+    syncScheduler.mu.Lock()
+
+    if syncScheduler.heap.Len() == 0 {
+        syncScheduler.mu.Unlock()
+        syncScheduler.wait(syncScheduler.syncPeriod)
+
+        return "", ""
+    }
+
+    target := (*syncScheduler.heap)[0]
+
+    // Was Next() called again before calling Advance()?
+    if syncScheduler.lastTarget == target {
+        syncScheduler.mu.Unlock()
+
+        <-time.After(syncScheduler.syncPeriod)
+
+        return target.peerID, target.bucket
+    }
+
+    if wait := target.nextSyncTime.Sub(time.Now()); wait > 0 {
+        syncScheduler.mu.Unlock()
+
+        // Another bucket may become due sooner while waiting so
+        // return nothing and let the caller try again
+        syncScheduler.wait(wait)
+
+        return "", ""
+    }
+
+    syncScheduler.lastTarget = target
+    syncScheduler.mu.Unlock()
+
+    return target.peerID, target.bucket
+}
+
+func (syncScheduler *AdaptiveSyncScheduler) Advance() {
+    syncScheduler.mu.Lock()
+    defer syncScheduler.mu.Unlock()
+
+    target := syncScheduler.lastTarget
+
+    if target == nil {
+        return
+    }
+
+    if target.index >= 0 {
+        heap.Remove(syncScheduler.heap, target.index)
+    }
+
+    // Writes that happen once the session has started mark
+    // the bucket dirty again
+    target.dirty = false
+    target.inFlight = true
+    syncScheduler.lastTarget = nil
+}
+
+func (syncScheduler *AdaptiveSyncScheduler) Schedule(peerID string) {
+    syncScheduler.mu.Lock()
+    defer syncScheduler.mu.Unlock()
+
+    for _, target := range syncScheduler.peers[peerID] {
+        if target.index >= 0 || target.inFlight {
+            continue
+        }
+
+        target.nextSyncTime = time.Now().Add(syncScheduler.delay(target))
+        heap.Push(syncScheduler.heap, target)
+    }
+
+    syncScheduler.notify()
+}
+
+func (syncScheduler *AdaptiveSyncScheduler) MarkDirty(peerID string, bucket string) {
+    syncScheduler.mu.Lock()
+    defer syncScheduler.mu.Unlock()
+
+    target, ok := syncScheduler.peers[peerID][bucket]
+
+    if !ok || target.dirty {
+        return
+    }
+
+    target.dirty = true
+    target.interval = syncScheduler.syncPeriod
+
+    if target.index < 0 {
+        return
+    }
+
+    if nextSyncTime := time.Now().Add(syncScheduler.delay(target)); nextSyncTime.Before(target.nextSyncTime) {
+        target.nextSyncTime = nextSyncTime
+        heap.Fix(syncScheduler.heap, target.index)
+        syncScheduler.notify()
+    }
+}
+
+func (syncScheduler *AdaptiveSyncScheduler) SyncCompleted(peerID string, bucket string, idle bool) {
+    syncScheduler.mu.Lock()
+    defer syncScheduler.mu.Unlock()
+
+    target, ok := syncScheduler.peers[peerID][bucket]
+
+    if !ok {
+        return
+    }
+
+    target.inFlight = false
+
+    if !idle {
+        target.interval = syncScheduler.syncPeriod
+
+        return
+    }
+
+    target.interval *= 2
+
+    if target.interval > syncScheduler.maxSyncPeriod {
+        target.interval = syncScheduler.maxSyncPeriod
+    }
+}
+
+// Dirty buckets are synced at a random point within the next sync period.
+// Otherwise the interval for the bucket is scaled by a random factor
+// between 1 - jitter and 1 + jitter
+func (syncScheduler *AdaptiveSyncScheduler) delay(target *syncTarget) time.Duration {
+    if target.dirty {
+        return time.Duration(syncScheduler.random.Int63n(int64(syncScheduler.syncPeriod) + 1))
+    }
+
+    scale := 1 + syncScheduler.jitter * (2 * syncScheduler.random.Float64() - 1)
+
+    return time.Duration(float64(target.interval) * scale)
+}
+
+func (syncScheduler *AdaptiveSyncScheduler) notify() {
+    select {
+    case syncScheduler.wakeup <- true:
+    default:
+    }
+}
+
+func (syncScheduler *AdaptiveSyncScheduler) wait(d time.Duration) {
+    select {
+    case <-syncScheduler.wakeup:
+    case <-time.After(d):
+    }
+}
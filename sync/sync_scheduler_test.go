@@ -532,4 +532,153 @@ var _ = Describe("SyncScheduler", func() {
             }
         })
     })
+
+    Describe("AdaptiveSyncScheduler", func() {
+        var syncPeriod time.Duration
+        var syncScheduler *AdaptiveSyncScheduler
+
+        // Calls Next() until it returns a peer and how long that took
+        nextSync := func(syncScheduler *AdaptiveSyncScheduler) (string, string, time.Duration) {
+            startTime := time.Now()
+
+            for time.Since(startTime) < time.Second * 2 {
+                peer, bucket := syncScheduler.Next()
+
+                if peer != "" {
+                    return peer, bucket, time.Since(startTime)
+                }
+            }
+
+            return "", "", time.Since(startTime)
+        }
+
+        // Runs the next sync session with the given outcome and returns the delay before the one after it
+        completeSync := func(syncScheduler *AdaptiveSyncScheduler, idle bool) time.Duration {
+            peer, bucket, _ := nextSync(syncScheduler)
+            syncScheduler.Advance()
+            syncScheduler.SyncCompleted(peer, bucket, idle)
+            syncScheduler.Schedule(peer)
+            _, _, delay := nextSync(syncScheduler)
+
+            return delay
+        }
+
+        BeforeEach(func() {
+            syncPeriod = time.Millisecond * 20
+        })
+
+        It("Should schedule every bucket of a peer on its own", func() {
+            syncScheduler = NewAdaptiveSyncScheduler(syncPeriod, syncPeriod * 4, 0)
+            syncScheduler.AddPeer("peer1", []string{ "default", "lww" })
+            syncScheduler.Schedule("peer1")
+
+            buckets := map[string]bool{ }
+
+            for i := 0; i < 2; i++ {
+                peer, bucket, delay := nextSync(syncScheduler)
+
+                Expect(peer).Should(Equal("peer1"))
+                Expect(delay).Should(BeNumerically("<", syncPeriod * 2))
+                buckets[bucket] = true
+                syncScheduler.Advance()
+            }
+
+            Expect(buckets).Should(Equal(map[string]bool{ "default": true, "lww": true }))
+        })
+
+        It("Should back off exponentially up to the max sync period while sync sessions are idle", func() {
+            syncScheduler = NewAdaptiveSyncScheduler(syncPeriod, syncPeriod * 4, 0)
+            syncScheduler.AddPeer("peer1", []string{ "default" })
+            syncScheduler.Schedule("peer1")
+
+            Expect(completeSync(syncScheduler, true)).Should(BeNumerically("~", syncPeriod * 2, syncPeriod / 2))
+            Expect(completeSync(syncScheduler, true)).Should(BeNumerically("~", syncPeriod * 4, syncPeriod / 2))
+            Expect(completeSync(syncScheduler, true)).Should(BeNumerically("~", syncPeriod * 4, syncPeriod / 2))
+        })
+
+        It("Should go back to the sync period after a sync session that found changes", func() {
+            syncScheduler = NewAdaptiveSyncScheduler(syncPeriod, syncPeriod * 4, 0)
+            syncScheduler.AddPeer("peer1", []string{ "default" })
+            syncScheduler.Schedule("peer1")
+
+            Expect(completeSync(syncScheduler, true)).Should(BeNumerically("~", syncPeriod * 2, syncPeriod / 2))
+            Expect(completeSync(syncScheduler, false)).Should(BeNumerically("~", syncPeriod, syncPeriod / 2))
+        })
+
+        It("Should sync a dirty bucket within one sync period even if it had backed off", func() {
+            syncScheduler = NewAdaptiveSyncScheduler(syncPeriod, time.Minute, 0)
+            syncScheduler.AddPeer("peer1", []string{ "default", "lww" })
+            syncScheduler.Schedule("peer1")
+
+            for i := 0; i < 2; i++ {
+                peer, bucket, _ := nextSync(syncScheduler)
+                syncScheduler.Advance()
+                syncScheduler.SyncCompleted(peer, bucket, true)
+            }
+
+            syncScheduler.Schedule("peer1")
+            syncScheduler.MarkDirty("peer1", "lww")
+
+            peer, bucket, delay := nextSync(syncScheduler)
+
+            Expect(peer).Should(Equal("peer1"))
+            Expect(bucket).Should(Equal("lww"))
+            Expect(delay).Should(BeNumerically("<=", syncPeriod + syncPeriod / 2))
+        })
+
+        It("Should ignore buckets and peers it doesn't know about", func() {
+            syncScheduler = NewAdaptiveSyncScheduler(syncPeriod, syncPeriod * 4, 0)
+            syncScheduler.AddPeer("peer1", []string{ "default" })
+            syncScheduler.MarkDirty("peer1", "cloud")
+            syncScheduler.MarkDirty("peer2", "default")
+            syncScheduler.SyncCompleted("peer2", "default", true)
+            syncScheduler.Schedule("peer2")
+
+            peer, _ := syncScheduler.Next()
+
+            Expect(peer).Should(BeEmpty())
+        })
+
+        It("Should stop scheduling a peer once it is removed", func() {
+            syncScheduler = NewAdaptiveSyncScheduler(syncPeriod, syncPeriod * 4, 0)
+            syncScheduler.AddPeer("peer1", []string{ "default", "lww" })
+            syncScheduler.Schedule("peer1")
+            syncScheduler.RemovePeer("peer1")
+
+            startTime := time.Now()
+
+            for time.Since(startTime) < syncPeriod * 3 {
+                peer, _ := syncScheduler.Next()
+
+                Expect(peer).Should(BeEmpty())
+            }
+        })
+
+        It("Should spread out the first sync sessions of peers that are added at the same time", func() {
+            syncScheduler = NewAdaptiveSyncScheduler(time.Millisecond * 100, time.Second, 0.5)
+
+            for i := 0; i < 50; i++ {
+                syncScheduler.AddPeer(fmt.Sprintf("peer-%d", i), []string{ "default" })
+                syncScheduler.Schedule(fmt.Sprintf("peer-%d", i))
+            }
+
+            startTime := time.Now()
+            var first, last time.Duration
+
+            for i := 0; i < 50; i++ {
+                _, _, _ = nextSync(syncScheduler)
+                syncScheduler.Advance()
+
+                if i == 0 {
+                    first = time.Since(startTime)
+                }
+
+                last = time.Since(startTime)
+            }
+
+            Expect(first).Should(BeNumerically(">=", time.Millisecond * 40))
+            Expect(last).Should(BeNumerically("<=", time.Millisecond * 170))
+            Expect(last - first).Should(BeNumerically(">", time.Millisecond * 40))
+        })
+    })
 })
@@ -244,10 +244,22 @@ func (bucket *MockBucket) RebuildMerkleLeafs() error {
     return nil
 }
 
+func (bucket *MockBucket) Redepth(depth uint8) error {
+    return nil
+}
+
 func (bucket *MockBucket) MerkleTree() *MerkleTree {
     return nil
 }
 
+func (bucket *MockBucket) KeyCount() uint64 {
+    return 0
+}
+
+func (bucket *MockBucket) MerkleRootChanges() uint64 {
+    return 0
+}
+
 func (bucket *MockBucket) GarbageCollect(tombstonePurgeAge uint64) error {
     return nil
 }
@@ -264,6 +276,22 @@ func (bucket *MockBucket) Watch(ctx context.Context, keys [][]byte, prefixes [][
 
 }
 
+func (bucket *MockBucket) ChangeLogID() string {
+    return ""
+}
+
+func (bucket *MockBucket) ChangeLogPosition() uint64 {
+    return 0
+}
+
+func (bucket *MockBucket) ChangeLogHorizon() uint64 {
+    return 0
+}
+
+func (bucket *MockBucket) ChangesSince(position uint64) (SiblingSetIterator, uint64, error) {
+    return nil, 0, nil
+}
+
 func (bucket *MockBucket) LockReads() {
 }
 
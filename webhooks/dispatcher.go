@@ -0,0 +1,724 @@
+package webhooks
+//
+ // Copyright (c) 2019 ARM Limited.
+ //
+ // SPDX-License-Identifier: MIT
+ //
+ // Permission is hereby granted, free of charge, to any person obtaining a copy
+ // of this software and associated documentation files (the "Software"), to
+ // deal in the Software without restriction, including without limitation the
+ // rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ // sell copies of the Software, and to permit persons to whom the Software is
+ // furnished to do so, subject to the following conditions:
+ //
+ // The above copyright notice and this permission notice shall be included in all
+ // copies or substantial portions of the Software.
+ //
+ // THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ // IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ // FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ // AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ // LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ // SOFTWARE.
+ //
+
+
+import (
+    "bytes"
+    "context"
+    "encoding/base64"
+    "encoding/binary"
+    "encoding/json"
+    "fmt"
+    "github.com/prometheus/client_golang/prometheus"
+    "io"
+    "io/ioutil"
+    "net/http"
+    "strings"
+    "sync"
+    "time"
+
+    . "github.com/armPelionEdge/devicedb/bucket"
+    . "github.com/armPelionEdge/devicedb/cluster"
+    . "github.com/armPelionEdge/devicedb/data"
+    . "github.com/armPelionEdge/devicedb/error"
+    . "github.com/armPelionEdge/devicedb/logging"
+    . "github.com/armPelionEdge/devicedb/storage"
+    . "github.com/armPelionEdge/devicedb/transport"
+)
+
+var (
+    CURSORS_PREFIX = []byte{ 0 }
+    DEAD_LETTERS_PREFIX = []byte{ 1 }
+)
+
+const (
+    DefaultPollInterval = time.Second
+    DefaultMaxAttempts = 8
+    DefaultRetryMin = time.Second
+    DefaultRetryMax = time.Minute
+    DefaultTimeout = time.Second * 10
+    DefaultMaxDeadLetters = 1000
+    // The most changes read from a change log before the cursor is saved
+    // and the log is read again
+    DeliveryBatchSize = 100
+)
+
+var (
+    prometheusWebhookDeliveries = prometheus.NewCounterVec(prometheus.CounterOpts{
+        Namespace: "sites",
+        Subsystem: "devicedb",
+        Name: "webhook_deliveries",
+        Help: "The number of webhook delivery attempts by result",
+    }, []string{
+        "webhook",
+        "result",
+    })
+)
+
+func init() {
+    prometheus.MustRegister(prometheusWebhookDeliveries)
+}
+
+type DispatcherConfig struct {
+    // Stores delivery cursors and dead letters
+    StorageDriver StorageDriver
+    // How often a bucket change log is checked for new updates
+    PollInterval time.Duration
+    // The number of times delivery of a payload is attempted before it
+    // is moved to the dead letter list
+    MaxAttempts int
+    // The delay before the first retry. It doubles after every failed
+    // attempt up to RetryMax
+    RetryMin time.Duration
+    RetryMax time.Duration
+    // The timeout of a single delivery request
+    Timeout time.Duration
+    // The most dead letters kept per webhook. The oldest ones are
+    // dropped first
+    MaxDeadLetters int
+    HTTPClient *http.Client
+}
+
+// A Subscription asks the dispatcher to deliver the updates made to
+// a bucket of one site to a webhook
+type Subscription struct {
+    WebhookID string
+    Webhook Webhook
+    SiteID string
+    Bucket Bucket
+}
+
+type subscriptionKey struct {
+    webhookID string
+    siteID string
+}
+
+type cursor struct {
+    ChangeLogID string `json:"changeLogID"`
+    Position uint64 `json:"position"`
+}
+
+// The Dispatcher delivers updates to webhooks. Every subscription is
+// served by its own goroutine which reads the bucket change log from a
+// cursor persisted in storage so updates made while a node was down are
+// still delivered. A subscription without a cursor starts from the
+// change log horizon, so it first delivers the latest update of every
+// key in the bucket. That way a node that takes over a partition from
+// another owner doesn't skip updates the other owner never delivered.
+// Delivery is at least once: receivers should use the delivery header to
+// discard duplicates. Deliveries made by different owners of a partition
+// have different delivery IDs so receivers that need exactly once should
+// also compare the siblings of a key
+type Dispatcher struct {
+    config DispatcherConfig
+    lock sync.Mutex
+    deliverers map[subscriptionKey]*deliverer
+    // Guards metrics, storage and lastDeadLetter separately from the
+    // deliverers so deliverers can be stopped while holding lock
+    metricsLock sync.Mutex
+    metrics map[string]*Metrics
+    lastDeadLetter uint64
+}
+
+func NewDispatcher(config DispatcherConfig) *Dispatcher {
+    if config.PollInterval <= 0 {
+        config.PollInterval = DefaultPollInterval
+    }
+
+    if config.MaxAttempts <= 0 {
+        config.MaxAttempts = DefaultMaxAttempts
+    }
+
+    if config.RetryMin <= 0 {
+        config.RetryMin = DefaultRetryMin
+    }
+
+    if config.RetryMax < config.RetryMin {
+        config.RetryMax = DefaultRetryMax
+
+        if config.RetryMax < config.RetryMin {
+            config.RetryMax = config.RetryMin
+        }
+    }
+
+    if config.Timeout <= 0 {
+        config.Timeout = DefaultTimeout
+    }
+
+    if config.MaxDeadLetters <= 0 {
+        config.MaxDeadLetters = DefaultMaxDeadLetters
+    }
+
+    if config.HTTPClient == nil {
+        config.HTTPClient = &http.Client{ }
+    }
+
+    return &Dispatcher{
+        config: config,
+        deliverers: make(map[subscriptionKey]*deliverer),
+        metrics: make(map[string]*Metrics),
+    }
+}
+
+// Reconcile starts delivering to every subscription in the list that is
+// not already being served and stops delivering to any subscription
+// missing from it. A subscription whose webhook or bucket changed is
+// restarted
+func (dispatcher *Dispatcher) Reconcile(subscriptions []Subscription) {
+    dispatcher.lock.Lock()
+    defer dispatcher.lock.Unlock()
+
+    wanted := make(map[subscriptionKey]Subscription, len(subscriptions))
+
+    for _, subscription := range subscriptions {
+        wanted[subscriptionKey{ subscription.WebhookID, subscription.SiteID }] = subscription
+    }
+
+    for key, deliverer := range dispatcher.deliverers {
+        subscription, ok := wanted[key]
+
+        if ok && subscription.Webhook == deliverer.subscription.Webhook && subscription.Bucket == deliverer.subscription.Bucket {
+            continue
+        }
+
+        deliverer.stop()
+        delete(dispatcher.deliverers, key)
+    }
+
+    for key, subscription := range wanted {
+        if _, ok := dispatcher.deliverers[key]; ok {
+            continue
+        }
+
+        deliverer := newDeliverer(dispatcher, subscription)
+        dispatcher.deliverers[key] = deliverer
+
+        go deliverer.run()
+    }
+}
+
+// Stop stops delivering to all subscriptions
+func (dispatcher *Dispatcher) Stop() {
+    dispatcher.Reconcile(nil)
+}
+
+// Status returns the delivery metrics and dead letters of a webhook as
+// seen by this node
+func (dispatcher *Dispatcher) Status(webhookID string) (Status, error) {
+    dispatcher.metricsLock.Lock()
+    defer dispatcher.metricsLock.Unlock()
+
+    var status Status
+
+    if metrics, ok := dispatcher.metrics[webhookID]; ok {
+        status.Metrics = *metrics
+    }
+
+    deadLetters, err := dispatcher.deadLetters(webhookID)
+
+    if err != nil {
+        return Status{}, err
+    }
+
+    status.DeadLetters = deadLetters
+
+    return status, nil
+}
+
+// Forget discards the cursors, metrics and dead letters of a webhook
+// that was removed. Any subscription to it must be stopped first
+func (dispatcher *Dispatcher) Forget(webhookID string) error {
+    dispatcher.metricsLock.Lock()
+    defer dispatcher.metricsLock.Unlock()
+
+    delete(dispatcher.metrics, webhookID)
+
+    iter, err := dispatcher.config.StorageDriver.GetMatches([][]byte{ cursorPrefix(webhookID), deadLetterPrefix(webhookID) })
+
+    if err != nil {
+        Log.Errorf("Storage driver error in Forget(%s): %v", webhookID, err.Error())
+
+        return EStorage
+    }
+
+    defer iter.Release()
+
+    batch := NewBatch()
+
+    for iter.Next() {
+        batch.Delete(append([]byte{ }, iter.Key()...))
+    }
+
+    if iter.Error() != nil {
+        Log.Errorf("Storage driver error in Forget(%s): %v", webhookID, iter.Error().Error())
+
+        return EStorage
+    }
+
+    if err := dispatcher.config.StorageDriver.Batch(batch); err != nil {
+        Log.Errorf("Storage driver error in Forget(%s): %v", webhookID, err.Error())
+
+        return EStorage
+    }
+
+    return nil
+}
+
+func (dispatcher *Dispatcher) cursor(webhookID string, siteID string) (cursor, bool, error) {
+    values, err := dispatcher.config.StorageDriver.Get([][]byte{ cursorKey(webhookID, siteID) })
+
+    if err != nil {
+        Log.Errorf("Storage driver error in cursor(%s, %s): %v", webhookID, siteID, err.Error())
+
+        return cursor{}, false, EStorage
+    }
+
+    if values[0] == nil {
+        return cursor{}, false, nil
+    }
+
+    var c cursor
+
+    if err := json.Unmarshal(values[0], &c); err != nil {
+        Log.Errorf("Unable to decode webhook cursor for webhook %s at site %s: %v", webhookID, siteID, err.Error())
+
+        return cursor{}, false, EStorage
+    }
+
+    return c, true, nil
+}
+
+func (dispatcher *Dispatcher) saveCursor(webhookID string, siteID string, c cursor) error {
+    encoded, _ := json.Marshal(c)
+
+    if err := dispatcher.config.StorageDriver.Batch(NewBatch().Put(cursorKey(webhookID, siteID), encoded)); err != nil {
+        Log.Errorf("Storage driver error in saveCursor(%s, %s): %v", webhookID, siteID, err.Error())
+
+        return EStorage
+    }
+
+    return nil
+}
+
+func (dispatcher *Dispatcher) recordDelivery(webhookID string) {
+    dispatcher.metricsLock.Lock()
+    defer dispatcher.metricsLock.Unlock()
+
+    metrics := dispatcher.webhookMetrics(webhookID)
+    metrics.Delivered++
+    metrics.LastDelivery = timestamp()
+
+    prometheusWebhookDeliveries.WithLabelValues(webhookID, "delivered").Inc()
+}
+
+func (dispatcher *Dispatcher) recordFailure(webhookID string, err error) {
+    dispatcher.metricsLock.Lock()
+    defer dispatcher.metricsLock.Unlock()
+
+    metrics := dispatcher.webhookMetrics(webhookID)
+    metrics.Failed++
+    metrics.LastError = err.Error()
+
+    prometheusWebhookDeliveries.WithLabelValues(webhookID, "failed").Inc()
+}
+
+func (dispatcher *Dispatcher) recordDeadLetter(webhookID string, deadLetter DeadLetter) error {
+    dispatcher.metricsLock.Lock()
+    defer dispatcher.metricsLock.Unlock()
+
+    dispatcher.webhookMetrics(webhookID).DeadLettered++
+
+    prometheusWebhookDeliveries.WithLabelValues(webhookID, "dead_lettered").Inc()
+
+    // Keys sort in the order dead letters were added so the oldest
+    // ones come first when the list is trimmed
+    sequence := uint64(time.Now().UnixNano())
+
+    if sequence <= dispatcher.lastDeadLetter {
+        sequence = dispatcher.lastDeadLetter + 1
+    }
+
+    dispatcher.lastDeadLetter = sequence
+
+    encoded, _ := json.Marshal(deadLetter)
+    key := make([]byte, len(deadLetterPrefix(webhookID)) + 8)
+    copy(key, deadLetterPrefix(webhookID))
+    binary.BigEndian.PutUint64(key[len(key) - 8:], sequence)
+
+    if err := dispatcher.config.StorageDriver.Batch(NewBatch().Put(key, encoded)); err != nil {
+        Log.Errorf("Storage driver error in recordDeadLetter(%s): %v", webhookID, err.Error())
+
+        return EStorage
+    }
+
+    iter, err := dispatcher.config.StorageDriver.GetMatches([][]byte{ deadLetterPrefix(webhookID) })
+
+    if err != nil {
+        Log.Errorf("Storage driver error in recordDeadLetter(%s): %v", webhookID, err.Error())
+
+        return EStorage
+    }
+
+    defer iter.Release()
+
+    var keys [][]byte
+
+    for iter.Next() {
+        keys = append(keys, append([]byte{ }, iter.Key()...))
+    }
+
+    if iter.Error() != nil {
+        Log.Errorf("Storage driver error in recordDeadLetter(%s): %v", webhookID, iter.Error().Error())
+
+        return EStorage
+    }
+
+    if len(keys) <= dispatcher.config.MaxDeadLetters {
+        return nil
+    }
+
+    batch := NewBatch()
+
+    for _, key := range keys[:len(keys) - dispatcher.config.MaxDeadLetters] {
+        batch.Delete(key)
+    }
+
+    if err := dispatcher.config.StorageDriver.Batch(batch); err != nil {
+        Log.Errorf("Storage driver error in recordDeadLetter(%s): %v", webhookID, err.Error())
+
+        return EStorage
+    }
+
+    return nil
+}
+
+func (dispatcher *Dispatcher) deadLetters(webhookID string) ([]DeadLetter, error) {
+    iter, err := dispatcher.config.StorageDriver.GetMatches([][]byte{ deadLetterPrefix(webhookID) })
+
+    if err != nil {
+        Log.Errorf("Storage driver error in deadLetters(%s): %v", webhookID, err.Error())
+
+        return nil, EStorage
+    }
+
+    defer iter.Release()
+
+    deadLetters := make([]DeadLetter, 0)
+
+    for iter.Next() {
+        var deadLetter DeadLetter
+
+        if err := json.Unmarshal(iter.Value(), &deadLetter); err != nil {
+            Log.Errorf("Unable to decode dead letter for webhook %s: %v", webhookID, err.Error())
+
+            return nil, EStorage
+        }
+
+        deadLetters = append(deadLetters, deadLetter)
+    }
+
+    if iter.Error() != nil {
+        Log.Errorf("Storage driver error in deadLetters(%s): %v", webhookID, iter.Error().Error())
+
+        return nil, EStorage
+    }
+
+    return deadLetters, nil
+}
+
+func (dispatcher *Dispatcher) webhookMetrics(webhookID string) *Metrics {
+    metrics, ok := dispatcher.metrics[webhookID]
+
+    if !ok {
+        metrics = &Metrics{ }
+        dispatcher.metrics[webhookID] = metrics
+    }
+
+    return metrics
+}
+
+func (dispatcher *Dispatcher) post(ctx context.Context, webhookID string, webhook Webhook, deliveryID string, body []byte) error {
+    request, err := http.NewRequest("POST", webhook.URL, bytes.NewReader(body))
+
+    if err != nil {
+        return err
+    }
+
+    ctx, cancel := context.WithTimeout(ctx, dispatcher.config.Timeout)
+    defer cancel()
+
+    request.Header.Set("Content-Type", "application/json")
+    request.Header.Set(SIGNATURE_HEADER, Sign(webhook.Secret, body))
+    request.Header.Set(DELIVERY_HEADER, deliveryID)
+    request.Header.Set(WEBHOOK_HEADER, webhookID)
+
+    resp, err := dispatcher.config.HTTPClient.Do(request.WithContext(ctx))
+
+    if err != nil {
+        return err
+    }
+
+    defer resp.Body.Close()
+
+    io.Copy(ioutil.Discard, resp.Body)
+
+    if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+        return fmt.Errorf("Received status code %d", resp.StatusCode)
+    }
+
+    return nil
+}
+
+type deliverer struct {
+    dispatcher *Dispatcher
+    subscription Subscription
+    ctx context.Context
+    cancel func()
+    done chan int
+}
+
+func newDeliverer(dispatcher *Dispatcher, subscription Subscription) *deliverer {
+    ctx, cancel := context.WithCancel(context.Background())
+
+    return &deliverer{
+        dispatcher: dispatcher,
+        subscription: subscription,
+        ctx: ctx,
+        cancel: cancel,
+        done: make(chan int),
+    }
+}
+
+func (deliverer *deliverer) stop() {
+    deliverer.cancel()
+    <-deliverer.done
+}
+
+func (deliverer *deliverer) run() {
+    defer close(deliverer.done)
+
+    for {
+        deliverer.deliverChanges()
+
+        select {
+        case <-deliverer.ctx.Done():
+            return
+        case <-time.After(deliverer.dispatcher.config.PollInterval):
+        }
+    }
+}
+
+// deliverChanges delivers every change made to the bucket since the
+// cursor until the end of the change log or until the deliverer is
+// stopped
+func (deliverer *deliverer) deliverChanges() {
+    webhookID := deliverer.subscription.WebhookID
+    siteID := deliverer.subscription.SiteID
+    bucket := deliverer.subscription.Bucket
+
+    for {
+        c, ok, err := deliverer.dispatcher.cursor(webhookID, siteID)
+
+        if err != nil {
+            return
+        }
+
+        if !ok {
+            // This node has never delivered to the webhook. Another owner
+            // may have been delivering before it so nothing is skipped
+            c = cursor{ ChangeLogID: bucket.ChangeLogID(), Position: bucket.ChangeLogHorizon() }
+
+            if err := deliverer.dispatcher.saveCursor(webhookID, siteID, c); err != nil {
+                return
+            }
+        }
+
+        if c.ChangeLogID != bucket.ChangeLogID() {
+            // The bucket was replaced by a copy from another replica. Its
+            // positions mean nothing here so start over from the oldest
+            // change still in its log
+            Log.Infof("Webhook %s restarting delivery for site %s from the start of the change log of bucket %s", webhookID, siteID, bucket.Name())
+
+            c = cursor{ ChangeLogID: bucket.ChangeLogID(), Position: 0 }
+        }
+
+        if horizon := bucket.ChangeLogHorizon(); c.Position < horizon {
+            c.Position = horizon
+        }
+
+        iter, end, err := bucket.ChangesSince(c.Position)
+
+        if err != nil {
+            if err != EOperationLocked {
+                Log.Warningf("Webhook %s unable to read the change log of bucket %s at site %s: %v", webhookID, bucket.Name(), siteID, err.Error())
+            }
+
+            return
+        }
+
+        delivered := 0
+        more := false
+
+        for iter.Next() {
+            if delivered == DeliveryBatchSize {
+                end = iter.LocalVersion()
+                more = true
+
+                break
+            }
+
+            delivered++
+
+            if !strings.HasPrefix(string(iter.Key()), deliverer.subscription.Webhook.Prefix) {
+                continue
+            }
+
+            if !deliverer.deliver(c.ChangeLogID, &Row{ Key: string(iter.Key()), LocalVersion: iter.LocalVersion(), Siblings: iter.Value() }) {
+                iter.Release()
+
+                return
+            }
+
+            c.Position = iter.LocalVersion() + 1
+
+            if err := deliverer.dispatcher.saveCursor(webhookID, siteID, c); err != nil {
+                iter.Release()
+
+                return
+            }
+        }
+
+        iter.Release()
+
+        if iter.Error() != nil {
+            Log.Warningf("Webhook %s unable to read the change log of bucket %s at site %s: %v", webhookID, bucket.Name(), siteID, iter.Error().Error())
+
+            return
+        }
+
+        if end > c.Position {
+            c.Position = end
+
+            if err := deliverer.dispatcher.saveCursor(webhookID, siteID, c); err != nil {
+                return
+            }
+        }
+
+        if !more {
+            return
+        }
+    }
+}
+
+// deliver sends an update to the webhook, retrying until it is accepted
+// or the attempts run out. It returns false only if the deliverer was
+// stopped first, in which case the update must be delivered again later
+func (deliverer *deliverer) deliver(changeLogID string, row *Row) bool {
+    var transportRow TransportRow
+
+    if err := transportRow.FromRow(row); err != nil {
+        Log.Errorf("Webhook %s unable to encode key %s: %v", deliverer.subscription.WebhookID, row.Key, err.Error())
+
+        return true
+    }
+
+    payload := Payload{
+        WebhookID: deliverer.subscription.WebhookID,
+        SiteID: deliverer.subscription.SiteID,
+        Bucket: deliverer.subscription.Bucket.Name(),
+        Key: transportRow.Key,
+        Serial: transportRow.LocalVersion,
+        Context: transportRow.Context,
+        Siblings: transportRow.Siblings,
+    }
+
+    body, _ := json.Marshal(payload)
+    deliveryID := fmt.Sprintf("%s-%d", changeLogID, row.LocalVersion)
+    delay := deliverer.dispatcher.config.RetryMin
+
+    for attempt := 1; ; attempt++ {
+        err := deliverer.dispatcher.post(deliverer.ctx, payload.WebhookID, deliverer.subscription.Webhook, deliveryID, body)
+
+        if err == nil {
+            deliverer.dispatcher.recordDelivery(payload.WebhookID)
+
+            return true
+        }
+
+        if deliverer.ctx.Err() != nil {
+            return false
+        }
+
+        deliverer.dispatcher.recordFailure(payload.WebhookID, err)
+
+        if attempt >= deliverer.dispatcher.config.MaxAttempts {
+            Log.Warningf("Webhook %s gave up on delivery %s after %d attempts: %v", payload.WebhookID, deliveryID, attempt, err.Error())
+
+            deliverer.dispatcher.recordDeadLetter(payload.WebhookID, DeadLetter{
+                DeliveryID: deliveryID,
+                Payload: payload,
+                Attempts: attempt,
+                Error: err.Error(),
+                Timestamp: timestamp(),
+            })
+
+            return true
+        }
+
+        Log.Warningf("Webhook %s delivery %s failed on attempt %d. Retrying in %v: %v", payload.WebhookID, deliveryID, attempt, delay, err.Error())
+
+        select {
+        case <-deliverer.ctx.Done():
+            return false
+        case <-time.After(delay):
+        }
+
+        delay *= 2
+
+        if delay > deliverer.dispatcher.config.RetryMax {
+            delay = deliverer.dispatcher.config.RetryMax
+        }
+    }
+}
+
+func timestamp() uint64 {
+    return uint64(time.Now().UnixNano()) / 1000000
+}
+
+func encodeID(id string) string {
+    return base64.StdEncoding.EncodeToString([]byte(id))
+}
+
+func cursorPrefix(webhookID string) []byte {
+    return []byte(string(CURSORS_PREFIX) + encodeID(webhookID) + ".")
+}
+
+func cursorKey(webhookID string, siteID string) []byte {
+    return []byte(string(cursorPrefix(webhookID)) + encodeID(siteID))
+}
+
+func deadLetterPrefix(webhookID string) []byte {
+    return []byte(string(DEAD_LETTERS_PREFIX) + encodeID(webhookID) + ".")
+}
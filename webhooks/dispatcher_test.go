@@ -0,0 +1,278 @@
+package webhooks_test
+//
+ // Copyright (c) 2019 ARM Limited.
+ //
+ // SPDX-License-Identifier: MIT
+ //
+ // Permission is hereby granted, free of charge, to any person obtaining a copy
+ // of this software and associated documentation files (the "Software"), to
+ // deal in the Software without restriction, including without limitation the
+ // rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ // sell copies of the Software, and to permit persons to whom the Software is
+ // furnished to do so, subject to the following conditions:
+ //
+ // The above copyright notice and this permission notice shall be included in all
+ // copies or substantial portions of the Software.
+ //
+ // THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ // IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ // FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ // AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ // LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ // SOFTWARE.
+ //
+
+import (
+    "encoding/json"
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "sync"
+    "time"
+
+    . "github.com/armPelionEdge/devicedb/bucket"
+    . "github.com/armPelionEdge/devicedb/bucket/builtin"
+    . "github.com/armPelionEdge/devicedb/cluster"
+    . "github.com/armPelionEdge/devicedb/data"
+    . "github.com/armPelionEdge/devicedb/storage"
+    . "github.com/armPelionEdge/devicedb/util"
+    . "github.com/armPelionEdge/devicedb/webhooks"
+
+    . "github.com/onsi/ginkgo"
+    . "github.com/onsi/gomega"
+)
+
+type receivedRequest struct {
+    payload Payload
+    signature string
+    verified bool
+    deliveryID string
+    webhookID string
+}
+
+var _ = Describe("Dispatcher", func() {
+    var storageEngine StorageDriver
+    var defaultBucket *DefaultBucket
+    var server *httptest.Server
+    var lock sync.Mutex
+    var received []receivedRequest
+    var responseCodes []int
+    var config DispatcherConfig
+    var dispatcher *Dispatcher
+    var webhook Webhook
+
+    BeforeEach(func() {
+        storageEngine = MakeNewStorageDriver()
+        storageEngine.Open()
+        defaultBucket, _ = NewDefaultBucket("cloud-1", NewPrefixedStorageDriver([]byte{ 0 }, storageEngine), 4)
+        received = nil
+        responseCodes = nil
+
+        server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            body, _ := ioutil.ReadAll(r.Body)
+
+            var payload Payload
+
+            json.Unmarshal(body, &payload)
+
+            lock.Lock()
+            defer lock.Unlock()
+
+            received = append(received, receivedRequest{
+                payload: payload,
+                signature: r.Header.Get(SIGNATURE_HEADER),
+                verified: Verify("secret", body, r.Header.Get(SIGNATURE_HEADER)),
+                deliveryID: r.Header.Get(DELIVERY_HEADER),
+                webhookID: r.Header.Get(WEBHOOK_HEADER),
+            })
+
+            // Respond with the queued status codes first, then succeed
+            if len(responseCodes) > 0 {
+                w.WriteHeader(responseCodes[0])
+                responseCodes = responseCodes[1:]
+
+                return
+            }
+
+            w.WriteHeader(http.StatusOK)
+        }))
+
+        webhook = Webhook{ SiteID: "site1", Bucket: "default", Prefix: "sensors/", URL: server.URL, Secret: "secret" }
+        config = DispatcherConfig{
+            StorageDriver: NewPrefixedStorageDriver([]byte{ 1 }, storageEngine),
+            PollInterval: time.Millisecond * 10,
+            MaxAttempts: 3,
+            RetryMin: time.Millisecond * 10,
+            RetryMax: time.Millisecond * 20,
+            Timeout: time.Second,
+        }
+        dispatcher = NewDispatcher(config)
+    })
+
+    AfterEach(func() {
+        dispatcher.Stop()
+        server.Close()
+        storageEngine.Close()
+    })
+
+    put := func(bucket Bucket, key string, value string) {
+        siblingSets, err := bucket.Get([][]byte{ []byte(key) })
+
+        Expect(err).Should(BeNil())
+
+        context := map[string]uint64{ }
+
+        if siblingSets[0] != nil {
+            context = siblingSets[0].Join()
+        }
+
+        updateBatch := NewUpdateBatch()
+        updateBatch.Put([]byte(key), []byte(value), NewDVV(NewDot("", 0), context))
+        _, err = bucket.Batch(updateBatch)
+
+        Expect(err).Should(BeNil())
+    }
+
+    requests := func() []receivedRequest {
+        lock.Lock()
+        defer lock.Unlock()
+
+        return append([]receivedRequest{ }, received...)
+    }
+
+    subscribe := func(dispatcher *Dispatcher) {
+        dispatcher.Reconcile([]Subscription{ Subscription{ WebhookID: "hook1", Webhook: webhook, SiteID: "site1", Bucket: defaultBucket } })
+        // Give the new subscription time to catch up with the change log
+        // before updates are made
+        time.Sleep(time.Millisecond * 100)
+    }
+
+    status := func() Status {
+        status, err := dispatcher.Status("hook1")
+
+        Expect(err).Should(BeNil())
+
+        return status
+    }
+
+    It("Should deliver signed payloads for updates to keys matching the prefix", func() {
+        subscribe(dispatcher)
+
+        put(defaultBucket, "sensors/a", "1")
+        put(defaultBucket, "settings/a", "2")
+        put(defaultBucket, "sensors/b", "3")
+
+        Eventually(requests).Should(HaveLen(2))
+        Consistently(requests, time.Millisecond * 100).Should(HaveLen(2))
+
+        r := requests()
+
+        Expect(r[0].payload.WebhookID).Should(Equal("hook1"))
+        Expect(r[0].payload.SiteID).Should(Equal("site1"))
+        Expect(r[0].payload.Bucket).Should(Equal("default"))
+        Expect(r[0].payload.Key).Should(Equal("sensors/a"))
+        Expect(r[0].payload.Siblings).Should(Equal([]string{ "1" }))
+        Expect(r[0].verified).Should(BeTrue())
+        Expect(r[0].webhookID).Should(Equal("hook1"))
+        Expect(r[1].payload.Key).Should(Equal("sensors/b"))
+        Expect(r[1].payload.Siblings).Should(Equal([]string{ "3" }))
+        Expect(r[1].verified).Should(BeTrue())
+        Expect(r[0].deliveryID).ShouldNot(Equal(r[1].deliveryID))
+        Expect(status().Metrics.Delivered).Should(Equal(uint64(2)))
+    })
+
+    It("Should start from the change log horizon when it has no cursor so updates made before it took over are not lost", func() {
+        put(defaultBucket, "sensors/a", "1")
+        put(defaultBucket, "sensors/a", "2")
+        subscribe(dispatcher)
+        put(defaultBucket, "sensors/b", "3")
+
+        Eventually(requests).Should(HaveLen(2))
+        Consistently(requests, time.Millisecond * 100).Should(HaveLen(2))
+
+        r := requests()
+
+        Expect(r[0].payload.Key).Should(Equal("sensors/a"))
+        Expect(r[0].payload.Siblings).Should(Equal([]string{ "2" }))
+        Expect(r[1].payload.Key).Should(Equal("sensors/b"))
+    })
+
+    It("Should retry failed deliveries with the same delivery ID", func() {
+        lock.Lock()
+        responseCodes = []int{ http.StatusInternalServerError, http.StatusServiceUnavailable }
+        lock.Unlock()
+
+        subscribe(dispatcher)
+        put(defaultBucket, "sensors/a", "1")
+
+        Eventually(requests).Should(HaveLen(3))
+        Eventually(func() uint64 { return status().Metrics.Delivered }).Should(Equal(uint64(1)))
+
+        r := requests()
+
+        Expect(r[1].deliveryID).Should(Equal(r[0].deliveryID))
+        Expect(r[2].deliveryID).Should(Equal(r[0].deliveryID))
+        Expect(status().Metrics.Failed).Should(Equal(uint64(2)))
+        Expect(status().Metrics.LastError).ShouldNot(BeEmpty())
+        Expect(status().DeadLetters).Should(BeEmpty())
+    })
+
+    It("Should move a payload to the dead letter list after the last attempt fails and carry on", func() {
+        lock.Lock()
+        responseCodes = []int{ http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError }
+        lock.Unlock()
+
+        subscribe(dispatcher)
+        put(defaultBucket, "sensors/a", "1")
+        put(defaultBucket, "sensors/b", "2")
+
+        Eventually(requests).Should(HaveLen(4))
+        Eventually(func() uint64 { return status().Metrics.Delivered }).Should(Equal(uint64(1)))
+
+        s := status()
+
+        Expect(s.Metrics.Failed).Should(Equal(uint64(3)))
+        Expect(s.Metrics.DeadLettered).Should(Equal(uint64(1)))
+        Expect(s.DeadLetters).Should(HaveLen(1))
+        Expect(s.DeadLetters[0].Payload.Key).Should(Equal("sensors/a"))
+        Expect(s.DeadLetters[0].Attempts).Should(Equal(3))
+        Expect(s.DeadLetters[0].DeliveryID).Should(Equal(requests()[0].deliveryID))
+        Expect(requests()[3].payload.Key).Should(Equal("sensors/b"))
+    })
+
+    It("Should resume from its cursor after a restart", func() {
+        subscribe(dispatcher)
+        put(defaultBucket, "sensors/a", "1")
+
+        Eventually(requests).Should(HaveLen(1))
+
+        dispatcher.Stop()
+        put(defaultBucket, "sensors/b", "2")
+
+        dispatcher = NewDispatcher(config)
+        subscribe(dispatcher)
+
+        Eventually(requests).Should(HaveLen(2))
+        Consistently(requests, time.Millisecond * 100).Should(HaveLen(2))
+        Expect(requests()[1].payload.Key).Should(Equal("sensors/b"))
+    })
+
+    It("Should stop delivering to a webhook that is no longer subscribed and forget its state", func() {
+        lock.Lock()
+        responseCodes = []int{ http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError }
+        lock.Unlock()
+
+        subscribe(dispatcher)
+        put(defaultBucket, "sensors/a", "1")
+
+        Eventually(func() []DeadLetter { return status().DeadLetters }).Should(HaveLen(1))
+
+        dispatcher.Reconcile(nil)
+        Expect(dispatcher.Forget("hook1")).Should(BeNil())
+        put(defaultBucket, "sensors/b", "2")
+
+        Consistently(requests, time.Millisecond * 100).Should(HaveLen(3))
+        Expect(status()).Should(Equal(Status{ DeadLetters: []DeadLetter{ } }))
+    })
+})
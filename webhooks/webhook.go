@@ -0,0 +1,126 @@
+package webhooks
+//
+ // Copyright (c) 2019 ARM Limited.
+ //
+ // SPDX-License-Identifier: MIT
+ //
+ // Permission is hereby granted, free of charge, to any person obtaining a copy
+ // of this software and associated documentation files (the "Software"), to
+ // deal in the Software without restriction, including without limitation the
+ // rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ // sell copies of the Software, and to permit persons to whom the Software is
+ // furnished to do so, subject to the following conditions:
+ //
+ // The above copyright notice and this permission notice shall be included in all
+ // copies or substantial portions of the Software.
+ //
+ // THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ // IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ // FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ // AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ // LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ // SOFTWARE.
+ //
+
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "strings"
+)
+
+// The request header carrying the signature of a payload. It is the hex
+// encoded HMAC-SHA256 of the request body keyed with the webhook secret,
+// prefixed with "sha256="
+const SIGNATURE_HEADER = "X-DeviceDB-Signature"
+// The request header identifying a delivery. Every attempt to deliver
+// the same update carries the same ID so receivers can discard duplicates
+const DELIVERY_HEADER = "X-DeviceDB-Delivery"
+// The request header naming the webhook a delivery is for
+const WEBHOOK_HEADER = "X-DeviceDB-Webhook"
+
+const signaturePrefix = "sha256="
+
+// The body of a webhook request. It describes the state of a key
+// after an update in the same form as the site bucket keys endpoint.
+// A key that was deleted has no siblings
+type Payload struct {
+    WebhookID string `json:"webhook"`
+    SiteID string `json:"site"`
+    Bucket string `json:"bucket"`
+    Key string `json:"key"`
+    Serial uint64 `json:"serial"`
+    Context string `json:"context"`
+    Siblings []string `json:"siblings"`
+}
+
+// A payload that could not be delivered after every retry
+type DeadLetter struct {
+    DeliveryID string `json:"delivery"`
+    Payload Payload `json:"payload"`
+    Attempts int `json:"attempts"`
+    Error string `json:"error"`
+    Timestamp uint64 `json:"timestamp"`
+}
+
+// Delivery metrics of a webhook since the node started
+type Metrics struct {
+    // Payloads accepted by the endpoint
+    Delivered uint64 `json:"delivered"`
+    // Attempts that failed, including ones that were retried later
+    Failed uint64 `json:"failed"`
+    // Payloads moved to the dead letter list after the last retry failed
+    DeadLettered uint64 `json:"deadLettered"`
+    // When a payload was last accepted by the endpoint, in milliseconds
+    LastDelivery uint64 `json:"lastDelivery"`
+    LastError string `json:"lastError"`
+}
+
+func (metrics *Metrics) Add(other Metrics) {
+    metrics.Delivered += other.Delivered
+    metrics.Failed += other.Failed
+    metrics.DeadLettered += other.DeadLettered
+
+    if other.LastDelivery > metrics.LastDelivery {
+        metrics.LastDelivery = other.LastDelivery
+    }
+
+    if metrics.LastError == "" {
+        metrics.LastError = other.LastError
+    }
+}
+
+// The delivery state of a webhook
+type Status struct {
+    Metrics Metrics `json:"metrics"`
+    DeadLetters []DeadLetter `json:"deadLetters"`
+}
+
+// Sign returns the value of the signature header for a request body
+func Sign(secret string, body []byte) string {
+    mac := hmac.New(sha256.New, []byte(secret))
+    mac.Write(body)
+
+    return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature header of a request body. Receivers
+// should reject requests whose signature does not verify
+func Verify(secret string, body []byte, signature string) bool {
+    if !strings.HasPrefix(signature, signaturePrefix) {
+        return false
+    }
+
+    expected, err := hex.DecodeString(signature[len(signaturePrefix):])
+
+    if err != nil {
+        return false
+    }
+
+    mac := hmac.New(sha256.New, []byte(secret))
+    mac.Write(body)
+
+    return hmac.Equal(mac.Sum(nil), expected)
+}
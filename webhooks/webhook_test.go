@@ -0,0 +1,51 @@
+package webhooks_test
+//
+ // Copyright (c) 2019 ARM Limited.
+ //
+ // SPDX-License-Identifier: MIT
+ //
+ // Permission is hereby granted, free of charge, to any person obtaining a copy
+ // of this software and associated documentation files (the "Software"), to
+ // deal in the Software without restriction, including without limitation the
+ // rights to use, copy, modify, merge, publish, distribute, sublicense, and/or
+ // sell copies of the Software, and to permit persons to whom the Software is
+ // furnished to do so, subject to the following conditions:
+ //
+ // The above copyright notice and this permission notice shall be included in all
+ // copies or substantial portions of the Software.
+ //
+ // THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ // IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ // FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ // AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ // LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ // SOFTWARE.
+ //
+
+import (
+    . "github.com/armPelionEdge/devicedb/webhooks"
+
+    . "github.com/onsi/ginkgo"
+    . "github.com/onsi/gomega"
+)
+
+var _ = Describe("Webhook", func() {
+    Describe("#Verify", func() {
+        It("Should accept a signature made with the same secret over the same body", func() {
+            Expect(Verify("secret", []byte("body"), Sign("secret", []byte("body")))).Should(BeTrue())
+        })
+
+        It("Should reject a signature made with another secret", func() {
+            Expect(Verify("secret", []byte("body"), Sign("other", []byte("body")))).Should(BeFalse())
+        })
+
+        It("Should reject a signature made over another body", func() {
+            Expect(Verify("secret", []byte("body"), Sign("secret", []byte("other")))).Should(BeFalse())
+        })
+
+        It("Should reject a signature without the sha256 prefix", func() {
+            Expect(Verify("secret", []byte("body"), Sign("secret", []byte("body"))[len("sha256="):])).Should(BeFalse())
+        })
+    })
+})